@@ -20,7 +20,7 @@ require (
 	go.dedis.ch/onet/v3 v3.2.5
 	go.dedis.ch/protobuf v1.0.11
 	go.etcd.io/bbolt v1.3.5 // indirect
-	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a // indirect
+	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
 	golang.org/x/lint v0.0.0-20200302205851-738671d3881b // indirect
 	golang.org/x/mobile v0.0.0-20200801112145-973feb4309de
 	golang.org/x/net v0.0.0-20200904194848-62affa334b73 // indirect
@@ -0,0 +1,163 @@
+package client
+
+/*
+Reliable UDP broadcast
+**********************
+With UseUDP, the relay broadcasts each downstream cell in fragments, with Reed-Solomon parity fragments. The client
+rebuilds the cells, and processes them in the order of the rounds. When a cell cannot be rebuilt, because a later round
+arrived or because nothing arrived for a while, the client sends a CLI_REL_DOWNSTREAM_NACK listing the fragments it misses.
+After CLIENT_UDP_MAX_NACKS unanswered requests, it gives up on that round, like the relay does when the round times out.
+The cells are only processed in the message path, as the fragments arrive; the goroutine watching for stalls only sends
+NACKs, and the fragments sent again bring the cells in.
+*/
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// CLIENT_UDP_REPAIR_DELAY is how long the client waits before asking again for the fragments of a cell
+const CLIENT_UDP_REPAIR_DELAY = 100 * time.Millisecond
+
+// CLIENT_UDP_MAX_NACKS is how many times the client asks for the fragments of a cell before giving up on it
+const CLIENT_UDP_MAX_NACKS = 3
+
+// startReceivingFragments prepares to rebuild the cells broadcast from round firstRound on
+func (p *PriFiLibClientInstance) startReceivingFragments(firstRound int32) {
+	p.clientState.udpLock.Lock()
+	defer p.clientState.udpLock.Unlock()
+
+	reassembler := net.NewDownstreamReassembler(firstRound)
+	p.clientState.downstreamReassembler = reassembler
+	p.clientState.downstreamNACKs = make(map[int32]int)
+	p.clientState.downstreamLastNACK = make(map[int32]time.Time)
+	p.clientState.downstreamLastProgress = time.Now()
+	p.clientState.downstreamReceiving = false
+
+	go p.watchDownstreamFragments(reassembler)
+}
+
+/*
+Received_REL_CLI_DOWNSTREAM_FRAGMENT handles REL_CLI_DOWNSTREAM_FRAGMENT messages.
+We store the fragment, ask for the fragments of the cells we cannot rebuild, then process the cells rebuilt.
+*/
+func (p *PriFiLibClientInstance) Received_REL_CLI_DOWNSTREAM_FRAGMENT(msg net.REL_CLI_DOWNSTREAM_FRAGMENT) error {
+	p.clientState.udpLock.Lock()
+	defer p.clientState.udpLock.Unlock()
+
+	r := p.clientState.downstreamReassembler
+	if r == nil {
+		log.Lvl3("Client " + strconv.Itoa(p.clientState.ID) + " : received a fragment but is not listening to the broadcast, discarding.")
+		return nil
+	}
+	if err := r.Add(msg); err != nil {
+		log.Error("Client "+strconv.Itoa(p.clientState.ID)+" : cannot use a fragment of round", msg.RoundID, ", error is", err)
+	}
+	p.clientState.downstreamReceiving = true
+	p.requestMissingFragments(false)
+	return p.processRebuiltCells()
+}
+
+// watchDownstreamFragments periodically asks for the fragments of the next cell, in case it was entirely lost. It only
+// sends NACKs: the cells are processed when the fragments sent again arrive. Until the first fragment, the relay's
+// round timeout moves the rounds on. It stops when the client stops using this reassembler
+func (p *PriFiLibClientInstance) watchDownstreamFragments(reassembler *net.DownstreamReassembler) {
+	for {
+		time.Sleep(CLIENT_UDP_REPAIR_DELAY)
+
+		p.clientState.udpLock.Lock()
+		if p.clientState.downstreamReassembler != reassembler || p.stateMachine.State() == "SHUTDOWN" {
+			p.clientState.udpLock.Unlock()
+			return
+		}
+		if p.clientState.downstreamReceiving && time.Since(p.clientState.downstreamLastProgress) >= CLIENT_UDP_REPAIR_DELAY {
+			p.requestMissingFragments(true)
+		}
+		p.clientState.udpLock.Unlock()
+	}
+}
+
+// requestMissingFragments sends a NACK for the cells we cannot rebuild though a later round arrived and, if stalled,
+// for the next cell; if we already rebuilt it, after giving up on the ones before, the relay sends it again, which
+// brings it to the message path. Gives up on the cells already requested too many times. Must be called with udpLock
+func (p *PriFiLibClientInstance) requestMissingFragments(stalled bool) {
+	r := p.clientState.downstreamReassembler
+	gaps := r.Gaps()
+	rounds := gaps
+	if stalled && (len(gaps) == 0 || gaps[0] != r.NextRound()) {
+		// the relay might simply not have sent this round yet, so this does not count as an unanswered request
+		rounds = append([]int32{r.NextRound()}, gaps...)
+	}
+
+	now := time.Now()
+	for i, roundID := range rounds {
+		isGap := len(rounds) == len(gaps) || i > 0
+		if now.Sub(p.clientState.downstreamLastNACK[roundID]) < CLIENT_UDP_REPAIR_DELAY {
+			continue
+		}
+		if isGap && p.clientState.downstreamNACKs[roundID] >= CLIENT_UDP_MAX_NACKS {
+			continue
+		}
+		toSend := &net.CLI_REL_DOWNSTREAM_NACK{
+			ClientID:  p.clientState.ID,
+			RoundID:   roundID,
+			Fragments: r.Missing(roundID),
+		}
+		p.messageSender.SendToRelayWithLog(toSend, "(round "+strconv.Itoa(int(roundID))+", fragments "+intsToString(toSend.Fragments)+")")
+		if isGap {
+			p.clientState.downstreamNACKs[roundID]++
+		}
+		p.clientState.downstreamLastNACK[roundID] = now
+	}
+
+	// the relay did not answer, it must have closed those rounds
+	for _, roundID := range r.Gaps() {
+		if roundID != r.NextRound() || p.clientState.downstreamNACKs[roundID] < CLIENT_UDP_MAX_NACKS ||
+			now.Sub(p.clientState.downstreamLastNACK[roundID]) < CLIENT_UDP_REPAIR_DELAY {
+			break
+		}
+		log.Lvl2("Client "+strconv.Itoa(p.clientState.ID)+" : giving up on the downstream cell of round", roundID)
+		r.SkipTo(roundID + 1)
+	}
+
+	for roundID := range p.clientState.downstreamNACKs {
+		if roundID < r.NextRound() {
+			delete(p.clientState.downstreamNACKs, roundID)
+			delete(p.clientState.downstreamLastNACK, roundID)
+		}
+	}
+}
+
+// processRebuiltCells processes the cells rebuilt, in order. Must be called with udpLock
+func (p *PriFiLibClientInstance) processRebuiltCells() error {
+	for _, cell := range p.clientState.downstreamReassembler.Deliverable() {
+		p.clientState.downstreamLastProgress = time.Now()
+
+		msg, err := new(net.REL_CLI_DOWNSTREAM_DATA_UDP).FromBytes(cell)
+		if err != nil {
+			log.Error("Client "+strconv.Itoa(p.clientState.ID)+" : cannot decode a downstream cell,", err)
+			continue
+		}
+		if err := p.Received_REL_CLI_UDP_DOWNSTREAM_DATA(msg.(net.REL_CLI_DOWNSTREAM_DATA_UDP)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func intsToString(ints []int) string {
+	if ints == nil {
+		return "all"
+	}
+	s := ""
+	for i, v := range ints {
+		if i > 0 {
+			s += ","
+		}
+		s += strconv.Itoa(v)
+	}
+	return s
+}
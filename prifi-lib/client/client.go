@@ -12,19 +12,22 @@ package client
  * - REL_CLI_TELL_TRUSTEES_PK - the trustee's identities. We react by sending our identity + ephemeral identity
  * - REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG - the shuffle from the trustees. We do some check, if they pass, we can communicate. We send the first round to the relay.
  * - REL_CLI_DOWNSTREAM_DATA - the data from the relay, for one round. We react by finishing the round (sending our data to the relay)
+ * - REL_CLI_EPOCH_START, REL_ALL_EPOCH_SWITCH - the key epoch rotation, see epoch.go
  *
  * local functions :
  *
  * ProcessDownStreamData() <- is called by Received_REL_CLI_DOWNSTREAM_DATA; it handles the raw data received
  * SendUpstreamData() <- it is called at the end of ProcessDownStreamData(). Hence, after getting some data down, we send some data up.
  *
- * TODO : traffic need to be encrypted
+ * With DownstreamEncryptionEnabled, the data for our streams is encrypted to keys we put in our upstream cells (see downstream.go)
+ * With UpstreamCompressionEnabled, we compress the data we send in our slot (see compression.go)
  */
 
 import (
 	"errors"
 	"strconv"
 
+	"github.com/dedis/prifi/prifi-lib/compression"
 	"github.com/dedis/prifi/prifi-lib/config"
 	"github.com/dedis/prifi/prifi-lib/crypto"
 	prifilog "github.com/dedis/prifi/prifi-lib/log"
@@ -38,7 +41,6 @@ import (
 	"github.com/dedis/prifi/prifi-lib/scheduler"
 	"github.com/dedis/prifi/prifi-lib/utils"
 	"github.com/dedis/prifi/utils"
-	"go.dedis.ch/kyber/v3/proof"
 	"math/rand"
 	"time"
 )
@@ -65,9 +67,16 @@ func (p *PriFiLibClientInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PAR
 	payloadSize := msg.IntValueOrElse("PayloadSize", p.clientState.PayloadSize)
 	useUDP := msg.BoolValueOrElse("UseUDP", p.clientState.UseUDP)
 	dcNetType := msg.StringValueOrElse("DCNetType", "not initialized")
+	dcNetPadGenerator := msg.StringValueOrElse("DCNetPadGenerator", dcnet.PAD_GENERATOR_XOF)
 	disruptionProtection := msg.BoolValueOrElse("DisruptionProtectionEnabled", false)
 	equivProtection := msg.BoolValueOrElse("EquivocationProtectionEnabled", false)
 	ForceDisruptionSinceRound3 := msg.BoolValueOrElse("ForceDisruptionSinceRound3", false)
+	downstreamEncryption := msg.BoolValueOrElse("DownstreamEncryptionEnabled", false)
+	upstreamCompression := msg.BoolValueOrElse("UpstreamCompressionEnabled", false)
+	openClosedSlotsMaxLength := msg.IntValueOrElse("OpenClosedSlotsMaxLength", 1)
+	openClosedSlotsScheduler := msg.StringValueOrElse("OpenClosedSlotsScheduler", scheduler.SLOT_SCHEDULER_BITMASK)
+	openClosedSlotsPositions := msg.IntValueOrElse("OpenClosedSlotsPositions", nClients)
+	session := msg.IntValueOrElse("Session", 0)
 	//sanity checks
 	if clientID < -1 {
 		return errors.New("ClientID cannot be negative")
@@ -81,10 +90,11 @@ func (p *PriFiLibClientInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PAR
 	if payloadSize < 1 {
 		return errors.New("PayloadSize cannot be 0")
 	}
-
-	switch dcNetType {
-	case "Verifiable":
-		panic("verifiable not supported yet")
+	if !dcnet.IsValidPadGenerator(dcNetPadGenerator) {
+		return errors.New("unknown DCNetPadGenerator " + dcNetPadGenerator)
+	}
+	if !scheduler.IsValidSlotScheduler(openClosedSlotsScheduler) {
+		return errors.New("unknown OpenClosedSlotsScheduler " + openClosedSlotsScheduler)
 	}
 
 	//set the received parameters
@@ -97,20 +107,38 @@ func (p *PriFiLibClientInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PAR
 	p.clientState.UseUDP = useUDP
 	p.clientState.TrusteePublicKey = make([]kyber.Point, nTrustees)
 	p.clientState.sharedSecrets = make([]kyber.Point, nTrustees)
+	p.clientState.epoch = nil
 	p.clientState.RoundNo = int32(0)
 	p.clientState.BufferedRoundData = make(map[int32]net.REL_CLI_DOWNSTREAM_DATA)
-	p.clientState.MessageHistory = config.CryptoSuite.XOF([]byte("init")) //any non-nil, non-empty, constant array
 	p.clientState.DisruptionProtectionEnabled = disruptionProtection
 	p.clientState.EquivocationProtectionEnabled = equivProtection
+	p.clientState.dcNetType = dcNetType
+	p.clientState.dcNetPadGenerator = dcNetPadGenerator
 	p.clientState.ForceDisruptionSinceRound3 = ForceDisruptionSinceRound3
+	p.clientState.DownstreamEncryptionEnabled = downstreamEncryption
+	p.clientState.downstreamKeys = make(map[string]*downstreamKey)
+	p.clientState.UpstreamCompressionEnabled = upstreamCompression
+	p.clientState.packer = compression.NewPacker()
+	p.clientState.OpenClosedSlotsMaxLength = openClosedSlotsMaxLength
+	p.clientState.OpenClosedSlotsScheduler = openClosedSlotsScheduler
+	p.clientState.OpenClosedSlotsPositions = openClosedSlotsPositions
+	p.clientState.footprintScheduled = false
 	p.clientState.MyLastRound = -10
 	p.clientState.DisruptionWrongBitPosition = -1
-	p.clientState.AllreadyDisrupted = false
+	p.clientState.DisruptionCooldown = 0
+	p.clientState.session = session
+	p.setupDownstreamChain(msg)
 
 	//we know our client number, if needed, parse the pcap for replay
 	if p.clientState.pcapReplay.Enabled {
+		// the fragments must fit in our slots with the protections enabled; cells are never smaller than PayloadSize
+		maxFragmentSize := p.dataCapacity(dcnet.CellLayout{
+			PayloadSize:            payloadSize,
+			DisruptionProtection:   disruptionProtection,
+			EquivocationProtection: equivProtection,
+		})
 		p.clientState.pcapReplay.PCAPFile = p.clientState.pcapReplay.PCAPFolder + "client" + strconv.Itoa(clientID) + ".pcap"
-		packets, err := utils.ParsePCAP(p.clientState.pcapReplay.PCAPFile, p.clientState.PayloadSize, uint16(clientID))
+		packets, err := utils.ParsePCAP(p.clientState.pcapReplay.PCAPFile, maxFragmentSize, uint16(clientID))
 		if err != nil {
 			log.Lvl2("Client", clientID, "Requested PCAP Replay, but could not parse;", err)
 		}
@@ -118,7 +146,7 @@ func (p *PriFiLibClientInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PAR
 
 		if len(packets) == 0 {
 			p.clientState.pcapReplay.PCAPFile = p.clientState.pcapReplay.PCAPFolder + "client" + strconv.Itoa(clientID) + ".pkts"
-			packets, err := utils.ParsePKTS(p.clientState.pcapReplay.PCAPFile, p.clientState.PayloadSize, uint16(clientID))
+			packets, err := utils.ParsePKTS(p.clientState.pcapReplay.PCAPFile, maxFragmentSize, uint16(clientID))
 			if err != nil {
 				log.Lvl2("Client", clientID, "Requested PKTS Replay, but could not parse;", err)
 			}
@@ -185,8 +213,7 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_DOWNSTREAM_DATA(msg net.REL_CL
 /*
 Received_REL_CLI_UDP_DOWNSTREAM_DATA handles REL_CLI_UDP_DOWNSTREAM_DATA messages which are part of PriFi's main loop.
 This is what happens in one round, for this client.
-We receive some downstream data. It should be encrypted, and we should test if this data is for us or not; is so, push it into the SOCKS/VPN chanel.
-For now, we do nothing with the downstream data.
+We receive some downstream data. If it is encrypted, we test if this data is for us or not; is so, push it into the SOCKS/VPN chanel.
 Once we received some data from the relay, we need to reply with a DC-net cell (that will get combined with other client's cell to produce some plaintext).
 If we're lucky (if this is our slot), we are allowed to embed some message (which will be the output produced by the relay). Either we send something from the
 SOCKS/VPN data, or if we're running latency tests, we send a "ping" message to compute the latency. If we have nothing to say, we send 0's.
@@ -202,8 +229,20 @@ latency-test message, test if the resync flag is on (which triggers a re-setup).
 When this function ends, it calls SendUpstreamData() which continues the communication loop.
 */
 func (p *PriFiLibClientInstance) ProcessDownStreamData(msg net.REL_CLI_DOWNSTREAM_DATA) error {
+	// the relay signs the cells, see downstream_chain.go
+	if err := p.verifyDownstreamCell(msg); err != nil {
+		log.Error(err)
+		return err
+	}
+
 	timing.StartMeasure("round-processing")
 
+	// the keys and slots change at the boundary of a key epoch
+	p.switchEpochIfNeeded(msg.RoundID)
+
+	// our cell of this round is bound to the downstream data we received, see dcnet.UpdateReceivedMessageHistory
+	p.clientState.DCNet.UpdateReceivedMessageHistory(msg.Data)
+
 	/*
 	 * HANDLE THE DOWNSTREAM DATA
 	 */
@@ -215,9 +254,13 @@ func (p *PriFiLibClientInstance) ProcessDownStreamData(msg net.REL_CLI_DOWNSTREA
 
 	//if it's just one byte, no data
 	if len(msg.Data) > 1 {
+		data, forUs := msg.Data, true
+		if msg.FlagEncrypted {
+			data, forUs = p.decryptDownstream(msg.Data)
+		}
 		//pass the data to the VPN/SOCKS5 proxy, if enabled
-		if p.clientState.DataOutputEnabled {
-			p.clientState.DataFromDCNet <- msg.Data
+		if forUs && p.clientState.DataOutputEnabled {
+			p.clientState.DataFromDCNet <- data
 		}
 		//test if it is the answer from our ping (for latency test)
 		if p.clientState.LatencyTest.DoLatencyTests && len(msg.Data) > 2 {
@@ -259,15 +302,25 @@ func (p *PriFiLibClientInstance) ProcessDownStreamData(msg net.REL_CLI_DOWNSTREA
 		log.Lvl3("Client", p.clientState.ID, "Relay wants to open/closed schedule slots ")
 
 		//do the schedule
-		bmc := new(scheduler.BitMaskSlotScheduler_Client)
-		bmc.Client_ReceivedScheduleRequest(p.clientState.nClients)
+		sched, err := scheduler.NewSlotSchedulerClient(p.clientState.OpenClosedSlotsScheduler, p.clientState.OpenClosedSlotsMaxLength)
+		if err != nil {
+			log.Fatal("Client", p.clientState.ID, err)
+		}
+		sched.Client_ReceivedScheduleRequest(p.clientState.OpenClosedSlotsPositions)
 
 		//check if we want to transmit
 		if p.WantsToTransmit() {
-			bmc.Client_ReserveRound(p.clientState.MySlot)
-			log.Lvl3("Client ", p.clientState.ID, "Gonna reserve slot", p.clientState.MySlot, "(we are in round", msg.RoundID, ")")
+			nRounds := p.roundsToReserve()
+			sched.Client_ReserveRounds(p.clientState.MySlot, nRounds)
+			log.Lvl3("Client ", p.clientState.ID, "Gonna reserve slot", sched.Client_MyOwnerID(), "for", nRounds, "rounds (we are in round", msg.RoundID, ")")
+		}
+		contribution := sched.Client_GetOpenScheduleContribution()
+
+		//with footprints, the relay announces our position instead of our slot
+		if p.clientState.OpenClosedSlotsScheduler == scheduler.SLOT_SCHEDULER_FOOTPRINT {
+			p.clientState.footprintScheduled = true
+			p.clientState.footprintOwnerID = sched.Client_MyOwnerID()
 		}
-		contribution := bmc.Client_GetOpenScheduleContribution()
 
 		//produce the next upstream cell
 
@@ -306,6 +359,28 @@ func (p *PriFiLibClientInstance) ProcessDownStreamData(msg net.REL_CLI_DOWNSTREA
 	return nil
 }
 
+// myOwnerID returns the owner ID the relay announces in our rounds: our slot, or our position in the last footprint
+// schedule
+func (p *PriFiLibClientInstance) myOwnerID() int {
+	if p.clientState.footprintScheduled {
+		return p.clientState.footprintOwnerID
+	}
+	return p.clientState.MySlot
+}
+
+// roundsToReserve returns how many consecutive rounds we reserve for our slot when we want to transmit: one per
+// message waiting (the scheduler caps it to OpenClosedSlotsMaxLength)
+func (p *PriFiLibClientInstance) roundsToReserve() int {
+	n := len(p.clientState.DataForDCNet) + len(p.clientState.LatencyTest.LatencyTestsToSend)
+	if p.clientState.NextDataForDCNet != nil {
+		n++
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
 // WantsToTransmit returns true if [we have a latency message to send] OR [we have data to send]
 func (p *PriFiLibClientInstance) WantsToTransmit() bool {
 
@@ -353,6 +428,19 @@ func (p *PriFiLibClientInstance) WantsToTransmit() bool {
 	}
 }
 
+// dataCapacity returns how much data we can send in our slot with this layout, once we add the key of the downstream
+// encryption and the flag of the compression
+func (p *PriFiLibClientInstance) dataCapacity(layout dcnet.CellLayout) int {
+	capacity := layout.DataSize()
+	if p.clientState.DownstreamEncryptionEnabled {
+		capacity -= crypto.DOWNSTREAM_KEY_SIZE
+	}
+	if p.clientState.UpstreamCompressionEnabled {
+		capacity -= compression.FLAG_SIZE
+	}
+	return capacity
+}
+
 /*
 SendUpstreamData determines if it's our round, embeds data (maybe latency-test message) in the payload if we can,
 creates the DC-net cipher and sends it to the relay.
@@ -363,34 +451,34 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 
 	//if we can send data
 	slotOwner := false
-	if ownerSlotID == p.clientState.MySlot {
+	if ownerSlotID != -1 && ownerSlotID == p.myOwnerID() {
 		slotOwner = true
 		p.clientState.MyLastRound = p.clientState.RoundNo
 	}
 
-	//how much data we can send
-	actualPayloadSize := p.clientState.PayloadSize
-	if p.clientState.DisruptionProtectionEnabled {
-		// Making room for the b_echo_last flag
-		actualPayloadSize--
-		if actualPayloadSize <= 0 {
-			log.Fatal("Client", p.clientState.ID, "Cannot have disruption protection with less than 1 bytes payload")
-		}
-	}
-	if p.clientState.EquivocationProtectionEnabled && slotOwner {
-		actualPayloadSize -= 16
-		if actualPayloadSize <= 0 {
-			log.Fatal("Client", p.clientState.ID, "Cannot have equivocation protection with less than 16 bytes payload")
-		}
+	//how much data we can send; the relay can change the size with each key epoch
+	layout := p.clientState.DCNet.CellLayoutOfRound(p.clientState.RoundNo)
+	actualPayloadSize := p.dataCapacity(layout)
+	if slotOwner && actualPayloadSize <= 0 {
+		log.Fatal("Client", p.clientState.ID, "Cannot send data in a payload of", layout.PayloadSize, "bytes with the protections enabled")
 	}
 
-	if slotOwner {
+	// a blame replaces our data in our slot, see disruption.go
+	blaming := p.clientState.DisruptionProtectionEnabled && slotOwner && p.clientState.DisruptionWrongBitPosition != -1
+
+	if blaming {
+		upstreamCellContent = p.blameCellContent()
+	} else if slotOwner {
+
+		// only the messages of DataForDCNet can share a compressed cell
+		fromDataForDCNet := false
 
 		//this data has already been polled out of the DataForDCNet chan, so send it first
 		//this is non-nil when OpenClosedSlot is true, and that it had to poll data out
 		if p.clientState.NextDataForDCNet != nil {
 			upstreamCellContent = *p.clientState.NextDataForDCNet
 			p.clientState.NextDataForDCNet = nil
+			fromDataForDCNet = true
 		} else {
 
 			//if there are some pcap packets to replay
@@ -436,6 +524,7 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 				//either select data from the data we have to send, if any
 				case myData := <-p.clientState.DataForDCNet:
 					upstreamCellContent = myData
+					fromDataForDCNet = true
 
 				//or, if we have nothing to send, and we are doing Latency tests, embed a pre-crafted message that we will recognize later on
 				default:
@@ -461,90 +550,66 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 			//copy(content[:], upstreamCellContent[:])
 			//p.clientState.DataHistory[p.clientState.RoundNo] = content
 		}
-	}
-
-	if p.clientState.DisruptionProtectionEnabled && slotOwner {
-		// If we are in blame part and checking the previous message
-		if p.clientState.DisruptionWrongBitPosition != -1 {
-			blameRoundID := p.clientState.RoundNo - int32(p.clientState.nClients)*2
-
-			pred := proof.Rep("X", "x", "B")
-			suite := config.CryptoSuite
-			B := suite.Point().Base()
-			sval := map[string]kyber.Scalar{"x": p.clientState.ephemeralPrivateKey}
-			pval := map[string]kyber.Point{"B": B, "X": p.clientState.EphemeralPublicKey}
-			prover := pred.Prover(suite, sval, pval, nil)
-			NIZK, _ := proof.HashProve(suite, "DISRUPTION", prover)
-
-			//send the data to the relay
-			toSend := &net.CLI_REL_DISRUPTION_BLAME{
-				BitPos:  p.clientState.DisruptionWrongBitPosition,
-				RoundID: blameRoundID,
-				NIZK:    NIZK,
-				Pval:    pval,
-			}
 
-			log.Lvl1("Disruption: Attempting to transmit blame for round", blameRoundID, p.clientState.DisruptionWrongBitPosition)
-
-			p.messageSender.SendToRelayWithLog(toSend, "(round "+strconv.Itoa(int(p.clientState.RoundNo))+")")
-
-			return nil
+		// the relay will encrypt the answers to the key we append, see downstream.go
+		if p.clientState.DownstreamEncryptionEnabled && upstreamCellContent != nil {
+			upstreamCellContent = p.appendDownstreamKey(upstreamCellContent, actualPayloadSize)
 		}
-		if !p.clientState.EquivocationProtectionEnabled {
-			// Making and storing hash
-			var hash [32]byte
-			if upstreamCellContent == nil {
-				// If the content is nil, some code will later change it into an empty slice. So the Hash must be from that
-				payload_to_hash := make([]byte, p.clientState.DCNet.DCNetPayloadSize-1)
-
-				// Saving data for possible disruption
-				p.clientState.LastMessage = payload_to_hash
-
-				// Creating hash
-				hash = sha256.Sum256(payload_to_hash)
-			} else {
-				// TODO: CHECK IT FITS
-				upstreamCellContent[3] = byte(p.clientState.ID)
-				// Saving data for possible disruption
-				p.clientState.LastMessage = upstreamCellContent
-				// Creating hash
-				hash = sha256.Sum256([]byte(upstreamCellContent))
-			}
 
-			p.clientState.HashFromPreviousMessage = hash
+		// the flag and the compressed data replace the data, see compression.go
+		if p.clientState.UpstreamCompressionEnabled && upstreamCellContent != nil {
+			cellSize := actualPayloadSize + compression.FLAG_SIZE
+			if p.clientState.DownstreamEncryptionEnabled {
+				cellSize += crypto.DOWNSTREAM_KEY_SIZE
+			}
+			// the key belongs to one stream, so its cell carries only one message
+			batch := fromDataForDCNet && !p.clientState.DownstreamEncryptionEnabled
+			upstreamCellContent = p.compressUpstream(upstreamCellContent, cellSize, batch)
 		}
-
 	}
 
-	// Adding the b_echo_last if the disruption protection is enabled
-	var slice_b_echo_last []byte
-	if p.clientState.DisruptionProtectionEnabled && slotOwner {
-		slice_b_echo_last = make([]byte, 1)
-		b_echo_last := p.clientState.B_echo_last
-		slice_b_echo_last[0] = b_echo_last
+	// the b_echo_last flag comes first if the disruption protection is enabled, see dcnet.CellLayout
+	var payload []byte
+	if slotOwner {
+		var err error
+		payload, err = layout.OwnerPayload(p.clientState.B_echo_last, upstreamCellContent)
+		if err != nil {
+			log.Error("Client", p.clientState.ID, ":", err, ", dropping the data of round", p.clientState.RoundNo)
+			payload, _ = layout.OwnerPayload(p.clientState.B_echo_last, nil)
+		}
 	}
-	payload := append(slice_b_echo_last, upstreamCellContent...)
 
-	upstreamCell, plainPayload := p.clientState.DCNet.EncodeForRound(p.clientState.RoundNo, slotOwner, payload)
+	var upstreamCell, plainPayload []byte
+	if p.clientState.DCNet.IsVerifiable() {
+		upstreamCell = p.clientState.DCNet.VerifiableEncodeForRound(p.clientState.RoundNo, ownerSlotID, payload)
+	} else {
+		upstreamCell, plainPayload = p.clientState.DCNet.EncodeForRound(p.clientState.RoundNo, slotOwner, payload)
+	}
 
-	if p.clientState.EquivocationProtectionEnabled && p.clientState.DisruptionProtectionEnabled && slotOwner && p.clientState.B_echo_last != 1 {
-		// Saving data for possible disruption
+	// while we ask the relay to retransmit our last message, we keep it to find the disrupted bit. The relay hashes
+	// and echoes the DC-net payload, which is what the ciphers XOR to
+	if p.clientState.DisruptionProtectionEnabled && slotOwner && (p.clientState.B_echo_last != 1 || blaming) {
 		p.clientState.LastMessage = plainPayload
-		hash := sha256.Sum256(plainPayload)
-		p.clientState.HashFromPreviousMessage = hash
+		p.clientState.LastMessageRoundID = p.clientState.RoundNo
+		p.clientState.HashFromPreviousMessage = sha256.Sum256(plainPayload)
+	}
+	if blaming {
+		// the relay takes it from here
+		p.clientState.B_echo_last = 0
+		p.clientState.DisruptionWrongBitPosition = -1
 	}
 
 	if p.clientState.ID == 0 && p.clientState.ForceDisruptionSinceRound3 && p.clientState.RoundNo > 3 && !slotOwner {
-		if p.clientState.AllreadyDisrupted {
-			if p.clientState.RoundNo != 6 {
-				p.clientState.AllreadyDisrupted = false
-			}
+		if p.clientState.DisruptionCooldown > 0 {
+			// the victim needs its next two slots to ask for the echo and to blame; with the equivocation protection,
+			// a disrupted cell carries nothing
+			p.clientState.DisruptionCooldown--
 		} else {
 			// TESTING DISRUPTION
 			log.Error("Pre-disruption", upstreamCell)
 			upstreamCell[len(upstreamCell)-1]++ // only disrupt a 0->1. if there was already a 1, no disruption (this simplifies things)
 			log.Error("Disrupting!   ", upstreamCell)
-			p.clientState.AllreadyDisrupted = true
+			p.clientState.DisruptionCooldown = 2
 		}
 
 	}
@@ -554,6 +619,9 @@ func (p *PriFiLibClientInstance) SendUpstreamData(ownerSlotID int) error {
 		RoundID:  p.clientState.RoundNo,
 		Data:     upstreamCell,
 	}
+	if err := p.signCipher(toSend); err != nil {
+		return err
+	}
 
 	p.messageSender.SendToRelayWithLog(toSend, "(round "+strconv.Itoa(int(p.clientState.RoundNo))+")")
 
@@ -585,6 +653,7 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_TRUSTEES_PK(trusteesPks [
 	}
 
 	p.clientState.TrusteePublicKey = make([]kyber.Point, p.clientState.nTrustees)
+	p.clientState.TrusteeDCNetPublicKey = p.clientState.TrusteePublicKey
 	p.clientState.sharedSecrets = make([]kyber.Point, p.clientState.nTrustees)
 
 	for i := 0; i < len(trusteesPks); i++ {
@@ -592,8 +661,15 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_TRUSTEES_PK(trusteesPks [
 		p.clientState.sharedSecrets[i] = config.CryptoSuite.Point().Mul(p.clientState.privateKey, trusteesPks[i])
 	}
 
-	p.clientState.DCNet = dcnet.NewDCNetEntity(p.clientState.ID,
-		dcnet.DCNET_CLIENT, p.clientState.PayloadSize, p.clientState.EquivocationProtectionEnabled, p.clientState.sharedSecrets)
+	if p.clientState.dcNetType == "Verifiable" {
+		p.clientState.DCNet = dcnet.NewVerifiableDCNetEntity(p.clientState.ID,
+			dcnet.DCNET_CLIENT, p.clientState.PayloadSize, p.clientState.sharedSecrets)
+	} else {
+		p.clientState.DCNet = dcnet.NewDCNetEntity(p.clientState.ID,
+			dcnet.DCNET_CLIENT, p.clientState.PayloadSize, p.clientState.EquivocationProtectionEnabled, p.clientState.dcNetPadGenerator,
+			p.clientState.sharedSecrets)
+		p.clientState.DCNet.DisruptionProtectionEnabled = p.clientState.DisruptionProtectionEnabled
+	}
 
 	//then, generate our ephemeral keys (used for shuffling)
 	p.clientState.EphemeralPublicKey, p.clientState.ephemeralPrivateKey = crypto.NewKeyPair()
@@ -604,6 +680,10 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_TRUSTEES_PK(trusteesPks [
 		Pk:       p.clientState.PublicKey,
 		EphPk:    p.clientState.EphemeralPublicKey,
 	}
+	// the relay checks our ciphers against our own commitments, so no trustee can frame us
+	if p.clientState.DCNet.IsVerifiable() {
+		toSend.VerifiableDCNetKey = p.clientState.DCNet.VerifiableDCNetKey()
+	}
 	p.messageSender.SendToRelayWithLog(toSend, "")
 
 	p.stateMachine.ChangeState("EPH_KEYS_SENT")
@@ -634,6 +714,9 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG(
 
 	//prepare for commmunication
 	p.clientState.MySlot = mySlot
+	if p.clientState.DCNet.IsVerifiable() {
+		p.clientState.DCNet.SetVerifiableSlots(msg.Base, msg.EphPks, mySlot, p.clientState.ephemeralPrivateKey)
+	}
 	p.clientState.RoundNo = int32(0)
 	p.clientState.BufferedRoundData = make(map[int32]net.REL_CLI_DOWNSTREAM_DATA)
 
@@ -644,6 +727,8 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG(
 			log.Error(e)
 			return errors.New(e)
 		}
+		// the first downstream cell is for the round after the blank one we send below
+		p.startReceivingFragments(p.clientState.RoundNo + 1)
 		p.clientState.StartStopReceiveBroadcast <- true
 		log.Lvl3("Client", p.clientState.ID, "indicated the udp-helper to start listening.")
 	}
@@ -657,38 +742,27 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG(
 	if p.clientState.ID == 0 {
 		slotOwner = true // we need one guy that takes the responsability for this first slot
 	}
-	payloadSize := p.clientState.PayloadSize
-
-	if p.clientState.EquivocationProtectionEnabled && slotOwner {
-		payloadSize -= 16
+	p.clientState.B_echo_last = 0
+	var data []byte
+	if slotOwner {
+		var err error
+		data, err = p.clientState.DCNet.CellLayoutOfRound(0).OwnerPayload(p.clientState.B_echo_last, nil)
+		if err != nil {
+			log.Fatal("Client", p.clientState.ID, "Cannot send data with the protections enabled,", err)
+		}
 	}
-	data := make([]byte, payloadSize)
-	if p.clientState.DisruptionProtectionEnabled {
-		// Making space for the b_echo_last
-		data2 := make([]byte, payloadSize-1)
 
-		// Saving data for possible disruption
-		p.clientState.LastMessage = data2
-
-		// Creating and storing hash
-		var hash [32]byte
-		hash = sha256.Sum256([]byte(data2))
-		p.clientState.HashFromPreviousMessage = hash
-
-		// As is inicialization, b_echo_last is 0
-		slice_b_echo_last := make([]byte, 1)
-		p.clientState.B_echo_last = 0
-		b_echo_last := p.clientState.B_echo_last
-		slice_b_echo_last[0] = b_echo_last
-		data = append(slice_b_echo_last, data2...)
+	var upstreamCell, plainPayload []byte
+	if p.clientState.DCNet.IsVerifiable() {
+		// there is no owner in round 0, everybody sends only pads
+		upstreamCell = p.clientState.DCNet.VerifiableEncodeForRound(0, -1, nil)
+	} else {
+		upstreamCell, plainPayload = p.clientState.DCNet.EncodeForRound(0, slotOwner, data)
 	}
-
-	upstreamCell, plainPayload := p.clientState.DCNet.EncodeForRound(0, slotOwner, data)
-	if p.clientState.EquivocationProtectionEnabled && p.clientState.DisruptionProtectionEnabled {
+	if p.clientState.DisruptionProtectionEnabled {
 		// Saving data for possible disruption
 		p.clientState.LastMessage = plainPayload
-		hash := sha256.Sum256(plainPayload)
-		p.clientState.HashFromPreviousMessage = hash
+		p.clientState.HashFromPreviousMessage = sha256.Sum256(plainPayload)
 	}
 
 	//send the data to the relay
@@ -697,6 +771,9 @@ func (p *PriFiLibClientInstance) Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG(
 		RoundID:  p.clientState.RoundNo,
 		Data:     upstreamCell,
 	}
+	if err := p.signCipher(toSend); err != nil {
+		return err
+	}
 	p.messageSender.SendToRelayWithLog(toSend, "(round "+strconv.Itoa(int(p.clientState.RoundNo))+")")
 
 	p.clientState.RoundNo++
@@ -69,7 +69,7 @@ func TestClient(t *testing.T) {
 	in := make(chan []byte, 6)
 	out := make(chan []byte, 3)
 
-	client := NewClient(true, true, in, out, false, "./", msw)
+	client := NewClient(true, true, in, out, false, "./", false, msw)
 
 	//when receiving no message, client should have some parameters ready
 	cs := client.clientState
@@ -448,7 +448,7 @@ func TestClient2(t *testing.T) {
 	in := make(chan []byte, 6)
 	out := make(chan []byte, 3)
 
-	client := NewClient(true, true, in, out, false, "./", msw)
+	client := NewClient(true, true, in, out, false, "./", false, msw)
 	cs := client.clientState
 
 	//we start by receiving a ALL_ALL_PARAMETERS from relay
@@ -579,9 +579,14 @@ func TestDisruptionClient(t *testing.T) {
 	in := make(chan []byte, 6)
 	out := make(chan []byte, 3)
 
-	client := NewClient(true, true, in, out, false, "./", msw)
+	client := NewClient(true, true, in, out, false, "./", false, msw)
 	cs := client.clientState
 
+	// with the disruption protection, we sign our ciphers with the key of our server identity
+	identity, identityKey := crypto.NewKeyPair()
+	relayIdentity, _ := crypto.NewKeyPair()
+	client.SetIdentities(identityKey, net.Identities{Relay: relayIdentity})
+
 	//we start by receiving a ALL_ALL_PARAMETERS from relay
 	msg := new(net.ALL_ALL_PARAMETERS)
 	msg.ForceParams = true
@@ -672,6 +677,9 @@ func TestDisruptionClient(t *testing.T) {
 	if msg6.RoundID != int32(0) {
 		t.Error("Client sent a wrong RoundID")
 	}
+	if err := net.VerifyCipher(identity, cs.session, 0, false, clientID, msg6.Data, msg6.Signature); err != nil {
+		t.Error("Client should sign its cipher,", err)
+	}
 	if len(msg6.Data) != upCellSize+8 {
 		t.Error("Client sent a payload with a wrong size")
 	}
@@ -687,14 +695,14 @@ func TestDisruptionClient(t *testing.T) {
 	sharedSecrets_t2 := make([]kyber.Point, 1)
 	sharedSecrets_t2[0] = cs.sharedSecrets[1]
 
-	t1 := dcnet.NewDCNetEntity(1, dcnet.DCNET_TRUSTEE, upCellSize, true, sharedSecrets_t1)
-	t2 := dcnet.NewDCNetEntity(2, dcnet.DCNET_TRUSTEE, upCellSize, true, sharedSecrets_t2)
+	t1 := dcnet.NewDCNetEntity(1, dcnet.DCNET_TRUSTEE, upCellSize, true, dcnet.PAD_GENERATOR_XOF, sharedSecrets_t1)
+	t2 := dcnet.NewDCNetEntity(2, dcnet.DCNET_TRUSTEE, upCellSize, true, dcnet.PAD_GENERATOR_XOF, sharedSecrets_t2)
 
 	x := t1.TrusteeEncodeForRound(0)
 
-	pad1 := dcnet.DCNetCipherFromBytes(x)
-	pad2 := dcnet.DCNetCipherFromBytes(t2.TrusteeEncodeForRound(0))
-	clientPad := dcnet.DCNetCipherFromBytes(msg6.Data)
+	pad1, _ := dcnet.DCNetCipherFromBytes(x)
+	pad2, _ := dcnet.DCNetCipherFromBytes(t2.TrusteeEncodeForRound(0))
+	clientPad, _ := dcnet.DCNetCipherFromBytes(msg6.Data)
 
 	dcNetDecoded := make([]byte, upCellSize)
 	i = 0
@@ -727,9 +735,9 @@ func TestDisruptionClient(t *testing.T) {
 	sentToRelay = make([]interface{}, 0)
 
 	//dcnet.old decode
-	pad1 = dcnet.DCNetCipherFromBytes(t1.TrusteeEncodeForRound(1))
-	pad2 = dcnet.DCNetCipherFromBytes(t2.TrusteeEncodeForRound(1))
-	clientPad = dcnet.DCNetCipherFromBytes(msg8.Data)
+	pad1, _ = dcnet.DCNetCipherFromBytes(t1.TrusteeEncodeForRound(1))
+	pad2, _ = dcnet.DCNetCipherFromBytes(t2.TrusteeEncodeForRound(1))
+	clientPad, _ = dcnet.DCNetCipherFromBytes(msg8.Data)
 
 	dcNetDecoded = make([]byte, upCellSize)
 	i = 0
@@ -761,9 +769,9 @@ func TestDisruptionClient(t *testing.T) {
 	sentToRelay = make([]interface{}, 0)
 
 	//dcnet decode
-	pad1 = dcnet.DCNetCipherFromBytes(t1.TrusteeEncodeForRound(2))
-	pad2 = dcnet.DCNetCipherFromBytes(t2.TrusteeEncodeForRound(2))
-	clientPad = dcnet.DCNetCipherFromBytes(msg10.Data)
+	pad1, _ = dcnet.DCNetCipherFromBytes(t1.TrusteeEncodeForRound(2))
+	pad2, _ = dcnet.DCNetCipherFromBytes(t2.TrusteeEncodeForRound(2))
+	clientPad, _ = dcnet.DCNetCipherFromBytes(msg10.Data)
 	dcNetDecoded = make([]byte, upCellSize)
 	i = 0
 	for i < len(dcNetDecoded) {
@@ -778,3 +786,80 @@ func TestDisruptionClient(t *testing.T) {
 
 	t.SkipNow() //we started a goroutine, let's kill everything, we're good
 }
+
+func TestDisruptionRevealSecretOnlyForTheBlame(t *testing.T) {
+	msgSender := new(TestMessageSender)
+	msw := newTestMessageSenderWrapper(msgSender)
+	sentToRelay = make([]interface{}, 0)
+	client := NewClient(true, true, make(chan []byte), make(chan []byte), false, "./", false, msw)
+	cs := client.clientState
+
+	// client 0 shares a secret with each of 2 trustees, and revealed its bits for bit 3 of round 5
+	_, identityKey := crypto.NewKeyPair()
+	trusteeIdentities := make([]kyber.Point, 2)
+	trusteeIdentityKeys := make([]kyber.Scalar, 2)
+	for j := range trusteeIdentities {
+		trusteeIdentities[j], trusteeIdentityKeys[j] = crypto.NewKeyPair()
+	}
+	client.SetIdentities(identityKey, net.Identities{Trustees: trusteeIdentities})
+	cs.session = 42
+	cs.TrusteeDCNetPublicKey = make([]kyber.Point, 2)
+	cs.sharedSecrets = make([]kyber.Point, 2)
+	for j := range cs.TrusteeDCNetPublicKey {
+		cs.TrusteeDCNetPublicKey[j], _ = crypto.NewKeyPair()
+		cs.sharedSecrets[j] = config.CryptoSuite.Point().Mul(cs.privateKey, cs.TrusteeDCNetPublicKey[j])
+	}
+	cs.blame = &revealedBits{RoundID: 5, BitPos: 3, Bits: map[int]int{0: 1, 1: 0}}
+
+	// the bits of trustee 0, signed by it
+	trusteeBits := func(trusteeID int, roundID int32, bitPos int, bit int, key kyber.Scalar) net.TRU_REL_DISRUPTION_REVEAL {
+		bits := net.TRU_REL_DISRUPTION_REVEAL{TrusteeID: trusteeID, RoundID: roundID, BitPos: bitPos, Bits: map[int]int{0: bit}}
+		if err := bits.Sign(key, cs.session); err != nil {
+			t.Fatal(err)
+		}
+		return bits
+	}
+	request := func(trusteeID int, roundID int32, bitPos int, bits net.TRU_REL_DISRUPTION_REVEAL) net.REL_ALL_REVEAL_SHARED_SECRETS {
+		return net.REL_ALL_REVEAL_SHARED_SECRETS{EntityID: trusteeID, RoundID: roundID, BitPos: bitPos, TrusteeBits: bits}
+	}
+
+	refused := []net.REL_ALL_REVEAL_SHARED_SECRETS{
+		// another blame
+		request(0, 6, 3, trusteeBits(0, 6, 3, 0, trusteeIdentityKeys[0])),
+		request(0, 5, 4, trusteeBits(0, 5, 4, 0, trusteeIdentityKeys[0])),
+		// an unknown trustee
+		request(-1, 5, 3, trusteeBits(-1, 5, 3, 0, trusteeIdentityKeys[0])),
+		request(2, 5, 3, trusteeBits(2, 5, 3, 0, trusteeIdentityKeys[0])),
+		// no bits, or the bits of another trustee, or not signed by the trustee
+		request(0, 5, 3, net.TRU_REL_DISRUPTION_REVEAL{}),
+		request(0, 5, 3, trusteeBits(1, 5, 3, 0, trusteeIdentityKeys[1])),
+		request(0, 5, 3, trusteeBits(0, 5, 3, 0, trusteeIdentityKeys[1])),
+		// the bits of the trustee in another blame
+		request(0, 5, 3, trusteeBits(0, 5, 4, 0, trusteeIdentityKeys[0])),
+		// bits that agree with ours
+		request(0, 5, 3, trusteeBits(0, 5, 3, 1, trusteeIdentityKeys[0])),
+		request(1, 5, 3, trusteeBits(1, 5, 3, 0, trusteeIdentityKeys[1])),
+	}
+	for i, msg := range refused {
+		if err := client.Received_REL_ALL_REVEAL_SHARED_SECRETS(msg); err == nil {
+			t.Error("Client should refuse to reveal its secret, request", i)
+		}
+	}
+	if len(sentToRelay) != 0 {
+		t.Fatal("Client should not have revealed any secret")
+	}
+
+	// the bits of trustee 0 disagree with ours: we reveal that secret, once
+	if err := client.Received_REL_ALL_REVEAL_SHARED_SECRETS(request(0, 5, 3, trusteeBits(0, 5, 3, 0, trusteeIdentityKeys[0]))); err != nil {
+		t.Error("Client should reveal the secret shared with trustee 0,", err)
+	}
+	if len(sentToRelay) != 1 {
+		t.Fatal("Client should have revealed the secret shared with trustee 0")
+	}
+	if reveal := sentToRelay[0].(*net.CLI_REL_SHARED_SECRET); !reveal.Secret.Equal(cs.sharedSecrets[0]) {
+		t.Error("Client revealed the wrong secret")
+	}
+	if err := client.Received_REL_ALL_REVEAL_SHARED_SECRETS(request(0, 5, 3, trusteeBits(0, 5, 3, 0, trusteeIdentityKeys[0]))); err == nil {
+		t.Error("Client should reveal a secret only once per blame")
+	}
+}
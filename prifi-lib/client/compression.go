@@ -0,0 +1,40 @@
+package client
+
+/*
+Upstream compression
+********************
+With UpstreamCompressionEnabled, the cell we send in our slot starts with a flag, and carries our data compressed if
+that is smaller (see prifi-lib/compression). The messages of DataForDCNet that still fit once compressed go in the same
+cell, so small headers do not take a cell each. A message that does not fit waits in NextDataForDCNet for our next
+slot.
+*/
+
+import (
+	"github.com/dedis/prifi/prifi-lib/compression"
+)
+
+// compressUpstream returns the cell of cellSize bytes carrying data, and, if batch, the next messages of DataForDCNet
+// that fit
+func (p *PriFiLibClientInstance) compressUpstream(data []byte, cellSize int, batch bool) []byte {
+	messages := [][]byte{data}
+	cell, _ := p.clientState.packer.Pack(messages, cellSize)
+
+	for batch && len(messages) < compression.MAX_MESSAGES_PER_CELL {
+		var next []byte
+		select {
+		case next = <-p.clientState.DataForDCNet:
+		default:
+			return cell
+		}
+
+		messages = append(messages, next)
+		c, n := p.clientState.packer.Pack(messages, cellSize)
+		if n < len(messages) {
+			// for our next slot
+			p.clientState.NextDataForDCNet = &next
+			return cell
+		}
+		cell = c
+	}
+	return cell
+}
@@ -2,8 +2,11 @@ package client
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/dcnet"
 	"github.com/dedis/prifi/prifi-lib/net"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/proof"
@@ -12,6 +15,16 @@ import (
 	"time"
 )
 
+// revealedBits are the bits we revealed in phase 1 of a blame. We only reveal a shared secret for that blame, and only
+// once: to settle a disagreement with the trustee that signed other bits. Otherwise, the relay could ask for all our
+// shared secrets, and regenerate our pads.
+type revealedBits struct {
+	RoundID        int32
+	BitPos         int
+	Bits           map[int]int // trustee ID -> bit
+	SecretRevealed bool
+}
+
 /*
 * Received_REL_ALL_DISRUPTION_REVEAL handles REL_ALL_DISRUPTION_REVEAL messages.
 * The method calls a function from the DCNet to regenerate the bits from roundID in position BitPos
@@ -21,6 +34,9 @@ func (p *PriFiLibClientInstance) Received_REL_ALL_DISRUPTION_REVEAL(msg net.REL_
 	log.Lvl1("Disruption Phase 1: Received de-anonymization query for round", msg.RoundID, "bit pos", msg.BitPos)
 
 	bitMap, PRGs := p.clientState.DCNet.GetBitsOfRound(int32(msg.RoundID), int32(msg.BitPos))
+	if bitMap == nil {
+		return errors.New("cannot reveal bit " + strconv.Itoa(msg.BitPos) + " of round " + strconv.Itoa(int(msg.RoundID)))
+	}
 
 	var pred_array []proof.Predicate
 	sval := make(map[string]kyber.Scalar)
@@ -38,12 +54,16 @@ func (p *PriFiLibClientInstance) Received_REL_ALL_DISRUPTION_REVEAL(msg net.REL_
 	}
 	pred := proof.And(pred_array...)
 
+	// the proof is bound to this blame and to us, so the relay cannot replay it in another one
+	context := net.BlameProofContext("DISRUPTION", p.clientState.session, msg.RoundID, msg.BitPos, false, p.clientState.ID)
 	prover := pred.Prover(suite, sval, pval, nil)
-	NIZK, _ := proof.HashProve(suite, "DISRUPTION", prover)
+	NIZK, _ := proof.HashProve(suite, context, prover)
 
 	//send the data to the relay
 	toSend := &net.CLI_REL_DISRUPTION_REVEAL{
 		ClientID: p.clientState.ID,
+		RoundID:  msg.RoundID,
+		BitPos:   msg.BitPos,
 		Bits:     bitMap,
 		NIZK:     NIZK,
 		Pval:     pval,
@@ -60,18 +80,28 @@ func (p *PriFiLibClientInstance) Received_REL_ALL_DISRUPTION_REVEAL(msg net.REL_
 	}
 	log.Lvl1("Disruption: Sending previous round to relay (Round: ", msg.RoundID, ", bit position:", msg.BitPos, "), value", bitMap)
 
+	// signed with our long-term key, the bits are evidence in the transcript of the blame
+	if err := toSend.Sign(p.clientState.identityKey, p.clientState.session); err != nil {
+		return errors.New("cannot sign the bits revealed, " + err.Error())
+	}
+	p.clientState.blame = &revealedBits{RoundID: msg.RoundID, BitPos: msg.BitPos, Bits: bitMap}
+
 	p.messageSender.SendToRelayWithLog(toSend, "")
 	return nil
 }
 
 /*
 * Received_REL_ALL_REVEAL_SHARED_SECRETS handles REL_ALL_REVEAL_SHARED_SECRETS messages.
-* The method gets the shared secret and sends it to the relay.
+* The method checks that the trustee signed bits that disagree with ours in the blame we revealed our bits for,
+* then gets the shared secret and sends it to the relay.
  */
 func (p *PriFiLibClientInstance) Received_REL_ALL_REVEAL_SHARED_SECRETS(msg net.REL_ALL_REVEAL_SHARED_SECRETS) error {
 	log.Lvl1("Disruption Phase 2: Received a reveal secret message for trustee", msg.EntityID)
-	// TODO: NIZK
-	// TODO: check that the relay asks for the correct entity, and not a honest entity. There should be a signature check on the TRU_REL_DISRUPTION_REVEAL the relay received (and forwarded to the client)
+	if err := p.checkSecretRequest(msg); err != nil {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " refuses to reveal the secret shared with trustee " +
+			strconv.Itoa(msg.EntityID) + ", " + err.Error())
+	}
+	p.clientState.blame.SecretRevealed = true
 	secret := p.clientState.sharedSecrets[msg.EntityID]
 
 	// as a pseudorandom base point multiplied by our private key.
@@ -81,7 +111,7 @@ func (p *PriFiLibClientInstance) Received_REL_ALL_REVEAL_SHARED_SECRETS(msg net.
 	B := suite.Point().Base() //BACK
 	// Generate the proof predicate: an OR branch for each public key.
 	sec := map[string]kyber.Scalar{"x": p.clientState.privateKey} //BACK
-	pub := map[string]kyber.Point{"B": B, "BT": p.clientState.TrusteePublicKey[msg.EntityID], "T": p.clientState.sharedSecrets[msg.EntityID]}
+	pub := map[string]kyber.Point{"B": B, "BT": p.clientState.TrusteeDCNetPublicKey[msg.EntityID], "T": p.clientState.sharedSecrets[msg.EntityID]}
 	preds := make([]proof.Predicate, len(X))
 	for i := range X {
 		name := fmt.Sprintf("X[%d]", i) // "X[0]","X[1]",...
@@ -97,8 +127,8 @@ func (p *PriFiLibClientInstance) Received_REL_ALL_REVEAL_SHARED_SECRETS(msg net.
 	choice := make(map[proof.Predicate]int)
 	choice[pred] = 0
 
-	// Generate the signature
-	M := "SHAREDKEY"
+	// Generate the signature, bound to this blame and to us
+	M := net.BlameProofContext("SHAREDKEY", p.clientState.session, msg.RoundID, msg.BitPos, false, p.clientState.ID)
 	prover := pred.Prover(suite, sec, pub, choice)
 	NIZK, _ := proof.HashProve(suite, M, prover)
 
@@ -113,10 +143,15 @@ func (p *PriFiLibClientInstance) Received_REL_ALL_REVEAL_SHARED_SECRETS(msg net.
 	toSend := &net.CLI_REL_SHARED_SECRET{
 		ClientID:  p.clientState.ID,
 		TrusteeID: msg.EntityID,
+		RoundID:   msg.RoundID,
+		BitPos:    msg.BitPos,
 		Secret:    secret,
-		NIZK:      make([]byte, 0),
+		NIZK:      NIZK,
 		Pub:       pub,
 	}
+	if err := toSend.Sign(p.clientState.identityKey, p.clientState.session); err != nil {
+		return errors.New("cannot sign the secret revealed, " + err.Error())
+	}
 
 	if p.clientState.ForceDisruptionSinceRound3 && p.clientState.ID == 0 {
 		//this client is hesitant to answer as he will get caught
@@ -130,6 +165,60 @@ func (p *PriFiLibClientInstance) Received_REL_ALL_REVEAL_SHARED_SECRETS(msg net.
 	return nil
 }
 
+// checkSecretRequest returns an error unless the relay asks for the secret shared with a trustee in the blame we
+// revealed our bits for, for the first time, and shows the bits that trustee signed, which disagree with ours
+func (p *PriFiLibClientInstance) checkSecretRequest(msg net.REL_ALL_REVEAL_SHARED_SECRETS) error {
+	b := p.clientState.blame
+	if b == nil || b.RoundID != msg.RoundID || b.BitPos != msg.BitPos {
+		return errors.New("we did not reveal our bits for bit " + strconv.Itoa(msg.BitPos) + " of round " + strconv.Itoa(int(msg.RoundID)))
+	}
+	if b.SecretRevealed {
+		return errors.New("we already revealed a secret in this blame")
+	}
+	if msg.EntityID < 0 || msg.EntityID >= len(p.clientState.sharedSecrets) || msg.EntityID >= len(p.clientState.TrusteeDCNetPublicKey) {
+		return errors.New("unknown trustee")
+	}
+	bits := msg.TrusteeBits
+	if bits.TrusteeID != msg.EntityID || bits.RoundID != b.RoundID || bits.BitPos != b.BitPos {
+		return errors.New("the bits shown are not the ones of that trustee in this blame")
+	}
+	if err := bits.Verify(p.clientState.identities.Of(true, msg.EntityID), p.clientState.session); err != nil {
+		return errors.New("the bits shown are not signed by the trustee, " + err.Error())
+	}
+	bit, found := bits.Bits[p.clientState.ID]
+	if !found || bit == b.Bits[msg.EntityID] {
+		return errors.New("the trustee revealed the same bit as us")
+	}
+	return nil
+}
+
+// signCipher signs our cipher with the key of our server identity when the disruption protection is on, so that the
+// relay cannot blame us with a cipher we did not send
+func (p *PriFiLibClientInstance) signCipher(msg *net.CLI_REL_UPSTREAM_DATA) error {
+	if !p.clientState.DisruptionProtectionEnabled {
+		return nil
+	}
+	signature, err := net.SignCipher(p.clientState.identityKey, p.clientState.session, msg.RoundID, false, msg.ClientID, msg.Data)
+	if err != nil {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " cannot sign its cipher for round " +
+			strconv.Itoa(int(msg.RoundID)) + ", " + err.Error())
+	}
+	msg.Signature = signature
+	return nil
+}
+
+// blameCellContent returns what we send in our slot to start the blame: "BLAME", the round of our disrupted message,
+// and the position of a bit that was flipped from 0 to 1 in its DC-net payload (see dcnet.CellLayout)
+func (p *PriFiLibClientInstance) blameCellContent() []byte {
+	content := make([]byte, 13)
+	copy(content[0:5], "BLAME")
+	binary.BigEndian.PutUint32(content[5:9], uint32(p.clientState.LastMessageRoundID))
+	binary.BigEndian.PutUint32(content[9:13], uint32(p.clientState.DisruptionWrongBitPosition))
+
+	log.Lvl1("Disruption: Attempting to transmit blame for round", p.clientState.LastMessageRoundID, p.clientState.DisruptionWrongBitPosition)
+	return content
+}
+
 func (p *PriFiLibClientInstance) handlePossibleDisruption(msg net.REL_CLI_DOWNSTREAM_DATA) error {
 	if p.clientState.RoundNo-1 == p.clientState.MyLastRound {
 
@@ -145,34 +234,15 @@ func (p *PriFiLibClientInstance) handlePossibleDisruption(msg net.REL_CLI_DOWNST
 				log.Lvl3(msg.Data)
 				log.Lvl3(p.clientState.LastMessage)
 
-				// Get the l-th bit
-				found := false
-				log.Lvl1("COMPARING", msg.Data, p.clientState.LastMessage)
-				for index, b := range msg.Data {
-					if b != p.clientState.LastMessage[index] {
-						log.Lvl1("MISMATCH", b, p.clientState.LastMessage[index])
-						log.Lvl1(index)
-						//Get the bit
-						for j := 0; j < 8; j++ {
-							mask := byte(1 << uint(j))
-							if (b & mask) != (p.clientState.LastMessage[index] & mask) {
-								bitPos := index*8 + (7 - j)
-
-								if (p.clientState.LastMessage[index] & mask) == 1 {
-									log.Lvl1("Bit at position", bitPos, "was a 1 toggled to 0, ignoring...")
-								} else {
-									// Found bit
-									p.clientState.DisruptionWrongBitPosition = bitPos
-									log.Lvl1("Disruptive bit position:", p.clientState.DisruptionWrongBitPosition)
-									found = true
-									break
-								}
-							}
-						}
-						if found {
-							break
-						}
-					}
+				// only a bit toggled from 0 to 1 can be blamed, see dcnet.FirstFlippedBit
+				bitPos := dcnet.FirstFlippedBit(p.clientState.LastMessage, msg.Data)
+				if bitPos == -1 {
+					log.Lvl1("Disruption: no bit was toggled from 0 to 1, there is nothing to blame")
+					p.clientState.B_echo_last = 0
+					p.clientState.DisruptionWrongBitPosition = -1
+				} else {
+					p.clientState.DisruptionWrongBitPosition = bitPos
+					log.Lvl1("Disruptive bit position:", p.clientState.DisruptionWrongBitPosition)
 				}
 			}
 		} else {
@@ -0,0 +1,86 @@
+package client
+
+/*
+Downstream encryption
+*********************
+With DownstreamEncryptionEnabled, when we own the slot, we append to our data an ephemeral public key for the stream
+that data belongs to (identified by its first bytes, as in the stream-multiplexer). The relay encrypts the answers to
+that key; we recognize them by the hint in front of the cell, and only we can decrypt them. Each stream has its own key,
+so the relay cannot link our streams together.
+*/
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// DOWNSTREAM_STREAM_TAG_SIZE is the number of bytes at the beginning of the data that identify a stream
+const DOWNSTREAM_STREAM_TAG_SIZE = 4
+
+// DOWNSTREAM_KEY_IDLE_TIMEOUT is how long we keep the key of a stream that is not used anymore
+const DOWNSTREAM_KEY_IDLE_TIMEOUT = 10 * time.Minute
+
+// the key we gave the relay for one of our streams
+type downstreamKey struct {
+	key      *crypto.DownstreamKey
+	lastUsed time.Time
+}
+
+// appendDownstreamKey pads the data we send in our slot to payloadSize, and appends the key of its stream (or zeros,
+// if there is no data)
+func (p *PriFiLibClientInstance) appendDownstreamKey(upstreamCellContent []byte, payloadSize int) []byte {
+	if len(upstreamCellContent) > payloadSize {
+		log.Error("Client "+strconv.Itoa(p.clientState.ID)+" : cannot send", len(upstreamCellContent), "bytes with a downstream key, truncating to", payloadSize)
+		upstreamCellContent = upstreamCellContent[:payloadSize]
+	}
+	out := make([]byte, payloadSize+crypto.DOWNSTREAM_KEY_SIZE)
+	copy(out, upstreamCellContent)
+
+	now := time.Now()
+	for tag, k := range p.clientState.downstreamKeys {
+		if now.Sub(k.lastUsed) > DOWNSTREAM_KEY_IDLE_TIMEOUT {
+			delete(p.clientState.downstreamKeys, tag)
+		}
+	}
+
+	tag := out[:DOWNSTREAM_STREAM_TAG_SIZE]
+	if len(upstreamCellContent) < DOWNSTREAM_STREAM_TAG_SIZE || bytes.Equal(tag, make([]byte, DOWNSTREAM_STREAM_TAG_SIZE)) {
+		return out
+	}
+	k, found := p.clientState.downstreamKeys[string(tag)]
+	if !found {
+		key, err := crypto.NewDownstreamKey()
+		if err != nil {
+			log.Error("Client "+strconv.Itoa(p.clientState.ID)+" : cannot create a downstream key,", err)
+			return out
+		}
+		k = &downstreamKey{key: key}
+		p.clientState.downstreamKeys[string(tag)] = k
+	}
+	k.lastUsed = now
+	copy(out[payloadSize:], k.key.Public[:])
+	return out
+}
+
+// decryptDownstream decrypts a downstream cell encrypted to one of our keys. Returns false if the cell is for
+// another client
+func (p *PriFiLibClientInstance) decryptDownstream(data []byte) ([]byte, bool) {
+	for _, k := range p.clientState.downstreamKeys {
+		if !k.key.IsFor(data) {
+			continue
+		}
+		plaintext, err := k.key.DecryptDownstream(data)
+		if err != nil {
+			// the hint is short, it may be another client's
+			log.Lvl3("Client "+strconv.Itoa(p.clientState.ID)+" : cannot decrypt a downstream cell,", err)
+			continue
+		}
+		k.lastUsed = time.Now()
+		return plaintext, true
+	}
+	return nil, false
+}
@@ -0,0 +1,115 @@
+package client
+
+/*
+Accountable downstream
+**********************
+With DownstreamChainEnabled in our configuration, we only accept the downstream cells signed with the key of the relay's
+server identity, chained to the cells we received before (see net/downstream_chain.go). With DownstreamGossipPeriod,
+every few rounds we send the signed head of our chain to the other clients and to the trustees, and compare theirs with
+ours: two heads signed for the same round that differ prove that the relay did not send the same cells to everyone. If
+we missed cells, we only continue after a head that another client gossiped; the relay alone cannot move us to another
+chain.
+*/
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// setupDownstreamChain starts the downstream chain of this session
+func (p *PriFiLibClientInstance) setupDownstreamChain(msg net.ALL_ALL_PARAMETERS) {
+	p.clientState.DownstreamGossipPeriod = msg.IntValueOrElse("DownstreamGossipPeriod", 0)
+	p.clientState.downstreamChainHead = net.NewDownstreamChainHead()
+	p.clientState.downstreamChainRound = 0 // there is no downstream cell in round 0, the first one chains after the genesis head
+	p.clientState.downstreamChainWitness = nil
+	if p.clientState.identities.Relay != nil {
+		p.clientState.downstreamChainWitness = net.NewDownstreamChainWitness(p.clientState.identities.Relay, p.clientState.session)
+	}
+}
+
+// verifyDownstreamCell checks that the relay signed a cell, after the ones we received before, and gossips the new head
+// of the chain if it is time to. Does nothing without DownstreamChainEnabled.
+func (p *PriFiLibClientInstance) verifyDownstreamCell(msg net.REL_CLI_DOWNSTREAM_DATA) error {
+	if !p.clientState.DownstreamChainEnabled {
+		return nil
+	}
+
+	// if we missed the previous cells, we only take the relay's word for the previous head if another client saw it too
+	previousHead := p.clientState.downstreamChainHead
+	if msg.RoundID != p.clientState.downstreamChainRound+1 {
+		previousHead = nil
+		if p.clientState.downstreamChainWitness != nil {
+			previousHead = p.clientState.downstreamChainWitness.Head(msg.RoundID - 1)
+		}
+		if previousHead == nil {
+			return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " refuses the downstream cell of round " +
+				strconv.Itoa(int(msg.RoundID)) + ", we missed the cells since round " + strconv.Itoa(int(p.clientState.downstreamChainRound)) +
+				" and nobody gossiped the head of round " + strconv.Itoa(int(msg.RoundID-1)))
+		}
+	}
+	head, err := net.VerifyDownstreamCell(p.clientState.identities.Relay, p.clientState.session, previousHead, &msg)
+	if err != nil {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " refuses a downstream cell, " + err.Error())
+	}
+	p.clientState.downstreamChainHead = head
+	p.clientState.downstreamChainRound = msg.RoundID
+
+	if p.clientState.DownstreamGossipPeriod > 0 && msg.RoundID%int32(p.clientState.DownstreamGossipPeriod) == 0 {
+		p.gossipDownstreamChainHead(net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD{
+			ClientID:  p.clientState.ID,
+			Session:   p.clientState.session,
+			RoundID:   msg.RoundID,
+			Head:      head,
+			Signature: msg.ChainSignature,
+		})
+	}
+	return nil
+}
+
+// gossipDownstreamChainHead sends the head of our chain to the other clients and to the trustees
+func (p *PriFiLibClientInstance) gossipDownstreamChainHead(h net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD) {
+	if _, err := p.addDownstreamChainHead(h); err != nil {
+		log.Error("Client", p.clientState.ID, ": cannot add our own head of round", h.RoundID, ",", err)
+		return
+	}
+	for i := 0; i < p.clientState.nClients; i++ {
+		if i != p.clientState.ID {
+			p.messageSender.SendToClientWithLog(i, &h, "(client "+strconv.Itoa(i)+", round "+strconv.Itoa(int(h.RoundID))+")")
+		}
+	}
+	for j := 0; j < p.clientState.nTrustees; j++ {
+		p.messageSender.SendToTrusteeWithLog(j, &h, "(trustee "+strconv.Itoa(j)+", round "+strconv.Itoa(int(h.RoundID))+")")
+	}
+}
+
+/*
+Received_CLI_ALL_DOWNSTREAM_CHAIN_HEAD handles CLI_ALL_DOWNSTREAM_CHAIN_HEAD messages, the head of the downstream chain
+of another client. We compare it with ours, and with those of the others, for that round.
+*/
+func (p *PriFiLibClientInstance) Received_CLI_ALL_DOWNSTREAM_CHAIN_HEAD(msg net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD) error {
+	if p.clientState.downstreamChainWitness == nil {
+		log.Lvl3("Client", p.clientState.ID, ": received the head of client", msg.ClientID, "but we do not know the relay's key, discarding.")
+		return nil
+	}
+	_, err := p.addDownstreamChainHead(msg)
+	if err != nil {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : invalid head from client " + strconv.Itoa(msg.ClientID) + ", " + err.Error())
+	}
+	return nil
+}
+
+// addDownstreamChainHead gives a head to our witness, and reports the relay if it equivocated
+func (p *PriFiLibClientInstance) addDownstreamChainHead(h net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD) (*net.DownstreamEquivocationProof, error) {
+	proof, err := p.clientState.downstreamChainWitness.Add(h)
+	if err != nil {
+		return nil, err
+	}
+	if proof != nil {
+		log.Error("Client", p.clientState.ID, ": the relay equivocated, it signed two different downstream histories for round",
+			proof.RoundID, "(the head of client", h.ClientID, "differs)")
+	}
+	return proof, nil
+}
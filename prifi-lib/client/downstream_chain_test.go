@@ -0,0 +1,149 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"github.com/dedis/prifi/prifi-lib/net"
+)
+
+// gossipMessageSender keeps the heads a client gossips
+type gossipMessageSender struct {
+	TestMessageSender
+	toClients  map[int][]*net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD
+	toTrustees map[int][]*net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD
+}
+
+func (t *gossipMessageSender) SendToClient(i int, msg interface{}) error {
+	t.toClients[i] = append(t.toClients[i], msg.(*net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD))
+	return nil
+}
+func (t *gossipMessageSender) SendToTrustee(i int, msg interface{}) error {
+	t.toTrustees[i] = append(t.toTrustees[i], msg.(*net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD))
+	return nil
+}
+
+func TestDownstreamChain(t *testing.T) {
+	relayPub, relayPriv := crypto.NewKeyPair()
+	session := 7
+
+	msgSender := &gossipMessageSender{
+		toClients:  make(map[int][]*net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD),
+		toTrustees: make(map[int][]*net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD),
+	}
+	p := &PriFiLibClientInstance{
+		messageSender: newTestMessageSenderWrapper(msgSender),
+		clientState:   &ClientState{ID: 0, nClients: 3, nTrustees: 1},
+	}
+
+	// without DownstreamChainEnabled, nothing is checked
+	p.setupDownstreamChain(net.ALL_ALL_PARAMETERS{})
+	if err := p.verifyDownstreamCell(net.REL_CLI_DOWNSTREAM_DATA{RoundID: 1, Data: []byte{1}}); err != nil {
+		t.Error("without DownstreamChainEnabled, an unsigned cell should be accepted,", err)
+	}
+
+	// with it, the cells must be signed, even if we do not know the relay's key
+	p.clientState.DownstreamChainEnabled = true
+	p.setupDownstreamChain(net.ALL_ALL_PARAMETERS{})
+	if p.verifyDownstreamCell(net.REL_CLI_DOWNSTREAM_DATA{RoundID: 1, Data: []byte{1}}) == nil {
+		t.Error("with DownstreamChainEnabled, an unsigned cell should be refused")
+	}
+
+	p.SetIdentities(nil, net.Identities{Relay: relayPub})
+	p.clientState.session = session // read with the other parameters
+	params := net.ALL_ALL_PARAMETERS{}
+	params.Add("DownstreamGossipPeriod", 2)
+	p.setupDownstreamChain(params)
+
+	relayHead := net.NewDownstreamChainHead()
+	signedCell := func(roundID int32, data []byte) net.REL_CLI_DOWNSTREAM_DATA {
+		cell := &net.REL_CLI_DOWNSTREAM_DATA{RoundID: roundID, OwnershipID: -1, Data: data}
+		head, err := net.SignDownstreamCell(relayPriv, session, relayHead, cell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		relayHead = head
+		return *cell
+	}
+
+	// there is no downstream cell in round 0
+	for roundID := int32(1); roundID <= 3; roundID++ {
+		if err := p.verifyDownstreamCell(signedCell(roundID, []byte{byte(roundID)})); err != nil {
+			t.Fatal("round", roundID, ":", err)
+		}
+	}
+
+	// the head of round 2 went to the other clients and to the trustee
+	for _, sent := range [][]*net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD{msgSender.toClients[1], msgSender.toClients[2], msgSender.toTrustees[0]} {
+		if len(sent) != 1 || sent[0].RoundID != 2 || sent[0].Session != session {
+			t.Fatal("the client should gossip the head of round 2 once, sent", sent)
+		}
+	}
+	if len(msgSender.toClients[0]) != 0 {
+		t.Error("the client should not send its head to itself")
+	}
+	ownHead := *msgSender.toTrustees[0][0]
+
+	// cells not signed, or not following ours, are refused
+	unsigned := net.REL_CLI_DOWNSTREAM_DATA{RoundID: 4, Data: []byte{4}}
+	if p.verifyDownstreamCell(unsigned) == nil {
+		t.Error("an unsigned cell should be refused")
+	}
+	tampered := signedCell(4, []byte{4})
+	tampered.Data = []byte{5}
+	if p.verifyDownstreamCell(tampered) == nil {
+		t.Error("a tampered cell should be refused")
+	}
+	relayHead = net.NewDownstreamChainHead()
+	if p.verifyDownstreamCell(signedCell(4, []byte{4})) == nil {
+		t.Error("a cell forking the chain should be refused")
+	}
+	otherPub, _ := crypto.NewKeyPair()
+	p.clientState.identities.Relay = otherPub
+	if p.verifyDownstreamCell(signedCell(4, []byte{4})) == nil {
+		t.Error("a cell not signed by the relay's server identity should be refused")
+	}
+	p.clientState.identities.Relay = relayPub
+
+	// after missing cells, we only follow a head gossiped by another client
+	relayHead = ownHead.Head
+	signedCell(3, []byte{3})
+	signedCell(4, []byte{4})
+	cell5 := signedCell(5, []byte{5})
+	missed := signedCell(6, []byte{6})
+	if p.verifyDownstreamCell(missed) == nil {
+		t.Error("after missing cells, a cell should be refused without a gossiped head")
+	}
+	gossiped := net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD{ClientID: 1, Session: session, RoundID: 5, Head: missed.PreviousChainHead, Signature: cell5.ChainSignature}
+	if err := p.Received_CLI_ALL_DOWNSTREAM_CHAIN_HEAD(gossiped); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.verifyDownstreamCell(missed); err != nil {
+		t.Error("after missing cells, a cell should be accepted after a gossiped head,", err)
+	}
+
+	// another client received other cells in round 2
+	relayHead = net.NewDownstreamChainHead()
+	signedCell(1, []byte{1})
+	other := signedCell(2, []byte{42})
+	otherHead := net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD{ClientID: 1, Session: session, RoundID: 2, Head: relayHead, Signature: other.ChainSignature}
+	if err := p.Received_CLI_ALL_DOWNSTREAM_CHAIN_HEAD(otherHead); err != nil {
+		t.Fatal(err)
+	}
+	proofs := p.clientState.downstreamChainWitness.Proofs
+	if len(proofs) != 1 || proofs[0].Verify() != nil {
+		t.Fatal("the client should find that the relay equivocated in round 2")
+	}
+
+	// the same head is fine, a head not signed by the relay is not
+	same := ownHead
+	same.ClientID = 2
+	if err := p.Received_CLI_ALL_DOWNSTREAM_CHAIN_HEAD(same); err != nil || len(p.clientState.downstreamChainWitness.Proofs) != 1 {
+		t.Error("the same head should not be an equivocation,", err)
+	}
+	forged := otherHead
+	forged.Signature = ownHead.Signature
+	if p.Received_CLI_ALL_DOWNSTREAM_CHAIN_HEAD(forged) == nil {
+		t.Error("a head not signed by the relay should be refused")
+	}
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/crypto"
+)
+
+func TestDownstreamEncryption(t *testing.T) {
+
+	p := &PriFiLibClientInstance{clientState: &ClientState{downstreamKeys: make(map[string]*downstreamKey)}}
+	payloadSize := 20
+
+	// nothing to send, no key
+	cell := p.appendDownstreamKey(make([]byte, payloadSize), payloadSize)
+	if len(cell) != payloadSize+crypto.DOWNSTREAM_KEY_SIZE || !bytes.Equal(cell, make([]byte, len(cell))) {
+		t.Error("An empty slot should not carry a key")
+	}
+
+	streamA := []byte("AAAAhello")
+	cellA := p.appendDownstreamKey(streamA, payloadSize)
+	if len(cellA) != payloadSize+crypto.DOWNSTREAM_KEY_SIZE || !bytes.Equal(cellA[:len(streamA)], streamA) {
+		t.Fatal("The data should be padded, then followed by the key")
+	}
+	keyA := cellA[payloadSize:]
+	if bytes.Equal(keyA, make([]byte, crypto.DOWNSTREAM_KEY_SIZE)) {
+		t.Fatal("The key is missing")
+	}
+	if !bytes.Equal(p.appendDownstreamKey([]byte("AAAAagain"), payloadSize)[payloadSize:], keyA) {
+		t.Error("A stream should keep its key")
+	}
+	keyB := p.appendDownstreamKey([]byte("BBBBhello"), payloadSize)[payloadSize:]
+	if bytes.Equal(keyA, keyB) {
+		t.Error("Each stream should have its own key")
+	}
+
+	// what the relay does
+	var public [crypto.DOWNSTREAM_KEY_SIZE]byte
+	copy(public[:], keyB)
+	answer := []byte("BBBBanswer")
+	encrypted, err := crypto.EncryptDownstream(&public, answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, forUs := p.decryptDownstream(encrypted)
+	if !forUs || !bytes.Equal(decrypted, answer) {
+		t.Error("The client should decrypt the answer on its stream")
+	}
+
+	// another client's answer
+	other, _ := crypto.NewDownstreamKey()
+	encrypted, _ = crypto.EncryptDownstream(other.Public, answer)
+	if _, forUs := p.decryptDownstream(encrypted); forUs {
+		t.Error("The client should not accept an answer for another client")
+	}
+}
@@ -0,0 +1,133 @@
+package client
+
+/*
+Key epochs
+**********
+Periodically, the relay rotates the DC-net keys and the slots without restarting the protocol. While the current
+epoch keeps carrying traffic, the client :
+
+- REL_CLI_EPOCH_START - derives a fresh key pair (for the DC-net secrets) and a fresh ephemeral key pair (for the
+  shuffle), and sends the public keys to the relay
+- REL_ALL_EPOCH_SWITCH - verifies the trustees' signatures on the shuffle, finds its new slot, and schedules the switch
+  to the new shared secrets in the DC-net. The new slot is used from the first round of the epoch on.
+*/
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/scheduler"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// clientEpoch holds the keys and slot of the key epoch being prepared
+type clientEpoch struct {
+	ID                    int32
+	BoundaryRound         int32 // -1 until the relay announces it
+	privateKey            kyber.Scalar
+	PublicKey             kyber.Point
+	ephemeralPrivateKey   kyber.Scalar
+	EphemeralPublicKey    kyber.Point
+	TrusteeDCNetPublicKey []kyber.Point
+	sharedSecrets         []kyber.Point
+	EphemeralPublicKeys   []kyber.Point
+	MySlot                int
+}
+
+/*
+Received_REL_CLI_EPOCH_START handles REL_CLI_EPOCH_START messages.
+We generate fresh keys for the next key epoch, and send the public parts to the relay.
+*/
+func (p *PriFiLibClientInstance) Received_REL_CLI_EPOCH_START(msg net.REL_CLI_EPOCH_START) error {
+
+	epoch := &clientEpoch{
+		ID:            msg.Epoch,
+		BoundaryRound: -1,
+		MySlot:        -1,
+	}
+	epoch.PublicKey, epoch.privateKey = crypto.NewKeyPair()
+	epoch.EphemeralPublicKey, epoch.ephemeralPrivateKey = crypto.NewKeyPair()
+	p.clientState.epoch = epoch
+
+	toSend := &net.CLI_REL_EPOCH_PK_AND_EPH_PK{
+		Epoch:    msg.Epoch,
+		ClientID: p.clientState.ID,
+		Pk:       epoch.PublicKey,
+		EphPk:    epoch.EphemeralPublicKey,
+	}
+	p.messageSender.SendToRelayWithLog(toSend, "(epoch "+strconv.Itoa(int(msg.Epoch))+")")
+
+	return nil
+}
+
+/*
+Received_REL_ALL_EPOCH_SWITCH handles REL_ALL_EPOCH_SWITCH messages.
+Like after the setup's shuffle, we check the trustees' signatures and locate our slot. The DC-net will encode the
+rounds from BoundaryRound on with the new shared secrets, and the new payload size.
+*/
+func (p *PriFiLibClientInstance) Received_REL_ALL_EPOCH_SWITCH(msg net.REL_ALL_EPOCH_SWITCH) error {
+
+	epoch := p.clientState.epoch
+	if epoch == nil || epoch.ID != msg.Epoch {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : received the switch to epoch " +
+			strconv.Itoa(int(msg.Epoch)) + ", which we did not prepare")
+	}
+	if len(msg.TrusteesPks) != p.clientState.nTrustees {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : epoch " + strconv.Itoa(int(msg.Epoch)) +
+			" has " + strconv.Itoa(len(msg.TrusteesPks)) + " trustee keys, expected " + strconv.Itoa(p.clientState.nTrustees))
+	}
+
+	// the trustees sign the shuffle with their long-term keys
+	neff := new(scheduler.NeffShuffle)
+	mySlot, err := neff.ClientVerifySigAndRecognizeSlot(epoch.ephemeralPrivateKey, p.clientState.TrusteePublicKey, msg.Base, msg.EphPks, msg.GetSignatures())
+	if err != nil {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : can't recognize our slot in epoch " +
+			strconv.Itoa(int(msg.Epoch)) + ", error is " + err.Error())
+	}
+
+	sharedSecrets := make([]kyber.Point, len(msg.TrusteesPks))
+	for i := range msg.TrusteesPks {
+		sharedSecrets[i] = config.CryptoSuite.Point().Mul(epoch.privateKey, msg.TrusteesPks[i])
+	}
+	if err := p.clientState.DCNet.SetNextEpoch(msg.BoundaryRound, sharedSecrets, msg.PayloadSize); err != nil {
+		return errors.New("Client " + strconv.Itoa(p.clientState.ID) + " : cannot switch to epoch " +
+			strconv.Itoa(int(msg.Epoch)) + ", error is " + err.Error())
+	}
+
+	epoch.BoundaryRound = msg.BoundaryRound
+	epoch.TrusteeDCNetPublicKey = msg.TrusteesPks
+	epoch.sharedSecrets = sharedSecrets
+	epoch.EphemeralPublicKeys = msg.EphPks
+	epoch.MySlot = mySlot
+
+	log.Lvl2("Client " + strconv.Itoa(p.clientState.ID) + " : epoch " + strconv.Itoa(int(msg.Epoch)) +
+		" starts at round " + strconv.Itoa(int(msg.BoundaryRound)) + ", payload size " +
+		strconv.Itoa(p.clientState.DCNet.PayloadSizeOfRound(msg.BoundaryRound)))
+
+	return nil
+}
+
+// switchEpochIfNeeded makes the prepared key epoch the current one, once roundID reaches its boundary. The DC-net
+// switches by itself; this updates our slot, and the keys used to reveal the shared secrets in case of disruption.
+func (p *PriFiLibClientInstance) switchEpochIfNeeded(roundID int32) {
+	epoch := p.clientState.epoch
+	if epoch == nil || epoch.BoundaryRound < 0 || roundID < epoch.BoundaryRound {
+		return
+	}
+
+	p.clientState.privateKey = epoch.privateKey
+	p.clientState.PublicKey = epoch.PublicKey
+	p.clientState.ephemeralPrivateKey = epoch.ephemeralPrivateKey
+	p.clientState.EphemeralPublicKey = epoch.EphemeralPublicKey
+	p.clientState.TrusteeDCNetPublicKey = epoch.TrusteeDCNetPublicKey
+	p.clientState.sharedSecrets = epoch.sharedSecrets
+	p.clientState.EphemeralPublicKeys = epoch.EphemeralPublicKeys
+	p.clientState.MySlot = epoch.MySlot
+	p.clientState.epoch = nil
+
+	log.Lvl2("Client "+strconv.Itoa(p.clientState.ID)+" : switched to epoch", epoch.ID, "in round", roundID, ", new slot is", epoch.MySlot)
+}
@@ -12,17 +12,22 @@ package client
  * - REL_CLI_TELL_TRUSTEES_PK - the trustee's identities. We react by sending our identity + ephemeral identity
  * - REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG - the shuffle from the trustees. We do some check, if they pass, we can communicate. We send the first round to the relay.
  * - REL_CLI_DOWNSTREAM_DATA - the data from the relay, for one round. We react by finishing the round (sending our data to the relay)
+ * - REL_CLI_DOWNSTREAM_FRAGMENT - a part of the data from the relay, broadcast by UDP (see broadcast.go)
+ * - CLI_ALL_DOWNSTREAM_CHAIN_HEAD - the head of the downstream chain of another client, signed by the relay (see downstream_chain.go)
  *
  * local functions :
  *
  * ProcessDownStreamData() <- is called by Received_REL_CLI_DOWNSTREAM_DATA; it handles the raw data received
  * SendUpstreamData() <- it is called at the end of ProcessDownStreamData(). Hence, after getting some data down, we send some data up.
  *
- * TODO : traffic need to be encrypted
+ * With DownstreamEncryptionEnabled, the data for our streams is encrypted to keys we put in our upstream cells (see downstream.go)
+ * With UpstreamCompressionEnabled, we compress the data we send in our slot (see compression.go)
+ * The downstream cells must be signed by the relay, if it gave us its key (see downstream_chain.go)
  */
 
 import (
 	"errors"
+	"github.com/dedis/prifi/prifi-lib/compression"
 	"github.com/dedis/prifi/prifi-lib/crypto"
 	"github.com/dedis/prifi/prifi-lib/dcnet"
 	prifilog "github.com/dedis/prifi/prifi-lib/log"
@@ -32,6 +37,7 @@ import (
 	"go.dedis.ch/onet/v3/log"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -46,6 +52,7 @@ type ClientState struct {
 	HashFromPreviousMessage       [32]byte
 	MyLastRound                   int32
 	LastMessage                   []byte
+	LastMessageRoundID            int32 // the round in which we sent LastMessage, blamed if it is disrupted
 	B_echo_last                   byte
 	DisruptionWrongBitPosition    int
 	ephemeralPrivateKey           kyber.Scalar
@@ -59,11 +66,14 @@ type ClientState struct {
 	PayloadSize                   int
 	privateKey                    kyber.Scalar
 	PublicKey                     kyber.Point
+	identityKey                   kyber.Scalar   // the private key of our server identity, see SetIdentities
+	identities                    net.Identities // the keys of the server identities of everyone, see SetIdentities
+	session                       int            // drawn by the relay at each setup, what we sign is bound to it
 	sharedSecrets                 []kyber.Point
 	TrusteePublicKey              []kyber.Point
+	TrusteeDCNetPublicKey         []kyber.Point // the shared secrets derive from those keys, which change with every key epoch
 	UseSocksProxy                 bool
 	UseUDP                        bool
-	MessageHistory                kyber.XOF
 	StartStopReceiveBroadcast     chan bool
 	timeStatistics                map[string]*prifilog.TimeStatistics
 	pcapReplay                    *PCAPReplayer
@@ -71,9 +81,39 @@ type ClientState struct {
 	LastWantToSend                time.Time
 	EquivocationProtectionEnabled bool
 	EphemeralPublicKeys           []kyber.Point
+	dcNetType                     string
+	dcNetPadGenerator             string
+	epoch                         *clientEpoch // the key epoch being prepared, nil if none
+	// reliable UDP broadcast
+	udpLock                sync.Mutex
+	downstreamReassembler  *net.DownstreamReassembler
+	downstreamNACKs        map[int32]int // number of NACKs sent for each round
+	downstreamLastNACK     map[int32]time.Time
+	downstreamLastProgress time.Time
+	downstreamReceiving    bool // whether a fragment of the broadcast arrived, before that we do not ask for any
+	// downstream encryption
+	DownstreamEncryptionEnabled bool
+	downstreamKeys              map[string]*downstreamKey // stream tag -> the key we gave the relay
+	// upstream compression
+	UpstreamCompressionEnabled bool
+	packer                     *compression.Packer
+	// accountable downstream, see downstream_chain.go
+	DownstreamChainEnabled bool // we refuse the downstream cells not signed by the relay's server identity
+	DownstreamGossipPeriod int  // we send the head of the downstream chain every that many rounds, 0 to never send it
+	downstreamChainHead    []byte
+	downstreamChainRound   int32 // the round of the last cell in downstreamChainHead
+	downstreamChainWitness *net.DownstreamChainWitness
+	// open-closed slots
+	OpenClosedSlotsMaxLength int
+	OpenClosedSlotsScheduler string
+	OpenClosedSlotsPositions int
+	footprintScheduled       bool // with footprints, the relay announces the positions of the last schedule
+	footprintOwnerID         int
+	// the blame we revealed our bits for, see disruption.go
+	blame *revealedBits
 	// TEST DISRUPTION
 	ForceDisruptionSinceRound3 bool
-	AllreadyDisrupted          bool
+	DisruptionCooldown         int // the slots of others to leave alone before disrupting again
 
 	//concurrent stuff
 	RoundNo           int32
@@ -98,7 +138,7 @@ type PriFiLibClientInstance struct {
 }
 
 // NewClient creates a new PriFi client entity state.
-func NewClient(doLatencyTest bool, dataOutputEnabled bool, dataForDCNet chan []byte, dataFromDCNet chan []byte, doReplayPcap bool, pcapFolder string, msgSender *net.MessageSenderWrapper) *PriFiLibClientInstance {
+func NewClient(doLatencyTest bool, dataOutputEnabled bool, dataForDCNet chan []byte, dataFromDCNet chan []byte, doReplayPcap bool, pcapFolder string, downstreamChainEnabled bool, msgSender *net.MessageSenderWrapper) *PriFiLibClientInstance {
 
 	clientState := new(ClientState)
 
@@ -119,6 +159,7 @@ func NewClient(doLatencyTest bool, dataOutputEnabled bool, dataForDCNet chan []b
 	clientState.NextDataForDCNet = nil
 	clientState.DataFromDCNet = dataFromDCNet
 	clientState.DataOutputEnabled = dataOutputEnabled
+	clientState.DownstreamChainEnabled = downstreamChainEnabled
 	clientState.LastWantToSend = time.Now()
 	clientState.pcapReplay = &PCAPReplayer{
 		Enabled:    doReplayPcap,
@@ -150,6 +191,12 @@ func NewClient(doLatencyTest bool, dataOutputEnabled bool, dataForDCNet chan []b
 	return &prifi
 }
 
+// SetIdentities gives the client the private key of its server identity, and the keys of the others
+func (p *PriFiLibClientInstance) SetIdentities(privateKey kyber.Scalar, identities net.Identities) {
+	p.clientState.identityKey = privateKey
+	p.clientState.identities = identities
+}
+
 // ReceivedMessage must be called when a PriFi host receives a message.
 // It takes care to call the correct message handler function.
 func (p *PriFiLibClientInstance) ReceivedMessage(msg interface{}) error {
@@ -171,6 +218,10 @@ func (p *PriFiLibClientInstance) ReceivedMessage(msg interface{}) error {
 		if p.stateMachine.AssertState("READY") {
 			err = p.Received_REL_CLI_UDP_DOWNSTREAM_DATA(typedMsg)
 		}
+	case net.REL_CLI_DOWNSTREAM_FRAGMENT:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_CLI_DOWNSTREAM_FRAGMENT(typedMsg)
+		}
 	case net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG:
 		if p.stateMachine.AssertState("EPH_KEYS_SENT") {
 			err = p.Received_REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG(typedMsg)
@@ -183,6 +234,16 @@ func (p *PriFiLibClientInstance) ReceivedMessage(msg interface{}) error {
 		if p.stateMachine.AssertState("READY") {
 			err = p.Received_REL_ALL_REVEAL_SHARED_SECRETS(typedMsg)
 		}
+	case net.REL_CLI_EPOCH_START:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_CLI_EPOCH_START(typedMsg)
+		}
+	case net.REL_ALL_EPOCH_SWITCH:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_ALL_EPOCH_SWITCH(typedMsg)
+		}
+	case net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD:
+		err = p.Received_CLI_ALL_DOWNSTREAM_CHAIN_HEAD(typedMsg)
 	default:
 		err = errors.New("Unrecognized message, type" + reflect.TypeOf(msg).String())
 	}
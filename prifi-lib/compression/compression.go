@@ -0,0 +1,151 @@
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+)
+
+/**
+ * Upstream compression. Every byte of an upstream cell costs XOR work to every client and trustee, and most upstream
+ * traffic is small headers, so the owner of a slot can compress what it sends. The cell then starts with a flag:
+ *
+ *	[FLAG_RAW][one message, padded with zeros]
+ *	[FLAG_DEFLATE][DEFLATE, with a shared dictionary, of [2-byte length][message][2-byte length][message]...][zeros]
+ *
+ * The messages are the ones of DataForDCNet (frames of the stream-multiplexer); a compressed cell can carry several of
+ * them. A message that does not compress goes raw, so the messages can have the size of the cell, minus the flag.
+ */
+
+// FLAG_SIZE is the room the flag takes in a cell
+const FLAG_SIZE = 1
+
+const (
+	// FLAG_RAW : the rest of the cell is one message
+	FLAG_RAW = 0
+	// FLAG_DEFLATE : the rest of the cell is a compressed batch of messages
+	FLAG_DEFLATE = 1
+)
+
+// MAX_MESSAGES_PER_CELL bounds the messages we try to put in one compressed cell
+const MAX_MESSAGES_PER_CELL = 16
+
+// dictionary holds strings common in upstream traffic: the start of TLS records and handshakes, and of HTTP requests.
+// The most common go last, where DEFLATE finds them with the shortest distances
+var dictionary = []byte("" +
+	"Accept-Language: en-US,en;q=0.9\r\nAccept-Encoding: gzip, deflate, br\r\nCache-Control: no-cache\r\n" +
+	"Content-Type: application/x-www-form-urlencoded\r\nContent-Length: \r\nCookie: \r\nReferer: https://\r\n" +
+	"Upgrade-Insecure-Requests: 1\r\nUser-Agent: Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko)" +
+	" Chrome/ Safari/537.36\r\nAccept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\n" +
+	"Connection: keep-alive\r\nHost: www.\r\nGET / HTTP/1.1\r\nPOST / HTTP/1.1\r\n" +
+	"\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03\x00\x00\x00\x00\x00\x00\x00\x00\x13\x01\x13\x02\x13\x03" +
+	"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00" +
+	"\x14\x03\x03\x00\x01\x01\x17\x03\x03\x00\x00\x17\x03\x03")
+
+// Packer compresses the messages of a slot owner into its cells
+type Packer struct {
+	writer *flate.Writer
+	buffer bytes.Buffer
+}
+
+// NewPacker creates a Packer
+func NewPacker() *Packer {
+	p := new(Packer)
+	p.writer, _ = flate.NewWriterDict(&p.buffer, flate.BestCompression, dictionary)
+	return p
+}
+
+// compress returns the compressed batch of the messages
+func (p *Packer) compress(messages [][]byte) []byte {
+	p.buffer.Reset()
+	p.writer.Reset(&p.buffer)
+	length := make([]byte, 2)
+	for _, m := range messages {
+		binary.BigEndian.PutUint16(length, uint16(len(m)))
+		p.writer.Write(length)
+		p.writer.Write(m)
+	}
+	p.writer.Close()
+	return p.buffer.Bytes()
+}
+
+// Pack returns a cell of cellSize bytes with as many of the messages as fit once compressed, and how many it holds.
+// If even the first message does not compress, the cell holds only it, raw (truncated if it is too long)
+func (p *Packer) Pack(messages [][]byte, cellSize int) ([]byte, int) {
+	cell := make([]byte, cellSize)
+	if len(messages) == 0 || cellSize <= FLAG_SIZE {
+		return cell, 0
+	}
+
+	// an empty slot stays all zeros
+	if len(messages) == 1 && DataLength(messages[0]) == 0 {
+		return cell, 1
+	}
+
+	n := 0
+	var compressed []byte
+	for n < len(messages) && n < MAX_MESSAGES_PER_CELL && len(messages[n]) <= 0xffff {
+		c := p.compress(messages[:n+1])
+		if FLAG_SIZE+len(c) > cellSize {
+			break
+		}
+		compressed = append(compressed[:0], c...)
+		n++
+	}
+
+	// compressing one message is only worth it if it saves room
+	if n > 1 || n == 1 && len(compressed) < len(messages[0]) {
+		cell[0] = FLAG_DEFLATE
+		copy(cell[FLAG_SIZE:], compressed)
+		return cell, n
+	}
+	cell[0] = FLAG_RAW
+	copy(cell[FLAG_SIZE:], messages[0])
+	return cell, 1
+}
+
+// Unpack returns the messages of a cell. A raw message keeps its padding
+func Unpack(cell []byte) ([][]byte, error) {
+	if len(cell) < FLAG_SIZE {
+		return nil, errors.New("compression: empty cell")
+	}
+	switch cell[0] {
+	case FLAG_RAW:
+		return [][]byte{cell[FLAG_SIZE:]}, nil
+	case FLAG_DEFLATE:
+	default:
+		return nil, errors.New("compression: unknown flag")
+	}
+
+	// the padding after the compressed data is never read
+	reader := flate.NewReaderDict(bytes.NewReader(cell[FLAG_SIZE:]), dictionary)
+	batch, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.New("compression: invalid batch, " + err.Error())
+	}
+
+	messages := make([][]byte, 0)
+	for len(batch) > 0 {
+		if len(batch) < 2 {
+			return nil, errors.New("compression: invalid batch")
+		}
+		length := int(binary.BigEndian.Uint16(batch[0:2]))
+		if 2+length > len(batch) {
+			return nil, errors.New("compression: invalid batch")
+		}
+		messages = append(messages, batch[2:2+length])
+		batch = batch[2+length:]
+	}
+	return messages, nil
+}
+
+// DataLength is the length of a message without its padding of zeros
+func DataLength(message []byte) int {
+	n := len(message)
+	for n > 0 && message[n-1] == 0 {
+		n--
+	}
+	return n
+}
@@ -0,0 +1,74 @@
+package compression
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestPackUnpack(t *testing.T) {
+
+	p := NewPacker()
+	cellSize := 500
+
+	// small headers share a cell
+	messages := [][]byte{
+		[]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\nUser-Agent: Mozilla/5.0\r\nAccept: */*\r\n\r\n"),
+		{0x17, 0x03, 0x03, 0x00, 0x05, 1, 2, 3, 4, 5},
+		[]byte("GET /style.css HTTP/1.1\r\nHost: www.example.com\r\nUser-Agent: Mozilla/5.0\r\nAccept: */*\r\n\r\n"),
+	}
+	cell, n := p.Pack(messages, cellSize)
+	if len(cell) != cellSize || n != 3 || cell[0] != FLAG_DEFLATE {
+		t.Fatal("The messages should be compressed together", n, cell[0])
+	}
+	unpacked, err := Unpack(cell)
+	if err != nil || len(unpacked) != 3 {
+		t.Fatal("Wrong batch", len(unpacked), err)
+	}
+	for i := range messages {
+		if !bytes.Equal(unpacked[i], messages[i]) {
+			t.Error("Wrong message", i, string(unpacked[i]))
+		}
+	}
+
+	// random data does not compress, it goes raw
+	random := make([]byte, cellSize-FLAG_SIZE)
+	rand.Read(random)
+	cell, n = p.Pack([][]byte{random, messages[0]}, cellSize)
+	if n != 1 || cell[0] != FLAG_RAW || !bytes.Equal(cell[FLAG_SIZE:], random) {
+		t.Error("Random data should go raw", n, cell[0])
+	}
+	unpacked, err = Unpack(cell)
+	if err != nil || len(unpacked) != 1 || !bytes.Equal(unpacked[0], random) {
+		t.Error("Wrong raw message", err)
+	}
+
+	// only what fits goes in the cell
+	many := make([][]byte, 0)
+	for i := 0; i < 10; i++ {
+		m := make([]byte, 100)
+		rand.Read(m)
+		many = append(many, m)
+	}
+	cell, n = p.Pack(many, cellSize)
+	unpacked, err = Unpack(cell)
+	if n < 2 || n > 4 || err != nil || len(unpacked) != n || !bytes.Equal(unpacked[n-1], many[n-1]) {
+		t.Error("Wrong partial batch", n, len(unpacked), err)
+	}
+
+	// an empty slot stays empty
+	cell, n = p.Pack([][]byte{make([]byte, 100)}, cellSize)
+	if n != 1 || !bytes.Equal(cell, make([]byte, cellSize)) {
+		t.Error("An empty slot should stay zeros")
+	}
+
+	if _, err := Unpack([]byte{FLAG_DEFLATE, 0xff, 0xff, 0xff}); err == nil {
+		t.Error("Invalid data should not unpack")
+	}
+	if _, err := Unpack([]byte{7, 0, 0}); err == nil {
+		t.Error("An unknown flag should not unpack")
+	}
+	if DataLength([]byte{1, 0, 2, 0, 0}) != 3 {
+		t.Error("Wrong data length")
+	}
+}
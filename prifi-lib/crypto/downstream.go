@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+/**
+ * Downstream encryption. The owner of a slot puts an ephemeral public key in its upstream cell; the relay encrypts the
+ * answers to that key, in a sealed box, so only that client can read them. The relay does not learn who the client is,
+ * since the key came out of the DC-net.
+ */
+
+// DOWNSTREAM_KEY_SIZE is the size of the ephemeral public key in an upstream cell
+const DOWNSTREAM_KEY_SIZE = 32
+
+// DOWNSTREAM_KEY_HINT_SIZE is the size of the hint telling which key a downstream cell is encrypted to
+const DOWNSTREAM_KEY_HINT_SIZE = 4
+
+// DOWNSTREAM_ENCRYPTION_OVERHEAD is how much longer an encrypted downstream cell is: the hint, the length, and the
+// sender's ephemeral key and authenticator of the sealed box
+const DOWNSTREAM_ENCRYPTION_OVERHEAD = DOWNSTREAM_KEY_HINT_SIZE + 4 + box.AnonymousOverhead
+
+// DownstreamKey is an ephemeral key pair to which the relay encrypts downstream data
+type DownstreamKey struct {
+	Public  *[DOWNSTREAM_KEY_SIZE]byte
+	private *[DOWNSTREAM_KEY_SIZE]byte
+}
+
+// NewDownstreamKey creates a fresh ephemeral key pair
+func NewDownstreamKey() (*DownstreamKey, error) {
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &DownstreamKey{Public: public, private: private}, nil
+}
+
+// DownstreamKeyHint returns the hint identifying a public key in a downstream cell
+func DownstreamKeyHint(public *[DOWNSTREAM_KEY_SIZE]byte) []byte {
+	h := sha256.Sum256(public[:])
+	return h[:DOWNSTREAM_KEY_HINT_SIZE]
+}
+
+// EncryptDownstream encrypts data to the public key, as [hint][length of the box][box]. Anything after the box (e.g.
+// padding) is ignored by DecryptDownstream
+func EncryptDownstream(public *[DOWNSTREAM_KEY_SIZE]byte, data []byte) ([]byte, error) {
+	sealed, err := box.SealAnonymous(nil, data, public, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, DOWNSTREAM_KEY_HINT_SIZE+4, DOWNSTREAM_KEY_HINT_SIZE+4+len(sealed))
+	copy(out, DownstreamKeyHint(public))
+	binary.BigEndian.PutUint32(out[DOWNSTREAM_KEY_HINT_SIZE:], uint32(len(sealed)))
+	return append(out, sealed...), nil
+}
+
+// IsFor tells if an encrypted downstream cell is for this key, by its hint
+func (k *DownstreamKey) IsFor(cell []byte) bool {
+	if len(cell) < DOWNSTREAM_KEY_HINT_SIZE {
+		return false
+	}
+	hint := DownstreamKeyHint(k.Public)
+	for i := range hint {
+		if hint[i] != cell[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// DecryptDownstream decrypts a cell produced by EncryptDownstream
+func (k *DownstreamKey) DecryptDownstream(cell []byte) ([]byte, error) {
+	if len(cell) < DOWNSTREAM_ENCRYPTION_OVERHEAD {
+		return nil, errors.New("encrypted downstream cell too short")
+	}
+	length := int(binary.BigEndian.Uint32(cell[DOWNSTREAM_KEY_HINT_SIZE:]))
+	sealed := cell[DOWNSTREAM_KEY_HINT_SIZE+4:]
+	if length < box.AnonymousOverhead || length > len(sealed) {
+		return nil, errors.New("encrypted downstream cell has an invalid length")
+	}
+	data, ok := box.OpenAnonymous(nil, sealed[:length], k.Public, k.private)
+	if !ok {
+		return nil, errors.New("cannot decrypt the downstream cell")
+	}
+	return data, nil
+}
@@ -0,0 +1,52 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDownstreamEncryption(t *testing.T) {
+
+	alice, err := NewDownstreamKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, _ := NewDownstreamKey()
+
+	data := []byte("downstream data for alice")
+	cell, err := EncryptDownstream(alice.Public, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cell) != len(data)+DOWNSTREAM_ENCRYPTION_OVERHEAD {
+		t.Error("Wrong overhead", len(cell)-len(data))
+	}
+	if bytes.Contains(cell, data) {
+		t.Error("The cell contains the data in clear")
+	}
+
+	if !alice.IsFor(cell) || bob.IsFor(cell) {
+		t.Error("The hint should designate alice only")
+	}
+
+	// padding after the box is ignored
+	padded := append(cell, make([]byte, 100)...)
+	decrypted, err := alice.DecryptDownstream(padded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Error("Decrypted", decrypted, "instead of", data)
+	}
+
+	if _, err := bob.DecryptDownstream(cell); err == nil {
+		t.Error("Bob should not decrypt alice's cell")
+	}
+	cell[len(cell)-1]++
+	if _, err := alice.DecryptDownstream(cell); err == nil {
+		t.Error("A modified cell should not decrypt")
+	}
+	if _, err := alice.DecryptDownstream(cell[:DOWNSTREAM_ENCRYPTION_OVERHEAD-1]); err == nil {
+		t.Error("A truncated cell should not decrypt")
+	}
+}
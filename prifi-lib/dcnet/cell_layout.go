@@ -0,0 +1,144 @@
+package dcnet
+
+/*
+Upstream cell layout
+********************
+The cipher a client or trustee sends for a round (see DCNetCipher.ToBytes) is
+
+	| header (CIPHER_HEADER_SIZE) | equivocation tag (with the equivocation protection) | DC-net payload |
+
+where the header gives the start of the tag (-1 if there is none) and of the DC-net payload, which has
+PayloadSizeOfRound bytes. The DC-net payloads of all ciphers XOR to the payload of the slot owner, which is
+
+	| b_echo_last flag (B_ECHO_FLAG_SIZE, with the disruption protection) | data (DataSize) |
+
+The equivocation protection seals these bytes with AES-GCM, which adds EQUIVOCATION_OVERHEAD bytes; hence the data is
+shorter, and the DC-net payload keeps its size.
+
+The disruption protection works on the DC-net payload as it is XORed, before the relay unseals it: the slot owner
+checks the hash of it, the relay echoes it back, and a blame gives the position of a bit in it (see PayloadBit). The
+pads are XORed there too, so every client and trustee finds the bits of its pads at that same position.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// CIPHER_HEADER_SIZE is the size of the header of a cipher, see DCNetCipher.ToBytes
+const CIPHER_HEADER_SIZE = 8
+
+// B_ECHO_FLAG_SIZE is the size of the b_echo_last flag, at the start of the payload with the disruption protection
+const B_ECHO_FLAG_SIZE = 1
+
+// EQUIVOCATION_OVERHEAD is what the equivocation protection adds to the payload of the slot owner (the GCM tag)
+const EQUIVOCATION_OVERHEAD = 16
+
+// CellLayout gives the parts of the upstream cells of a round, given its payload size and the protections enabled
+type CellLayout struct {
+	PayloadSize            int // the size of the DC-net payload, see PayloadSizeOfRound
+	DisruptionProtection   bool
+	EquivocationProtection bool
+}
+
+// CellLayoutOfRound returns the layout of the cells of round roundID
+func (e *DCNetEntity) CellLayoutOfRound(roundID int32) CellLayout {
+	return CellLayout{
+		PayloadSize:            e.PayloadSizeOfRound(roundID),
+		DisruptionProtection:   e.DisruptionProtectionEnabled,
+		EquivocationProtection: e.EquivocationProtectionEnabled,
+	}
+}
+
+// flagSize is the size of the b_echo_last flag in this layout, 0 without the disruption protection
+func (l CellLayout) flagSize() int {
+	if l.DisruptionProtection {
+		return B_ECHO_FLAG_SIZE
+	}
+	return 0
+}
+
+// plaintextSize is the size of the payload of the slot owner before the equivocation protection seals it
+func (l CellLayout) plaintextSize() int {
+	if l.EquivocationProtection {
+		return l.PayloadSize - EQUIVOCATION_OVERHEAD
+	}
+	return l.PayloadSize
+}
+
+// DataSize is the number of bytes of data the slot owner can send in a cell
+func (l CellLayout) DataSize() int {
+	return l.plaintextSize() - l.flagSize()
+}
+
+// OwnerPayload is the payload the slot owner encodes: the b_echo_last flag (with the disruption protection), then the
+// data padded to DataSize
+func (l CellLayout) OwnerPayload(bEchoLast byte, data []byte) ([]byte, error) {
+	if l.DataSize() <= 0 {
+		return nil, errors.New("a payload of " + strconv.Itoa(l.PayloadSize) + " bytes leaves no room for data")
+	}
+	if len(data) > l.DataSize() {
+		return nil, errors.New("cannot send " + strconv.Itoa(len(data)) + " bytes, the cell has room for " + strconv.Itoa(l.DataSize()))
+	}
+	payload := make([]byte, l.plaintextSize())
+	if l.DisruptionProtection {
+		payload[0] = bEchoLast
+	}
+	copy(payload[l.flagSize():], data)
+	return payload, nil
+}
+
+// SplitPayload splits the payload of the slot owner, as decoded by the relay (and unsealed with the equivocation
+// protection), into the b_echo_last flag (0 without the disruption protection) and the data
+func (l CellLayout) SplitPayload(decoded []byte) (byte, []byte, error) {
+	if len(decoded) != l.plaintextSize() || len(decoded) < l.flagSize() {
+		return 0, nil, errors.New("decoded a payload of " + strconv.Itoa(len(decoded)) + " bytes instead of " + strconv.Itoa(l.plaintextSize()))
+	}
+	if !l.DisruptionProtection {
+		return 0, decoded, nil
+	}
+	return decoded[0], decoded[B_ECHO_FLAG_SIZE:], nil
+}
+
+// CipherPayload returns the DC-net payload of a cipher, see DCNetCipher.ToBytes
+func CipherPayload(cipher []byte) ([]byte, error) {
+	if len(cipher) < CIPHER_HEADER_SIZE {
+		return nil, errors.New("the cipher is shorter than its header")
+	}
+	payloadStart := int(binary.BigEndian.Uint32(cipher[4:8]))
+	if payloadStart < CIPHER_HEADER_SIZE || payloadStart > len(cipher) {
+		return nil, errors.New("the cipher has an invalid header")
+	}
+	return cipher[payloadStart:], nil
+}
+
+// PayloadBit returns the bit at bitPos of a DC-net payload (or of a pad), counting from the most significant bit of
+// its first byte
+func PayloadBit(payload []byte, bitPos int) (int, error) {
+	if bitPos < 0 || bitPos/8 >= len(payload) {
+		return 0, errors.New("bit position " + strconv.Itoa(bitPos) + " is out of the payload of " + strconv.Itoa(len(payload)) + " bytes")
+	}
+	mask := byte(0x80 >> uint(bitPos%8))
+	if payload[bitPos/8]&mask == 0 {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+// FirstFlippedBit returns the position (see PayloadBit) of the first bit that is 0 in sent and 1 in received, or -1 if
+// there is none. Only such bits can be blamed: the pads XOR to 1 there, and nobody can claim it is its data.
+func FirstFlippedBit(sent []byte, received []byte) int {
+	for index := 0; index < len(sent) && index < len(received); index++ {
+		flipped := ^sent[index] & received[index]
+		if flipped == 0 {
+			continue
+		}
+		for j := 0; j < 8; j++ {
+			if flipped&(0x80>>uint(j)) != 0 {
+				return index*8 + j
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,180 @@
+package dcnet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPayloadBit(t *testing.T) {
+	payload := []byte{0x80, 0x01, 0x00}
+	for bitPos, expected := range map[int]int{0: 1, 1: 0, 7: 0, 8: 0, 15: 1, 23: 0} {
+		if bit, err := PayloadBit(payload, bitPos); err != nil || bit != expected {
+			t.Error("bit", bitPos, "should be", expected, ", got", bit, err)
+		}
+	}
+	for _, bitPos := range []int{-1, 24} {
+		if _, err := PayloadBit(payload, bitPos); err == nil {
+			t.Error("bit", bitPos, "is out of the payload")
+		}
+	}
+}
+
+func TestFirstFlippedBit(t *testing.T) {
+	if pos := FirstFlippedBit([]byte{0x00, 0x00}, []byte{0x00, 0x00}); pos != -1 {
+		t.Error("nothing was flipped, got", pos)
+	}
+	// 1->0 flips cannot be blamed
+	if pos := FirstFlippedBit([]byte{0xFF, 0x00}, []byte{0x7F, 0x00}); pos != -1 {
+		t.Error("a 1->0 flip should be ignored, got", pos)
+	}
+	if pos := FirstFlippedBit([]byte{0xFF, 0x00}, []byte{0x7F, 0x20}); pos != 10 {
+		t.Error("bit 10 was flipped, got", pos)
+	}
+	if pos := FirstFlippedBit([]byte{0x00}, []byte{0x80}); pos != 0 {
+		t.Error("bit 0 was flipped, got", pos)
+	}
+	// only the common part is compared
+	if pos := FirstFlippedBit([]byte{0x00}, []byte{0x00, 0xFF}); pos != -1 {
+		t.Error("the bytes after the message should be ignored, got", pos)
+	}
+}
+
+func TestCipherPayload(t *testing.T) {
+	c := &DCNetCipher{Payload: []byte{1, 2, 3}, EquivocationProtectionTag: []byte{4, 5}}
+	payload, err := CipherPayload(c.ToBytes())
+	if err != nil || !bytes.Equal(payload, c.Payload) {
+		t.Error("the payload of the cipher should be", c.Payload, ", got", payload, err)
+	}
+	if _, err := CipherPayload([]byte{0, 0, 0}); err == nil {
+		t.Error("a cipher shorter than its header should be refused")
+	}
+	if _, err := CipherPayload([]byte{0, 0, 0, 0, 0, 0, 0, 100}); err == nil {
+		t.Error("a payload starting after the cipher should be refused")
+	}
+}
+
+// TestCellLayout sends a message, then disrupts it, with every combination of the protections. The message must come
+// out of the DC-net intact, and the disrupted bit must be found at the same position in the payload of the slot owner,
+// in the ciphers, and in the pads.
+func TestCellLayout(t *testing.T) {
+	payloadSize := 100
+	for _, disruption := range []bool{false, true} {
+		for _, equivocation := range []bool{false, true} {
+			tg := NewTestGroup(t, equivocation, PAD_GENERATOR_XOF, payloadSize, 3, 2)
+			entities := []*DCNetEntity{tg.Relay.DCNetEntity}
+			for _, n := range append(tg.Clients, tg.Trustees...) {
+				entities = append(entities, n.DCNetEntity)
+			}
+			for _, e := range entities {
+				e.DisruptionProtectionEnabled = disruption
+			}
+			layout := tg.Relay.DCNetEntity.CellLayoutOfRound(0)
+
+			expectedDataSize := payloadSize
+			if disruption {
+				expectedDataSize -= B_ECHO_FLAG_SIZE
+			}
+			if equivocation {
+				expectedDataSize -= EQUIVOCATION_OVERHEAD
+			}
+			if layout.DataSize() != expectedDataSize {
+				t.Fatal("disruption", disruption, "equivocation", equivocation, ": the data size should be",
+					expectedDataSize, ", got", layout.DataSize())
+			}
+			if _, err := layout.OwnerPayload(1, make([]byte, layout.DataSize()+1)); err == nil {
+				t.Error("data bigger than the cell should be refused")
+			}
+
+			for roundID := int32(0); roundID < 2; roundID++ {
+				message := []byte("the slot owner sends this")
+				ownerPayload, err := layout.OwnerPayload(1, message)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// client 0 owns the slot, client 2 disrupts it in round 1
+				clientCiphers := make([][]byte, len(tg.Clients))
+				var plainPayload []byte
+				clientCiphers[0], plainPayload = tg.Clients[0].DCNetEntity.EncodeForRound(roundID, true, ownerPayload)
+				for i := 1; i < len(tg.Clients); i++ {
+					clientCiphers[i], _ = tg.Clients[i].DCNetEntity.EncodeForRound(roundID, false, nil)
+				}
+				disruptedBit := -1
+				if roundID == 1 {
+					for disruptedBit = 0; ; disruptedBit++ {
+						if bit, _ := PayloadBit(plainPayload, disruptedBit); bit == 0 {
+							break
+						}
+					}
+					payload, _ := CipherPayload(clientCiphers[2])
+					payload[disruptedBit/8] ^= 0x80 >> uint(disruptedBit%8)
+				}
+				trusteeCiphers := make([][]byte, len(tg.Trustees))
+				for j := range tg.Trustees {
+					trusteeCiphers[j] = tg.Trustees[j].DCNetEntity.TrusteeEncodeForRound(roundID)
+				}
+
+				relay := tg.Relay.DCNetEntity
+				relay.DecodeStart(roundID)
+				for _, c := range clientCiphers {
+					relay.DecodeClient(roundID, c)
+				}
+				for _, c := range trusteeCiphers {
+					relay.DecodeTrustee(roundID, c)
+				}
+				decoded, ciphertext := relay.DecodeCell(roundID, false)
+
+				if roundID == 0 {
+					// the message goes through, and the slot owner can check what the relay received
+					flag, data, err := layout.SplitPayload(decoded)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if disruption && flag != 1 {
+						t.Error("the b_echo_last flag should be 1, got", flag)
+					}
+					if !bytes.Equal(bytes.TrimRight(data, "\x00"), message) {
+						t.Error("disruption", disruption, "equivocation", equivocation, ": the data should be", message, ", got", data)
+					}
+					if !bytes.Equal(ciphertext, plainPayload) {
+						t.Error("the slot owner should know the DC-net payload the relay decodes")
+					}
+					continue
+				}
+
+				// the slot owner finds the disrupted bit by comparing what it sent with what the relay echoes
+				if pos := FirstFlippedBit(plainPayload, ciphertext); pos != disruptedBit {
+					t.Fatal("disruption", disruption, "equivocation", equivocation, ": bit", disruptedBit,
+						"was disrupted, the slot owner found", pos)
+				}
+
+				// the bits of the pads of each entity XOR to its cipher at that position, except for the disruptor
+				check := func(name string, e *DCNetEntity, cipher []byte, honest bool) {
+					bits, _ := e.GetBitsOfRound(roundID, int32(disruptedBit))
+					payload, err := CipherPayload(cipher)
+					if err != nil {
+						t.Fatal(err)
+					}
+					sent, err := PayloadBit(payload, disruptedBit)
+					if err != nil {
+						t.Fatal(err)
+					}
+					xor := 0
+					for _, bit := range bits {
+						xor ^= bit
+					}
+					if (xor == sent) != honest {
+						t.Error("disruption", disruption, "equivocation", equivocation, ":", name,
+							"revealed bits", bits, "for the bit", sent, "of its cipher")
+					}
+				}
+				for i, n := range tg.Clients {
+					check(n.name, n.DCNetEntity, clientCiphers[i], i != 2)
+				}
+				for j, n := range tg.Trustees {
+					check(n.name, n.DCNetEntity, trusteeCiphers[j], true)
+				}
+			}
+		}
+	}
+}
@@ -1,12 +1,14 @@
 package dcnet
 
 import (
+	"errors"
 	"fmt"
 	"github.com/dedis/prifi/prifi-lib/config"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/suites"
 	"go.dedis.ch/onet/v3/log"
 	"strconv"
+	"sync"
 )
 
 // Relay, Trustee or Client
@@ -29,29 +31,38 @@ type DCNetEntity struct {
 	EntityID                      int
 	Entity                        DCNET_ENTITY
 	EquivocationProtectionEnabled bool
-	DCNetPayloadSize              int
+	DisruptionProtectionEnabled   bool // only changes the layout of the cells, see CellLayoutOfRound
+	DCNetPayloadSize              int  // the payload size of the first epoch; see PayloadSizeOfRound
+	PadGeneratorType              string
 
 	cryptoSuite  suites.Suite
-	sharedKeys   []kyber.Point // keys shared with other DC-net members
-	sharedPRNGs  []kyber.XOF   // PRNGs shared with other DC-net members (seeded with sharedKeys)
-	currentRound int32
+	epochs       []*dcNetEpoch // keys shared with other DC-net members, one set per key epoch
+	currentRound int32         // the next round to be encoded (or decoded, by the relay)
 
-	//Used by the relay
-	DCNetRoundDecoder *DCNetRoundDecoder //nil if unused
+	//Used by the relay, one decoder per round being decoded
+	roundDecoders     map[int32]*DCNetRoundDecoder
+	roundDecodersLock sync.Mutex
 
 	//Equivocation protection
 	equivocationProtection    *EquivocationProtection //nil if unused
 	equivocationContribLength int                     //0 if equivocation protection is disabled
 
+	//Verifiable DC-net
+	verifiable *verifiableDCNet //nil if unused
+
 	verbose bool
 }
 
-// DCNetRoundDecoder is used by the relay to decode the dcnet ciphers
+// DCNetRoundDecoder is used by the relay to decode the dcnet ciphers of one round. The ciphers are folded in as
+// they arrive, so it only holds the accumulated XOR (and the equivocation tags)
 type DCNetRoundDecoder struct {
-	currentRoundBeingDecoded int32
-	xorBuffer                []byte
-	equivTrusteeContribs     [][]byte
-	equivClientContribs      [][]byte
+	sync.Mutex
+	roundID              int32
+	xorBuffer            []byte
+	equivTrusteeContribs [][]byte
+	equivClientContribs  [][]byte
+	equivHistory         kyber.Scalar  //the downstream history when the round was opened, nil if unused
+	pointBuffer          []kyber.Point //used by the verifiable DC-net
 }
 
 // Used by clients, trustees
@@ -60,6 +71,7 @@ func NewDCNetEntity(
 	entity DCNET_ENTITY,
 	PayloadSize int,
 	equivocationProtection bool,
+	padGeneratorType string,
 	sharedKeys []kyber.Point) *DCNetEntity {
 
 	e := new(DCNetEntity)
@@ -67,7 +79,8 @@ func NewDCNetEntity(
 	e.Entity = entity
 	e.DCNetPayloadSize = PayloadSize
 	e.EquivocationProtectionEnabled = equivocationProtection
-	e.DCNetRoundDecoder = nil
+	e.PadGeneratorType = padGeneratorType
+	e.roundDecoders = make(map[int32]*DCNetRoundDecoder)
 	e.currentRound = 0
 
 	e.verbose = false // todo: wire in the .toml
@@ -80,21 +93,19 @@ func NewDCNetEntity(
 
 	// if the node participates in the DC-net
 	if entity != DCNET_RELAY {
-		e.sharedKeys = sharedKeys
-
-		// Use the provided shared secrets to seed a pseudorandom DC-nets ciphers shared with each peer.
-		e.sharedPRNGs = make([]kyber.XOF, len(sharedKeys))
 		for i := range sharedKeys {
 			e.verbosePrint("key", i, ":", sharedKeys[i])
-			seed, err := sharedKeys[i].MarshalBinary()
-			if err != nil {
-				log.Fatal("Could not extract data from shared key", err)
-			}
-			e.sharedPRNGs[i] = e.cryptoSuite.XOF(seed)
 		}
+
+		// Use the provided shared secrets to seed a pseudorandom DC-nets ciphers shared with each peer.
+		epoch, err := newDCNetEpoch(0, sharedKeys, PayloadSize)
+		if err != nil {
+			log.Fatal("Could not extract data from shared key", err)
+		}
+		e.epochs = []*dcNetEpoch{epoch}
 	} else {
-		e.sharedKeys = make([]kyber.Point, 0)
-		e.sharedPRNGs = make([]kyber.XOF, 0)
+		epoch, _ := newDCNetEpoch(0, make([]kyber.Point, 0), PayloadSize)
+		e.epochs = []*dcNetEpoch{epoch}
 	}
 
 	// if the equivocation protection is enabled
@@ -117,6 +128,21 @@ func NewDCNetEntity(
 	return e
 }
 
+// creates the pad generators of round roundID, one per shared key. Pads are random-access, so this never depends
+// on the rounds encoded before
+func (e *DCNetEntity) roundPRNGs(roundID int32) []PadGenerator {
+	sharedSeeds := e.epochOfRound(roundID).sharedSeeds
+	prngs := make([]PadGenerator, len(sharedSeeds))
+	for i := range sharedSeeds {
+		prng, err := NewRoundPadGenerator(e.PadGeneratorType, sharedSeeds[i], roundID)
+		if err != nil {
+			log.Fatal("Could not create the pad generator", err)
+		}
+		prngs[i] = prng
+	}
+	return prngs
+}
+
 func (e *DCNetEntity) verbosePrint(info ...interface{}) {
 	if !e.verbose {
 		return
@@ -138,77 +164,47 @@ func (e *DCNetEntity) verbosePrint(info ...interface{}) {
 	log.Lvl1(s, s2)
 }
 
-// Encodes "Payload" in the correct round. Will skip PRNG material if the round is in the future,
-// and crash if the round is in the past or the Payload is too long
+// Encodes the trustee's cipher for any round, and crash if the entity is misconfigured
 func (e *DCNetEntity) TrusteeEncodeForRound(roundID int32) []byte {
+	if e.verifiable != nil {
+		return e.VerifiableEncodeForRound(roundID, -1, nil)
+	}
 	upstreamCell, _ := e.EncodeForRound(roundID, false, nil)
 	return upstreamCell
 }
 
-// Encodes "Payload" in the correct round. Will skip PRNG material if the round is in the future,
-// and crash if the round is in the past or the Payload is too long
+// Encodes "Payload" in the correct round. Pads are derived per round, so any round (past or future) can be encoded
+// directly; crashes if the Payload is too long
 func (e *DCNetEntity) EncodeForRound(roundID int32, slotOwner bool, payload []byte) ([]byte, []byte) {
-	if len(payload) > e.DCNetPayloadSize {
-		panic("DCNet: cannot encode Payload of length " + strconv.Itoa(int(len(payload))) + " max length is " + strconv.Itoa(len(payload)))
+	payloadSize := e.PayloadSizeOfRound(roundID)
+	if len(payload) > payloadSize {
+		panic("DCNet: cannot encode Payload of length " + strconv.Itoa(int(len(payload))) + " max length is " + strconv.Itoa(payloadSize))
 	}
-
-	if roundID < e.currentRound {
-		sharedKeys := e.sharedKeys
-
-		// Use the provided shared secrets to seed a pseudorandom DC-nets ciphers shared with each peer.
-		sharedPRNGsCopy := make([]kyber.XOF, len(sharedKeys))
-		for i := range sharedKeys {
-			e.verbosePrint("key", i, ":", sharedKeys[i])
-			seed, err := sharedKeys[i].MarshalBinary()
-			if err != nil {
-				log.Fatal("Could not extract data from shared key", err)
-			}
-			sharedPRNGsCopy[i] = e.cryptoSuite.XOF(seed)
-		}
-		round := int32(0)
-		for round < roundID {
-			//discard crypto material
-
-			// consume the PRNGs
-			for i := range e.sharedPRNGs {
-				dummy := make([]byte, e.DCNetPayloadSize)
-				sharedPRNGsCopy[i].XORKeyStream(dummy, dummy)
-			}
-
-			round++
-
-		}
-		e.sharedPRNGs = sharedPRNGsCopy
-		e.currentRound = roundID
+	if e.verifiable != nil {
+		panic("DCNet: verifiable ciphers need the slot owner, use VerifiableEncodeForRound")
 	}
 
-	for e.currentRound < roundID {
-		//discard crypto material
-		log.Lvl4("DCNet: Discarding round", e.currentRound)
-
-		// consume the PRNGs
-		for i := range e.sharedPRNGs {
-			dummy := make([]byte, e.DCNetPayloadSize)
-			e.sharedPRNGs[i].XORKeyStream(dummy, dummy)
-		}
-
-		e.currentRound++
+	// pads are derived per round, so past and future rounds cost the same as the next one
+	prngs := e.roundPRNGs(roundID)
+	if roundID >= e.currentRound {
+		e.currentRound = roundID + 1
 	}
+
 	var plainPayload []byte
 	var c *DCNetCipher
 	if e.Entity == DCNET_CLIENT {
-		c, plainPayload = e.clientEncode(slotOwner, payload)
+		c, plainPayload = e.clientEncode(prngs, payloadSize, slotOwner, payload)
 	} else {
-		c = e.trusteeEncode()
+		c = e.trusteeEncode(prngs, payloadSize)
 	}
-	e.currentRound++
 
 	e.verbosePrint("r[", roundID, "]:\n", c.Payload)
 	e.verbosePrint("r[", roundID, "]: equiv\n", c.EquivocationProtectionTag)
 	return c.ToBytes(), plainPayload
 }
 
-// Adds `newdata` into the sponge representing the received downstream data
+// Adds `newdata` into the hash chain representing the downstream data. The clients call it with each downstream cell
+// before encoding its round, and the relay with each downstream cell it sends, before starting to decode its round
 func (e *DCNetEntity) UpdateReceivedMessageHistory(newData []byte) {
 	if e.EquivocationProtectionEnabled {
 		e.equivocationProtection.UpdateHistory(newData)
@@ -216,17 +212,17 @@ func (e *DCNetEntity) UpdateReceivedMessageHistory(newData []byte) {
 }
 
 // Encode for clients
-func (e *DCNetEntity) clientEncode(slotOwner bool, payload []byte) (*DCNetCipher, []byte) {
+func (e *DCNetEntity) clientEncode(prngs []PadGenerator, payloadSize int, slotOwner bool, payload []byte) (*DCNetCipher, []byte) {
 
 	c := new(DCNetCipher)
 
 	if payload == nil {
-		payload = make([]byte, e.DCNetPayloadSize)
+		payload = make([]byte, payloadSize)
 	} else {
 		// deep clone and pad
-		dcnetPayloadSize := e.DCNetPayloadSize
+		dcnetPayloadSize := payloadSize
 		if e.EquivocationProtectionEnabled && slotOwner {
-			dcnetPayloadSize -= 16
+			dcnetPayloadSize -= EQUIVOCATION_OVERHEAD
 		}
 		payload2 := make([]byte, dcnetPayloadSize)
 		copy(payload2[0:len(payload)], payload)
@@ -234,13 +230,24 @@ func (e *DCNetEntity) clientEncode(slotOwner bool, payload []byte) (*DCNetCipher
 	}
 	c.Payload = payload
 
+	// what the DC-net payloads XOR to, if we own the slot; see CellLayout
+	plainPayload := make([]byte, payloadSize)
+
+	// without equivocation protection, the pads are not needed individually; XOR them in directly
+	if !e.EquivocationProtectionEnabled {
+		copy(plainPayload, c.Payload)
+		for i := range prngs {
+			prngs[i].XORKeyStream(c.Payload, c.Payload)
+		}
+		return c, plainPayload
+	}
+
 	// prepare the pads
-	p_ij := make([][]byte, len(e.sharedPRNGs))
+	p_ij := make([][]byte, len(prngs))
 	for i := range p_ij {
-		p_ij[i] = make([]byte, e.DCNetPayloadSize)
-		e.sharedPRNGs[i].XORKeyStream(p_ij[i], p_ij[i])
+		p_ij[i] = make([]byte, payloadSize)
+		prngs[i].XORKeyStream(p_ij[i], p_ij[i])
 	}
-	plainPayload := make([]byte, e.DCNetPayloadSize)
 
 	// if the equivocation protection is enabled, encrypt the Payload, and add the tag
 	if e.EquivocationProtectionEnabled {
@@ -262,16 +269,24 @@ func (e *DCNetEntity) clientEncode(slotOwner bool, payload []byte) (*DCNetCipher
 }
 
 // Encode for trustees
-func (e *DCNetEntity) trusteeEncode() *DCNetCipher {
+func (e *DCNetEntity) trusteeEncode(prngs []PadGenerator, payloadSize int) *DCNetCipher {
 	c := new(DCNetCipher)
 
-	c.Payload = make([]byte, e.DCNetPayloadSize)
+	c.Payload = make([]byte, payloadSize)
+
+	// without equivocation protection, the pads are not needed individually; XOR them in directly
+	if !e.EquivocationProtectionEnabled {
+		for i := range prngs {
+			prngs[i].XORKeyStream(c.Payload, c.Payload)
+		}
+		return c
+	}
 
 	// prepare the pads
-	p_ij := make([][]byte, len(e.sharedPRNGs))
+	p_ij := make([][]byte, len(prngs))
 	for i := range p_ij {
-		p_ij[i] = make([]byte, e.DCNetPayloadSize)
-		e.sharedPRNGs[i].XORKeyStream(p_ij[i], p_ij[i])
+		p_ij[i] = make([]byte, payloadSize)
+		prngs[i].XORKeyStream(p_ij[i], p_ij[i])
 	}
 
 	// DC-net encrypt the Payload
@@ -290,126 +305,186 @@ func (e *DCNetEntity) trusteeEncode() *DCNetCipher {
 	return c
 }
 
-// Function to get the bits from previous round in an exact position.
+// Function to get the bits from previous round in an exact position (see PayloadBit). The pads are recomputed for that
+// round only, without modifying the state used to encode the next rounds.
 func (e *DCNetEntity) GetBitsOfRound(roundID int32, bitPosition int32) (map[int]int, [][]byte) {
 	if roundID >= e.currentRound {
 		return nil, nil
 	}
 
-	sharedKeys := e.sharedKeys
+	rtn := make(map[int]int)
 
-	// Use the provided shared secrets to seed a pseudorandom DC-nets ciphers shared with each peer.
-	sharedPRNGsCopy := make([]kyber.XOF, len(sharedKeys))
-	for i := range sharedKeys {
-		e.verbosePrint("key", i, ":", sharedKeys[i])
-		seed, err := sharedKeys[i].MarshalBinary()
+	// prepare the pads; the live state of the entity is not touched
+	payloadSize := e.PayloadSizeOfRound(roundID)
+	prngs := e.roundPRNGs(roundID)
+	p_ij := make([][]byte, len(prngs))
+	for i := range p_ij {
+		p_ij[i] = make([]byte, payloadSize)
+		prngs[i].XORKeyStream(p_ij[i], p_ij[i])
+	}
+	// the position is in the DC-net payload, where the pads are XORed in; see CellLayout
+	for i := range p_ij {
+		bit, err := PayloadBit(p_ij[i], int(bitPosition))
 		if err != nil {
-			log.Fatal("Could not extract data from shared key", err)
+			log.Error("DCNet:", err)
+			return nil, nil
 		}
-		sharedPRNGsCopy[i] = e.cryptoSuite.XOF(seed)
+		rtn[i] = bit
 	}
-	round := int32(0)
-	for round < roundID {
-		//discard crypto material
 
-		// consume the PRNGs
-		for i := range e.sharedPRNGs {
-			dummy := make([]byte, e.DCNetPayloadSize)
-			sharedPRNGsCopy[i].XORKeyStream(dummy, dummy)
-		}
+	return rtn, p_ij
+}
 
-		round++
+// Used by the relay to start decoding a round. Several rounds can be decoded at the same time, and the ciphers of
+// different rounds can be given concurrently; starting a round twice keeps what was decoded so far. With the equivocation
+// protection, the round is decoded with the current downstream history, see UpdateReceivedMessageHistory
+func (e *DCNetEntity) DecodeStart(roundID int32) {
+	e.roundDecodersLock.Lock()
+	defer e.roundDecodersLock.Unlock()
 
+	if _, found := e.roundDecoders[roundID]; found {
+		return
 	}
-	e.sharedPRNGs = sharedPRNGsCopy
-	e.currentRound = roundID
+	if roundID >= e.currentRound {
+		e.currentRound = roundID + 1
+	}
+	d := new(DCNetRoundDecoder)
+	d.roundID = roundID
+	d.xorBuffer = make([]byte, e.PayloadSizeOfRound(roundID))
+	d.equivClientContribs = make([][]byte, 0)
+	d.equivTrusteeContribs = make([][]byte, 0)
+	if e.EquivocationProtectionEnabled {
+		// the clients encode this round after hashing its downstream cell, the last one sent
+		d.equivHistory = e.equivocationProtection.History()
+	}
+	e.roundDecoders[roundID] = d
+}
 
-	rtn := make(map[int]int)
+// Used by the relay to abandon the decoding of a round, e.g. if it timed out
+func (e *DCNetEntity) DecodeDiscard(roundID int32) {
+	e.roundDecodersLock.Lock()
+	defer e.roundDecodersLock.Unlock()
 
-	// prepare the pads
+	delete(e.roundDecoders, roundID)
+}
 
-	p_ij := make([][]byte, len(e.sharedPRNGs))
-	for i := range p_ij {
-		p_ij[i] = make([]byte, e.DCNetPayloadSize)
-		e.sharedPRNGs[i].XORKeyStream(p_ij[i], p_ij[i])
+// returns the decoder of round roundID, which must have been started
+func (e *DCNetEntity) roundDecoder(roundID int32, caller string) *DCNetRoundDecoder {
+	e.roundDecodersLock.Lock()
+	defer e.roundDecodersLock.Unlock()
+
+	d, found := e.roundDecoders[roundID]
+	if !found {
+		panic("Cannot " + caller + " for round " + strconv.Itoa(int(roundID)) + ", it is not being decoded")
 	}
-	// DC-net encrypt the Payload
-	for i := range p_ij {
-		bytePosition := int(bitPosition / 8)
-		// TODO: CHECK WHY THIS HAPPEN, CLEARLY A BUG HERE
-		if !e.EquivocationProtectionEnabled {
-			bytePosition++
-		}
-		byte_toGet := p_ij[i][bytePosition]
-		bitInByte := (8-bitPosition%8)%8 - 1
-		mask := byte(1 << uint(bitInByte))
-		if (byte_toGet & mask) == 0 {
-			rtn[i] = 0
-		} else {
-			rtn[i] = 1
-		}
+	return d
+}
+
+// called by the relay to decode a client contribution. Fails if the cipher is malformed, or does not have the size of
+// the round
+func (e *DCNetEntity) DecodeClient(roundID int32, slice []byte) error {
+	d := e.roundDecoder(roundID, "DecodeClient")
+	d.Lock()
+	defer d.Unlock()
 
+	if e.verifiable != nil {
+		return e.verifiableDecode(d, slice)
 	}
 
-	return rtn, p_ij
-}
+	dcNetCipher, err := DCNetCipherFromBytes(slice)
+	if err != nil {
+		return err
+	}
+	if len(dcNetCipher.Payload) != len(d.xorBuffer) {
+		return errors.New("the payload has " + strconv.Itoa(len(dcNetCipher.Payload)) + " bytes instead of " + strconv.Itoa(len(d.xorBuffer)))
+	}
 
-// Used by the relay to start decoding a round
-func (e *DCNetEntity) DecodeStart(roundID int32) {
-	e.DCNetRoundDecoder = new(DCNetRoundDecoder)
-	e.DCNetRoundDecoder.currentRoundBeingDecoded = roundID
-	e.DCNetRoundDecoder.xorBuffer = make([]byte, e.DCNetPayloadSize)
-	e.DCNetRoundDecoder.equivClientContribs = make([][]byte, 0)
-	e.DCNetRoundDecoder.equivTrusteeContribs = make([][]byte, 0)
+	for i := range dcNetCipher.Payload {
+		d.xorBuffer[i] ^= dcNetCipher.Payload[i]
+	}
+
+	if e.EquivocationProtectionEnabled {
+		d.equivClientContribs = append(d.equivClientContribs, dcNetCipher.EquivocationProtectionTag)
+	}
+	return nil
 }
 
-// called by the relay to decode a client contribution
-func (e *DCNetEntity) DecodeClient(roundID int32, slice []byte) {
+// called by the relay to decode a trustee contribution. Fails if the cipher is malformed, or does not have the size of
+// the round
+func (e *DCNetEntity) DecodeTrustee(roundID int32, slice []byte) error {
+	d := e.roundDecoder(roundID, "DecodeTrustee")
+	d.Lock()
+	defer d.Unlock()
 
-	dcNetCipher := DCNetCipherFromBytes(slice)
+	if e.verifiable != nil {
+		return e.verifiableDecode(d, slice)
+	}
 
-	if roundID != e.DCNetRoundDecoder.currentRoundBeingDecoded {
-		panic("Cannot DecodeClient for round" +
-			strconv.Itoa(int(roundID)) + ", we are in round " + strconv.Itoa(int(e.DCNetRoundDecoder.currentRoundBeingDecoded)))
+	dcNetCipher, err := DCNetCipherFromBytes(slice)
+	if err != nil {
+		return err
+	}
+	if len(dcNetCipher.Payload) != len(d.xorBuffer) {
+		return errors.New("the payload has " + strconv.Itoa(len(dcNetCipher.Payload)) + " bytes instead of " + strconv.Itoa(len(d.xorBuffer)))
 	}
 
 	for i := range dcNetCipher.Payload {
-		e.DCNetRoundDecoder.xorBuffer[i] ^= dcNetCipher.Payload[i]
+		d.xorBuffer[i] ^= dcNetCipher.Payload[i]
 	}
 
 	if e.EquivocationProtectionEnabled {
-		e.DCNetRoundDecoder.equivClientContribs = append(e.DCNetRoundDecoder.equivClientContribs, dcNetCipher.EquivocationProtectionTag)
+		d.equivTrusteeContribs = append(d.equivTrusteeContribs, dcNetCipher.EquivocationProtectionTag)
 	}
+	return nil
 }
 
-// called by the relay to decode a client contribution
-func (e *DCNetEntity) DecodeTrustee(roundID int32, slice []byte) {
-
-	dcNetCipher := DCNetCipherFromBytes(slice)
+// called by the relay to decode the XOR of several contributions, accumulated before the round was started, with their
+// equivocation tags. Not possible with the verifiable DC-net, which checks each contribution. Fails if the payload
+// does not have the size of the round
+func (e *DCNetEntity) DecodeAccumulated(roundID int32, payload []byte, clientTags, trusteeTags [][]byte) error {
+	if e.verifiable != nil {
+		panic("Cannot DecodeAccumulated with the verifiable DC-net")
+	}
+	d := e.roundDecoder(roundID, "DecodeAccumulated")
+	d.Lock()
+	defer d.Unlock()
 
-	if roundID != e.DCNetRoundDecoder.currentRoundBeingDecoded {
-		panic("Cannot DecodeClient for round" +
-			strconv.Itoa(int(roundID)) + ", we are in round " + strconv.Itoa(int(e.DCNetRoundDecoder.currentRoundBeingDecoded)))
+	if len(payload) != len(d.xorBuffer) {
+		return errors.New("the accumulated payload has " + strconv.Itoa(len(payload)) + " bytes instead of " + strconv.Itoa(len(d.xorBuffer)))
 	}
 
-	for i := range dcNetCipher.Payload {
-		e.DCNetRoundDecoder.xorBuffer[i] ^= dcNetCipher.Payload[i]
+	for i := range payload {
+		d.xorBuffer[i] ^= payload[i]
 	}
 
 	if e.EquivocationProtectionEnabled {
-		e.DCNetRoundDecoder.equivTrusteeContribs = append(e.DCNetRoundDecoder.equivTrusteeContribs, dcNetCipher.EquivocationProtectionTag)
+		d.equivClientContribs = append(d.equivClientContribs, clientTags...)
+		d.equivTrusteeContribs = append(d.equivTrusteeContribs, trusteeTags...)
 	}
+	return nil
 }
 
-// Called on the relay to decode the cell, after having stored the cryptographic materials
-func (e *DCNetEntity) DecodeCell(isOpenClosedSlot bool) ([]byte, []byte) {
-	//No Equivocation -> just XOR
-	d := e.DCNetRoundDecoder
+// Called on the relay to decode the cell of a round, after having stored the cryptographic materials. The round is
+// then forgotten
+func (e *DCNetEntity) DecodeCell(roundID int32, isOpenClosedSlot bool) ([]byte, []byte) {
+	d := e.roundDecoder(roundID, "DecodeCell")
+	e.roundDecodersLock.Lock()
+	delete(e.roundDecoders, roundID)
+	e.roundDecodersLock.Unlock()
+
+	d.Lock()
+	defer d.Unlock()
 
+	if e.verifiable != nil {
+		decoded := e.verifiableDecodeCell(d)
+		return decoded, decoded
+	}
+
+	//No Equivocation -> just XOR
 	cipherText := d.xorBuffer
 	var decoded []byte
 	if e.EquivocationProtectionEnabled && !isOpenClosedSlot {
-		decoded = e.equivocationProtection.RelayDecode(d.xorBuffer, d.equivTrusteeContribs, d.equivClientContribs)
+		decoded = e.equivocationProtection.RelayDecode(d.equivHistory, d.xorBuffer, d.equivTrusteeContribs, d.equivClientContribs)
 	} else {
 		decoded = cipherText
 	}
@@ -2,7 +2,9 @@ package dcnet
 
 import (
 	"encoding/binary"
+	"errors"
 	"math"
+	"strconv"
 )
 
 // DCNetCipher is the output of a DC-net round
@@ -33,12 +35,12 @@ func (c *DCNetCipher) ToBytes() []byte {
 	return out
 }
 
-// Decodes some bytes into a DCNetCipher
-func DCNetCipherFromBytes(data []byte) *DCNetCipher {
+// Decodes some bytes into a DCNetCipher. Returns an error if they are not a valid cipher
+func DCNetCipherFromBytes(data []byte) (*DCNetCipher, error) {
 	c := new(DCNetCipher)
 
 	if len(data) < 8 {
-		panic("DCNetCipherFromBytes: data too short")
+		return nil, errors.New("DCNetCipherFromBytes: data too short, " + strconv.Itoa(len(data)) + " bytes")
 	}
 
 	minusOneInUint32 := math.MaxInt32
@@ -46,11 +48,15 @@ func DCNetCipherFromBytes(data []byte) *DCNetCipher {
 	equivocationTagStart := int(binary.BigEndian.Uint32(data[0:4]))
 	payloadStart := int(binary.BigEndian.Uint32(data[4:8]))
 
+	if payloadStart < 8 || payloadStart > len(data) {
+		return nil, errors.New("DCNetCipherFromBytes: the payload starts at " + strconv.Itoa(payloadStart) + ", out of " + strconv.Itoa(len(data)) + " bytes")
+	}
+
 	if equivocationTagStart != minusOneInUint32 {
 		c.EquivocationProtectionTag = data[8:payloadStart]
 	}
 
 	c.Payload = data[payloadStart:]
 
-	return c
+	return c, nil
 }
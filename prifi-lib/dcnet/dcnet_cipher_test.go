@@ -37,40 +37,55 @@ func ChangeLength(length int, t *testing.T) {
 		EquivocationProtectionTag: randomBytes(length),
 		Payload:                   nil,
 	}
-	if !assertEqual(&a, DCNetCipherFromBytes(a.ToBytes())) {
+	b, err := DCNetCipherFromBytes(a.ToBytes())
+	if err != nil || !assertEqual(&a, b) {
 		t.Error("DCNetCipher could not be marshalled-unmarshalled")
 		fmt.Printf("%+v\n", a)
 		fmt.Printf("%+v\n", a.ToBytes())
-		fmt.Printf("%+v\n", DCNetCipherFromBytes(a.ToBytes()))
+		fmt.Printf("%+v\n", b)
 	}
 
 	a = DCNetCipher{
 		EquivocationProtectionTag: nil,
 		Payload:                   nil,
 	}
-	if !assertEqual(&a, DCNetCipherFromBytes(a.ToBytes())) {
+	b, err = DCNetCipherFromBytes(a.ToBytes())
+	if err != nil || !assertEqual(&a, b) {
 		t.Error("DCNetCipher could not be marshalled-unmarshalled")
 		fmt.Printf("%+v\n", a)
-		fmt.Printf("%+v\n", DCNetCipherFromBytes(a.ToBytes()))
+		fmt.Printf("%+v\n", b)
 	}
 
 	a = DCNetCipher{
 		EquivocationProtectionTag: nil,
 		Payload:                   randomBytes(length),
 	}
-	if !assertEqual(&a, DCNetCipherFromBytes(a.ToBytes())) {
+	b, err = DCNetCipherFromBytes(a.ToBytes())
+	if err != nil || !assertEqual(&a, b) {
 		t.Error("DCNetCipher could not be marshalled-unmarshalled")
 		fmt.Printf("%+v\n", a)
-		fmt.Printf("%+v\n", DCNetCipherFromBytes(a.ToBytes()))
+		fmt.Printf("%+v\n", b)
 	}
 
 	a = DCNetCipher{
 		EquivocationProtectionTag: randomBytes(length),
 		Payload:                   randomBytes(length),
 	}
-	if !assertEqual(&a, DCNetCipherFromBytes(a.ToBytes())) {
+	b, err = DCNetCipherFromBytes(a.ToBytes())
+	if err != nil || !assertEqual(&a, b) {
 		t.Error("DCNetCipher could not be marshalled-unmarshalled")
 		fmt.Printf("%+v\n", a)
-		fmt.Printf("%+v\n", DCNetCipherFromBytes(a.ToBytes()))
+		fmt.Printf("%+v\n", b)
+	}
+}
+
+func TestDCNetCipherFromInvalidBytes(t *testing.T) {
+	valid := (&DCNetCipher{EquivocationProtectionTag: randomBytes(16), Payload: randomBytes(10)}).ToBytes()
+
+	invalid := [][]byte{nil, valid[:7], append(valid[:4:4], 0, 0, 0, 7), append(valid[:4:4], 0, 0, 1, 0)}
+	for i, data := range invalid {
+		if _, err := DCNetCipherFromBytes(data); err == nil {
+			t.Error("invalid cipher", i, "should not decode")
+		}
 	}
 }
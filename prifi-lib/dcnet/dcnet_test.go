@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/dedis/prifi/prifi-lib/config"
 	"go.dedis.ch/kyber/v3"
+	"sync"
 	"testing"
 )
 
@@ -37,13 +38,182 @@ func TestDCNetCreation(t *testing.T) {
 }
 
 func VariousLevelsOfProtection(t *testing.T, nRounds int32, dcNetMessageSize, NClients, NTrustees int) {
-	tg := NewTestGroup(t, false, dcNetMessageSize, NClients, NTrustees)
+	tg := NewTestGroup(t, false, PAD_GENERATOR_XOF, dcNetMessageSize, NClients, NTrustees)
 	SimulateRounds(t, tg, nRounds)
-	tg = NewTestGroup(t, true, dcNetMessageSize, NClients, NTrustees)
+	tg = NewTestGroup(t, true, PAD_GENERATOR_XOF, dcNetMessageSize, NClients, NTrustees)
 	SimulateRounds(t, tg, nRounds)
 }
 
-func NewTestGroup(t *testing.T, equivocationProtectionEnabled bool, dcNetMessageSize, nclients, ntrustees int) *TestGroup {
+func TestDCNetPadGenerators(t *testing.T) {
+	for _, padGenerator := range []string{PAD_GENERATOR_XOF, PAD_GENERATOR_AES_CTR, PAD_GENERATOR_CHACHA20} {
+		for _, equiv := range []bool{false, true} {
+			tg := NewTestGroup(t, equiv, padGenerator, 100, 3, 2)
+			SimulateRounds(t, tg, 20)
+		}
+	}
+}
+
+func TestDCNetRandomAccessPads(t *testing.T) {
+	for _, padGenerator := range padGenerators {
+		tg := NewTestGroup(t, false, padGenerator, 100, 2, 1)
+		fresh := NewTestGroup(t, false, padGenerator, 100, 2, 1)
+		trustee := tg.Trustees[0].DCNetEntity
+
+		ciphers := make([][]byte, 5)
+		for r := int32(0); r < 5; r++ {
+			ciphers[r] = trustee.TrusteeEncodeForRound(r)
+		}
+
+		// looking at the past neither costs a replay nor changes the next rounds
+		_, pads := trustee.GetBitsOfRound(2, 0)
+		for i := range pads {
+			pad, err := RoundPad(padGenerator, tg.Trustees[0].sharedSecrets[i], 2, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(pads[i], pad) {
+				t.Error(padGenerator, "GetBitsOfRound should return the pads of round 2")
+			}
+		}
+		if !bytes.Equal(trustee.TrusteeEncodeForRound(5), fresh.Trustees[0].DCNetEntity.TrusteeEncodeForRound(5)) {
+			t.Error(padGenerator, "GetBitsOfRound should not modify the pads of the next rounds")
+		}
+
+		// re-encoding a past round gives the same cipher
+		if !bytes.Equal(trustee.TrusteeEncodeForRound(3), ciphers[3]) {
+			t.Error(padGenerator, "re-encoding round 3 should give the same cipher")
+		}
+		if bits, _ := trustee.GetBitsOfRound(7, 0); bits != nil {
+			t.Error(padGenerator, "GetBitsOfRound should refuse rounds not yet encoded")
+		}
+	}
+}
+
+func TestDCNetConcurrentRounds(t *testing.T) {
+	for _, equiv := range []bool{false, true} {
+		tg := NewTestGroup(t, equiv, PAD_GENERATOR_XOF, 100, 3, 2)
+		relay := tg.Relay.DCNetEntity
+		payloadSize := relay.DCNetPayloadSize
+		if equiv {
+			payloadSize -= 16
+		}
+
+		// several rounds are decoded at once, their ciphers folded concurrently
+		nRounds := int32(5)
+		messages := make([][]byte, nRounds)
+		var wg sync.WaitGroup
+		for roundID := int32(0); roundID < nRounds; roundID++ {
+			messages[roundID] = randomBytes(payloadSize)
+			relay.DecodeStart(roundID)
+			for i, c := range tg.Clients {
+				m, _ := c.DCNetEntity.EncodeForRound(roundID, i == int(roundID)%len(tg.Clients), messages[roundID])
+				wg.Add(1)
+				go func(roundID int32, m []byte) {
+					defer wg.Done()
+					relay.DecodeClient(roundID, m)
+				}(roundID, m)
+			}
+			for _, tr := range tg.Trustees {
+				m := tr.DCNetEntity.TrusteeEncodeForRound(roundID)
+				wg.Add(1)
+				go func(roundID int32, m []byte) {
+					defer wg.Done()
+					relay.DecodeTrustee(roundID, m)
+				}(roundID, m)
+			}
+		}
+		wg.Wait()
+
+		// the cells come out in the order of the rounds
+		for roundID := int32(0); roundID < nRounds; roundID++ {
+			output, _ := relay.DecodeCell(roundID, false)
+			if !bytes.Equal(output, messages[roundID]) {
+				t.Error("DC-net decoding of round", roundID, "failed with equiv=", equiv)
+			}
+		}
+
+		relay.DecodeStart(nRounds)
+		relay.DecodeDiscard(nRounds)
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("DecodeCell should panic when the round is not being decoded")
+				}
+			}()
+			relay.DecodeCell(nRounds, false)
+		}()
+	}
+}
+
+func TestDCNetDecodeAccumulated(t *testing.T) {
+	tg := NewTestGroup(t, true, PAD_GENERATOR_XOF, 100, 3, 2)
+	relay := tg.Relay.DCNetEntity
+	message := randomBytes(relay.DCNetPayloadSize - 16)
+
+	// the relay XORs the ciphers before the round starts, keeping only the equivocation tags
+	payload := make([]byte, relay.DCNetPayloadSize)
+	clientTags := make([][]byte, 0)
+	trusteeTags := make([][]byte, 0)
+	for i, c := range tg.Clients {
+		m, _ := c.DCNetEntity.EncodeForRound(0, i == 0, message)
+		cipher, _ := DCNetCipherFromBytes(m)
+		for k := range cipher.Payload {
+			payload[k] ^= cipher.Payload[k]
+		}
+		clientTags = append(clientTags, cipher.EquivocationProtectionTag)
+	}
+	for _, tr := range tg.Trustees {
+		cipher, _ := DCNetCipherFromBytes(tr.DCNetEntity.TrusteeEncodeForRound(0))
+		for k := range cipher.Payload {
+			payload[k] ^= cipher.Payload[k]
+		}
+		trusteeTags = append(trusteeTags, cipher.EquivocationProtectionTag)
+	}
+
+	relay.DecodeStart(0)
+	if err := relay.DecodeAccumulated(0, append(payload, 0), clientTags, trusteeTags); err == nil {
+		t.Error("an accumulated payload longer than the round should be refused")
+	}
+	if err := relay.DecodeAccumulated(0, payload, clientTags, trusteeTags); err != nil {
+		t.Fatal(err)
+	}
+	output, _ := relay.DecodeCell(0, false)
+	if !bytes.Equal(output, message) {
+		t.Error("DC-net decoding of accumulated ciphers failed")
+	}
+}
+
+func TestDCNetDecodeMalformedCiphers(t *testing.T) {
+	tg := NewTestGroup(t, true, PAD_GENERATOR_XOF, 100, 1, 1)
+	relay := tg.Relay.DCNetEntity
+	message := randomBytes(relay.DCNetPayloadSize - 16)
+
+	m, _ := tg.Clients[0].DCNetEntity.EncodeForRound(0, true, message)
+	tr := tg.Trustees[0].DCNetEntity.TrusteeEncodeForRound(0)
+
+	// a malformed cipher is refused instead of crashing the relay, and leaves the round untouched
+	relay.DecodeStart(0)
+	for i, invalid := range [][]byte{nil, m[:7], append(append([]byte{}, m...), 0)} {
+		if err := relay.DecodeClient(0, invalid); err == nil {
+			t.Error("invalid client cipher", i, "should be refused")
+		}
+		if err := relay.DecodeTrustee(0, invalid); err == nil {
+			t.Error("invalid trustee cipher", i, "should be refused")
+		}
+	}
+	if err := relay.DecodeClient(0, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := relay.DecodeTrustee(0, tr); err != nil {
+		t.Fatal(err)
+	}
+	output, _ := relay.DecodeCell(0, false)
+	if !bytes.Equal(output, message) {
+		t.Error("DC-net decoding failed after refusing the invalid ciphers")
+	}
+}
+
+func NewTestGroup(t *testing.T, equivocationProtectionEnabled bool, padGeneratorType string, dcNetMessageSize, nclients, ntrustees int) *TestGroup {
 
 	// Use a pseudorandom stream from a well-known seed
 	// for all our setup randomness,
@@ -63,7 +233,7 @@ func NewTestGroup(t *testing.T, equivocationProtectionEnabled bool, dcNetMessage
 
 	relay := new(TestNode)
 	relay.name = "Relay"
-	relay.DCNetEntity = NewDCNetEntity(0, DCNET_RELAY, dcNetMessageSize, equivocationProtectionEnabled, nil)
+	relay.DCNetEntity = NewDCNetEntity(0, DCNET_RELAY, dcNetMessageSize, equivocationProtectionEnabled, padGeneratorType, nil)
 
 	// Create tables of the clients' and the trustees' public session keys
 	clientsKeys := make([]kyber.Point, nclients)
@@ -85,7 +255,7 @@ func NewTestGroup(t *testing.T, equivocationProtectionEnabled bool, dcNetMessage
 		for i := range n.peerKeys {
 			n.sharedSecrets[i] = config.CryptoSuite.Point().Mul(n.privKey, n.peerKeys[i])
 		}
-		n.DCNetEntity = NewDCNetEntity(i, DCNET_CLIENT, dcNetMessageSize, equivocationProtectionEnabled, n.sharedSecrets)
+		n.DCNetEntity = NewDCNetEntity(i, DCNET_CLIENT, dcNetMessageSize, equivocationProtectionEnabled, padGeneratorType, n.sharedSecrets)
 	}
 
 	for i, n := range trustees {
@@ -97,7 +267,7 @@ func NewTestGroup(t *testing.T, equivocationProtectionEnabled bool, dcNetMessage
 		for i := range n.peerKeys {
 			n.sharedSecrets[i] = config.CryptoSuite.Point().Mul(n.privKey, n.peerKeys[i])
 		}
-		n.DCNetEntity = NewDCNetEntity(i, DCNET_TRUSTEE, dcNetMessageSize, equivocationProtectionEnabled, n.sharedSecrets)
+		n.DCNetEntity = NewDCNetEntity(i, DCNET_TRUSTEE, dcNetMessageSize, equivocationProtectionEnabled, padGeneratorType, n.sharedSecrets)
 	}
 
 	// Create a set of fake history streams for the relay and clients
@@ -124,13 +294,13 @@ func SimulateRounds(t *testing.T, tg *TestGroup, maxRounds int32) {
 		clientMessages := make([][]byte, 0)
 		trusteesMessages := make([][]byte, 0)
 		first := true
-		dcNetPayloadSize := d.DCNetPayloadSize
+		dcNetPayloadSize := d.PayloadSizeOfRound(roundID)
 		if d.EquivocationProtectionEnabled {
 			dcNetPayloadSize -= 16
 		}
 		message := randomBytes(dcNetPayloadSize)
 
-		downstreamMessage := randomBytes(d.DCNetPayloadSize) //used only to update the history
+		downstreamMessage := randomBytes(d.PayloadSizeOfRound(roundID)) //used only to update the history
 		for i := range tg.Clients {
 			tg.Clients[i].DCNetEntity.UpdateReceivedMessageHistory(downstreamMessage)
 		}
@@ -164,7 +334,7 @@ func SimulateRounds(t *testing.T, tg *TestGroup, maxRounds int32) {
 			tg.Relay.DCNetEntity.DecodeTrustee(roundID, m)
 		}
 
-		output, _ := tg.Relay.DCNetEntity.DecodeCell(false)
+		output, _ := tg.Relay.DCNetEntity.DecodeCell(roundID, false)
 
 		//fmt.Println("-----------------")
 		//fmt.Println(output)
@@ -0,0 +1,102 @@
+package dcnet
+
+import (
+	"errors"
+	"strconv"
+
+	"go.dedis.ch/kyber/v3"
+)
+
+// dcNetEpoch holds the keys shared with the other DC-net members during one key epoch, and the size of its payloads
+type dcNetEpoch struct {
+	firstRound  int32
+	sharedKeys  []kyber.Point
+	sharedSeeds [][]byte // marshalled sharedKeys, which seed the pads of each round
+	payloadSize int
+}
+
+// how many past epochs are remembered, e.g. to recompute the pads of a disrupted round just before a switch
+const maxPastEpochs = 1
+
+func newDCNetEpoch(firstRound int32, sharedKeys []kyber.Point, payloadSize int) (*dcNetEpoch, error) {
+	epoch := &dcNetEpoch{
+		firstRound:  firstRound,
+		sharedKeys:  sharedKeys,
+		sharedSeeds: make([][]byte, len(sharedKeys)),
+		payloadSize: payloadSize,
+	}
+	for i := range sharedKeys {
+		seed, err := sharedKeys[i].MarshalBinary()
+		if err != nil {
+			return nil, errors.New("could not extract data from shared key: " + err.Error())
+		}
+		epoch.sharedSeeds[i] = seed
+	}
+	return epoch, nil
+}
+
+// returns the epoch whose keys encode round roundID
+func (e *DCNetEntity) epochOfRound(roundID int32) *dcNetEpoch {
+	epoch := e.epochs[0]
+	for _, next := range e.epochs[1:] {
+		if next.firstRound > roundID {
+			break
+		}
+		epoch = next
+	}
+	return epoch
+}
+
+// SetNextEpoch schedules a switch to new shared keys: rounds from firstRound on are encoded with sharedKeys, while the
+// previous rounds keep their keys, so the switch happens without losing any round. The payloads of the new epoch have
+// payloadSize bytes, or keep their size if it is 0. The switch must be scheduled before firstRound is encoded (or, for
+// the relay, decoded). The relay has no keys, and gives none.
+func (e *DCNetEntity) SetNextEpoch(firstRound int32, sharedKeys []kyber.Point, payloadSize int) error {
+	if e.verifiable != nil {
+		return errors.New("the verifiable DC-net does not support key epochs")
+	}
+	if len(sharedKeys) != len(e.epochs[0].sharedKeys) {
+		return errors.New("expected " + strconv.Itoa(len(e.epochs[0].sharedKeys)) + " shared keys, got " + strconv.Itoa(len(sharedKeys)))
+	}
+	if firstRound < e.currentRound {
+		return errors.New("round " + strconv.Itoa(int(firstRound)) + " is already encoded, cannot switch keys there")
+	}
+	last := e.epochs[len(e.epochs)-1]
+	if firstRound <= last.firstRound {
+		return errors.New("an epoch already starts at round " + strconv.Itoa(int(last.firstRound)))
+	}
+	if payloadSize < 0 {
+		return errors.New("invalid payload size " + strconv.Itoa(payloadSize))
+	}
+	if payloadSize == 0 {
+		payloadSize = last.payloadSize
+	}
+
+	epoch, err := newDCNetEpoch(firstRound, sharedKeys, payloadSize)
+	if err != nil {
+		return err
+	}
+	e.epochs = append(e.epochs, epoch)
+
+	// forget the epochs that ended before the previous one
+	current := 0
+	for i := range e.epochs {
+		if e.epochs[i].firstRound <= e.currentRound {
+			current = i
+		}
+	}
+	if current > maxPastEpochs {
+		e.epochs = e.epochs[current-maxPastEpochs:]
+	}
+	return nil
+}
+
+// SharedKeysOfRound returns the keys shared with the other DC-net members that encode round roundID
+func (e *DCNetEntity) SharedKeysOfRound(roundID int32) []kyber.Point {
+	return e.epochOfRound(roundID).sharedKeys
+}
+
+// PayloadSizeOfRound returns the size of the payload of round roundID, which changes with the epochs
+func (e *DCNetEntity) PayloadSizeOfRound(roundID int32) int {
+	return e.epochOfRound(roundID).payloadSize
+}
@@ -0,0 +1,145 @@
+package dcnet
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"go.dedis.ch/kyber/v3"
+)
+
+// nextEpochSecrets derives fresh shared secrets for all members of the group, as after a key epoch rotation
+func nextEpochSecrets(tg *TestGroup, seed string) (clientSecrets, trusteeSecrets [][]kyber.Point) {
+	rand := config.CryptoSuite.XOF([]byte(seed))
+	clientPriv := make([]kyber.Scalar, len(tg.Clients))
+	trusteePriv := make([]kyber.Scalar, len(tg.Trustees))
+	for i := range clientPriv {
+		clientPriv[i] = config.CryptoSuite.Scalar().Pick(rand)
+	}
+	for j := range trusteePriv {
+		trusteePriv[j] = config.CryptoSuite.Scalar().Pick(rand)
+	}
+
+	clientSecrets = make([][]kyber.Point, len(tg.Clients))
+	trusteeSecrets = make([][]kyber.Point, len(tg.Trustees))
+	for i := range clientSecrets {
+		clientSecrets[i] = make([]kyber.Point, len(tg.Trustees))
+		for j := range trusteePriv {
+			trusteePub := config.CryptoSuite.Point().Mul(trusteePriv[j], nil)
+			clientSecrets[i][j] = config.CryptoSuite.Point().Mul(clientPriv[i], trusteePub)
+		}
+	}
+	for j := range trusteeSecrets {
+		trusteeSecrets[j] = make([]kyber.Point, len(tg.Clients))
+		for i := range clientPriv {
+			clientPub := config.CryptoSuite.Point().Mul(clientPriv[i], nil)
+			trusteeSecrets[j][i] = config.CryptoSuite.Point().Mul(trusteePriv[j], clientPub)
+		}
+	}
+	return
+}
+
+func TestDCNetEpochs(t *testing.T) {
+	for _, equiv := range []bool{false, true} {
+		tg := NewTestGroup(t, equiv, PAD_GENERATOR_XOF, 100, 3, 2)
+		unchanged := NewTestGroup(t, equiv, PAD_GENERATOR_XOF, 100, 3, 2)
+
+		// switch in the middle of the rounds simulated, then once more
+		for e, boundary := range []int32{7, 13} {
+			clientSecrets, trusteeSecrets := nextEpochSecrets(tg, "DCTestEpoch"+strconv.Itoa(e))
+			for i, c := range tg.Clients {
+				if err := c.DCNetEntity.SetNextEpoch(boundary, clientSecrets[i], 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for j, tr := range tg.Trustees {
+				if err := tr.DCNetEntity.SetNextEpoch(boundary, trusteeSecrets[j], 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		SimulateRounds(t, tg, 20)
+
+		trustee := tg.Trustees[0].DCNetEntity
+		other := unchanged.Trustees[0].DCNetEntity
+		if !bytes.Equal(trustee.TrusteeEncodeForRound(6), other.TrusteeEncodeForRound(6)) {
+			t.Error("rounds before the boundary should keep the keys of the setup")
+		}
+		if bytes.Equal(trustee.TrusteeEncodeForRound(13), other.TrusteeEncodeForRound(13)) {
+			t.Error("rounds after the boundary should use the new keys")
+		}
+		if trustee.SharedKeysOfRound(6)[0].Equal(trustee.SharedKeysOfRound(7)[0]) {
+			t.Error("SharedKeysOfRound should follow the epochs")
+		}
+	}
+}
+
+func TestDCNetEpochsPayloadSize(t *testing.T) {
+	for _, equiv := range []bool{false, true} {
+		tg := NewTestGroup(t, equiv, PAD_GENERATOR_XOF, 100, 3, 2)
+
+		// the cells grow, keep their size with the next keys, then shrink
+		for e, next := range []struct {
+			boundary    int32
+			payloadSize int
+		}{{7, 250}, {11, 0}, {15, 60}} {
+			clientSecrets, trusteeSecrets := nextEpochSecrets(tg, "DCTestEpochSize"+strconv.Itoa(e))
+			for i, c := range tg.Clients {
+				if err := c.DCNetEntity.SetNextEpoch(next.boundary, clientSecrets[i], next.payloadSize); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for j, tr := range tg.Trustees {
+				if err := tr.DCNetEntity.SetNextEpoch(next.boundary, trusteeSecrets[j], next.payloadSize); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tg.Relay.DCNetEntity.SetNextEpoch(next.boundary, nil, next.payloadSize); err != nil {
+				t.Fatal(err)
+			}
+		}
+		SimulateRounds(t, tg, 20)
+
+		trustee := tg.Trustees[0].DCNetEntity
+		for roundID, size := range map[int32]int{6: 100, 7: 250, 12: 250, 15: 60, 20: 60} {
+			if trustee.PayloadSizeOfRound(roundID) != size || tg.Relay.DCNetEntity.PayloadSizeOfRound(roundID) != size {
+				t.Error("round", roundID, "should have a payload of", size, "bytes")
+			}
+			if c, err := DCNetCipherFromBytes(trustee.TrusteeEncodeForRound(roundID)); err != nil || len(c.Payload) != size {
+				t.Error("the cipher of round", roundID, "has", len(c.Payload), "bytes instead of", size)
+			}
+		}
+		if _, pads := trustee.GetBitsOfRound(8, 0); len(pads[0]) != 250 {
+			t.Error("the pads of a past round should have its size")
+		}
+	}
+}
+
+func TestDCNetEpochsErrors(t *testing.T) {
+	tg := NewTestGroup(t, false, PAD_GENERATOR_XOF, 100, 2, 2)
+	clientSecrets, _ := nextEpochSecrets(tg, "DCTestEpoch")
+	client := tg.Clients[0].DCNetEntity
+	client.EncodeForRound(4, false, nil)
+
+	if err := client.SetNextEpoch(3, clientSecrets[0], 0); err == nil {
+		t.Error("should not switch keys in a round already encoded")
+	}
+	if err := client.SetNextEpoch(10, clientSecrets[0][:1], 0); err == nil {
+		t.Error("should not accept a different number of keys")
+	}
+	if err := client.SetNextEpoch(10, clientSecrets[0], -1); err == nil {
+		t.Error("should not accept a negative payload size")
+	}
+	if err := client.SetNextEpoch(10, clientSecrets[0], 0); err != nil {
+		t.Error(err)
+	}
+	if err := client.SetNextEpoch(10, clientSecrets[0], 0); err == nil {
+		t.Error("should not start two epochs in the same round")
+	}
+
+	vtg := NewVerifiableTestGroup(t, 100, 2, 2)
+	if err := vtg.Clients[0].DCNetEntity.SetNextEpoch(10, clientSecrets[0], 0); err == nil {
+		t.Error("the verifiable DC-net should refuse key epochs")
+	}
+}
@@ -52,15 +52,26 @@ func (e *EquivocationProtection) hashInGroup(data []byte) kyber.Scalar {
 	return e.suite.Scalar().SetBytes(data)
 }
 
-// Update History adds those bits to the history hash chain
+// Update History adds those bits to the history hash chain: history = H(history || data). The relay and the clients
+// hash the same downstream cells in the same order, so they all hold the same history; a client that was sent other
+// data has another history, and the relay cannot decode the rounds it takes part in
 func (e *EquivocationProtection) UpdateHistory(data []byte) {
 	historyB, err := e.history.MarshalBinary()
 	if err != nil {
 		log.Fatal("Could not unmarshall bytes", err)
 	}
 	toBeHashed := make([]byte, len(historyB)+len(data))
+	copy(toBeHashed, historyB)
+	copy(toBeHashed[len(historyB):], data)
 	newPayload := sha256.Sum256(toBeHashed)
-	e.history.SetBytes(newPayload[:])
+
+	// a new scalar, so the histories given by History() are not changed
+	e.history = e.suite.Scalar().SetBytes(newPayload[:])
+}
+
+// History returns the current history, which the relay keeps for each round it decodes
+func (e *EquivocationProtection) History() kyber.Scalar {
+	return e.history
 }
 
 // a function that takes a payload x, encrypt it as x' = x + k, and returns x' and kappa = k + history * (sum of the (hashes of pads))
@@ -158,8 +169,8 @@ func (e *EquivocationProtection) TrusteeProve() []byte {
 	return nil
 }
 
-// given all contributions, decodes the payload
-func (e *EquivocationProtection) RelayDecode(encryptedPayload []byte, trusteesContributions [][]byte, clientsContributions [][]byte) []byte {
+// given all contributions, and the history the clients encoded them with, decodes the payload
+func (e *EquivocationProtection) RelayDecode(history kyber.Scalar, encryptedPayload []byte, trusteesContributions [][]byte, clientsContributions [][]byte) []byte {
 
 	//reconstitute the abstract.Point values
 	trustee_kappa_j := make([]kyber.Scalar, len(trusteesContributions))
@@ -184,7 +195,7 @@ func (e *EquivocationProtection) RelayDecode(encryptedPayload []byte, trusteesCo
 		sumClients = sumClients.Add(sumClients, v)
 	}
 
-	prod := sumTrustees.Mul(sumTrustees, e.history)
+	prod := sumTrustees.Mul(sumTrustees, history)
 	k_i := sumClients.Sub(sumClients, prod)
 
 	//now use k to decrypt the payload
@@ -204,7 +215,7 @@ func (e *EquivocationProtection) RelayDecode(encryptedPayload []byte, trusteesCo
 		}
 		log.Lvl1("sumTrustees:", sumTrustees)
 		log.Lvl1("sumClients:", sumClients)
-		log.Lvl1("history:", e.history)
+		log.Lvl1("history:", history)
 		log.Lvl1("prod:", prod)
 		log.Lvl1("k_i:", k_i)
 		return make([]byte, 0)
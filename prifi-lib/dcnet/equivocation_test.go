@@ -39,18 +39,18 @@ func equivocationTestForDataLength(t *testing.T, payloadSize int) {
 	sharedSecrets_t[1] = config.CryptoSuite.Point().Mul(c2priv, tpub)
 
 	// set up the DC-nets
-	dcnet_Trustee := NewDCNetEntity(0, DCNET_TRUSTEE, payloadSize, false, sharedSecrets_t)
-	dcnet_Client1 := NewDCNetEntity(0, DCNET_CLIENT, payloadSize, false, sharedSecret_c1)
-	dcnet_Client2 := NewDCNetEntity(1, DCNET_CLIENT, payloadSize, false, sharedSecret_c2)
+	dcnet_Trustee := NewDCNetEntity(0, DCNET_TRUSTEE, payloadSize, false, PAD_GENERATOR_XOF, sharedSecrets_t)
+	dcnet_Client1 := NewDCNetEntity(0, DCNET_CLIENT, payloadSize, false, PAD_GENERATOR_XOF, sharedSecret_c1)
+	dcnet_Client2 := NewDCNetEntity(1, DCNET_CLIENT, payloadSize, false, PAD_GENERATOR_XOF, sharedSecret_c2)
 
 	data := randomBytes(payloadSize)
 
 	// get the pads
-	padRound2_t := DCNetCipherFromBytes(dcnet_Trustee.TrusteeEncodeForRound(0))
+	padRound2_t, _ := DCNetCipherFromBytes(dcnet_Trustee.TrusteeEncodeForRound(0))
 	encode_for_round_1, _ := dcnet_Client1.EncodeForRound(0, true, data)
-	padRound1_c1 := DCNetCipherFromBytes(encode_for_round_1)
+	padRound1_c1, _ := DCNetCipherFromBytes(encode_for_round_1)
 	encode_for_round_2, _ := dcnet_Client2.EncodeForRound(0, false, nil)
-	padRound1_c2 := DCNetCipherFromBytes(encode_for_round_2)
+	padRound1_c2, _ := DCNetCipherFromBytes(encode_for_round_2)
 
 	res := make([]byte, payloadSize)
 	for i := range padRound1_c2.Payload {
@@ -108,7 +108,7 @@ func equivocationTestForDataLength(t *testing.T, payloadSize int) {
 	clientContrib[0] = kappa1
 	clientContrib[1] = kappa2
 
-	payloadPlaintext := e_relay.RelayDecode(x_prim1, trusteesContrib, clientContrib)
+	payloadPlaintext := e_relay.RelayDecode(e_relay.History(), x_prim1, trusteesContrib, clientContrib)
 
 	if bytes.Compare(payload, payloadPlaintext) != 0 {
 		log.Lvl1(payload)
@@ -116,3 +116,102 @@ func equivocationTestForDataLength(t *testing.T, payloadSize int) {
 		t.Error("payloads don't match")
 	}
 }
+
+func TestEquivocationHistory(t *testing.T) {
+	e1 := NewEquivocation()
+	e2 := NewEquivocation()
+
+	initial := e1.History()
+	e1.UpdateHistory([]byte{1, 2, 3})
+	if e1.History().Equal(initial) {
+		t.Error("the history should change with the downstream data")
+	}
+	if !initial.Equal(e2.History()) {
+		t.Error("updating a history should not change the ones given before")
+	}
+	e2.UpdateHistory([]byte{1, 2, 4})
+	if e1.History().Equal(e2.History()) {
+		t.Error("different downstream data should give different histories")
+	}
+	e2 = NewEquivocation()
+	e2.UpdateHistory([]byte{1, 2, 3})
+	if !e1.History().Equal(e2.History()) {
+		t.Error("the same downstream data should give the same history")
+	}
+}
+
+// TestEquivocationDownstreamHistory runs rounds in which the relay sends a downstream cell to the clients before they
+// encode; the slot owner's message can only be decoded if every client received what the relay sent
+func TestEquivocationDownstreamHistory(t *testing.T) {
+	payloadSize := 100
+	tg := NewTestGroup(t, true, PAD_GENERATOR_XOF, payloadSize, 2, 2)
+	message := []byte("the slot owner sends this")
+
+	for roundID := int32(0); roundID < 4; roundID++ {
+		downstream := randomBytes(50)
+		tg.Relay.DCNetEntity.UpdateReceivedMessageHistory(downstream)
+		tg.Clients[0].DCNetEntity.UpdateReceivedMessageHistory(downstream)
+
+		// from round 2, the relay equivocates, and sends other data to client 1
+		equivocated := roundID >= 2
+		if equivocated {
+			other := make([]byte, len(downstream))
+			copy(other, downstream)
+			other[0] ^= 1
+			downstream = other
+		}
+		tg.Clients[1].DCNetEntity.UpdateReceivedMessageHistory(downstream)
+
+		tg.Relay.DCNetEntity.DecodeStart(roundID)
+		c0, _ := tg.Clients[0].DCNetEntity.EncodeForRound(roundID, true, message)
+		c1, _ := tg.Clients[1].DCNetEntity.EncodeForRound(roundID, false, nil)
+		tg.Relay.DCNetEntity.DecodeClient(roundID, c0)
+		tg.Relay.DCNetEntity.DecodeClient(roundID, c1)
+		for _, n := range tg.Trustees {
+			tg.Relay.DCNetEntity.DecodeTrustee(roundID, n.DCNetEntity.TrusteeEncodeForRound(roundID))
+		}
+		decoded, _ := tg.Relay.DCNetEntity.DecodeCell(roundID, false)
+
+		if decodedMessage := decoded[:len(message)]; bytes.Equal(decodedMessage, message) == equivocated {
+			t.Error("round", roundID, ": equivocated", equivocated, ", but decoded", decodedMessage)
+		}
+	}
+}
+
+// TestEquivocationPipelinedHistory checks that the relay decodes each round with the history of its downstream cell,
+// even if it sent the cells of later rounds before
+func TestEquivocationPipelinedHistory(t *testing.T) {
+	payloadSize := 100
+	window := int32(3)
+	tg := NewTestGroup(t, true, PAD_GENERATOR_XOF, payloadSize, 2, 1)
+	message := []byte("the slot owner sends this")
+
+	clientCiphers := make(map[int32][][]byte)
+	for roundID := int32(0); roundID < window; roundID++ {
+		downstream := randomBytes(50)
+		tg.Relay.DCNetEntity.UpdateReceivedMessageHistory(downstream)
+		tg.Relay.DCNetEntity.DecodeStart(roundID)
+
+		for i, n := range tg.Clients {
+			n.DCNetEntity.UpdateReceivedMessageHistory(downstream)
+			var c []byte
+			if i == 0 {
+				c, _ = n.DCNetEntity.EncodeForRound(roundID, true, message)
+			} else {
+				c, _ = n.DCNetEntity.EncodeForRound(roundID, false, nil)
+			}
+			clientCiphers[roundID] = append(clientCiphers[roundID], c)
+		}
+	}
+
+	for roundID := int32(0); roundID < window; roundID++ {
+		for _, c := range clientCiphers[roundID] {
+			tg.Relay.DCNetEntity.DecodeClient(roundID, c)
+		}
+		tg.Relay.DCNetEntity.DecodeTrustee(roundID, tg.Trustees[0].DCNetEntity.TrusteeEncodeForRound(roundID))
+		decoded, _ := tg.Relay.DCNetEntity.DecodeCell(roundID, false)
+		if !bytes.Equal(decoded[:len(message)], message) {
+			t.Error("round", roundID, "should decode to", message, ", got", decoded[:len(message)])
+		}
+	}
+}
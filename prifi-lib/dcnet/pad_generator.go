@@ -0,0 +1,89 @@
+package dcnet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"go.dedis.ch/kyber/v3"
+	"golang.org/x/crypto/chacha20"
+)
+
+// Names of the pad generators, as given in prifi.toml ("DCNetPadGenerator")
+const (
+	// kyber's XOF (blake2xb for Ed25519), the historical generator
+	PAD_GENERATOR_XOF = "XOF"
+
+	// AES-256 in counter mode, using AES-NI when available
+	PAD_GENERATOR_AES_CTR = "AES-CTR"
+
+	// ChaCha20, fast on CPUs without AES-NI
+	PAD_GENERATOR_CHACHA20 = "ChaCha20"
+)
+
+// PadGenerator produces the pseudo-random pads shared by two DC-net members. Both ends of a shared secret
+// must use the same kind of generator, so it is negotiated in ALL_ALL_PARAMETERS
+type PadGenerator interface {
+	// XORKeyStream XORs each byte of src with the next byte of the pad, and stores the result in dst
+	XORKeyStream(dst, src []byte)
+}
+
+// IsValidPadGenerator returns true iff padGeneratorType names a known generator ("" stands for the default)
+func IsValidPadGenerator(padGeneratorType string) bool {
+	switch padGeneratorType {
+	case "", PAD_GENERATOR_XOF, PAD_GENERATOR_AES_CTR, PAD_GENERATOR_CHACHA20:
+		return true
+	}
+	return false
+}
+
+// NewPadGenerator creates a pad generator of the given type, seeded with seed. The empty type stands for the XOF.
+func NewPadGenerator(padGeneratorType string, seed []byte) (PadGenerator, error) {
+	switch padGeneratorType {
+	case "", PAD_GENERATOR_XOF:
+		return config.CryptoSuite.XOF(seed), nil
+
+	case PAD_GENERATOR_AES_CTR:
+		key := sha256.Sum256(seed)
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, aes.BlockSize)
+		return cipher.NewCTR(block, iv), nil
+
+	case PAD_GENERATOR_CHACHA20:
+		key := sha256.Sum256(seed)
+		nonce := make([]byte, chacha20.NonceSize)
+		return chacha20.NewUnauthenticatedCipher(key[:], nonce)
+	}
+	return nil, errors.New("unknown pad generator \"" + padGeneratorType + "\"")
+}
+
+// NewRoundPadGenerator creates the pad generator of one round, from the seed shared by two DC-net members (the
+// marshalled shared key). Each round has its own generator, so the pad of any round can be computed directly,
+// without generating the pads of the previous rounds
+func NewRoundPadGenerator(padGeneratorType string, seed []byte, roundID int32) (PadGenerator, error) {
+	roundSeed := make([]byte, len(seed)+4)
+	copy(roundSeed, seed)
+	binary.BigEndian.PutUint32(roundSeed[len(seed):], uint32(roundID))
+	return NewPadGenerator(padGeneratorType, roundSeed)
+}
+
+// RoundPad returns the first "size" bytes of the pad of round roundID, derived from a DC-net shared secret
+func RoundPad(padGeneratorType string, sharedKey kyber.Point, roundID int32, size int) ([]byte, error) {
+	seed, err := sharedKey.MarshalBinary()
+	if err != nil {
+		return nil, errors.New("could not extract data from shared key: " + err.Error())
+	}
+	prng, err := NewRoundPadGenerator(padGeneratorType, seed, roundID)
+	if err != nil {
+		return nil, err
+	}
+	pad := make([]byte, size)
+	prng.XORKeyStream(pad, pad)
+	return pad, nil
+}
@@ -0,0 +1,98 @@
+package dcnet
+
+import (
+	"bytes"
+	"testing"
+)
+
+var padGenerators = []string{PAD_GENERATOR_XOF, PAD_GENERATOR_AES_CTR, PAD_GENERATOR_CHACHA20}
+
+func TestPadGenerators(t *testing.T) {
+	seed := []byte("some shared secret")
+
+	for _, padGenerator := range padGenerators {
+		g1, err := NewPadGenerator(padGenerator, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g2, _ := NewPadGenerator(padGenerator, seed)
+		g3, _ := NewPadGenerator(padGenerator, []byte("another shared secret"))
+
+		p1 := make([]byte, 1000)
+		p2 := make([]byte, 1000)
+		p3 := make([]byte, 1000)
+		g1.XORKeyStream(p1, p1)
+		g2.XORKeyStream(p2, p2)
+		g3.XORKeyStream(p3, p3)
+
+		if !bytes.Equal(p1, p2) {
+			t.Error(padGenerator, "should produce the same pads from the same seed")
+		}
+		if bytes.Equal(p1, p3) || bytes.Equal(p1, make([]byte, 1000)) {
+			t.Error(padGenerator, "should produce different pads from different seeds")
+		}
+	}
+
+	if _, err := NewPadGenerator("ROT13", seed); err == nil {
+		t.Error("Unknown pad generators should be refused")
+	}
+	if IsValidPadGenerator("ROT13") || !IsValidPadGenerator("") {
+		t.Error("IsValidPadGenerator is wrong")
+	}
+}
+
+func benchmarkPadGenerator(b *testing.B, padGenerator string, payloadSize int) {
+	g, err := NewPadGenerator(padGenerator, []byte("some shared secret"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	pad := make([]byte, payloadSize)
+	b.SetBytes(int64(payloadSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.XORKeyStream(pad, pad)
+	}
+}
+
+func BenchmarkPadGeneratorXOF(b *testing.B) {
+	benchmarkPadGenerator(b, PAD_GENERATOR_XOF, 10000)
+}
+
+func BenchmarkPadGeneratorAESCTR(b *testing.B) {
+	benchmarkPadGenerator(b, PAD_GENERATOR_AES_CTR, 10000)
+}
+
+func BenchmarkPadGeneratorChaCha20(b *testing.B) {
+	benchmarkPadGenerator(b, PAD_GENERATOR_CHACHA20, 10000)
+}
+
+// one trustee encoding a round for 10 clients
+func benchmarkTrusteeEncode(b *testing.B, padGenerator string, equivocation bool) {
+	tg := NewTestGroup(nil, equivocation, padGenerator, 10000, 10, 1)
+	trustee := tg.Trustees[0].DCNetEntity
+	b.SetBytes(int64(10 * 10000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trustee.TrusteeEncodeForRound(int32(i))
+	}
+}
+
+func BenchmarkTrusteeEncodeXOF(b *testing.B) {
+	benchmarkTrusteeEncode(b, PAD_GENERATOR_XOF, false)
+}
+
+func BenchmarkTrusteeEncodeAESCTR(b *testing.B) {
+	benchmarkTrusteeEncode(b, PAD_GENERATOR_AES_CTR, false)
+}
+
+func BenchmarkTrusteeEncodeChaCha20(b *testing.B) {
+	benchmarkTrusteeEncode(b, PAD_GENERATOR_CHACHA20, false)
+}
+
+func BenchmarkTrusteeEncodeEquivXOF(b *testing.B) {
+	benchmarkTrusteeEncode(b, PAD_GENERATOR_XOF, true)
+}
+
+func BenchmarkTrusteeEncodeEquivAESCTR(b *testing.B) {
+	benchmarkTrusteeEncode(b, PAD_GENERATOR_AES_CTR, true)
+}
@@ -0,0 +1,420 @@
+package dcnet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/proof"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// Verifiable DC-net
+//
+// For each round r, the payload is cut in chunks of EmbedLen() bytes, and each chunk k uses a public generator
+// H_rk = HashToPoint(r, k), whose discrete logarithm is unknown.
+//
+// Each client i and trustee j derive a scalar s_ij from their shared secret. Then:
+// Clients compute:
+// s_i = SUM_j(s_ij),  c_ik = s_i * H_rk (+ M_k if slot owner), with S_i = s_i * G
+//
+// Trustees compute:
+// t_j = -SUM_i(s_ij), c_jk = t_j * H_rk, with T_j = t_j * G
+//
+// Relay compute:
+// M_k = SUM_i(c_ik) + SUM_j(c_jk)
+//
+// Both ends of each pad publish C_ij = s_ij * G (their "VerifiableDCNetKey"). The relay takes S_i = SUM_j(C_ij) from
+// the commitments of client i, and T_j = -SUM_i(C_ij) from the ones of trustee j: nobody can frame another entity by
+// committing to a wrong pad. If the two ends of a pad disagree, the pads do not cancel; the relay cannot tell which
+// end lied, and refuses the keys, naming the pair. Each cipher comes with a NIZK that log_G(S_i) = log_H(c_ik) for all k, or (for clients only)
+// that the sender knows the private key of the round's slot owner. A cipher that fails this check identifies its
+// sender as a disruptor.
+
+// verifiableDCNet holds the state of a verifiable DC-net entity
+type verifiableDCNet struct {
+	chunkSize int // bytes embedded per group element
+	nChunks   int // group elements per cipher
+
+	//Used by clients, trustees
+	secret     kyber.Scalar   // s_i for clients, t_j for trustees
+	padScalars []kyber.Scalar // s_ij, one per shared key
+
+	//Used by clients, relay
+	slotBase       kyber.Point   // last base of the Neff shuffle
+	slotKeys       []kyber.Point // shuffled ephemeral public keys, i.e., one per slot
+	mySlot         int           // -1 if unused
+	slotPrivateKey kyber.Scalar  // nil if unused
+
+	//Used by the relay
+	clientCommitments  []kyber.Point // S_i
+	trusteeCommitments []kyber.Point // T_j
+	generatorsLock     sync.Mutex    // the rounds of the window are verified concurrently
+	generatorsRoundID  int32
+	generators         []kyber.Point // cached H_rk for generatorsRoundID
+}
+
+// NewVerifiableDCNetEntity creates a DCNetEntity in which pads are group elements, and ciphers are proven correct.
+// Equivocation protection is not needed (and not supported) in this mode.
+func NewVerifiableDCNetEntity(
+	entityID int,
+	entity DCNET_ENTITY,
+	PayloadSize int,
+	sharedKeys []kyber.Point) *DCNetEntity {
+
+	e := NewDCNetEntity(entityID, entity, PayloadSize, false, PAD_GENERATOR_XOF, sharedKeys)
+
+	v := new(verifiableDCNet)
+	v.chunkSize = e.cryptoSuite.Point().EmbedLen()
+	v.nChunks = (PayloadSize + v.chunkSize - 1) / v.chunkSize
+	v.mySlot = -1
+	v.generatorsRoundID = -1
+
+	if entity != DCNET_RELAY {
+		v.padScalars = make([]kyber.Scalar, len(sharedKeys))
+		v.secret = e.cryptoSuite.Scalar().Zero()
+		for i := range sharedKeys {
+			v.padScalars[i] = verifiablePadScalar(e, sharedKeys[i])
+			v.secret.Add(v.secret, v.padScalars[i])
+		}
+		if entity == DCNET_TRUSTEE {
+			v.secret.Neg(v.secret)
+		}
+	}
+
+	e.verifiable = v
+	return e
+}
+
+// derives s_ij from the shared secret. Both ends of the shared secret obtain the same scalar
+func verifiablePadScalar(e *DCNetEntity, sharedKey kyber.Point) kyber.Scalar {
+	seed, err := sharedKey.MarshalBinary()
+	if err != nil {
+		panic("Could not extract data from shared key: " + err.Error())
+	}
+	seed = append([]byte("verifiable-dcnet-pad"), seed...)
+	return e.cryptoSuite.Scalar().Pick(e.cryptoSuite.XOF(seed))
+}
+
+// IsVerifiable returns true iff this entity was created with NewVerifiableDCNetEntity
+func (e *DCNetEntity) IsVerifiable() bool {
+	return e.verifiable != nil
+}
+
+// VerifiableDCNetKey returns the commitments C_ij = s_ij * G to each shared pad, to be sent to the relay by the
+// clients and the trustees
+func (e *DCNetEntity) VerifiableDCNetKey() []byte {
+	if e.verifiable == nil || e.Entity == DCNET_RELAY {
+		panic("VerifiableDCNetKey can only be called on a verifiable client or trustee")
+	}
+
+	out := make([]byte, 0)
+	for _, s := range e.verifiable.padScalars {
+		b, err := e.cryptoSuite.Point().Mul(s, nil).MarshalBinary()
+		if err != nil {
+			panic("Could not marshal commitment: " + err.Error())
+		}
+		out = append(out, b...)
+	}
+	return out
+}
+
+// SetVerifiableDCNetKeys is called on the relay with the VerifiableDCNetKey of each client and of each trustee (in
+// order), and computes the commitments to their secrets. It fails, naming the pair, if a client and a trustee do not
+// commit to the same pad.
+func (e *DCNetEntity) SetVerifiableDCNetKeys(clientKeys [][]byte, trusteeKeys [][]byte) error {
+	if e.verifiable == nil {
+		return errors.New("SetVerifiableDCNetKeys called on a non-verifiable DC-net")
+	}
+	if len(clientKeys) == 0 || len(trusteeKeys) == 0 {
+		return errors.New("no VerifiableDCNetKey given")
+	}
+
+	// C[i][j] as committed by client i, and by trustee j
+	clientPads, err := e.verifiableCommitments("client", clientKeys, len(trusteeKeys))
+	if err != nil {
+		return err
+	}
+	trusteePads, err := e.verifiableCommitments("trustee", trusteeKeys, len(clientKeys))
+	if err != nil {
+		return err
+	}
+
+	clientCommitments := make([]kyber.Point, len(clientKeys))
+	trusteeCommitments := make([]kyber.Point, len(trusteeKeys))
+	for j := range trusteeCommitments {
+		trusteeCommitments[j] = e.cryptoSuite.Point().Null()
+	}
+	for i := range clientCommitments {
+		clientCommitments[i] = e.cryptoSuite.Point().Null()
+		for j := range trusteeCommitments {
+			if !clientPads[i][j].Equal(trusteePads[j][i]) {
+				return errors.New("client " + strconv.Itoa(i) + " and trustee " + strconv.Itoa(j) + " commit to different pads")
+			}
+			clientCommitments[i].Add(clientCommitments[i], clientPads[i][j])
+			trusteeCommitments[j].Sub(trusteeCommitments[j], trusteePads[j][i])
+		}
+	}
+
+	e.verifiable.clientCommitments = clientCommitments
+	e.verifiable.trusteeCommitments = trusteeCommitments
+	return nil
+}
+
+// parses the VerifiableDCNetKey of each entity of a kind, each of which commits to nPeers pads
+func (e *DCNetEntity) verifiableCommitments(kind string, vkeys [][]byte, nPeers int) ([][]kyber.Point, error) {
+	pointLen := e.cryptoSuite.PointLen()
+	commitments := make([][]kyber.Point, len(vkeys))
+	for i, vkey := range vkeys {
+		if len(vkey) != nPeers*pointLen {
+			return nil, errors.New("VerifiableDCNetKey of " + kind + " " + strconv.Itoa(i) + " has invalid length " + strconv.Itoa(len(vkey)))
+		}
+		commitments[i] = make([]kyber.Point, nPeers)
+		for j := range commitments[i] {
+			commitments[i][j] = e.cryptoSuite.Point()
+			if err := commitments[i][j].UnmarshalBinary(vkey[j*pointLen : (j+1)*pointLen]); err != nil {
+				return nil, errors.New("VerifiableDCNetKey of " + kind + " " + strconv.Itoa(i) + " is invalid: " + err.Error())
+			}
+		}
+	}
+	return commitments, nil
+}
+
+// SetVerifiableSlots tells the DC-net the result of the Neff shuffle. Clients give their own slot and
+// ephemeral private key, the relay gives -1 and nil.
+func (e *DCNetEntity) SetVerifiableSlots(base kyber.Point, slotKeys []kyber.Point, mySlot int, slotPrivateKey kyber.Scalar) {
+	if e.verifiable == nil {
+		panic("SetVerifiableSlots called on a non-verifiable DC-net")
+	}
+	e.verifiable.slotBase = base
+	e.verifiable.slotKeys = slotKeys
+	e.verifiable.mySlot = mySlot
+	e.verifiable.slotPrivateKey = slotPrivateKey
+}
+
+// returns the public generators H_rk for this round
+func (e *DCNetEntity) verifiableGenerators(roundID int32) []kyber.Point {
+	v := e.verifiable
+	v.generatorsLock.Lock()
+	defer v.generatorsLock.Unlock()
+
+	if v.generators != nil && v.generatorsRoundID == roundID {
+		return v.generators
+	}
+
+	generators := make([]kyber.Point, v.nChunks)
+	for k := range generators {
+		seed := []byte("verifiable-dcnet-generator-" + strconv.Itoa(int(roundID)) + "-" + strconv.Itoa(k))
+		generators[k] = e.cryptoSuite.Point().Pick(e.cryptoSuite.XOF(seed))
+	}
+	v.generators = generators
+	v.generatorsRoundID = roundID
+	return generators
+}
+
+// returns the slot key of ownerSlot, or nil if there is no (known) owner
+func (v *verifiableDCNet) ownerKey(ownerSlot int) kyber.Point {
+	if ownerSlot < 0 || ownerSlot >= len(v.slotKeys) || v.slotBase == nil {
+		return nil
+	}
+	return v.slotKeys[ownerSlot]
+}
+
+// builds the predicate "log_G(X) = log_H(c_k) for all k [OR I own the slot]", and the associated public values
+func (e *DCNetEntity) verifiablePredicate(commitment kyber.Point, generators, ciphers []kyber.Point,
+	ownerKey kyber.Point) (proof.Predicate, proof.Predicate, map[string]kyber.Point) {
+
+	pval := make(map[string]kyber.Point)
+	pval["G"] = e.cryptoSuite.Point().Base()
+	pval["X"] = commitment
+
+	reps := make([]proof.Predicate, 0, len(generators)+1)
+	reps = append(reps, proof.Rep("X", "x", "G"))
+	for k := range generators {
+		H := "H" + strconv.Itoa(k)
+		C := "C" + strconv.Itoa(k)
+		pval[H] = generators[k]
+		pval[C] = ciphers[k]
+		reps = append(reps, proof.Rep(C, "x", H))
+	}
+	padPredicate := proof.And(reps...)
+
+	if ownerKey == nil {
+		return padPredicate, padPredicate, pval
+	}
+
+	pval["B"] = e.verifiable.slotBase
+	pval["P"] = ownerKey
+	return proof.Or(padPredicate, proof.Rep("P", "p", "B")), padPredicate, pval
+}
+
+// the Fiat-Shamir context binds the proof to the round and to the group elements
+func verifiableProofContext(roundID int32, points []byte) string {
+	h := sha256.Sum256(points)
+	return "PriFi-VerifiableDCNet-" + strconv.Itoa(int(roundID)) + "-" + hex.EncodeToString(h[:])
+}
+
+// VerifiableEncodeForRound produces a verifiable cipher for the round; ownerSlot is the slot owning the round (-1 if
+// none). Trustees may give any ownerSlot. The result is the group elements, followed by the proof.
+func (e *DCNetEntity) VerifiableEncodeForRound(roundID int32, ownerSlot int, payload []byte) []byte {
+	v := e.verifiable
+	if v == nil || e.Entity == DCNET_RELAY {
+		panic("VerifiableEncodeForRound can only be called on a verifiable client or trustee")
+	}
+	if len(payload) > e.DCNetPayloadSize {
+		panic("DCNet: cannot encode Payload of length " + strconv.Itoa(len(payload)) + " max length is " + strconv.Itoa(e.DCNetPayloadSize))
+	}
+
+	var ownerKey kyber.Point
+	slotOwner := false
+	if e.Entity == DCNET_CLIENT {
+		ownerKey = v.ownerKey(ownerSlot)
+		slotOwner = ownerKey != nil && ownerSlot == v.mySlot && v.slotPrivateKey != nil
+	}
+
+	generators := e.verifiableGenerators(roundID)
+	ciphers := make([]kyber.Point, v.nChunks)
+	pointsBytes := make([]byte, 0, v.nChunks*e.cryptoSuite.PointLen())
+
+	paddedPayload := make([]byte, e.DCNetPayloadSize)
+	copy(paddedPayload, payload)
+
+	for k := range ciphers {
+		ciphers[k] = e.cryptoSuite.Point().Mul(v.secret, generators[k])
+		if slotOwner {
+			end := (k + 1) * v.chunkSize
+			if end > e.DCNetPayloadSize {
+				end = e.DCNetPayloadSize
+			}
+			M_k := e.cryptoSuite.Point().Embed(paddedPayload[k*v.chunkSize:end], e.cryptoSuite.RandomStream())
+			ciphers[k].Add(ciphers[k], M_k)
+		}
+		b, err := ciphers[k].MarshalBinary()
+		if err != nil {
+			panic("Could not marshal cipher: " + err.Error())
+		}
+		pointsBytes = append(pointsBytes, b...)
+	}
+
+	commitment := e.cryptoSuite.Point().Mul(v.secret, nil)
+	pred, padPredicate, pval := e.verifiablePredicate(commitment, generators, ciphers, ownerKey)
+
+	sval := make(map[string]kyber.Scalar)
+	choice := make(map[proof.Predicate]int)
+	if slotOwner {
+		sval["p"] = v.slotPrivateKey
+		choice[pred] = 1
+	} else {
+		sval["x"] = v.secret
+		if pred != padPredicate {
+			choice[pred] = 0
+		}
+	}
+
+	prover := pred.Prover(e.cryptoSuite, sval, pval, choice)
+	NIZK, err := proof.HashProve(e.cryptoSuite, verifiableProofContext(roundID, pointsBytes), prover)
+	if err != nil {
+		panic("Could not produce the verifiable DC-net proof: " + err.Error())
+	}
+
+	e.verbosePrint("r[", roundID, "]: verifiable cipher, owner ", slotOwner)
+	return append(pointsBytes, NIZK...)
+}
+
+// parses a verifiable cipher into its group elements and its proof
+func (e *DCNetEntity) verifiableCipherFromBytes(data []byte) ([]kyber.Point, []byte, error) {
+	pointLen := e.cryptoSuite.PointLen()
+	n := e.verifiable.nChunks
+	if len(data) < n*pointLen {
+		return nil, nil, errors.New("verifiable cipher too short (" + strconv.Itoa(len(data)) + " bytes)")
+	}
+	ciphers := make([]kyber.Point, n)
+	for k := range ciphers {
+		ciphers[k] = e.cryptoSuite.Point()
+		if err := ciphers[k].UnmarshalBinary(data[k*pointLen : (k+1)*pointLen]); err != nil {
+			return nil, nil, errors.New("verifiable cipher contains an invalid point: " + err.Error())
+		}
+	}
+	return ciphers, data[n*pointLen:], nil
+}
+
+// checks the proof of a cipher against the commitment of its sender
+func (e *DCNetEntity) verifyCipher(roundID int32, commitment kyber.Point, ownerKey kyber.Point, data []byte) error {
+	ciphers, NIZK, err := e.verifiableCipherFromBytes(data)
+	if err != nil {
+		return err
+	}
+	pointsBytes := data[:len(data)-len(NIZK)]
+	generators := e.verifiableGenerators(roundID)
+	pred, _, pval := e.verifiablePredicate(commitment, generators, ciphers, ownerKey)
+	verifier := pred.Verifier(e.cryptoSuite, pval)
+	return proof.HashVerify(e.cryptoSuite, verifiableProofContext(roundID, pointsBytes), verifier, NIZK)
+}
+
+// VerifyClientCipher is called by the relay to check that client clientID formed its cipher correctly for this round,
+// i.e., that it only contains its pads, or that it owns the slot ownerSlot (-1 if none)
+func (e *DCNetEntity) VerifyClientCipher(roundID int32, clientID int, ownerSlot int, data []byte) error {
+	v := e.verifiable
+	if v == nil || v.clientCommitments == nil {
+		return errors.New("cannot verify client ciphers, the verifiable DC-net keys are not set")
+	}
+	if clientID < 0 || clientID >= len(v.clientCommitments) {
+		return errors.New("unknown client " + strconv.Itoa(clientID))
+	}
+	return e.verifyCipher(roundID, v.clientCommitments[clientID], v.ownerKey(ownerSlot), data)
+}
+
+// VerifyTrusteeCipher is called by the relay to check that trustee trusteeID formed its cipher correctly for this round
+func (e *DCNetEntity) VerifyTrusteeCipher(roundID int32, trusteeID int, data []byte) error {
+	v := e.verifiable
+	if v == nil || v.trusteeCommitments == nil {
+		return errors.New("cannot verify trustee ciphers, the verifiable DC-net keys are not set")
+	}
+	if trusteeID < 0 || trusteeID >= len(v.trusteeCommitments) {
+		return errors.New("unknown trustee " + strconv.Itoa(trusteeID))
+	}
+	return e.verifyCipher(roundID, v.trusteeCommitments[trusteeID], nil, data)
+}
+
+// adds the group elements of a cipher in the decoding buffer
+func (e *DCNetEntity) verifiableDecode(d *DCNetRoundDecoder, slice []byte) error {
+	ciphers, _, err := e.verifiableCipherFromBytes(slice)
+	if err != nil {
+		return errors.New("cannot decode verifiable cipher: " + err.Error())
+	}
+	if d.pointBuffer == nil {
+		d.pointBuffer = make([]kyber.Point, len(ciphers))
+		for k := range d.pointBuffer {
+			d.pointBuffer[k] = e.cryptoSuite.Point().Null()
+		}
+	}
+	if len(ciphers) != len(d.pointBuffer) {
+		return errors.New("the cipher has " + strconv.Itoa(len(ciphers)) + " elements instead of " + strconv.Itoa(len(d.pointBuffer)))
+	}
+	for k := range ciphers {
+		d.pointBuffer[k].Add(d.pointBuffer[k], ciphers[k])
+	}
+	return nil
+}
+
+// extracts the payload from the decoding buffer
+func (e *DCNetEntity) verifiableDecodeCell(d *DCNetRoundDecoder) []byte {
+	v := e.verifiable
+	out := make([]byte, e.DCNetPayloadSize)
+	null := e.cryptoSuite.Point().Null()
+	for k, M_k := range d.pointBuffer {
+		if M_k.Equal(null) {
+			continue // nobody transmitted
+		}
+		data, err := M_k.Data()
+		if err != nil {
+			log.Lvl2("Verifiable DC-net: could not extract data of chunk", k, err)
+			continue
+		}
+		copy(out[k*v.chunkSize:], data)
+	}
+	return out
+}
@@ -0,0 +1,240 @@
+package dcnet
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"go.dedis.ch/kyber/v3"
+)
+
+// NewVerifiableTestGroup creates a verifiable DC-net, where client i owns slot i
+func NewVerifiableTestGroup(t *testing.T, dcNetMessageSize, nclients, ntrustees int) *TestGroup {
+	tg := NewTestGroup(t, false, PAD_GENERATOR_XOF, dcNetMessageSize, nclients, ntrustees)
+
+	// a fake Neff shuffle: a random base, and client i owns slot i
+	rand := config.CryptoSuite.XOF([]byte("VerifiableDCTest"))
+	base := config.CryptoSuite.Point().Pick(rand)
+	slotPrivateKeys := make([]kyber.Scalar, nclients)
+	slotKeys := make([]kyber.Point, nclients)
+	for i := range slotKeys {
+		slotPrivateKeys[i] = config.CryptoSuite.Scalar().Pick(rand)
+		slotKeys[i] = config.CryptoSuite.Point().Mul(slotPrivateKeys[i], base)
+	}
+
+	clientKeys := make([][]byte, nclients)
+	for i, n := range tg.Clients {
+		n.DCNetEntity = NewVerifiableDCNetEntity(i, DCNET_CLIENT, dcNetMessageSize, n.sharedSecrets)
+		n.DCNetEntity.SetVerifiableSlots(base, slotKeys, i, slotPrivateKeys[i])
+		clientKeys[i] = n.DCNetEntity.VerifiableDCNetKey()
+	}
+	trusteeKeys := make([][]byte, ntrustees)
+	for i, n := range tg.Trustees {
+		n.DCNetEntity = NewVerifiableDCNetEntity(i, DCNET_TRUSTEE, dcNetMessageSize, n.sharedSecrets)
+		trusteeKeys[i] = n.DCNetEntity.VerifiableDCNetKey()
+	}
+
+	tg.Relay.DCNetEntity = NewVerifiableDCNetEntity(0, DCNET_RELAY, dcNetMessageSize, nil)
+	if err := tg.Relay.DCNetEntity.SetVerifiableDCNetKeys(clientKeys, trusteeKeys); err != nil {
+		t.Fatal(err)
+	}
+	tg.Relay.DCNetEntity.SetVerifiableSlots(base, slotKeys, -1, nil)
+
+	return tg
+}
+
+func TestVerifiableDCNet(t *testing.T) {
+	dcNetMessageSize := 100
+	nClients := 3
+	nTrustees := 2
+	tg := NewVerifiableTestGroup(t, dcNetMessageSize, nClients, nTrustees)
+	relay := tg.Relay.DCNetEntity
+
+	for roundID := int32(0); roundID < 6; roundID++ {
+		owner := int(roundID) % nClients
+		message := randomBytes(dcNetMessageSize)
+
+		relay.DecodeStart(roundID)
+		for i, c := range tg.Clients {
+			var m []byte
+			if i == owner {
+				m = c.DCNetEntity.VerifiableEncodeForRound(roundID, owner, message)
+			} else {
+				m = c.DCNetEntity.VerifiableEncodeForRound(roundID, owner, nil)
+			}
+			if err := relay.VerifyClientCipher(roundID, i, owner, m); err != nil {
+				t.Error("Client", i, "cipher should verify, but", err)
+			}
+			relay.DecodeClient(roundID, m)
+		}
+		for j, tr := range tg.Trustees {
+			m := tr.DCNetEntity.TrusteeEncodeForRound(roundID)
+			if err := relay.VerifyTrusteeCipher(roundID, j, m); err != nil {
+				t.Error("Trustee", j, "cipher should verify, but", err)
+			}
+			relay.DecodeTrustee(roundID, m)
+		}
+
+		output, _ := relay.DecodeCell(roundID, false)
+		if !bytes.Equal(output, message) {
+			t.Error("Verifiable DC-net decoding failed in round", roundID)
+		}
+	}
+
+	// a round without owner decodes to zeros
+	roundID := int32(6)
+	relay.DecodeStart(roundID)
+	for i, c := range tg.Clients {
+		m := c.DCNetEntity.VerifiableEncodeForRound(roundID, -1, randomBytes(10))
+		if err := relay.VerifyClientCipher(roundID, i, -1, m); err != nil {
+			t.Error(err)
+		}
+		relay.DecodeClient(roundID, m)
+	}
+	for _, tr := range tg.Trustees {
+		relay.DecodeTrustee(roundID, tr.DCNetEntity.TrusteeEncodeForRound(roundID))
+	}
+	output, _ := relay.DecodeCell(roundID, false)
+	if !bytes.Equal(output, make([]byte, dcNetMessageSize)) {
+		t.Error("Verifiable DC-net round without owner should decode to zeros")
+	}
+}
+
+func TestVerifiableDCNetDetectsDisruption(t *testing.T) {
+	dcNetMessageSize := 50
+	tg := NewVerifiableTestGroup(t, dcNetMessageSize, 2, 2)
+	relay := tg.Relay.DCNetEntity
+	roundID := int32(3)
+
+	// flipping a bit in the cipher
+	m := tg.Clients[0].DCNetEntity.VerifiableEncodeForRound(roundID, 1, nil)
+	m[0] ^= 1
+	if err := relay.VerifyClientCipher(roundID, 0, 1, m); err == nil {
+		t.Error("A modified cipher should not verify")
+	}
+
+	// a non-owner claiming the slot: its message is embedded, but the proof cannot be produced
+	m = tg.Clients[0].DCNetEntity.VerifiableEncodeForRound(roundID, 0, randomBytes(10))
+	if err := relay.VerifyClientCipher(roundID, 0, 1, m); err == nil {
+		t.Error("A cipher proven for another owner should not verify")
+	}
+
+	// replaying a cipher in another round
+	m = tg.Trustees[1].DCNetEntity.TrusteeEncodeForRound(roundID)
+	if err := relay.VerifyTrusteeCipher(roundID+1, 1, m); err == nil {
+		t.Error("A cipher replayed in another round should not verify")
+	}
+
+	// a cipher sent under someone else's identity
+	m = tg.Trustees[1].DCNetEntity.TrusteeEncodeForRound(roundID)
+	if err := relay.VerifyTrusteeCipher(roundID, 0, m); err == nil {
+		t.Error("A cipher from trustee 1 should not verify as trustee 0's")
+	}
+}
+
+// with a window, the relay verifies and decodes the ciphers of several rounds at the same time
+func TestVerifiableDCNetKeysCannotFrame(t *testing.T) {
+	dcNetMessageSize := 50
+	tg := NewVerifiableTestGroup(t, dcNetMessageSize, 2, 2)
+	clientKeys := [][]byte{tg.Clients[0].DCNetEntity.VerifiableDCNetKey(), tg.Clients[1].DCNetEntity.VerifiableDCNetKey()}
+	trusteeKeys := [][]byte{tg.Trustees[0].DCNetEntity.VerifiableDCNetKey(), tg.Trustees[1].DCNetEntity.VerifiableDCNetKey()}
+
+	// trustee 1 commits to another pad with client 0, which would make the honest client's proofs fail
+	pointLen := config.CryptoSuite.PointLen()
+	wrong, _ := config.CryptoSuite.Point().Pick(config.CryptoSuite.RandomStream()).MarshalBinary()
+	framing := append([]byte{}, trusteeKeys[1]...)
+	copy(framing[:pointLen], wrong)
+
+	relay := NewVerifiableDCNetEntity(0, DCNET_RELAY, dcNetMessageSize, nil)
+	err := relay.SetVerifiableDCNetKeys(clientKeys, [][]byte{trusteeKeys[0], framing})
+	if err == nil || !strings.Contains(err.Error(), "client 0 and trustee 1") {
+		t.Error("The relay should refuse keys on which client 0 and trustee 1 disagree, got", err)
+	}
+	if err := relay.SetVerifiableDCNetKeys(clientKeys, trusteeKeys[:1]); err == nil {
+		t.Error("The relay should refuse client keys that do not commit to a pad per trustee")
+	}
+}
+
+func TestVerifiableDCNetConcurrentRounds(t *testing.T) {
+	dcNetMessageSize := 50
+	nClients := 2
+	tg := NewVerifiableTestGroup(t, dcNetMessageSize, nClients, 2)
+	relay := tg.Relay.DCNetEntity
+	nRounds := 4
+
+	messages := make([][]byte, nRounds)
+	ciphers := make([][][]byte, nRounds)
+	for r := range ciphers {
+		roundID := int32(r)
+		owner := r % nClients
+		messages[r] = randomBytes(dcNetMessageSize)
+		for i, c := range tg.Clients {
+			if i == owner {
+				ciphers[r] = append(ciphers[r], c.DCNetEntity.VerifiableEncodeForRound(roundID, owner, messages[r]))
+			} else {
+				ciphers[r] = append(ciphers[r], c.DCNetEntity.VerifiableEncodeForRound(roundID, owner, nil))
+			}
+		}
+		for _, tr := range tg.Trustees {
+			ciphers[r] = append(ciphers[r], tr.DCNetEntity.TrusteeEncodeForRound(roundID))
+		}
+		relay.DecodeStart(roundID)
+	}
+
+	var wg sync.WaitGroup
+	for r := range ciphers {
+		wg.Add(1)
+		go func(roundID int32) {
+			defer wg.Done()
+			owner := int(roundID) % nClients
+			for i, m := range ciphers[roundID] {
+				var err error
+				if i < nClients {
+					err = relay.VerifyClientCipher(roundID, i, owner, m)
+				} else {
+					err = relay.VerifyTrusteeCipher(roundID, i-nClients, m)
+				}
+				if err == nil {
+					if i < nClients {
+						err = relay.DecodeClient(roundID, m)
+					} else {
+						err = relay.DecodeTrustee(roundID, m)
+					}
+				}
+				if err != nil {
+					t.Error("round", roundID, "cipher", i, ":", err)
+				}
+			}
+		}(int32(r))
+	}
+	wg.Wait()
+
+	for r := range messages {
+		if output, _ := relay.DecodeCell(int32(r), false); !bytes.Equal(output, messages[r]) {
+			t.Error("Verifiable DC-net decoding failed in round", r)
+		}
+	}
+}
+
+func TestVerifiableDCNetMalformedCiphers(t *testing.T) {
+	dcNetMessageSize := 50
+	tg := NewVerifiableTestGroup(t, dcNetMessageSize, 2, 2)
+	relay := tg.Relay.DCNetEntity
+	roundID := int32(0)
+	m := tg.Clients[0].DCNetEntity.VerifiableEncodeForRound(roundID, 1, nil)
+
+	relay.DecodeStart(roundID)
+	for _, malformed := range [][]byte{nil, m[:10], m[:len(m)-1]} {
+		if err := relay.VerifyClientCipher(roundID, 0, 1, malformed); err == nil {
+			t.Error("A malformed cipher of", len(malformed), "bytes should not verify")
+		}
+	}
+	if err := relay.DecodeClient(roundID, m[:10]); err == nil {
+		t.Error("A truncated cipher should not be decoded")
+	}
+	if err := relay.DecodeTrustee(roundID, nil); err == nil {
+		t.Error("An empty cipher should not be decoded")
+	}
+}
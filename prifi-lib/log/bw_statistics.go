@@ -33,6 +33,10 @@ type BitrateStatistics struct {
 	totalDownstreamRetransmitBytes   int64
 	instantDownstreamRetransmitBytes int64
 
+	totalUpstreamDataBytes   int64
+	instantUpstreamDataBytes int64
+	totalCompressedCells     int64
+
 	reportNo int
 }
 
@@ -83,6 +87,17 @@ func (stats *BitrateStatistics) AddUpstreamCell(nBytes int64) {
 	stats.instantUpstreamBytes += nBytes
 }
 
+//AddUpstreamData adds N bytes to the count of data the upstream cells carried, without padding
+func (stats *BitrateStatistics) AddUpstreamData(nBytes int64) {
+	stats.totalUpstreamDataBytes += nBytes
+	stats.instantUpstreamDataBytes += nBytes
+}
+
+//AddCompressedUpstreamCell counts an upstream cell that was compressed
+func (stats *BitrateStatistics) AddCompressedUpstreamCell() {
+	stats.totalCompressedCells++
+}
+
 //Report prints (if t>period=5 seconds have passed since the last report) all the information, without extra data
 func (stats *BitrateStatistics) Report() string {
 	return stats.ReportWithInfo("")
@@ -94,7 +109,7 @@ func (stats *BitrateStatistics) ReportWithInfo(info string) string {
 	if now.After(stats.nextReport) {
 
 		//human-readable output
-		str := fmt.Sprintf("[%v] %0.1f round/sec, %0.1f kB/s up, %0.1f kB/s down, %0.1f kB/s down(udp), %0.1f kB/s down(re-udp), %v cells, %v total",
+		str := fmt.Sprintf("[%v] %0.1f round/sec, %0.1f kB/s up, %0.1f kB/s down, %0.1f kB/s down(udp), %0.1f kB/s down(re-udp), %v cells, %v total, %0.1f kB/s up(effective), %v compressed cells",
 			stats.reportNo,
 			float64(stats.instantUpstreamCells)/stats.period.Seconds(),
 			float64(stats.instantUpstreamBytes)/1024/stats.period.Seconds(),
@@ -102,18 +117,21 @@ func (stats *BitrateStatistics) ReportWithInfo(info string) string {
 			float64(stats.instantDownstreamUDPBytes)/1024/stats.period.Seconds(),
 			float64(stats.instantDownstreamRetransmitBytes)/1024/stats.period.Seconds(),
 			stats.totalUpstreamCells,
-			int64(stats.totalUpstreamCells)*int64(stats.cellSize))
+			int64(stats.totalUpstreamCells)*int64(stats.cellSize),
+			float64(stats.instantUpstreamDataBytes)/1024/stats.period.Seconds(),
+			stats.totalCompressedCells)
 
 		log.Lvlf1(str)
 
 		//json output
-		strJSON := fmt.Sprintf("{ \"type\"=\"relay_bw\", \"report_id\"=\"%v\", \"round_per_sec\"=\"%0.1f\", \"up_kbps\"=\"%0.1f\", \"down_kbps\"=\"%0.1f\", \"down_udp_kbps\"=\"%0.1f\", \"down_re_udp_kbps\"=\"%0.1f\" }\n",
+		strJSON := fmt.Sprintf("{ \"type\"=\"relay_bw\", \"report_id\"=\"%v\", \"round_per_sec\"=\"%0.1f\", \"up_kbps\"=\"%0.1f\", \"down_kbps\"=\"%0.1f\", \"down_udp_kbps\"=\"%0.1f\", \"down_re_udp_kbps\"=\"%0.1f\", \"up_effective_kbps\"=\"%0.1f\" }\n",
 			stats.reportNo,
 			float64(stats.instantUpstreamCells)/stats.period.Seconds(),
 			float64(stats.instantUpstreamBytes)/1024/stats.period.Seconds(),
 			float64(stats.instantDownstreamBytes)/1024/stats.period.Seconds(),
 			float64(stats.instantDownstreamUDPBytes)/1024/stats.period.Seconds(),
-			float64(stats.instantDownstreamRetransmitBytes)/1024/stats.period.Seconds())
+			float64(stats.instantDownstreamRetransmitBytes)/1024/stats.period.Seconds(),
+			float64(stats.instantUpstreamDataBytes)/1024/stats.period.Seconds())
 
 		// Next report time
 		stats.instantUpstreamCells = 0
@@ -121,6 +139,7 @@ func (stats *BitrateStatistics) ReportWithInfo(info string) string {
 		stats.instantDownstreamBytes = 0
 		stats.instantDownstreamUDPBytes = 0
 		stats.instantDownstreamRetransmitBytes = 0
+		stats.instantUpstreamDataBytes = 0
 
 		stats.nextReport = now.Add(stats.period)
 		stats.reportNo++
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -10,7 +11,14 @@ func TestBWStatistics(t *testing.T) {
 	b.AddDownstreamUDPCell(int64(2000), 2)
 	b.AddDownstreamRetransmitCell(int64(1000))
 	b.AddUpstreamCell(int64(1000))
-	b.Report()
+	b.AddUpstreamData(int64(2048))
+	b.AddCompressedUpstreamCell()
+	if s := b.Report(); !strings.Contains(s, "\"up_effective_kbps\"=\"0.4\"") {
+		t.Error("Wrong effective upstream bitrate", s)
+	}
+	if b.instantUpstreamDataBytes != 0 || b.totalUpstreamDataBytes != 2048 || b.totalCompressedCells != 1 {
+		t.Error("Wrong upstream data counters")
+	}
 	b.Dump()
 }
 func TestLatencyStatistics(t *testing.T) {
@@ -16,6 +16,8 @@ type SchedulesStatistics struct {
 	period                     time.Duration
 	reportNo                   int
 	scheduleLengthRepartitions map[int]int
+	slots                      int
+	openSlots                  int
 }
 
 //NewSchedulesStatistics create a new TimeStatistics struct, with a period (for reporting) of 5 second
@@ -42,6 +44,13 @@ func (stats *SchedulesStatistics) AddSchedule(newSchedule map[int]bool) {
 	}
 
 	stats.scheduleLengthRepartitions[scheduleLength]++
+	stats.slots += len(newSchedule)
+	stats.openSlots += scheduleLength
+}
+
+//OpenSlots returns how many slots were open in all the schedules added, and how many slots they had
+func (stats *SchedulesStatistics) OpenSlots() (int, int) {
+	return stats.openSlots, stats.slots
 }
 
 //Report prints (if t>period=5 seconds have passed since the last report) all the information, without extra data
@@ -0,0 +1,113 @@
+package net
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/onet/v3/network"
+)
+
+func init() {
+	network.RegisterMessage(BlameTranscript{})
+}
+
+// BlameVerdict is the outcome of the blame protocol of the disruption protection: the client or trustee the relay
+// found guilty of disrupting a round, and why. The relay signs it with the key of its server identity, so the layer
+// acting on it (e.g., evicting the guilty entity) can check where it comes from.
+type BlameVerdict struct {
+	RoundID         int32
+	BitPos          int
+	GuiltyIsTrustee bool // true if GuiltyID is a trustee, false if it is a client
+	GuiltyID        int
+	Reason          string
+	Signature       []byte
+}
+
+// signedBytes returns the encoding of the verdict covered by the signature
+func (v *BlameVerdict) signedBytes() []byte {
+	out := make([]byte, 13)
+	binary.BigEndian.PutUint32(out[0:4], uint32(v.RoundID))
+	binary.BigEndian.PutUint32(out[4:8], uint32(v.BitPos))
+	if v.GuiltyIsTrustee {
+		out[8] = 1
+	}
+	binary.BigEndian.PutUint32(out[9:13], uint32(v.GuiltyID))
+	return append(out, []byte(v.Reason)...)
+}
+
+// Sign signs the verdict with the private key of the relay's server identity
+func (v *BlameVerdict) Sign(privateKey kyber.Scalar) error {
+	if privateKey == nil {
+		return errors.New("no key to sign the verdict")
+	}
+	sig, err := schnorr.Sign(config.CryptoSuite, privateKey, v.signedBytes())
+	if err != nil {
+		return err
+	}
+	v.Signature = sig
+	return nil
+}
+
+// Verify checks the signature of the verdict against relayPublicKey, which must be the key of the relay's server
+// identity as known from the roster, never one taken from the relay's messages
+func (v *BlameVerdict) Verify(relayPublicKey kyber.Point) error {
+	if relayPublicKey == nil {
+		return errors.New("the key of the relay is unknown")
+	}
+	if v.Signature == nil {
+		return errors.New("the verdict is not signed")
+	}
+	return schnorr.Verify(config.CryptoSuite, relayPublicKey, v.signedBytes(), v.Signature)
+}
+
+// BlameTranscript is the evidence behind a BlameVerdict: what the relay stored of the blamed round, and everything
+// the clients and trustees revealed during the blame, as they sent it. The ciphers, the reveals and the secrets are
+// signed by their senders (see blame_evidence.go), so anyone can re-check the verdict from it (see
+// relay.VerifyBlameTranscript) with the keys of the roster, without trusting the relay.
+type BlameTranscript struct {
+	Verdict                 BlameVerdict
+	Session                 int        // what the signatures of the entities are bound to
+	Identities              Identities // the keys of the server identities, as the relay knows them
+	DCNetPadGenerator       string
+	PayloadSize             int           // the size of the DC-net payload of the blamed round, see dcnet.CellLayout
+	ClientPublicKeys        []kyber.Point // indexed by client ID
+	TrusteePublicKeys       []kyber.Point // the DC-net keys, indexed by trustee ID
+	ClientCiphers           [][]byte      // the ciphers of the blamed round, as stored in CiphertextsHistoryClients
+	TrusteeCiphers          [][]byte      // the ciphers of the blamed round, as stored in CiphertextsHistoryTrustees
+	ClientCipherSignatures  [][]byte      // see SignCipher
+	TrusteeCipherSignatures [][]byte
+	ClientReveals           []CLI_REL_DISRUPTION_REVEAL
+	TrusteeReveals          []TRU_REL_DISRUPTION_REVEAL
+	ClientSecrets           []CLI_REL_SHARED_SECRET // in phase 2, the secret of the blamed client, if it answered
+	TrusteeSecrets          []TRU_REL_SHARED_SECRET // in phase 2, the secret of the blamed trustee, if it answered
+}
+
+// Save writes the transcript to the file at path
+func (t *BlameTranscript) Save(path string) error {
+	b, err := network.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0660)
+}
+
+// LoadBlameTranscript reads a transcript written by Save
+func LoadBlameTranscript(path string) (*BlameTranscript, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	_, msg, err := network.Unmarshal(b, config.CryptoSuite)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := msg.(*BlameTranscript)
+	if !ok {
+		return nil, errors.New("the file does not contain a blame transcript")
+	}
+	return t, nil
+}
@@ -0,0 +1,206 @@
+package net
+
+/*
+Evidence of the blames
+**********************
+The relay could report other ciphers or other reveals than the ones an entity sent, and frame it. So, with the
+disruption protection, the clients and trustees sign with the key of their server identity (see Identities) what can
+be evidence in a blame: their ciphers (CLI_REL_UPSTREAM_DATA, TRU_REL_DC_CIPHER), the bits they reveal and their shared
+secrets. Those signatures, and the proofs of the reveals and of the secrets, are bound to the session, the round and
+the bit blamed, and the entity that makes them, so they cannot be replayed in another blame.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+)
+
+// blameContext encodes what a signature or a proof of an entity is bound to
+func blameContext(label string, session int, roundID int32, bitPos int, isTrustee bool, entityID int) []byte {
+	out := make([]byte, 17)
+	binary.BigEndian.PutUint32(out[0:4], uint32(session))
+	binary.BigEndian.PutUint32(out[4:8], uint32(roundID))
+	binary.BigEndian.PutUint32(out[8:12], uint32(bitPos))
+	if isTrustee {
+		out[12] = 1
+	}
+	binary.BigEndian.PutUint32(out[13:17], uint32(entityID))
+	return append([]byte(label), out...)
+}
+
+// BlameProofContext returns the context of a proof of a blame, label being "DISRUPTION" for the bits revealed,
+// "SHAREDKEY" for a shared secret, and "BLAME" for the anonymous blame of a slot owner (CLI_REL_DISRUPTION_BLAME),
+// which has no entityID (-1)
+func BlameProofContext(label string, session int, roundID int32, bitPos int, isTrustee bool, entityID int) string {
+	return string(blameContext(label, session, roundID, bitPos, isTrustee, entityID))
+}
+
+// signEvidence signs msg with the key of the server identity of an entity
+func signEvidence(privateKey kyber.Scalar, msg []byte) ([]byte, error) {
+	if privateKey == nil {
+		return nil, errors.New("no key to sign with")
+	}
+	return schnorr.Sign(config.CryptoSuite, privateKey, msg)
+}
+
+// verifyEvidence checks the signature of msg against the key of the server identity of an entity
+func verifyEvidence(publicKey kyber.Point, msg []byte, signature []byte) error {
+	if publicKey == nil {
+		return errors.New("the key of the entity is unknown")
+	}
+	if signature == nil {
+		return errors.New("not signed")
+	}
+	return schnorr.Verify(config.CryptoSuite, publicKey, msg, signature)
+}
+
+// SignCipher signs the cipher an entity sends for a round
+func SignCipher(privateKey kyber.Scalar, session int, roundID int32, isTrustee bool, entityID int, cipher []byte) ([]byte, error) {
+	return signEvidence(privateKey, append(blameContext("CIPHER", session, roundID, 0, isTrustee, entityID), cipher...))
+}
+
+// VerifyCipher checks the signature of a cipher, see SignCipher
+func VerifyCipher(publicKey kyber.Point, session int, roundID int32, isTrustee bool, entityID int, cipher []byte, signature []byte) error {
+	return verifyEvidence(publicKey, append(blameContext("CIPHER", session, roundID, 0, isTrustee, entityID), cipher...), signature)
+}
+
+// revealSignedBytes encodes bits revealed with their proof, in the order of the peers and of the commitments
+func revealSignedBytes(context []byte, bits map[int]int, pval map[string]kyber.Point, NIZK []byte) ([]byte, error) {
+	out := context
+	peers := make([]int, 0, len(bits))
+	for peer := range bits {
+		peers = append(peers, peer)
+	}
+	sort.Ints(peers)
+	for _, peer := range peers {
+		b := make([]byte, 5)
+		binary.BigEndian.PutUint32(b[0:4], uint32(peer))
+		b[4] = byte(bits[peer])
+		out = append(out, b...)
+	}
+	out, err := appendPoints(out, pval)
+	if err != nil {
+		return nil, err
+	}
+	return append(out, NIZK...), nil
+}
+
+// secretSignedBytes encodes a shared secret revealed for the pad shared with peerID, with its proof and the keys it
+// is proven for
+func secretSignedBytes(context []byte, peerID int, secret kyber.Point, pub map[string]kyber.Point, NIZK []byte) ([]byte, error) {
+	if secret == nil {
+		return nil, errors.New("no secret")
+	}
+	point, err := secret.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	peer := make([]byte, 4)
+	binary.BigEndian.PutUint32(peer, uint32(peerID))
+	out, err := appendPoints(append(append(context, peer...), point...), pub)
+	if err != nil {
+		return nil, err
+	}
+	return append(out, NIZK...), nil
+}
+
+// appendPoints appends the named points to out, in the order of their names
+func appendPoints(out []byte, points map[string]kyber.Point) ([]byte, error) {
+	names := make([]string, 0, len(points))
+	for name := range points {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if points[name] == nil {
+			return nil, errors.New("no value for point " + name)
+		}
+		point, err := points[name].MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		out = append(append(append(out, name...), 0), point...)
+	}
+	return out, nil
+}
+
+// Sign signs the bits revealed by the client with the key of its server identity
+func (m *CLI_REL_DISRUPTION_REVEAL) Sign(privateKey kyber.Scalar, session int) error {
+	b, err := revealSignedBytes(blameContext("REVEAL", session, m.RoundID, m.BitPos, false, m.ClientID), m.Bits, m.Pval, m.NIZK)
+	if err != nil {
+		return err
+	}
+	m.Signature, err = signEvidence(privateKey, b)
+	return err
+}
+
+// Verify checks the signature of the bits revealed against the key of the client's server identity
+func (m *CLI_REL_DISRUPTION_REVEAL) Verify(publicKey kyber.Point, session int) error {
+	b, err := revealSignedBytes(blameContext("REVEAL", session, m.RoundID, m.BitPos, false, m.ClientID), m.Bits, m.Pval, m.NIZK)
+	if err != nil {
+		return err
+	}
+	return verifyEvidence(publicKey, b, m.Signature)
+}
+
+// Sign signs the bits revealed by the trustee with the key of its server identity
+func (m *TRU_REL_DISRUPTION_REVEAL) Sign(privateKey kyber.Scalar, session int) error {
+	b, err := revealSignedBytes(blameContext("REVEAL", session, m.RoundID, m.BitPos, true, m.TrusteeID), m.Bits, m.Pval, m.NIZK)
+	if err != nil {
+		return err
+	}
+	m.Signature, err = signEvidence(privateKey, b)
+	return err
+}
+
+// Verify checks the signature of the bits revealed against the key of the trustee's server identity
+func (m *TRU_REL_DISRUPTION_REVEAL) Verify(publicKey kyber.Point, session int) error {
+	b, err := revealSignedBytes(blameContext("REVEAL", session, m.RoundID, m.BitPos, true, m.TrusteeID), m.Bits, m.Pval, m.NIZK)
+	if err != nil {
+		return err
+	}
+	return verifyEvidence(publicKey, b, m.Signature)
+}
+
+// Sign signs the secret revealed by the client with the key of its server identity
+func (m *CLI_REL_SHARED_SECRET) Sign(privateKey kyber.Scalar, session int) error {
+	b, err := secretSignedBytes(blameContext("SECRET", session, m.RoundID, m.BitPos, false, m.ClientID), m.TrusteeID, m.Secret, m.Pub, m.NIZK)
+	if err != nil {
+		return err
+	}
+	m.Signature, err = signEvidence(privateKey, b)
+	return err
+}
+
+// Verify checks the signature of the secret revealed against the key of the client's server identity
+func (m *CLI_REL_SHARED_SECRET) Verify(publicKey kyber.Point, session int) error {
+	b, err := secretSignedBytes(blameContext("SECRET", session, m.RoundID, m.BitPos, false, m.ClientID), m.TrusteeID, m.Secret, m.Pub, m.NIZK)
+	if err != nil {
+		return err
+	}
+	return verifyEvidence(publicKey, b, m.Signature)
+}
+
+// Sign signs the secret revealed by the trustee with the key of its server identity
+func (m *TRU_REL_SHARED_SECRET) Sign(privateKey kyber.Scalar, session int) error {
+	b, err := secretSignedBytes(blameContext("SECRET", session, m.RoundID, m.BitPos, true, m.TrusteeID), m.ClientID, m.Secret, m.Pub, m.NIZK)
+	if err != nil {
+		return err
+	}
+	m.Signature, err = signEvidence(privateKey, b)
+	return err
+}
+
+// Verify checks the signature of the secret revealed against the key of the trustee's server identity
+func (m *TRU_REL_SHARED_SECRET) Verify(publicKey kyber.Point, session int) error {
+	b, err := secretSignedBytes(blameContext("SECRET", session, m.RoundID, m.BitPos, true, m.TrusteeID), m.ClientID, m.Secret, m.Pub, m.NIZK)
+	if err != nil {
+		return err
+	}
+	return verifyEvidence(publicKey, b, m.Signature)
+}
@@ -0,0 +1,90 @@
+package net
+
+import (
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"go.dedis.ch/kyber/v3"
+)
+
+func TestBlameEvidence(t *testing.T) {
+	pub, priv := crypto.NewKeyPair()
+	otherPub, _ := crypto.NewKeyPair()
+	session := 42
+	cipher := []byte{1, 2, 3}
+
+	signature, err := SignCipher(priv, session, 5, false, 1, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyCipher(pub, session, 5, false, 1, cipher, signature); err != nil {
+		t.Error("the cipher should verify,", err)
+	}
+	if VerifyCipher(pub, session, 6, false, 1, cipher, signature) == nil || VerifyCipher(pub, session+1, 5, false, 1, cipher, signature) == nil {
+		t.Error("a cipher of another round or session should not verify")
+	}
+	if VerifyCipher(pub, session, 5, true, 1, cipher, signature) == nil || VerifyCipher(pub, session, 5, false, 2, cipher, signature) == nil {
+		t.Error("a cipher of another entity should not verify")
+	}
+	if VerifyCipher(otherPub, session, 5, false, 1, cipher, signature) == nil || VerifyCipher(nil, session, 5, false, 1, cipher, signature) == nil {
+		t.Error("a cipher should only verify with the key of its sender")
+	}
+	if _, err := SignCipher(nil, session, 5, false, 1, cipher); err == nil {
+		t.Error("signing without a key should fail")
+	}
+
+	// every field of the reveal is covered
+	B := config.CryptoSuite.Point().Base()
+	reveal := CLI_REL_DISRUPTION_REVEAL{ClientID: 1, RoundID: 5, BitPos: 12, Bits: map[int]int{0: 1, 1: 0},
+		NIZK: []byte{4, 5}, Pval: map[string]kyber.Point{"B": B, "T0": B}}
+	if err := reveal.Sign(priv, session); err != nil {
+		t.Fatal(err)
+	}
+	if err := reveal.Verify(pub, session); err != nil {
+		t.Error("the reveal should verify,", err)
+	}
+	tampered := []func(r *CLI_REL_DISRUPTION_REVEAL){
+		func(r *CLI_REL_DISRUPTION_REVEAL) { r.ClientID = 2 },
+		func(r *CLI_REL_DISRUPTION_REVEAL) { r.RoundID = 6 },
+		func(r *CLI_REL_DISRUPTION_REVEAL) { r.BitPos = 13 },
+		func(r *CLI_REL_DISRUPTION_REVEAL) { r.Bits = map[int]int{0: 0, 1: 0} },
+		func(r *CLI_REL_DISRUPTION_REVEAL) { r.NIZK = []byte{4, 6} },
+		func(r *CLI_REL_DISRUPTION_REVEAL) { r.Pval = map[string]kyber.Point{"B": B, "T0": otherPub} },
+	}
+	for i, tamper := range tampered {
+		r := reveal
+		tamper(&r)
+		if r.Verify(pub, session) == nil {
+			t.Error("tampered reveal", i, "should not verify")
+		}
+	}
+	if reveal.Verify(pub, session+1) == nil {
+		t.Error("a reveal of another session should not verify")
+	}
+
+	// the secret, with the keys it is proven for
+	secret := TRU_REL_SHARED_SECRET{TrusteeID: 0, ClientID: 1, RoundID: 5, BitPos: 12, Secret: B, NIZK: []byte{7},
+		Pub: map[string]kyber.Point{"X[0]": pub, "BT": otherPub}}
+	if err := secret.Sign(priv, session); err != nil {
+		t.Fatal(err)
+	}
+	if err := secret.Verify(pub, session); err != nil {
+		t.Error("the secret should verify,", err)
+	}
+	forged := secret
+	forged.Pub = map[string]kyber.Point{"X[0]": otherPub, "BT": otherPub}
+	if forged.Verify(pub, session) == nil {
+		t.Error("a secret with other keys should not verify")
+	}
+	forged = secret
+	forged.ClientID = 0
+	if forged.Verify(pub, session) == nil {
+		t.Error("a secret for another peer should not verify")
+	}
+	unsigned := secret
+	unsigned.Signature = nil
+	if unsigned.Verify(pub, session) == nil {
+		t.Error("an unsigned secret should not verify")
+	}
+}
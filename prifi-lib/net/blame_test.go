@@ -0,0 +1,54 @@
+package net
+
+import (
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/crypto"
+)
+
+func TestBlameVerdictSignature(t *testing.T) {
+	pub, priv := crypto.NewKeyPair()
+	verdict := &BlameVerdict{
+		RoundID:  12,
+		BitPos:   791,
+		GuiltyID: 1,
+		Reason:   "revealed a bit that is not the one of the pad",
+	}
+
+	if verdict.Verify(pub) == nil {
+		t.Error("An unsigned verdict should not verify")
+	}
+	if err := verdict.Sign(priv); err != nil {
+		t.Fatal(err)
+	}
+	if err := verdict.Verify(pub); err != nil {
+		t.Error("The verdict should verify,", err)
+	}
+
+	// changing any field breaks the signature
+	verdict.GuiltyIsTrustee = true
+	if verdict.Verify(pub) == nil {
+		t.Error("A verdict against another entity should not verify")
+	}
+	verdict.GuiltyIsTrustee = false
+	verdict.RoundID++
+	if verdict.Verify(pub) == nil {
+		t.Error("A verdict for another round should not verify")
+	}
+	verdict.RoundID--
+
+	// only the relay's key is accepted
+	otherPub, otherPriv := crypto.NewKeyPair()
+	if verdict.Verify(otherPub) == nil {
+		t.Error("A verdict should not verify with another key")
+	}
+	if verdict.Verify(nil) == nil {
+		t.Error("A verdict should not verify without the relay's key")
+	}
+	if err := verdict.Sign(otherPriv); err != nil {
+		t.Fatal(err)
+	}
+	if verdict.Verify(pub) == nil {
+		t.Error("A verdict signed by another key should not verify")
+	}
+}
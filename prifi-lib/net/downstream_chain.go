@@ -0,0 +1,228 @@
+package net
+
+/*
+Accountable downstream
+**********************
+The relay signs each downstream cell with the key of its server identity (see Identities). It signs the head of a
+hash chain over all the cells of the session, head = H(previous head || cell), so each signature commits it to the
+whole downstream history: the data, but also the slot owners (OwnershipID), the open-closed requests, and the hash of
+the previous upstream cell that the disruption protection relies on. The cell carries the previous head and the
+signature; the clients check that the previous head is theirs, and refuse the cells not signed by the relay. A client
+that missed cells only takes the previous head of a cell if another client gossiped that head for the previous round.
+
+With DownstreamGossipPeriod, the clients send their head to the other clients and to the trustees every few rounds
+(CLI_ALL_DOWNSTREAM_CHAIN_HEAD). The signed heads of a round are the same for everyone if the relay sent the same cells
+to everyone; two that differ are the proof that it did not (see DownstreamEquivocationProof), which anybody can check
+with the relay's key.
+
+The session, drawn by the relay at each setup, is signed too, so that heads of different sessions are never compared.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+)
+
+// DOWNSTREAM_CHAIN_HEAD_SIZE is the size of a head of the downstream chain
+const DOWNSTREAM_CHAIN_HEAD_SIZE = sha256.Size
+
+// DOWNSTREAM_CHAIN_MEMORY is the number of rounds for which a DownstreamChainWitness keeps the heads
+const DOWNSTREAM_CHAIN_MEMORY = 100
+
+// NewDownstreamChainHead returns the head of the chain before the first cell of a session
+func NewDownstreamChainHead() []byte {
+	return make([]byte, DOWNSTREAM_CHAIN_HEAD_SIZE)
+}
+
+// downstreamCellDigest hashes the fields of a downstream cell covered by the chain
+func downstreamCellDigest(msg *REL_CLI_DOWNSTREAM_DATA) []byte {
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header[0:4], uint32(msg.RoundID))
+	binary.BigEndian.PutUint32(header[4:8], uint32(msg.OwnershipID))
+	if msg.FlagResync {
+		header[8] |= 1
+	}
+	if msg.FlagOpenClosedRequest {
+		header[8] |= 2
+	}
+	if msg.FlagEncrypted {
+		header[8] |= 4
+	}
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(msg.HashOfPreviousUpstreamData)))
+
+	h := sha256.New()
+	h.Write(header)
+	h.Write(msg.HashOfPreviousUpstreamData)
+	h.Write(msg.Data)
+	return h.Sum(nil)
+}
+
+// nextDownstreamChainHead returns H(previousHead || cell)
+func nextDownstreamChainHead(previousHead []byte, msg *REL_CLI_DOWNSTREAM_DATA) []byte {
+	h := sha256.New()
+	h.Write(previousHead)
+	h.Write(downstreamCellDigest(msg))
+	return h.Sum(nil)
+}
+
+// downstreamChainSignedBytes returns the encoding of a head covered by the relay's signature
+func downstreamChainSignedBytes(session int, roundID int32, head []byte) []byte {
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint32(out[0:4], uint32(session))
+	binary.BigEndian.PutUint32(out[4:8], uint32(roundID))
+	return append(out, head...)
+}
+
+// verifyDownstreamChainHead checks the relay's signature of the head of a round
+func verifyDownstreamChainHead(relayPublicKey kyber.Point, session int, roundID int32, head, signature []byte) error {
+	if len(head) != DOWNSTREAM_CHAIN_HEAD_SIZE {
+		return errors.New("the head of the downstream chain has " + strconv.Itoa(len(head)) + " bytes")
+	}
+	return schnorr.Verify(config.CryptoSuite, relayPublicKey, downstreamChainSignedBytes(session, roundID, head), signature)
+}
+
+// SignDownstreamCell is used by the relay to chain a cell after previousHead: it sets the PreviousChainHead and the
+// ChainSignature of the cell, and returns the new head
+func SignDownstreamCell(privateKey kyber.Scalar, session int, previousHead []byte, msg *REL_CLI_DOWNSTREAM_DATA) ([]byte, error) {
+	if privateKey == nil {
+		return nil, errors.New("no key to sign with")
+	}
+	head := nextDownstreamChainHead(previousHead, msg)
+	sig, err := schnorr.Sign(config.CryptoSuite, privateKey, downstreamChainSignedBytes(session, msg.RoundID, head))
+	if err != nil {
+		return nil, err
+	}
+	msg.PreviousChainHead = previousHead
+	msg.ChainSignature = sig
+	return head, nil
+}
+
+// VerifyDownstreamCell is used by the clients to check that the relay signed a cell, chained after previousHead, and
+// returns the new head
+func VerifyDownstreamCell(relayPublicKey kyber.Point, session int, previousHead []byte, msg *REL_CLI_DOWNSTREAM_DATA) ([]byte, error) {
+	if relayPublicKey == nil {
+		return nil, errors.New("the key of the relay is unknown")
+	}
+	if msg.ChainSignature == nil {
+		return nil, errors.New("the downstream cell of round " + strconv.Itoa(int(msg.RoundID)) + " is not signed")
+	}
+	if previousHead == nil || !bytes.Equal(previousHead, msg.PreviousChainHead) {
+		return nil, errors.New("the downstream cell of round " + strconv.Itoa(int(msg.RoundID)) + " does not follow the previous ones")
+	}
+	head := nextDownstreamChainHead(msg.PreviousChainHead, msg)
+	if err := verifyDownstreamChainHead(relayPublicKey, session, msg.RoundID, head, msg.ChainSignature); err != nil {
+		return nil, errors.New("invalid signature of the downstream cell of round " + strconv.Itoa(int(msg.RoundID)) + ", " + err.Error())
+	}
+	return head, nil
+}
+
+// DownstreamEquivocationProof shows that the relay signed two different downstream histories for the same round of
+// a session, i.e., that it did not send the same cells to every client
+type DownstreamEquivocationProof struct {
+	RelayPublicKey kyber.Point
+	Session        int
+	RoundID        int32
+	HeadA          []byte
+	SignatureA     []byte
+	HeadB          []byte
+	SignatureB     []byte
+}
+
+// Verify checks that the heads differ, and that the relay signed both. It is up to the caller to check that
+// RelayPublicKey belongs to the relay.
+func (p *DownstreamEquivocationProof) Verify() error {
+	if bytes.Equal(p.HeadA, p.HeadB) {
+		return errors.New("the relay signed the same head twice")
+	}
+	if err := verifyDownstreamChainHead(p.RelayPublicKey, p.Session, p.RoundID, p.HeadA, p.SignatureA); err != nil {
+		return err
+	}
+	return verifyDownstreamChainHead(p.RelayPublicKey, p.Session, p.RoundID, p.HeadB, p.SignatureB)
+}
+
+// DownstreamChainWitness keeps the heads signed by the relay for the last rounds of a session, the client's own and
+// those gossiped by the others, and finds those that differ. It is thread-safe.
+type DownstreamChainWitness struct {
+	sync.Mutex
+	relayPublicKey kyber.Point
+	session        int
+	heads          map[int32]CLI_ALL_DOWNSTREAM_CHAIN_HEAD
+	newestRound    int32
+	Proofs         []*DownstreamEquivocationProof // every equivocation found so far
+}
+
+// NewDownstreamChainWitness creates a witness of the downstream chain signed by relayPublicKey in the given session
+func NewDownstreamChainWitness(relayPublicKey kyber.Point, session int) *DownstreamChainWitness {
+	return &DownstreamChainWitness{
+		relayPublicKey: relayPublicKey,
+		session:        session,
+		heads:          make(map[int32]CLI_ALL_DOWNSTREAM_CHAIN_HEAD),
+		Proofs:         make([]*DownstreamEquivocationProof, 0),
+	}
+}
+
+// Add checks the signature of a head, and compares it with the head known for that round, if any. It returns the
+// proof of equivocation if they differ, nil otherwise; an error if the head is not from this session, or not signed
+// by the relay.
+func (w *DownstreamChainWitness) Add(h CLI_ALL_DOWNSTREAM_CHAIN_HEAD) (*DownstreamEquivocationProof, error) {
+	if h.Session != w.session {
+		return nil, errors.New("the head of round " + strconv.Itoa(int(h.RoundID)) + " is from another session")
+	}
+	if err := verifyDownstreamChainHead(w.relayPublicKey, h.Session, h.RoundID, h.Head, h.Signature); err != nil {
+		return nil, errors.New("the head of round " + strconv.Itoa(int(h.RoundID)) + " is not signed by the relay, " + err.Error())
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	known, found := w.heads[h.RoundID]
+	if found {
+		if bytes.Equal(known.Head, h.Head) {
+			return nil, nil
+		}
+		proof := &DownstreamEquivocationProof{
+			RelayPublicKey: w.relayPublicKey,
+			Session:        w.session,
+			RoundID:        h.RoundID,
+			HeadA:          known.Head,
+			SignatureA:     known.Signature,
+			HeadB:          h.Head,
+			SignatureB:     h.Signature,
+		}
+		w.Proofs = append(w.Proofs, proof)
+		return proof, nil
+	}
+
+	if h.RoundID <= w.newestRound-DOWNSTREAM_CHAIN_MEMORY {
+		return nil, nil
+	}
+	w.heads[h.RoundID] = h
+	if h.RoundID > w.newestRound {
+		w.newestRound = h.RoundID
+		for roundID := range w.heads {
+			if roundID <= w.newestRound-DOWNSTREAM_CHAIN_MEMORY {
+				delete(w.heads, roundID)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Head returns the head signed by the relay that the witness knows for a round, nil if there is none
+func (w *DownstreamChainWitness) Head(roundID int32) []byte {
+	w.Lock()
+	defer w.Unlock()
+
+	if h, found := w.heads[roundID]; found {
+		return h.Head
+	}
+	return nil
+}
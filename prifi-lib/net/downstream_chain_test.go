@@ -0,0 +1,148 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/crypto"
+)
+
+func downstreamCell(roundID int32, data string) *REL_CLI_DOWNSTREAM_DATA {
+	return &REL_CLI_DOWNSTREAM_DATA{
+		RoundID:                    roundID,
+		OwnershipID:                1,
+		HashOfPreviousUpstreamData: []byte{1, 2, 3},
+		Data:                       []byte(data),
+	}
+}
+
+func TestDownstreamChain(t *testing.T) {
+	pub, priv := crypto.NewKeyPair()
+	session := 42
+
+	relayHead := NewDownstreamChainHead()
+	clientHead := NewDownstreamChainHead()
+	for roundID := int32(0); roundID < 3; roundID++ {
+		cell := downstreamCell(roundID, "some data")
+		var err error
+		relayHead, err = SignDownstreamCell(priv, session, relayHead, cell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientHead, err = VerifyDownstreamCell(pub, session, clientHead, cell)
+		if err != nil {
+			t.Fatal("round", roundID, ":", err)
+		}
+		if !bytes.Equal(relayHead, clientHead) {
+			t.Error("round", roundID, ": the client should have the head of the relay")
+		}
+	}
+
+	// every field of the cell is covered
+	cell := downstreamCell(3, "some data")
+	next, _ := SignDownstreamCell(priv, session, relayHead, cell)
+	tampered := []func(c *REL_CLI_DOWNSTREAM_DATA){
+		func(c *REL_CLI_DOWNSTREAM_DATA) { c.Data[0] ^= 1 },
+		func(c *REL_CLI_DOWNSTREAM_DATA) { c.OwnershipID = 2 },
+		func(c *REL_CLI_DOWNSTREAM_DATA) { c.HashOfPreviousUpstreamData[0] ^= 1 },
+		func(c *REL_CLI_DOWNSTREAM_DATA) { c.FlagOpenClosedRequest = true },
+		func(c *REL_CLI_DOWNSTREAM_DATA) { c.RoundID = 4 },
+	}
+	for i, tamper := range tampered {
+		c := downstreamCell(3, "some data")
+		c.PreviousChainHead = cell.PreviousChainHead
+		c.ChainSignature = cell.ChainSignature
+		tamper(c)
+		if _, err := VerifyDownstreamCell(pub, session, clientHead, c); err == nil {
+			t.Error("tampered cell", i, "should not verify")
+		}
+	}
+	if _, err := VerifyDownstreamCell(pub, session+1, clientHead, cell); err == nil {
+		t.Error("a cell of another session should not verify")
+	}
+	otherPub, _ := crypto.NewKeyPair()
+	if _, err := VerifyDownstreamCell(otherPub, session, clientHead, cell); err == nil {
+		t.Error("a cell signed by another key should not verify")
+	}
+	if _, err := VerifyDownstreamCell(pub, session, clientHead, downstreamCell(3, "some data")); err == nil {
+		t.Error("an unsigned cell should not verify")
+	}
+
+	if _, err := VerifyDownstreamCell(nil, session, clientHead, cell); err == nil {
+		t.Error("a cell should not verify without the relay's key")
+	}
+
+	// a cell that does not follow ours is refused
+	if _, err := VerifyDownstreamCell(pub, session, NewDownstreamChainHead(), cell); err == nil {
+		t.Error("a cell chained after another head should not verify")
+	}
+	if _, err := VerifyDownstreamCell(pub, session, nil, cell); err == nil {
+		t.Error("a cell should not verify without a previous head")
+	}
+	head, err := VerifyDownstreamCell(pub, session, clientHead, cell)
+	if err != nil || !bytes.Equal(head, next) {
+		t.Error("the cell should verify after ours,", err)
+	}
+}
+
+func TestDownstreamChainWitness(t *testing.T) {
+	pub, priv := crypto.NewKeyPair()
+	session := 42
+
+	// the relay sends "a" to client 0, and "b" to client 1 in round 0
+	signedHead := func(clientID int, data string) CLI_ALL_DOWNSTREAM_CHAIN_HEAD {
+		cell := downstreamCell(0, data)
+		head, err := SignDownstreamCell(priv, session, NewDownstreamChainHead(), cell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return CLI_ALL_DOWNSTREAM_CHAIN_HEAD{ClientID: clientID, Session: session, RoundID: 0, Head: head, Signature: cell.ChainSignature}
+	}
+	h0, h1 := signedHead(0, "a"), signedHead(1, "b")
+
+	w := NewDownstreamChainWitness(pub, session)
+	if proof, err := w.Add(h0); proof != nil || err != nil {
+		t.Fatal("the first head should be accepted", proof, err)
+	}
+	if proof, err := w.Add(signedHead(2, "a")); proof != nil || err != nil {
+		t.Error("the same head should be accepted", proof, err)
+	}
+	proof, err := w.Add(h1)
+	if err != nil || proof == nil {
+		t.Fatal("two different heads for the same round should give a proof", err)
+	}
+	if err := proof.Verify(); err != nil {
+		t.Error("the proof should verify,", err)
+	}
+	if len(w.Proofs) != 1 {
+		t.Error("the witness should keep the proof")
+	}
+	if !bytes.Equal(w.Head(0), h0.Head) || w.Head(1) != nil {
+		t.Error("the witness should keep the first head of each round")
+	}
+
+	// the proof cannot be forged
+	forged := *proof
+	forged.HeadB = forged.HeadA
+	if forged.Verify() == nil {
+		t.Error("a proof with the same head twice should not verify")
+	}
+	forged = *proof
+	forged.RoundID = 1
+	if forged.Verify() == nil {
+		t.Error("a proof for another round should not verify")
+	}
+
+	// heads not signed by the relay, or of another session, are refused
+	bad := h1
+	bad.Head = append([]byte{}, h1.Head...)
+	bad.Head[0] ^= 1
+	if _, err := w.Add(bad); err == nil {
+		t.Error("a head not signed by the relay should be refused")
+	}
+	bad = h1
+	bad.Session = session + 1
+	if _, err := w.Add(bad); err == nil {
+		t.Error("a head of another session should be refused")
+	}
+}
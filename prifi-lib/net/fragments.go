@@ -0,0 +1,193 @@
+package net
+
+/*
+ * Reliable UDP broadcast of the downstream cells.
+ * A cell (a REL_CLI_DOWNSTREAM_DATA_UDP) larger than one datagram is cut in fragments, and Reed-Solomon parity fragments
+ * are added so that a client can rebuild it despite a few losses. The client asks for the fragments it could not
+ * recover with a CLI_REL_DOWNSTREAM_NACK, and the relay broadcasts them again.
+ */
+
+import (
+	"errors"
+	"strconv"
+)
+
+// FragmentCell cuts a downstream cell in fragments of at most fragmentSize bytes, followed by nParity parity
+// fragments. The fragmentation only depends on its inputs, so the relay can fragment a cell again to resend a fragment
+func FragmentCell(roundID int32, cell []byte, fragmentSize, nParity int) ([]*REL_CLI_DOWNSTREAM_FRAGMENT, error) {
+	if fragmentSize < 1 {
+		return nil, errors.New("cannot cut a cell in fragments of " + strconv.Itoa(fragmentSize) + " bytes")
+	}
+	nData := (len(cell) + fragmentSize - 1) / fragmentSize
+	if nData == 0 {
+		nData = 1
+	}
+	// spread the cell evenly over the fragments, to minimize the padding
+	shardSize := (len(cell) + nData - 1) / nData
+
+	rs, err := NewReedSolomon(nData, nParity)
+	if err != nil {
+		return nil, errors.New("cannot fragment a cell of " + strconv.Itoa(len(cell)) + " bytes, " + err.Error())
+	}
+	shards := make([][]byte, nData+nParity)
+	for i := range shards {
+		shards[i] = make([]byte, shardSize)
+		if i < nData && i*shardSize < len(cell) {
+			copy(shards[i], cell[i*shardSize:])
+		}
+	}
+	if err := rs.Encode(shards); err != nil {
+		return nil, err
+	}
+
+	fragments := make([]*REL_CLI_DOWNSTREAM_FRAGMENT, len(shards))
+	for i := range shards {
+		fragments[i] = &REL_CLI_DOWNSTREAM_FRAGMENT{
+			RoundID:    roundID,
+			Index:      i,
+			NData:      nData,
+			NParity:    nParity,
+			CellLength: len(cell),
+			Data:       shards[i],
+		}
+	}
+	return fragments, nil
+}
+
+// cellFragments holds the fragments received for one cell
+type cellFragments struct {
+	nData      int
+	nParity    int
+	cellLength int
+	shards     [][]byte
+	received   int
+}
+
+// DownstreamReassembler rebuilds the downstream cells from their fragments, and gives them in the order of the rounds
+type DownstreamReassembler struct {
+	nextRound   int32 // the next round to give
+	highestSeen int32
+	rounds      map[int32]*cellFragments
+	cells       map[int32][]byte // rebuilt, waiting for the previous rounds
+}
+
+// NewDownstreamReassembler creates a DownstreamReassembler expecting firstRound first
+func NewDownstreamReassembler(firstRound int32) *DownstreamReassembler {
+	return &DownstreamReassembler{
+		nextRound:   firstRound,
+		highestSeen: firstRound - 1,
+		rounds:      make(map[int32]*cellFragments),
+		cells:       make(map[int32][]byte),
+	}
+}
+
+// NextRound returns the round of the next cell to be given
+func (r *DownstreamReassembler) NextRound() int32 {
+	return r.nextRound
+}
+
+// Add stores a fragment, and rebuilds its cell when enough fragments were received. Fragments of past or already
+// rebuilt cells are ignored
+func (r *DownstreamReassembler) Add(f REL_CLI_DOWNSTREAM_FRAGMENT) error {
+	if f.RoundID < r.nextRound {
+		return nil
+	}
+	if _, done := r.cells[f.RoundID]; done {
+		return nil
+	}
+	if f.RoundID > r.highestSeen {
+		r.highestSeen = f.RoundID
+	}
+
+	c, found := r.rounds[f.RoundID]
+	if !found {
+		if f.NData < 1 || f.NParity < 0 || f.NData+f.NParity > 256 || f.CellLength < 0 {
+			return errors.New("invalid fragment for round " + strconv.Itoa(int(f.RoundID)))
+		}
+		c = &cellFragments{
+			nData:      f.NData,
+			nParity:    f.NParity,
+			cellLength: f.CellLength,
+			shards:     make([][]byte, f.NData+f.NParity),
+		}
+		r.rounds[f.RoundID] = c
+	}
+	if f.NData != c.nData || f.NParity != c.nParity || f.CellLength != c.cellLength || f.Index < 0 || f.Index >= len(c.shards) {
+		return errors.New("fragment " + strconv.Itoa(f.Index) + " does not match the other fragments of round " + strconv.Itoa(int(f.RoundID)))
+	}
+	if c.shards[f.Index] != nil {
+		return nil
+	}
+	c.shards[f.Index] = f.Data
+	c.received++
+
+	if c.received < c.nData {
+		return nil
+	}
+	rs, err := NewReedSolomon(c.nData, c.nParity)
+	if err != nil {
+		return err
+	}
+	if err := rs.Reconstruct(c.shards); err != nil {
+		return errors.New("cannot rebuild the cell of round " + strconv.Itoa(int(f.RoundID)) + ", " + err.Error())
+	}
+	cell := make([]byte, 0, c.cellLength)
+	for i := 0; i < c.nData; i++ {
+		cell = append(cell, c.shards[i]...)
+	}
+	if len(cell) < c.cellLength {
+		return errors.New("fragments of round " + strconv.Itoa(int(f.RoundID)) + " are too short")
+	}
+	r.cells[f.RoundID] = cell[:c.cellLength]
+	delete(r.rounds, f.RoundID)
+	return nil
+}
+
+// Deliverable returns the cells that were rebuilt, up to the first one still missing
+func (r *DownstreamReassembler) Deliverable() [][]byte {
+	cells := make([][]byte, 0)
+	for {
+		cell, found := r.cells[r.nextRound]
+		if !found {
+			return cells
+		}
+		cells = append(cells, cell)
+		delete(r.cells, r.nextRound)
+		r.nextRound++
+	}
+}
+
+// Gaps returns the rounds that cannot be given yet, though a later round was seen
+func (r *DownstreamReassembler) Gaps() []int32 {
+	gaps := make([]int32, 0)
+	for roundID := r.nextRound; roundID < r.highestSeen; roundID++ {
+		if _, found := r.cells[roundID]; !found {
+			gaps = append(gaps, roundID)
+		}
+	}
+	return gaps
+}
+
+// Missing returns the data fragments still needed to rebuild the cell of a round, or nil if no fragment of that round
+// was received
+func (r *DownstreamReassembler) Missing(roundID int32) []int {
+	c, found := r.rounds[roundID]
+	if !found {
+		return nil
+	}
+	missing := make([]int, 0)
+	for i := 0; i < c.nData && c.received+len(missing) < c.nData; i++ {
+		if c.shards[i] == nil {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// SkipTo gives up on the cells of the rounds before roundID
+func (r *DownstreamReassembler) SkipTo(roundID int32) {
+	for ; r.nextRound < roundID; r.nextRound++ {
+		delete(r.rounds, r.nextRound)
+		delete(r.cells, r.nextRound)
+	}
+}
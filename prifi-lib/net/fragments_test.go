@@ -0,0 +1,277 @@
+package net
+
+import (
+	"bytes"
+	"crypto/rand"
+	mrand "math/rand"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+
+	if _, err := NewReedSolomon(0, 1); err == nil {
+		t.Error("Should not accept 0 data shards")
+	}
+	if _, err := NewReedSolomon(200, 57); err == nil {
+		t.Error("Should not accept more than 256 shards")
+	}
+
+	for _, params := range [][2]int{{1, 0}, {1, 1}, {4, 2}, {10, 3}, {200, 56}} {
+		nData, nParity := params[0], params[1]
+		rs, err := NewReedSolomon(nData, nParity)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		shards := make([][]byte, nData+nParity)
+		for i := range shards {
+			shards[i] = make([]byte, 50)
+			if i < nData {
+				rand.Read(shards[i])
+			}
+		}
+		if err := rs.Encode(shards); err != nil {
+			t.Fatal(err)
+		}
+
+		for trial := 0; trial < 20; trial++ {
+			received := make([][]byte, len(shards))
+			copy(received, shards)
+			// erase nParity random shards
+			for _, i := range mrand.Perm(len(shards))[:nParity] {
+				received[i] = nil
+			}
+			if err := rs.Reconstruct(received); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < nData; i++ {
+				if !bytes.Equal(received[i], shards[i]) {
+					t.Fatal("Data shard", i, "was not reconstructed correctly with", nData, "data and", nParity, "parity shards")
+				}
+			}
+		}
+
+		if nParity > 0 {
+			received := make([][]byte, len(shards))
+			copy(received, shards)
+			for i := 0; i <= nParity; i++ {
+				received[i] = nil
+			}
+			if err := rs.Reconstruct(received); err == nil {
+				t.Error("Should not reconstruct with less than nData shards")
+			}
+		}
+	}
+
+	rs, _ := NewReedSolomon(2, 1)
+	if err := rs.Encode([][]byte{make([]byte, 2), make([]byte, 2)}); err == nil {
+		t.Error("Should not encode with a wrong number of shards")
+	}
+	if err := rs.Encode([][]byte{make([]byte, 2), make([]byte, 3), make([]byte, 2)}); err == nil {
+		t.Error("Should not encode shards of different lengths")
+	}
+}
+
+func TestDownstreamFragmentMessage(t *testing.T) {
+
+	msg := &REL_CLI_DOWNSTREAM_FRAGMENT{
+		RoundID:    123,
+		Index:      4,
+		NData:      5,
+		NParity:    2,
+		CellLength: 6789,
+		Data:       genDataSlice(),
+	}
+	msg.Print()
+
+	data, err := msg.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != DOWNSTREAM_FRAGMENT_HEADER_SIZE+len(msg.Data) {
+		t.Error("Wrong encoded length", len(data))
+	}
+
+	decoded, err := new(REL_CLI_DOWNSTREAM_FRAGMENT).FromBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg2 := decoded.(REL_CLI_DOWNSTREAM_FRAGMENT)
+	if msg2.RoundID != msg.RoundID || msg2.Index != msg.Index || msg2.NData != msg.NData || msg2.NParity != msg.NParity ||
+		msg2.CellLength != msg.CellLength || !bytes.Equal(msg2.Data, msg.Data) {
+		t.Error("Fragment changed after ToBytes/FromBytes", msg2)
+	}
+
+	if _, err := new(REL_CLI_DOWNSTREAM_FRAGMENT).FromBytes(data[:DOWNSTREAM_FRAGMENT_HEADER_SIZE-1]); err == nil {
+		t.Error("Should not decode a truncated fragment")
+	}
+	msg.Index = -1
+	if _, err := msg.ToBytes(); err == nil {
+		t.Error("Should not encode a negative index")
+	}
+}
+
+func TestFragmentCell(t *testing.T) {
+
+	if _, err := FragmentCell(0, make([]byte, 10), 0, 1); err == nil {
+		t.Error("Should not accept fragments of 0 bytes")
+	}
+	if _, err := FragmentCell(0, make([]byte, 1000), 1, 1); err == nil {
+		t.Error("Should not accept more than 256 fragments")
+	}
+
+	cell := make([]byte, 1000)
+	rand.Read(cell)
+
+	fragments, err := FragmentCell(7, cell, 300, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fragments) != 4+2 {
+		t.Fatal("Expected 4 data and 2 parity fragments, got", len(fragments))
+	}
+	for i, f := range fragments {
+		if f.RoundID != 7 || f.Index != i || f.NData != 4 || f.NParity != 2 || f.CellLength != 1000 || len(f.Data) != 250 {
+			t.Error("Wrong fragment", i, f.RoundID, f.Index, f.NData, f.NParity, f.CellLength, len(f.Data))
+		}
+	}
+
+	// the fragmentation is deterministic, so the relay can resend a fragment
+	again, _ := FragmentCell(7, cell, 300, 2)
+	for i := range fragments {
+		if !bytes.Equal(fragments[i].Data, again[i].Data) {
+			t.Error("Fragment", i, "changed when fragmenting the cell again")
+		}
+	}
+
+	// an empty cell still has one fragment
+	fragments, err = FragmentCell(8, []byte{}, 300, 1)
+	if err != nil || len(fragments) != 2 {
+		t.Error("An empty cell should have one data fragment", err)
+	}
+}
+
+func TestDownstreamReassembler(t *testing.T) {
+
+	nRounds := 10
+	cells := make([][]byte, nRounds)
+	fragments := make([][]*REL_CLI_DOWNSTREAM_FRAGMENT, nRounds)
+	for i := range cells {
+		cells[i] = make([]byte, 500+i)
+		rand.Read(cells[i])
+		fragments[i], _ = FragmentCell(int32(i), cells[i], 100, 2)
+	}
+
+	r := NewDownstreamReassembler(0)
+	if r.Missing(0) != nil {
+		t.Error("Nothing was received for round 0, should not list fragments")
+	}
+
+	// round 0 arrives with 2 losses, which the parity covers
+	for _, f := range fragments[0][2:] {
+		if err := r.Add(*f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	delivered := r.Deliverable()
+	if len(delivered) != 1 || !bytes.Equal(delivered[0], cells[0]) {
+		t.Fatal("Round 0 should have been rebuilt")
+	}
+	if r.NextRound() != 1 {
+		t.Error("Next round should be 1, is", r.NextRound())
+	}
+
+	// round 1 loses 3 fragments, round 2 arrives entirely
+	for _, f := range fragments[1][3:] {
+		r.Add(*f)
+	}
+	for _, f := range fragments[2] {
+		r.Add(*f)
+	}
+	if len(r.Deliverable()) != 0 {
+		t.Error("Round 2 should wait for round 1")
+	}
+	gaps := r.Gaps()
+	if len(gaps) != 1 || gaps[0] != 1 {
+		t.Fatal("Round 1 should be the only gap, got", gaps)
+	}
+	missing := r.Missing(1)
+	if len(missing) != 1 || missing[0] > 2 {
+		t.Fatal("Only one of the first 3 fragments of round 1 is needed, got", missing)
+	}
+
+	// the relay resends it
+	r.Add(*fragments[1][missing[0]])
+	delivered = r.Deliverable()
+	if len(delivered) != 2 || !bytes.Equal(delivered[0], cells[1]) || !bytes.Equal(delivered[1], cells[2]) {
+		t.Fatal("Rounds 1 and 2 should have been delivered in order")
+	}
+
+	// duplicates and fragments of past rounds are ignored
+	if err := r.Add(*fragments[1][0]); err != nil {
+		t.Error(err)
+	}
+	if len(r.Deliverable()) != 0 {
+		t.Error("A past round should not be delivered again")
+	}
+
+	// inconsistent fragments are rejected
+	bad := *fragments[3][0]
+	bad.NData = 0
+	if err := r.Add(bad); err == nil {
+		t.Error("Should reject a fragment with no data fragments")
+	}
+	r.Add(*fragments[3][0])
+	bad = *fragments[3][1]
+	bad.CellLength++
+	if err := r.Add(bad); err == nil {
+		t.Error("Should reject a fragment that does not match the others")
+	}
+
+	// round 3 is lost for good, round 4 arrives; we give up on round 3
+	for _, f := range fragments[4] {
+		r.Add(*f)
+	}
+	r.SkipTo(4)
+	delivered = r.Deliverable()
+	if len(delivered) != 1 || !bytes.Equal(delivered[0], cells[4]) {
+		t.Fatal("Round 4 should be delivered after giving up on round 3")
+	}
+
+	// random losses and reordering over the remaining rounds, with retransmissions
+	all := make([]*REL_CLI_DOWNSTREAM_FRAGMENT, 0)
+	for i := 5; i < nRounds; i++ {
+		all = append(all, fragments[i]...)
+	}
+	mrand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+	delivered = make([][]byte, 0)
+	for _, f := range all {
+		if mrand.Intn(100) < 30 {
+			continue
+		}
+		r.Add(*f)
+		delivered = append(delivered, r.Deliverable()...)
+	}
+	for r.NextRound() < int32(nRounds) {
+		roundID := r.NextRound()
+		missing := r.Missing(roundID)
+		if missing == nil {
+			// nothing arrived, the client asks for the whole cell
+			for i := range fragments[roundID] {
+				missing = append(missing, i)
+			}
+		}
+		for _, i := range missing {
+			r.Add(*fragments[roundID][i])
+		}
+		delivered = append(delivered, r.Deliverable()...)
+	}
+	if len(delivered) != nRounds-5 {
+		t.Fatal("Expected", nRounds-5, "cells, got", len(delivered))
+	}
+	for i, cell := range delivered {
+		if !bytes.Equal(cell, cells[5+i]) {
+			t.Error("Cell of round", 5+i, "was not rebuilt correctly")
+		}
+	}
+}
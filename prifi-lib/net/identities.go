@@ -0,0 +1,23 @@
+package net
+
+import "go.dedis.ch/kyber/v3"
+
+// Identities are the long-term public keys of the entities, the ones of their server identity in the roster. Unlike
+// the keys announced during the protocol, everyone knows them beforehand: what is signed with them can be attributed.
+type Identities struct {
+	Relay    kyber.Point
+	Clients  []kyber.Point // indexed by client ID
+	Trustees []kyber.Point // indexed by trustee ID
+}
+
+// Of returns the key of the client, or of the trustee, id, or nil if it is unknown
+func (ids Identities) Of(isTrustee bool, id int) kyber.Point {
+	keys := ids.Clients
+	if isTrustee {
+		keys = ids.Trustees
+	}
+	if id < 0 || id >= len(keys) {
+		return nil
+	}
+	return keys[id]
+}
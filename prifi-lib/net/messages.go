@@ -3,6 +3,7 @@ package net
 import (
 	"encoding/binary"
 	"errors"
+	"strconv"
 
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/onet/v3/log"
@@ -29,10 +30,19 @@ import (
 // TRU_REL_TELL_NEW_BASE_AND_EPH_PKS
 // TRU_REL_TELL_PK
 // REL_TRU_TELL_RATE_CHANGE
+// REL_CLI_EPOCH_START
+// CLI_REL_EPOCH_PK_AND_EPH_PK
+// REL_TRU_EPOCH_SHUFFLE
+// TRU_REL_EPOCH_SHUFFLE
+// REL_TRU_EPOCH_TRANSCRIPT
+// TRU_REL_EPOCH_SHUFFLE_SIG
+// REL_ALL_EPOCH_SWITCH
+// REL_CLI_DOWNSTREAM_FRAGMENT
+// CLI_REL_DOWNSTREAM_NACK
+// CLI_ALL_DOWNSTREAM_CHAIN_HEAD
 
 //not used yet :
 // REL_CLI_DOWNSTREAM_DATA
-// CLI_REL_DOWNSTREAM_NACK
 
 // ALL_ALL_SHUTDOWN message tells the participants to stop the protocol.
 type ALL_ALL_SHUTDOWN struct {
@@ -41,17 +51,19 @@ type ALL_ALL_SHUTDOWN struct {
 // CLI_REL_TELL_PK_AND_EPH_PK message contains the public key and ephemeral key of a client
 // and is sent to the relay.
 type CLI_REL_TELL_PK_AND_EPH_PK struct {
-	ClientID int
-	Pk       kyber.Point
-	EphPk    kyber.Point
+	ClientID           int
+	Pk                 kyber.Point
+	EphPk              kyber.Point
+	VerifiableDCNetKey []byte // with the verifiable DC-net, our commitment to each pad, see dcnet/verifiable.go
 }
 
 // CLI_REL_UPSTREAM_DATA message contains the upstream data of a client for a given round
 // and is sent to the relay.
 type CLI_REL_UPSTREAM_DATA struct {
-	ClientID int
-	RoundID  int32 // rounds increase 1 by 1, only represent ciphers
-	Data     []byte
+	ClientID  int
+	RoundID   int32 // rounds increase 1 by 1, only represent ciphers
+	Data      []byte
+	Signature []byte // with the disruption protection, see SignCipher
 }
 
 // CLI_REL_OPENCLOSED_DATA message contains whether slots are gonna be Open or Closed in the next round
@@ -70,6 +82,9 @@ type REL_CLI_DOWNSTREAM_DATA struct {
 	Data                       []byte
 	FlagResync                 bool
 	FlagOpenClosedRequest      bool
+	FlagEncrypted              bool   // Data is encrypted to the owner of some slot, see crypto/downstream.go
+	PreviousChainHead          []byte // the head of the downstream chain before this cell, see downstream_chain.go
+	ChainSignature             []byte // the relay's signature of the head after this cell
 }
 
 //Converts []ByteArray -> [][]byte and returns it
@@ -138,6 +153,7 @@ type TRU_REL_DC_CIPHER struct {
 	RoundID   int32
 	TrusteeID int
 	Data      []byte
+	Signature []byte // with the disruption protection, see SignCipher
 }
 
 // TRU_REL_SHUFFLE_SIG contains the signatures shuffled by a trustee and is sent to the relay.
@@ -193,29 +209,34 @@ func (m *REL_CLI_DOWNSTREAM_DATA_UDP) ToBytes() ([]byte, error) {
 
 	//convert the message to bytes
 	hashLen := len(m.REL_CLI_DOWNSTREAM_DATA.HashOfPreviousUpstreamData)
-	buf := make([]byte, 4+4+4+hashLen+len(m.REL_CLI_DOWNSTREAM_DATA.Data)+4+4)
+	chainLen := len(m.REL_CLI_DOWNSTREAM_DATA.PreviousChainHead) + len(m.REL_CLI_DOWNSTREAM_DATA.ChainSignature)
+	buf := make([]byte, 4+4+4+hashLen+4+4+chainLen+len(m.REL_CLI_DOWNSTREAM_DATA.Data)+4+4)
 
 	resyncInt := 0
 	if m.REL_CLI_DOWNSTREAM_DATA.FlagResync {
 		resyncInt = 1
 	}
-	openclosedInt := 0
+	flagsInt := 0
 	if m.REL_CLI_DOWNSTREAM_DATA.FlagOpenClosedRequest {
-		openclosedInt = 1
+		flagsInt |= 1
+	}
+	if m.REL_CLI_DOWNSTREAM_DATA.FlagEncrypted {
+		flagsInt |= 2
 	}
 
-	// [0:4 roundID] [4:8 OwnershipID] [8:12 Length of Hash] [Variable: Hash] [8:end-8 data] [end-8:end-4 resyncFlag] [end-4:end openClosedFlag]
+	// [0:4 roundID] [4:8 OwnershipID] [8:12 Length of Hash] [Variable: Hash] [4: Length of previous head] [Variable: previous head]
+	// [4: Length of signature] [Variable: signature] [data] [end-8:end-4 resyncFlag] [end-4:end openClosedFlag | encryptedFlag<<1]
 	binary.BigEndian.PutUint32(buf[0:4], uint32(m.REL_CLI_DOWNSTREAM_DATA.RoundID))
 	binary.BigEndian.PutUint32(buf[4:8], uint32(m.REL_CLI_DOWNSTREAM_DATA.OwnershipID))
-	binary.BigEndian.PutUint32(buf[8:12], uint32(hashLen))
-	startIndex := 12
-	if hashLen > 0 {
-		copy(buf[12:12+hashLen], m.REL_CLI_DOWNSTREAM_DATA.HashOfPreviousUpstreamData)
-		startIndex += hashLen
+	startIndex := 8
+	for _, field := range [][]byte{m.REL_CLI_DOWNSTREAM_DATA.HashOfPreviousUpstreamData, m.REL_CLI_DOWNSTREAM_DATA.PreviousChainHead, m.REL_CLI_DOWNSTREAM_DATA.ChainSignature} {
+		binary.BigEndian.PutUint32(buf[startIndex:startIndex+4], uint32(len(field)))
+		copy(buf[startIndex+4:], field)
+		startIndex += 4 + len(field)
 	}
 
 	binary.BigEndian.PutUint32(buf[len(buf)-8:len(buf)-4], uint32(resyncInt)) //todo : to be coded on one byte
-	binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(openclosedInt))       //todo : to be coded on one byte
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(flagsInt))            //todo : to be coded on one byte
 	copy(buf[startIndex:len(buf)-8], m.REL_CLI_DOWNSTREAM_DATA.Data)
 
 	return buf, nil
@@ -225,36 +246,125 @@ func (m *REL_CLI_DOWNSTREAM_DATA_UDP) ToBytes() ([]byte, error) {
 // FromBytes decodes the message contained in the message's byteEncoded field.
 func (m *REL_CLI_DOWNSTREAM_DATA_UDP) FromBytes(buffer []byte) (interface{}, error) {
 
-	//the smallest message is 4 bytes, indicating a length of 0
-	if len(buffer) < 8 { //4 (roundID) + 4 (flagResync)
-		e := "Messages.go : FromBytes() : cannot decode, smaller than 8 bytes"
+	//the smallest message has three empty fields
+	if len(buffer) < 28 { //4 (roundID) + 4 (OwnershipID) + 3*4 (lengths) + 4 (flagResync) + 4 (flags)
+		e := "Messages.go : FromBytes() : cannot decode, smaller than 28 bytes"
 		return REL_CLI_DOWNSTREAM_DATA_UDP{}, errors.New(e)
 	}
 
-	// [0:4 roundID] [4:8 OwnershipID] [8:12 Length of Hash] [Variable: Hash] [8:end-8 data] [end-8:end-4 resyncFlag] [end-4:end openClosedFlag]
+	// [0:4 roundID] [4:8 OwnershipID] [8:12 Length of Hash] [Variable: Hash] [4: Length of previous head] [Variable: previous head]
+	// [4: Length of signature] [Variable: signature] [data] [end-8:end-4 resyncFlag] [end-4:end openClosedFlag | encryptedFlag<<1]
 	roundID := int32(binary.BigEndian.Uint32(buffer[0:4]))
 	ownerShipID := int(binary.BigEndian.Uint32(buffer[4:8]))
-	hashLen := int(binary.BigEndian.Uint32(buffer[8:12]))
 	flagResyncInt := int(binary.BigEndian.Uint32(buffer[len(buffer)-8 : len(buffer)-4]))
-	flagOpenClosedInt := int(binary.BigEndian.Uint32(buffer[len(buffer)-4:]))
-	hashOfPreviousUpstreamData := buffer[12 : 12+hashLen]
-	data := buffer[12+hashLen : len(buffer)-8]
+	flagsInt := int(binary.BigEndian.Uint32(buffer[len(buffer)-4:]))
+	fields := make([][]byte, 3) // the hash, the previous head and the signature
+	startIndex := 8
+	for i := range fields {
+		if startIndex+4 > len(buffer)-8 {
+			return REL_CLI_DOWNSTREAM_DATA_UDP{}, errors.New("Messages.go : FromBytes() : cannot decode, truncated message")
+		}
+		fieldLen := int(binary.BigEndian.Uint32(buffer[startIndex : startIndex+4]))
+		if fieldLen > len(buffer)-8-startIndex-4 {
+			return REL_CLI_DOWNSTREAM_DATA_UDP{}, errors.New("Messages.go : FromBytes() : cannot decode, truncated message")
+		}
+		if fieldLen > 0 {
+			fields[i] = buffer[startIndex+4 : startIndex+4+fieldLen]
+		}
+		startIndex += 4 + fieldLen
+	}
+	data := buffer[startIndex : len(buffer)-8]
 
 	flagResync := false
 	if flagResyncInt == 1 {
 		flagResync = true
 	}
-	flagOpenClosed := false
-	if flagOpenClosedInt == 1 {
-		flagOpenClosed = true
-	}
+	flagOpenClosed := flagsInt&1 == 1
+	flagEncrypted := flagsInt&2 == 2
 
-	innerMessage := REL_CLI_DOWNSTREAM_DATA{roundID, ownerShipID, hashOfPreviousUpstreamData, data, flagResync, flagOpenClosed}
+	innerMessage := REL_CLI_DOWNSTREAM_DATA{roundID, ownerShipID, fields[0], data, flagResync, flagOpenClosed, flagEncrypted, fields[1], fields[2]}
 	resultMessage := REL_CLI_DOWNSTREAM_DATA_UDP{innerMessage}
 
 	return resultMessage, nil
 }
 
+/*
+REL_CLI_DOWNSTREAM_FRAGMENT message is one UDP datagram of a downstream cell (a REL_CLI_DOWNSTREAM_DATA_UDP) broadcast
+by the relay. The cell is cut in NData fragments, followed by NParity Reed-Solomon parity fragments; any NData of them are
+enough to rebuild it. Like REL_CLI_DOWNSTREAM_DATA_UDP, it does not go through SDA, and implements MarshallableMessage.
+*/
+type REL_CLI_DOWNSTREAM_FRAGMENT struct {
+	RoundID    int32
+	Index      int // in [0, NData[ for the data, in [NData, NData+NParity[ for the parity
+	NData      int
+	NParity    int
+	CellLength int
+	Data       []byte
+}
+
+// DOWNSTREAM_FRAGMENT_HEADER_SIZE is the size of a REL_CLI_DOWNSTREAM_FRAGMENT without its data
+const DOWNSTREAM_FRAGMENT_HEADER_SIZE = 14
+
+// Print prints the raw value of this message.
+func (m REL_CLI_DOWNSTREAM_FRAGMENT) Print() {
+	log.Printf("%+v\n", m)
+}
+
+// ToBytes encodes a message into a slice of bytes.
+func (m *REL_CLI_DOWNSTREAM_FRAGMENT) ToBytes() ([]byte, error) {
+	if m.Index < 0 || m.Index > 0xffff || m.NData < 0 || m.NData > 0xffff || m.NParity < 0 || m.NParity > 0xffff {
+		return nil, errors.New("Messages.go : ToBytes() : fragment indices out of range")
+	}
+
+	// [0:4 roundID] [4:6 index] [6:8 nData] [8:10 nParity] [10:14 cellLength] [14:end data]
+	buf := make([]byte, DOWNSTREAM_FRAGMENT_HEADER_SIZE+len(m.Data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(m.RoundID))
+	binary.BigEndian.PutUint16(buf[4:6], uint16(m.Index))
+	binary.BigEndian.PutUint16(buf[6:8], uint16(m.NData))
+	binary.BigEndian.PutUint16(buf[8:10], uint16(m.NParity))
+	binary.BigEndian.PutUint32(buf[10:14], uint32(m.CellLength))
+	copy(buf[DOWNSTREAM_FRAGMENT_HEADER_SIZE:], m.Data)
+
+	return buf, nil
+}
+
+// FromBytes decodes the message contained in the message's byteEncoded field.
+func (m *REL_CLI_DOWNSTREAM_FRAGMENT) FromBytes(buffer []byte) (interface{}, error) {
+	if len(buffer) < DOWNSTREAM_FRAGMENT_HEADER_SIZE {
+		e := "Messages.go : FromBytes() : cannot decode a fragment smaller than " + strconv.Itoa(DOWNSTREAM_FRAGMENT_HEADER_SIZE) + " bytes"
+		return REL_CLI_DOWNSTREAM_FRAGMENT{}, errors.New(e)
+	}
+
+	resultMessage := REL_CLI_DOWNSTREAM_FRAGMENT{
+		RoundID:    int32(binary.BigEndian.Uint32(buffer[0:4])),
+		Index:      int(binary.BigEndian.Uint16(buffer[4:6])),
+		NData:      int(binary.BigEndian.Uint16(buffer[6:8])),
+		NParity:    int(binary.BigEndian.Uint16(buffer[8:10])),
+		CellLength: int(binary.BigEndian.Uint32(buffer[10:14])),
+		Data:       buffer[DOWNSTREAM_FRAGMENT_HEADER_SIZE:],
+	}
+
+	return resultMessage, nil
+}
+
+// CLI_REL_DOWNSTREAM_NACK message is sent by a client that could not rebuild a downstream cell broadcast by UDP. It
+// lists the fragments missing, or none if no fragment of the cell was received.
+type CLI_REL_DOWNSTREAM_NACK struct {
+	ClientID  int
+	RoundID   int32
+	Fragments []int
+}
+
+// CLI_ALL_DOWNSTREAM_CHAIN_HEAD message is gossiped by a client to the other clients and to the trustees: the head of
+// the downstream chain after a round, and the relay's signature of it, see downstream_chain.go
+type CLI_ALL_DOWNSTREAM_CHAIN_HEAD struct {
+	ClientID  int
+	Session   int
+	RoundID   int32
+	Head      []byte
+	Signature []byte
+}
+
 // REL_CLI_DISRUPTED_ROUND is when the relay detects a disruption, and sends it back to the client
 type REL_CLI_DISRUPTED_ROUND struct {
 	RoundID int32
@@ -279,39 +389,147 @@ type REL_ALL_DISRUPTION_REVEAL struct {
 
 // CLI_REL_DISRUPTION_REVEAL contains a map with individual bits to find a disruptor, and is sent to the relay
 type CLI_REL_DISRUPTION_REVEAL struct {
-	ClientID int
-	Bits     map[int]int
-	NIZK     []byte
-	Pval     map[string]kyber.Point
+	ClientID  int
+	RoundID   int32
+	BitPos    int
+	Bits      map[int]int
+	NIZK      []byte
+	Pval      map[string]kyber.Point
+	Signature []byte // see blame_evidence.go
 }
 
 // TRU_REL_DISRUPTION_REVEAL contains a map with individual bits to find a disruptor, and is sent to the relay
 type TRU_REL_DISRUPTION_REVEAL struct {
 	TrusteeID int
+	RoundID   int32
+	BitPos    int
 	Bits      map[int]int
 	NIZK      []byte
 	Pval      map[string]kyber.Point
+	Signature []byte // see blame_evidence.go
 }
 
 // REL_ALL_REVEAL_SHARED_SECRETS contains request ro reveal the shared secret with the specified recipient, and is sent by the relay
 type REL_ALL_REVEAL_SHARED_SECRETS struct {
-	EntityID int
+	EntityID    int
+	RoundID     int32 // the round and the bit blamed
+	BitPos      int
+	ClientBits  CLI_REL_DISRUPTION_REVEAL // to the trustee, the signed bits of client EntityID that disagree with its own
+	TrusteeBits TRU_REL_DISRUPTION_REVEAL // to the client, the signed bits of trustee EntityID that disagree with its own
 }
 
 // CLI_REL_SHARED_SECRET contains the shared secret requested by the relay, with a proof we computed it correctly
 type CLI_REL_SHARED_SECRET struct {
 	ClientID  int
 	TrusteeID int
+	RoundID   int32
+	BitPos    int
 	Secret    kyber.Point
 	NIZK      []byte
 	Pub       map[string]kyber.Point
+	Signature []byte // see blame_evidence.go
 }
 
 // TRU_REL_SHARED_SECRET contains the shared secret requested by the relay, with a proof we computed it correctly
 type TRU_REL_SHARED_SECRET struct {
 	TrusteeID int
 	ClientID  int
+	RoundID   int32
+	BitPos    int
 	Secret    kyber.Point
 	NIZK      []byte
 	Pub       map[string]kyber.Point
+	Signature []byte // see blame_evidence.go
+}
+
+// REL_CLI_EPOCH_START asks the clients to generate fresh keys for the next key epoch, and is sent by the relay
+type REL_CLI_EPOCH_START struct {
+	Epoch int32
+}
+
+// CLI_REL_EPOCH_PK_AND_EPH_PK contains the fresh public key (used to derive the DC-net secrets) and ephemeral key
+// (used for the shuffle) of a client for the next key epoch, and is sent to the relay
+type CLI_REL_EPOCH_PK_AND_EPH_PK struct {
+	Epoch    int32
+	ClientID int
+	Pk       kyber.Point
+	EphPk    kyber.Point
+}
+
+// REL_TRU_EPOCH_SHUFFLE contains the clients' keys for the next key epoch and the current state of the shuffle,
+// and is sent by the relay to one trustee
+type REL_TRU_EPOCH_SHUFFLE struct {
+	Epoch  int32
+	Pks    []kyber.Point
+	EphPks []kyber.Point
+	Base   kyber.Point
+}
+
+// TRU_REL_EPOCH_SHUFFLE contains the fresh public key of a trustee for the next key epoch, and its shuffle of the
+// clients' ephemeral keys. It is sent to the relay
+type TRU_REL_EPOCH_SHUFFLE struct {
+	Epoch     int32
+	TrusteeID int
+	Pk        kyber.Point
+	NewBase   kyber.Point
+	NewEphPks []kyber.Point
+	Proof     []byte
+}
+
+// REL_TRU_EPOCH_TRANSCRIPT contains all the shuffles of the next key epoch, and is sent by the relay to the trustees
+// to be verified and signed
+type REL_TRU_EPOCH_TRANSCRIPT struct {
+	Epoch  int32
+	Bases  []kyber.Point
+	EphPks []PublicKeyArray
+	Proofs []ByteArray
+}
+
+// TRU_REL_EPOCH_SHUFFLE_SIG contains the signature of the last shuffle of the next key epoch. The trustee does not
+// encode rounds from NextRound on until it knows when the epoch starts. It is sent to the relay
+type TRU_REL_EPOCH_SHUFFLE_SIG struct {
+	Epoch     int32
+	TrusteeID int
+	Sig       []byte
+	NextRound int32
+}
+
+// REL_ALL_EPOCH_SWITCH announces that the next key epoch starts at BoundaryRound, and contains the trustees' fresh
+// public keys, the signed result of the shuffle, and the size of the upstream payloads during the epoch. It is sent
+// by the relay to the clients and the trustees
+type REL_ALL_EPOCH_SWITCH struct {
+	Epoch         int32
+	BoundaryRound int32
+	TrusteesPks   []kyber.Point
+	Base          kyber.Point
+	EphPks        []kyber.Point
+	TrusteesSigs  []ByteArray
+	PayloadSize   int
+}
+
+//Converts []ByteArray -> [][]byte and returns it
+func (m *REL_ALL_EPOCH_SWITCH) GetSignatures() [][]byte {
+	out := make([][]byte, 0)
+	for k := range m.TrusteesSigs {
+		out = append(out, m.TrusteesSigs[k].Bytes)
+	}
+	return out
+}
+
+//Converts []PublicKeyArray -> [][]abstract.Point and returns it
+func (m *REL_TRU_EPOCH_TRANSCRIPT) GetKeys() [][]kyber.Point {
+	out := make([][]kyber.Point, 0)
+	for k := range m.EphPks {
+		out = append(out, m.EphPks[k].Keys)
+	}
+	return out
+}
+
+//Converts []ByteArray -> [][]byte and returns it
+func (m *REL_TRU_EPOCH_TRANSCRIPT) GetProofs() [][]byte {
+	out := make([][]byte, 0)
+	for k := range m.Proofs {
+		out = append(out, m.Proofs[k].Bytes)
+	}
+	return out
 }
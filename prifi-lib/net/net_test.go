@@ -152,6 +152,10 @@ func TestUDPMessage(t *testing.T) {
 	content.FlagResync = true
 	content.Data = genDataSlice()
 	content.FlagOpenClosedRequest = true
+	content.FlagEncrypted = true
+	content.HashOfPreviousUpstreamData = []byte{1, 2, 3}
+	content.PreviousChainHead = NewDownstreamChainHead()
+	content.ChainSignature = []byte{4, 5, 6, 7}
 
 	msg.SetContent(*content)
 
@@ -183,9 +187,30 @@ func TestUDPMessage(t *testing.T) {
 	if parsedMsg.FlagResync != content.FlagResync {
 		t.Error("FlagResync unparsed incorrectly")
 	}
+	if parsedMsg.FlagOpenClosedRequest != content.FlagOpenClosedRequest {
+		t.Error("FlagOpenClosedRequest unparsed incorrectly")
+	}
+	if parsedMsg.FlagEncrypted != content.FlagEncrypted {
+		t.Error("FlagEncrypted unparsed incorrectly")
+	}
 	if !bytes.Equal(parsedMsg.Data, content.Data) {
 		t.Error("Data unparsed incorrectly")
 	}
+	if !bytes.Equal(parsedMsg.HashOfPreviousUpstreamData, content.HashOfPreviousUpstreamData) {
+		t.Error("HashOfPreviousUpstreamData unparsed incorrectly")
+	}
+	if !bytes.Equal(parsedMsg.PreviousChainHead, content.PreviousChainHead) {
+		t.Error("PreviousChainHead unparsed incorrectly")
+	}
+	if !bytes.Equal(parsedMsg.ChainSignature, content.ChainSignature) {
+		t.Error("ChainSignature unparsed incorrectly")
+	}
+
+	//a length pointing after the end of the message should fail
+	void = new(REL_CLI_DOWNSTREAM_DATA_UDP)
+	if _, err := void.FromBytes(msgBytes[0:20]); err == nil {
+		t.Error("REL_CLI_DOWNSTREAM_DATA_UDP should not decode a truncated message")
+	}
 
 	//this should fail, cannot read the size if len<4
 	void = new(REL_CLI_DOWNSTREAM_DATA_UDP)
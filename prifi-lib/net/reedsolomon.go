@@ -0,0 +1,206 @@
+package net
+
+/*
+ * Reed-Solomon erasure code over GF(2^8), used to add parity to the downstream cells broadcast by UDP.
+ * The code is systematic: the first nData shards are the data itself, the nParity others are computed with a Cauchy
+ * matrix. Any nData shards out of the nData+nParity are enough to recover the data.
+ */
+
+import (
+	"errors"
+	"strconv"
+)
+
+// the primitive polynomial x^8 + x^4 + x^3 + x^2 + 1
+const gfPolynomial = 0x11d
+
+var gfExp [512]byte
+var gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPolynomial
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+// ReedSolomon encodes and reconstructs shards of equal length
+type ReedSolomon struct {
+	nData   int
+	nParity int
+	parity  [][]byte // nParity x nData Cauchy matrix
+}
+
+// NewReedSolomon creates a code with nData data shards and nParity parity shards. There can be at most 256 shards
+func NewReedSolomon(nData, nParity int) (*ReedSolomon, error) {
+	if nData < 1 || nParity < 0 || nData+nParity > 256 {
+		return nil, errors.New("cannot have " + strconv.Itoa(nData) + " data and " + strconv.Itoa(nParity) + " parity shards")
+	}
+	rs := &ReedSolomon{nData: nData, nParity: nParity, parity: make([][]byte, nParity)}
+	for j := range rs.parity {
+		rs.parity[j] = make([]byte, nData)
+		for i := range rs.parity[j] {
+			// 1 / (x_j + y_i), with x_j = nData+j and y_i = i all distinct
+			rs.parity[j][i] = gfInv(byte(nData+j) ^ byte(i))
+		}
+	}
+	return rs, nil
+}
+
+// row returns the line of the generator matrix giving shard index
+func (rs *ReedSolomon) row(index int) []byte {
+	if index < rs.nData {
+		r := make([]byte, rs.nData)
+		r[index] = 1
+		return r
+	}
+	return rs.parity[index-rs.nData]
+}
+
+// Encode computes the parity shards from the data shards. shards must hold nData+nParity shards of the same length
+func (rs *ReedSolomon) Encode(shards [][]byte) error {
+	if len(shards) != rs.nData+rs.nParity {
+		return errors.New("expected " + strconv.Itoa(rs.nData+rs.nParity) + " shards, got " + strconv.Itoa(len(shards)))
+	}
+	size := len(shards[0])
+	for _, s := range shards {
+		if len(s) != size {
+			return errors.New("all shards must have the same length")
+		}
+	}
+	for j, coefficients := range rs.parity {
+		out := shards[rs.nData+j]
+		for k := range out {
+			out[k] = 0
+		}
+		for i, c := range coefficients {
+			gfMulAdd(c, shards[i], out)
+		}
+	}
+	return nil
+}
+
+// Reconstruct fills in the missing (nil) data shards, provided at least nData shards are present. The parity shards
+// are not rebuilt
+func (rs *ReedSolomon) Reconstruct(shards [][]byte) error {
+	if len(shards) != rs.nData+rs.nParity {
+		return errors.New("expected " + strconv.Itoa(rs.nData+rs.nParity) + " shards, got " + strconv.Itoa(len(shards)))
+	}
+
+	missingData := false
+	for i := 0; i < rs.nData; i++ {
+		if shards[i] == nil {
+			missingData = true
+		}
+	}
+	if !missingData {
+		return nil
+	}
+
+	// pick nData present shards, and the corresponding lines of the generator matrix
+	present := make([]int, 0, rs.nData)
+	size := -1
+	for i := range shards {
+		if shards[i] != nil && len(present) < rs.nData {
+			present = append(present, i)
+			size = len(shards[i])
+		}
+	}
+	if len(present) < rs.nData {
+		return errors.New("cannot reconstruct with " + strconv.Itoa(len(present)) + " shards out of " + strconv.Itoa(rs.nData) + " needed")
+	}
+	matrix := make([][]byte, rs.nData)
+	for k, index := range present {
+		matrix[k] = append([]byte(nil), rs.row(index)...)
+		if len(shards[index]) != size {
+			return errors.New("all shards must have the same length")
+		}
+	}
+
+	decoder, err := gfInvertMatrix(matrix)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < rs.nData; i++ {
+		if shards[i] != nil {
+			continue
+		}
+		out := make([]byte, size)
+		for k, index := range present {
+			gfMulAdd(decoder[i][k], shards[index], out)
+		}
+		shards[i] = out
+	}
+	return nil
+}
+
+// out += c * in
+func gfMulAdd(c byte, in, out []byte) {
+	if c == 0 {
+		return
+	}
+	logC := gfLog[c]
+	for k, v := range in {
+		if v != 0 {
+			out[k] ^= gfExp[logC+gfLog[v]]
+		}
+	}
+}
+
+// gfInvertMatrix inverts a square matrix by Gauss-Jordan elimination
+func gfInvertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && m[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		scale := gfInv(m[col][col])
+		for k := 0; k < n; k++ {
+			m[col][k] = gfMul(m[col][k], scale)
+			inv[col][k] = gfMul(inv[col][k], scale)
+		}
+		for row := 0; row < n; row++ {
+			if row == col || m[row][col] == 0 {
+				continue
+			}
+			factor := m[row][col]
+			for k := 0; k < n; k++ {
+				m[row][k] ^= gfMul(factor, m[col][k])
+				inv[row][k] ^= gfMul(factor, inv[col][k])
+			}
+		}
+	}
+	return inv, nil
+}
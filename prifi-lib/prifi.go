@@ -5,6 +5,7 @@ import (
 	"github.com/dedis/prifi/prifi-lib/net"
 	"github.com/dedis/prifi/prifi-lib/relay"
 	"github.com/dedis/prifi/prifi-lib/trustee"
+	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/onet/v3/log"
 )
 
@@ -23,9 +24,10 @@ type PriFiLibInstance struct { //todo remove this, like it was done for client
 	specializedLibInstance SpecializedLibInstance
 }
 
-//Prifi's "Relay", "Client" and "Trustee" instance all can receive a message
+//Prifi's "Relay", "Client" and "Trustee" instance all can receive a message, and be given their identity
 type SpecializedLibInstance interface {
 	ReceivedMessage(msg interface{}) error
+	SetIdentities(privateKey kyber.Scalar, identities net.Identities)
 }
 
 // Possible role of PriFi entities.
@@ -39,9 +41,9 @@ const (
 )
 
 // NewPriFiClient creates a new PriFi client
-func NewPriFiClient(doLatencyTest bool, dataOutputEnabled bool, dataForDCNet chan []byte, dataFromDCNet chan []byte, doReplayPcap bool, pcapFolder string, msgSender net.MessageSender) *PriFiLibInstance {
+func NewPriFiClient(doLatencyTest bool, dataOutputEnabled bool, dataForDCNet chan []byte, dataFromDCNet chan []byte, doReplayPcap bool, pcapFolder string, downstreamChainEnabled bool, msgSender net.MessageSender) *PriFiLibInstance {
 	msw := newMessageSenderWrapper(msgSender)
-	c := client.NewClient(doLatencyTest, dataOutputEnabled, dataForDCNet, dataFromDCNet, doReplayPcap, pcapFolder, msw)
+	c := client.NewClient(doLatencyTest, dataOutputEnabled, dataForDCNet, dataFromDCNet, doReplayPcap, pcapFolder, downstreamChainEnabled, msw)
 	p := &PriFiLibInstance{
 		role:                   PRIFI_ROLE_CLIENT,
 		specializedLibInstance: c,
@@ -50,10 +52,11 @@ func NewPriFiClient(doLatencyTest bool, dataOutputEnabled bool, dataForDCNet cha
 	return p
 }
 
-// NewPriFiRelay creates a new PriFi relay
-func NewPriFiRelay(dataOutputEnabled bool, dataForClients chan []byte, dataFromDCNet chan []byte, experimentResultChan chan interface{}, timeoutHandler func([]int, []int), msgSender net.MessageSender) *PriFiLibInstance {
+// NewPriFiRelay creates a new PriFi relay. timeoutHandler is called when clients or trustees miss a round, and
+// blameHandler with the verdicts of the disruption protection; both can be nil.
+func NewPriFiRelay(dataOutputEnabled bool, dataForClients chan []byte, dataFromDCNet chan []byte, experimentResultChan chan interface{}, timeoutHandler func([]int, []int), blameHandler func(net.BlameTranscript), msgSender net.MessageSender) *PriFiLibInstance {
 	msw := newMessageSenderWrapper(msgSender)
-	r := relay.NewRelay(dataOutputEnabled, dataForClients, dataFromDCNet, experimentResultChan, timeoutHandler, msw)
+	r := relay.NewRelay(dataOutputEnabled, dataForClients, dataFromDCNet, experimentResultChan, timeoutHandler, blameHandler, msw)
 	p := &PriFiLibInstance{
 		role:                   PRIFI_ROLE_RELAY,
 		specializedLibInstance: r,
@@ -95,6 +98,12 @@ func (p *PriFiLibInstance) ReceivedMessage(msg interface{}) error {
 	return nil
 }
 
+// SetIdentities gives the entity the private key of its server identity, and the long-term keys of the others; what
+// must be attributed to an entity is signed with those keys. It must be called before the first message.
+func (p *PriFiLibInstance) SetIdentities(privateKey kyber.Scalar, identities net.Identities) {
+	p.specializedLibInstance.SetIdentities(privateKey, identities)
+}
+
 func newMessageSenderWrapper(msgSender net.MessageSender) *net.MessageSenderWrapper {
 
 	errHandling := func(e error) { /* do nothing yet, we are alerted of errors via the SDA */ }
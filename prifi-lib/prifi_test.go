@@ -1,10 +1,24 @@
 package prifi_lib
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"github.com/dedis/prifi/prifi-lib/crypto"
 	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/relay"
+	"github.com/dedis/prifi/prifi-lib/scheduler"
+	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/onet/v3/log"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 /**
@@ -35,13 +49,13 @@ func TestPrifi(t *testing.T) {
 	in := make(chan []byte, 6)
 	out := make(chan []byte, 3)
 
-	client0 := NewPriFiClient(true, true, in, out, false, "./", msgSender)
-	client1 := NewPriFiClient(true, true, in, out, false, "./", msgSender)
+	client0 := NewPriFiClient(true, true, in, out, false, "./", false, msgSender)
+	client1 := NewPriFiClient(true, true, in, out, false, "./", false, msgSender)
 
 	timeoutHandler := func(clients, trustees []int) { log.Error(clients, trustees) }
 	resultChan := make(chan interface{}, 1)
 
-	relay := NewPriFiRelay(true, in, out, resultChan, timeoutHandler, msgSender)
+	relay := NewPriFiRelay(true, in, out, resultChan, timeoutHandler, nil, msgSender)
 
 	alwaysSlowDown := true
 	neverSlowDown := false
@@ -72,3 +86,977 @@ func TestPrifi(t *testing.T) {
 	_ = trustee0
 	_ = trustee1
 }
+
+/**
+ * In-memory network, delivering the messages one at a time and in order, like onet does
+ */
+// the tests on the in-memory network wait for some rounds to happen; this only bounds a test that hangs, it is
+// generous since the rounds are much slower with -race
+const testRouterTimeout = 5 * time.Minute
+
+type routedMessage struct {
+	role int16
+	id   int
+	msg  interface{}
+}
+
+type TestRouter struct {
+	sync.Mutex
+	relay    *PriFiLibInstance
+	clients  []*PriFiLibInstance
+	trustees []*PriFiLibInstance
+	queue    []routedMessage
+	notify   chan bool
+	stopped  bool
+	received map[string]int
+	drop     func(msg interface{}) bool // if set, the messages it returns true for are lost
+
+	identities       net.Identities // the keys of the entities, as in the roster of the SDA layer, see setIdentities
+	relayIdentityKey kyber.Scalar
+}
+
+func newTestRouter() *TestRouter {
+	return &TestRouter{notify: make(chan bool, 1), received: make(map[string]int)}
+}
+
+// setIdentities gives each entity a long-term key and the keys of the others, as the SDA layer does with those of the
+// roster
+func (r *TestRouter) setIdentities() {
+	relayPub, relayPriv := crypto.NewKeyPair()
+	r.identities = net.Identities{Relay: relayPub}
+	r.relayIdentityKey = relayPriv
+	privateKeys := make([]kyber.Scalar, 0)
+	for range r.clients {
+		pub, priv := crypto.NewKeyPair()
+		r.identities.Clients = append(r.identities.Clients, pub)
+		privateKeys = append(privateKeys, priv)
+	}
+	for range r.trustees {
+		pub, priv := crypto.NewKeyPair()
+		r.identities.Trustees = append(r.identities.Trustees, pub)
+		privateKeys = append(privateKeys, priv)
+	}
+
+	r.relay.SetIdentities(relayPriv, r.identities)
+	for i, client := range r.clients {
+		client.SetIdentities(privateKeys[i], r.identities)
+	}
+	for j, trustee := range r.trustees {
+		trustee.SetIdentities(privateKeys[len(r.clients)+j], r.identities)
+	}
+}
+
+func (r *TestRouter) enqueue(role int16, id int, msg interface{}) error {
+	// the entities reuse the messages they send, so take a copy like the network would
+	v := reflect.ValueOf(msg)
+	if v.Kind() == reflect.Ptr {
+		msg = v.Elem().Interface()
+	}
+	if params, ok := msg.(net.ALL_ALL_PARAMETERS); ok {
+		copied := net.ALL_ALL_PARAMETERS{TrusteesPks: params.TrusteesPks, ForceParams: params.ForceParams}
+		for k, v := range params.ParamsInt {
+			copied.Add(k, v)
+		}
+		for k, v := range params.ParamsStr {
+			copied.Add(k, v)
+		}
+		for k, v := range params.ParamsBool {
+			copied.Add(k, v)
+		}
+		msg = copied
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if r.stopped {
+		return errors.New("network is stopped")
+	}
+	r.queue = append(r.queue, routedMessage{role, id, msg})
+	select {
+	case r.notify <- true:
+	default:
+	}
+	return nil
+}
+
+func (r *TestRouter) SendToClient(i int, msg interface{}) error {
+	return r.enqueue(PRIFI_ROLE_CLIENT, i, msg)
+}
+func (r *TestRouter) SendToTrustee(i int, msg interface{}) error {
+	return r.enqueue(PRIFI_ROLE_TRUSTEE, i, msg)
+}
+func (r *TestRouter) SendToRelay(msg interface{}) error {
+	return r.enqueue(PRIFI_ROLE_RELAY, 0, msg)
+}
+func (r *TestRouter) BroadcastToAllClients(msg interface{}) error {
+	return errors.New("not implemented")
+}
+func (r *TestRouter) ClientSubscribeToBroadcast(clientID int, messageReceived func(interface{}) error, startStopChan chan bool) error {
+	return errors.New("not implemented")
+}
+
+// deliver delivers the messages until the router is stopped, then stops the trustees, which would otherwise keep
+// their sending goroutine
+func (r *TestRouter) deliver() {
+	for {
+		r.Lock()
+		if r.stopped {
+			r.Unlock()
+			for _, trustee := range r.trustees {
+				trustee.ReceivedMessage(net.ALL_ALL_SHUTDOWN{})
+			}
+			return
+		}
+		if len(r.queue) == 0 {
+			r.Unlock()
+			<-r.notify
+			continue
+		}
+		m := r.queue[0]
+		r.queue = r.queue[1:]
+		r.received[reflect.TypeOf(m.msg).Name()]++
+		r.Unlock()
+		if r.drop != nil && r.drop(m.msg) {
+			continue
+		}
+
+		switch m.role {
+		case PRIFI_ROLE_RELAY:
+			r.relay.ReceivedMessage(m.msg)
+		case PRIFI_ROLE_CLIENT:
+			r.clients[m.id].ReceivedMessage(m.msg)
+		case PRIFI_ROLE_TRUSTEE:
+			r.trustees[m.id].ReceivedMessage(m.msg)
+		}
+	}
+}
+
+func (r *TestRouter) count(msgType string) int {
+	r.Lock()
+	defer r.Unlock()
+	return r.received[msgType]
+}
+
+func (r *TestRouter) stop() {
+	r.Lock()
+	r.stopped = true
+	r.Unlock()
+	select {
+	case r.notify <- true:
+	default:
+	}
+}
+
+func TestPrifiKeyEpochs(t *testing.T) {
+	nClients := 2
+	nTrustees := 2
+	payloadSize := 100
+
+	router := newTestRouter()
+	dataFromDCNet := make(chan []byte, 1000)
+	router.relay = NewPriFiRelay(true, make(chan []byte), dataFromDCNet, make(chan interface{}, 1), func(clients, trustees []int) {
+		t.Error("clients", clients, "and trustees", trustees, "timed out")
+	}, nil, router)
+
+	// each client has plenty of data to send
+	for i := 0; i < nClients; i++ {
+		dataForDCNet := make(chan []byte, 1000)
+		for k := 0; k < cap(dataForDCNet); k++ {
+			dataForDCNet <- []byte("client " + strconv.Itoa(i) + " message " + strconv.Itoa(k))
+		}
+		router.clients = append(router.clients, NewPriFiClient(false, false, dataForDCNet, nil, false, "./", false, router))
+	}
+	for j := 0; j < nTrustees; j++ {
+		router.trustees = append(router.trustees, NewPriFiTrustee(true, false, 0, router))
+	}
+	go router.deliver()
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.Add("StartNow", true)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("NClients", nClients)
+	msg.Add("PayloadSize", payloadSize)
+	msg.Add("DownstreamCellSize", payloadSize)
+	msg.Add("WindowSize", 2)
+	msg.Add("ExperimentRoundLimit", -1)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("DCNetPadGenerator", "XOF")
+	msg.Add("RelayRoundTimeOut", 10000)
+	msg.Add("RelayMaxNumberOfConsecutiveFailedRounds", 3)
+	msg.Add("RelayTrusteeCacheLowBound", 5)
+	msg.Add("RelayTrusteeCacheHighBound", 10)
+	msg.Add("RelayEpochLength", 10)
+	msg.ForceParams = true
+	router.SendToRelay(msg)
+
+	// every decoded cell must be a message of some client, or empty; the cells of rounds encoded with mismatching
+	// keys would be random
+	messages := 0
+	deadline := time.After(testRouterTimeout)
+	for router.count("REL_ALL_EPOCH_SWITCH") < 3*(nClients+nTrustees) || messages < 10 {
+		select {
+		case cell := <-dataFromDCNet:
+			if len(cell) != payloadSize {
+				t.Fatal("Decoded cell has size", len(cell), "instead of", payloadSize)
+			}
+			content := bytes.TrimRight(cell, "\x00")
+			if len(content) == 0 {
+				continue
+			}
+			if !bytes.HasPrefix(content, []byte("client ")) {
+				t.Fatal("Decoded cell is garbage:", cell)
+			}
+			messages++
+		case <-deadline:
+			t.Fatal("Only", router.count("REL_ALL_EPOCH_SWITCH"), "switches and", messages, "messages before the deadline")
+		}
+	}
+
+	// the cells decoded after the last switch are correct too
+	for k := 0; k < 3*router.count("REL_CLI_EPOCH_START"); k++ {
+		cell := <-dataFromDCNet
+		content := bytes.TrimRight(cell, "\x00")
+		if len(content) > 0 && !bytes.HasPrefix(content, []byte("client ")) {
+			t.Fatal("Decoded cell is garbage:", cell)
+		}
+	}
+
+	go func() {
+		for range dataFromDCNet {
+		}
+	}()
+	router.relay.ReceivedMessage(net.ALL_ALL_SHUTDOWN{})
+	router.stop()
+}
+
+func TestPrifiDownstreamEncryption(t *testing.T) {
+	nClients := 2
+	nTrustees := 2
+	payloadSize := 100
+
+	router := newTestRouter()
+	dataForClients := make(chan []byte, 1000)
+	dataFromDCNet := make(chan []byte, 1000)
+	router.relay = NewPriFiRelay(true, dataForClients, dataFromDCNet, make(chan interface{}, 1), func(clients, trustees []int) {
+		t.Error("clients", clients, "and trustees", trustees, "timed out")
+	}, nil, router)
+
+	// each client sends requests on its own stream, and gets its answers on dataFromRelay
+	dataFromRelay := make([]chan []byte, nClients)
+	for i := 0; i < nClients; i++ {
+		dataForDCNet := make(chan []byte, 10)
+		for k := 0; k < cap(dataForDCNet); k++ {
+			dataForDCNet <- []byte("str" + strconv.Itoa(i) + " request " + strconv.Itoa(k))
+		}
+		dataFromRelay[i] = make(chan []byte, 1000)
+		router.clients = append(router.clients, NewPriFiClient(false, true, dataForDCNet, dataFromRelay[i], false, "./", false, router))
+	}
+	for j := 0; j < nTrustees; j++ {
+		router.trustees = append(router.trustees, NewPriFiTrustee(true, false, 0, router))
+	}
+	go router.deliver()
+
+	// the relay answers each request on the same stream
+	go func() {
+		for cell := range dataFromDCNet {
+			content := bytes.TrimRight(cell, "\x00")
+			if len(content) == 0 {
+				continue
+			}
+			if len(cell) != payloadSize-crypto.DOWNSTREAM_KEY_SIZE {
+				t.Error("Decoded cell has size", len(cell), "instead of", payloadSize-crypto.DOWNSTREAM_KEY_SIZE)
+			}
+			dataForClients <- append([]byte(string(content[:4])+" answer to"), content[4:]...)
+		}
+	}()
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.Add("StartNow", true)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("NClients", nClients)
+	msg.Add("PayloadSize", payloadSize)
+	msg.Add("DownstreamCellSize", payloadSize)
+	msg.Add("WindowSize", 1)
+	msg.Add("ExperimentRoundLimit", -1)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("RelayRoundTimeOut", 10000)
+	msg.Add("RelayTrusteeCacheLowBound", 5)
+	msg.Add("RelayTrusteeCacheHighBound", 10)
+	msg.Add("DownstreamEncryptionEnabled", true)
+	msg.ForceParams = true
+	router.SendToRelay(msg)
+
+	// every client gets its answers, and only them
+	answers := make([]int, nClients)
+	deadline := time.After(testRouterTimeout)
+	for answers[0] < 5 || answers[1] < 5 {
+		select {
+		case data := <-dataFromRelay[0]:
+			if !bytes.HasPrefix(data, []byte("str0 answer to request")) {
+				t.Fatal("Client 0 received", string(data))
+			}
+			answers[0]++
+		case data := <-dataFromRelay[1]:
+			if !bytes.HasPrefix(data, []byte("str1 answer to request")) {
+				t.Fatal("Client 1 received", string(data))
+			}
+			answers[1]++
+		case <-deadline:
+			t.Fatal("Only", answers, "answers before the deadline")
+		}
+	}
+
+	router.relay.ReceivedMessage(net.ALL_ALL_SHUTDOWN{})
+	router.stop()
+}
+
+func TestPrifiUpstreamCompression(t *testing.T) {
+	nClients := 2
+	nTrustees := 2
+	payloadSize := 100
+	nRequests := 10
+
+	router := newTestRouter()
+	dataFromDCNet := make(chan []byte, 1000)
+	router.relay = NewPriFiRelay(true, make(chan []byte, 1), dataFromDCNet, make(chan interface{}, 1), func(clients, trustees []int) {
+		t.Error("clients", clients, "and trustees", trustees, "timed out")
+	}, nil, router)
+
+	// the requests are small and alike, so several of them fit in a cell
+	for i := 0; i < nClients; i++ {
+		dataForDCNet := make(chan []byte, nRequests)
+		for k := 0; k < nRequests; k++ {
+			dataForDCNet <- []byte("str" + strconv.Itoa(i) + " GET / HTTP/1.1 request " + strconv.Itoa(k))
+		}
+		router.clients = append(router.clients, NewPriFiClient(false, true, dataForDCNet, make(chan []byte, 1000), false, "./", false, router))
+	}
+	for j := 0; j < nTrustees; j++ {
+		router.trustees = append(router.trustees, NewPriFiTrustee(true, false, 0, router))
+	}
+	go router.deliver()
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.Add("StartNow", true)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("NClients", nClients)
+	msg.Add("PayloadSize", payloadSize)
+	msg.Add("DownstreamCellSize", payloadSize)
+	msg.Add("WindowSize", 1)
+	msg.Add("ExperimentRoundLimit", -1)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("RelayRoundTimeOut", 10000)
+	msg.Add("RelayTrusteeCacheLowBound", 5)
+	msg.Add("RelayTrusteeCacheHighBound", 10)
+	msg.Add("UpstreamCompressionEnabled", true)
+	msg.ForceParams = true
+	router.SendToRelay(msg)
+
+	// every request arrives intact and in order
+	next := make([]int, nClients)
+	deadline := time.After(testRouterTimeout)
+	for next[0] < nRequests || next[1] < nRequests {
+		select {
+		case data := <-dataFromDCNet:
+			content := string(bytes.TrimRight(data, "\x00"))
+			if len(content) == 0 {
+				continue
+			}
+			i, _ := strconv.Atoi(content[3:4])
+			if i >= nClients || content != "str"+strconv.Itoa(i)+" GET / HTTP/1.1 request "+strconv.Itoa(next[i]) {
+				t.Fatal("Relay received", content)
+			}
+			next[i]++
+		case <-deadline:
+			t.Fatal("Only", next, "requests before the deadline")
+		}
+	}
+
+	go func() {
+		for range dataFromDCNet {
+		}
+	}()
+	router.relay.ReceivedMessage(net.ALL_ALL_SHUTDOWN{})
+	router.stop()
+}
+
+func TestPrifiDownstreamChain(t *testing.T) {
+	nClients := 3
+	nTrustees := 2
+	payloadSize := 100
+	gossipPeriod := 3
+
+	router := newTestRouter()
+	dataFromDCNet := make(chan []byte, 1000)
+	router.relay = NewPriFiRelay(true, make(chan []byte), dataFromDCNet, make(chan interface{}, 1), func(clients, trustees []int) {
+		t.Error("clients", clients, "and trustees", trustees, "timed out")
+	}, nil, router)
+	for i := 0; i < nClients; i++ {
+		router.clients = append(router.clients, NewPriFiClient(false, false, make(chan []byte, 1), nil, false, "./", true, router))
+	}
+	for j := 0; j < nTrustees; j++ {
+		router.trustees = append(router.trustees, NewPriFiTrustee(true, false, 0, router))
+	}
+	router.setIdentities()
+	go router.deliver()
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.Add("StartNow", true)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("NClients", nClients)
+	msg.Add("PayloadSize", payloadSize)
+	msg.Add("DownstreamCellSize", payloadSize)
+	msg.Add("WindowSize", 2)
+	msg.Add("ExperimentRoundLimit", -1)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("RelayRoundTimeOut", 10000)
+	msg.Add("RelayTrusteeCacheLowBound", 5)
+	msg.Add("RelayTrusteeCacheHighBound", 10)
+	msg.Add("RelayEpochLength", 10)
+	msg.Add("DownstreamChainEnabled", true)
+	msg.Add("DownstreamGossipPeriod", gossipPeriod)
+	msg.ForceParams = true
+	router.SendToRelay(msg)
+
+	// the clients only answer the cells signed by the relay's server identity, so the rounds go on, and they gossip the heads to the
+	// other clients and to the trustees
+	rounds := 0
+	deadline := time.After(testRouterTimeout)
+	for rounds < 10*gossipPeriod || router.count("CLI_ALL_DOWNSTREAM_CHAIN_HEAD") < 5*nClients*(nClients-1+nTrustees) {
+		select {
+		case <-dataFromDCNet:
+			rounds++
+		case <-deadline:
+			t.Fatal("Only", rounds, "rounds and", router.count("CLI_ALL_DOWNSTREAM_CHAIN_HEAD"), "heads before the deadline")
+		}
+	}
+
+	go func() {
+		for range dataFromDCNet {
+		}
+	}()
+	router.relay.ReceivedMessage(net.ALL_ALL_SHUTDOWN{})
+	router.stop()
+}
+
+func TestPrifiAdaptivePayloadSize(t *testing.T) {
+	nClients := 2
+	nTrustees := 2
+	payloadSize := 100
+
+	router := newTestRouter()
+	dataFromDCNet := make(chan []byte, 1000)
+	router.relay = NewPriFiRelay(true, make(chan []byte), dataFromDCNet, make(chan interface{}, 1), func(clients, trustees []int) {
+		t.Error("clients", clients, "and trustees", trustees, "timed out")
+	}, nil, router)
+
+	// the clients fill their cells for a while, then stop sending
+	for i := 0; i < nClients; i++ {
+		dataForDCNet := make(chan []byte, 60)
+		for k := 0; k < cap(dataForDCNet); k++ {
+			message := []byte("client " + strconv.Itoa(i) + " message " + strconv.Itoa(k) + " ")
+			dataForDCNet <- append(message, bytes.Repeat([]byte("x"), payloadSize-len(message))...)
+		}
+		router.clients = append(router.clients, NewPriFiClient(false, false, dataForDCNet, nil, false, "./", false, router))
+	}
+	for j := 0; j < nTrustees; j++ {
+		router.trustees = append(router.trustees, NewPriFiTrustee(true, false, 0, router))
+	}
+	go router.deliver()
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.Add("StartNow", true)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("NClients", nClients)
+	msg.Add("PayloadSize", payloadSize)
+	msg.Add("DownstreamCellSize", payloadSize)
+	msg.Add("WindowSize", 2)
+	msg.Add("ExperimentRoundLimit", -1)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("RelayRoundTimeOut", 10000)
+	msg.Add("RelayTrusteeCacheLowBound", 5)
+	msg.Add("RelayTrusteeCacheHighBound", 10)
+	msg.Add("RelayEpochLength", 10)
+	msg.Add("MaxPayloadSize", 4*payloadSize)
+	msg.ForceParams = true
+	router.SendToRelay(msg)
+
+	// the full cells double, which halves their fill, so they keep that size; once the clients are idle, they shrink
+	sizes := make([]int, 0)
+	deadline := time.After(testRouterTimeout)
+	for len(sizes) < 3 {
+		select {
+		case cell := <-dataFromDCNet:
+			content := bytes.TrimRight(cell, "\x00")
+			if len(content) > 0 && !bytes.HasPrefix(content, []byte("client ")) {
+				t.Fatal("Decoded cell is garbage:", cell)
+			}
+			if len(sizes) == 0 || sizes[len(sizes)-1] != len(cell) {
+				sizes = append(sizes, len(cell))
+			}
+		case <-deadline:
+			t.Fatal("The cells only had the sizes", sizes, "before the deadline")
+		}
+	}
+	if sizes[0] != payloadSize || sizes[1] != 2*payloadSize || sizes[2] != payloadSize {
+		t.Error("The cells should have had the sizes", payloadSize, 2*payloadSize, payloadSize, ", not", sizes)
+	}
+
+	go func() {
+		for range dataFromDCNet {
+		}
+	}()
+	router.relay.ReceivedMessage(net.ALL_ALL_SHUTDOWN{})
+	router.stop()
+}
+
+// runOpenClosedSlots sends nRequests from each client that has data with the open-closed slots, checks that they all
+// arrive in order, and returns how many schedules it took
+func runOpenClosedSlots(t *testing.T, nClients int, clientsWithData int, nRequests int, params map[string]interface{}) int {
+	nTrustees := 2
+	payloadSize := 100
+
+	router := newTestRouter()
+	dataFromDCNet := make(chan []byte, 1000)
+	router.relay = NewPriFiRelay(true, make(chan []byte), dataFromDCNet, make(chan interface{}, 1), func(clients, trustees []int) {
+		t.Error("clients", clients, "and trustees", trustees, "timed out")
+	}, nil, router)
+
+	// the data is all queued from the start
+	for i := 0; i < nClients; i++ {
+		dataForDCNet := make(chan []byte, nRequests)
+		if i < clientsWithData {
+			for k := 0; k < nRequests; k++ {
+				dataForDCNet <- []byte("client " + strconv.Itoa(i) + " request " + strconv.Itoa(k))
+			}
+		}
+		router.clients = append(router.clients, NewPriFiClient(false, false, dataForDCNet, nil, false, "./", false, router))
+	}
+	for j := 0; j < nTrustees; j++ {
+		router.trustees = append(router.trustees, NewPriFiTrustee(true, false, 0, router))
+	}
+	go router.deliver()
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.Add("StartNow", true)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("NClients", nClients)
+	msg.Add("PayloadSize", payloadSize)
+	msg.Add("DownstreamCellSize", payloadSize)
+	msg.Add("WindowSize", 1)
+	msg.Add("ExperimentRoundLimit", -1)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("RelayRoundTimeOut", 10000)
+	msg.Add("RelayTrusteeCacheLowBound", 5)
+	msg.Add("RelayTrusteeCacheHighBound", 10)
+	msg.Add("UseOpenClosedSlots", true)
+	msg.Add("OpenClosedSlotsMinDelayBetweenRequests", 10)
+	for k, v := range params {
+		msg.Add(k, v)
+	}
+	msg.ForceParams = true
+	router.SendToRelay(msg)
+
+	// every request arrives intact and in order
+	next := make([]int, clientsWithData)
+	received := 0
+	deadline := time.After(testRouterTimeout)
+	for received < clientsWithData*nRequests {
+		select {
+		case data := <-dataFromDCNet:
+			content := string(bytes.TrimRight(data, "\x00"))
+			if len(content) == 0 {
+				continue
+			}
+			i, _ := strconv.Atoi(strings.Fields(content)[1])
+			if i >= clientsWithData || content != "client "+strconv.Itoa(i)+" request "+strconv.Itoa(next[i]) {
+				t.Fatal("Relay received", content)
+			}
+			next[i]++
+			received++
+		case <-deadline:
+			t.Fatal("Only", next, "requests before the deadline")
+		}
+	}
+	schedules := router.count("CLI_REL_OPENCLOSED_DATA") / nClients
+
+	go func() {
+		for range dataFromDCNet {
+		}
+	}()
+	router.relay.ReceivedMessage(net.ALL_ALL_SHUTDOWN{})
+	router.stop()
+	return schedules
+}
+
+func TestPrifiVariableLengthSlots(t *testing.T) {
+	nRequests := 12
+
+	// with one round per schedule and the window, client 0 gets 2 rounds per schedule; with 4, it gets 5
+	oneRound := runOpenClosedSlots(t, 2, 1, nRequests, map[string]interface{}{"OpenClosedSlotsMaxLength": 1})
+	fourRounds := runOpenClosedSlots(t, 2, 1, nRequests, map[string]interface{}{"OpenClosedSlotsMaxLength": 4})
+	if fourRounds >= oneRound {
+		t.Error("Reserving 4 rounds took", fourRounds, "schedules, and 1 round", oneRound)
+	}
+	if fourRounds > nRequests/4+1 {
+		t.Error("Reserving 4 rounds should take at most", nRequests/4+1, "schedules, took", fourRounds)
+	}
+}
+
+func TestPrifiFootprintSlots(t *testing.T) {
+	// more clients than positions, so they collide, and reserve again until all their requests went through
+	for _, window := range []int{1, 2} {
+		runOpenClosedSlots(t, 4, 4, 5, map[string]interface{}{
+			"OpenClosedSlotsScheduler": scheduler.SLOT_SCHEDULER_FOOTPRINT,
+			"OpenClosedSlotsPositions": 3,
+			"OpenClosedSlotsMaxLength": 2,
+			"WindowSize":               window,
+		})
+	}
+}
+
+// runDisruption runs PriFi with client 0 disrupting the slots of the others, and returns the first verdict of the
+// blame it triggers. The messages drop returns true for are lost, if it is not nil.
+func runDisruption(t *testing.T, nClients int, nTrustees int, params map[string]interface{}, drop func(msg interface{}) bool) (net.BlameTranscript, *TestRouter) {
+	payloadSize := 100
+
+	router := newTestRouter()
+	router.drop = drop
+	verdicts := make(chan net.BlameTranscript, 10)
+	router.relay = NewPriFiRelay(true, make(chan []byte), make(chan []byte, 1000), make(chan interface{}, 1), func(clients, trustees []int) {
+		t.Error("clients", clients, "and trustees", trustees, "timed out")
+	}, func(transcript net.BlameTranscript) {
+		verdicts <- transcript
+	}, router)
+
+	// the honest clients have data, so the disruptor has slots to disrupt
+	for i := 0; i < nClients; i++ {
+		dataForDCNet := make(chan []byte, 1000)
+		for k := 0; i > 0 && k < cap(dataForDCNet); k++ {
+			dataForDCNet <- []byte("client " + strconv.Itoa(i) + " message " + strconv.Itoa(k))
+		}
+		router.clients = append(router.clients, NewPriFiClient(false, false, dataForDCNet, nil, false, "./", false, router))
+	}
+	for j := 0; j < nTrustees; j++ {
+		router.trustees = append(router.trustees, NewPriFiTrustee(true, false, 0, router))
+	}
+	router.setIdentities()
+	go router.deliver()
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.Add("StartNow", true)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("NClients", nClients)
+	msg.Add("PayloadSize", payloadSize)
+	msg.Add("DownstreamCellSize", payloadSize)
+	msg.Add("WindowSize", 1)
+	msg.Add("ExperimentRoundLimit", -1)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("RelayRoundTimeOut", 10000)
+	msg.Add("RelayTrusteeCacheLowBound", 5)
+	msg.Add("RelayTrusteeCacheHighBound", 10)
+	msg.Add("DisruptionProtectionEnabled", true)
+	msg.Add("ForceDisruptionSinceRound3", true)
+	for k, v := range params {
+		msg.Add(k, v)
+	}
+	msg.ForceParams = true
+	router.SendToRelay(msg)
+
+	var transcript net.BlameTranscript
+	select {
+	case transcript = <-verdicts:
+	case <-time.After(testRouterTimeout):
+		t.Fatal("No verdict before the deadline")
+	}
+
+	router.relay.ReceivedMessage(net.ALL_ALL_SHUTDOWN{})
+	router.stop()
+	return transcript, router
+}
+
+func TestPrifiDisruptionBlame(t *testing.T) {
+	for _, c := range []struct{ nClients, nTrustees int }{{2, 1}, {2, 2}, {3, 2}} {
+		transcript, router := runDisruption(t, c.nClients, c.nTrustees, nil, nil)
+		verdict := transcript.Verdict
+
+		if verdict.GuiltyIsTrustee || verdict.GuiltyID != 0 {
+			t.Error("Client 0 disrupted, but the verdict is against", verdict.GuiltyID, "(trustee:", verdict.GuiltyIsTrustee, "):", verdict.Reason)
+		}
+		if err := verdict.Verify(router.identities.Relay); err != nil {
+			t.Error("The verdict should be signed by the relay,", err)
+		}
+
+		// the disruptor lies consistently in phase 1, so it takes the shared secrets to find it
+		if n := router.count("REL_ALL_DISRUPTION_REVEAL"); n < c.nClients+c.nTrustees {
+			t.Error("The reveal should have been sent to everyone, was sent", n, "times")
+		}
+		if router.count("CLI_REL_DISRUPTION_REVEAL") < c.nClients || router.count("TRU_REL_DISRUPTION_REVEAL") < c.nTrustees {
+			t.Error("Everyone should have revealed its bits")
+		}
+		if router.count("TRU_REL_SHARED_SECRET") == 0 && router.count("CLI_REL_SHARED_SECRET") == 0 {
+			t.Error("The verdict should come from a shared secret:", verdict.Reason)
+		}
+
+		// anyone can check the verdict from the transcript
+		if err := relay.VerifyBlameTranscript(&transcript, router.identities); err != nil {
+			t.Error("The transcript should support the verdict,", err)
+		}
+		if len(transcript.ClientReveals) != c.nClients || len(transcript.TrusteeReveals) != c.nTrustees {
+			t.Error("The transcript should have the bits of everyone")
+		}
+	}
+}
+
+func TestPrifiBlameTimeout(t *testing.T) {
+	// client 1 never reveals its bits
+	silent := func(msg interface{}) bool {
+		reveal, ok := msg.(net.CLI_REL_DISRUPTION_REVEAL)
+		return ok && reveal.ClientID == 1
+	}
+	transcript, router := runDisruption(t, 2, 2, map[string]interface{}{"RelayBlameTimeOut": 500}, silent)
+	verdict := transcript.Verdict
+
+	if verdict.GuiltyIsTrustee || verdict.GuiltyID != 1 {
+		t.Error("Client 1 kept silent, but the verdict is against", verdict.GuiltyID, "(trustee:", verdict.GuiltyIsTrustee, "):", verdict.Reason)
+	}
+	if err := relay.VerifyBlameTranscript(&transcript, router.identities); err != nil {
+		t.Error("The transcript should support the verdict,", err)
+	}
+	if clientReveals := len(transcript.ClientReveals); clientReveals != 1 {
+		t.Error("The transcript should have the bits of client 0 only, has", clientReveals, "reveals")
+	}
+}
+
+func TestPrifiBlameTranscript(t *testing.T) {
+	transcript, router := runDisruption(t, 2, 2, nil, nil)
+	identities := router.identities
+
+	// the transcript survives a round trip to a file
+	dir, err := ioutil.TempDir("", "blame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "blame.bin")
+	if err := transcript.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := net.LoadBlameTranscript(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := relay.VerifyBlameTranscript(loaded, identities); err != nil {
+		t.Error("The transcript read from the file should support the verdict,", err)
+	}
+
+	// a verdict that was changed is not signed anymore, nor is one signed by another key than the relay's
+	tampered := *loaded
+	tampered.Verdict.GuiltyID = 1
+	if relay.VerifyBlameTranscript(&tampered, identities) == nil {
+		t.Error("A changed verdict should not verify")
+	}
+	otherPub, otherPriv := crypto.NewKeyPair()
+	if err := tampered.Verdict.Sign(otherPriv); err != nil {
+		t.Fatal(err)
+	}
+	other := identities
+	other.Relay = otherPub
+	if relay.VerifyBlameTranscript(&tampered, identities) == nil || relay.VerifyBlameTranscript(loaded, other) == nil {
+		t.Error("A verdict should only verify with the key of the relay")
+	}
+
+	// a verdict signed against an honest client does not follow from the transcript (we play the relay)
+	priv := router.relayIdentityKey
+	if err := tampered.Verdict.Sign(priv); err != nil {
+		t.Fatal(err)
+	}
+	if err := tampered.Verdict.Verify(identities.Relay); err != nil {
+		t.Fatal(err)
+	}
+	if relay.VerifyBlameTranscript(&tampered, identities) == nil {
+		t.Error("A verdict against an honest client should not verify")
+	}
+	tampered.Verdict.GuiltyIsTrustee = true
+	tampered.Verdict.GuiltyID = 0
+	if err := tampered.Verdict.Sign(priv); err != nil {
+		t.Fatal(err)
+	}
+	if relay.VerifyBlameTranscript(&tampered, identities) == nil {
+		t.Error("A verdict against an honest trustee should not verify")
+	}
+
+	// without the shared secrets, nobody can be found guilty: the pair that disagrees may just be slow
+	tampered.ClientSecrets = nil
+	tampered.TrusteeSecrets = nil
+	tampered.Verdict = loaded.Verdict
+	if relay.VerifyBlameTranscript(&tampered, identities) == nil {
+		t.Error("A verdict against a silent client of the pair should not verify")
+	}
+
+	// the relay cannot make up the evidence, what the clients and trustees sent is signed
+	forged := *loaded
+	forged.ClientCiphers = append([][]byte{}, loaded.ClientCiphers...)
+	forged.ClientCiphers[0] = append([]byte{}, loaded.ClientCiphers[0]...)
+	forged.ClientCiphers[0][len(forged.ClientCiphers[0])-1] ^= 1
+	if relay.VerifyBlameTranscript(&forged, identities) == nil {
+		t.Error("A cipher not sent by the client should not be evidence")
+	}
+	forged = *loaded
+	forged.ClientReveals = append([]net.CLI_REL_DISRUPTION_REVEAL{}, loaded.ClientReveals...)
+	forged.ClientReveals[0].Bits = map[int]int{0: 1 - loaded.ClientReveals[0].Bits[0], 1: loaded.ClientReveals[0].Bits[1]}
+	if relay.VerifyBlameTranscript(&forged, identities) == nil {
+		t.Error("Bits not revealed by the client should not be evidence")
+	}
+	forged = *loaded
+	forged.ClientPublicKeys = append([]kyber.Point{}, loaded.ClientPublicKeys...)
+	forged.ClientPublicKeys[0] = otherPub
+	if relay.VerifyBlameTranscript(&forged, identities) == nil {
+		t.Error("A secret proven for other keys than the ones of the transcript should not be evidence")
+	}
+	forged = *loaded
+	forged.Session++
+	if relay.VerifyBlameTranscript(&forged, identities) == nil {
+		t.Error("The evidence of another session should not verify")
+	}
+}
+
+// runProtections runs PriFi with the given parameters, and checks that what the clients send reaches the relay
+// intact: their requests, or the packets of a .pkts file if replayPCAP is true
+func runProtections(t *testing.T, params map[string]interface{}, replayPCAP bool) {
+	nClients := 2
+	nTrustees := 2
+	payloadSize := 100
+	nRequests := 5
+	name := "ReplayPCAP=" + strconv.FormatBool(replayPCAP)
+	for k, v := range params {
+		name += " " + k + "=" + strconv.FormatBool(v.(bool))
+	}
+
+	// every packet is bigger than the cells, so it is sent in fragments; the last two are never replayed
+	pcapFolder, err := ioutil.TempDir("", "pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pcapFolder)
+	pcapFolder += "/"
+	for i := 0; i < nClients; i++ {
+		pkts := strings.Repeat("0:00:00.0,\t250,\t1\n", nRequests+2)
+		if err := ioutil.WriteFile(pcapFolder+"client"+strconv.Itoa(i)+".pkts", []byte(pkts), 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := newTestRouter()
+	dataFromDCNet := make(chan []byte, 1000)
+	router.relay = NewPriFiRelay(true, make(chan []byte, 1), dataFromDCNet, make(chan interface{}, 1), func(clients, trustees []int) {
+		t.Error(name, ": clients", clients, "and trustees", trustees, "timed out")
+	}, nil, router)
+	for i := 0; i < nClients; i++ {
+		dataForDCNet := make(chan []byte, nRequests)
+		for k := 0; !replayPCAP && k < nRequests; k++ {
+			dataForDCNet <- []byte("client " + strconv.Itoa(i) + " request " + strconv.Itoa(k))
+		}
+		router.clients = append(router.clients, NewPriFiClient(false, true, dataForDCNet, make(chan []byte, 1000), replayPCAP, pcapFolder, false, router))
+	}
+	for j := 0; j < nTrustees; j++ {
+		router.trustees = append(router.trustees, NewPriFiTrustee(true, false, 0, router))
+	}
+	router.setIdentities()
+	go router.deliver()
+
+	msg := new(net.ALL_ALL_PARAMETERS)
+	msg.Add("StartNow", true)
+	msg.Add("NTrustees", nTrustees)
+	msg.Add("NClients", nClients)
+	msg.Add("PayloadSize", payloadSize)
+	msg.Add("DownstreamCellSize", payloadSize)
+	msg.Add("WindowSize", 1)
+	msg.Add("ExperimentRoundLimit", -1)
+	msg.Add("DCNetType", "Simple")
+	msg.Add("RelayRoundTimeOut", 10000)
+	msg.Add("RelayTrusteeCacheLowBound", 5)
+	msg.Add("RelayTrusteeCacheHighBound", 10)
+	for k, v := range params {
+		msg.Add(k, v)
+	}
+	msg.ForceParams = true
+	router.SendToRelay(msg)
+
+	// every request, or the last fragment of every packet, arrives intact and in order
+	next := make([]int, nClients)
+	deadline := time.After(testRouterTimeout)
+	for next[0] < nRequests || next[1] < nRequests {
+		select {
+		case data := <-dataFromDCNet:
+			if replayPCAP {
+				// the meta-messages of the fragments follow each other, see utils.ParsePCAP
+				for pos := 0; pos+17 <= len(data) && binary.BigEndian.Uint16(data[pos:pos+2]) == 21845; pos += 17 {
+					i := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+					packetID := int(binary.BigEndian.Uint32(data[pos+4 : pos+8]))
+					if i >= nClients || packetID != next[i] && packetID != next[i]-1 {
+						t.Fatal(name, ": relay received packet", packetID, "of client", i, "after packet", next[i]-1)
+					}
+					if data[pos+16] == 1 {
+						next[i] = packetID + 1
+					}
+				}
+				continue
+			}
+			content := string(bytes.TrimRight(data, "\x00"))
+			if len(content) == 0 {
+				continue
+			}
+			i, _ := strconv.Atoi(strings.Fields(content)[1])
+			if i >= nClients || content != "client "+strconv.Itoa(i)+" request "+strconv.Itoa(next[i]) {
+				t.Fatal(name, ": relay received", content)
+			}
+			next[i]++
+		case <-deadline:
+			t.Fatal(name, ": only", next, "requests before the deadline")
+		}
+	}
+
+	go func() {
+		for range dataFromDCNet {
+		}
+	}()
+	router.relay.ReceivedMessage(net.ALL_ALL_SHUTDOWN{})
+	router.stop()
+}
+
+// every combination of the protections and the options that take room in the cells, see dcnet.CellLayout
+var cellOptions = []string{"DisruptionProtectionEnabled", "EquivocationProtectionEnabled", "UpstreamCompressionEnabled",
+	"DownstreamEncryptionEnabled"}
+
+func cellOptionsCombinations(options []string) []map[string]interface{} {
+	combinations := make([]map[string]interface{}, 0)
+	for c := 0; c < 1<<uint(len(options)); c++ {
+		params := make(map[string]interface{})
+		for k, option := range options {
+			params[option] = c&(1<<uint(k)) != 0
+		}
+		combinations = append(combinations, params)
+	}
+	return combinations
+}
+
+func TestPrifiProtectionsMatrix(t *testing.T) {
+	for _, params := range cellOptionsCombinations(cellOptions) {
+		for _, replayPCAP := range []bool{false, true} {
+			runProtections(t, params, replayPCAP)
+		}
+	}
+}
+
+func TestPrifiDisruptionBlameMatrix(t *testing.T) {
+	for _, params := range cellOptionsCombinations(cellOptions[1:]) {
+		transcript, router := runDisruption(t, 2, 2, params, nil)
+		if transcript.Verdict.GuiltyIsTrustee || transcript.Verdict.GuiltyID != 0 {
+			t.Error(params, ": client 0 disrupted, but the verdict is against", transcript.Verdict.GuiltyID,
+				"(trustee:", transcript.Verdict.GuiltyIsTrustee, "):", transcript.Verdict.Reason)
+		}
+		if err := relay.VerifyBlameTranscript(&transcript, router.identities); err != nil {
+			t.Error(params, ": the transcript should support the verdict,", err)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package relay
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/kyber/v3"
+)
+
+/*
+VerifyBlameTranscript checks the verdict of a blame against its transcript, as a third party would. identities are
+the keys of the server identities of the relay, the clients and the trustees, as known from the roster. It returns nil
+if the verdict is signed by the relay, every cipher, bit and secret of the transcript is signed by the entity that sent
+it, for the round and the bit blamed (see net/blame_evidence.go), and this evidence shows that the entity the verdict
+blames misbehaved, i.e., either
+  - it did not reveal its bits in phase 1 before the deadline;
+  - its bits revealed in phase 1 are invalid, their proof does not verify, or they do not XOR to the bit of its cipher;
+  - or, in phase 2, the proof of its shared secret does not verify, or the pad regenerated from a proven shared secret
+    has another bit than the one it revealed for that pad. If neither of the pair revealed its secret, there is no
+    verdict to check.
+
+The checks are the ones the relay did, on the data of the transcript only. The relay cannot forge what the entities
+signed; it can only leave out what an entity sent, and have it found silent.
+*/
+func VerifyBlameTranscript(t *net.BlameTranscript, identities net.Identities) error {
+	v := t.Verdict
+	if err := v.Verify(identities.Relay); err != nil {
+		return errors.New("the signature of the verdict does not verify: " + err.Error())
+	}
+	nClients := len(t.ClientPublicKeys)
+	nTrustees := len(t.TrusteePublicKeys)
+	if len(t.ClientCiphers) != nClients || len(t.TrusteeCiphers) != nTrustees ||
+		len(t.ClientCipherSignatures) != nClients || len(t.TrusteeCipherSignatures) != nTrustees {
+		return errors.New("the transcript does not have one signed cipher per client and per trustee")
+	}
+	if v.GuiltyIsTrustee && (v.GuiltyID < 0 || v.GuiltyID >= nTrustees) ||
+		!v.GuiltyIsTrustee && (v.GuiltyID < 0 || v.GuiltyID >= nClients) {
+		return errors.New("the verdict blames an unknown entity")
+	}
+	if err := verifyBlameEvidence(t, identities); err != nil {
+		return err
+	}
+
+	// phase 1: the bits revealed by the guilty entity, if it revealed any
+	context := net.BlameProofContext("DISRUPTION", t.Session, v.RoundID, v.BitPos, v.GuiltyIsTrustee, v.GuiltyID)
+	if v.GuiltyIsTrustee {
+		r := trusteeReveal(t, v.GuiltyID)
+		if r == nil || checkReveal(context, nClients, r.Bits, r.Pval, r.NIZK, t.TrusteeCiphers[v.GuiltyID], v.BitPos) != nil {
+			return nil
+		}
+	} else {
+		r := clientReveal(t, v.GuiltyID)
+		if r == nil || checkReveal(context, nTrustees, r.Bits, r.Pval, r.NIZK, t.ClientCiphers[v.GuiltyID], v.BitPos) != nil {
+			return nil
+		}
+	}
+
+	return verifyBlamedPair(t)
+}
+
+// verifyBlameEvidence checks that the ciphers, the bits and the secrets of the transcript are signed by the clients
+// and trustees that sent them, for the round and the bit blamed. The secrets must also be proven for the keys of the
+// transcript: an entity only proves its secret for the keys the relay gave it, so other keys would be the relay's doing.
+func verifyBlameEvidence(t *net.BlameTranscript, identities net.Identities) error {
+	v := t.Verdict
+	forBlame := func(roundID int32, bitPos int) error {
+		if roundID != v.RoundID || bitPos != v.BitPos {
+			return errors.New("it is for bit " + strconv.Itoa(bitPos) + " of round " + strconv.Itoa(int(roundID)) + ", not the one blamed")
+		}
+		return nil
+	}
+	for i := range t.ClientCiphers {
+		if err := net.VerifyCipher(identities.Of(false, i), t.Session, v.RoundID, false, i, t.ClientCiphers[i], t.ClientCipherSignatures[i]); err != nil {
+			return errors.New("the cipher of client " + strconv.Itoa(i) + " is not signed by it: " + err.Error())
+		}
+	}
+	for j := range t.TrusteeCiphers {
+		if err := net.VerifyCipher(identities.Of(true, j), t.Session, v.RoundID, true, j, t.TrusteeCiphers[j], t.TrusteeCipherSignatures[j]); err != nil {
+			return errors.New("the cipher of trustee " + strconv.Itoa(j) + " is not signed by it: " + err.Error())
+		}
+	}
+	for _, r := range t.ClientReveals {
+		err := forBlame(r.RoundID, r.BitPos)
+		if err == nil {
+			err = r.Verify(identities.Of(false, r.ClientID), t.Session)
+		}
+		if err != nil {
+			return errors.New("invalid bits of client " + strconv.Itoa(r.ClientID) + ": " + err.Error())
+		}
+	}
+	for _, r := range t.TrusteeReveals {
+		err := forBlame(r.RoundID, r.BitPos)
+		if err == nil {
+			err = r.Verify(identities.Of(true, r.TrusteeID), t.Session)
+		}
+		if err != nil {
+			return errors.New("invalid bits of trustee " + strconv.Itoa(r.TrusteeID) + ": " + err.Error())
+		}
+	}
+	for _, s := range t.ClientSecrets {
+		err := forBlame(s.RoundID, s.BitPos)
+		if err == nil {
+			err = s.Verify(identities.Of(false, s.ClientID), t.Session)
+		}
+		if err == nil {
+			err = checkSecretKeys(t, s.ClientID, s.TrusteeID, s.Pub["X[0]"], s.Pub["BT"])
+		}
+		if err != nil {
+			return errors.New("invalid secret of client " + strconv.Itoa(s.ClientID) + ": " + err.Error())
+		}
+	}
+	for _, s := range t.TrusteeSecrets {
+		err := forBlame(s.RoundID, s.BitPos)
+		if err == nil {
+			err = s.Verify(identities.Of(true, s.TrusteeID), t.Session)
+		}
+		if err == nil {
+			err = checkSecretKeys(t, s.ClientID, s.TrusteeID, s.Pub["BT"], s.Pub["X[0]"])
+		}
+		if err != nil {
+			return errors.New("invalid secret of trustee " + strconv.Itoa(s.TrusteeID) + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// checkSecretKeys returns an error unless the keys a secret was proven for are the ones of the transcript for the
+// client and the trustee
+func checkSecretKeys(t *net.BlameTranscript, clientID, trusteeID int, clientKey, trusteeKey kyber.Point) error {
+	if clientID < 0 || clientID >= len(t.ClientPublicKeys) || trusteeID < 0 || trusteeID >= len(t.TrusteePublicKeys) {
+		return errors.New("it is for an unknown pair")
+	}
+	if clientKey == nil || trusteeKey == nil || !clientKey.Equal(t.ClientPublicKeys[clientID]) || !trusteeKey.Equal(t.TrusteePublicKeys[trusteeID]) {
+		return errors.New("it is proven for other keys than the ones of the transcript")
+	}
+	return nil
+}
+
+// verifyBlamedPair checks a verdict of phase 2, see VerifyBlameTranscript
+func verifyBlamedPair(t *net.BlameTranscript) error {
+	v := t.Verdict
+	var clientID, trusteeID int
+	if len(t.ClientSecrets) > 0 {
+		clientID, trusteeID = t.ClientSecrets[0].ClientID, t.ClientSecrets[0].TrusteeID
+	} else if len(t.TrusteeSecrets) > 0 {
+		clientID, trusteeID = t.TrusteeSecrets[0].ClientID, t.TrusteeSecrets[0].TrusteeID
+	} else {
+		// the pair that disagrees was silent: we cannot tell which of them disrupted
+		return errors.New("the transcript shows no misbehavior in phase 1, and no shared secret revealed in phase 2")
+	}
+	if clientID < 0 || clientID >= len(t.ClientPublicKeys) || trusteeID < 0 || trusteeID >= len(t.TrusteePublicKeys) {
+		return errors.New("the shared secret revealed is for an unknown pair")
+	}
+	if v.GuiltyIsTrustee && v.GuiltyID != trusteeID || !v.GuiltyIsTrustee && v.GuiltyID != clientID {
+		return errors.New("the verdict blames an entity that is not part of the pair that revealed its shared secret")
+	}
+	clientKey := t.ClientPublicKeys[clientID]
+	trusteeKey := t.TrusteePublicKeys[trusteeID]
+
+	// the proofs of the secrets: an invalid one from the guilty entity is enough, else the first valid one is used
+	var secret kyber.Point
+	for _, s := range t.ClientSecrets {
+		if s.ClientID != clientID || s.TrusteeID != trusteeID {
+			continue
+		}
+		context := net.BlameProofContext("SHAREDKEY", t.Session, v.RoundID, v.BitPos, false, clientID)
+		if verifySecretProof(context, clientKey, trusteeKey, s.Secret, s.NIZK) != nil {
+			if !v.GuiltyIsTrustee {
+				return nil
+			}
+		} else if secret == nil {
+			secret = s.Secret
+		}
+	}
+	for _, s := range t.TrusteeSecrets {
+		if s.ClientID != clientID || s.TrusteeID != trusteeID {
+			continue
+		}
+		context := net.BlameProofContext("SHAREDKEY", t.Session, v.RoundID, v.BitPos, true, trusteeID)
+		if verifySecretProof(context, trusteeKey, clientKey, s.Secret, s.NIZK) != nil {
+			if v.GuiltyIsTrustee {
+				return nil
+			}
+		} else if secret == nil {
+			secret = s.Secret
+		}
+	}
+	if secret == nil {
+		return errors.New("the transcript has no valid shared secret for client " + strconv.Itoa(clientID) +
+			" and trustee " + strconv.Itoa(trusteeID))
+	}
+
+	// the bit of the pad, against the one the guilty entity revealed
+	val, err := padBit(t.DCNetPadGenerator, secret, v.RoundID, t.PayloadSize, v.BitPos)
+	if err != nil {
+		return err
+	}
+	var revealed map[int]int
+	peerID := trusteeID
+	if v.GuiltyIsTrustee {
+		if r := trusteeReveal(t, trusteeID); r != nil {
+			revealed = r.Bits
+		}
+		peerID = clientID
+	} else if r := clientReveal(t, clientID); r != nil {
+		revealed = r.Bits
+	}
+	bit, found := revealed[peerID]
+	if !found {
+		return errors.New("the transcript does not have the bit revealed by the guilty entity")
+	}
+	if bit == val {
+		return errors.New("the guilty entity revealed the bit of the pad, " + strconv.Itoa(val))
+	}
+	return nil
+}
+
+// clientReveal returns the bits revealed by client clientID, or nil
+func clientReveal(t *net.BlameTranscript, clientID int) *net.CLI_REL_DISRUPTION_REVEAL {
+	for i := range t.ClientReveals {
+		if t.ClientReveals[i].ClientID == clientID {
+			return &t.ClientReveals[i]
+		}
+	}
+	return nil
+}
+
+// trusteeReveal returns the bits revealed by trustee trusteeID, or nil
+func trusteeReveal(t *net.BlameTranscript, trusteeID int) *net.TRU_REL_DISRUPTION_REVEAL {
+	for i := range t.TrusteeReveals {
+		if t.TrusteeReveals[i].TrusteeID == trusteeID {
+			return &t.TrusteeReveals[i]
+		}
+	}
+	return nil
+}
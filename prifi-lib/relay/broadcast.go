@@ -0,0 +1,74 @@
+package relay
+
+/*
+Reliable UDP broadcast
+**********************
+With UseUDP, the downstream cells are broadcast in fragments of UDPFragmentSize bytes, plus UDPParityFragments
+Reed-Solomon parity fragments per cell. A client that could not rebuild a cell sends a CLI_REL_DOWNSTREAM_NACK; while the
+round is open, we broadcast the fragments it misses again, from the data already sent.
+*/
+
+import (
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// broadcastDownstreamCell broadcasts the fragments of a downstream cell by UDP. If indices is nil, all fragments are
+// sent, otherwise only those. Returns the number of bytes sent
+func (p *PriFiLibRelayInstance) broadcastDownstreamCell(msg *net.REL_CLI_DOWNSTREAM_DATA, indices []int) int {
+	cell, err := (&net.REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA: *msg}).ToBytes()
+	if err != nil {
+		log.Error("Relay : cannot encode the downstream cell of round", msg.RoundID, ", error is", err)
+		return 0
+	}
+	fragments, err := net.FragmentCell(msg.RoundID, cell, p.relayState.UDPFragmentSize, p.relayState.UDPParityFragments)
+	if err != nil {
+		log.Error("Relay : cannot fragment the downstream cell of round", msg.RoundID, ", error is", err)
+		return 0
+	}
+
+	if indices == nil {
+		indices = make([]int, len(fragments))
+		for i := range indices {
+			indices[i] = i
+		}
+	}
+	sent := 0
+	for _, i := range indices {
+		if i < 0 || i >= len(fragments) {
+			continue
+		}
+		p.messageSender.BroadcastToAllClientsWithLog(fragments[i], "(UDP broadcast, round "+strconv.Itoa(int(msg.RoundID))+
+			", fragment "+strconv.Itoa(i+1)+"/"+strconv.Itoa(len(fragments))+")")
+		sent += len(fragments[i].Data)
+	}
+	return sent
+}
+
+/*
+Received_CLI_REL_DOWNSTREAM_NACK handles CLI_REL_DOWNSTREAM_NACK messages.
+A client misses some fragments of a downstream cell; if the round is still open, we broadcast them again. Otherwise,
+the client will give up on that round.
+*/
+func (p *PriFiLibRelayInstance) Received_CLI_REL_DOWNSTREAM_NACK(msg net.CLI_REL_DOWNSTREAM_NACK) error {
+	if !p.relayState.UseUDP || !p.relayState.roundManager.IsRoundOpenend(msg.RoundID) {
+		log.Lvl3("Relay : client", msg.ClientID, "misses round", msg.RoundID, "which is not open, ignoring.")
+		return nil
+	}
+	toSend := p.relayState.roundManager.GetDataAlreadySent(msg.RoundID)
+	if toSend == nil {
+		return nil
+	}
+
+	var indices []int
+	if len(msg.Fragments) > 0 {
+		indices = msg.Fragments
+	}
+	log.Lvl2("Relay : client", msg.ClientID, "misses fragments", msg.Fragments, "of round", msg.RoundID, ", sending them again.")
+	sent := p.broadcastDownstreamCell(toSend, indices)
+	p.relayState.bitrateStatistics.AddDownstreamRetransmitCell(int64(sent))
+
+	return nil
+}
@@ -3,6 +3,7 @@ package relay
 import (
 	"errors"
 	"fmt"
+	"github.com/dedis/prifi/prifi-lib/dcnet"
 	"github.com/dedis/prifi/prifi-lib/net"
 	"go.dedis.ch/onet/v3/log"
 	"runtime/debug"
@@ -29,12 +30,20 @@ type BufferableRoundManager struct {
 	bufferedClientCiphers  map[int]map[int32][]byte
 	bufferedTrusteeCiphers map[int]map[int32][]byte
 
+	//in accumulator mode, the buffered ciphers above are nil (they only record who sent something), and the ciphers of
+	//the rounds not yet opened are XORed here on arrival
+	accumulate   bool
+	accumulators map[int32]*RoundAccumulator
+
 	//we remember the last round we close for OpenNextRound()
 	lastRoundClosed int32
 
 	//remember who was the last owner, next is this+1
 	lastOwner int
 
+	//the owner IDs are in [0, nSlots[; the slots of the shuffle by default, see SetNumberOfSlots
+	nSlots int
+
 	//initially equal to 1 (the first round where the relay has downstream data), then happens after schedule
 	nextOCSlotRound int32
 
@@ -47,6 +56,10 @@ type BufferableRoundManager struct {
 	//holds the schedule, i.e. which ownerslot will be skipped in the future. Keys are in [0, nclients[
 	storedOwnerSchedule map[int]bool
 
+	//with variable-length slots, how many consecutive rounds each slot reserved, and how many the last owner has left
+	storedSlotLengths      map[int]int
+	roundsLeftForLastOwner int
+
 	//stop/resume functions when we have too much/little ciphers
 	DoSendStopResumeMessages bool
 	LowBound                 int //restart sending at lowerbound
@@ -57,6 +70,13 @@ type BufferableRoundManager struct {
 	resumeSent               map[int]bool
 }
 
+// RoundAccumulator holds the XOR of the payloads received for a round, and their equivocation tags
+type RoundAccumulator struct {
+	Payload     []byte
+	ClientTags  [][]byte
+	TrusteeTags [][]byte
+}
+
 func sortedIntMapOfIntMapDump(m map[int]map[int32][]byte) {
 	nodes := make([]int, 0, len(m))
 	for i := range m {
@@ -93,7 +113,7 @@ func (b *BufferableRoundManager) MemoryUsage() {
 		clientSizeOfCipherBuffered += thisClientSize
 	}
 	for i := 0; i < b.nTrustees; i++ {
-		thisTrusteeCiphers := b.bufferedClientCiphers[i]
+		thisTrusteeCiphers := b.bufferedTrusteeCiphers[i]
 		trusteeNumberOfCipherBuffered += uint32(len(thisTrusteeCiphers))
 
 		thisTrusteeSize := uint64(0)
@@ -105,8 +125,19 @@ func (b *BufferableRoundManager) MemoryUsage() {
 		}
 		trusteeSizeOfCipherBuffered += thisTrusteeSize
 	}
+	accumulatorsSize := uint64(0)
+	for _, a := range b.accumulators {
+		accumulatorsSize += uint64(len(a.Payload))
+		for _, t := range a.ClientTags {
+			accumulatorsSize += uint64(len(t))
+		}
+		for _, t := range a.TrusteeTags {
+			accumulatorsSize += uint64(len(t))
+		}
+	}
 	log.Lvl1("[BufferableRoundManager] trustees:", trusteeNumberOfCipherBuffered, "=", trusteeSizeOfCipherBuffered,
-		"B (", strTrustees, "); clients:", clientNumberOfCipherBuffered, "=", clientSizeOfCipherBuffered, "B (", strClients, ")")
+		"B (", strTrustees, "); clients:", clientNumberOfCipherBuffered, "=", clientSizeOfCipherBuffered, "B (", strClients, ")",
+		"; accumulators:", len(b.accumulators), "=", accumulatorsSize, "B")
 	// (config:", b.nClients, "clients", b.nTrustees, "trustees, window =", b.maxNumberOfConcurrentRounds, "b.sendStopResumeMessage =",	b.DoSendStopResumeMessages, ", lowBound =", b.LowBound, ", highBound =", b.HighBound, ")")
 }
 
@@ -153,6 +184,7 @@ func NewBufferableRoundManager(nClients, nTrustees, maxNumberOfConcurrentRounds
 	b := new(BufferableRoundManager)
 
 	b.nClients = nClients
+	b.nSlots = nClients
 	b.nTrustees = nTrustees
 	b.maxNumberOfConcurrentRounds = maxNumberOfConcurrentRounds
 	b.lastRoundClosed = -1 // next is round 0
@@ -164,13 +196,35 @@ func NewBufferableRoundManager(nClients, nTrustees, maxNumberOfConcurrentRounds
 	b.dataAlreadySent = make(map[int32]*net.REL_CLI_DOWNSTREAM_DATA)
 	b.openRounds = make(map[int32]time.Time)
 	b.storedOwnerSchedule = nil
+	b.storedSlotLengths = nil
 
 	b.bufferedClientCiphers = make(map[int]map[int32][]byte)
 	b.bufferedTrusteeCiphers = make(map[int]map[int32][]byte)
+	b.accumulators = make(map[int32]*RoundAccumulator)
 
 	return b
 }
 
+// EnableAccumulation switches to accumulator mode: the ciphers are not kept, those of the rounds not yet opened are
+// XORed into a RoundAccumulator, fetched with TakeAccumulator() when the round opens. The ciphers of the open rounds
+// must be given to the DC-net by the caller. Must be called before any cipher is added
+func (b *BufferableRoundManager) EnableAccumulation() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.accumulate = true
+}
+
+// TakeAccumulator returns what was accumulated for the given round, or nil if nothing was, and forgets it
+func (b *BufferableRoundManager) TakeAccumulator(roundID int32) *RoundAccumulator {
+	b.Lock()
+	defer b.Unlock()
+
+	a := b.accumulators[roundID]
+	delete(b.accumulators, roundID)
+	return a
+}
+
 // CurrentRound returns the current round, ie the smallest open round, or returns (false, -1) if no rounds are open
 func (b *BufferableRoundManager) CurrentRound() int32 {
 	b.Lock()
@@ -242,7 +296,13 @@ func (b *BufferableRoundManager) UpdateAndGetNextOwnerID() int {
 
 func (b *BufferableRoundManager) updateAndGetNextOwnerID() int {
 
-	nextOwnerIDCandidate := (b.lastOwner + 1) % b.nClients
+	//the last owner reserved several consecutive rounds
+	if b.roundsLeftForLastOwner > 0 {
+		b.roundsLeftForLastOwner--
+		return b.lastOwner
+	}
+
+	nextOwnerIDCandidate := (b.lastOwner + 1) % b.nSlots
 
 	if b.storedOwnerSchedule == nil || len(b.storedOwnerSchedule) == 0 {
 
@@ -255,7 +315,7 @@ func (b *BufferableRoundManager) updateAndGetNextOwnerID() int {
 	// check if disabled in the schedule, iterate until find a non-closed slot (or go further than the schedule in time)
 	loopCount := 0
 	for found && !open {
-		nextOwnerIDCandidate = (nextOwnerIDCandidate + 1) % b.nClients
+		nextOwnerIDCandidate = (nextOwnerIDCandidate + 1) % b.nSlots
 		open, found = b.storedOwnerSchedule[nextOwnerIDCandidate]
 
 		if loopCount == len(b.storedOwnerSchedule) {
@@ -265,6 +325,9 @@ func (b *BufferableRoundManager) updateAndGetNextOwnerID() int {
 	}
 
 	b.lastOwner = nextOwnerIDCandidate
+	if length := b.storedSlotLengths[nextOwnerIDCandidate]; length > 1 {
+		b.roundsLeftForLastOwner = length - 1
+	}
 	return nextOwnerIDCandidate
 }
 
@@ -310,6 +373,7 @@ func (b *BufferableRoundManager) OpenNextRound() int32 {
 }
 
 // CloseRound finalizes this round, returning all ciphers stored, then increasing the round number. Should only be called when HasAllCiphersForCurrentRound() == true
+// In accumulator mode, the ciphers returned are nil
 func (b *BufferableRoundManager) CollectRoundData() ([][]byte, [][]byte, error) {
 	b.Lock()
 	defer b.Unlock()
@@ -349,6 +413,7 @@ func (b *BufferableRoundManager) closeRound() error {
 	//close current round
 	delete(b.dataAlreadySent, currentRoundID)
 	delete(b.openRounds, currentRoundID)
+	delete(b.accumulators, currentRoundID)
 
 	//discard the buffered ciphers
 	for i := 0; i < b.nClients; i++ {
@@ -460,13 +525,21 @@ func (b *BufferableRoundManager) NextDownstreamRoundForOpenClosedRequest() int32
 	return b.nextOCSlotRound
 }
 
+// SetNumberOfSlots sets the number of owner IDs, when they are not the slots of the shuffle (e.g., the positions of the
+// footprint scheduling)
+func (b *BufferableRoundManager) SetNumberOfSlots(nSlots int) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.nSlots = nSlots
+	b.lastOwner = -1
+}
+
 // SetStoredRoundSchedule stores the schedule, and resets the nextOwner to be 0
 func (b *BufferableRoundManager) SetStoredRoundSchedule(s map[int]bool) {
 	b.Lock()
 	defer b.Unlock()
 
-	b.storedOwnerSchedule = s
-
 	//next OCSlotRound is right at the end of this schedule. maxKey != nClients
 	numberOfOpenSlots := 0
 	for _, isSlotOpen := range s {
@@ -475,11 +548,35 @@ func (b *BufferableRoundManager) SetStoredRoundSchedule(s map[int]bool) {
 		}
 	}
 
+	b.setStoredSchedule(s, nil, numberOfOpenSlots)
+}
+
+// SetStoredRoundLayout stores a schedule of variable-length slots, where each slot owner gets as many consecutive
+// rounds as it reserved, and resets the nextOwner to be 0
+func (b *BufferableRoundManager) SetStoredRoundLayout(lengths map[int]int) {
+	b.Lock()
+	defer b.Unlock()
+
+	s := make(map[int]bool)
+	numberOfRounds := 0
+	for slot, length := range lengths {
+		s[slot] = length > 0
+		numberOfRounds += length
+	}
+
+	b.setStoredSchedule(s, lengths, numberOfRounds)
+}
+
+func (b *BufferableRoundManager) setStoredSchedule(s map[int]bool, lengths map[int]int, numberOfRounds int) {
+	b.storedOwnerSchedule = s
+	b.storedSlotLengths = lengths
+
 	b.lastOwner = -1 //this resets the owner schedule
+	b.roundsLeftForLastOwner = 0
 
 	_, currentRoundID := b.currentRound()
-	//there will be numberOfOpenSlots after this one for data, then, next one is OC slot
-	b.nextOCSlotRound = currentRoundID + int32(numberOfOpenSlots) + int32(b.maxNumberOfConcurrentRounds) + 1
+	//there will be numberOfRounds after this one for data, then, next one is OC slot
+	b.nextOCSlotRound = currentRoundID + int32(numberOfRounds) + int32(b.maxNumberOfConcurrentRounds) + 1
 }
 
 // SetDataAlreadySent sets the "DataAlreadySent" field for the given round
@@ -524,7 +621,13 @@ func (b *BufferableRoundManager) AddTrusteeCipher(roundID int32, trusteeID int,
 	if roundID < currendRound {
 		return errors.New("Can't accept a trustee cipher in the past")
 	}
-	b.addToBuffer(&b.bufferedTrusteeCiphers, roundID, trusteeID, data)
+	if b.accumulate {
+		if err := b.accumulateCipher(&b.bufferedTrusteeCiphers, roundID, trusteeID, data, true); err != nil {
+			return err
+		}
+	} else {
+		b.addToBuffer(&b.bufferedTrusteeCiphers, roundID, trusteeID, data)
+	}
 
 	if roundID == currendRound {
 		b.trusteeAckMap[trusteeID] = true
@@ -553,7 +656,13 @@ func (b *BufferableRoundManager) AddClientCipher(roundID int32, clientID int, da
 	if roundID < currendRound {
 		return errors.New("Can't accept a client cipher in the past")
 	}
-	b.addToBuffer(&b.bufferedClientCiphers, roundID, clientID, data)
+	if b.accumulate {
+		if err := b.accumulateCipher(&b.bufferedClientCiphers, roundID, clientID, data, false); err != nil {
+			return err
+		}
+	} else {
+		b.addToBuffer(&b.bufferedClientCiphers, roundID, clientID, data)
+	}
 
 	if roundID == currendRound {
 		b.clientAckMap[clientID] = true
@@ -562,6 +671,30 @@ func (b *BufferableRoundManager) AddClientCipher(roundID int32, clientID int, da
 	return nil
 }
 
+// BufferedCiphers returns the ciphers already received for the given round, indexed by client and trustee ID. In
+// accumulator mode, there are none; see TakeAccumulator()
+func (b *BufferableRoundManager) BufferedCiphers(roundID int32) (map[int][]byte, map[int][]byte) {
+	b.Lock()
+	defer b.Unlock()
+
+	clients := make(map[int][]byte)
+	trustees := make(map[int][]byte)
+	if b.accumulate {
+		return clients, trustees
+	}
+	for i := 0; i < b.nClients; i++ {
+		if data, exists := b.bufferedClientCiphers[i][roundID]; exists {
+			clients[i] = data
+		}
+	}
+	for i := 0; i < b.nTrustees; i++ {
+		if data, exists := b.bufferedTrusteeCiphers[i][roundID]; exists {
+			trustees[i] = data
+		}
+	}
+	return clients, trustees
+}
+
 // HasAllCiphersForCurrentRound returns true iff we received exactly one cipher for every client and trustee for this round
 func (b *BufferableRoundManager) HasAllCiphersForCurrentRound() bool {
 	b.Lock()
@@ -676,3 +809,40 @@ func (b *BufferableRoundManager) addToBuffer(bufferPtr *map[int]map[int32][]byte
 	}
 	buffer[entityID][roundID] = data
 }
+
+// accumulateCipher records that the entity sent its cipher for this round, and XORs it into the round's accumulator if
+// the round is not opened yet
+func (b *BufferableRoundManager) accumulateCipher(bufferPtr *map[int]map[int32][]byte, roundID int32, entityID int, data []byte, fromTrustee bool) error {
+	if _, exists := (*bufferPtr)[entityID][roundID]; exists {
+		return errors.New("Already received a cipher from " + strconv.Itoa(entityID) + " for round " + strconv.Itoa(int(roundID)))
+	}
+	if !b.isRoundOpen(roundID) {
+		cipher, err := dcnet.DCNetCipherFromBytes(data)
+		if err != nil {
+			return errors.New("Invalid cipher from " + strconv.Itoa(entityID) + " for round " + strconv.Itoa(int(roundID)) + ", " + err.Error())
+		}
+		a, found := b.accumulators[roundID]
+		if !found {
+			a = &RoundAccumulator{Payload: make([]byte, len(cipher.Payload))}
+			b.accumulators[roundID] = a
+		}
+		if len(cipher.Payload) != len(a.Payload) {
+			return errors.New("Can't accumulate a payload of " + strconv.Itoa(len(cipher.Payload)) + " bytes with " + strconv.Itoa(len(a.Payload)) + " bytes")
+		}
+		for i := range cipher.Payload {
+			a.Payload[i] ^= cipher.Payload[i]
+		}
+		if cipher.EquivocationProtectionTag != nil {
+			// copy, so that the cipher can be garbage-collected
+			tag := make([]byte, len(cipher.EquivocationProtectionTag))
+			copy(tag, cipher.EquivocationProtectionTag)
+			if fromTrustee {
+				a.TrusteeTags = append(a.TrusteeTags, tag)
+			} else {
+				a.ClientTags = append(a.ClientTags, tag)
+			}
+		}
+	}
+	b.addToBuffer(bufferPtr, roundID, entityID, nil)
+	return nil
+}
@@ -3,6 +3,7 @@ package relay
 import (
 	"bytes"
 	"crypto/rand"
+	"github.com/dedis/prifi/prifi-lib/dcnet"
 	"go.dedis.ch/onet/v3/log"
 	"testing"
 )
@@ -105,6 +106,47 @@ func TestOwnerSlots(test *testing.T) {
 	}
 }
 
+func TestOwnerIDWithVariableLengthSlots(test *testing.T) {
+
+	window := 2
+	nClients := 3
+	nTrustees := 1
+	b := NewBufferableRoundManager(nClients, nTrustees, window)
+	b.OpenNextRound() // round 0 carries the schedule
+
+	//client 0 reserves 2 rounds, client 1 none, client 2 three
+	layout := make(map[int]int)
+	layout[0] = 2
+	layout[1] = 0
+	layout[2] = 3
+	b.SetStoredRoundLayout(layout)
+
+	expected := []int{0, 0, 2, 2, 2, 0, 0, 2}
+	for i, owner := range expected {
+		if o := b.UpdateAndGetNextOwnerID(); o != owner {
+			test.Error("owner", i, "should be", owner, "is", o)
+		}
+	}
+
+	//the next OC slot comes after the 5 rounds reserved and the window
+	if b.NextDownstreamRoundForOpenClosedRequest() != int32(5+window+1) {
+		test.Error("the next OC slot round should be", 5+window+1, "is", b.NextDownstreamRoundForOpenClosedRequest())
+	}
+
+	//a plain schedule forgets the lengths
+	schedule := make(map[int]bool)
+	schedule[0] = true
+	schedule[1] = false
+	schedule[2] = true
+	b.SetStoredRoundSchedule(schedule)
+	expected = []int{0, 2, 0, 2}
+	for i, owner := range expected {
+		if o := b.UpdateAndGetNextOwnerID(); o != owner {
+			test.Error("owner", i, "should be", owner, "is", o)
+		}
+	}
+}
+
 func TestRoundSuccessionWithSchedule(test *testing.T) {
 
 	window := 10
@@ -437,6 +479,76 @@ func TestCipherBuffering(test *testing.T) {
 	}
 }
 
+func TestCipherAccumulation(test *testing.T) {
+
+	window := 1
+	nClients := 2
+	nTrustees := 1
+	b := NewBufferableRoundManager(nClients, nTrustees, window)
+	b.EnableAccumulation()
+	b.OpenNextRound()
+
+	cipher := func(tag byte) []byte {
+		return (&dcnet.DCNetCipher{EquivocationProtectionTag: []byte{tag}, Payload: genDataSlice()}).ToBytes()
+	}
+	client0, client1, trustee0 := cipher(1), cipher(2), cipher(3)
+
+	//round 0 is open, its ciphers are only acknowledged
+	b.AddClientCipher(0, 0, cipher(4))
+	if b.TakeAccumulator(0) != nil {
+		test.Error("BufferManager should not accumulate the ciphers of an open round")
+	}
+
+	//round 1 is not open yet, its ciphers are XORed on arrival
+	b.AddClientCipher(1, 0, client0)
+	b.AddClientCipher(1, 1, client1)
+	b.AddTrusteeCipher(1, 0, trustee0)
+	if err := b.AddClientCipher(1, 1, client1); err == nil {
+		test.Error("BufferManager should refuse a cipher received twice, it would cancel out")
+	}
+	if b.NumberOfBufferedCiphers(0) != 1 {
+		test.Error("Number of ciphers for trustee 0 should be 1")
+	}
+	clients, trustees := b.BufferedCiphers(1)
+	if len(clients) != 0 || len(trustees) != 0 {
+		test.Error("BufferManager should not keep the ciphers in accumulator mode")
+	}
+
+	b.AddClientCipher(0, 1, cipher(5))
+	b.AddTrusteeCipher(0, 0, cipher(6))
+	if err := b.CloseRound(); err != nil {
+		test.Error(err)
+	}
+	b.OpenNextRound()
+	if !b.HasAllCiphersForCurrentRound() {
+		test.Error("BufferManager should remember who sent ciphers for round 1")
+	}
+
+	a := b.TakeAccumulator(1)
+	if a == nil {
+		test.Fatal("BufferManager should have accumulated the ciphers of round 1")
+	}
+	expected := make([]byte, len(a.Payload))
+	for _, c := range [][]byte{client0, client1, trustee0} {
+		cipher, err := dcnet.DCNetCipherFromBytes(c)
+		if err != nil {
+			test.Fatal(err)
+		}
+		for i, v := range cipher.Payload {
+			expected[i] ^= v
+		}
+	}
+	if !bytes.Equal(a.Payload, expected) {
+		test.Error("BufferManager did not XOR the ciphers of round 1")
+	}
+	if len(a.ClientTags) != 2 || len(a.TrusteeTags) != 1 || a.TrusteeTags[0][0] != 3 {
+		test.Error("BufferManager did not keep the equivocation tags of round 1")
+	}
+	if b.TakeAccumulator(1) != nil {
+		test.Error("TakeAccumulator should forget the accumulator")
+	}
+}
+
 func TestRateLimiter(test *testing.T) {
 
 	window := 100
@@ -521,3 +633,25 @@ func TestRateLimiter(test *testing.T) {
 		test.Error("Resume should have been called")
 	}
 }
+
+func TestOwnerIDWithMoreSlotsThanClients(test *testing.T) {
+
+	b := NewBufferableRoundManager(2, 1, 1)
+	b.SetNumberOfSlots(4)
+
+	//without a schedule, the owners go through all the slots
+	for i, owner := range []int{0, 1, 2, 3, 0} {
+		if o := b.UpdateAndGetNextOwnerID(); o != owner {
+			test.Error("owner", i, "should be", owner, "is", o)
+		}
+	}
+
+	//only position 3 reserved
+	b.OpenNextRound()
+	b.SetStoredRoundLayout(map[int]int{0: 0, 1: 0, 2: 0, 3: 1})
+	for i := 0; i < 3; i++ {
+		if o := b.UpdateAndGetNextOwnerID(); o != 3 {
+			test.Error("owner", i, "should be 3, is", o)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package relay
+
+/*
+Upstream compression
+********************
+With UpstreamCompressionEnabled, the cell of the slot owner starts with a flag, and either carries one message raw, or
+a compressed batch of messages (see prifi-lib/compression). Each message is then handled as if it came in its own cell.
+*/
+
+import (
+	"github.com/dedis/prifi/prifi-lib/compression"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// decompressUpstream returns the messages of an upstream cell; none if the cell is invalid
+func (p *PriFiLibRelayInstance) decompressUpstream(cell []byte) [][]byte {
+	messages, err := compression.Unpack(cell)
+	if err != nil {
+		log.Error("Relay : could not decompress the upstream cell,", err)
+		return nil
+	}
+	if cell[0] == compression.FLAG_DEFLATE {
+		p.relayState.bitrateStatistics.AddCompressedUpstreamCell()
+	}
+	return messages
+}
@@ -0,0 +1,200 @@
+package relay
+
+/*
+Decoding pipeline
+*****************
+With a window > 1, several rounds are open at the same time, and their ciphers arrive interleaved. Instead of waiting
+for a round to be complete before decoding it, each open round has a goroutine that folds its ciphers into the DC-net
+as soon as they arrive; the rounds of the window are thus decoded in parallel. Only the finalization (DecodeCell) is
+ordered, by the relay's main loop.
+
+A round with an invalid cipher, e.g. one whose proof does not verify with the verifiable DC-net, is discarded, and its
+senders are reported to the relay, which evicts them (see reportDisruptors).
+*/
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/dcnet"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// a cipher waiting to be folded in the DC-net, or the ciphers accumulated before the round opened
+type roundCipher struct {
+	fromTrustee bool
+	entityID    int
+	data        []byte
+	accumulated *RoundAccumulator
+}
+
+// roundDecoding is the state of the decoding of one open round
+type roundDecoding struct {
+	roundID          int32
+	ownerSlot        int
+	ciphers          chan roundCipher
+	done             chan bool
+	receivedClients  map[int]bool
+	receivedTrustees map[int]bool
+	disruption       disruptionError // only written by the folding goroutine, read once it is done
+}
+
+// disruptionError is returned by finish if some ciphers of the round were invalid
+type disruptionError struct {
+	roundID     int32
+	clients     []int
+	trustees    []int
+	accumulated bool // the ciphers accumulated before the round opened were invalid; we do not know whose they were
+}
+
+func (e *disruptionError) Error() string {
+	s := "round " + strconv.Itoa(int(e.roundID)) + " was disrupted by"
+	for _, id := range e.clients {
+		s += " client-" + strconv.Itoa(id)
+	}
+	for _, id := range e.trustees {
+		s += " trustee-" + strconv.Itoa(id)
+	}
+	if e.accumulated {
+		s += " the ciphers received before the round opened"
+	}
+	return s
+}
+
+// decodingPipeline folds the ciphers of the open rounds in the DC-net. It is not thread-safe: like the rest of the
+// relay's state, it is used under processingLock
+type decodingPipeline struct {
+	dcNet     *dcnet.DCNetEntity
+	queueSize int
+	rounds    map[int32]*roundDecoding
+}
+
+func newDecodingPipeline(dcNet *dcnet.DCNetEntity, nClients, nTrustees int) *decodingPipeline {
+	return &decodingPipeline{
+		dcNet:     dcNet,
+		queueSize: nClients + nTrustees + 1, // one cipher per entity, plus what was accumulated
+		rounds:    make(map[int32]*roundDecoding),
+	}
+}
+
+// start starts decoding a round that was just opened, with the ciphers already received for it, or what the round
+// manager accumulated from them. ownerSlot is needed to verify the ciphers of the verifiable DC-net
+func (d *decodingPipeline) start(roundID int32, ownerSlot int, clientCiphers, trusteeCiphers map[int][]byte, accumulated *RoundAccumulator) {
+	if _, found := d.rounds[roundID]; found {
+		return
+	}
+
+	d.dcNet.DecodeStart(roundID)
+	r := &roundDecoding{
+		roundID:          roundID,
+		ownerSlot:        ownerSlot,
+		disruption:       disruptionError{roundID: roundID},
+		ciphers:          make(chan roundCipher, d.queueSize),
+		done:             make(chan bool),
+		receivedClients:  make(map[int]bool),
+		receivedTrustees: make(map[int]bool),
+	}
+	d.rounds[roundID] = r
+	go d.fold(r)
+
+	if accumulated != nil {
+		r.ciphers <- roundCipher{accumulated: accumulated}
+	}
+	for clientID, data := range clientCiphers {
+		d.addClientCipher(roundID, clientID, data)
+	}
+	for trusteeID, data := range trusteeCiphers {
+		d.addTrusteeCipher(roundID, trusteeID, data)
+	}
+}
+
+// fold is the goroutine decoding one round, until its ciphers channel is closed
+func (d *decodingPipeline) fold(r *roundDecoding) {
+	for c := range r.ciphers {
+		if c.accumulated != nil {
+			if err := d.dcNet.DecodeAccumulated(r.roundID, c.accumulated.Payload, c.accumulated.ClientTags, c.accumulated.TrusteeTags); err != nil {
+				log.Error("Relay: the ciphers received before round", r.roundID, "opened are invalid:", err)
+				r.disruption.accumulated = true
+			}
+			continue
+		}
+		var err error
+		if d.dcNet.IsVerifiable() {
+			if c.fromTrustee {
+				err = d.dcNet.VerifyTrusteeCipher(r.roundID, c.entityID, c.data)
+			} else {
+				err = d.dcNet.VerifyClientCipher(r.roundID, c.entityID, r.ownerSlot, c.data)
+			}
+		}
+		if err == nil {
+			if c.fromTrustee {
+				err = d.dcNet.DecodeTrustee(r.roundID, c.data)
+			} else {
+				err = d.dcNet.DecodeClient(r.roundID, c.data)
+			}
+		}
+		if err != nil {
+			entity := "client"
+			if c.fromTrustee {
+				entity = "trustee"
+				r.disruption.trustees = append(r.disruption.trustees, c.entityID)
+			} else {
+				r.disruption.clients = append(r.disruption.clients, c.entityID)
+			}
+			log.Error("Relay:", entity, c.entityID, "sent an invalid cipher for round", r.roundID, ":", err)
+		}
+	}
+	close(r.done)
+}
+
+// addClientCipher folds the cipher of a client, if its round is being decoded. Otherwise, it will be given to
+// start() when the round opens
+func (d *decodingPipeline) addClientCipher(roundID int32, clientID int, data []byte) {
+	r, found := d.rounds[roundID]
+	if !found || r.receivedClients[clientID] {
+		return
+	}
+	r.receivedClients[clientID] = true
+	r.ciphers <- roundCipher{fromTrustee: false, entityID: clientID, data: data}
+}
+
+// addTrusteeCipher folds the cipher of a trustee, if its round is being decoded. Otherwise, it will be given to
+// start() when the round opens
+func (d *decodingPipeline) addTrusteeCipher(roundID int32, trusteeID int, data []byte) {
+	r, found := d.rounds[roundID]
+	if !found || r.receivedTrustees[trusteeID] {
+		return
+	}
+	r.receivedTrustees[trusteeID] = true
+	r.ciphers <- roundCipher{fromTrustee: true, entityID: trusteeID, data: data}
+}
+
+// finish waits until all ciphers of the round are folded; the round can then be decoded with DecodeCell. If some
+// ciphers were invalid, the round is discarded, and it returns a *disruptionError naming their senders
+func (d *decodingPipeline) finish(roundID int32) error {
+	r, found := d.rounds[roundID]
+	if !found {
+		return errors.New("round " + strconv.Itoa(int(roundID)) + " is not being decoded")
+	}
+	delete(d.rounds, roundID)
+	close(r.ciphers)
+	<-r.done
+
+	if len(r.disruption.clients) > 0 || len(r.disruption.trustees) > 0 || r.disruption.accumulated {
+		d.dcNet.DecodeDiscard(roundID)
+		return &r.disruption
+	}
+	return nil
+}
+
+// discard abandons the decoding of a round, e.g. if it timed out
+func (d *decodingPipeline) discard(roundID int32) {
+	r, found := d.rounds[roundID]
+	if !found {
+		return
+	}
+	delete(d.rounds, roundID)
+	close(r.ciphers)
+	<-r.done
+	d.dcNet.DecodeDiscard(roundID)
+}
@@ -0,0 +1,25 @@
+package relay
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/dcnet"
+)
+
+func TestDecodingMalformedCiphers(t *testing.T) {
+	payloadSize := 100
+	dcNet := dcnet.NewDCNetEntity(0, dcnet.DCNET_RELAY, payloadSize, false, dcnet.PAD_GENERATOR_XOF, nil)
+	d := newDecodingPipeline(dcNet, 2, 1)
+
+	// a cipher too short to be parsed, or longer than the round, makes its sender a disruptor instead of crashing
+	d.start(0, 0, nil, nil, nil)
+	d.addClientCipher(0, 0, []byte{1, 2, 3})
+	d.addClientCipher(0, 1, (&dcnet.DCNetCipher{Payload: make([]byte, payloadSize+1)}).ToBytes())
+	d.addTrusteeCipher(0, 0, (&dcnet.DCNetCipher{Payload: make([]byte, payloadSize)}).ToBytes())
+	err := d.finish(0)
+	if err == nil || !strings.Contains(err.Error(), "client-0") || !strings.Contains(err.Error(), "client-1") ||
+		strings.Contains(err.Error(), "trustee-0") {
+		t.Error("the clients should be reported as disruptors, and only them, got", err)
+	}
+}
@@ -2,189 +2,383 @@ package relay
 
 import (
 	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/dcnet"
 	"github.com/dedis/prifi/prifi-lib/net"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/onet/v3/log"
 
-	"fmt"
+	"errors"
 	"go.dedis.ch/kyber/v3/proof"
 	"strconv"
+	"time"
 )
 
-// Received_CLI_REL_BLAME
-func (p *PriFiLibRelayInstance) Received_CLI_REL_DISRUPTION_BLAME(msg net.CLI_REL_DISRUPTION_BLAME) error {
-	pred := proof.Rep("X", "x", "B")
-	suite := config.CryptoSuite
-	//B := suite.Point().Base()
-	/*for _, key := range(p.relayState.EphemeralPublicKeys) {
-		pval := map[string]kyber.Point{"B": B, "X": key}
-		verifier := pred.Verifier(suite, pval)
-		err := proof.HashVerify(suite, "DISRUPTION", verifier, msg.NIZK)
-		if err != nil {
-			log.Lvl1("Proof failed to verify: ", key)
-			continue
+/*
+Blame protocol
+**************
+When the slot owner sees that its message was disrupted, it sends "BLAME", the round and the position of a bit that was
+flipped from 0 to 1 in the DC-net payload of its slot (see dcnet.CellLayout and upstreamPhase2b_extractPayload). Then:
+ - Phase 1: every client and trustee reveals the bit of the pad it shares with each peer at that position, with a
+   proof. Whoever's bits do not XOR to the bit of the cipher it sent is the disruptor. Otherwise, a client and a trustee
+   disagree on the bit of the pad they share.
+ - Phase 2: that client and that trustee reveal their shared secret, with a proof it is the Diffie-Hellman secret of
+   their keys. Each of them only does so once per blame, if we show it the bits the other signed, which disagree with
+   its own: we cannot collect the secrets of honest pairs. The relay regenerates the pad: whoever revealed the wrong
+   bit is the disruptor.
+An entity whose proof does not verify is found guilty as well, and so is one that does not reveal its bits in phase 1
+before BlameTimeOut. In phase 2, if neither of the pair reveals its secret before BlameTimeOut, the blame ends without
+a verdict: we cannot tell which of them is the disruptor, and would otherwise evict whichever we picked for being slow.
+The verdict is signed with the key of the relay's server identity, and given to the blameHandler, which can then evict
+the disruptor. It comes with a transcript of the blame, from which anyone can check the verdict again, see
+VerifyBlameTranscript.
+*/
+
+// signedCipher is a cipher kept for the blames, with the signature of its sender, see net.SignCipher
+type signedCipher struct {
+	Data      []byte
+	Signature []byte
+}
+
+// verifyCipherSignature checks that a client or trustee signed its cipher for a round with the key of its server
+// identity; we only keep signed ciphers, so that a blame never rests on our word
+func (p *PriFiLibRelayInstance) verifyCipherSignature(isTrustee bool, entityID int, roundID int32, cipher []byte, signature []byte) error {
+	key := p.relayState.identities.Of(isTrustee, entityID)
+	if err := net.VerifyCipher(key, p.relayState.session, roundID, isTrustee, entityID, cipher, signature); err != nil {
+		entity := "client"
+		if isTrustee {
+			entity = "trustee"
+		}
+		return errors.New("Relay : refusing the cipher of " + entity + " " + strconv.Itoa(entityID) + " for round " +
+			strconv.Itoa(int(roundID)) + ", invalid signature: " + err.Error())
+	}
+	return nil
+}
+
+// startBlame starts the blame phase 1 for the bit bitPos of round roundID, unless a blame is already in progress. It
+// returns an error if the relay no longer has the ciphers of that round.
+func (p *PriFiLibRelayInstance) startBlame(roundID int32, bitPos int) error {
+	if p.relayState.blamingData.InProgress {
+		log.Lvl2("Disruption: a blame is already in progress, ignoring the blame of round", roundID)
+		return nil
+	}
+	// the position is in the DC-net payload, see dcnet.CellLayout
+	if bitPos < 0 || bitPos >= 8*p.relayState.DCNet.PayloadSizeOfRound(roundID) {
+		return errors.New("Disruption: cannot blame bit " + strconv.Itoa(bitPos) + " of round " + strconv.Itoa(int(roundID)))
+	}
+	for i := 0; i < p.relayState.nClients; i++ {
+		if _, found := p.relayState.CiphertextsHistoryClients[int32(i)][roundID]; !found {
+			return errors.New("Disruption: no cipher of client " + strconv.Itoa(i) + " for round " + strconv.Itoa(int(roundID)))
+		}
+	}
+	for j := 0; j < p.relayState.nTrustees; j++ {
+		if _, found := p.relayState.CiphertextsHistoryTrustees[int32(j)][roundID]; !found {
+			return errors.New("Disruption: no cipher of trustee " + strconv.Itoa(j) + " for round " + strconv.Itoa(int(roundID)))
 		}
-		log.Lvl1("Proof verified.", key)
-	}*/
-	verifier := pred.Verifier(suite, msg.Pval)
-	err := proof.HashVerify(suite, "DISRUPTION", verifier, msg.NIZK)
-	if err != nil {
-		log.Fatal("Proof failed to verify: ")
 	}
-	log.Lvl1("Proof verified.")
 
-	// TODO: p.stateMachine.ChangeState("BLAMING")
+	log.Error("Disruption: Going into Blame phase 1. Round:", roundID, ", bit position:", bitPos)
 
+	p.relayState.blamingData = BlamingData{
+		ID:         p.relayState.blamingData.ID + 1,
+		InProgress: true,
+		RoundID:    roundID,
+		BitPos:     bitPos,
+		Transcript: p.newBlameTranscript(roundID),
+	}
+	p.relayState.clientBitMap = make(map[int]map[int]int)
+	p.relayState.trusteeBitMap = make(map[int]map[int]int)
+
+	// Broadcast Blame phase 1
 	toSend := &net.REL_ALL_DISRUPTION_REVEAL{
-		RoundID: msg.RoundID,
-		BitPos:  msg.BitPos,
-		Pval:    msg.Pval,
-		NIZK:    msg.NIZK,
+		RoundID: roundID,
+		BitPos:  bitPos,
+	}
+	for i := 0; i < p.relayState.nClients; i++ {
+		p.messageSender.SendToClientWithLog(i, toSend, "Reveal message sent to client "+strconv.Itoa(i))
+	}
+	for j := 0; j < p.relayState.nTrustees; j++ {
+		p.messageSender.SendToTrusteeWithLog(j, toSend, "Reveal message sent to trustee "+strconv.Itoa(j))
+	}
+
+	go p.checkIfBlameHasEndedAfterTimeOut(p.relayState.blamingData.ID)
+	return nil
+}
+
+// checkIfBlameHasEndedAfterTimeOut ends the blame blameID if it has no verdict after BlameTimeOut: in phase 1, the
+// first entity that did not answer is found guilty, so a disruptor cannot stall the blame by keeping silent. In phase
+// 2, the blame ends without a verdict
+func (p *PriFiLibRelayInstance) checkIfBlameHasEndedAfterTimeOut(blameID int) {
+
+	time.Sleep(time.Duration(p.relayState.BlameTimeOut) * time.Millisecond)
+
+	// never treat the timeout while receiving a message
+	p.relayState.processingLock.Lock()
+	defer p.relayState.processingLock.Unlock()
+
+	b := p.relayState.blamingData
+	if !b.InProgress || b.ID != blameID || p.stateMachine.State() == "SHUTDOWN" {
+		return
 	}
-	p.relayState.blamingData.RoundID = msg.RoundID
-	p.relayState.blamingData.BitPos = msg.BitPos
 
-	// broadcast to all trustees
+	if b.SecretsRequested {
+		// a secret from either of the pair, valid or not, would have given a verdict; both being silent does not tell
+		// which one disrupted, so we blame neither
+		p.relayState.blamingData.InProgress = false
+		log.Error("Disruption Phase 2: neither client", b.ClientID, "nor trustee", b.TrusteeID,
+			"revealed their shared secret before the deadline, the blame of round", b.RoundID, "ends without a verdict")
+		return
+	}
+	for i := 0; i < p.relayState.nClients; i++ {
+		if _, found := p.relayState.clientBitMap[i]; !found {
+			p.issueVerdict(false, i, "Disruption Phase 1: did not reveal its bits before the deadline")
+			return
+		}
+	}
 	for j := 0; j < p.relayState.nTrustees; j++ {
-		// send to the j-th trustee
-		p.messageSender.SendToTrusteeWithLog(j, toSend, "Reveal message sent to trustee "+strconv.Itoa(j+1))
+		if _, found := p.relayState.trusteeBitMap[j]; !found {
+			p.issueVerdict(true, j, "Disruption Phase 1: did not reveal its bits before the deadline")
+			return
+		}
 	}
+}
 
-	// broadcast to all clients
+// newBlameTranscript starts the transcript of a blame of round roundID with what the relay knows of that round
+func (p *PriFiLibRelayInstance) newBlameTranscript(roundID int32) net.BlameTranscript {
+	t := net.BlameTranscript{
+		Session:                 p.relayState.session,
+		Identities:              p.relayState.identities,
+		DCNetPadGenerator:       p.relayState.dcNetPadGenerator,
+		PayloadSize:             p.relayState.DCNet.PayloadSizeOfRound(roundID),
+		ClientPublicKeys:        make([]kyber.Point, p.relayState.nClients),
+		TrusteePublicKeys:       make([]kyber.Point, p.relayState.nTrustees),
+		ClientCiphers:           make([][]byte, p.relayState.nClients),
+		TrusteeCiphers:          make([][]byte, p.relayState.nTrustees),
+		ClientCipherSignatures:  make([][]byte, p.relayState.nClients),
+		TrusteeCipherSignatures: make([][]byte, p.relayState.nTrustees),
+	}
 	for i := 0; i < p.relayState.nClients; i++ {
-		// send to the i-th client
-		p.messageSender.SendToClientWithLog(i, toSend, "Reveal message sent to client "+strconv.Itoa(i+1))
+		c := p.relayState.CiphertextsHistoryClients[int32(i)][roundID]
+		t.ClientPublicKeys[i] = p.relayState.clients[i].PublicKey
+		t.ClientCiphers[i] = c.Data
+		t.ClientCipherSignatures[i] = c.Signature
+	}
+	for j := 0; j < p.relayState.nTrustees; j++ {
+		c := p.relayState.CiphertextsHistoryTrustees[int32(j)][roundID]
+		t.TrusteePublicKeys[j] = p.relayState.trustees[j].DCNetPublicKey
+		t.TrusteeCiphers[j] = c.Data
+		t.TrusteeCipherSignatures[j] = c.Signature
+	}
+	return t
+}
+
+// Received_CLI_REL_DISRUPTION_BLAME handles a blame sent outside of the DC-net. The client proves it owns one of the
+// ephemeral keys of the shuffle.
+func (p *PriFiLibRelayInstance) Received_CLI_REL_DISRUPTION_BLAME(msg net.CLI_REL_DISRUPTION_BLAME) error {
+	suite := config.CryptoSuite
+	if msg.Pval == nil || msg.Pval["X"] == nil {
+		return errors.New("Disruption: blame of round " + strconv.Itoa(int(msg.RoundID)) + " has no key")
+	}
+	known := false
+	for _, key := range p.relayState.EphemeralPublicKeys {
+		if key.Equal(msg.Pval["X"]) {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return errors.New("Disruption: blame of round " + strconv.Itoa(int(msg.RoundID)) + " is not from an ephemeral key of the shuffle")
+	}
+
+	// the proof is bound to this blame, so that it cannot be replayed to start another one
+	context := net.BlameProofContext("BLAME", p.relayState.session, msg.RoundID, msg.BitPos, false, -1)
+	pval := map[string]kyber.Point{"B": suite.Point().Base(), "X": msg.Pval["X"]}
+	verifier := proof.Rep("X", "x", "B").Verifier(suite, pval)
+	if err := proof.HashVerify(suite, context, verifier, msg.NIZK); err != nil {
+		return errors.New("Disruption: the proof of the blame of round " + strconv.Itoa(int(msg.RoundID)) + " failed to verify: " + err.Error())
+	}
+	log.Lvl1("Proof verified.")
+
+	return p.startBlame(msg.RoundID, msg.BitPos)
+}
+
+// verifyRevealProof checks the proof sent with bits revealed for nPeers pads, bound to context (see
+// net.BlameProofContext). Only "B" is taken from the relay, the other points from the entity.
+func verifyRevealProof(context string, nPeers int, pval map[string]kyber.Point, NIZK []byte) error {
+	suite := config.CryptoSuite
+	pub := map[string]kyber.Point{"B": suite.Point().Base()}
+	preds := make([]proof.Predicate, nPeers)
+	for i := 0; i < nPeers; i++ {
+		i_string := strconv.Itoa(i)
+		if pval["T"+i_string] == nil {
+			return errors.New("missing the commitment to pad " + i_string)
+		}
+		pub["T"+i_string] = pval["T"+i_string]
+		preds[i] = proof.Rep("T"+i_string, "t"+i_string, "B")
+	}
+	verifier := proof.And(preds...).Verifier(suite, pub)
+	return proof.HashVerify(suite, context, verifier, NIZK)
+}
+
+// checkRevealedBits returns an error unless bits has one bit (0 or 1) per peer
+func checkRevealedBits(nPeers int, bits map[int]int) error {
+	if len(bits) != nPeers {
+		return errors.New("revealed " + strconv.Itoa(len(bits)) + " bits instead of " + strconv.Itoa(nPeers))
+	}
+	for peer, bit := range bits {
+		if peer < 0 || peer >= nPeers || (bit != 0 && bit != 1) {
+			return errors.New("revealed an invalid bit " + strconv.Itoa(bit) + " for peer " + strconv.Itoa(peer))
+		}
 	}
+	return nil
+}
 
-	//Bool var to let the round finish then stop, switch to state blaming, and reveal ?
+// checkReveal returns an error, the reason of the verdict, unless bits are valid bits for nPeers pads with a valid
+// proof bound to context, and XOR to the bit at bitPos of the cipher the entity sent
+func checkReveal(context string, nPeers int, bits map[int]int, pval map[string]kyber.Point, NIZK []byte, cipher []byte, bitPos int) error {
+	if err := checkRevealedBits(nPeers, bits); err != nil {
+		return err
+	}
+	if err := verifyRevealProof(context, nPeers, pval, NIZK); err != nil {
+		return errors.New("invalid proof of the bits revealed, " + err.Error())
+	}
+	log.Lvl3("Proof verified.")
 
+	log.Lvl2("Disruption: comparing", bits, "with", cipher)
+	sent, err := cipherBit(cipher, bitPos)
+	if err != nil {
+		return err
+	}
+	result := 0
+	for _, bit := range bits {
+		result ^= bit
+	}
+	if result != sent {
+		return errors.New("the bits revealed do not match the cipher sent")
+	}
 	return nil
 }
 
 /*
 * Received_CLI_REL_DISRUPTION_REVEAL handles CLI_REL_DISRUPTION_REVEAL messages
-* First, saves the bits reveal by the client.
+* First, checks the proof and saves the bits reveal by the client.
 * It checks that the bits received by the client matches with the ones of the disruptive round.
 * For this it XORs the bits revealed together and compares it to the bit in the disruptive position.
 * If there is a mismatch, the client is the disruptor.
 * Else checks if all the reveals are received to move to next blame phase.
  */
 func (p *PriFiLibRelayInstance) Received_CLI_REL_DISRUPTION_REVEAL(msg net.CLI_REL_DISRUPTION_REVEAL) error {
-
-	log.Lvl1("Disruption Phase 1: Received bits from Client", msg.ClientID, "value", msg.Bits)
-	var pred_array []proof.Predicate
-	suite := config.CryptoSuite
-	for i := 1; i < p.relayState.nTrustees; i++ {
-		i_string := strconv.Itoa(i)
-		pred_array = append(pred_array, proof.Rep("T"+i_string, "t"+i_string, "B"))
+	if !p.relayState.blamingData.InProgress || p.relayState.blamingData.SecretsRequested {
+		log.Lvl2("Disruption: ignoring the bits of client", msg.ClientID, ", not in blame phase 1")
+		return nil
 	}
-	pred := proof.And(pred_array...)
-	verifier := pred.Verifier(suite, msg.Pval)
-	err := proof.HashVerify(suite, "DISRUPTION", verifier, msg.NIZK)
-	if err != nil {
-		log.Fatal("Proof failed to verify: ")
+	if msg.ClientID < 0 || msg.ClientID >= p.relayState.nClients {
+		return errors.New("Disruption: bits revealed by unknown client " + strconv.Itoa(msg.ClientID))
 	}
-	log.Lvl3("Proof verified.")
-
-	p.relayState.clientBitMap[msg.ClientID] = msg.Bits
+	log.Lvl1("Disruption Phase 1: Received bits from Client", msg.ClientID, "value", msg.Bits)
 
-	result := p.compareBits(msg.ClientID, msg.Bits, p.relayState.CiphertextsHistoryClients)
-	if !result {
-		log.Fatal("Disruption Phase 1: Disruptor is Client", msg.ClientID, ".")
-	} else if (len(p.relayState.clientBitMap) == p.relayState.nClients) && (len(p.relayState.trusteeBitMap) == p.relayState.nTrustees) {
-		log.Lvl1("Disruption Phase 1: Trustee", msg.ClientID, ", is consistent with itself, checking mismatches with all trustees...")
-		mismatch := p.checkMismatchingPairs()
-		if mismatch {
-			toClient := &net.REL_ALL_REVEAL_SHARED_SECRETS{
-				EntityID: p.relayState.blamingData.TrusteeID,
-			}
-			toTrustee := &net.REL_ALL_REVEAL_SHARED_SECRETS{
-				EntityID: p.relayState.blamingData.ClientID,
-			}
-			p.messageSender.SendToTrusteeWithLog(p.relayState.blamingData.ClientID, toTrustee, "")
-			p.messageSender.SendToClientWithLog(p.relayState.blamingData.TrusteeID, toClient, "")
-		} else {
-			log.Fatal("Disruption Phase 2: No mismatching pairs ? this should never occur.")
-		}
+	// without a valid signature, the bits are no evidence: the client stays silent, see checkIfBlameHasEndedAfterTimeOut
+	b := &p.relayState.blamingData
+	if err := p.checkBlameEvidence(msg.RoundID, msg.BitPos, msg.Verify(p.relayState.identities.Of(false, msg.ClientID), p.relayState.session)); err != nil {
+		return errors.New("Disruption: ignoring the bits of client " + strconv.Itoa(msg.ClientID) + ", " + err.Error())
 	}
+	b.Transcript.ClientReveals = append(b.Transcript.ClientReveals, msg)
+	context := net.BlameProofContext("DISRUPTION", p.relayState.session, b.RoundID, b.BitPos, false, msg.ClientID)
+	if err := checkReveal(context, p.relayState.nTrustees, msg.Bits, msg.Pval, msg.NIZK, b.Transcript.ClientCiphers[msg.ClientID], b.BitPos); err != nil {
+		p.issueVerdict(false, msg.ClientID, "Disruption Phase 1: "+err.Error())
+		return nil
+	}
+	p.relayState.clientBitMap[msg.ClientID] = msg.Bits
+	log.Lvl1("Disruption Phase 1: Client", msg.ClientID, ", is consistent with itself")
 
-	return nil
+	return p.checkPhase1Done()
 }
 
 /*
 * Received_TRU_REL_DISRUPTION_REVEAL handles TRU_REL_DISRUPTION_REVEAL messages
-* First, saves the bits reveal by the trustee.
+* First, checks the proof and saves the bits reveal by the trustee.
 * It checks that the bits received by the trustee matches with the ones of the disruptive round.
 * For this it XORs the bits revealed together and compares it to the bit in the disruptive position.
 * If there is a mismatch, the trustee is the disruptor.
 * Else checks if all the reveals are received to move to next blame phase.
  */
 func (p *PriFiLibRelayInstance) Received_TRU_REL_DISRUPTION_REVEAL(msg net.TRU_REL_DISRUPTION_REVEAL) error {
-
+	if !p.relayState.blamingData.InProgress || p.relayState.blamingData.SecretsRequested {
+		log.Lvl2("Disruption: ignoring the bits of trustee", msg.TrusteeID, ", not in blame phase 1")
+		return nil
+	}
+	if msg.TrusteeID < 0 || msg.TrusteeID >= p.relayState.nTrustees {
+		return errors.New("Disruption: bits revealed by unknown trustee " + strconv.Itoa(msg.TrusteeID))
+	}
 	log.Lvl1("Disruption Phase 1: Received bits from Trustee", msg.TrusteeID, "value", msg.Bits)
 
-	var pred_array []proof.Predicate
-	suite := config.CryptoSuite
-	for i := 1; i < p.relayState.nTrustees; i++ {
-		i_string := strconv.Itoa(i)
-		pred_array = append(pred_array, proof.Rep("T"+i_string, "t"+i_string, "B"))
+	// without a valid signature, the bits are no evidence: the trustee stays silent, see checkIfBlameHasEndedAfterTimeOut
+	b := &p.relayState.blamingData
+	if err := p.checkBlameEvidence(msg.RoundID, msg.BitPos, msg.Verify(p.relayState.identities.Of(true, msg.TrusteeID), p.relayState.session)); err != nil {
+		return errors.New("Disruption: ignoring the bits of trustee " + strconv.Itoa(msg.TrusteeID) + ", " + err.Error())
 	}
-	pred := proof.And(pred_array...)
-	verifier := pred.Verifier(suite, msg.Pval)
-	err := proof.HashVerify(suite, "DISRUPTION", verifier, msg.NIZK)
-	if err != nil {
-		log.Fatal("Proof failed to verify: ")
+	b.Transcript.TrusteeReveals = append(b.Transcript.TrusteeReveals, msg)
+	context := net.BlameProofContext("DISRUPTION", p.relayState.session, b.RoundID, b.BitPos, true, msg.TrusteeID)
+	if err := checkReveal(context, p.relayState.nClients, msg.Bits, msg.Pval, msg.NIZK, b.Transcript.TrusteeCiphers[msg.TrusteeID], b.BitPos); err != nil {
+		p.issueVerdict(true, msg.TrusteeID, "Disruption Phase 1: "+err.Error())
+		return nil
 	}
-	log.Lvl3("Proof verified.")
-
 	p.relayState.trusteeBitMap[msg.TrusteeID] = msg.Bits
-	result := p.compareBits(msg.TrusteeID, msg.Bits, p.relayState.CiphertextsHistoryTrustees)
-	if !result {
-		log.Fatal("Disruption Phase 1: Disruptor is Trustee", msg.TrusteeID, ".")
-	} else if (len(p.relayState.clientBitMap) == p.relayState.nClients) && (len(p.relayState.trusteeBitMap) == p.relayState.nTrustees) {
-		log.Lvl1("Disruption Phase 1: Trustee", msg.TrusteeID, ", is consistent with itself, checking mismatches with all clients...")
-		mismatch := p.checkMismatchingPairs()
-		if mismatch {
-			toClient := &net.REL_ALL_REVEAL_SHARED_SECRETS{
-				EntityID: p.relayState.blamingData.TrusteeID,
-			}
-			toTrustee := &net.REL_ALL_REVEAL_SHARED_SECRETS{
-				EntityID: p.relayState.blamingData.ClientID,
-			}
-			p.messageSender.SendToTrusteeWithLog(p.relayState.blamingData.ClientID, toTrustee, "")
-			p.messageSender.SendToClientWithLog(p.relayState.blamingData.TrusteeID, toClient, "")
-		} else {
-			log.Fatal("Disruption Phase 2: No mismatching pairs ? this should never occur.")
-		}
-	}
+	log.Lvl1("Disruption Phase 1: Trustee", msg.TrusteeID, ", is consistent with itself")
 
-	return nil
+	return p.checkPhase1Done()
 }
 
-/*
-* Auxiliary function that does the check of the bits revealed with the bit in the disruptive position.
- */
-func (p *PriFiLibRelayInstance) compareBits(id int, bits map[int]int, CiphertextsHistory map[int32]map[int32][]byte) bool {
-	round := p.relayState.blamingData.RoundID
-	bitPosition := p.relayState.blamingData.BitPos
-	bytePosition := bitPosition/8 + 9 // LB->CV: why + 9 ? avoid magic numbers :)
+// checkPhase1Done moves to phase 2 once every entity revealed consistent bits: the first client and trustee that
+// disagree on the bit of their shared pad must reveal their shared secret
+func (p *PriFiLibRelayInstance) checkPhase1Done() error {
+	if len(p.relayState.clientBitMap) < p.relayState.nClients || len(p.relayState.trusteeBitMap) < p.relayState.nTrustees {
+		return nil
+	}
 
-	log.Lvl2("Disruption: comparing", bits, "with", CiphertextsHistory[int32(id)][int32(round)])
+	log.Lvl1("Disruption Phase 1: everyone is consistent with itself, checking mismatches between clients and trustees...")
+	if !p.checkMismatchingPairs() {
+		// the bits of everyone XOR to the bit of the cell, so the blamed bit was not flipped: the blame was wrong
+		p.relayState.blamingData.InProgress = false
+		return errors.New("Disruption Phase 2: no mismatching pair, the bit blamed was not disrupted")
+	}
 
-	byteToGet := CiphertextsHistory[int32(id)][int32(round)][bytePosition]
-	bitInBytePosition := (8-bitPosition%8)%8 - 1
-	mask := byte(1 << uint(bitInBytePosition))
-	result := 0
-	for _, bit := range bits {
-		result ^= bit
+	// each of the pair only reveals its secret if we show the signed bits of the other, which disagree with its own
+	b := p.relayState.blamingData
+	p.relayState.blamingData.SecretsRequested = true
+	toClient := &net.REL_ALL_REVEAL_SHARED_SECRETS{
+		EntityID:    b.TrusteeID,
+		RoundID:     b.RoundID,
+		BitPos:      b.BitPos,
+		TrusteeBits: *trusteeReveal(&b.Transcript, b.TrusteeID),
 	}
-	bytePreviousResult := mask & byteToGet
-	bitPreviousResult := 0
-	if bytePreviousResult != 0 {
-		bitPreviousResult = 1
+	toTrustee := &net.REL_ALL_REVEAL_SHARED_SECRETS{
+		EntityID:   b.ClientID,
+		RoundID:    b.RoundID,
+		BitPos:     b.BitPos,
+		ClientBits: *clientReveal(&b.Transcript, b.ClientID),
 	}
+	p.messageSender.SendToTrusteeWithLog(p.relayState.blamingData.TrusteeID, toTrustee, "")
+	p.messageSender.SendToClientWithLog(p.relayState.blamingData.ClientID, toClient, "")
+	return nil
+}
 
-	return (result == bitPreviousResult)
+// cipherBit returns the bit at bitPos of the DC-net payload of a cipher stored in the history
+func cipherBit(cipher []byte, bitPos int) (int, error) {
+	payload, err := dcnet.CipherPayload(cipher)
+	if err != nil {
+		return 0, err
+	}
+	return dcnet.PayloadBit(payload, bitPos)
+}
+
+// padBit regenerates the pad of round roundID from the secret, and returns its bit at bitPos
+func padBit(padGenerator string, secret kyber.Point, roundID int32, payloadSize int, bitPos int) (int, error) {
+	// pads are random-access, only the disrupted round needs to be generated
+	p_ij, err := dcnet.RoundPad(padGenerator, secret, roundID, payloadSize)
+	if err != nil {
+		return 0, errors.New("could not regenerate the pad, " + err.Error())
+	}
+	return dcnet.PayloadBit(p_ij, bitPos)
 }
 
 /*
@@ -193,8 +387,10 @@ func (p *PriFiLibRelayInstance) compareBits(id int, bits map[int]int, Ciphertext
 * When a mismatch is found, the Reveal secret message is called to the client and trustee.
  */
 func (p *PriFiLibRelayInstance) checkMismatchingPairs() bool {
-	for clientID, clientBits := range p.relayState.clientBitMap {
-		for trusteeID, clientBit := range clientBits {
+	// in the order of the IDs, so the relay always picks the same pair
+	for clientID := 0; clientID < p.relayState.nClients; clientID++ {
+		for trusteeID := 0; trusteeID < p.relayState.nTrustees; trusteeID++ {
+			clientBit := p.relayState.clientBitMap[clientID][trusteeID]
 			trusteeBit := p.relayState.trusteeBitMap[trusteeID][clientID]
 			if clientBit != trusteeBit {
 				log.Error("Disruption Phase 2: mismatch between trustee", trusteeID, "and client", clientID)
@@ -209,42 +405,66 @@ func (p *PriFiLibRelayInstance) checkMismatchingPairs() bool {
 	return false
 }
 
+// verifySecretProof checks the proof, bound to context (see net.BlameProofContext), that secret is the Diffie-Hellman
+// secret of the key X of the entity revealing it and the key peerKey of its peer, i.e., that the entity knows x such
+// that X = xB and secret = x*peerKey
+func verifySecretProof(context string, X kyber.Point, peerKey kyber.Point, secret kyber.Point, NIZK []byte) error {
+	if secret == nil {
+		return errors.New("no secret")
+	}
+	suite := config.CryptoSuite
+	pub := map[string]kyber.Point{"B": suite.Point().Base(), "BT": peerKey, "T": secret, "X[0]": X}
+	pred := proof.Or(proof.And(proof.Rep("X[0]", "x", "B"), proof.Rep("T", "x", "BT")))
+	verifier := pred.Verifier(suite, pub)
+	return proof.HashVerify(suite, context, verifier, NIZK)
+}
+
+// checkBlameEvidence returns an error if what an entity revealed is for another round or bit than the ones blamed, or
+// if signatureErr, the outcome of checking its signature, is one
+func (p *PriFiLibRelayInstance) checkBlameEvidence(roundID int32, bitPos int, signatureErr error) error {
+	b := p.relayState.blamingData
+	if roundID != b.RoundID || bitPos != b.BitPos {
+		return errors.New("they are for bit " + strconv.Itoa(bitPos) + " of round " + strconv.Itoa(int(roundID)) +
+			", not the one blamed")
+	}
+	if signatureErr != nil {
+		return errors.New("invalid signature: " + signatureErr.Error())
+	}
+	return nil
+}
+
+// isBlamedPair returns true iff we are in phase 2, and asked this client and this trustee for their secret
+func (p *PriFiLibRelayInstance) isBlamedPair(clientID, trusteeID int) bool {
+	b := p.relayState.blamingData
+	return b.InProgress && b.SecretsRequested && b.ClientID == clientID && b.TrusteeID == trusteeID
+}
+
 /*
 Received_TRU_REL_SHARED_SECRETS handles TRU_REL_SECRET messages
 Check the NIZK, if correct regenerate the cipher up to the disrupted round and check if this trustee is the disruptor
 */
 func (p *PriFiLibRelayInstance) Received_TRU_REL_SHARED_SECRETS(msg net.TRU_REL_SHARED_SECRET) error {
+	if !p.isBlamedPair(msg.ClientID, msg.TrusteeID) {
+		log.Lvl2("Disruption: ignoring the secret of trustee", msg.TrusteeID, "for client", msg.ClientID)
+		return nil
+	}
 	log.Lvl1("Disruption Phase 2: Received shared secret from Trustee", msg.TrusteeID, "for client", msg.ClientID, "value", msg.Secret)
-
-	M := "SHAREDKEY"
-	X := make([]kyber.Point, 1)
-	X[0] = p.relayState.trustees[msg.TrusteeID].PublicKey
-	preds := make([]proof.Predicate, len(X))
-	for i := range X {
-		name := fmt.Sprintf("X[%d]", i) // "X[0]","X[1]",...
-		msg.Pub[name] = X[i]            // public point value
-
-		// Predicate indicates knowledge of the private key for X[i]
-		// and correspondence of the key with the linkage tag
-		preds[i] = proof.And(proof.Rep(name, "x", "B"), proof.Rep("T", "x", "BT"))
+	b := &p.relayState.blamingData
+	if err := p.checkBlameEvidence(msg.RoundID, msg.BitPos, msg.Verify(p.relayState.identities.Of(true, msg.TrusteeID), p.relayState.session)); err != nil {
+		return errors.New("Disruption: ignoring the secret of trustee " + strconv.Itoa(msg.TrusteeID) + ", " + err.Error())
 	}
-	pred := proof.Or(preds...) // make a big Or predicate
-	suite := config.CryptoSuite
-	// Verify the signature
-	verifier := pred.Verifier(suite, msg.Pub)
-	err := proof.HashVerify(suite, M, verifier, msg.NIZK)
-	if err != nil {
-		log.Error("signature failed to verify: ", err)
+	b.Transcript.TrusteeSecrets = append(b.Transcript.TrusteeSecrets, msg)
+
+	X := p.relayState.trustees[msg.TrusteeID].DCNetPublicKey
+	peerKey := p.relayState.clients[msg.ClientID].PublicKey
+	context := net.BlameProofContext("SHAREDKEY", p.relayState.session, b.RoundID, b.BitPos, true, msg.TrusteeID)
+	if err := verifySecretProof(context, X, peerKey, msg.Secret, msg.NIZK); err != nil {
+		p.issueVerdict(true, msg.TrusteeID, "Disruption Phase 2: invalid proof of the shared secret, "+err.Error())
+		return nil
 	}
 	log.Lvl3("Linkable Ring Signature verified.")
 
-	val := p.replayRounds(msg.Secret)
-	if val != p.relayState.blamingData.TrusteeBitRevealed {
-		log.Fatal("Disruption Phase 2: Disruptor is Trustee", msg.TrusteeID, ".")
-	} else {
-		log.Lvl1("Disruption Phase 2: Trustee", msg.TrusteeID, "didn't lie, so it should be Client", msg.ClientID, ".")
-	}
-	return nil
+	return p.judgeBlamedPair(msg.Secret)
 }
 
 /*
@@ -252,74 +472,94 @@ Received_CLI_REL_SHARED_SECRET handles CLI_REL_SECRET messages
 Check the NIZK, if correct regenerate the cipher up to the disrupted round and check if this client is the disruptor
 */
 func (p *PriFiLibRelayInstance) Received_CLI_REL_SHARED_SECRET(msg net.CLI_REL_SHARED_SECRET) error {
+	if !p.isBlamedPair(msg.ClientID, msg.TrusteeID) {
+		log.Lvl2("Disruption: ignoring the secret of client", msg.ClientID, "for trustee", msg.TrusteeID)
+		return nil
+	}
 	log.Lvl1("Disruption Phase 2: Received shared secret from Client", msg.ClientID, "for Trustee", msg.TrusteeID, "value", msg.Secret)
+	b := &p.relayState.blamingData
+	if err := p.checkBlameEvidence(msg.RoundID, msg.BitPos, msg.Verify(p.relayState.identities.Of(false, msg.ClientID), p.relayState.session)); err != nil {
+		return errors.New("Disruption: ignoring the secret of client " + strconv.Itoa(msg.ClientID) + ", " + err.Error())
+	}
+	b.Transcript.ClientSecrets = append(b.Transcript.ClientSecrets, msg)
+
+	X := p.relayState.clients[msg.ClientID].PublicKey
+	peerKey := p.relayState.trustees[msg.TrusteeID].DCNetPublicKey
+	context := net.BlameProofContext("SHAREDKEY", p.relayState.session, b.RoundID, b.BitPos, false, msg.ClientID)
+	if err := verifySecretProof(context, X, peerKey, msg.Secret, msg.NIZK); err != nil {
+		p.issueVerdict(false, msg.ClientID, "Disruption Phase 2: invalid proof of the shared secret, "+err.Error())
+		return nil
+	}
+	log.Lvl3("Linkable Ring Signature verified.")
 
-	M := "SHAREDKEY"
-	X := make([]kyber.Point, 1)
-	X[0] = p.relayState.trustees[msg.TrusteeID].PublicKey
-	preds := make([]proof.Predicate, len(X))
-	for i := range X {
-		name := fmt.Sprintf("X[%d]", i) // "X[0]","X[1]",...
-		msg.Pub[name] = X[i]            // public point value
+	return p.judgeBlamedPair(msg.Secret)
+}
 
-		// Predicate indicates knowledge of the private key for X[i]
-		// and correspondence of the key with the linkage tag
-		preds[i] = proof.And(proof.Rep(name, "x", "B"), proof.Rep("T", "x", "BT"))
-	}
-	pred := proof.Or(preds...) // make a big Or predicate
-	suite := config.CryptoSuite
-	// Verify the signature
-	verifier := pred.Verifier(suite, msg.Pub)
-	err := proof.HashVerify(suite, M, verifier, msg.NIZK)
+// judgeBlamedPair regenerates the pad of the blamed client and trustee from their shared secret, which was proven
+// correct: the one that revealed another bit is the disruptor. The first valid secret is enough, the other one is the
+// same.
+func (p *PriFiLibRelayInstance) judgeBlamedPair(secret kyber.Point) error {
+	b := p.relayState.blamingData
+	val, err := padBit(b.Transcript.DCNetPadGenerator, secret, b.RoundID, b.Transcript.PayloadSize, b.BitPos)
 	if err != nil {
-		log.Error("signature failed to verify: ", err)
+		return errors.New("Disruption: " + err.Error())
 	}
-	log.Lvl3("Linkable Ring Signature verified.")
 
-	val := p.replayRounds(msg.Secret)
-	if val != p.relayState.blamingData.ClientBitRevealed {
-		log.Fatal("Disruption Phase 2: Disruptor is Client", msg.ClientID, ".")
+	if val != b.ClientBitRevealed {
+		p.issueVerdict(false, b.ClientID, "Disruption Phase 2: revealed a bit that is not the one of the pad shared with trustee "+strconv.Itoa(b.TrusteeID))
 	} else {
-		log.Lvl1("Disruption Phase 2: Client", msg.ClientID, "didn't lie, so it should be Client", msg.TrusteeID, ".")
+		p.issueVerdict(true, b.TrusteeID, "Disruption Phase 2: revealed a bit that is not the one of the pad shared with client "+strconv.Itoa(b.ClientID))
 	}
 	return nil
 }
 
-/*
-replayRounds takes the secret revealed by a user and recomputes until the disrupted bit
-*/
-func (p *PriFiLibRelayInstance) replayRounds(secret kyber.Point) int {
-	seed, err := secret.MarshalBinary()
-	if err != nil {
-		log.Fatal("Could not extract data from shared key", err)
+// issueVerdict ends the blame: it signs the verdict against the given client or trustee with the key of our server
+// identity, and gives it to the blameHandler with the transcript of the blame
+func (p *PriFiLibRelayInstance) issueVerdict(guiltyIsTrustee bool, guiltyID int, reason string) {
+	verdict := net.BlameVerdict{
+		RoundID:         p.relayState.blamingData.RoundID,
+		BitPos:          p.relayState.blamingData.BitPos,
+		GuiltyIsTrustee: guiltyIsTrustee,
+		GuiltyID:        guiltyID,
+		Reason:          reason,
 	}
-	sharedPRNG := config.CryptoSuite.XOF(seed)
-
-	round := int32(0)
-	disruptive_round := p.relayState.blamingData.RoundID
-	for round < disruptive_round {
+	p.relayState.blamingData.InProgress = false
+	p.giveVerdict(verdict, p.relayState.blamingData.Transcript)
+}
 
-		dummy := make([]byte, p.relayState.DCNet.DCNetPayloadSize)
-		sharedPRNG.XORKeyStream(dummy, dummy)
-		round++
+// reportDisruptors gives a verdict against each client and trustee that sent an invalid cipher in a round, e.g. one
+// whose proof does not verify with the verifiable DC-net. Unlike the verdicts of a blame, a third party cannot check
+// those with VerifyBlameTranscript: the ciphers are not signed, and the transcript holds no evidence.
+func (p *PriFiLibRelayInstance) reportDisruptors(d *disruptionError) {
+	transcript := net.BlameTranscript{Session: p.relayState.session, Identities: p.relayState.identities}
+	verdict := net.BlameVerdict{RoundID: d.roundID, BitPos: -1, Reason: "sent an invalid cipher"}
+	for _, clientID := range d.clients {
+		verdict.GuiltyIsTrustee, verdict.GuiltyID = false, clientID
+		p.giveVerdict(verdict, transcript)
+	}
+	for _, trusteeID := range d.trustees {
+		verdict.GuiltyIsTrustee, verdict.GuiltyID = true, trusteeID
+		p.giveVerdict(verdict, transcript)
+	}
+}
 
+// giveVerdict signs the verdict with the key of our server identity, and gives it to the blameHandler with transcript
+func (p *PriFiLibRelayInstance) giveVerdict(verdict net.BlameVerdict, transcript net.BlameTranscript) {
+	if err := verdict.Sign(p.relayState.identityKey); err != nil {
+		log.Error("Disruption: could not sign the verdict,", err)
+		return
 	}
 
-	p_ij := make([]byte, p.relayState.DCNet.DCNetPayloadSize)
-	sharedPRNG.XORKeyStream(p_ij, p_ij)
+	entity := "Client"
+	if verdict.GuiltyIsTrustee {
+		entity = "Trustee"
+	}
+	log.Error("Disruption: Disruptor is", entity, verdict.GuiltyID, "(round", verdict.RoundID, ", bit position", verdict.BitPos, "):", verdict.Reason)
 
-	var rtn int
+	transcript.Verdict = verdict
 
-	bitPosition := p.relayState.blamingData.BitPos
-	bytePosition := int(bitPosition/8) + 1
-	byte_toGet := p_ij[bytePosition]
-	bitInByte := (8-bitPosition%8)%8 - 1
-	mask := byte(1 << uint(bitInByte))
-	if (byte_toGet & mask) == 0 {
-		rtn = 0
-	} else {
-		rtn = 1
+	// the handler typically stops this relay, so it must not run while we hold the processing lock
+	if p.relayState.blameHandler != nil {
+		go p.relayState.blameHandler(transcript)
 	}
-
-	return rtn
 }
@@ -0,0 +1,319 @@
+package relay
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"github.com/dedis/prifi/prifi-lib/dcnet"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/proof"
+)
+
+// proveSecret proves that secret = x*peerKey, as the clients and trustees do
+func proveSecret(context string, x kyber.Scalar, X kyber.Point, peerKey kyber.Point, secret kyber.Point) []byte {
+	suite := config.CryptoSuite
+	sec := map[string]kyber.Scalar{"x": x}
+	pub := map[string]kyber.Point{"B": suite.Point().Base(), "BT": peerKey, "T": secret, "X[0]": X}
+	pred := proof.Or(proof.And(proof.Rep("X[0]", "x", "B"), proof.Rep("T", "x", "BT")))
+	prover := pred.Prover(suite, sec, pub, map[proof.Predicate]int{pred: 0})
+	NIZK, _ := proof.HashProve(suite, context, prover)
+	return NIZK
+}
+
+func TestVerifySecretProof(t *testing.T) {
+	suite := config.CryptoSuite
+	clientPub, clientPriv := crypto.NewKeyPair()
+	trusteePub, trusteePriv := crypto.NewKeyPair()
+	secret := suite.Point().Mul(clientPriv, trusteePub)
+	clientContext := net.BlameProofContext("SHAREDKEY", 7, 5, 12, false, 0)
+	trusteeContext := net.BlameProofContext("SHAREDKEY", 7, 5, 12, true, 0)
+
+	// both sides prove the same secret
+	if err := verifySecretProof(clientContext, clientPub, trusteePub, secret, proveSecret(clientContext, clientPriv, clientPub, trusteePub, secret)); err != nil {
+		t.Error("The proof of the client should verify,", err)
+	}
+	if err := verifySecretProof(trusteeContext, trusteePub, clientPub, secret, proveSecret(trusteeContext, trusteePriv, trusteePub, clientPub, secret)); err != nil {
+		t.Error("The proof of the trustee should verify,", err)
+	}
+
+	// a wrong secret cannot be proven
+	wrongSecret := suite.Point().Add(secret, suite.Point().Base())
+	if verifySecretProof(clientContext, clientPub, trusteePub, wrongSecret, proveSecret(clientContext, clientPriv, clientPub, trusteePub, wrongSecret)) == nil {
+		t.Error("The proof of a wrong secret should not verify")
+	}
+	// nor can the proof of another entity, or of another blame, be used
+	otherPub, otherPriv := crypto.NewKeyPair()
+	if verifySecretProof(clientContext, clientPub, trusteePub, secret, proveSecret(clientContext, otherPriv, otherPub, trusteePub, secret)) == nil {
+		t.Error("The proof of another key should not verify")
+	}
+	otherContext := net.BlameProofContext("SHAREDKEY", 7, 6, 12, false, 0)
+	if verifySecretProof(clientContext, clientPub, trusteePub, secret, proveSecret(otherContext, clientPriv, clientPub, trusteePub, secret)) == nil {
+		t.Error("The proof of another blame should not verify")
+	}
+	if verifySecretProof(clientContext, clientPub, trusteePub, secret, make([]byte, 0)) == nil {
+		t.Error("An empty proof should not verify")
+	}
+	if verifySecretProof(clientContext, clientPub, trusteePub, nil, nil) == nil {
+		t.Error("A missing secret should not verify")
+	}
+}
+
+// proveReveal commits to nPeers pads and proves it, as the clients and trustees do when they reveal their bits
+func proveReveal(context string, nPeers int) (map[string]kyber.Point, []byte) {
+	suite := config.CryptoSuite
+	var preds []proof.Predicate
+	sval := make(map[string]kyber.Scalar)
+	pval := map[string]kyber.Point{"B": suite.Point().Base()}
+	for i := 0; i < nPeers; i++ {
+		i_string := strconv.Itoa(i)
+		preds = append(preds, proof.Rep("T"+i_string, "t"+i_string, "B"))
+		sval["t"+i_string] = suite.Scalar().Pick(suite.RandomStream())
+		pval["T"+i_string] = suite.Point().Mul(sval["t"+i_string], nil)
+	}
+	prover := proof.And(preds...).Prover(suite, sval, pval, nil)
+	NIZK, _ := proof.HashProve(suite, context, prover)
+	return pval, NIZK
+}
+
+func TestVerifyRevealProof(t *testing.T) {
+	suite := config.CryptoSuite
+	nPeers := 3
+	context := net.BlameProofContext("DISRUPTION", 7, 5, 12, false, 1)
+	pval, NIZK := proveReveal(context, nPeers)
+
+	if err := verifyRevealProof(context, nPeers, pval, NIZK); err != nil {
+		t.Error("The proof should verify,", err)
+	}
+	if verifyRevealProof(context, nPeers+1, pval, NIZK) == nil {
+		t.Error("The proof should not verify for another number of peers")
+	}
+	if verifyRevealProof(context, nPeers, pval, NIZK[1:]) == nil {
+		t.Error("A truncated proof should not verify")
+	}
+	if verifyRevealProof(net.BlameProofContext("DISRUPTION", 7, 5, 12, false, 2), nPeers, pval, NIZK) == nil {
+		t.Error("The proof of another client should not verify")
+	}
+
+	// the base point is the relay's, not the entity's
+	pval["B"] = suite.Point().Mul(suite.Scalar().SetInt64(2), nil)
+	if verifyRevealProof(context, nPeers, pval, NIZK) != nil {
+		t.Error("The base point sent should be ignored")
+	}
+}
+
+func TestCheckRevealedBits(t *testing.T) {
+	if err := checkRevealedBits(2, map[int]int{0: 1, 1: 0}); err != nil {
+		t.Error(err)
+	}
+	if checkRevealedBits(2, map[int]int{0: 1}) == nil {
+		t.Error("A missing bit should be detected")
+	}
+	if checkRevealedBits(2, map[int]int{0: 1, 2: 0}) == nil {
+		t.Error("A bit for an unknown peer should be detected")
+	}
+	if checkRevealedBits(2, map[int]int{0: 1, 1: 2}) == nil {
+		t.Error("A bit should be 0 or 1")
+	}
+}
+
+func TestVerifyBlameTranscriptPhase1(t *testing.T) {
+	nClients, nTrustees := 2, 2
+	session := 7
+	relayPub, relayPriv := crypto.NewKeyPair()
+	identities := net.Identities{Relay: relayPub}
+	clientKeys := make([]kyber.Scalar, nClients)
+
+	transcript := &net.BlameTranscript{
+		Verdict:                 net.BlameVerdict{RoundID: 5, BitPos: 12, GuiltyID: 1},
+		Session:                 session,
+		DCNetPadGenerator:       dcnet.PAD_GENERATOR_XOF,
+		PayloadSize:             10,
+		ClientPublicKeys:        make([]kyber.Point, nClients),
+		TrusteePublicKeys:       make([]kyber.Point, nTrustees),
+		ClientCiphers:           make([][]byte, nClients),
+		TrusteeCiphers:          make([][]byte, nTrustees),
+		ClientCipherSignatures:  make([][]byte, nClients),
+		TrusteeCipherSignatures: make([][]byte, nTrustees),
+	}
+	for i := range transcript.ClientPublicKeys {
+		var pub kyber.Point
+		pub, clientKeys[i] = crypto.NewKeyPair()
+		identities.Clients = append(identities.Clients, pub)
+		transcript.ClientPublicKeys[i], _ = crypto.NewKeyPair()
+		transcript.ClientCiphers[i] = make([]byte, 20)
+		transcript.ClientCiphers[i][7] = dcnet.CIPHER_HEADER_SIZE // the payload, all zeros, follows the header
+		transcript.ClientCipherSignatures[i], _ = net.SignCipher(clientKeys[i], session, 5, false, i, transcript.ClientCiphers[i])
+	}
+	for j := range transcript.TrusteePublicKeys {
+		pub, priv := crypto.NewKeyPair()
+		identities.Trustees = append(identities.Trustees, pub)
+		transcript.TrusteePublicKeys[j], _ = crypto.NewKeyPair()
+		transcript.TrusteeCiphers[j] = make([]byte, 20)
+		transcript.TrusteeCiphers[j][7] = dcnet.CIPHER_HEADER_SIZE
+		transcript.TrusteeCipherSignatures[j], _ = net.SignCipher(priv, session, 5, true, j, transcript.TrusteeCiphers[j])
+	}
+	if err := transcript.Verdict.Sign(relayPriv); err != nil {
+		t.Fatal(err)
+	}
+	signedReveal := func(r net.CLI_REL_DISRUPTION_REVEAL) net.CLI_REL_DISRUPTION_REVEAL {
+		r.RoundID, r.BitPos = 5, 12
+		if err := r.Sign(clientKeys[r.ClientID], session); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	// client 1 did not reveal its bits before the deadline
+	if err := VerifyBlameTranscript(transcript, identities); err != nil {
+		t.Error("The missing bits should support the verdict,", err)
+	}
+	otherPub, otherPriv := crypto.NewKeyPair()
+	other := identities
+	other.Relay = otherPub
+	if VerifyBlameTranscript(transcript, other) == nil {
+		t.Error("A verdict should only verify with the relay's key")
+	}
+
+	// client 1 revealed a single bit for two trustees
+	transcript.ClientReveals = []net.CLI_REL_DISRUPTION_REVEAL{signedReveal(net.CLI_REL_DISRUPTION_REVEAL{ClientID: 1, Bits: map[int]int{0: 1}})}
+	if err := VerifyBlameTranscript(transcript, identities); err != nil {
+		t.Error("The invalid bits should support the verdict,", err)
+	}
+
+	// client 1 revealed bits without a valid proof
+	transcript.ClientReveals = []net.CLI_REL_DISRUPTION_REVEAL{signedReveal(net.CLI_REL_DISRUPTION_REVEAL{ClientID: 1, Bits: map[int]int{0: 1, 1: 1}})}
+	if err := VerifyBlameTranscript(transcript, identities); err != nil {
+		t.Error("The invalid proof should support the verdict,", err)
+	}
+
+	// the relay cannot make up the evidence: bits or a cipher not signed by the client, or bits of another blame
+	forged := transcript.ClientReveals[0]
+	forged.Bits = map[int]int{0: 1}
+	transcript.ClientReveals = []net.CLI_REL_DISRUPTION_REVEAL{forged}
+	if VerifyBlameTranscript(transcript, identities) == nil {
+		t.Error("Bits not signed by the client should not be evidence")
+	}
+	replayed := signedReveal(net.CLI_REL_DISRUPTION_REVEAL{ClientID: 1, Bits: map[int]int{0: 1}})
+	replayed.RoundID = 4
+	replayed.Sign(clientKeys[1], session)
+	transcript.ClientReveals = []net.CLI_REL_DISRUPTION_REVEAL{replayed}
+	if VerifyBlameTranscript(transcript, identities) == nil {
+		t.Error("Bits of another round should not be evidence")
+	}
+	transcript.ClientReveals = nil
+	transcript.ClientCipherSignatures[1], _ = net.SignCipher(otherPriv, session, 5, false, 1, transcript.ClientCiphers[1])
+	if VerifyBlameTranscript(transcript, identities) == nil {
+		t.Error("A cipher not signed by the client should not be evidence")
+	}
+	transcript.ClientCipherSignatures[1], _ = net.SignCipher(clientKeys[1], session, 5, false, 1, transcript.ClientCiphers[1])
+
+	// the same evidence does not support a verdict against client 0
+	transcript.ClientReveals = []net.CLI_REL_DISRUPTION_REVEAL{signedReveal(net.CLI_REL_DISRUPTION_REVEAL{ClientID: 1, Bits: map[int]int{0: 1, 1: 1}})}
+	transcript.Verdict.GuiltyID = 0
+	if err := transcript.Verdict.Sign(relayPriv); err != nil {
+		t.Fatal(err)
+	}
+	pval, NIZK := proveReveal(net.BlameProofContext("DISRUPTION", session, 5, 12, false, 0), nTrustees)
+	transcript.ClientReveals = append(transcript.ClientReveals, signedReveal(net.CLI_REL_DISRUPTION_REVEAL{ClientID: 0, Bits: map[int]int{0: 1, 1: 1}, Pval: pval, NIZK: NIZK}))
+	if VerifyBlameTranscript(transcript, identities) == nil {
+		t.Error("The verdict against client 0 should not verify")
+	}
+}
+
+func TestDisruptionBlameContext(t *testing.T) {
+	suite := config.CryptoSuite
+	relay := NewRelay(false, nil, nil, nil, nil, nil, newTestMessageSenderWrapper(new(TestMessageSender)))
+	relay.relayState.session = 7
+	X, x := crypto.NewKeyPair()
+	relay.relayState.EphemeralPublicKeys = []kyber.Point{X}
+	relay.relayState.blamingData.InProgress = true // a valid blame is then ignored, without going further
+
+	blame := func(context string, roundID int32, bitPos int) net.CLI_REL_DISRUPTION_BLAME {
+		pval := map[string]kyber.Point{"B": suite.Point().Base(), "X": X}
+		prover := proof.Rep("X", "x", "B").Prover(suite, map[string]kyber.Scalar{"x": x}, pval, nil)
+		NIZK, _ := proof.HashProve(suite, context, prover)
+		return net.CLI_REL_DISRUPTION_BLAME{RoundID: roundID, BitPos: bitPos, NIZK: NIZK, Pval: pval}
+	}
+
+	if err := relay.Received_CLI_REL_DISRUPTION_BLAME(blame(net.BlameProofContext("BLAME", 7, 5, 12, false, -1), 5, 12)); err != nil {
+		t.Error("The blame should be accepted,", err)
+	}
+	replayed := blame(net.BlameProofContext("BLAME", 7, 5, 12, false, -1), 6, 12)
+	if relay.Received_CLI_REL_DISRUPTION_BLAME(replayed) == nil {
+		t.Error("The proof of a blame should not be accepted for another round")
+	}
+	replayed = blame(net.BlameProofContext("BLAME", 7, 5, 12, false, -1), 5, 13)
+	if relay.Received_CLI_REL_DISRUPTION_BLAME(replayed) == nil {
+		t.Error("The proof of a blame should not be accepted for another bit")
+	}
+	if relay.Received_CLI_REL_DISRUPTION_BLAME(blame(net.BlameProofContext("BLAME", 6, 5, 12, false, -1), 5, 12)) == nil {
+		t.Error("The proof of a blame should not be accepted in another session")
+	}
+	if relay.Received_CLI_REL_DISRUPTION_BLAME(blame("DISRUPTION", 5, 12)) == nil {
+		t.Error("A proof without the context of the blame should not be accepted")
+	}
+}
+
+func TestBlamePhase2TimeOut(t *testing.T) {
+	verdicts := make(chan net.BlameTranscript, 1)
+	relay := NewRelay(false, nil, nil, nil, nil, func(transcript net.BlameTranscript) {
+		verdicts <- transcript
+	}, newTestMessageSenderWrapper(new(TestMessageSender)))
+	relay.relayState.BlameTimeOut = 1
+	relay.relayState.blamingData = BlamingData{ID: 3, InProgress: true, SecretsRequested: true, RoundID: 5, BitPos: 12,
+		ClientID: 0, TrusteeID: 1}
+
+	// neither the client nor the trustee revealed their secret: we cannot tell which one disrupted
+	relay.checkIfBlameHasEndedAfterTimeOut(3)
+	if relay.relayState.blamingData.InProgress {
+		t.Error("The blame should end after the deadline")
+	}
+	select {
+	case v := <-verdicts:
+		t.Error("No one should be found guilty when the pair is silent, got", v.Verdict)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReportDisruptors(t *testing.T) {
+	verdicts := make(chan net.BlameTranscript, 3)
+	relay := NewRelay(false, nil, nil, nil, nil, func(transcript net.BlameTranscript) {
+		verdicts <- transcript
+	}, newTestMessageSenderWrapper(new(TestMessageSender)))
+	relayIdentity, relayIdentityKey := crypto.NewKeyPair()
+	relay.SetIdentities(relayIdentityKey, net.Identities{Relay: relayIdentity})
+
+	// the senders of invalid ciphers are found guilty, not whoever sent the invalid accumulated ciphers
+	relay.reportDisruptors(&disruptionError{roundID: 7, clients: []int{1}, trustees: []int{0}, accumulated: true})
+	guilty := make(map[bool]int)
+	for i := 0; i < 2; i++ {
+		select {
+		case transcript := <-verdicts:
+			v := transcript.Verdict
+			if err := v.Verify(relayIdentity); err != nil {
+				t.Error("The verdict should be signed by the relay,", err)
+			}
+			if v.RoundID != 7 {
+				t.Error("The verdict should be for round 7, not", v.RoundID)
+			}
+			guilty[v.GuiltyIsTrustee] = v.GuiltyID
+		case <-time.After(time.Second):
+			t.Fatal("The relay should give a verdict against each disruptor")
+		}
+	}
+	if id, found := guilty[false]; !found || id != 1 {
+		t.Error("Client 1 should be found guilty")
+	}
+	if id, found := guilty[true]; !found || id != 0 {
+		t.Error("Trustee 0 should be found guilty")
+	}
+	select {
+	case v := <-verdicts:
+		t.Error("Only the senders of invalid ciphers should be found guilty, got", v.Verdict)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,87 @@
+package relay
+
+/*
+Downstream encryption
+*********************
+With DownstreamEncryptionEnabled, the owner of a slot appends an ephemeral public key to the data it sends. The first
+bytes of that data identify the stream it belongs to (as in the stream-multiplexer); we remember the key of each stream,
+and encrypt the data going down that stream to it. Only the client that opened the stream can read the answer, yet we
+do not know which client it is. Data of unknown streams, and the relay's own messages, are sent in clear.
+*/
+
+import (
+	"bytes"
+	"encoding/hex"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// DOWNSTREAM_STREAM_TAG_SIZE is the number of bytes at the beginning of the data that identify a stream
+const DOWNSTREAM_STREAM_TAG_SIZE = 4
+
+// DOWNSTREAM_KEY_IDLE_TIMEOUT is how long we keep the key of a stream that is not used anymore
+const DOWNSTREAM_KEY_IDLE_TIMEOUT = 10 * time.Minute
+
+// the key a client gave for one of its streams
+type downstreamKey struct {
+	public   [crypto.DOWNSTREAM_KEY_SIZE]byte
+	lastUsed time.Time
+}
+
+// learnDownstreamKey removes the key at the end of an upstream payload and remembers it for the stream of that payload.
+// Returns the payload without the key
+func (p *PriFiLibRelayInstance) learnDownstreamKey(upstreamPlaintext []byte) []byte {
+	if len(upstreamPlaintext) < crypto.DOWNSTREAM_KEY_SIZE {
+		return upstreamPlaintext
+	}
+	keyStart := len(upstreamPlaintext) - crypto.DOWNSTREAM_KEY_SIZE
+	key := upstreamPlaintext[keyStart:]
+	payload := upstreamPlaintext[:keyStart]
+
+	now := time.Now()
+	for tag, k := range p.relayState.downstreamKeys {
+		if now.Sub(k.lastUsed) > DOWNSTREAM_KEY_IDLE_TIMEOUT {
+			delete(p.relayState.downstreamKeys, tag)
+		}
+	}
+
+	// an empty slot has no stream and no key
+	zeros := make([]byte, crypto.DOWNSTREAM_KEY_SIZE)
+	if len(payload) < DOWNSTREAM_STREAM_TAG_SIZE || bytes.Equal(key, zeros) ||
+		bytes.Equal(payload[:DOWNSTREAM_STREAM_TAG_SIZE], zeros[:DOWNSTREAM_STREAM_TAG_SIZE]) {
+		return payload
+	}
+
+	tag := string(payload[:DOWNSTREAM_STREAM_TAG_SIZE])
+	k := &downstreamKey{lastUsed: now}
+	copy(k.public[:], key)
+	if old, found := p.relayState.downstreamKeys[tag]; !found || old.public != k.public {
+		log.Lvl3("Relay : stream", hex.EncodeToString([]byte(tag)), "has a new downstream key")
+	}
+	p.relayState.downstreamKeys[tag] = k
+
+	return payload
+}
+
+// encryptDownstream encrypts the data for the clients to the key of its stream, if we know it. Returns the data to
+// send, and whether it is encrypted
+func (p *PriFiLibRelayInstance) encryptDownstream(data []byte) ([]byte, bool) {
+	if len(data) < DOWNSTREAM_STREAM_TAG_SIZE {
+		return data, false
+	}
+	k, found := p.relayState.downstreamKeys[string(data[:DOWNSTREAM_STREAM_TAG_SIZE])]
+	if !found {
+		log.Lvl3("Relay : no downstream key for stream", hex.EncodeToString(data[:DOWNSTREAM_STREAM_TAG_SIZE]), ", sending in clear")
+		return data, false
+	}
+
+	encrypted, err := crypto.EncryptDownstream(&k.public, data)
+	if err != nil {
+		log.Error("Relay : could not encrypt downstream data,", err)
+		return data, false
+	}
+	k.lastUsed = time.Now()
+	return encrypted, true
+}
@@ -0,0 +1,33 @@
+package relay
+
+/*
+Accountable downstream
+**********************
+With DownstreamChainEnabled, we sign each downstream cell with the key of our server identity, chained to the cells
+sent before in the session (see net/downstream_chain.go). The clients refuse the cells we did not sign, and, with
+DownstreamGossipPeriod, compare the heads of the chain among themselves and with the trustees; sending different cells
+to different clients is then provable. The chain restarts with each session, see newSession.
+*/
+
+import (
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// addDownstreamChainParameters tells the clients how often to gossip the head of the downstream chain
+func (p *PriFiLibRelayInstance) addDownstreamChainParameters(msg *net.ALL_ALL_PARAMETERS) {
+	msg.Add("DownstreamGossipPeriod", p.relayState.DownstreamGossipPeriod)
+}
+
+// signDownstreamCell chains and signs a cell before it is sent, if DownstreamChainEnabled
+func (p *PriFiLibRelayInstance) signDownstreamCell(msg *net.REL_CLI_DOWNSTREAM_DATA) {
+	if !p.relayState.DownstreamChainEnabled {
+		return
+	}
+	head, err := net.SignDownstreamCell(p.relayState.identityKey, p.relayState.session, p.relayState.downstreamChainHead, msg)
+	if err != nil {
+		log.Error("Relay : cannot sign the downstream cell of round", msg.RoundID, ", error is", err)
+		return
+	}
+	p.relayState.downstreamChainHead = head
+}
@@ -0,0 +1,44 @@
+package relay
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/crypto"
+)
+
+func TestDownstreamEncryption(t *testing.T) {
+
+	p := &PriFiLibRelayInstance{relayState: &RelayState{downstreamKeys: make(map[string]*downstreamKey)}}
+
+	key, _ := crypto.NewDownstreamKey()
+	payload := []byte("AAAAsome request")
+	upstream := append(append([]byte{}, payload...), key.Public[:]...)
+
+	if out := p.learnDownstreamKey(upstream); !bytes.Equal(out, payload) {
+		t.Fatal("The key should be removed from the payload")
+	}
+
+	// an empty slot
+	if out := p.learnDownstreamKey(make([]byte, 50)); len(out) != 50-crypto.DOWNSTREAM_KEY_SIZE {
+		t.Error("The key should be removed from an empty payload")
+	}
+	if len(p.relayState.downstreamKeys) != 1 {
+		t.Error("Only the stream AAAA should have a key")
+	}
+
+	answer := []byte("AAAAsome answer")
+	encrypted, flagEncrypted := p.encryptDownstream(answer)
+	if !flagEncrypted || bytes.Contains(encrypted, answer) {
+		t.Fatal("The answer should be encrypted")
+	}
+	decrypted, err := key.DecryptDownstream(encrypted)
+	if err != nil || !bytes.Equal(decrypted, answer) {
+		t.Error("The client should decrypt the answer", err)
+	}
+
+	other := []byte("BBBBunknown stream")
+	if out, flagEncrypted := p.encryptDownstream(other); flagEncrypted || !bytes.Equal(out, other) {
+		t.Error("The data of an unknown stream should be sent in clear")
+	}
+}
@@ -0,0 +1,281 @@
+package relay
+
+/*
+Key epochs
+**********
+Every EpochLength rounds, the relay rotates the DC-net keys and the slots without restarting the protocol. The
+preparation happens in the background, while the current epoch keeps carrying traffic :
+
+- REL_CLI_EPOCH_START - asks the clients for fresh keys
+- CLI_REL_EPOCH_PK_AND_EPH_PK - when we have the fresh keys of all clients, the trustees shuffle them like during the
+  setup
+- TRU_REL_EPOCH_SHUFFLE - we forward the shuffle to the next trustee, or send the transcript to all of them
+- TRU_REL_EPOCH_SHUFFLE_SIG - when all trustees signed, we pick the first round of the new epoch and announce it with
+  REL_ALL_EPOCH_SWITCH, with the payload size of the epoch (see payloadsize.go). The trustees stopped encoding in
+  advance, and the round is after all opened rounds, so every round is encoded entirely with the keys of one epoch,
+  and no round is lost.
+*/
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/scheduler"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// relayEpoch holds the state of the key epoch being prepared
+type relayEpoch struct {
+	ID                  int32
+	BoundaryRound       int32 // -1 until all trustees signed the shuffle
+	PayloadSize         int   // chosen with the boundary, see payloadsize.go
+	clientPks           []kyber.Point
+	clientEphPks        []kyber.Point
+	nClientsPkCollected int
+	trusteePks          []kyber.Point
+	neffShuffle         *scheduler.NeffShuffleRelay
+	nSigsCollected      int
+	trusteesNextRound   int32 // the first round that some trustee did not encode yet
+	EphemeralPublicKeys []kyber.Point
+}
+
+// startEpochIfNeeded starts preparing the next key epoch, once the current one has lasted EpochLength rounds
+func (p *PriFiLibRelayInstance) startEpochIfNeeded(roundID int32) {
+	if p.relayState.EpochLength <= 0 || p.relayState.epoch != nil {
+		return
+	}
+	if roundID+1 < p.relayState.epochFirstRound+int32(p.relayState.EpochLength) {
+		return
+	}
+
+	p.relayState.epoch = &relayEpoch{
+		ID:            p.relayState.epochID + 1,
+		BoundaryRound: -1,
+		clientPks:     make([]kyber.Point, p.relayState.nClients),
+		clientEphPks:  make([]kyber.Point, p.relayState.nClients),
+		trusteePks:    make([]kyber.Point, p.relayState.nTrustees),
+	}
+
+	log.Lvl2("Relay : preparing epoch", p.relayState.epoch.ID, "after round", roundID)
+
+	toSend := &net.REL_CLI_EPOCH_START{Epoch: p.relayState.epoch.ID}
+	for i := 0; i < p.relayState.nClients; i++ {
+		p.messageSender.SendToClientWithLog(i, toSend, "(client "+strconv.Itoa(i)+", epoch "+strconv.Itoa(int(toSend.Epoch))+")")
+	}
+}
+
+// preparedEpoch returns the key epoch being prepared, or an error if it is not the given one
+func (p *PriFiLibRelayInstance) preparedEpoch(epochID int32) (*relayEpoch, error) {
+	epoch := p.relayState.epoch
+	if epoch == nil || epoch.ID != epochID {
+		return nil, errors.New("Relay : received a message for epoch " + strconv.Itoa(int(epochID)) + ", which we are not preparing")
+	}
+	return epoch, nil
+}
+
+/*
+Received_CLI_REL_EPOCH_PK_AND_EPH_PK handles CLI_REL_EPOCH_PK_AND_EPH_PK messages.
+We do nothing until we have collected the fresh keys of all clients; then, we send them to the first trustee for it to
+Neff-Shuffle them.
+*/
+func (p *PriFiLibRelayInstance) Received_CLI_REL_EPOCH_PK_AND_EPH_PK(msg net.CLI_REL_EPOCH_PK_AND_EPH_PK) error {
+
+	epoch, err := p.preparedEpoch(msg.Epoch)
+	if err != nil {
+		return err
+	}
+	if msg.ClientID < 0 || msg.ClientID >= p.relayState.nClients || epoch.clientPks[msg.ClientID] != nil {
+		return errors.New("Relay : unexpected keys from client " + strconv.Itoa(msg.ClientID) + " for epoch " + strconv.Itoa(int(msg.Epoch)))
+	}
+
+	epoch.clientPks[msg.ClientID] = msg.Pk
+	epoch.clientEphPks[msg.ClientID] = msg.EphPk
+	epoch.nClientsPkCollected++
+
+	log.Lvl2("Relay : received CLI_REL_EPOCH_PK_AND_EPH_PK (" + strconv.Itoa(epoch.nClientsPkCollected) + "/" + strconv.Itoa(p.relayState.nClients) + ")")
+
+	if epoch.nClientsPkCollected < p.relayState.nClients {
+		return nil
+	}
+
+	neffShuffle := new(scheduler.NeffShuffle)
+	neffShuffle.Init()
+	epoch.neffShuffle = neffShuffle.RelayView
+	epoch.neffShuffle.Init(p.relayState.nTrustees)
+	for i := 0; i < p.relayState.nClients; i++ {
+		epoch.neffShuffle.AddClient(epoch.clientEphPks[i])
+	}
+
+	return p.sendEpochShuffleToNextTrustee(epoch)
+}
+
+// sendEpochShuffleToNextTrustee sends the current state of the shuffle of the next key epoch to the next trustee
+func (p *PriFiLibRelayInstance) sendEpochShuffleToNextTrustee(epoch *relayEpoch) error {
+	msg, trusteeID, err := epoch.neffShuffle.SendToNextTrustee()
+	if err != nil {
+		e := "Could not do SendToNextTrustee for epoch " + strconv.Itoa(int(epoch.ID)) + ", error is " + err.Error()
+		log.Error(e)
+		return errors.New(e)
+	}
+	shuffle := msg.(*net.REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE)
+
+	toSend := &net.REL_TRU_EPOCH_SHUFFLE{
+		Epoch:  epoch.ID,
+		Pks:    epoch.clientPks,
+		EphPks: shuffle.EphPks,
+		Base:   shuffle.Base,
+	}
+	p.messageSender.SendToTrusteeWithLog(trusteeID, toSend, "(epoch "+strconv.Itoa(int(epoch.ID))+", "+strconv.Itoa(trusteeID)+"-th iteration)")
+
+	return nil
+}
+
+/*
+Received_TRU_REL_EPOCH_SHUFFLE handles TRU_REL_EPOCH_SHUFFLE messages.
+We forward the shuffle to the next trustee. After the last trustee, we broadcast the transcript to all trustees, who
+will sign it.
+*/
+func (p *PriFiLibRelayInstance) Received_TRU_REL_EPOCH_SHUFFLE(msg net.TRU_REL_EPOCH_SHUFFLE) error {
+
+	epoch, err := p.preparedEpoch(msg.Epoch)
+	if err != nil {
+		return err
+	}
+	if msg.TrusteeID < 0 || msg.TrusteeID >= p.relayState.nTrustees {
+		return errors.New("Relay : unexpected shuffle from trustee " + strconv.Itoa(msg.TrusteeID) + " for epoch " + strconv.Itoa(int(msg.Epoch)))
+	}
+
+	epoch.trusteePks[msg.TrusteeID] = msg.Pk
+	epoch.EphemeralPublicKeys = msg.NewEphPks
+	done, err := epoch.neffShuffle.ReceivedShuffleFromTrustee(msg.NewBase, msg.NewEphPks, msg.Proof)
+	if err != nil {
+		e := "Relay : error in ReceivedShuffleFromTrustee for epoch " + strconv.Itoa(int(msg.Epoch)) + ", " + err.Error()
+		log.Error(e)
+		return errors.New(e)
+	}
+
+	if !done {
+		return p.sendEpochShuffleToNextTrustee(epoch)
+	}
+
+	transcript, err := epoch.neffShuffle.SendTranscript()
+	if err != nil {
+		e := "Could not do SendTranscript for epoch " + strconv.Itoa(int(msg.Epoch)) + ", error is " + err.Error()
+		log.Error(e)
+		return errors.New(e)
+	}
+	t := transcript.(*net.REL_TRU_TELL_TRANSCRIPT)
+
+	toSend := &net.REL_TRU_EPOCH_TRANSCRIPT{
+		Epoch:  msg.Epoch,
+		Bases:  t.Bases,
+		EphPks: t.EphPks,
+		Proofs: t.Proofs,
+	}
+	for j := 0; j < p.relayState.nTrustees; j++ {
+		p.messageSender.SendToTrusteeWithLog(j, toSend, "(trustee "+strconv.Itoa(j)+", epoch "+strconv.Itoa(int(msg.Epoch))+")")
+	}
+
+	return nil
+}
+
+/*
+Received_TRU_REL_EPOCH_SHUFFLE_SIG handles TRU_REL_EPOCH_SHUFFLE_SIG messages.
+We do nothing until all trustees signed. Then, the next key epoch starts at the first round that was neither encoded
+by a trustee nor opened by us (with some margin, so the clients learn about it before receiving the round); we
+announce it to everyone.
+*/
+func (p *PriFiLibRelayInstance) Received_TRU_REL_EPOCH_SHUFFLE_SIG(msg net.TRU_REL_EPOCH_SHUFFLE_SIG) error {
+
+	epoch, err := p.preparedEpoch(msg.Epoch)
+	if err != nil {
+		return err
+	}
+
+	done, err := epoch.neffShuffle.ReceivedSignatureFromTrustee(msg.TrusteeID, msg.Sig)
+	if err != nil {
+		e := "Could not do ReceivedSignatureFromTrustee for epoch " + strconv.Itoa(int(msg.Epoch)) + ", error is " + err.Error()
+		log.Error(e)
+		return errors.New(e)
+	}
+	if msg.NextRound > epoch.trusteesNextRound {
+		epoch.trusteesNextRound = msg.NextRound
+	}
+	if !done {
+		return nil
+	}
+
+	// the shuffle is signed with the trustees' long-term keys
+	trusteesPks := make([]kyber.Point, p.relayState.nTrustees)
+	for j := 0; j < p.relayState.nTrustees; j++ {
+		trusteesPks[j] = p.relayState.trustees[j].PublicKey
+	}
+	signed, err := epoch.neffShuffle.VerifySigsAndSendToClients(trusteesPks)
+	if err != nil {
+		e := "Could not do VerifySigsAndSendToClients for epoch " + strconv.Itoa(int(msg.Epoch)) + ", error is " + err.Error()
+		log.Error(e)
+		return errors.New(e)
+	}
+	s := signed.(*net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG)
+
+	boundary := p.relayState.roundManager.NextRoundToOpen() + int32(p.relayState.WindowSize)
+	if epoch.trusteesNextRound > boundary {
+		boundary = epoch.trusteesNextRound
+	}
+	epoch.BoundaryRound = boundary
+	epoch.EphemeralPublicKeys = s.EphPks
+	epoch.PayloadSize = p.nextEpochPayloadSize()
+
+	// our DC-net holds no keys, only the size of the cells
+	if err := p.relayState.DCNet.SetNextEpoch(boundary, nil, epoch.PayloadSize); err != nil {
+		e := "Relay : cannot switch to epoch " + strconv.Itoa(int(epoch.ID)) + ", error is " + err.Error()
+		log.Error(e)
+		return errors.New(e)
+	}
+
+	log.Lvl2("Relay : epoch", epoch.ID, "starts at round", boundary, "with a payload size of", epoch.PayloadSize)
+
+	toSend := &net.REL_ALL_EPOCH_SWITCH{
+		Epoch:         epoch.ID,
+		BoundaryRound: boundary,
+		TrusteesPks:   epoch.trusteePks,
+		Base:          s.Base,
+		EphPks:        s.EphPks,
+		TrusteesSigs:  s.TrusteesSigs,
+		PayloadSize:   epoch.PayloadSize,
+	}
+	for i := 0; i < p.relayState.nClients; i++ {
+		p.messageSender.SendToClientWithLog(i, toSend, "(client "+strconv.Itoa(i)+", epoch "+strconv.Itoa(int(epoch.ID))+")")
+	}
+	for j := 0; j < p.relayState.nTrustees; j++ {
+		p.messageSender.SendToTrusteeWithLog(j, toSend, "(trustee "+strconv.Itoa(j)+", epoch "+strconv.Itoa(int(epoch.ID))+")")
+	}
+
+	return nil
+}
+
+// switchEpochIfNeeded makes the prepared key epoch the current one, once the round we open reaches its boundary.
+// Our DC-net holds no key; this updates the keys used to check the secrets revealed in case of disruption.
+func (p *PriFiLibRelayInstance) switchEpochIfNeeded(roundID int32) {
+	epoch := p.relayState.epoch
+	if epoch == nil || epoch.BoundaryRound < 0 || roundID < epoch.BoundaryRound {
+		return
+	}
+
+	for i := 0; i < p.relayState.nClients; i++ {
+		p.relayState.clients[i].PublicKey = epoch.clientPks[i]
+		p.relayState.clients[i].EphemeralPublicKey = epoch.clientEphPks[i]
+	}
+	for j := 0; j < p.relayState.nTrustees; j++ {
+		p.relayState.trustees[j].DCNetPublicKey = epoch.trusteePks[j]
+	}
+	p.relayState.EphemeralPublicKeys = epoch.EphemeralPublicKeys
+	p.relayState.epochID = epoch.ID
+	p.relayState.epochFirstRound = epoch.BoundaryRound
+	p.relayState.epoch = nil
+	p.relayState.payloadUsage = newPayloadUsage(p.relayState.schedulesStatistics)
+
+	log.Lvl1("Relay : switched to epoch", epoch.ID, "in round", roundID)
+}
@@ -59,7 +59,7 @@ type PriFiLibRelayInstance struct {
 // Note: the returned state is not sufficient for the PrFi protocol
 // to start; this entity will expect a ALL_ALL_PARAMETERS message as
 // first received message to complete it's state.
-func NewRelay(dataOutputEnabled bool, dataForClients chan []byte, dataFromDCNet chan []byte, experimentResultChan chan interface{}, timeoutHandler func([]int, []int), msgSender *net.MessageSenderWrapper) *PriFiLibRelayInstance {
+func NewRelay(dataOutputEnabled bool, dataForClients chan []byte, dataFromDCNet chan []byte, experimentResultChan chan interface{}, timeoutHandler func([]int, []int), blameHandler func(net.BlameTranscript), msgSender *net.MessageSenderWrapper) *PriFiLibRelayInstance {
 	relayState := new(RelayState)
 
 	//init the static stuff
@@ -67,6 +67,7 @@ func NewRelay(dataOutputEnabled bool, dataForClients chan []byte, dataFromDCNet
 	relayState.DataFromDCNet = dataFromDCNet
 	relayState.DataOutputEnabled = dataOutputEnabled
 	relayState.timeoutHandler = timeoutHandler
+	relayState.blameHandler = blameHandler
 	relayState.ExperimentResultChannel = experimentResultChan
 	relayState.ExperimentResultData = make([]string, 0)
 	relayState.PriorityDataForClients = make(chan []byte, 10) // This is used for relay's control message (like latency-tests) d
@@ -85,6 +86,8 @@ func NewRelay(dataOutputEnabled bool, dataForClients chan []byte, dataFromDCNet
 	neffShuffle.Init()
 	relayState.neffShuffle = neffShuffle.RelayView
 	relayState.Name = "Relay"
+	relayState.UDPFragmentSize = 1400 // fits in an Ethernet frame
+	relayState.UDPParityFragments = 1
 
 	//init the state machine
 	states := []string{"BEFORE_INIT", "COLLECTING_TRUSTEES_PKS", "COLLECTING_CLIENT_PKS", "COLLECTING_SHUFFLES", "COLLECTING_SHUFFLE_SIGNATURES", "COMMUNICATING", "BLAMING", "SHUTDOWN"}
@@ -110,28 +113,44 @@ func NewRelay(dataOutputEnabled bool, dataForClients chan []byte, dataFromDCNet
 	return &prifi
 }
 
+// SetIdentities gives the relay the private key of its server identity, which signs the blame verdicts, and the keys
+// of the server identities of the clients and trustees
+func (p *PriFiLibRelayInstance) SetIdentities(privateKey kyber.Scalar, identities net.Identities) {
+	p.relayState.processingLock.Lock()
+	defer p.relayState.processingLock.Unlock()
+
+	p.relayState.identityKey = privateKey
+	p.relayState.identities = identities
+}
+
 // NodeRepresentation regroups the information about one client or trustee.
 type NodeRepresentation struct {
 	ID                 int
 	Connected          bool
 	PublicKey          kyber.Point
 	EphemeralPublicKey kyber.Point
+	DCNetPublicKey     kyber.Point // for trustees, the key used for the DC-net secrets; changes with each key epoch
 }
 
 // BlamingData is a struct used in the blame phase of the disruption protection.
 // [round#, bitPos, clientID, bitRevealed, trusteeID, bitRevealed]
 type BlamingData struct {
+	ID                 int  // counts the blames, so that a timeout only ends the blame it was started for
+	InProgress         bool // a blame has started, and has no verdict yet
+	SecretsRequested   bool // phase 2: the relay asked the pair (ClientID, TrusteeID) to reveal their shared secret
 	RoundID            int32
 	BitPos             int
 	ClientID           int
 	ClientBitRevealed  int
 	TrusteeID          int
 	TrusteeBitRevealed int
+	Transcript         net.BlameTranscript // the evidence gathered so far, given to the blameHandler with the verdict
 }
 
 // RelayState contains the mutable state of the relay.
 type RelayState struct {
 	DCNet                                  *dcnet.DCNetEntity
+	decoding                               *decodingPipeline
 	clients                                []NodeRepresentation
 	roundManager                           *BufferableRoundManager
 	neffShuffle                            *scheduler.NeffShuffleRelay
@@ -142,7 +161,6 @@ type RelayState struct {
 	DataFromDCNet                          chan []byte // VPN / SOCKS should read data from there !
 	DataOutputEnabled                      bool        // If FALSE, nothing will be written to DataFromDCNet
 	DownstreamCellSize                     int
-	MessageHistory                         kyber.XOF
 	Name                                   string
 	nClients                               int
 	nClientsPkCollected                    int
@@ -150,6 +168,8 @@ type RelayState struct {
 	nTrusteesPkCollected                   int
 	privateKey                             kyber.Scalar
 	PublicKey                              kyber.Point
+	identityKey                            kyber.Scalar   // the private key of our server identity, see SetIdentities
+	identities                             net.Identities // the keys of the server identities of everyone
 	ExperimentRoundLimit                   int
 	trustees                               []NodeRepresentation
 	PayloadSize                            int
@@ -161,23 +181,52 @@ type RelayState struct {
 	ExperimentResultChannel                chan interface{}
 	ExperimentResultData                   []string
 	timeoutHandler                         func([]int, []int)
+	blameHandler                           func(net.BlameTranscript) // called with the verdict of each blame and its evidence, see disruption.go
 	bitrateStatistics                      *prifilog.BitrateStatistics
 	schedulesStatistics                    *prifilog.SchedulesStatistics
 	timeStatistics                         map[string]*prifilog.TimeStatistics
-	slotScheduler                          *scheduler.BitMaskSlotScheduler_Relay
+	slotScheduler                          scheduler.SlotScheduler_Relay
 	dcNetType                              string
+	dcNetPadGenerator                      string
 	time0                                  uint64
 	pcapLogger                             *utils.PCAPLog
 	DisruptionProtectionEnabled            bool
 	OpenClosedSlotsMinDelayBetweenRequests int
+	OpenClosedSlotsMaxLength               int            // the most consecutive rounds a slot can reserve in one schedule
+	OpenClosedSlotsScheduler               string         // "BitMask" or "Footprint", see prifi-lib/scheduler
+	OpenClosedSlotsPositions               int            // the number of owner IDs in a schedule: nClients, or the footprint positions
+	schedulePending                        bool           // a footprint schedule was requested, and not decoded yet
 	OpenClosedSlotsRequestsRoundID         map[int32]bool // contains roundID -> true if that round should be a OC slot request
 	numberOfConsecutiveFailedRounds        int
 	MaxNumberOfConsecutiveFailedRounds     int // Kill the protocol if that many rounds fail consecutively
 	ProcessingLoopSleepTime                int
 	RoundTimeOut                           int //The timeout before retransmission (UDP) and/or considering the round failed
+	BlameTimeOut                           int // The time the clients and trustees have to answer in a blame; in phase 1, the silent ones are then found guilty
 	TrusteeCacheLowBound                   int // Number of ciphertexts buffered by trustees. When <= TRUSTEE_CACHE_LOWBOUND, resume sending
 	TrusteeCacheHighBound                  int // Number of ciphertexts buffered by trustees. When >= TRUSTEE_CACHE_HIGHBOUND, stop sending
 	EquivocationProtectionEnabled          bool
+	EpochLength                            int // Number of rounds after which the DC-net keys are rotated. 0 disables the rotation
+	MaxPayloadSize                         int // With key epochs, the payload size adapts between PayloadSize and this. 0 keeps PayloadSize
+	UDPFragmentSize                        int // Max bytes of downstream cell per UDP datagram
+	UDPParityFragments                     int // Number of Reed-Solomon parity datagrams per downstream cell
+	DownstreamEncryptionEnabled            bool
+	downstreamKeys                         map[string]*downstreamKey // stream tag -> key of the client that opened it
+	UpstreamCompressionEnabled             bool
+	DownstreamChainEnabled                 bool
+	DownstreamGossipPeriod                 int // The clients gossip the head of the downstream chain every that many rounds, 0 disables it
+
+	session int // drawn anew at each setup, see newSession
+
+	// accountable downstream, see downstream_chain.go
+	downstreamChainHead []byte
+
+	// key epochs
+	epochID         int32
+	epochFirstRound int32
+	epoch           *relayEpoch // the key epoch being prepared, if any
+
+	// adaptive payload size
+	payloadUsage payloadUsage // how the cells of the current epoch were used, see payloadsize.go
 
 	// sync
 	processingLock sync.Mutex // either we treat a message, or a timeout, never both
@@ -185,8 +234,8 @@ type RelayState struct {
 	//disruption protection
 	LastMessageOfClients       map[int32][]byte
 	BEchoFlags                 map[int32]byte
-	CiphertextsHistoryTrustees map[int32]map[int32][]byte
-	CiphertextsHistoryClients  map[int32]map[int32][]byte
+	CiphertextsHistoryTrustees map[int32]map[int32]signedCipher
+	CiphertextsHistoryClients  map[int32]map[int32]signedCipher
 	DisruptionReveal           bool
 	clientBitMap               map[int]map[int]int
 	trusteeBitMap              map[int]map[int]int
@@ -197,8 +246,9 @@ type RelayState struct {
 	ForceDisruptionSinceRound3 bool
 
 	//Used for verifiable DC-net, part of the dcnet.old/owned.go
-	VerifiableDCNetKeys [][]byte
-	nVkeysCollected     int
+	VerifiableDCNetKeys       [][]byte // of the trustees
+	ClientVerifiableDCNetKeys [][]byte
+	nVkeysCollected           int
 }
 
 // ReceivedMessage must be called when a PriFi host receives a message.
@@ -264,6 +314,22 @@ func (p *PriFiLibRelayInstance) ReceivedMessage(msg interface{}) error {
 		if p.stateMachine.AssertState("COMMUNICATING") {
 			err = p.Received_CLI_REL_DISRUPTION_BLAME(typedMsg)
 		}
+	case net.CLI_REL_DOWNSTREAM_NACK:
+		if p.stateMachine.AssertState("COMMUNICATING") {
+			err = p.Received_CLI_REL_DOWNSTREAM_NACK(typedMsg)
+		}
+	case net.CLI_REL_EPOCH_PK_AND_EPH_PK:
+		if p.stateMachine.AssertState("COMMUNICATING") {
+			err = p.Received_CLI_REL_EPOCH_PK_AND_EPH_PK(typedMsg)
+		}
+	case net.TRU_REL_EPOCH_SHUFFLE:
+		if p.stateMachine.AssertState("COMMUNICATING") {
+			err = p.Received_TRU_REL_EPOCH_SHUFFLE(typedMsg)
+		}
+	case net.TRU_REL_EPOCH_SHUFFLE_SIG:
+		if p.stateMachine.AssertState("COMMUNICATING") {
+			err = p.Received_TRU_REL_EPOCH_SHUFFLE_SIG(typedMsg)
+		}
 	default:
 		err = errors.New("Unrecognized message, type" + reflect.TypeOf(msg).String())
 	}
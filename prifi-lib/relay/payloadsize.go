@@ -0,0 +1,110 @@
+package relay
+
+/*
+Adaptive payload size
+*********************
+With MaxPayloadSize above PayloadSize, the size of the upstream cells follows the demand. During each key epoch, we
+measure how full the decoded cells are, and which part of the slots the clients opened (see SchedulesStatistics).
+When all trustees signed the shuffle of the next epoch, we pick its payload size: twice the current one if the cells
+were mostly full, half of it if the slots were mostly unused, always between PayloadSize and MaxPayloadSize. The size
+goes to the clients and trustees in REL_ALL_EPOCH_SWITCH, and their DC-nets apply it from the boundary round on, with
+the new keys; the rounds before keep their size.
+
+The data the clients send is cut for PayloadSize, so it fits in any cell; bigger cells are filled with several
+messages only with UpstreamCompressionEnabled, or by the pcap replay.
+*/
+
+import (
+	"github.com/dedis/prifi/prifi-lib/compression"
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// PAYLOAD_GROW_FILL : when the cells of an epoch are that full on average, the next epoch has cells twice as big
+const PAYLOAD_GROW_FILL = 0.75
+
+// PAYLOAD_SHRINK_FILL : when the slots of an epoch use less than that of their cells (a closed slot uses nothing),
+// the next epoch has cells half as big
+const PAYLOAD_SHRINK_FILL = 0.25
+
+// payloadUsage measures how the upstream cells of the current epoch are used
+type payloadUsage struct {
+	usedBytes       int64
+	capacity        int64
+	openSlotsBefore int // the totals of the schedules statistics when the epoch started
+	slotsBefore     int
+}
+
+func newPayloadUsage(schedules *prifilog.SchedulesStatistics) payloadUsage {
+	u := payloadUsage{}
+	u.openSlotsBefore, u.slotsBefore = schedules.OpenSlots()
+	return u
+}
+
+// add records a decoded cell of size bytes, of which the slot owner used used bytes
+func (u *payloadUsage) add(used, size int) {
+	u.usedBytes += int64(used)
+	u.capacity += int64(size)
+}
+
+// fill is how full the cells were on average, 0 if there were none
+func (u *payloadUsage) fill() float64 {
+	if u.capacity == 0 {
+		return 0
+	}
+	return float64(u.usedBytes) / float64(u.capacity)
+}
+
+// openRatio is the part of the slots that were open since the epoch started; 1 without the open-closed schedules
+func (u *payloadUsage) openRatio(schedules *prifilog.SchedulesStatistics) float64 {
+	openSlots, slots := schedules.OpenSlots()
+	if slots == u.slotsBefore {
+		return 1
+	}
+	return float64(openSlots-u.openSlotsBefore) / float64(slots-u.slotsBefore)
+}
+
+// nextPayloadSize picks the payload size of the next epoch, given how full the cells of the current one were, and the
+// part of the slots that were open
+func nextPayloadSize(current, min, max int, fill, openRatio float64) int {
+	next := current
+	if fill >= PAYLOAD_GROW_FILL {
+		next = current * 2
+	} else if fill*openRatio < PAYLOAD_SHRINK_FILL {
+		next = current / 2
+	}
+	if next > max {
+		next = max
+	}
+	if next < min {
+		next = min
+	}
+	return next
+}
+
+// usedBytes is how much of a decoded payload the slot owner used, without the padding
+func (p *PriFiLibRelayInstance) usedBytes(payload []byte) int {
+	if p.relayState.DownstreamEncryptionEnabled && !p.relayState.UpstreamCompressionEnabled && len(payload) >= crypto.DOWNSTREAM_KEY_SIZE {
+		// the key comes after the padding
+		return compression.DataLength(payload[:len(payload)-crypto.DOWNSTREAM_KEY_SIZE])
+	}
+	return compression.DataLength(payload)
+}
+
+// nextEpochPayloadSize picks the payload size of the epoch being prepared, from the usage of the current one
+func (p *PriFiLibRelayInstance) nextEpochPayloadSize() int {
+	current := p.relayState.DCNet.PayloadSizeOfRound(p.relayState.epochFirstRound)
+	if p.relayState.MaxPayloadSize <= p.relayState.PayloadSize {
+		return current
+	}
+
+	usage := &p.relayState.payloadUsage
+	fill := usage.fill()
+	openRatio := usage.openRatio(p.relayState.schedulesStatistics)
+	next := nextPayloadSize(current, p.relayState.PayloadSize, p.relayState.MaxPayloadSize, fill, openRatio)
+
+	log.Lvl2("Relay : the cells of epoch", p.relayState.epochID, "were", int(fill*100), "% full, and", int(openRatio*100),
+		"% of the slots open; the payload size goes from", current, "to", next)
+	return next
+}
@@ -0,0 +1,52 @@
+package relay
+
+import (
+	"testing"
+
+	prifilog "github.com/dedis/prifi/prifi-lib/log"
+)
+
+func TestNextPayloadSize(t *testing.T) {
+	cases := []struct {
+		current         int
+		fill, openRatio float64
+		next            int
+	}{
+		{1000, 0.9, 1, 2000},
+		{1000, 0.9, 0.1, 2000}, // the few open slots are full
+		{3000, 0.9, 1, 4000},   // capped
+		{4000, 0.9, 1, 4000},
+		{2000, 0.5, 1, 2000}, // after growing, the same demand keeps the size
+		{2000, 0.5, 0.2, 1000},
+		{2000, 0.1, 1, 1000},
+		{1000, 0, 1, 1000}, // not below the minimum
+	}
+	for _, c := range cases {
+		if next := nextPayloadSize(c.current, 1000, 4000, c.fill, c.openRatio); next != c.next {
+			t.Error("with", c.current, "bytes,", c.fill, "full and", c.openRatio, "open, the next size should be", c.next, "not", next)
+		}
+	}
+}
+
+func TestPayloadUsage(t *testing.T) {
+	schedules := prifilog.NewSchedulesStatistics()
+	schedules.AddSchedule(map[int]bool{0: true, 1: true})
+
+	u := newPayloadUsage(schedules)
+	if u.fill() != 0 || u.openRatio(schedules) != 1 {
+		t.Error("without cells nor schedules, the usage should be empty and the slots open")
+	}
+
+	u.add(100, 100)
+	u.add(0, 100)
+	u.add(50, 200)
+	if u.fill() != 0.375 {
+		t.Error("the cells should be 37.5% full, not", u.fill())
+	}
+
+	// only the schedules of the epoch count
+	schedules.AddSchedule(map[int]bool{0: true, 1: false, 2: false, 3: false})
+	if u.openRatio(schedules) != 0.25 {
+		t.Error("25% of the slots should be open, not", u.openRatio(schedules))
+	}
+}
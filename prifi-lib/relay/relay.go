@@ -15,9 +15,11 @@ Then, this file simple handle the answer to the different message kind :
 - TRU_REL_TELL_NEW_BASE_AND_EPH_PKS - when we receive the result of one shuffle, we forward it to the next trustee
 - TRU_REL_SHUFFLE_SIG - when the shuffle has been done by all trustee, we send the transcript, and they answer with a signature, which we
 						   broadcast to the clients
-- CLI_REL_UPSTREAM_DATA - data for the DC-net
+- CLI_REL_UPSTREAM_DATA - data for the DC-net. The answers can be encrypted to the slot owner, see downstream.go
 - REL_CLI_UDP_DOWNSTREAM_DATA - is NEVER received here, but casted to CLI_REL_UPSTREAM_DATA by messages.go
-- TRU_REL_DC_CIPHER - data for the DC-net
+- TRU_REL_DC_CIPHER - data for the DC-net. The ciphers are folded in as they arrive, see decoding.go
+- CLI_REL_EPOCH_PK_AND_EPH_PK, TRU_REL_EPOCH_SHUFFLE, TRU_REL_EPOCH_SHUFFLE_SIG - key epochs, see epoch.go
+- CLI_REL_DOWNSTREAM_NACK - a client misses some fragments of a downstream cell sent by UDP, see broadcast.go
 
 local functions :
 
@@ -32,6 +34,7 @@ considered disconnected
 */
 
 import (
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"strconv"
@@ -41,10 +44,11 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"fmt"
-	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/compression"
 	"github.com/dedis/prifi/prifi-lib/dcnet"
 	prifilog "github.com/dedis/prifi/prifi-lib/log"
 	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/scheduler"
 	"github.com/dedis/prifi/prifi-lib/utils"
 	"github.com/dedis/prifi/utils"
 	"go.dedis.ch/kyber/v3"
@@ -99,19 +103,61 @@ func (p *PriFiLibRelayInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PARA
 	reportingLimit := msg.IntValueOrElse("ExperimentRoundLimit", p.relayState.ExperimentRoundLimit)
 	useUDP := msg.BoolValueOrElse("UseUDP", p.relayState.UseUDP)
 	dcNetType := msg.StringValueOrElse("DCNetType", p.relayState.dcNetType)
+	dcNetPadGenerator := msg.StringValueOrElse("DCNetPadGenerator", p.relayState.dcNetPadGenerator)
 	disruptionProtection := msg.BoolValueOrElse("DisruptionProtectionEnabled", false)
 	openClosedSlotsMinDelayBetweenRequests := msg.IntValueOrElse("OpenClosedSlotsMinDelayBetweenRequests", p.relayState.OpenClosedSlotsMinDelayBetweenRequests)
+	openClosedSlotsMaxLength := msg.IntValueOrElse("OpenClosedSlotsMaxLength", p.relayState.OpenClosedSlotsMaxLength)
+	openClosedSlotsScheduler := msg.StringValueOrElse("OpenClosedSlotsScheduler", p.relayState.OpenClosedSlotsScheduler)
+	openClosedSlotsPositions := msg.IntValueOrElse("OpenClosedSlotsPositions", p.relayState.OpenClosedSlotsPositions)
 	maxNumberOfConsecutiveFailedRounds := msg.IntValueOrElse("RelayMaxNumberOfConsecutiveFailedRounds", p.relayState.MaxNumberOfConsecutiveFailedRounds)
 	processingLoopSleepTime := msg.IntValueOrElse("RelayProcessingLoopSleepTime", p.relayState.ProcessingLoopSleepTime)
 	roundTimeOut := msg.IntValueOrElse("RelayRoundTimeOut", p.relayState.RoundTimeOut)
+	blameTimeOut := msg.IntValueOrElse("RelayBlameTimeOut", p.relayState.BlameTimeOut)
 	trusteeCacheLowBound := msg.IntValueOrElse("RelayTrusteeCacheLowBound", p.relayState.TrusteeCacheLowBound)
 	trusteeCacheHighBound := msg.IntValueOrElse("RelayTrusteeCacheHighBound", p.relayState.TrusteeCacheHighBound)
 	equivocationProtectionEnabled := msg.BoolValueOrElse("EquivocationProtectionEnabled", p.relayState.EquivocationProtectionEnabled)
 	ForceDisruptionSinceRound3 := msg.BoolValueOrElse("ForceDisruptionSinceRound3", false)
+	epochLength := msg.IntValueOrElse("RelayEpochLength", p.relayState.EpochLength)
+	maxPayloadSize := msg.IntValueOrElse("MaxPayloadSize", p.relayState.MaxPayloadSize)
+	udpFragmentSize := msg.IntValueOrElse("UDPFragmentSize", p.relayState.UDPFragmentSize)
+	udpParityFragments := msg.IntValueOrElse("UDPParityFragments", p.relayState.UDPParityFragments)
+	downstreamEncryption := msg.BoolValueOrElse("DownstreamEncryptionEnabled", p.relayState.DownstreamEncryptionEnabled)
+	upstreamCompression := msg.BoolValueOrElse("UpstreamCompressionEnabled", p.relayState.UpstreamCompressionEnabled)
+	downstreamChain := msg.BoolValueOrElse("DownstreamChainEnabled", p.relayState.DownstreamChainEnabled)
+	downstreamGossipPeriod := msg.IntValueOrElse("DownstreamGossipPeriod", p.relayState.DownstreamGossipPeriod)
 
 	if payloadSize < 1 {
 		return errors.New("payloadSize cannot be 0")
 	}
+	if maxPayloadSize != 0 && maxPayloadSize < payloadSize {
+		return errors.New("MaxPayloadSize cannot be smaller than PayloadSize")
+	}
+	if dcNetType != "Simple" && dcNetType != "Verifiable" {
+		return errors.New("unknown DCNetType " + dcNetType)
+	}
+	if !dcnet.IsValidPadGenerator(dcNetPadGenerator) {
+		return errors.New("unknown DCNetPadGenerator " + dcNetPadGenerator)
+	}
+	if blameTimeOut < 1 {
+		blameTimeOut = roundTimeOut
+	}
+	if openClosedSlotsMaxLength < 1 {
+		openClosedSlotsMaxLength = 1
+	}
+	slotScheduler, err := scheduler.NewSlotSchedulerRelay(openClosedSlotsScheduler, openClosedSlotsMaxLength)
+	if err != nil {
+		return err
+	}
+	// the owner IDs are the slots of the shuffle, or the positions of the footprints
+	if openClosedSlotsScheduler != scheduler.SLOT_SCHEDULER_FOOTPRINT || openClosedSlotsPositions < 1 {
+		openClosedSlotsPositions = nClients
+	}
+	if openClosedSlotsScheduler == scheduler.SLOT_SCHEDULER_FOOTPRINT && openClosedSlotsPositions*scheduler.FOOTPRINT_SIZE > payloadSize {
+		return errors.New("the footprints of OpenClosedSlotsPositions do not fit in PayloadSize")
+	}
+	if useUDP && (udpFragmentSize < 1 || udpParityFragments < 0) {
+		return errors.New("UDPFragmentSize must be positive and UDPParityFragments cannot be negative")
+	}
 
 	p.relayState.clients = make([]NodeRepresentation, nClients)
 	p.relayState.trustees = make([]NodeRepresentation, nTrustees)
@@ -129,18 +175,40 @@ func (p *PriFiLibRelayInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PARA
 	p.relayState.WindowSize = windowSize
 	p.relayState.numberOfNonAckedDownstreamPackets = 0
 	p.relayState.OpenClosedSlotsMinDelayBetweenRequests = openClosedSlotsMinDelayBetweenRequests
+	p.relayState.OpenClosedSlotsMaxLength = openClosedSlotsMaxLength
+	p.relayState.OpenClosedSlotsScheduler = openClosedSlotsScheduler
+	p.relayState.OpenClosedSlotsPositions = openClosedSlotsPositions
+	p.relayState.slotScheduler = slotScheduler
+	p.relayState.schedulePending = false
 	p.relayState.MaxNumberOfConsecutiveFailedRounds = maxNumberOfConsecutiveFailedRounds
 	p.relayState.ProcessingLoopSleepTime = processingLoopSleepTime
 	p.relayState.RoundTimeOut = roundTimeOut
+	p.relayState.BlameTimeOut = blameTimeOut
 	p.relayState.TrusteeCacheLowBound = trusteeCacheLowBound
 	p.relayState.TrusteeCacheHighBound = trusteeCacheHighBound
 	p.relayState.EquivocationProtectionEnabled = equivocationProtectionEnabled
 	p.relayState.ForceDisruptionSinceRound3 = ForceDisruptionSinceRound3
-	p.relayState.MessageHistory = config.CryptoSuite.XOF([]byte("init")) //any non-nil, non-empty, constant array
+	p.relayState.EpochLength = epochLength
+	p.relayState.MaxPayloadSize = maxPayloadSize
+	p.relayState.payloadUsage = newPayloadUsage(p.relayState.schedulesStatistics)
+	p.relayState.UDPFragmentSize = udpFragmentSize
+	p.relayState.UDPParityFragments = udpParityFragments
+	p.relayState.DownstreamEncryptionEnabled = downstreamEncryption
+	p.relayState.downstreamKeys = make(map[string]*downstreamKey)
+	p.relayState.UpstreamCompressionEnabled = upstreamCompression
+	p.relayState.DownstreamChainEnabled = downstreamChain
+	p.relayState.DownstreamGossipPeriod = downstreamGossipPeriod
+	p.newSession()
+	p.relayState.epochID = 0
+	p.relayState.epochFirstRound = 0
+	p.relayState.epoch = nil
 	p.relayState.VerifiableDCNetKeys = make([][]byte, nTrustees)
+	p.relayState.ClientVerifiableDCNetKeys = make([][]byte, nClients)
 	p.relayState.nVkeysCollected = 0
 	p.relayState.roundManager = NewBufferableRoundManager(nClients, nTrustees, windowSize)
+	p.relayState.roundManager.SetNumberOfSlots(openClosedSlotsPositions)
 	p.relayState.dcNetType = dcNetType
+	p.relayState.dcNetPadGenerator = dcNetPadGenerator
 	p.relayState.pcapLogger = utils.NewPCAPLog()
 	p.relayState.DisruptionProtectionEnabled = disruptionProtection
 	p.relayState.clientBitMap = make(map[int]map[int]int)
@@ -148,18 +216,39 @@ func (p *PriFiLibRelayInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PARA
 	p.relayState.OpenClosedSlotsRequestsRoundID = make(map[int32]bool)
 	p.relayState.LastMessageOfClients = make(map[int32][]byte)
 	p.relayState.BEchoFlags = make(map[int32]byte)
-	p.relayState.CiphertextsHistoryTrustees = make(map[int32]map[int32][]byte)
-	p.relayState.CiphertextsHistoryClients = make(map[int32]map[int32][]byte)
+	p.relayState.CiphertextsHistoryTrustees = make(map[int32]map[int32]signedCipher)
+	p.relayState.CiphertextsHistoryClients = make(map[int32]map[int32]signedCipher)
 	//CV->LB: Is this the proper way to initialize this?
 	for i := int32(0); i < int32(nClients); i++ {
-		p.relayState.CiphertextsHistoryClients[i] = make(map[int32][]byte)
+		p.relayState.CiphertextsHistoryClients[i] = make(map[int32]signedCipher)
 	}
 	for j := int32(0); j < int32(nTrustees); j++ {
-		p.relayState.CiphertextsHistoryTrustees[j] = make(map[int32][]byte)
+		p.relayState.CiphertextsHistoryTrustees[j] = make(map[int32]signedCipher)
 	}
 	switch dcNetType {
 	case "Verifiable":
-		panic("Verifiable DCNet not implemented yet")
+		// disruptors are identified by the proofs on each cipher, and those cannot cover the open-closed bitmaps
+		if useOpenClosedSlots || disruptionProtection || equivocationProtectionEnabled {
+			log.Lvl1("Relay: the Verifiable DC-net disables open-closed slots, disruption and equivocation protection.")
+		}
+		// the verifiable DC-net binds the slots to the keys of the setup
+		if epochLength > 0 {
+			log.Lvl1("Relay: the Verifiable DC-net disables the key epochs.")
+		}
+		p.relayState.EpochLength = 0
+		p.relayState.UseOpenClosedSlots = false
+		p.relayState.DisruptionProtectionEnabled = false
+		p.relayState.EquivocationProtectionEnabled = false
+	}
+
+	// the payload size changes with the keys, see payloadsize.go
+	if p.relayState.MaxPayloadSize > payloadSize && p.relayState.EpochLength <= 0 {
+		log.Lvl1("Relay: the payload size only adapts with the key epochs, MaxPayloadSize is ignored.")
+	}
+
+	// without disruption protection, there is no need to keep the full ciphers of the rounds not yet opened
+	if !p.relayState.DisruptionProtectionEnabled && dcNetType != "Verifiable" {
+		p.relayState.roundManager.EnableAccumulation()
 	}
 
 	//this should be in NewRelayState, but we need p
@@ -194,6 +283,17 @@ func (p *PriFiLibRelayInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PARA
 	return nil
 }
 
+// newSession draws the session of this setup, which the signatures of the downstream chain and of the ciphers and
+// reveals of the blames are bound to, and restarts the downstream chain
+func (p *PriFiLibRelayInstance) newSession() {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		log.Error("Relay : cannot draw the session,", err)
+	}
+	p.relayState.session = int(binary.BigEndian.Uint32(b) >> 1)
+	p.relayState.downstreamChainHead = net.NewDownstreamChainHead()
+}
+
 // ConnectToTrustees connects to the trustees and initializes them with default parameters.
 func (p *PriFiLibRelayInstance) BroadcastParameters() error {
 
@@ -205,8 +305,11 @@ func (p *PriFiLibRelayInstance) BroadcastParameters() error {
 	msg.Add("StartNow", true)
 	msg.Add("PayloadSize", p.relayState.PayloadSize)
 	msg.Add("DCNetType", p.relayState.dcNetType)
+	msg.Add("DCNetPadGenerator", p.relayState.dcNetPadGenerator)
 	msg.Add("DisruptionProtectionEnabled", p.relayState.DisruptionProtectionEnabled)
 	msg.Add("EquivocationProtectionEnabled", p.relayState.EquivocationProtectionEnabled)
+	msg.Add("Session", p.relayState.session)
+	p.addDownstreamChainParameters(msg)
 	msg.ForceParams = true
 
 	// Send those parameters to all trustees
@@ -229,12 +332,19 @@ If we finished a round (we had collected all data, and called DecodeCell()), we
 Either we send something from the SOCKS/VPN buffer, or we answer the latency-test message if we received any, or we send 1 bit.
 */
 func (p *PriFiLibRelayInstance) Received_CLI_REL_UPSTREAM_DATA(msg net.CLI_REL_UPSTREAM_DATA) error {
-	// CV-LB: I am not sure if this is a good programing practice...
-	if p.relayState.CiphertextsHistoryClients[int32(msg.ClientID)] == nil {
-		p.relayState.CiphertextsHistoryClients[int32(msg.ClientID)] = make(map[int32][]byte)
+	// the full ciphers are only needed to find disruptors, and must be signed to be evidence
+	if p.relayState.DisruptionProtectionEnabled {
+		if err := p.verifyCipherSignature(false, msg.ClientID, msg.RoundID, msg.Data, msg.Signature); err != nil {
+			return err
+		}
+		if p.relayState.CiphertextsHistoryClients[int32(msg.ClientID)] == nil {
+			p.relayState.CiphertextsHistoryClients[int32(msg.ClientID)] = make(map[int32]signedCipher)
+		}
+		p.relayState.CiphertextsHistoryClients[int32(msg.ClientID)][msg.RoundID] = signedCipher{msg.Data, msg.Signature}
+	}
+	if err := p.relayState.roundManager.AddClientCipher(msg.RoundID, msg.ClientID, msg.Data); err == nil {
+		p.relayState.decoding.addClientCipher(msg.RoundID, msg.ClientID, msg.Data)
 	}
-	p.relayState.CiphertextsHistoryClients[int32(msg.ClientID)][msg.RoundID] = msg.Data
-	p.relayState.roundManager.AddClientCipher(msg.RoundID, msg.ClientID, msg.Data)
 	if p.relayState.roundManager.HasAllCiphersForCurrentRound() {
 		p.upstreamPhase1_processCiphers(true)
 	}
@@ -248,11 +358,19 @@ If it's for this round, we call decode on it, and remember we received it.
 If for a future round we need to Buffer it.
 */
 func (p *PriFiLibRelayInstance) Received_TRU_REL_DC_CIPHER(msg net.TRU_REL_DC_CIPHER) error {
-	if p.relayState.CiphertextsHistoryTrustees[int32(msg.TrusteeID)] == nil {
-		p.relayState.CiphertextsHistoryTrustees[int32(msg.TrusteeID)] = make(map[int32][]byte)
+	// the full ciphers are only needed to find disruptors, and must be signed to be evidence
+	if p.relayState.DisruptionProtectionEnabled {
+		if err := p.verifyCipherSignature(true, msg.TrusteeID, msg.RoundID, msg.Data, msg.Signature); err != nil {
+			return err
+		}
+		if p.relayState.CiphertextsHistoryTrustees[int32(msg.TrusteeID)] == nil {
+			p.relayState.CiphertextsHistoryTrustees[int32(msg.TrusteeID)] = make(map[int32]signedCipher)
+		}
+		p.relayState.CiphertextsHistoryTrustees[int32(msg.TrusteeID)][msg.RoundID] = signedCipher{msg.Data, msg.Signature}
+	}
+	if err := p.relayState.roundManager.AddTrusteeCipher(msg.RoundID, msg.TrusteeID, msg.Data); err == nil {
+		p.relayState.decoding.addTrusteeCipher(msg.RoundID, msg.TrusteeID, msg.Data)
 	}
-	p.relayState.CiphertextsHistoryTrustees[int32(msg.TrusteeID)][msg.RoundID] = msg.Data
-	p.relayState.roundManager.AddTrusteeCipher(msg.RoundID, msg.TrusteeID, msg.Data)
 	if p.relayState.roundManager.HasAllCiphersForCurrentRound() {
 		p.upstreamPhase1_processCiphers(true)
 	}
@@ -263,7 +381,9 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_DC_CIPHER(msg net.TRU_REL_DC_CI
 // Received_CLI_REL_OPENCLOSED_DATA handles the reception of the OpenClosed map, which details which
 // pseudonymous clients want to transmit in a given round
 func (p *PriFiLibRelayInstance) Received_CLI_REL_OPENCLOSED_DATA(msg net.CLI_REL_OPENCLOSED_DATA) error {
-	p.relayState.roundManager.AddClientCipher(msg.RoundID, msg.ClientID, msg.OpenClosedData)
+	if err := p.relayState.roundManager.AddClientCipher(msg.RoundID, msg.ClientID, msg.OpenClosedData); err == nil {
+		p.relayState.decoding.addClientCipher(msg.RoundID, msg.ClientID, msg.OpenClosedData)
+	}
 	if p.relayState.roundManager.HasAllCiphersForCurrentRound() {
 		p.upstreamPhase1_processCiphers(false)
 	}
@@ -325,27 +445,46 @@ func (p *PriFiLibRelayInstance) downstreamPhase_sendMany() {
 	}
 }
 
+// startDecodingRound starts folding the ciphers of a round that was just opened, including those received in advance
+func (p *PriFiLibRelayInstance) startDecodingRound(roundID int32, ownerSlot int) {
+	clientCiphers, trusteeCiphers := p.relayState.roundManager.BufferedCiphers(roundID)
+	accumulated := p.relayState.roundManager.TakeAccumulator(roundID)
+	p.relayState.decoding.start(roundID, ownerSlot, clientCiphers, trusteeCiphers, accumulated)
+}
+
+// finishDecodingRound waits until all ciphers of the current round are folded in the DC-net, which can then decode the
+// cell. The rounds are finalized in order. If some ciphers are invalid, their senders are evicted, and an error naming
+// them is returned.
+func (p *PriFiLibRelayInstance) finishDecodingRound(roundID int32) error {
+	if !p.relayState.roundManager.HasAllCiphersForCurrentRound() {
+		return errors.New("Cannot decode round " + strconv.Itoa(int(roundID)) + " yet, missing ciphers.")
+	}
+	err := p.relayState.decoding.finish(roundID)
+	if disruption, ok := err.(*disruptionError); ok {
+		p.reportDisruptors(disruption)
+	}
+	return err
+}
+
 // upstreamPhase2a_extractOCMap extracts the open-closed request map, updates the inner OCMap stored, potentially
 // sleeps if all slots are closed.
 func (p *PriFiLibRelayInstance) upstreamPhase2a_extractOCMap(roundID int32) error {
 	//classical DC-net decoding
-	clientSlices, trusteesSlices, err := p.relayState.roundManager.CollectRoundData()
-	if err != nil {
+	if err := p.finishDecodingRound(roundID); err != nil {
 		return err
 	}
-	for _, s := range clientSlices {
-		p.relayState.DCNet.DecodeClient(roundID, s)
-	}
-	for _, s := range trusteesSlices {
-		p.relayState.DCNet.DecodeTrustee(roundID, s)
-	}
 
 	//here we have the plaintext map
-	openClosedData, _ := p.relayState.DCNet.DecodeCell(true)
-
-	//compute the map
-	newSchedule := p.relayState.slotScheduler.Relay_ComputeFinalSchedule(openClosedData, p.relayState.nClients)
-	p.relayState.roundManager.SetStoredRoundSchedule(newSchedule)
+	openClosedData, _ := p.relayState.DCNet.DecodeCell(roundID, true)
+
+	//compute the map, and how many consecutive rounds each open slot gets
+	layout := p.relayState.slotScheduler.Relay_ComputeFinalLayout(openClosedData, p.relayState.OpenClosedSlotsPositions)
+	newSchedule := scheduler.OpenSlots(layout)
+	p.relayState.roundManager.SetStoredRoundLayout(layout)
+	p.relayState.schedulePending = false
+	if footprints, ok := p.relayState.slotScheduler.(*scheduler.FootprintSlotScheduler_Relay); ok && footprints.LastCollisions > 0 {
+		log.Lvl2("Relay : the schedule of round", roundID, "had", footprints.LastCollisions, "collisions, those clients will reserve again")
+	}
 	p.relayState.schedulesStatistics.AddSchedule(newSchedule)
 
 	// if all slots are closed, do not immediately send the next downstream data (which will be a OCSlots schedule)
@@ -374,84 +513,69 @@ func (p *PriFiLibRelayInstance) upstreamPhase2b_extractPayload() error {
 
 	// we decode the DC-net cell
 	roundID := p.relayState.roundManager.CurrentRound()
-	clientSlices, trusteesSlices, err := p.relayState.roundManager.CollectRoundData()
-	if err != nil {
+	if err := p.finishDecodingRound(roundID); err != nil {
 		return err
 	}
 
-	//decode all clients and trustees
-	for _, s := range clientSlices {
-		p.relayState.DCNet.DecodeClient(roundID, s)
-	}
-	for _, s := range trusteesSlices {
-		p.relayState.DCNet.DecodeTrustee(roundID, s)
-	}
-
-	upstreamPlaintext, ciphertext := p.relayState.DCNet.DecodeCell(false)
-	if p.relayState.EquivocationProtectionEnabled && p.relayState.DisruptionProtectionEnabled {
-		// Generating and storing the hash from the payload
-		p.relayState.HashOfLastUpstreamMessage = sha256.Sum256([]byte(ciphertext))
+	upstreamPlaintext, ciphertext := p.relayState.DCNet.DecodeCell(roundID, false)
+	if p.relayState.DisruptionProtectionEnabled {
+		// the slot owner checks the hash of the DC-net payload, and we echo it back if asked, see dcnet.CellLayout
+		p.relayState.HashOfLastUpstreamMessage = sha256.Sum256(ciphertext)
 		p.relayState.LastMessageOfClients[roundID] = ciphertext
 	}
 	p.relayState.bitrateStatistics.AddUpstreamCell(int64(len(upstreamPlaintext)))
 
-	if p.relayState.DisruptionProtectionEnabled {
-
-		var b_echo_last byte
-		b_echo_last = upstreamPlaintext[0]
-		p.relayState.BEchoFlags[roundID] = b_echo_last
-		p.relayState.DisruptionReveal = false
-		previousRound := roundID - int32(p.relayState.nClients)
-
-		if b_echo_last == 1 {
-			if len(upstreamPlaintext) > 13 && string(upstreamPlaintext[1:6]) == "BLAME" {
-				log.Error("Detected a BLAME request!")
-
-				blameRoundID := int32(binary.BigEndian.Uint32(upstreamPlaintext[6:10]))
-				blameBitPosition := int(binary.BigEndian.Uint32(upstreamPlaintext[10:14]))
-
-				_ = blameRoundID // TODO: This should be used insted of "previousRound-p.relayState.nClients"
-				blameRoundID = previousRound - int32(p.relayState.nClients)
-
-				log.Error("Disruption: Going into Blame phase 1. Round:", blameRoundID, ", bit position:", blameBitPosition)
-
-				p.relayState.DisruptionReveal = true
-
-				p.relayState.blamingData.RoundID = blameRoundID
-				p.relayState.blamingData.BitPos = blameBitPosition
+	if upstreamPlaintext != nil {
+		// the payload size changes with the key epochs
+		b_echo_last, data, err := p.relayState.DCNet.CellLayoutOfRound(roundID).SplitPayload(upstreamPlaintext)
+		if err != nil {
+			e := "Relay : DecodeCell produced wrong-size payload, " + err.Error()
+			log.Error(e)
+			return errors.New(e)
+		}
+		upstreamPlaintext = data
 
-				// Broadcast Blame phase 1
-				toSend := &net.REL_ALL_DISRUPTION_REVEAL{
-					RoundID: int32(p.relayState.blamingData.RoundID),
-					BitPos:  p.relayState.blamingData.BitPos,
-				}
-				for j := 0; j < p.relayState.nClients; j++ {
-					p.messageSender.SendToClientWithLog(j, toSend, "")
-				}
-				for j := 0; j < p.relayState.nTrustees; j++ {
-					p.messageSender.SendToTrusteeWithLog(j, toSend, "")
+		if p.relayState.DisruptionProtectionEnabled {
+			p.relayState.BEchoFlags[roundID] = b_echo_last
+			p.relayState.DisruptionReveal = false
+
+			if b_echo_last == 1 {
+				if len(data) >= 13 && string(data[0:5]) == "BLAME" {
+					log.Error("Detected a BLAME request!")
+
+					blameRoundID := int32(binary.BigEndian.Uint32(data[5:9]))
+					blameBitPosition := int(binary.BigEndian.Uint32(data[9:13]))
+
+					p.relayState.DisruptionReveal = true
+					if err := p.startBlame(blameRoundID, blameBitPosition); err != nil {
+						log.Error(err)
+					}
+				} else {
+					log.Lvl1("b_echo_last=", b_echo_last, "(current round:", roundID, ")")
 				}
-
-			} else {
-				log.Lvl1("b_echo_last=", b_echo_last, "(current round:", roundID, ")")
 			}
 		}
-		upstreamPlaintext = upstreamPlaintext[1:]
-		if !p.relayState.EquivocationProtectionEnabled {
-			// Saving in history
-			p.relayState.LastMessageOfClients[roundID] = upstreamPlaintext
-		}
+		p.relayState.payloadUsage.add(p.usedBytes(upstreamPlaintext), len(upstreamPlaintext))
+	}
 
-		//TEST
-		if p.relayState.roundManager.CurrentRound() == 100 {
-			//upstreamPlaintext[3] = 8
-		}
+	// a compressed cell can carry several messages, see compression.go
+	messages := [][]byte{upstreamPlaintext}
+	if p.relayState.UpstreamCompressionEnabled && upstreamPlaintext != nil {
+		messages = p.decompressUpstream(upstreamPlaintext)
+	}
+	for _, message := range messages {
+		p.handleUpstreamMessage(message)
+	}
 
-		if !p.relayState.EquivocationProtectionEnabled {
-			// Generating and storing the hash from the payload
-			p.relayState.HashOfLastUpstreamMessage = sha256.Sum256([]byte(upstreamPlaintext))
-		}
+	return nil
+}
+
+// handleUpstreamMessage gives a message of the slot owner to the latency tests, the pcap statistics, or the SOCKS/VPN
+func (p *PriFiLibRelayInstance) handleUpstreamMessage(upstreamPlaintext []byte) {
 
+	// the slot owner appended the key to which we encrypt the answers, see downstream.go
+	if p.relayState.DownstreamEncryptionEnabled && upstreamPlaintext != nil {
+		upstreamPlaintext = p.learnDownstreamKey(upstreamPlaintext)
 	}
 	log.Lvl4("Decoded cell is", upstreamPlaintext)
 
@@ -463,13 +587,13 @@ func (p *PriFiLibRelayInstance) upstreamPhase2b_extractPayload() error {
 			// then, we simply have to send it down
 			// log.Info("Relay noticed a latency-test message on round", p.relayState.dcnetRoundManager.CurrentRound())
 			p.relayState.PriorityDataForClients <- upstreamPlaintext
-		} else if pattern == 21845 {
-			//0101010101010101
+		} else if pattern == 21845 && len(upstreamPlaintext) >= 17 {
+			//0101010101010101, then the client ID, the packet ID, the timestamp and the fragmentation flag
 			clientID := uint16(binary.BigEndian.Uint16(upstreamPlaintext[2:4]))
 			ID := uint32(binary.BigEndian.Uint32(upstreamPlaintext[4:8]))
 			timestamp := int64(binary.BigEndian.Uint64(upstreamPlaintext[8:16]))
 			frag := false
-			if upstreamPlaintext[17] == byte(1) {
+			if upstreamPlaintext[16] == byte(1) {
 				frag = true
 			}
 			now := prifilog.MsTimeStampNow() - int64(p.relayState.time0)
@@ -490,7 +614,7 @@ func (p *PriFiLibRelayInstance) upstreamPhase2b_extractPayload() error {
 				ID := int32(binary.BigEndian.Uint32(upstreamPlaintext[pos+4 : pos+8]))
 				timestamp := int64(binary.BigEndian.Uint64(upstreamPlaintext[pos+8 : pos+16]))
 				frag := false
-				if upstreamPlaintext[pos+17] == byte(1) {
+				if upstreamPlaintext[pos+16] == byte(1) {
 					frag = true
 				}
 
@@ -508,27 +632,11 @@ func (p *PriFiLibRelayInstance) upstreamPhase2b_extractPayload() error {
 	}
 
 	if upstreamPlaintext != nil {
-		// verify that the decoded payload has the correct size
-		expectedSize := p.relayState.PayloadSize
-		if p.relayState.DisruptionProtectionEnabled {
-			// One less because of the b_echo_last flag
-			expectedSize--
-		}
-		if p.relayState.EquivocationProtectionEnabled {
-			expectedSize -= 16
-		}
-		if len(upstreamPlaintext) != expectedSize {
-			e := "Relay : DecodeCell produced wrong-size payload, " + strconv.Itoa(len(upstreamPlaintext)) + "!=" + strconv.Itoa(p.relayState.PayloadSize)
-			log.Error(e)
-			return errors.New(e)
-		}
-
+		p.relayState.bitrateStatistics.AddUpstreamData(int64(compression.DataLength(upstreamPlaintext)))
 		if p.relayState.DataOutputEnabled {
 			p.relayState.DataFromDCNet <- upstreamPlaintext
 		}
 	}
-
-	return nil
 }
 
 // upstreamPhase3_FinalizeRound happens when the data for the upstream round has been collected, and essentially
@@ -575,12 +683,24 @@ func (p *PriFiLibRelayInstance) upstreamPhase3_finalizeRound(roundID int32) erro
 
 	p.relayState.roundManager.CloseRound()
 
-	// clean history
+	// clean history; a blame comes two slots after the disrupted round, see disruption.go
+	earliestCiphers := p.relayState.roundManager.lastRoundClosed - 2*int32(p.relayState.nClients) - int32(p.relayState.WindowSize)
+	if p.relayState.blamingData.InProgress && p.relayState.blamingData.RoundID < earliestCiphers {
+		earliestCiphers = p.relayState.blamingData.RoundID
+	}
 	for _, m := range p.relayState.CiphertextsHistoryTrustees {
-		delete(m, roundID)
+		for k := range m {
+			if k < earliestCiphers {
+				delete(m, k)
+			}
+		}
 	}
 	for _, m := range p.relayState.CiphertextsHistoryClients {
-		delete(m, roundID)
+		for k := range m {
+			if k < earliestCiphers {
+				delete(m, k)
+			}
+		}
 	}
 	earliest := p.relayState.roundManager.lastRoundClosed - int32(p.relayState.nClients)
 	for k := range p.relayState.LastMessageOfClients {
@@ -589,10 +709,7 @@ func (p *PriFiLibRelayInstance) upstreamPhase3_finalizeRound(roundID int32) erro
 		}
 	}
 
-	// we just closed that round. If there is any other round opened (window > 1), directly prepare to decode it
-	if roundOpened, nextRoundID := p.relayState.roundManager.currentRound(); roundOpened {
-		p.relayState.DCNet.DecodeStart(nextRoundID)
-	}
+	p.startEpochIfNeeded(roundID)
 
 	return nil
 }
@@ -607,6 +724,7 @@ have the data already (and we're not waiting on it). Clean the old data.
 func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 
 	var downstreamCellContent []byte
+	flagEncrypted := false
 
 	select {
 	case downstreamCellContent = <-p.relayState.PriorityDataForClients:
@@ -623,6 +741,9 @@ func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 
 		// either select data from the data we have to send, if any
 		case downstreamCellContent = <-p.relayState.DataForClients:
+			if p.relayState.DownstreamEncryptionEnabled {
+				downstreamCellContent, flagEncrypted = p.encryptDownstream(downstreamCellContent)
+			}
 
 		default:
 			downstreamCellContent = make([]byte, 1)
@@ -635,6 +756,7 @@ func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 		if p.relayState.BEchoFlags[p.relayState.roundManager.lastRoundClosed] == 1 {
 			previousRound := p.relayState.roundManager.lastRoundClosed - int32(p.relayState.nClients)
 			downstreamCellContent = p.relayState.LastMessageOfClients[previousRound]
+			flagEncrypted = false
 			log.Lvl1("b_echo_last=1 on round", p.relayState.roundManager.lastRoundClosed, "retransmitting upstream of round", previousRound)
 			log.Lvl1(downstreamCellContent)
 		}
@@ -648,6 +770,7 @@ func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 	}
 
 	nextDownstreamRoundID := p.relayState.roundManager.NextRoundToOpen()
+	p.switchEpochIfNeeded(nextDownstreamRoundID)
 
 	// used if we're replaying a pcap. The first message we decode is "time0"
 	if nextDownstreamRoundID == 1 {
@@ -664,8 +787,15 @@ func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 		p.relayState.OpenClosedSlotsRequestsRoundID[nextDownstreamRoundID] = true
 	}
 
-	//compute next owner
-	nextOwner := p.relayState.roundManager.UpdateAndGetNextOwnerID()
+	//compute next owner; the footprint positions are drawn anew with each schedule, so nobody owns the rounds opened
+	//before the pending one is decoded
+	nextOwner := -1
+	if !p.relayState.schedulePending {
+		nextOwner = p.relayState.roundManager.UpdateAndGetNextOwnerID()
+	}
+	if flagOpenClosedRequest && p.relayState.OpenClosedSlotsScheduler == scheduler.SLOT_SCHEDULER_FOOTPRINT {
+		p.relayState.schedulePending = true
+	}
 
 	//sending data part
 	timing.StartMeasure("sending-data")
@@ -681,16 +811,21 @@ func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 		HashOfPreviousUpstreamData: p.relayState.HashOfLastUpstreamMessage[:],
 		Data:                       downstreamCellContent,
 		FlagResync:                 flagResync,
-		FlagOpenClosedRequest:      flagOpenClosedRequest}
+		FlagOpenClosedRequest:      flagOpenClosedRequest,
+		FlagEncrypted:              flagEncrypted}
 
-	if roundOpened, _ := p.relayState.roundManager.currentRound(); !roundOpened {
-		//prepare for the next round (this empties the dc-net buffer, making them ready for a new round)
-		p.relayState.DCNet.DecodeStart(nextDownstreamRoundID)
-	}
+	// the clients refuse the cells we did not sign, see downstream_chain.go
+	p.signDownstreamCell(toSend)
 
 	p.relayState.roundManager.OpenNextRound()
 	p.relayState.roundManager.SetDataAlreadySent(nextDownstreamRoundID, toSend)
 
+	// the clients hash this cell before encoding the round, see dcnet.UpdateReceivedMessageHistory
+	p.relayState.DCNet.UpdateReceivedMessageHistory(downstreamCellContent)
+
+	// the ciphers of this round are decoded as they arrive, in parallel with the other open rounds
+	p.startDecodingRound(nextDownstreamRoundID, nextOwner)
+
 	if !p.relayState.UseUDP {
 		// broadcast to all clients
 		for i := 0; i < p.relayState.nClients; i++ {
@@ -700,8 +835,8 @@ func (p *PriFiLibRelayInstance) downstreamPhase1_openRoundAndSendData() error {
 
 		p.relayState.bitrateStatistics.AddDownstreamCell(int64(len(downstreamCellContent)))
 	} else {
-		toSend2 := &net.REL_CLI_DOWNSTREAM_DATA_UDP{REL_CLI_DOWNSTREAM_DATA: *toSend}
-		p.messageSender.BroadcastToAllClientsWithLog(toSend2, "(UDP broadcast, round "+strconv.Itoa(int(nextDownstreamRoundID))+")")
+		// the clients ask for the fragments they miss, see broadcast.go
+		p.broadcastDownstreamCell(toSend, nil)
 
 		p.relayState.bitrateStatistics.AddDownstreamUDPCell(int64(len(downstreamCellContent)), p.relayState.nClients)
 	}
@@ -728,7 +863,7 @@ We do nothing, until we have received one per trustee; Then, we pack them in one
 */
 func (p *PriFiLibRelayInstance) Received_TRU_REL_TELL_PK(msg net.TRU_REL_TELL_PK) error {
 
-	p.relayState.trustees[msg.TrusteeID] = NodeRepresentation{msg.TrusteeID, true, msg.Pk, msg.Pk}
+	p.relayState.trustees[msg.TrusteeID] = NodeRepresentation{msg.TrusteeID, true, msg.Pk, msg.Pk, msg.Pk}
 	p.relayState.nTrusteesPkCollected++
 
 	log.Lvl2("Relay : received TRU_REL_TELL_PK (" + strconv.Itoa(p.relayState.nTrusteesPkCollected) + "/" + strconv.Itoa(p.relayState.nTrustees) + ")")
@@ -750,10 +885,18 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_TELL_PK(msg net.TRU_REL_TELL_PK
 		toSend.Add("StartNow", true)
 		toSend.Add("PayloadSize", p.relayState.PayloadSize)
 		toSend.Add("DCNetType", p.relayState.dcNetType)
+		toSend.Add("DCNetPadGenerator", p.relayState.dcNetPadGenerator)
 		toSend.Add("DisruptionProtectionEnabled", p.relayState.DisruptionProtectionEnabled)
 		toSend.Add("EquivocationProtectionEnabled", p.relayState.EquivocationProtectionEnabled)
 		toSend.Add("ForceDisruptionSinceRound3", p.relayState.ForceDisruptionSinceRound3)
+		toSend.Add("DownstreamEncryptionEnabled", p.relayState.DownstreamEncryptionEnabled)
+		toSend.Add("UpstreamCompressionEnabled", p.relayState.UpstreamCompressionEnabled)
+		toSend.Add("OpenClosedSlotsMaxLength", p.relayState.OpenClosedSlotsMaxLength)
+		toSend.Add("OpenClosedSlotsScheduler", p.relayState.OpenClosedSlotsScheduler)
+		toSend.Add("OpenClosedSlotsPositions", p.relayState.OpenClosedSlotsPositions)
 		toSend.TrusteesPks = trusteesPk
+		toSend.Add("Session", p.relayState.session)
+		p.addDownstreamChainParameters(toSend)
 
 		// Send those parameters to all clients
 		for j := 0; j < p.relayState.nClients; j++ {
@@ -775,7 +918,8 @@ and send them to the first trustee for it to Neff-Shuffle them.
 */
 func (p *PriFiLibRelayInstance) Received_CLI_REL_TELL_PK_AND_EPH_PK(msg net.CLI_REL_TELL_PK_AND_EPH_PK) error {
 
-	p.relayState.clients[msg.ClientID] = NodeRepresentation{msg.ClientID, true, msg.Pk, msg.EphPk}
+	p.relayState.clients[msg.ClientID] = NodeRepresentation{msg.ClientID, true, msg.Pk, msg.EphPk, nil}
+	p.relayState.ClientVerifiableDCNetKeys[msg.ClientID] = msg.VerifiableDCNetKey
 	p.relayState.nClientsPkCollected++
 
 	log.Lvl2("Relay : received CLI_REL_TELL_PK_AND_EPH_PK (" + strconv.Itoa(p.relayState.nClientsPkCollected) + "/" + strconv.Itoa(p.relayState.nClients) + ")")
@@ -875,11 +1019,22 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_TELL_NEW_BASE_AND_EPH_PKS(msg n
 			p.messageSender.SendToTrusteeWithLog(j, toSend, "(trustee "+strconv.Itoa(j+1)+")")
 		}
 
-		p.relayState.DCNet = dcnet.NewDCNetEntity(0, dcnet.DCNET_RELAY, p.relayState.PayloadSize,
-			p.relayState.EquivocationProtectionEnabled, nil)
+		if p.relayState.dcNetType == "Verifiable" {
+			p.relayState.DCNet = dcnet.NewVerifiableDCNetEntity(0, dcnet.DCNET_RELAY, p.relayState.PayloadSize, nil)
+			if err := p.relayState.DCNet.SetVerifiableDCNetKeys(p.relayState.ClientVerifiableDCNetKeys, p.relayState.VerifiableDCNetKeys); err != nil {
+				e := "Relay : could not use the VerifiableDCNetKeys, error is " + err.Error()
+				log.Error(e)
+				return errors.New(e)
+			}
+			p.relayState.DCNet.SetVerifiableSlots(p.relayState.neffShuffle.LastBase, p.relayState.EphemeralPublicKeys, -1, nil)
+		} else {
+			p.relayState.DCNet = dcnet.NewDCNetEntity(0, dcnet.DCNET_RELAY, p.relayState.PayloadSize,
+				p.relayState.EquivocationProtectionEnabled, p.relayState.dcNetPadGenerator, nil)
+			p.relayState.DCNet.DisruptionProtectionEnabled = p.relayState.DisruptionProtectionEnabled
+		}
 
-		// prepare to collect the ciphers
-		p.relayState.DCNet.DecodeStart(0)
+		// the ciphers are folded in as they arrive, from round 0 on
+		p.relayState.decoding = newDecodingPipeline(p.relayState.DCNet, p.relayState.nClients, p.relayState.nTrustees)
 
 		p.stateMachine.ChangeState("COLLECTING_SHUFFLE_SIGNATURES")
 
@@ -921,6 +1076,7 @@ func (p *PriFiLibRelayInstance) Received_TRU_REL_SHUFFLE_SIG(msg net.TRU_REL_SHU
 		msg := toSend5.(*net.REL_CLI_TELL_EPH_PKS_AND_TRUSTEES_SIG)
 		// changing state
 		p.relayState.roundManager.OpenNextRound()
+		p.startDecodingRound(0, -1) // there is no downstream data, hence no owner, in round 0
 		log.Lvl2("Relay : ready to communicate.")
 		p.stateMachine.ChangeState("COMMUNICATING")
 
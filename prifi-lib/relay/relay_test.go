@@ -9,6 +9,7 @@ import (
 	"github.com/dedis/prifi/prifi-lib/crypto"
 	"github.com/dedis/prifi/prifi-lib/dcnet"
 	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/sign/schnorr"
 	"go.dedis.ch/onet/v3/log"
 	"strconv"
@@ -105,7 +106,11 @@ func TestRelayRun1(t *testing.T) {
 	dataForClients := make(chan []byte, 6)
 	dataFromDCNet := make(chan []byte, 3)
 
-	relay := NewRelay(true, dataForClients, dataFromDCNet, resultChan, timeoutHandler, msw)
+	relay := NewRelay(true, dataForClients, dataFromDCNet, resultChan, timeoutHandler, nil, msw)
+	_, relayIdentityKey := crypto.NewKeyPair()
+	clientIdentity, clientIdentityKey := crypto.NewKeyPair()
+	trusteeIdentity, trusteeIdentityKey := crypto.NewKeyPair()
+	relay.SetIdentities(relayIdentityKey, net.Identities{Clients: []kyber.Point{clientIdentity}, Trustees: []kyber.Point{trusteeIdentity}})
 
 	//when receiving no message, client should have some parameters ready
 	rs := relay.relayState
@@ -419,6 +424,7 @@ func TestRelayRun1(t *testing.T) {
 		RoundID:  0,
 		Data:     emptyData.ToBytes(),
 	}
+	msg17.Signature, _ = net.SignCipher(clientIdentityKey, rs.session, 0, false, 0, msg17.Data)
 	if err := relay.ReceivedMessage(msg17); err != nil {
 		t.Error("Relay should be able to receive this message, but", err)
 	}
@@ -432,6 +438,7 @@ func TestRelayRun1(t *testing.T) {
 		RoundID:   0,
 		Data:      emptyData.ToBytes(),
 	}
+	msg18.Signature, _ = net.SignCipher(trusteeIdentityKey, rs.session, 0, true, 0, msg18.Data)
 	if err := relay.ReceivedMessage(msg18); err != nil {
 		t.Error("Relay should be able to receive this message, but", err)
 	}
@@ -461,9 +468,15 @@ func TestRelayRun2(t *testing.T) {
 	dataForClients := make(chan []byte, 6)
 	dataFromDCNet := make(chan []byte, 3)
 
-	relay := NewRelay(true, dataForClients, dataFromDCNet, resultChan, timeoutHandler, msw)
+	relay := NewRelay(true, dataForClients, dataFromDCNet, resultChan, timeoutHandler, nil, msw)
 	rs := relay.relayState
 
+	// with the disruption protection, the ciphers are signed with the keys of the server identities
+	_, relayIdentityKey := crypto.NewKeyPair()
+	clientIdentity, clientIdentityKey := crypto.NewKeyPair()
+	trusteeIdentity, trusteeIdentityKey := crypto.NewKeyPair()
+	relay.SetIdentities(relayIdentityKey, net.Identities{Clients: []kyber.Point{clientIdentity}, Trustees: []kyber.Point{trusteeIdentity}})
+
 	//we start by receiving a ALL_ALL_PARAMETERS from relay
 	msg := new(net.ALL_ALL_PARAMETERS)
 	msg.ForceParams = true
@@ -605,6 +618,10 @@ func TestRelayRun2(t *testing.T) {
 		RoundID:   0,
 		Data:      emptyData.ToBytes(),
 	}
+	if err := relay.ReceivedMessage(msg17); err == nil {
+		t.Error("Relay should refuse an unsigned cipher")
+	}
+	msg17.Signature, _ = net.SignCipher(trusteeIdentityKey, rs.session, 0, true, 0, msg17.Data)
 	if err := relay.ReceivedMessage(msg17); err != nil {
 		t.Error("Relay should be able to receive this message, but", err)
 	}
@@ -619,6 +636,11 @@ func TestRelayRun2(t *testing.T) {
 		RoundID:  0,
 		Data:     emptyData.ToBytes(),
 	}
+	msg18.Signature, _ = net.SignCipher(trusteeIdentityKey, rs.session, 0, false, 0, msg18.Data)
+	if err := relay.ReceivedMessage(msg18); err == nil {
+		t.Error("Relay should refuse a cipher not signed by the client")
+	}
+	msg18.Signature, _ = net.SignCipher(clientIdentityKey, rs.session, 0, false, 0, msg18.Data)
 	if err := relay.ReceivedMessage(msg18); err != nil {
 		t.Error("Relay should be able to receive this message, but", err)
 	}
@@ -629,6 +651,7 @@ func TestRelayRun2(t *testing.T) {
 		RoundID:   1,
 		Data:      emptyData.ToBytes(),
 	}
+	msg19.Signature, _ = net.SignCipher(trusteeIdentityKey, rs.session, 1, true, 0, msg19.Data)
 	if err := relay.ReceivedMessage(msg19); err != nil {
 		t.Error("Relay should be able to receive this message, but", err)
 	}
@@ -639,6 +662,7 @@ func TestRelayRun2(t *testing.T) {
 		RoundID:  1,
 		Data:     emptyData.ToBytes(),
 	}
+	msg20.Signature, _ = net.SignCipher(clientIdentityKey, rs.session, 1, false, 0, msg20.Data)
 	if err := relay.ReceivedMessage(msg20); err != nil {
 		t.Error("Relay should be able to receive this message, but", err)
 	}
@@ -662,7 +686,7 @@ func TestRelayRun3(t *testing.T) {
 	dataForClients := make(chan []byte, 6)
 	dataFromDCNet := make(chan []byte, 3)
 
-	relay := NewRelay(true, dataForClients, dataFromDCNet, resultChan, timeoutHandler, msw)
+	relay := NewRelay(true, dataForClients, dataFromDCNet, resultChan, timeoutHandler, nil, msw)
 
 	//we start by receiving a ALL_ALL_PARAMETERS from relay
 	msg := new(net.ALL_ALL_PARAMETERS)
@@ -857,7 +881,7 @@ func TestRelayRun3(t *testing.T) {
 	binary.BigEndian.PutUint64(latencyMessage[4:12], uint64(currentTime))
 
 	latencyMessage2 := dcnet.DCNetCipher{
-		Payload: latencyMessage,
+		Payload: append(latencyMessage, make([]byte, upCellSize-len(latencyMessage))...),
 	}
 
 	msg18 := net.CLI_REL_UPSTREAM_DATA{
@@ -895,8 +919,6 @@ func TestRelayRun3(t *testing.T) {
 
 func TestRelayRun4(t *testing.T) {
 
-	t.Skip() //Verifiable DC-net disabled for now
-
 	timeoutHandler := func(clients, trustees []int) { log.Error(clients, trustees) }
 	resultChan := make(chan interface{}, 1)
 
@@ -907,7 +929,7 @@ func TestRelayRun4(t *testing.T) {
 	dataForClients := make(chan []byte, 6)
 	dataFromDCNet := make(chan []byte, 3)
 
-	relay := NewRelay(true, dataForClients, dataFromDCNet, resultChan, timeoutHandler, msw)
+	relay := NewRelay(true, dataForClients, dataFromDCNet, resultChan, timeoutHandler, nil, msw)
 
 	//we start by receiving a ALL_ALL_PARAMETERS from relay
 	msg := new(net.ALL_ALL_PARAMETERS)
@@ -984,7 +1006,7 @@ func TestRelayRun4(t *testing.T) {
 		t.Error("DCNetType not passed correctly to Client")
 	}
 
-	relay2 := NewRelay(true, dataForClients, dataFromDCNet, resultChan, timeoutHandler, msw)
+	relay2 := NewRelay(true, dataForClients, dataFromDCNet, resultChan, timeoutHandler, nil, msw)
 
 	//we start by receiving a ALL_ALL_PARAMETERS from relay
 	msg21 := new(net.ALL_ALL_PARAMETERS)
@@ -1005,3 +1027,85 @@ func TestRelayRun4(t *testing.T) {
 		t.Error("Relay should output an error when DCNetType != {Simple, Verifiable}")
 	}
 }
+
+// ciphers of a round with 100 clients and 3 trustees, as received by the relay
+func benchmarkRoundCiphers(payloadSize int) (*dcnet.DCNetEntity, [][]byte, [][]byte) {
+	dcNet := dcnet.NewDCNetEntity(0, dcnet.DCNET_RELAY, payloadSize, false, dcnet.PAD_GENERATOR_XOF, nil)
+	cipher := (&dcnet.DCNetCipher{Payload: make([]byte, payloadSize)}).ToBytes()
+	clientCiphers := make([][]byte, 100)
+	for i := range clientCiphers {
+		clientCiphers[i] = cipher
+	}
+	trusteeCiphers := make([][]byte, 3)
+	for j := range trusteeCiphers {
+		trusteeCiphers[j] = cipher
+	}
+	return dcNet, clientCiphers, trusteeCiphers
+}
+
+// the rounds are decoded one after the other, once all their ciphers are there
+func benchmarkSequentialDecoding(b *testing.B, payloadSize int) {
+	dcNet, clientCiphers, trusteeCiphers := benchmarkRoundCiphers(payloadSize)
+	b.SetBytes(int64(payloadSize * (len(clientCiphers) + len(trusteeCiphers))))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		roundID := int32(i)
+		dcNet.DecodeStart(roundID)
+		for _, c := range clientCiphers {
+			dcNet.DecodeClient(roundID, c)
+		}
+		for _, c := range trusteeCiphers {
+			dcNet.DecodeTrustee(roundID, c)
+		}
+		dcNet.DecodeCell(roundID, false)
+	}
+}
+
+// the rounds of the window are decoded in parallel, their ciphers arriving interleaved; only the finalization is ordered
+func benchmarkPipelinedDecoding(b *testing.B, payloadSize, window int) {
+	dcNet, clientCiphers, trusteeCiphers := benchmarkRoundCiphers(payloadSize)
+	pipeline := newDecodingPipeline(dcNet, len(clientCiphers), len(trusteeCiphers))
+	b.SetBytes(int64(payloadSize * (len(clientCiphers) + len(trusteeCiphers))))
+	b.ResetTimer()
+	for i := 0; i < b.N; i += window {
+		firstRound, lastRound := int32(i), int32(i+window-1)
+		if int(lastRound) >= b.N {
+			lastRound = int32(b.N - 1)
+		}
+		for roundID := firstRound; roundID <= lastRound; roundID++ {
+			pipeline.start(roundID, -1, nil, nil, nil)
+		}
+		for clientID, c := range clientCiphers {
+			for roundID := firstRound; roundID <= lastRound; roundID++ {
+				pipeline.addClientCipher(roundID, clientID, c)
+			}
+		}
+		for trusteeID, c := range trusteeCiphers {
+			for roundID := firstRound; roundID <= lastRound; roundID++ {
+				pipeline.addTrusteeCipher(roundID, trusteeID, c)
+			}
+		}
+		for roundID := firstRound; roundID <= lastRound; roundID++ {
+			if err := pipeline.finish(roundID); err != nil {
+				b.Fatal(err)
+			}
+			dcNet.DecodeCell(roundID, false)
+		}
+	}
+}
+
+func BenchmarkSequentialDecoding(b *testing.B) {
+	benchmarkSequentialDecoding(b, 10000)
+}
+
+func BenchmarkPipelinedDecodingWindow1(b *testing.B) {
+	benchmarkPipelinedDecoding(b, 10000, 1)
+}
+
+func BenchmarkPipelinedDecodingWindow4(b *testing.B) {
+	benchmarkPipelinedDecoding(b, 10000, 4)
+}
+
+func BenchmarkPipelinedDecodingWindow10(b *testing.B) {
+	benchmarkPipelinedDecoding(b, 10000, 10)
+}
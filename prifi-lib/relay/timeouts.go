@@ -27,7 +27,8 @@ func (p *PriFiLibRelayInstance) checkIfRoundHasEndedAfterTimeOut_Phase1(roundID
 		return //nothing to ensure in that case
 	}
 
-	// new policy : just kill that round, do not retransmit, let SOCKS take care of the loss
+	// new policy : just kill that round, do not retransmit; the stream-multiplexer re-sends the frames it carried (see
+	// stream-multiplexer/arq.go)
 
 	p.relayState.numberOfConsecutiveFailedRounds++
 	log.Lvl1("WARNING: Timeout for round", roundID, ", force closing. Already", p.relayState.numberOfConsecutiveFailedRounds,
@@ -50,15 +51,10 @@ func (p *PriFiLibRelayInstance) checkIfRoundHasEndedAfterTimeOut_Phase1(roundID
 		p.relayState.roundManager.Dump()
 		p.relayState.roundManager.ForceCloseRound()
 		p.relayState.roundManager.Dump()
+		p.relayState.decoding.discard(roundID)
 
 		p.relayState.numberOfNonAckedDownstreamPackets-- // packet is not "in-flight" because it is lost
 
-		// if we still have open rounds (after closing this one), we need to tell the DC-net to move to this new round
-		if roundOpened, roundID := p.relayState.roundManager.currentRound(); roundOpened {
-			//prepare for the next round (this empties the dc-net buffer, making them ready for a new round)
-			p.relayState.DCNet.DecodeStart(roundID)
-		}
-
 		// if we can, open new rounds
 		p.downstreamPhase_sendMany()
 
@@ -4,63 +4,92 @@ import (
 	"math"
 )
 
-// SlotScheduler is a protocol between the relay and the clients that allows to decide which slots are gonna be
-// "open" (fixed-length byte array) or "closed" (inexistant, no message at all)
-type SlotScheduler interface {
-
-	//the client receives a new schedule request from the relay
-	Client_ReceivedScheduleRequest()
-
-	//the client alters the schedule being computed, and ask to transmit
-	Client_ReserveRound(slotID int)
-
-	//return the schedule to send as payload
-	Client_GetOpenScheduleContribution() []byte
-
-	//Called with each client's contribution
-	Relay_CombineContributions(contributions ...[]byte) []byte
-
-	// returns all contributions in forms of a map of open slots
-	Relay_ComputeFinalSchedule() map[int]bool
-}
-
 // BitMaskScheduler_Client holds the info necessary for a client to compute his "contribution", or part of the bitmask
 type BitMaskSlotScheduler_Client struct {
 	NClients          int
 	ClientWantsToSend bool
 	MySlotID          int
+
+	// with MaxSlotLength > 1, each slot has a field of SlotLengthBits(MaxSlotLength) bits in the bitmask, holding the
+	// number of consecutive rounds its owner reserves; otherwise, one bit
+	MaxSlotLength     int
+	MyRoundsToReserve int
 }
 
 // BitMaskScheduler_Relay
 type BitMaskSlotScheduler_Relay struct {
+	MaxSlotLength int // must be the clients' one
+}
+
+// SlotLengthBits returns how many bits of the bitmask each slot takes, so a client can reserve up to maxSlotLength
+// consecutive rounds
+func SlotLengthBits(maxSlotLength int) int {
+	bits := 1
+	for (1<<uint(bits))-1 < maxSlotLength {
+		bits++
+	}
+	return bits
 }
 
 // Client_ReceivedScheduleRequest instantiates the fields of BitMaskScheduler_Client
 func (bmc *BitMaskSlotScheduler_Client) Client_ReceivedScheduleRequest(nClients int) {
 	bmc.NClients = nClients
 	bmc.ClientWantsToSend = false
+	bmc.MyRoundsToReserve = 0
 }
 
 // Client_ReserveRound indicates to reserve a slot in the next round
 func (bmc *BitMaskSlotScheduler_Client) Client_ReserveRound(slotID int) {
+	bmc.Client_ReserveRounds(slotID, 1)
+}
+
+// Client_ReserveRounds indicates to reserve nRounds consecutive rounds for our slot, at most MaxSlotLength
+func (bmc *BitMaskSlotScheduler_Client) Client_ReserveRounds(slotID int, nRounds int) {
+	if nRounds > bmc.maxSlotLength() {
+		nRounds = bmc.maxSlotLength()
+	}
+	if nRounds < 1 {
+		return
+	}
 	bmc.MySlotID = slotID
 	bmc.ClientWantsToSend = true
+	bmc.MyRoundsToReserve = nRounds
+}
+
+// Client_MyOwnerID returns our slot if we reserved it, -1 otherwise
+func (bmc *BitMaskSlotScheduler_Client) Client_MyOwnerID() int {
+	if !bmc.ClientWantsToSend {
+		return -1
+	}
+	return bmc.MySlotID
+}
+
+func (bmc *BitMaskSlotScheduler_Client) maxSlotLength() int {
+	if bmc.MaxSlotLength < 1 {
+		return 1
+	}
+	return bmc.MaxSlotLength
 }
 
 // Client_GetOpenScheduleContribution computes their contribution as a bit array
 func (bmc *BitMaskSlotScheduler_Client) Client_GetOpenScheduleContribution() []byte {
-	//length of the contribution is nClients/8 bytes
-	nBytes := int(math.Ceil(float64(bmc.NClients) / 8))
+	//length of the contribution is nClients*bits/8 bytes
+	bits := SlotLengthBits(bmc.MaxSlotLength)
+	nBytes := int(math.Ceil(float64(bmc.NClients*bits) / 8))
 	payload := make([]byte, nBytes)
 
 	if !bmc.ClientWantsToSend {
 		return payload //all zeros
 	}
 
-	//set a bit to 1 at the correct position
-	whichByte := int(math.Floor(float64(bmc.MySlotID) / 8))
-	whichBit := uint(bmc.MySlotID % 8)
-	payload[whichByte] = 1 << whichBit
+	//write the number of rounds in the field of our slot, lowest bit first
+	for i := 0; i < bits; i++ {
+		if bmc.MyRoundsToReserve&(1<<uint(i)) == 0 {
+			continue
+		}
+		bitIndex := bmc.MySlotID*bits + i
+		payload[bitIndex/8] |= 1 << uint(bitIndex%8)
+	}
 	return payload
 }
 
@@ -78,6 +107,9 @@ func (bmr *BitMaskSlotScheduler_Relay) Relay_CombineContributions(contributions
 
 // Relay_ComputeFinalSchedule computes the map[int32]bool of open slots in the next round given the stored contributions
 func (bmr *BitMaskSlotScheduler_Relay) Relay_ComputeFinalSchedule(allContributions []byte, maxSlots int) map[int]bool {
+	if bmr.MaxSlotLength > 1 {
+		return OpenSlots(bmr.Relay_ComputeFinalLayout(allContributions, maxSlots))
+	}
 
 	//this schedules goes from [0; maxSlots[
 	res := make(map[int]bool)
@@ -99,3 +131,39 @@ func (bmr *BitMaskSlotScheduler_Relay) Relay_ComputeFinalSchedule(allContributio
 
 	return res
 }
+
+// Relay_ComputeFinalLayout computes the number of consecutive rounds reserved by each slot in [0; maxSlots[ given the
+// stored contributions, 0 if the slot is closed
+func (bmr *BitMaskSlotScheduler_Relay) Relay_ComputeFinalLayout(allContributions []byte, maxSlots int) map[int]int {
+	bits := SlotLengthBits(bmr.MaxSlotLength)
+	res := make(map[int]int)
+
+	for slot := 0; slot < maxSlots; slot++ {
+		length := 0
+		for i := 0; i < bits; i++ {
+			bitIndex := slot*bits + i
+			if bitIndex/8 >= len(allContributions) {
+				break
+			}
+			if allContributions[bitIndex/8]&(1<<uint(bitIndex%8)) > 0 {
+				length |= 1 << uint(i)
+			}
+		}
+		// a disruptor could set more than allowed, the bits of its field are all it can spoil
+		if bmr.MaxSlotLength > 0 && length > bmr.MaxSlotLength {
+			length = bmr.MaxSlotLength
+		}
+		res[slot] = length
+	}
+
+	return res
+}
+
+// OpenSlots returns which slots of a layout are open, i.e. reserved at least one round
+func OpenSlots(layout map[int]int) map[int]bool {
+	res := make(map[int]bool)
+	for slot, length := range layout {
+		res[slot] = length > 0
+	}
+	return res
+}
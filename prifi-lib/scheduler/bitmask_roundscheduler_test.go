@@ -92,3 +92,78 @@ func Test2Client(t *testing.T) {
 
 	fmt.Println(finalSched)
 }
+
+func TestSlotLengthBits(t *testing.T) {
+	expected := map[int]int{0: 1, 1: 1, 2: 2, 3: 2, 4: 3, 7: 3, 8: 4, 15: 4}
+	for maxLength, bits := range expected {
+		if SlotLengthBits(maxLength) != bits {
+			t.Error("SlotLengthBits(", maxLength, ") should be", bits, ", is", SlotLengthBits(maxLength))
+		}
+	}
+}
+
+func TestVariableLengthSlots(t *testing.T) {
+
+	nClients := 5
+	maxLength := 4 // 3 bits per slot, 15 bits in total
+
+	//slot -> rounds asked
+	asked := map[int]int{0: 1, 2: 4, 3: 9, 4: 0}
+	expected := map[int]int{0: 1, 1: 0, 2: 4, 3: 4, 4: 0}
+
+	contributions := make([][]byte, 0)
+	for slot, nRounds := range asked {
+		bmc := new(BitMaskSlotScheduler_Client)
+		bmc.MaxSlotLength = maxLength
+		bmc.Client_ReceivedScheduleRequest(nClients)
+		bmc.Client_ReserveRounds(slot, nRounds)
+		contribution := bmc.Client_GetOpenScheduleContribution()
+		if len(contribution) != 2 {
+			t.Error("Contribution should have length 2, has length", len(contribution))
+		}
+		contributions = append(contributions, contribution)
+	}
+
+	bmr := new(BitMaskSlotScheduler_Relay)
+	bmr.MaxSlotLength = maxLength
+	layout := bmr.Relay_ComputeFinalLayout(bmr.Relay_CombineContributions(contributions...), nClients)
+
+	if len(layout) != nClients {
+		t.Error("layout should have length", nClients, ", has length", len(layout))
+	}
+	for slot, nRounds := range expected {
+		if layout[slot] != nRounds {
+			t.Error("slot", slot, "should have", nRounds, "rounds, has", layout[slot])
+		}
+	}
+
+	finalSched := bmr.Relay_ComputeFinalSchedule(bmr.Relay_CombineContributions(contributions...), nClients)
+	for slot, nRounds := range expected {
+		if finalSched[slot] != (nRounds > 0) {
+			t.Error("slot", slot, "should be open:", nRounds > 0)
+		}
+	}
+
+	//a disruptor setting all bits only gets the maximum length
+	allOnes := []byte{0xFF, 0xFF}
+	layout = bmr.Relay_ComputeFinalLayout(allOnes, nClients)
+	for slot := 0; slot < nClients; slot++ {
+		if layout[slot] != maxLength {
+			t.Error("slot", slot, "should have", maxLength, "rounds, has", layout[slot])
+		}
+	}
+}
+
+func TestVariableLengthSlotsCompatibility(t *testing.T) {
+
+	//with one round per slot, the contribution is the plain bitmask
+	bmc := new(BitMaskSlotScheduler_Client)
+	bmc.MaxSlotLength = 1
+	bmc.Client_ReceivedScheduleRequest(10)
+	bmc.Client_ReserveRounds(9, 3)
+	contribution := bmc.Client_GetOpenScheduleContribution()
+
+	if len(contribution) != 2 || contribution[0] != 0 || contribution[1] != 2 {
+		t.Error("Contribution should be the bitmask [0 2], is", contribution)
+	}
+}
@@ -0,0 +1,166 @@
+package scheduler
+
+/*
+Footprint scheduling
+********************
+Instead of one field per slot of the shuffle, the schedule has NSlots reservation positions, which can be more or fewer
+than the clients. A client that wants to transmit picks a position at random, and writes its footprint there: a random
+nonce, the number of consecutive rounds it wants, and a checksum of both. Two clients on the same position XOR their
+footprints, which (but with probability 2^-16) breaks the checksum: the relay sees the collision, and does not schedule
+that position. The owner IDs the relay announces are then the positions, and the clients that got no round simply
+reserve again in the next schedule, at a new random position.
+*/
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+)
+
+// FOOTPRINT_NONCE_SIZE is the size of the random part of a footprint
+const FOOTPRINT_NONCE_SIZE = 2
+
+// FOOTPRINT_CHECKSUM_SIZE is the size of the checksum of a footprint, which detects the collisions
+const FOOTPRINT_CHECKSUM_SIZE = 2
+
+// FOOTPRINT_SIZE is the size of a footprint: nonce, number of rounds, checksum
+const FOOTPRINT_SIZE = FOOTPRINT_NONCE_SIZE + 1 + FOOTPRINT_CHECKSUM_SIZE
+
+// FootprintSlotScheduler_Client holds the reservation of a client: its position and its footprint
+type FootprintSlotScheduler_Client struct {
+	NSlots            int
+	MaxSlotLength     int
+	ClientWantsToSend bool
+	MyPosition        int
+	MyFootprint       []byte
+}
+
+// FootprintSlotScheduler_Relay computes the layout from the combined footprints
+type FootprintSlotScheduler_Relay struct {
+	MaxSlotLength  int // must be the clients' one
+	LastCollisions int // the number of collisions seen in the last layout computed
+}
+
+// footprintChecksum returns the checksum of the nonce and number of rounds of a footprint
+func footprintChecksum(footprint []byte) []byte {
+	hash := sha256.Sum256(footprint[:FOOTPRINT_NONCE_SIZE+1])
+	return hash[:FOOTPRINT_CHECKSUM_SIZE]
+}
+
+// Client_ReceivedScheduleRequest instantiates the fields of FootprintSlotScheduler_Client
+func (fc *FootprintSlotScheduler_Client) Client_ReceivedScheduleRequest(nSlots int) {
+	fc.NSlots = nSlots
+	fc.ClientWantsToSend = false
+	fc.MyPosition = -1
+	fc.MyFootprint = nil
+}
+
+// Client_ReserveRounds picks a random position, and a footprint asking nRounds consecutive rounds, at most
+// MaxSlotLength. The slotID is not used, the position replaces it.
+func (fc *FootprintSlotScheduler_Client) Client_ReserveRounds(slotID int, nRounds int) {
+	maxSlotLength := fc.MaxSlotLength
+	if maxSlotLength < 1 {
+		maxSlotLength = 1
+	}
+	if maxSlotLength > 255 {
+		maxSlotLength = 255
+	}
+	if nRounds > maxSlotLength {
+		nRounds = maxSlotLength
+	}
+	if nRounds < 1 || fc.NSlots < 1 {
+		return
+	}
+
+	position, err := rand.Int(rand.Reader, big.NewInt(int64(fc.NSlots)))
+	if err != nil {
+		panic(err.Error())
+	}
+
+	// the nonce is not zero, so an empty position is never a valid footprint
+	footprint := make([]byte, FOOTPRINT_SIZE)
+	for binary.BigEndian.Uint16(footprint[:FOOTPRINT_NONCE_SIZE]) == 0 {
+		if _, err := rand.Read(footprint[:FOOTPRINT_NONCE_SIZE]); err != nil {
+			panic(err.Error())
+		}
+	}
+	footprint[FOOTPRINT_NONCE_SIZE] = byte(nRounds)
+	copy(footprint[FOOTPRINT_NONCE_SIZE+1:], footprintChecksum(footprint))
+
+	fc.ClientWantsToSend = true
+	fc.MyPosition = int(position.Int64())
+	fc.MyFootprint = footprint
+}
+
+// Client_GetOpenScheduleContribution writes our footprint at our position, in NSlots*FOOTPRINT_SIZE bytes
+func (fc *FootprintSlotScheduler_Client) Client_GetOpenScheduleContribution() []byte {
+	payload := make([]byte, fc.NSlots*FOOTPRINT_SIZE)
+	if fc.ClientWantsToSend {
+		copy(payload[fc.MyPosition*FOOTPRINT_SIZE:], fc.MyFootprint)
+	}
+	return payload
+}
+
+// Client_MyOwnerID returns our position if we reserved one, -1 otherwise
+func (fc *FootprintSlotScheduler_Client) Client_MyOwnerID() int {
+	if !fc.ClientWantsToSend {
+		return -1
+	}
+	return fc.MyPosition
+}
+
+// Relay_CombineContributions combines (XOR) the received contributions from each clients. In the real DC-net,
+// this is done automatically by the DC-net
+func (fr *FootprintSlotScheduler_Relay) Relay_CombineContributions(contributions ...[]byte) []byte {
+	out := make([]byte, len(contributions[0]))
+	for j := range contributions {
+		for i := range contributions[j] {
+			out[i] ^= contributions[j][i]
+		}
+	}
+	return out
+}
+
+// Relay_ComputeFinalLayout computes the number of consecutive rounds reserved at each position in [0; maxSlots[,
+// 0 if the position is empty or has a collision
+func (fr *FootprintSlotScheduler_Relay) Relay_ComputeFinalLayout(allContributions []byte, maxSlots int) map[int]int {
+	res := make(map[int]int)
+	fr.LastCollisions = 0
+
+	for position := 0; position < maxSlots; position++ {
+		res[position] = 0
+		if (position+1)*FOOTPRINT_SIZE > len(allContributions) {
+			continue
+		}
+		footprint := allContributions[position*FOOTPRINT_SIZE : (position+1)*FOOTPRINT_SIZE]
+
+		empty := true
+		for _, b := range footprint {
+			if b != 0 {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			continue
+		}
+
+		nRounds := int(footprint[FOOTPRINT_NONCE_SIZE])
+		valid := binary.BigEndian.Uint16(footprint[:FOOTPRINT_NONCE_SIZE]) != 0 && nRounds > 0 &&
+			bytes.Equal(footprint[FOOTPRINT_NONCE_SIZE+1:], footprintChecksum(footprint))
+		if !valid {
+			fr.LastCollisions++
+			continue
+		}
+
+		// a disruptor could ask more than allowed
+		if fr.MaxSlotLength > 0 && nRounds > fr.MaxSlotLength {
+			nRounds = fr.MaxSlotLength
+		}
+		res[position] = nRounds
+	}
+
+	return res
+}
@@ -0,0 +1,170 @@
+package scheduler
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSlotSchedulerTypes(t *testing.T) {
+	for _, schedulerType := range []string{"", SLOT_SCHEDULER_BITMASK, SLOT_SCHEDULER_FOOTPRINT} {
+		if !IsValidSlotScheduler(schedulerType) {
+			t.Error(schedulerType, "should be valid")
+		}
+		if _, err := NewSlotSchedulerClient(schedulerType, 1); err != nil {
+			t.Error(err)
+		}
+		if _, err := NewSlotSchedulerRelay(schedulerType, 1); err != nil {
+			t.Error(err)
+		}
+	}
+	if IsValidSlotScheduler("Lottery") {
+		t.Error("Lottery should not be valid")
+	}
+	if _, err := NewSlotSchedulerClient("Lottery", 1); err == nil {
+		t.Error("Should not create an unknown scheduler")
+	}
+	if _, err := NewSlotSchedulerRelay("Lottery", 1); err == nil {
+		t.Error("Should not create an unknown scheduler")
+	}
+}
+
+func TestFootprintClient(t *testing.T) {
+	nSlots := 10
+
+	fc := &FootprintSlotScheduler_Client{MaxSlotLength: 4}
+	fc.Client_ReceivedScheduleRequest(nSlots)
+	if fc.Client_MyOwnerID() != -1 {
+		t.Error("Should have no position before reserving")
+	}
+	empty := fc.Client_GetOpenScheduleContribution()
+	if len(empty) != nSlots*FOOTPRINT_SIZE {
+		t.Error("Contribution should have length", nSlots*FOOTPRINT_SIZE, ", has length", len(empty))
+	}
+
+	fc.Client_ReserveRounds(0, 7)
+	position := fc.Client_MyOwnerID()
+	if position < 0 || position >= nSlots {
+		t.Error("Position", position, "is out of the schedule")
+	}
+
+	fr := &FootprintSlotScheduler_Relay{MaxSlotLength: 4}
+	layout := fr.Relay_ComputeFinalLayout(fc.Client_GetOpenScheduleContribution(), nSlots)
+	if len(layout) != nSlots {
+		t.Error("layout should have length", nSlots, ", has length", len(layout))
+	}
+	for p, nRounds := range layout {
+		if p == position && nRounds != 4 {
+			t.Error("Position", p, "should have the 4 rounds allowed, has", nRounds)
+		}
+		if p != position && nRounds != 0 {
+			t.Error("Position", p, "should be closed, has", nRounds)
+		}
+	}
+	if fr.LastCollisions != 0 {
+		t.Error("There should be no collision")
+	}
+
+	// a new schedule forgets the reservation
+	fc.Client_ReceivedScheduleRequest(nSlots)
+	if fc.Client_MyOwnerID() != -1 {
+		t.Error("Should have no position after a new request")
+	}
+}
+
+func TestFootprintCollision(t *testing.T) {
+	nSlots := 4
+
+	fc1 := &FootprintSlotScheduler_Client{MaxSlotLength: 2}
+	fc2 := &FootprintSlotScheduler_Client{MaxSlotLength: 2}
+	fc3 := &FootprintSlotScheduler_Client{MaxSlotLength: 2}
+	for _, fc := range []*FootprintSlotScheduler_Client{fc1, fc2, fc3} {
+		fc.Client_ReceivedScheduleRequest(nSlots)
+		fc.Client_ReserveRounds(0, 1)
+	}
+
+	// 1 and 2 collide on position 1, 3 is alone on position 3
+	fc1.MyPosition = 1
+	fc2.MyPosition = 1
+	fc3.MyPosition = 3
+
+	fr := &FootprintSlotScheduler_Relay{MaxSlotLength: 2}
+	contributions := fr.Relay_CombineContributions(fc1.Client_GetOpenScheduleContribution(),
+		fc2.Client_GetOpenScheduleContribution(), fc3.Client_GetOpenScheduleContribution())
+	layout := fr.Relay_ComputeFinalLayout(contributions, nSlots)
+
+	if layout[1] != 0 {
+		t.Error("Position 1 has a collision and should be closed")
+	}
+	if layout[3] != 1 {
+		t.Error("Position 3 should have 1 round, has", layout[3])
+	}
+	if layout[0] != 0 || layout[2] != 0 {
+		t.Error("Positions 0 and 2 should be closed")
+	}
+	if fr.LastCollisions != 1 {
+		t.Error("There should be 1 collision, there are", fr.LastCollisions)
+	}
+}
+
+// footprintTrial lets nClients reserve among nSlots positions, and returns how many got their rounds, how many
+// collisions the relay saw, and how many positions it scheduled for several clients
+func footprintTrial(nClients, nSlots int) (int, int, int) {
+	clients := make([]*FootprintSlotScheduler_Client, nClients)
+	contributions := make([][]byte, nClients)
+	clientsAt := make(map[int]int)
+	for i := range clients {
+		clients[i] = &FootprintSlotScheduler_Client{MaxSlotLength: 1}
+		clients[i].Client_ReceivedScheduleRequest(nSlots)
+		clients[i].Client_ReserveRounds(0, 1)
+		contributions[i] = clients[i].Client_GetOpenScheduleContribution()
+		clientsAt[clients[i].Client_MyOwnerID()]++
+	}
+
+	fr := &FootprintSlotScheduler_Relay{MaxSlotLength: 1}
+	layout := fr.Relay_ComputeFinalLayout(fr.Relay_CombineContributions(contributions...), nSlots)
+
+	scheduled := 0
+	undetected := 0
+	for position, nRounds := range layout {
+		if nRounds == 0 {
+			continue
+		}
+		if clientsAt[position] == 1 {
+			scheduled++
+		} else {
+			undetected++
+		}
+	}
+	return scheduled, fr.LastCollisions, undetected
+}
+
+func TestFootprintCollisionRates(t *testing.T) {
+	trials := 300
+
+	for _, c := range []struct{ nClients, nSlots int }{{5, 5}, {10, 20}, {20, 10}, {30, 90}} {
+		scheduled, collisions, undetected := 0, 0, 0
+		for i := 0; i < trials; i++ {
+			s, n, u := footprintTrial(c.nClients, c.nSlots)
+			scheduled += s
+			collisions += n
+			undetected += u
+		}
+
+		// a client gets its rounds if none of the others picked its position
+		successRate := float64(scheduled) / float64(trials*c.nClients)
+		expected := math.Pow(1-1/float64(c.nSlots), float64(c.nClients-1))
+		t.Log(c.nClients, "clients on", c.nSlots, "positions:", int(100*successRate), "% scheduled (expected",
+			int(100*expected), "%),", float64(collisions)/float64(trials), "collisions per schedule")
+
+		if math.Abs(successRate-expected) > 0.05 {
+			t.Error("The success rate", successRate, "is too far from the expected", expected)
+		}
+		if collisions == 0 {
+			t.Error("There should have been collisions")
+		}
+		// the checksum fails to see a collision with probability 2^-16
+		if undetected > collisions/100 {
+			t.Error(undetected, "collisions went undetected, out of", collisions)
+		}
+	}
+}
@@ -1 +1,74 @@
 package scheduler
+
+import (
+	"errors"
+)
+
+// Names of the slot schedulers, as given in prifi.toml ("OpenClosedSlotsScheduler")
+const (
+	// one field per slot of the shuffle, see bitmask_roundscheduler.go
+	SLOT_SCHEDULER_BITMASK = "BitMask"
+
+	// random reservations, see footprint_roundscheduler.go
+	SLOT_SCHEDULER_FOOTPRINT = "Footprint"
+)
+
+// SlotScheduler_Client is the client side of a protocol between the relay and the clients that allows to decide which
+// slots are gonna be "open" (fixed-length byte array) or "closed" (inexistant, no message at all). The contribution of
+// each client goes through the DC-net, so the relay only learns the combination.
+type SlotScheduler_Client interface {
+
+	//the client receives a new schedule request from the relay, for a schedule of nSlots slots
+	Client_ReceivedScheduleRequest(nSlots int)
+
+	//the client alters the schedule being computed, and asks to transmit for nRounds consecutive rounds
+	Client_ReserveRounds(slotID int, nRounds int)
+
+	//return the schedule to send as payload
+	Client_GetOpenScheduleContribution() []byte
+
+	//the owner ID the relay announces in the rounds reserved, -1 if none
+	Client_MyOwnerID() int
+}
+
+// SlotScheduler_Relay is the relay side of a SlotScheduler_Client
+type SlotScheduler_Relay interface {
+
+	//Called with each client's contribution
+	Relay_CombineContributions(contributions ...[]byte) []byte
+
+	// returns the number of consecutive rounds reserved by each owner ID in [0, maxSlots[, 0 if closed
+	Relay_ComputeFinalLayout(allContributions []byte, maxSlots int) map[int]int
+}
+
+// IsValidSlotScheduler returns true iff schedulerType names a known scheduler ("" stands for the default)
+func IsValidSlotScheduler(schedulerType string) bool {
+	switch schedulerType {
+	case "", SLOT_SCHEDULER_BITMASK, SLOT_SCHEDULER_FOOTPRINT:
+		return true
+	}
+	return false
+}
+
+// NewSlotSchedulerClient creates the client side of the given scheduler, where a client can reserve up to
+// maxSlotLength consecutive rounds. The empty type stands for the bitmask.
+func NewSlotSchedulerClient(schedulerType string, maxSlotLength int) (SlotScheduler_Client, error) {
+	switch schedulerType {
+	case "", SLOT_SCHEDULER_BITMASK:
+		return &BitMaskSlotScheduler_Client{MaxSlotLength: maxSlotLength}, nil
+	case SLOT_SCHEDULER_FOOTPRINT:
+		return &FootprintSlotScheduler_Client{MaxSlotLength: maxSlotLength}, nil
+	}
+	return nil, errors.New("unknown slot scheduler " + schedulerType)
+}
+
+// NewSlotSchedulerRelay creates the relay side of the given scheduler. The empty type stands for the bitmask.
+func NewSlotSchedulerRelay(schedulerType string, maxSlotLength int) (SlotScheduler_Relay, error) {
+	switch schedulerType {
+	case "", SLOT_SCHEDULER_BITMASK:
+		return &BitMaskSlotScheduler_Relay{MaxSlotLength: maxSlotLength}, nil
+	case SLOT_SCHEDULER_FOOTPRINT:
+		return &FootprintSlotScheduler_Relay{MaxSlotLength: maxSlotLength}, nil
+	}
+	return nil, errors.New("unknown slot scheduler " + schedulerType)
+}
@@ -1,6 +1,7 @@
 package trustee
 
 import (
+	"errors"
 	"fmt"
 	"github.com/dedis/prifi/prifi-lib/config"
 	"github.com/dedis/prifi/prifi-lib/net"
@@ -10,6 +11,16 @@ import (
 	"strconv"
 )
 
+// revealedBits are the bits we revealed in phase 1 of a blame. We only reveal a shared secret for that blame, and only
+// once: to settle a disagreement with the client that signed other bits. Otherwise, the relay could ask for all our
+// shared secrets, and regenerate the pads of the clients.
+type revealedBits struct {
+	RoundID        int32
+	BitPos         int
+	Bits           map[int]int // client ID -> bit
+	SecretRevealed bool
+}
+
 /*
 * Received_REL_ALL_DISRUPTION_REVEAL handles REL_ALL_DISRUPTION_REVEAL messages.
 * The method calls a function from the DCNet to regenerate the bits from roundID in position BitPos
@@ -17,7 +28,13 @@ import (
  */
 func (p *PriFiLibTrusteeInstance) Received_REL_ALL_DISRUPTION_REVEAL(msg net.REL_ALL_DISRUPTION_REVEAL) error {
 	log.Lvl1("Disruption Phase 1: Received de-anonymization query for round", msg.RoundID, "bit pos", msg.BitPos)
+	// the ciphers are encoded in another goroutine, see sendData
+	p.trusteeState.epochLock.Lock()
 	bitMap, PRGs := p.trusteeState.DCNet.GetBitsOfRound(int32(msg.RoundID), int32(msg.BitPos))
+	p.trusteeState.epochLock.Unlock()
+	if bitMap == nil {
+		return errors.New("cannot reveal bit " + strconv.Itoa(msg.BitPos) + " of round " + strconv.Itoa(int(msg.RoundID)))
+	}
 
 	var pred_array []proof.Predicate
 	sval := make(map[string]kyber.Scalar)
@@ -35,19 +52,24 @@ func (p *PriFiLibTrusteeInstance) Received_REL_ALL_DISRUPTION_REVEAL(msg net.REL
 	}
 	pred := proof.And(pred_array...)
 
+	// the proof is bound to this blame and to us, so the relay cannot replay it in another one
+	context := net.BlameProofContext("DISRUPTION", p.trusteeState.session, msg.RoundID, msg.BitPos, true, p.trusteeState.ID)
 	prover := pred.Prover(suite, sval, pval, nil)
-	NIZK, _ := proof.HashProve(suite, "DISRUPTION", prover)
+	NIZK, _ := proof.HashProve(suite, context, prover)
 
-	verifier := pred.Verifier(suite, pval)
-	err := proof.HashVerify(suite, "DISRUPTION", verifier, NIZK)
-	if err != nil {
-		log.Error("EE Proof failed to verify: ")
-	}
-	log.Lvl1("EE Proof verified.")
 	toSend := &net.TRU_REL_DISRUPTION_REVEAL{
 		TrusteeID: p.trusteeState.ID,
+		RoundID:   msg.RoundID,
+		BitPos:    msg.BitPos,
 		Bits:      bitMap,
+		NIZK:      NIZK,
+		Pval:      pval,
+	}
+	// signed with our long-term key, the bits are evidence in the transcript of the blame
+	if err := toSend.Sign(p.trusteeState.identityKey, p.trusteeState.session); err != nil {
+		return errors.New("cannot sign the bits revealed, " + err.Error())
 	}
+	p.trusteeState.blame = &revealedBits{RoundID: msg.RoundID, BitPos: msg.BitPos, Bits: bitMap}
 	p.messageSender.SendToRelayWithLog(toSend, "")
 	log.Lvl1("Disruption: Sending previous round to relay (Round: ", msg.RoundID, ", bit position:", msg.BitPos, "), value", bitMap)
 	return nil
@@ -55,19 +77,24 @@ func (p *PriFiLibTrusteeInstance) Received_REL_ALL_DISRUPTION_REVEAL(msg net.REL
 
 /*
 * Received_REL_ALL_REVEAL_SHARED_SECRETS handles REL_ALL_REVEAL_SHARED_SECRETS messages.
-* The method gets the shared secret and sends it to the relay.
+* The method checks that the client signed bits that disagree with ours in the blame we revealed our bits for,
+* then gets the shared secret and sends it to the relay.
  */
 func (p *PriFiLibTrusteeInstance) Received_REL_ALL_REVEAL_SHARED_SECRETS(msg net.REL_ALL_REVEAL_SHARED_SECRETS) error {
 	log.Lvl1("Disruption Phase 2: Received a reveal secret message for client", msg.EntityID)
-	// TODO: check that the relay asks for the correct entity, and not a honest entity. There should be a signature check on the TRU_REL_DISRUPTION_REVEAL the relay received (and forwarded to the client)
+	if err := p.checkSecretRequest(msg); err != nil {
+		return errors.New("Trustee " + strconv.Itoa(p.trusteeState.ID) + " refuses to reveal the secret shared with client " +
+			strconv.Itoa(msg.EntityID) + ", " + err.Error())
+	}
+	p.trusteeState.blame.SecretRevealed = true
 	secret := p.trusteeState.sharedSecrets[msg.EntityID]
 	// as a pseudorandom base point multiplied by our private key.
 	suite := config.CryptoSuite
 	X := make([]kyber.Point, 1)
-	X[0] = p.trusteeState.PublicKey
+	X[0] = p.trusteeState.DCNetPublicKey
 	B := suite.Point().Base() //BACK
 	// Generate the proof predicate: an OR branch for each public key.
-	sec := map[string]kyber.Scalar{"x": p.trusteeState.privateKey} //BACK
+	sec := map[string]kyber.Scalar{"x": p.trusteeState.dcNetPrivateKey} //BACK
 	pub := map[string]kyber.Point{"B": B, "BT": p.trusteeState.ClientPublicKeys[msg.EntityID], "T": p.trusteeState.sharedSecrets[msg.EntityID]}
 	preds := make([]proof.Predicate, len(X))
 	for i := range X {
@@ -84,8 +111,8 @@ func (p *PriFiLibTrusteeInstance) Received_REL_ALL_REVEAL_SHARED_SECRETS(msg net
 	choice := make(map[proof.Predicate]int)
 	choice[pred] = 0
 
-	// Generate the signature
-	M := "SHAREDKEY"
+	// Generate the signature, bound to this blame and to us
+	M := net.BlameProofContext("SHAREDKEY", p.trusteeState.session, msg.RoundID, msg.BitPos, true, p.trusteeState.ID)
 	prover := pred.Prover(suite, sec, pub, choice)
 	NIZK, _ := proof.HashProve(suite, M, prover)
 
@@ -100,11 +127,43 @@ func (p *PriFiLibTrusteeInstance) Received_REL_ALL_REVEAL_SHARED_SECRETS(msg net
 	toSend := &net.TRU_REL_SHARED_SECRET{
 		TrusteeID: p.trusteeState.ID,
 		ClientID:  msg.EntityID,
+		RoundID:   msg.RoundID,
+		BitPos:    msg.BitPos,
 		Secret:    secret,
 		NIZK:      NIZK,
 		Pub:       pub,
 	}
+	if err := toSend.Sign(p.trusteeState.identityKey, p.trusteeState.session); err != nil {
+		return errors.New("cannot sign the secret revealed, " + err.Error())
+	}
 	p.messageSender.SendToRelayWithLog(toSend, "Sent secret to relay")
 	log.Lvl1("Reveling secret with client", msg.EntityID)
 	return nil
 }
+
+// checkSecretRequest returns an error unless the relay asks for the secret shared with a client in the blame we
+// revealed our bits for, for the first time, and shows the bits that client signed, which disagree with ours
+func (p *PriFiLibTrusteeInstance) checkSecretRequest(msg net.REL_ALL_REVEAL_SHARED_SECRETS) error {
+	b := p.trusteeState.blame
+	if b == nil || b.RoundID != msg.RoundID || b.BitPos != msg.BitPos {
+		return errors.New("we did not reveal our bits for bit " + strconv.Itoa(msg.BitPos) + " of round " + strconv.Itoa(int(msg.RoundID)))
+	}
+	if b.SecretRevealed {
+		return errors.New("we already revealed a secret in this blame")
+	}
+	if msg.EntityID < 0 || msg.EntityID >= len(p.trusteeState.sharedSecrets) || msg.EntityID >= len(p.trusteeState.ClientPublicKeys) {
+		return errors.New("unknown client")
+	}
+	bits := msg.ClientBits
+	if bits.ClientID != msg.EntityID || bits.RoundID != b.RoundID || bits.BitPos != b.BitPos {
+		return errors.New("the bits shown are not the ones of that client in this blame")
+	}
+	if err := bits.Verify(p.trusteeState.identities.Of(false, msg.EntityID), p.trusteeState.session); err != nil {
+		return errors.New("the bits shown are not signed by the client, " + err.Error())
+	}
+	bit, found := bits.Bits[p.trusteeState.ID]
+	if !found || bit == b.Bits[msg.EntityID] {
+		return errors.New("the client revealed the same bit as us")
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package trustee
+
+/*
+Accountable downstream
+**********************
+The relay signs the downstream cells it sends to the clients, chained in a hash chain (see net/downstream_chain.go).
+With DownstreamGossipPeriod, the clients send us the signed head of their chain every few rounds:
+
+- CLI_ALL_DOWNSTREAM_CHAIN_HEAD - we compare the heads of the clients for each round; two that differ prove that the
+  relay did not send the same cells to every client
+*/
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// setupDownstreamChain starts comparing the heads of the downstream chain of this session, signed by the relay's server
+// identity
+func (p *PriFiLibTrusteeInstance) setupDownstreamChain(msg net.ALL_ALL_PARAMETERS) {
+	p.trusteeState.downstreamChainWitness = nil
+	if p.trusteeState.identities.Relay != nil {
+		p.trusteeState.downstreamChainWitness = net.NewDownstreamChainWitness(p.trusteeState.identities.Relay, p.trusteeState.session)
+	}
+}
+
+/*
+Received_CLI_ALL_DOWNSTREAM_CHAIN_HEAD handles CLI_ALL_DOWNSTREAM_CHAIN_HEAD messages, the head of the downstream chain
+of a client. We compare it with those of the other clients for that round.
+*/
+func (p *PriFiLibTrusteeInstance) Received_CLI_ALL_DOWNSTREAM_CHAIN_HEAD(msg net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD) error {
+	if p.trusteeState.downstreamChainWitness == nil {
+		log.Lvl3("Trustee", p.trusteeState.ID, ": received the head of client", msg.ClientID, "but we do not know the relay's key, discarding.")
+		return nil
+	}
+	proof, err := p.trusteeState.downstreamChainWitness.Add(msg)
+	if err != nil {
+		return errors.New("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : invalid head from client " + strconv.Itoa(msg.ClientID) + ", " + err.Error())
+	}
+	if proof != nil {
+		log.Error("Trustee", p.trusteeState.ID, ": the relay equivocated, it signed two different downstream histories for round",
+			proof.RoundID, "(the head of client", msg.ClientID, "differs)")
+	}
+	return nil
+}
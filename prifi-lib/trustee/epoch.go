@@ -0,0 +1,162 @@
+package trustee
+
+/*
+Key epochs
+**********
+Periodically, the relay rotates the DC-net keys and the slots without restarting the protocol. While the current
+epoch keeps carrying traffic, the trustee :
+
+- REL_TRU_EPOCH_SHUFFLE - derives a fresh key pair, the new shared secrets with the clients' fresh keys, and shuffles
+  the clients' fresh ephemeral keys
+- REL_TRU_EPOCH_TRANSCRIPT - verifies and signs the shuffles. From then on, it stops encoding new rounds, since they
+  might belong to the next epoch
+- REL_ALL_EPOCH_SWITCH - learns the first round of the next epoch, schedules the switch in the DC-net, and resumes
+*/
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/dedis/prifi/prifi-lib/config"
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"github.com/dedis/prifi/prifi-lib/net"
+	"github.com/dedis/prifi/prifi-lib/scheduler"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// TRUSTEE_EPOCH_PAUSE_SLEEP is how long the sending goroutine waits before checking again if the boundary of the next
+// key epoch is known
+const TRUSTEE_EPOCH_PAUSE_SLEEP = 10 * time.Millisecond
+
+// trusteeEpoch holds the keys of the key epoch being prepared
+type trusteeEpoch struct {
+	ID               int32
+	privateKey       kyber.Scalar
+	PublicKey        kyber.Point
+	ClientPublicKeys []kyber.Point
+	sharedSecrets    []kyber.Point
+	neffShuffle      *scheduler.NeffShuffleTrustee
+}
+
+/*
+Received_REL_TRU_EPOCH_SHUFFLE handles REL_TRU_EPOCH_SHUFFLE messages.
+They contain the clients' fresh keys for the next key epoch; we derive our own fresh keys and the new shared secrets,
+then shuffle the ephemeral keys like during the setup.
+*/
+func (p *PriFiLibTrusteeInstance) Received_REL_TRU_EPOCH_SHUFFLE(msg net.REL_TRU_EPOCH_SHUFFLE) error {
+
+	if len(msg.Pks) != p.trusteeState.nClients || len(msg.EphPks) != p.trusteeState.nClients {
+		e := "Trustee " + strconv.Itoa(p.trusteeState.ID) + " : epoch " + strconv.Itoa(int(msg.Epoch)) + " has " +
+			strconv.Itoa(len(msg.Pks)) + " clients, expected " + strconv.Itoa(p.trusteeState.nClients)
+		log.Error(e)
+		return errors.New(e)
+	}
+
+	epoch := &trusteeEpoch{
+		ID:               msg.Epoch,
+		ClientPublicKeys: msg.Pks,
+		sharedSecrets:    make([]kyber.Point, len(msg.Pks)),
+	}
+	epoch.PublicKey, epoch.privateKey = crypto.NewKeyPair()
+	for i := range msg.Pks {
+		epoch.sharedSecrets[i] = config.CryptoSuite.Point().Mul(epoch.privateKey, msg.Pks[i])
+	}
+
+	// the shuffle is signed with our long-term key, which the clients know
+	neffShuffle := new(scheduler.NeffShuffle)
+	neffShuffle.Init()
+	epoch.neffShuffle = neffShuffle.TrusteeView
+	epoch.neffShuffle.Init(p.trusteeState.ID, p.trusteeState.privateKey, p.trusteeState.PublicKey)
+
+	shuffle, err := epoch.neffShuffle.ReceivedShuffleFromRelay(msg.Base, msg.EphPks, true, nil)
+	if err != nil {
+		return errors.New("Could not do ReceivedShuffleFromRelay for epoch " + strconv.Itoa(int(msg.Epoch)) + ", error is " + err.Error())
+	}
+	p.trusteeState.epoch = epoch
+
+	s := shuffle.(*net.TRU_REL_TELL_NEW_BASE_AND_EPH_PKS)
+	toSend := &net.TRU_REL_EPOCH_SHUFFLE{
+		Epoch:     msg.Epoch,
+		TrusteeID: p.trusteeState.ID,
+		Pk:        epoch.PublicKey,
+		NewBase:   s.NewBase,
+		NewEphPks: s.NewEphPks,
+		Proof:     s.Proof,
+	}
+	p.messageSender.SendToRelayWithLog(toSend, "(epoch "+strconv.Itoa(int(msg.Epoch))+")")
+
+	return nil
+}
+
+/*
+Received_REL_TRU_EPOCH_TRANSCRIPT handles REL_TRU_EPOCH_TRANSCRIPT messages.
+We verify the shuffles of the next key epoch and sign the last one. Until we know when the epoch starts, we do not
+encode rounds we have not sent yet; we tell the relay which one is the first of them.
+*/
+func (p *PriFiLibTrusteeInstance) Received_REL_TRU_EPOCH_TRANSCRIPT(msg net.REL_TRU_EPOCH_TRANSCRIPT) error {
+
+	epoch := p.trusteeState.epoch
+	if epoch == nil || epoch.ID != msg.Epoch {
+		return errors.New("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : received a transcript for epoch " +
+			strconv.Itoa(int(msg.Epoch)) + ", which we did not shuffle")
+	}
+
+	sig, err := epoch.neffShuffle.ReceivedTranscriptFromRelay(msg.Bases, msg.GetKeys(), msg.GetProofs())
+	if err != nil {
+		return errors.New("Could not do ReceivedTranscriptFromRelay for epoch " + strconv.Itoa(int(msg.Epoch)) + ", error is " + err.Error())
+	}
+
+	p.trusteeState.epochLock.Lock()
+	p.trusteeState.pausedAtRound = p.trusteeState.nextRoundToSend
+	nextRound := p.trusteeState.pausedAtRound
+	p.trusteeState.epochLock.Unlock()
+
+	toSend := &net.TRU_REL_EPOCH_SHUFFLE_SIG{
+		Epoch:     msg.Epoch,
+		TrusteeID: p.trusteeState.ID,
+		Sig:       sig.(*net.TRU_REL_SHUFFLE_SIG).Sig,
+		NextRound: nextRound,
+	}
+	p.messageSender.SendToRelayWithLog(toSend, "(epoch "+strconv.Itoa(int(msg.Epoch))+", paused at round "+strconv.Itoa(int(nextRound))+")")
+
+	return nil
+}
+
+/*
+Received_REL_ALL_EPOCH_SWITCH handles REL_ALL_EPOCH_SWITCH messages.
+The relay tells us the first round of the next key epoch. The DC-net encodes the rounds from there on with the new
+shared secrets, and the payload size the relay chose for the epoch, and we resume sending.
+*/
+func (p *PriFiLibTrusteeInstance) Received_REL_ALL_EPOCH_SWITCH(msg net.REL_ALL_EPOCH_SWITCH) error {
+
+	epoch := p.trusteeState.epoch
+	if epoch == nil || epoch.ID != msg.Epoch {
+		return errors.New("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : received the switch to epoch " +
+			strconv.Itoa(int(msg.Epoch)) + ", which we did not prepare")
+	}
+
+	p.trusteeState.epochLock.Lock()
+	err := p.trusteeState.DCNet.SetNextEpoch(msg.BoundaryRound, epoch.sharedSecrets, msg.PayloadSize)
+	if err == nil {
+		p.trusteeState.pausedAtRound = -1
+	}
+	p.trusteeState.epochLock.Unlock()
+	if err != nil {
+		return errors.New("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : cannot switch to epoch " +
+			strconv.Itoa(int(msg.Epoch)) + ", error is " + err.Error())
+	}
+
+	// those are used to reveal the shared secrets in case of disruption
+	p.trusteeState.ClientPublicKeys = epoch.ClientPublicKeys
+	p.trusteeState.sharedSecrets = epoch.sharedSecrets
+	p.trusteeState.dcNetPrivateKey = epoch.privateKey
+	p.trusteeState.DCNetPublicKey = epoch.PublicKey
+	p.trusteeState.epoch = nil
+
+	log.Lvl2("Trustee " + strconv.Itoa(p.trusteeState.ID) + " : epoch " + strconv.Itoa(int(msg.Epoch)) +
+		" starts at round " + strconv.Itoa(int(msg.BoundaryRound)))
+
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 	"go.dedis.ch/onet/v3/log"
 	"reflect"
 	"strings"
+	"sync"
 )
 
 // Possible sending rates for the trustees.
@@ -70,12 +71,17 @@ func NewTrustee(neverSlowDown bool, alwaysSlowDown bool, baseSleepTime int, msgS
 	return &prifi
 }
 
+// SetIdentities gives the trustee the private key of its server identity, and the keys of the others
+func (p *PriFiLibTrusteeInstance) SetIdentities(privateKey kyber.Scalar, identities net.Identities) {
+	p.trusteeState.identityKey = privateKey
+	p.trusteeState.identities = identities
+}
+
 // TrusteeState contains the mutable state of the trustee.
 type TrusteeState struct {
 	DCNet                         *dcnet.DCNetEntity
 	ClientPublicKeys              []kyber.Point
 	ID                            int
-	MessageHistory                kyber.XOF
 	Name                          string
 	nClients                      int
 	neffShuffle                   *scheduler.NeffShuffleTrustee
@@ -83,6 +89,10 @@ type TrusteeState struct {
 	PayloadSize                   int
 	privateKey                    kyber.Scalar
 	PublicKey                     kyber.Point
+	identityKey                   kyber.Scalar   // the private key of our server identity, see SetIdentities
+	identities                    net.Identities // the keys of the server identities of everyone, see SetIdentities
+	session                       int            // drawn by the relay at each setup, what we sign is bound to it
+	DisruptionProtectionEnabled   bool
 	sendingRate                   chan int16
 	sharedSecrets                 []kyber.Point
 	TrusteeID                     int
@@ -90,6 +100,22 @@ type TrusteeState struct {
 	AlwaysSlowDown                bool //enforce the sleep in the sending function even if rate is FULL
 	NeverSlowDown                 bool //ignore the sleep in the sending function if rate is STOPPED
 	EquivocationProtectionEnabled bool
+	dcNetType                     string
+	dcNetPadGenerator             string
+	dcNetPrivateKey               kyber.Scalar // the shared secrets derive from this key, which changes with every key epoch
+	DCNetPublicKey                kyber.Point
+
+	//key epochs
+	epoch           *trusteeEpoch // the key epoch being prepared, nil if none
+	epochLock       sync.Mutex    // protects the DC-net and the fields below, shared with the sending goroutine
+	nextRoundToSend int32
+	pausedAtRound   int32 // when >= 0, rounds from this one on wait until the next epoch's boundary is known
+
+	// the blame we revealed our bits for, see disruption.go
+	blame *revealedBits
+
+	//accountable downstream
+	downstreamChainWitness *net.DownstreamChainWitness // the heads gossiped by the clients, see downstream_chain.go
 }
 
 // NeffShuffleResult holds the result of the NeffShuffle,
@@ -133,6 +159,20 @@ func (p *PriFiLibTrusteeInstance) ReceivedMessage(msg interface{}) error {
 		if p.stateMachine.AssertState("READY") {
 			err = p.Received_REL_ALL_REVEAL_SHARED_SECRETS(typedMsg)
 		}
+	case net.REL_TRU_EPOCH_SHUFFLE:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_TRU_EPOCH_SHUFFLE(typedMsg)
+		}
+	case net.REL_TRU_EPOCH_TRANSCRIPT:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_TRU_EPOCH_TRANSCRIPT(typedMsg)
+		}
+	case net.REL_ALL_EPOCH_SWITCH:
+		if p.stateMachine.AssertState("READY") {
+			err = p.Received_REL_ALL_EPOCH_SWITCH(typedMsg)
+		}
+	case net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD:
+		err = p.Received_CLI_ALL_DOWNSTREAM_CHAIN_HEAD(typedMsg)
 	default:
 		err = errors.New("Unrecognized message, type" + reflect.TypeOf(msg).String())
 	}
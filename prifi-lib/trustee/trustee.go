@@ -11,6 +11,8 @@ Then, this file simple handle the answer to the different message kind :
 - REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_AND_BASE - the client's identities (and ephemeral ones), and a base. We react by Neff-Shuffling and sending the result
 - REL_TRU_TELL_TRANSCRIPT - the Neff-Shuffle's results. We perform some checks, sign the last one, send it to the relay, and follow by continuously sending ciphers.
 - REL_TRU_TELL_RATE_CHANGE - Received when the relay requests a sending rate change, the message contains the necessary information needed to perform this change
+- REL_TRU_EPOCH_SHUFFLE, REL_TRU_EPOCH_TRANSCRIPT, REL_ALL_EPOCH_SWITCH - the key epoch rotation, see epoch.go
+- CLI_ALL_DOWNSTREAM_CHAIN_HEAD - the head of the downstream chain of a client, signed by the relay, see downstream_chain.go
 */
 
 import (
@@ -54,7 +56,10 @@ func (p *PriFiLibTrusteeInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PA
 	nClients := msg.IntValueOrElse("NClients", p.trusteeState.nClients)
 	payloadSize := msg.IntValueOrElse("PayloadSize", p.trusteeState.PayloadSize)
 	dcNetType := msg.StringValueOrElse("DCNetType", "not initilaized")
+	dcNetPadGenerator := msg.StringValueOrElse("DCNetPadGenerator", dcnet.PAD_GENERATOR_XOF)
 	equivProtection := msg.BoolValueOrElse("EquivocationProtectionEnabled", false)
+	disruptionProtection := msg.BoolValueOrElse("DisruptionProtectionEnabled", false)
+	session := msg.IntValueOrElse("Session", 0)
 
 	//sanity checks
 	if trusteeID < -1 {
@@ -69,10 +74,8 @@ func (p *PriFiLibTrusteeInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PA
 	if payloadSize < 1 {
 		return errors.New("payloadSize cannot be 0")
 	}
-
-	switch dcNetType {
-	case "Verifiable":
-		panic("not supported yet")
+	if !dcnet.IsValidPadGenerator(dcNetPadGenerator) {
+		return errors.New("unknown DCNetPadGenerator " + dcNetPadGenerator)
 	}
 
 	p.trusteeState.ID = trusteeID
@@ -82,7 +85,17 @@ func (p *PriFiLibTrusteeInstance) Received_ALL_ALL_PARAMETERS(msg net.ALL_ALL_PA
 	p.trusteeState.PayloadSize = payloadSize
 	p.trusteeState.TrusteeID = trusteeID
 	p.trusteeState.EquivocationProtectionEnabled = equivProtection
+	p.trusteeState.DisruptionProtectionEnabled = disruptionProtection
+	p.trusteeState.session = session
+	p.trusteeState.dcNetType = dcNetType
+	p.trusteeState.dcNetPadGenerator = dcNetPadGenerator
 	p.trusteeState.neffShuffle.Init(trusteeID, p.trusteeState.privateKey, p.trusteeState.PublicKey)
+	p.trusteeState.dcNetPrivateKey = p.trusteeState.privateKey
+	p.trusteeState.DCNetPublicKey = p.trusteeState.PublicKey
+	p.trusteeState.epoch = nil
+	p.trusteeState.nextRoundToSend = 0
+	p.trusteeState.pausedAtRound = -1
+	p.setupDownstreamChain(msg)
 
 	//placeholders for pubkeys and secrets
 	p.trusteeState.ClientPublicKeys = make([]kyber.Point, nClients)
@@ -190,15 +203,34 @@ func (p *PriFiLibTrusteeInstance) Received_REL_TRU_TELL_RATE_CHANGE(msg net.REL_
 
 /*
 sendData is an auxiliary function used by Send_TRU_REL_DC_CIPHER. It computes the DC-net's cipher and sends it.
-It returns the new round number (previous + 1).
+It returns the new round number (previous + 1, or the same if the round has to wait for a key epoch switch).
 */
 func sendData(p *PriFiLibTrusteeInstance, roundID int32) (int32, error) {
+	p.trusteeState.epochLock.Lock()
+	if p.trusteeState.pausedAtRound >= 0 && roundID >= p.trusteeState.pausedAtRound {
+		// this round might belong to the next key epoch, wait for its boundary
+		p.trusteeState.epochLock.Unlock()
+		time.Sleep(TRUSTEE_EPOCH_PAUSE_SLEEP)
+		return roundID, nil
+	}
 	data := p.trusteeState.DCNet.TrusteeEncodeForRound(roundID)
+	p.trusteeState.nextRoundToSend = roundID + 1
+	p.trusteeState.epochLock.Unlock()
+
 	//send the data
 	toSend := &net.TRU_REL_DC_CIPHER{
 		RoundID:   roundID,
 		TrusteeID: p.trusteeState.ID,
 		Data:      data}
+	if p.trusteeState.DisruptionProtectionEnabled {
+		// so that the relay cannot blame us with a cipher we did not send
+		signature, err := net.SignCipher(p.trusteeState.identityKey, p.trusteeState.session, roundID, true, p.trusteeState.ID, data)
+		if err != nil {
+			return -1, errors.New("Trustee " + strconv.Itoa(p.trusteeState.ID) + " cannot sign its cipher for round " +
+				strconv.Itoa(int(roundID)) + ", " + err.Error())
+		}
+		toSend.Signature = signature
+	}
 	if !p.messageSender.SendToRelayWithLog(toSend, "(round "+strconv.Itoa(int(roundID))+")") {
 		return -1, errors.New("Could not send")
 	}
@@ -243,12 +275,21 @@ func (p *PriFiLibTrusteeInstance) Received_REL_TRU_TELL_CLIENTS_PKS_AND_EPH_PKS_
 		p.trusteeState.sharedSecrets[i] = config.CryptoSuite.Point().Mul(p.trusteeState.privateKey, clientsPks[i])
 	}
 
-	p.trusteeState.DCNet = dcnet.NewDCNetEntity(p.trusteeState.ID, dcnet.DCNET_TRUSTEE,
-		p.trusteeState.PayloadSize, p.trusteeState.EquivocationProtectionEnabled, p.trusteeState.sharedSecrets)
-
 	//In case we use the simple dcnet, vkey isn't needed
 	vkey := make([]byte, 1)
 
+	if p.trusteeState.dcNetType == "Verifiable" {
+		p.trusteeState.DCNet = dcnet.NewVerifiableDCNetEntity(p.trusteeState.ID, dcnet.DCNET_TRUSTEE,
+			p.trusteeState.PayloadSize, p.trusteeState.sharedSecrets)
+
+		// the relay needs the commitments to our pads to verify the ciphers
+		vkey = p.trusteeState.DCNet.VerifiableDCNetKey()
+	} else {
+		p.trusteeState.DCNet = dcnet.NewDCNetEntity(p.trusteeState.ID, dcnet.DCNET_TRUSTEE,
+			p.trusteeState.PayloadSize, p.trusteeState.EquivocationProtectionEnabled, p.trusteeState.dcNetPadGenerator,
+			p.trusteeState.sharedSecrets)
+	}
+
 	toSend, err := p.trusteeState.neffShuffle.ReceivedShuffleFromRelay(msg.Base, msg.EphPks, true, vkey)
 	if err != nil {
 		return errors.New("Could not do ReceivedShuffleFromRelay, error is " + err.Error())
@@ -325,3 +325,122 @@ func TestTrustee(t *testing.T) {
 
 	t.SkipNow() //we started a goroutine, let's kill everything, we're good
 }
+
+func TestTrusteeDownstreamChain(t *testing.T) {
+	relayPub, relayPriv := crypto.NewKeyPair()
+	session := 7
+	p := &PriFiLibTrusteeInstance{trusteeState: &TrusteeState{ID: 0}}
+
+	// the relay sends different cells to clients 0 and 1 in round 1
+	signedHead := func(clientID int, data []byte) net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD {
+		cell := &net.REL_CLI_DOWNSTREAM_DATA{RoundID: 1, Data: data}
+		head, err := net.SignDownstreamCell(relayPriv, session, net.NewDownstreamChainHead(), cell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD{ClientID: clientID, Session: session, RoundID: 1, Head: head, Signature: cell.ChainSignature}
+	}
+
+	// without the relay's key, the heads are discarded
+	p.setupDownstreamChain(net.ALL_ALL_PARAMETERS{})
+	if err := p.Received_CLI_ALL_DOWNSTREAM_CHAIN_HEAD(signedHead(0, []byte{1})); err != nil {
+		t.Error(err)
+	}
+
+	p.SetIdentities(nil, net.Identities{Relay: relayPub})
+	p.trusteeState.session = session // read with the other parameters
+	p.setupDownstreamChain(net.ALL_ALL_PARAMETERS{})
+	if err := p.Received_CLI_ALL_DOWNSTREAM_CHAIN_HEAD(signedHead(0, []byte{1})); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Received_CLI_ALL_DOWNSTREAM_CHAIN_HEAD(signedHead(1, []byte{2})); err != nil {
+		t.Fatal(err)
+	}
+	proofs := p.trusteeState.downstreamChainWitness.Proofs
+	if len(proofs) != 1 || proofs[0].Verify() != nil {
+		t.Error("the trustee should find that the relay equivocated in round 1")
+	}
+
+	wrongSession := signedHead(2, []byte{1})
+	wrongSession.Session++
+	if p.Received_CLI_ALL_DOWNSTREAM_CHAIN_HEAD(wrongSession) == nil {
+		t.Error("a head of another session should be refused")
+	}
+}
+
+func TestDisruptionRevealSecretOnlyForTheBlame(t *testing.T) {
+	msgSender := new(TestMessageSender)
+	msgSender.sentToRelay = make(chan interface{}, 15)
+	msw := newTestMessageSenderWrapper(msgSender)
+	trustee := NewTrustee(true, false, 1000, msw)
+	ts := trustee.trusteeState
+
+	// trustee 0 shares a secret with each of 2 clients, and revealed its bits for bit 3 of round 5
+	_, identityKey := crypto.NewKeyPair()
+	clientIdentities := make([]kyber.Point, 2)
+	clientIdentityKeys := make([]kyber.Scalar, 2)
+	for i := range clientIdentities {
+		clientIdentities[i], clientIdentityKeys[i] = crypto.NewKeyPair()
+	}
+	trustee.SetIdentities(identityKey, net.Identities{Clients: clientIdentities})
+	ts.session = 42
+	ts.DCNetPublicKey, ts.dcNetPrivateKey = crypto.NewKeyPair()
+	ts.ClientPublicKeys = make([]kyber.Point, 2)
+	ts.sharedSecrets = make([]kyber.Point, 2)
+	for i := range ts.ClientPublicKeys {
+		ts.ClientPublicKeys[i], _ = crypto.NewKeyPair()
+		ts.sharedSecrets[i] = config.CryptoSuite.Point().Mul(ts.dcNetPrivateKey, ts.ClientPublicKeys[i])
+	}
+	ts.blame = &revealedBits{RoundID: 5, BitPos: 3, Bits: map[int]int{0: 1, 1: 0}}
+
+	clientBits := func(clientID int, roundID int32, bitPos int, bit int, key kyber.Scalar) net.CLI_REL_DISRUPTION_REVEAL {
+		bits := net.CLI_REL_DISRUPTION_REVEAL{ClientID: clientID, RoundID: roundID, BitPos: bitPos, Bits: map[int]int{0: bit}}
+		if err := bits.Sign(key, ts.session); err != nil {
+			t.Fatal(err)
+		}
+		return bits
+	}
+	request := func(clientID int, roundID int32, bitPos int, bits net.CLI_REL_DISRUPTION_REVEAL) net.REL_ALL_REVEAL_SHARED_SECRETS {
+		return net.REL_ALL_REVEAL_SHARED_SECRETS{EntityID: clientID, RoundID: roundID, BitPos: bitPos, ClientBits: bits}
+	}
+
+	refused := []net.REL_ALL_REVEAL_SHARED_SECRETS{
+		// another blame
+		request(0, 6, 3, clientBits(0, 6, 3, 0, clientIdentityKeys[0])),
+		request(0, 5, 4, clientBits(0, 5, 4, 0, clientIdentityKeys[0])),
+		// an unknown client
+		request(-1, 5, 3, clientBits(-1, 5, 3, 0, clientIdentityKeys[0])),
+		request(2, 5, 3, clientBits(2, 5, 3, 0, clientIdentityKeys[0])),
+		// no bits, or the bits of another client, or not signed by the client
+		request(0, 5, 3, net.CLI_REL_DISRUPTION_REVEAL{}),
+		request(0, 5, 3, clientBits(1, 5, 3, 0, clientIdentityKeys[1])),
+		request(0, 5, 3, clientBits(0, 5, 3, 0, clientIdentityKeys[1])),
+		// the bits of the client in another blame
+		request(0, 5, 3, clientBits(0, 5, 4, 0, clientIdentityKeys[0])),
+		// bits that agree with ours
+		request(0, 5, 3, clientBits(0, 5, 3, 1, clientIdentityKeys[0])),
+		request(1, 5, 3, clientBits(1, 5, 3, 0, clientIdentityKeys[1])),
+	}
+	for i, msg := range refused {
+		if err := trustee.Received_REL_ALL_REVEAL_SHARED_SECRETS(msg); err == nil {
+			t.Error("Trustee should refuse to reveal its secret, request", i)
+		}
+	}
+	if len(msgSender.sentToRelay) != 0 {
+		t.Fatal("Trustee should not have revealed any secret")
+	}
+
+	// the bits of client 0 disagree with ours: we reveal that secret, once
+	if err := trustee.Received_REL_ALL_REVEAL_SHARED_SECRETS(request(0, 5, 3, clientBits(0, 5, 3, 0, clientIdentityKeys[0]))); err != nil {
+		t.Error("Trustee should reveal the secret shared with client 0,", err)
+	}
+	if len(msgSender.sentToRelay) != 1 {
+		t.Fatal("Trustee should have revealed the secret shared with client 0")
+	}
+	if reveal := (<-msgSender.sentToRelay).(*net.TRU_REL_SHARED_SECRET); !reveal.Secret.Equal(ts.sharedSecrets[0]) {
+		t.Error("Trustee revealed the wrong secret")
+	}
+	if err := trustee.Received_REL_ALL_REVEAL_SHARED_SECRETS(request(0, 5, 3, clientBits(0, 5, 3, 0, clientIdentityKeys[0]))); err == nil {
+		t.Error("Trustee should reveal a secret only once per blame")
+	}
+}
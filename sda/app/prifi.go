@@ -13,6 +13,8 @@ import (
 	"runtime"
 
 	"github.com/BurntSushi/toml"
+	prifi_net "github.com/dedis/prifi/prifi-lib/net"
+	prifi_relay "github.com/dedis/prifi/prifi-lib/relay"
 	prifi_protocol "github.com/dedis/prifi/sda/protocols"
 	prifi_service "github.com/dedis/prifi/sda/services"
 	"github.com/urfave/cli"
@@ -84,6 +86,12 @@ func main() {
 			Aliases: []string{"socks"},
 			Action:  startSocksTunnelOnly,
 		},
+		{
+			Name:      "verify-blame",
+			Usage:     "checks the verdict of a blame from the transcript saved by the relay",
+			ArgsUsage: "transcript-file (the keys of the relay and of the trustees are read from the group file)",
+			Action:    verifyBlame,
+		},
 	}
 	app.Flags = []cli.Flag{
 		cli.IntFlag{
@@ -267,6 +275,81 @@ func startSocksTunnelOnly(c *cli.Context) error {
 	return nil
 }
 
+// verifyBlame checks a blame transcript written by the relay, see BlameTranscriptFolder, against the keys in the group
+// file: the relay's, and the trustees' if it lists them. The clients are not in the group file, their keys are the ones
+// the relay reports. It does not need the cothority.
+func verifyBlame(c *cli.Context) error {
+	file := c.Args().First()
+	if file == "" {
+		log.Error("Usage: prifi verify-blame transcript-file")
+		os.Exit(1)
+	}
+
+	group := readCothorityGroupConfig(c)
+	if group == nil {
+		log.Error("Could not read the group description, which has the relay's key")
+		os.Exit(1)
+	}
+	var relay *network.ServerIdentity
+	var trustees []*network.ServerIdentity
+	for _, si := range group.Roster.List {
+		switch group.GetDescription(si) {
+		case "relay":
+			relay = si
+		case "trustee":
+			trustees = append(trustees, si)
+		}
+	}
+	if relay == nil {
+		log.Error("There is no relay in the group description")
+		os.Exit(1)
+	}
+
+	transcript, err := prifi_net.LoadBlameTranscript(file)
+	if err != nil {
+		log.Error("Could not read the blame transcript", file, ":", err)
+		os.Exit(1)
+	}
+
+	v := transcript.Verdict
+	entity := "client"
+	if v.GuiltyIsTrustee {
+		entity = "trustee"
+	}
+	log.Info("Verdict against", entity, v.GuiltyID, "for bit", v.BitPos, "of round", v.RoundID, ":", v.Reason)
+	log.Info("Checking the signature with the key of the relay", relay.Address, ":", relay.Public)
+
+	identities := transcript.Identities
+	identities.Relay = relay.Public
+	for i, key := range identities.Clients {
+		log.Info("Client", i, "identity", key, "(as reported by the relay)")
+	}
+	for j, key := range identities.Trustees {
+		var trustee *network.ServerIdentity
+		for _, si := range trustees {
+			if key != nil && si.Public.Equal(key) {
+				trustee = si
+			}
+		}
+		if trustee == nil && len(trustees) > 0 {
+			log.Error("The identity of trustee", j, "is not one of the trustees of the group description")
+			os.Exit(1)
+		}
+		if trustee != nil {
+			log.Info("Trustee", j, "identity", key, "is", trustee.Address)
+		} else {
+			log.Info("Trustee", j, "identity", key, "(as reported by the relay)")
+		}
+	}
+
+	if err := prifi_relay.VerifyBlameTranscript(transcript, identities); err != nil {
+		log.Error("The verdict does NOT follow from the transcript:", err)
+		os.Exit(1)
+	}
+	log.Info("The verdict follows from the transcript.")
+	return nil
+}
+
 /**
  * COTHORITY
  */
@@ -111,3 +111,48 @@ func (p *PriFiSDAProtocol) Received_CLI_REL_DISRUPTION_SECRET(msg Struct_CLI_REL
 func (p *PriFiSDAProtocol) Received_TRU_REL_DISRUPTION_SECRET(msg Struct_TRU_REL_DISRUPTION_SECRET) error {
 	return p.prifiLibInstance.ReceivedMessage(msg.TRU_REL_SHARED_SECRET)
 }
+
+// Received_REL_CLI_EPOCH_START forward an REL_CLI_EPOCH_START message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_REL_CLI_EPOCH_START(msg Struct_REL_CLI_EPOCH_START) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.REL_CLI_EPOCH_START)
+}
+
+// Received_CLI_REL_EPOCH_PK_AND_EPH_PK forward an CLI_REL_EPOCH_PK_AND_EPH_PK message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_CLI_REL_EPOCH_PK_AND_EPH_PK(msg Struct_CLI_REL_EPOCH_PK_AND_EPH_PK) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.CLI_REL_EPOCH_PK_AND_EPH_PK)
+}
+
+// Received_REL_TRU_EPOCH_SHUFFLE forward an REL_TRU_EPOCH_SHUFFLE message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_REL_TRU_EPOCH_SHUFFLE(msg Struct_REL_TRU_EPOCH_SHUFFLE) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.REL_TRU_EPOCH_SHUFFLE)
+}
+
+// Received_TRU_REL_EPOCH_SHUFFLE forward an TRU_REL_EPOCH_SHUFFLE message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_TRU_REL_EPOCH_SHUFFLE(msg Struct_TRU_REL_EPOCH_SHUFFLE) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.TRU_REL_EPOCH_SHUFFLE)
+}
+
+// Received_REL_TRU_EPOCH_TRANSCRIPT forward an REL_TRU_EPOCH_TRANSCRIPT message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_REL_TRU_EPOCH_TRANSCRIPT(msg Struct_REL_TRU_EPOCH_TRANSCRIPT) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.REL_TRU_EPOCH_TRANSCRIPT)
+}
+
+// Received_TRU_REL_EPOCH_SHUFFLE_SIG forward an TRU_REL_EPOCH_SHUFFLE_SIG message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_TRU_REL_EPOCH_SHUFFLE_SIG(msg Struct_TRU_REL_EPOCH_SHUFFLE_SIG) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.TRU_REL_EPOCH_SHUFFLE_SIG)
+}
+
+// Received_REL_ALL_EPOCH_SWITCH forward an REL_ALL_EPOCH_SWITCH message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_REL_ALL_EPOCH_SWITCH(msg Struct_REL_ALL_EPOCH_SWITCH) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.REL_ALL_EPOCH_SWITCH)
+}
+
+// Received_CLI_REL_DOWNSTREAM_NACK forward an CLI_REL_DOWNSTREAM_NACK message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_CLI_REL_DOWNSTREAM_NACK(msg Struct_CLI_REL_DOWNSTREAM_NACK) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.CLI_REL_DOWNSTREAM_NACK)
+}
+
+// Received_CLI_ALL_DOWNSTREAM_CHAIN_HEAD forward an CLI_ALL_DOWNSTREAM_CHAIN_HEAD message to PriFi's lib
+func (p *PriFiSDAProtocol) Received_CLI_ALL_DOWNSTREAM_CHAIN_HEAD(msg Struct_CLI_ALL_DOWNSTREAM_CHAIN_HEAD) error {
+	return p.prifiLibInstance.ReceivedMessage(msg.CLI_ALL_DOWNSTREAM_CHAIN_HEAD)
+}
@@ -5,6 +5,7 @@ import (
 	"strconv"
 
 	"github.com/dedis/prifi/prifi-lib/net"
+	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
 )
@@ -60,6 +61,24 @@ func (p *PriFiSDAProtocol) buildMessageSender(identities map[string]PriFiIdentit
 	return MessageSender{p.TreeNodeInstance, relay, clients, trustees, newRealUDPChannel()}
 }
 
+// identities returns the keys of the server identities of the nodes we know, with the IDs PriFi-Lib gives them
+func (ms MessageSender) identities() net.Identities {
+	ids := net.Identities{
+		Clients:  make([]kyber.Point, len(ms.clients)),
+		Trustees: make([]kyber.Point, len(ms.trustees)),
+	}
+	if ms.relay != nil {
+		ids.Relay = ms.relay.ServerIdentity.Public
+	}
+	for i, client := range ms.clients {
+		ids.Clients[i] = client.ServerIdentity.Public
+	}
+	for j, trustee := range ms.trustees {
+		ids.Trustees[j] = trustee.ServerIdentity.Public
+	}
+	return ids
+}
+
 //SendToClient sends a message to client i, or fails if it is unknown
 func (ms MessageSender) FastSendToClient(i int, msg *net.REL_CLI_DOWNSTREAM_DATA) error {
 
@@ -111,16 +130,16 @@ func (ms MessageSender) SendToRelay(msg interface{}) error {
 	return ms.tree.SendTo(ms.relay, msg)
 }
 
-//BroadcastToAllClients broadcasts a message (must be a REL_CLI_DOWNSTREAM_DATA_UDP) to all clients using UDP
+//BroadcastToAllClients broadcasts a message (must be a MarshallableMessage, e.g. a REL_CLI_DOWNSTREAM_FRAGMENT) to all clients using UDP
 func (ms MessageSender) BroadcastToAllClients(msg interface{}) error {
 
-	castedMsg, canCast := msg.(*net.REL_CLI_DOWNSTREAM_DATA_UDP)
+	castedMsg, canCast := msg.(MarshallableMessage)
 	if !canCast {
-		log.Error("Message sender : could not cast msg to REL_CLI_DOWNSTREAM_DATA_UDP, and I don't know how to send other messages.")
+		e := "Message sender : could not cast msg to MarshallableMessage, and I don't know how to send other messages."
+		log.Error(e)
+		return errors.New(e)
 	}
-	ms.udpChannel.Broadcast(castedMsg)
-
-	return nil
+	return ms.udpChannel.Broadcast(castedMsg)
 }
 
 //ClientSubscribeToBroadcast allows a client to subscribe to UDP broadcast
@@ -145,7 +164,7 @@ func (ms MessageSender) ClientSubscribeToBroadcast(clientID int, messageReceived
 		}
 
 		if listening {
-			emptyMessage := net.REL_CLI_DOWNSTREAM_DATA_UDP{}
+			emptyMessage := net.REL_CLI_DOWNSTREAM_FRAGMENT{}
 			//listen and decode
 			log.Lvl4("client", clientName, " calling listen and block...")
 			filledMessage, err := ms.udpChannel.ListenAndBlock(&emptyMessage, lastSeenMessage, clientName)
@@ -155,12 +174,13 @@ func (ms MessageSender) ClientSubscribeToBroadcast(clientID int, messageReceived
 				log.Error(clientName, " an error occurred : ", err)
 			}
 
-			log.Lvl4(clientName, " Received an UDP message n°"+strconv.Itoa(lastSeenMessage))
-
-			if err != nil {
-				log.Error(clientName, " an error occurred : ", err)
+			if filledMessage == nil {
+				//lost, the client will ask for it again
+				continue
 			}
 
+			log.Lvl4(clientName, " Received an UDP message n°"+strconv.Itoa(lastSeenMessage))
+
 			messageReceived(filledMessage)
 
 		}
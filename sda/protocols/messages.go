@@ -136,3 +136,57 @@ type Struct_TRU_REL_DISRUPTION_SECRET struct {
 	*onet.TreeNode
 	net.TRU_REL_SHARED_SECRET
 }
+
+//Struct_REL_CLI_EPOCH_START is a wrapper for REL_CLI_EPOCH_START (but also contains a *onet.TreeNode)
+type Struct_REL_CLI_EPOCH_START struct {
+	*onet.TreeNode
+	net.REL_CLI_EPOCH_START
+}
+
+//Struct_CLI_REL_EPOCH_PK_AND_EPH_PK is a wrapper for CLI_REL_EPOCH_PK_AND_EPH_PK (but also contains a *onet.TreeNode)
+type Struct_CLI_REL_EPOCH_PK_AND_EPH_PK struct {
+	*onet.TreeNode
+	net.CLI_REL_EPOCH_PK_AND_EPH_PK
+}
+
+//Struct_REL_TRU_EPOCH_SHUFFLE is a wrapper for REL_TRU_EPOCH_SHUFFLE (but also contains a *onet.TreeNode)
+type Struct_REL_TRU_EPOCH_SHUFFLE struct {
+	*onet.TreeNode
+	net.REL_TRU_EPOCH_SHUFFLE
+}
+
+//Struct_TRU_REL_EPOCH_SHUFFLE is a wrapper for TRU_REL_EPOCH_SHUFFLE (but also contains a *onet.TreeNode)
+type Struct_TRU_REL_EPOCH_SHUFFLE struct {
+	*onet.TreeNode
+	net.TRU_REL_EPOCH_SHUFFLE
+}
+
+//Struct_REL_TRU_EPOCH_TRANSCRIPT is a wrapper for REL_TRU_EPOCH_TRANSCRIPT (but also contains a *onet.TreeNode)
+type Struct_REL_TRU_EPOCH_TRANSCRIPT struct {
+	*onet.TreeNode
+	net.REL_TRU_EPOCH_TRANSCRIPT
+}
+
+//Struct_TRU_REL_EPOCH_SHUFFLE_SIG is a wrapper for TRU_REL_EPOCH_SHUFFLE_SIG (but also contains a *onet.TreeNode)
+type Struct_TRU_REL_EPOCH_SHUFFLE_SIG struct {
+	*onet.TreeNode
+	net.TRU_REL_EPOCH_SHUFFLE_SIG
+}
+
+//Struct_REL_ALL_EPOCH_SWITCH is a wrapper for REL_ALL_EPOCH_SWITCH (but also contains a *onet.TreeNode)
+type Struct_REL_ALL_EPOCH_SWITCH struct {
+	*onet.TreeNode
+	net.REL_ALL_EPOCH_SWITCH
+}
+
+//Struct_CLI_REL_DOWNSTREAM_NACK is a wrapper for CLI_REL_DOWNSTREAM_NACK (but also contains a *onet.TreeNode)
+type Struct_CLI_REL_DOWNSTREAM_NACK struct {
+	*onet.TreeNode
+	net.CLI_REL_DOWNSTREAM_NACK
+}
+
+//Struct_CLI_ALL_DOWNSTREAM_CHAIN_HEAD is a wrapper for CLI_ALL_DOWNSTREAM_CHAIN_HEAD (but also contains a *onet.TreeNode)
+type Struct_CLI_ALL_DOWNSTREAM_CHAIN_HEAD struct {
+	*onet.TreeNode
+	net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD
+}
@@ -2,6 +2,7 @@ package protocols
 
 import (
 	prifi_lib "github.com/dedis/prifi/prifi-lib"
+	"github.com/dedis/prifi/prifi-lib/net"
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
 )
@@ -49,8 +50,15 @@ type PrifiTomlConfig struct {
 	DoLatencyTests                          bool
 	SocksServerPort                         int
 	SocksClientPort                         int
+	SocksLocalHandshake                     bool
+	SocksUpstreamProxy                      string
+	EgressPolicyFile                        string
+	DNSProxyPort                            int
+	DNSResolver                             string
+	TunInterface                            string
 	ProtocolVersion                         string
 	DCNetType                               string
+	DCNetPadGenerator                       string
 	ReplayPCAP                              bool
 	PCAPFolder                              string
 	TrusteeSleepTimeBetweenMessages         int
@@ -60,13 +68,26 @@ type PrifiTomlConfig struct {
 	DisruptionProtectionEnabled             bool
 	EquivocationProtectionEnabled           bool // not linked in the back
 	OpenClosedSlotsMinDelayBetweenRequests  int
+	OpenClosedSlotsMaxLength                int
+	OpenClosedSlotsScheduler                string
+	OpenClosedSlotsPositions                int
 	RelayMaxNumberOfConsecutiveFailedRounds int
 	RelayProcessingLoopSleepTime            int
 	RelayRoundTimeOut                       int
+	RelayBlameTimeOut                       int
 	RelayTrusteeCacheLowBound               int
 	RelayTrusteeCacheHighBound              int
+	RelayEpochLength                        int
+	MaxPayloadSize                          int
+	UDPFragmentSize                         int
+	UDPParityFragments                      int
+	DownstreamEncryptionEnabled             bool
+	UpstreamCompressionEnabled              bool
+	DownstreamChainEnabled                  bool
+	DownstreamGossipPeriod                  int
 	VerboseIngressEgressServers             bool
 	ForceDisruptionSinceRound3              bool
+	BlameTranscriptFolder                   string
 }
 
 //PriFiSDAWrapperConfig is all the information the SDA-Protocols needs. It contains the network map of identities, our role, and the socks parameters if we are the corresponding role
@@ -117,6 +138,7 @@ func (p *PriFiSDAProtocol) SetConfigFromPriFiService(config *PriFiSDAWrapperConf
 			config.RelaySideSocksConfig.UpstreamChannel,
 			experimentResultChan,
 			p.handleTimeout,
+			p.handleBlameVerdict,
 			ms)
 	case Trustee:
 		p.prifiLibInstance = prifi_lib.NewPriFiTrustee(config.Toml.TrusteeNeverSlowDown,
@@ -133,8 +155,11 @@ func (p *PriFiSDAProtocol) SetConfigFromPriFiService(config *PriFiSDAWrapperConf
 			config.ClientSideSocksConfig.DownstreamChannel,
 			config.Toml.ReplayPCAP,
 			config.Toml.PCAPFolder,
+			config.Toml.DownstreamChainEnabled,
 			ms)
 	}
+	// the keys of the roster sign what must be attributed to an entity, e.g., the blame verdicts of the relay
+	p.prifiLibInstance.SetIdentities(p.Private(), ms.identities())
 
 	p.registerHandlers()
 
@@ -146,3 +171,9 @@ func (p *PriFiSDAProtocol) SetConfigFromPriFiService(config *PriFiSDAWrapperConf
 func (p *PriFiSDAProtocol) SetTimeoutHandler(handler func([]string, []string)) {
 	p.toHandler = handler
 }
+
+// SetBlameHandler sets the function that will be called with the verdict of the
+// disruption protection and its transcript, and the identity of the guilty node, if the protocol runs as the relay.
+func (p *PriFiSDAProtocol) SetBlameHandler(handler func(net.BlameTranscript, *network.ServerIdentity)) {
+	p.blameHandler = handler
+}
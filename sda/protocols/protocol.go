@@ -43,6 +43,7 @@ type PriFiSDAProtocol struct {
 	role          PriFiRole
 	ms            MessageSender
 	toHandler     func([]string, []string)
+	blameHandler  func(net.BlameTranscript, *network.ServerIdentity)
 	ResultChannel chan interface{}
 
 	//this is the actual "PriFi" (DC-net) protocol/library, defined in prifi-lib/prifi.go
@@ -74,13 +75,26 @@ func (p *PriFiSDAProtocol) Start() error {
 	msg.Add("ExperimentRoundLimit", p.config.Toml.RelayReportingLimit)
 	msg.Add("UseUDP", p.config.Toml.UseUDP)
 	msg.Add("DCNetType", p.config.Toml.DCNetType)
+	msg.Add("DCNetPadGenerator", p.config.Toml.DCNetPadGenerator)
 	msg.Add("DisruptionProtectionEnabled", p.config.Toml.DisruptionProtectionEnabled)
 	msg.Add("OpenClosedSlotsMinDelayBetweenRequests", p.config.Toml.OpenClosedSlotsMinDelayBetweenRequests)
+	msg.Add("OpenClosedSlotsMaxLength", p.config.Toml.OpenClosedSlotsMaxLength)
+	msg.Add("OpenClosedSlotsScheduler", p.config.Toml.OpenClosedSlotsScheduler)
+	msg.Add("OpenClosedSlotsPositions", p.config.Toml.OpenClosedSlotsPositions)
 	msg.Add("RelayMaxNumberOfConsecutiveFailedRounds", p.config.Toml.RelayMaxNumberOfConsecutiveFailedRounds)
 	msg.Add("RelayProcessingLoopSleepTime", p.config.Toml.RelayProcessingLoopSleepTime)
 	msg.Add("RelayRoundTimeOut", p.config.Toml.RelayRoundTimeOut)
+	msg.Add("RelayBlameTimeOut", p.config.Toml.RelayBlameTimeOut)
 	msg.Add("RelayTrusteeCacheLowBound", p.config.Toml.RelayTrusteeCacheLowBound)
 	msg.Add("RelayTrusteeCacheHighBound", p.config.Toml.RelayTrusteeCacheHighBound)
+	msg.Add("RelayEpochLength", p.config.Toml.RelayEpochLength)
+	msg.Add("MaxPayloadSize", p.config.Toml.MaxPayloadSize)
+	msg.Add("UDPFragmentSize", p.config.Toml.UDPFragmentSize)
+	msg.Add("UDPParityFragments", p.config.Toml.UDPParityFragments)
+	msg.Add("DownstreamEncryptionEnabled", p.config.Toml.DownstreamEncryptionEnabled)
+	msg.Add("UpstreamCompressionEnabled", p.config.Toml.UpstreamCompressionEnabled)
+	msg.Add("DownstreamChainEnabled", p.config.Toml.DownstreamChainEnabled)
+	msg.Add("DownstreamGossipPeriod", p.config.Toml.DownstreamGossipPeriod)
 	msg.Add("EquivocationProtectionEnabled", p.config.Toml.EquivocationProtectionEnabled)
 	msg.Add("ForceDisruptionSinceRound3", p.config.Toml.ForceDisruptionSinceRound3)
 	msg.ForceParams = true
@@ -138,6 +152,15 @@ func init() {
 	network.RegisterMessage(net.REL_ALL_REVEAL_SHARED_SECRETS{})
 	network.RegisterMessage(net.CLI_REL_SHARED_SECRET{})
 	network.RegisterMessage(net.TRU_REL_SHARED_SECRET{})
+	network.RegisterMessage(net.REL_CLI_EPOCH_START{})
+	network.RegisterMessage(net.CLI_REL_EPOCH_PK_AND_EPH_PK{})
+	network.RegisterMessage(net.REL_TRU_EPOCH_SHUFFLE{})
+	network.RegisterMessage(net.TRU_REL_EPOCH_SHUFFLE{})
+	network.RegisterMessage(net.REL_TRU_EPOCH_TRANSCRIPT{})
+	network.RegisterMessage(net.TRU_REL_EPOCH_SHUFFLE_SIG{})
+	network.RegisterMessage(net.REL_ALL_EPOCH_SWITCH{})
+	network.RegisterMessage(net.CLI_REL_DOWNSTREAM_NACK{})
+	network.RegisterMessage(net.CLI_ALL_DOWNSTREAM_CHAIN_HEAD{})
 
 	onet.GlobalProtocolRegister(ProtocolName, NewPriFiSDAWrapperProtocol)
 }
@@ -159,6 +182,27 @@ func (p *PriFiSDAProtocol) handleTimeout(clientsIds []int, trusteesIds []int) {
 	p.toHandler(clients, trustees)
 }
 
+// handleBlameVerdict finds the ServerIdentity of the client or trustee found guilty
+// and calls the blame handler.
+func (p *PriFiSDAProtocol) handleBlameVerdict(transcript net.BlameTranscript) {
+	verdict := transcript.Verdict
+	nodes := p.ms.clients
+	if verdict.GuiltyIsTrustee {
+		nodes = p.ms.trustees
+	}
+	node, found := nodes[verdict.GuiltyID]
+	if !found {
+		log.Error("Blame verdict against unknown node", verdict.GuiltyID, "(trustee:", verdict.GuiltyIsTrustee, ")")
+		return
+	}
+
+	if p.blameHandler == nil {
+		log.Error("Blame verdict against", node.ServerIdentity, ", but no handler to evict it.")
+		return
+	}
+	p.blameHandler(transcript, node.ServerIdentity)
+}
+
 // NewPriFiSDAWrapperProtocol creates a bare PrifiSDAWrapper struct.
 // SetConfig **MUST** be called on it before it can participate
 // to the protocol.
@@ -272,5 +316,47 @@ func (p *PriFiSDAProtocol) registerHandlers() error {
 		return errors.New("couldn't register handler: " + err.Error())
 	}
 
+	//register key epoch handlers
+	err = p.RegisterHandler(p.Received_REL_CLI_EPOCH_START)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_CLI_REL_EPOCH_PK_AND_EPH_PK)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_REL_TRU_EPOCH_SHUFFLE)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_TRU_REL_EPOCH_SHUFFLE)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_REL_TRU_EPOCH_TRANSCRIPT)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_TRU_REL_EPOCH_SHUFFLE_SIG)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+	err = p.RegisterHandler(p.Received_REL_ALL_EPOCH_SWITCH)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+
+	//register reliable broadcast handlers
+	err = p.RegisterHandler(p.Received_CLI_REL_DOWNSTREAM_NACK)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+
+	//register accountable downstream handlers
+	err = p.RegisterHandler(p.Received_CLI_ALL_DOWNSTREAM_CHAIN_HEAD)
+	if err != nil {
+		return errors.New("couldn't register handler: " + err.Error())
+	}
+
 	return nil
 }
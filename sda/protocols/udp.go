@@ -27,8 +27,8 @@ const UDP_PORT int = 10101
 // MAX_UDP_SIZE is the max size of one broadcasted packet
 const MAX_UDP_SIZE int = 65507
 
-// FAKE_LOCAL_UDP_SIMULATED_LOSS_PERCENTAGE is the simulated loss percentage when we use a non-lossy local chanel
-const FAKE_LOCAL_UDP_SIMULATED_LOSS_PERCENTAGE = 0
+// FAKE_LOCAL_UDP_BUFFERED_MESSAGES is how many messages the fake local channel keeps for the listeners that lag behind
+const FAKE_LOCAL_UDP_BUFFERED_MESSAGES = 1024
 
 // MarshallableMessage . Since we can only send []byte over UDP, each interface{} we want to send needs to implement MarshallableMessage.
 // It has methods Print(), used for debug, ToBytes(), that converts it to a raw byte array, SetByte(), which simply store a byte array in the
@@ -51,10 +51,10 @@ type UDPChannel interface {
 
 /**
  * The localhost, non-udp, cheating udp channel that uses go-channels to transmit information.
- * It has perfect orderding, and no loss.
+ * It has perfect orderding, and each listener independently misses lossPercentage% of the messages.
  */
-func newLocalhostUDPChannel() UDPChannel {
-	return &LocalhostChannel{}
+func newLocalhostUDPChannel(lossPercentage int) UDPChannel {
+	return &LocalhostChannel{LossPercentage: lossPercentage}
 }
 
 /**
@@ -67,8 +67,9 @@ func newRealUDPChannel() UDPChannel {
 //LocalhostChannel is the fake, local UDP channel that uses channels
 type LocalhostChannel struct {
 	sync.RWMutex
-	lastMessageID int //the first real message has ID 1, as the struct puts in a 0 when initialized
-	lastMessage   []byte
+	LossPercentage int //the simulated loss percentage
+	lastMessageID  int //the first real message has ID 1, as the struct puts in a 0 when initialized
+	messages       map[int][]byte
 }
 
 //RealUDPChannel is the real UDP channel
@@ -83,11 +84,11 @@ func (lc *LocalhostChannel) Broadcast(msg MarshallableMessage) error {
 	lc.Lock()
 	defer lc.Unlock()
 
-	if lc.lastMessage == nil {
+	if lc.messages == nil {
 
 		log.Lvl4("Broadcast - setting msg # to 0")
 		lc.lastMessageID = 0
-		lc.lastMessage = make([]byte, 0)
+		lc.messages = make(map[int][]byte)
 	}
 
 	data, err := msg.ToBytes()
@@ -95,36 +96,26 @@ func (lc *LocalhostChannel) Broadcast(msg MarshallableMessage) error {
 		log.Error("Broadcast: could not marshal message, error is", err.Error())
 	}
 
-	//append message to the buffer bool
-	lc.lastMessage = data
+	//append message to the buffer, and forget the oldest one
 	lc.lastMessageID++
+	lc.messages[lc.lastMessageID] = data
+	delete(lc.messages, lc.lastMessageID-FAKE_LOCAL_UDP_BUFFERED_MESSAGES)
 	log.Lvl4("Broadcast - added message, new message has Id ", lc.lastMessageID, ".")
 
 	return nil
 }
 
-//ListenAndBlock of LocalhostChannel is the implementation of message reception for the fake localhost channel
+//ListenAndBlock of LocalhostChannel is the implementation of message reception for the fake localhost channel.
+//It returns the message following lastSeenMessage, or nil if this listener lost it
 func (lc *LocalhostChannel) ListenAndBlock(emptyMessage MarshallableMessage, lastSeenMessage int, identityListening string) (interface{}, error) {
 
 	//we wait until there is a new message
 	lc.RLock()
 	defer lc.RUnlock()
 
-	//our channel is lossy. we decide "in advance" if we will miss next message
-	r := rand.Intn(100)
-	willIgnoreNextMessage := false
-	if r < FAKE_LOCAL_UDP_SIMULATED_LOSS_PERCENTAGE {
-		willIgnoreNextMessage = true
-	}
-
-	if willIgnoreNextMessage {
-		log.Lvl4("ListenAndBlock : Lossy UDP (loss", FAKE_LOCAL_UDP_SIMULATED_LOSS_PERCENTAGE, "%), we will ignore message coming after", lastSeenMessage, "and wait for message after", (lastSeenMessage + 1))
-		lastSeenMessage++
-	}
-
 	log.Lvl4("ListenAndBlock - waiting on message ", (lastSeenMessage + 1), ".")
 
-	for lc.lastMessageID == lastSeenMessage {
+	for lc.lastMessageID <= lastSeenMessage {
 		//unlock before wait !
 		lc.RUnlock()
 
@@ -133,13 +124,15 @@ func (lc *LocalhostChannel) ListenAndBlock(emptyMessage MarshallableMessage, las
 		lc.RLock()
 	}
 
-	log.Lvl4("ListenAndBlock - returning message n°" + strconv.Itoa(lastSeenMessage+1) + ".")
-	//there's one
-	lastMsg := lc.lastMessage
-
-	emptyMessage.FromBytes(lastMsg)
+	//our channel is lossy, and we do not wait for the listeners that lag too much behind
+	data, found := lc.messages[lastSeenMessage+1]
+	if !found || rand.Intn(100) < lc.LossPercentage {
+		log.Lvl4("ListenAndBlock : Lossy UDP (loss", lc.LossPercentage, "%), we lost message n°"+strconv.Itoa(lastSeenMessage+1)+".")
+		return nil, nil
+	}
 
-	return emptyMessage, nil
+	log.Lvl4("ListenAndBlock - returning message n°" + strconv.Itoa(lastSeenMessage+1) + ".")
+	return emptyMessage.FromBytes(data)
 }
 
 //Broadcast of RealUDPChannel is the implementation of broadcast for the real UDP channel
@@ -206,7 +199,7 @@ func (c *RealUDPChannel) ListenAndBlock(emptyMessage MarshallableMessage, lastSe
 	sizeAdvertised := int(binary.BigEndian.Uint32(buf[0:4]))
 
 	if sizeAdvertised+4 != n {
-		log.Error("ListenAndBlock(", identityListening, "): could not receive read the ", string(sizeAdvertised+4), ", only", n, ", error is", err.Error())
+		log.Error("ListenAndBlock(", identityListening, "): could not receive read the ", strconv.Itoa(sizeAdvertised+4), ", only", n, ", error is", err.Error())
 	}
 	message := make([]byte, sizeAdvertised)
 	copy(message[:], buf[4:sizeAdvertised+4])
@@ -0,0 +1,116 @@
+package protocols
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/dedis/prifi/prifi-lib/net"
+)
+
+func TestLocalhostChannelLoss(t *testing.T) {
+
+	cell := make([]byte, 100)
+	rand.Read(cell)
+	fragments, err := net.FragmentCell(0, cell, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lossless := newLocalhostUDPChannel(0)
+	lossy := newLocalhostUDPChannel(100)
+	for i := 0; i < 10; i++ {
+		lossless.Broadcast(fragments[0])
+		lossy.Broadcast(fragments[0])
+	}
+	for i := 0; i < 10; i++ {
+		msg, err := lossless.ListenAndBlock(&net.REL_CLI_DOWNSTREAM_FRAGMENT{}, i, "client-0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg == nil || !bytes.Equal(msg.(net.REL_CLI_DOWNSTREAM_FRAGMENT).Data, cell) {
+			t.Error("Message", i+1, "should have been received")
+		}
+		if msg, _ := lossy.ListenAndBlock(&net.REL_CLI_DOWNSTREAM_FRAGMENT{}, i, "client-0"); msg != nil {
+			t.Error("Message", i+1, "should have been lost")
+		}
+	}
+}
+
+func TestLocalhostChannelFragmentRepair(t *testing.T) {
+
+	nRounds := 20
+	nClients := 3
+	channel := newLocalhostUDPChannel(20)
+
+	cells := make([][]byte, nRounds)
+	fragments := make([][]*net.REL_CLI_DOWNSTREAM_FRAGMENT, nRounds)
+	for i := range cells {
+		cells[i] = make([]byte, 5000)
+		rand.Read(cells[i])
+		fragments[i], _ = net.FragmentCell(int32(i), cells[i], 1000, 2)
+		for _, f := range fragments[i] {
+			channel.Broadcast(f)
+		}
+	}
+	sent := nRounds * len(fragments[0])
+
+	lastSeen := make([]int, nClients)
+	reassemblers := make([]*net.DownstreamReassembler, nClients)
+	delivered := make([][][]byte, nClients)
+	listen := func(upTo int) {
+		for c := range reassemblers {
+			for ; lastSeen[c] < upTo; lastSeen[c]++ {
+				msg, err := channel.ListenAndBlock(&net.REL_CLI_DOWNSTREAM_FRAGMENT{}, lastSeen[c], "client")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if msg != nil {
+					reassemblers[c].Add(msg.(net.REL_CLI_DOWNSTREAM_FRAGMENT))
+				}
+			}
+			delivered[c] = append(delivered[c], reassemblers[c].Deliverable()...)
+		}
+	}
+	for c := range reassemblers {
+		reassemblers[c] = net.NewDownstreamReassembler(0)
+	}
+	listen(sent)
+
+	// the parity alone cannot cover 20% of loss; the clients ask for what they miss, until they have everything
+	for attempt := 0; attempt < 100; attempt++ {
+		nacks := 0
+		for _, r := range reassemblers {
+			if r.NextRound() == int32(nRounds) {
+				continue
+			}
+			roundID := r.NextRound()
+			missing := r.Missing(roundID)
+			if missing == nil {
+				for i := range fragments[roundID] {
+					missing = append(missing, i)
+				}
+			}
+			for _, i := range missing {
+				channel.Broadcast(fragments[roundID][i])
+				sent++
+			}
+			nacks++
+		}
+		if nacks == 0 {
+			break
+		}
+		listen(sent)
+	}
+
+	for c := range reassemblers {
+		if len(delivered[c]) != nRounds {
+			t.Fatal("Client", c, "rebuilt", len(delivered[c]), "cells out of", nRounds)
+		}
+		for i := range delivered[c] {
+			if !bytes.Equal(delivered[c][i], cells[i]) {
+				t.Error("Client", c, "did not rebuild the cell of round", i, "correctly")
+			}
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
+	"sort"
 	"sync"
 )
 
@@ -25,6 +26,10 @@ import (
  * He kills his local instance of PriFi protocol
  * He empties the list of waiting nodes
  *
+ * When the disruption protection finds a disruptor :
+ * he removes it from the list of nodes, and ignores its connections from now on
+ * he renumbers the other nodes, kills PriFi, and reruns it if > threshold
+ *
  * Every X seconds :
  * if the protocol is not running
  * count the number of participants, if > threshold, start prifi
@@ -59,6 +64,7 @@ type churnHandler struct {
 	nextFreeTrusteeID int
 	relayIdentity     *network.ServerIdentity //necessary to call createRoster
 	trusteesIDs       []*network.ServerIdentity
+	evicted           map[string]bool // the nodes found guilty of disruption, which cannot join again
 
 	//to be specified when instantiated
 	startProtocol     func()
@@ -83,6 +89,7 @@ func (c *churnHandler) init(relayID *network.ServerIdentity, trusteesIDs []*netw
 	c.nextFreeTrusteeID = 0
 	c.relayIdentity = relayID
 	c.trusteesIDs = trusteesIDs
+	c.evicted = make(map[string]bool)
 }
 
 /**
@@ -220,6 +227,10 @@ func (c *churnHandler) handleConnection(msg *network.Envelope) {
 		log.Lvl4("Ignored new connection request from", node, ID, "already in the list")
 		return
 	}
+	if c.evicted[ID] {
+		log.Lvl2("Ignored new connection request from", node, ID, "evicted for disruption")
+		return
+	}
 
 	log.Lvl2("Received new connection request from", node, ID)
 
@@ -295,6 +306,51 @@ func (c *churnHandler) handleDisconnection(msg *network.Envelope) {
 	c.handleUnknownDisconnection()
 }
 
+/**
+ * Renumbers the entries from 0, in the order of their current numeric IDs, and returns the next free ID
+ */
+func renumber(entries map[string]*waitQueueEntry) int {
+	sorted := make([]*waitQueueEntry, 0, len(entries))
+	for _, v := range entries {
+		sorted = append(sorted, v)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].numericID < sorted[j].numericID })
+	for i, v := range sorted {
+		v.numericID = i
+	}
+	return len(sorted)
+}
+
+/**
+ * Evicts a node found guilty of disruption: it is removed from the waiting nodes and cannot join again. The others
+ * keep their order, and the protocol restarts without it.
+ */
+func (c *churnHandler) evict(serverID *network.ServerIdentity, isTrustee bool) {
+
+	c.waitQueue.writeMutex.Lock()
+	defer c.waitQueue.writeMutex.Unlock()
+
+	ID := idFromServerIdentity(serverID)
+	c.evicted[ID] = true
+
+	if !c.waitQueue.contains(ID, isTrustee) {
+		log.Lvl2("Evicted", ID, " (isATrustee:", isTrustee, "), which was not in the list")
+		return
+	}
+	log.Lvl1("Evicting", ID, " (isATrustee:", isTrustee, ")")
+
+	if isTrustee {
+		delete(c.waitQueue.trustees, ID)
+		c.nextFreeTrusteeID = renumber(c.waitQueue.trustees)
+	} else {
+		delete(c.waitQueue.clients, ID)
+		c.nextFreeClientID = renumber(c.waitQueue.clients)
+	}
+
+	c.stopProtocol()
+	c.tryStartProtocol()
+}
+
 /**
  * restarts the protocol (stop + start) if nClients waiting & nTrustees waiting both > 1
  */
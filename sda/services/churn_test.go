@@ -633,3 +633,91 @@ func TestChurn(t *testing.T) {
 		t.Error("Protocol should have restarted")
 	}
 }
+
+func TestChurnEviction(t *testing.T) {
+
+	relayID := genSI("127.0.0.0:1")
+	trustees := []*network.ServerIdentity{genSI("0.127.0.0:0")}
+	clients := make([]*network.ServerIdentity, 3)
+	for i := 0; i < len(clients); i++ {
+		clients[i] = genSI("0.0.127.0:" + strconv.Itoa(i))
+	}
+
+	c := new(churnHandler)
+	c.init(relayID, trustees)
+	c.stopProtocol = stopProtocol
+	c.startProtocol = startProtocol
+	c.isProtocolRunning = func() bool { return true }
+
+	c.handleConnection(genPacketFromSource(trustees[0]))
+	for i := 0; i < len(clients); i++ {
+		c.handleConnection(genPacketFromSource(clients[i]))
+	}
+	stopProtocolCalled = false
+	startProtocolCalled = false
+
+	//evict the client in the middle
+	c.evict(clients[1], false)
+	nClients, nTrustees := c.waitQueue.count()
+	if nClients != 2 {
+		t.Error("nClients should be 2, is", nClients)
+	}
+	if nTrustees != 1 {
+		t.Error("nTrustees should be 1, is", nTrustees)
+	}
+	if !stopProtocolCalled || !startProtocolCalled {
+		t.Error("Protocol should have been restarted without the evicted client")
+	}
+	idMap := c.createIdentitiesMap()
+	if testIfInIDMap(idMap, clients[1]) {
+		t.Error("Client 1 should not be in idMap")
+	}
+	if !testIDMapForCollisions(idMap) {
+		t.Error("Something is wrong in the ID map")
+		log.Lvlf1("%+v", idMap)
+	}
+	for _, v := range idMap {
+		if v.ServerID.Equal(clients[2]) && v.ID != 1 {
+			t.Error("Client 2 should now have ID 1, has", v.ID)
+		}
+	}
+	stopProtocolCalled = false
+	startProtocolCalled = false
+
+	//the evicted client cannot join again
+	c.handleConnection(genPacketFromSource(clients[1]))
+	nClients, _ = c.waitQueue.count()
+	if nClients != 2 {
+		t.Error("nClients should still be 2, is", nClients)
+	}
+	if stopProtocolCalled || startProtocolCalled {
+		t.Error("Protocol should not have been restarted for an evicted client")
+	}
+
+	//a new client gets the next ID
+	newClient := genSI("0.0.127.0:3")
+	c.handleConnection(genPacketFromSource(newClient))
+	idMap = c.createIdentitiesMap()
+	if !testIDMapForCollisions(idMap) {
+		t.Error("Something is wrong in the ID map")
+		log.Lvlf1("%+v", idMap)
+	}
+	for _, v := range idMap {
+		if v.ServerID.Equal(newClient) && v.ID != 2 {
+			t.Error("The new client should have ID 2, has", v.ID)
+		}
+	}
+
+	//evicting the only trustee stops the protocol until another one joins
+	stopProtocolCalled = false
+	startProtocolCalled = false
+	c.evict(trustees[0], true)
+	if !stopProtocolCalled {
+		t.Error("Protocol should have been stopped")
+	}
+	if startProtocolCalled {
+		t.Error("Protocol should not have started without trustees")
+	}
+	stopProtocolCalled = false
+	startProtocolCalled = false
+}
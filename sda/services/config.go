@@ -88,4 +88,7 @@ func (s *ServiceState) setConfigToPriFiProtocol(wrapper *prifi_protocol.PriFiSDA
 
 	//when PriFi-protocol (via PriFi-lib) detects a slow client, call "handleTimeout"
 	wrapper.SetTimeoutHandler(s.handleTimeout)
+
+	//when the disruption protection finds a disruptor, call "handleBlameVerdict"
+	wrapper.SetBlameHandler(s.handleBlameVerdict)
 }
@@ -1,12 +1,15 @@
 package services
 
 import (
+	"fmt"
+	"github.com/dedis/prifi/prifi-lib/net"
 	prifi_protocol "github.com/dedis/prifi/sda/protocols"
 	"github.com/dedis/prifi/utils"
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
 	"io/ioutil"
 	"os"
+	"path"
 	"runtime/pprof"
 	"time"
 )
@@ -107,6 +110,46 @@ func (s *ServiceState) handleTimeout(lateClients []string, lateTrustees []string
 	s.NetworkErrorHappened(nil)
 }
 
+// handleBlameVerdict is a callback that should be called on the relay when
+// the disruption protection found a disruptor. It saves the transcript of the
+// blame, evicts the disruptor, and restarts PriFi without it.
+func (s *ServiceState) handleBlameVerdict(transcript net.BlameTranscript, guilty *network.ServerIdentity) {
+	verdict := transcript.Verdict
+	if err := verdict.Verify(s.churnHandler.relayIdentity.Public); err != nil {
+		log.Error("Ignoring a blame verdict against", guilty, ", it is not signed by the relay:", err)
+		return
+	}
+	s.saveBlameTranscript(&transcript)
+	log.Error("Evicting", guilty, "found guilty of disruption in round", verdict.RoundID, ":", verdict.Reason)
+	s.churnHandler.evict(guilty, verdict.GuiltyIsTrustee)
+}
+
+// saveBlameTranscript writes the transcript of a blame in the BlameTranscriptFolder,
+// where "prifi verify-blame" can check it.
+func (s *ServiceState) saveBlameTranscript(transcript *net.BlameTranscript) {
+	folder := s.prifiTomlConfig.BlameTranscriptFolder
+	if folder == "" {
+		return
+	}
+	if err := os.MkdirAll(folder, 0750); err != nil {
+		log.Error("Could not create the folder", folder, "for the blame transcripts:", err)
+		return
+	}
+
+	entity := "client"
+	if transcript.Verdict.GuiltyIsTrustee {
+		entity = "trustee"
+	}
+	fileName := fmt.Sprintf("blame-round%d-%s%d-%d.bin", transcript.Verdict.RoundID, entity,
+		transcript.Verdict.GuiltyID, time.Now().Unix())
+	filePath := path.Join(folder, fileName)
+	if err := transcript.Save(filePath); err != nil {
+		log.Error("Could not save the blame transcript:", err)
+		return
+	}
+	log.Lvl1("Blame transcript saved in", filePath)
+}
+
 // This is a handler passed to the SDA when starting a host. The SDA usually handle all the network by itself,
 // but in our case it is useful to know when a network RESET occurred, so we can kill protocols (otherwise they
 // remain in some weird state)
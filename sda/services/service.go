@@ -12,6 +12,9 @@ import (
 	"io/ioutil"
 	"strconv"
 
+	"github.com/dedis/prifi/prifi-lib/compression"
+	"github.com/dedis/prifi/prifi-lib/crypto"
+	"github.com/dedis/prifi/prifi-lib/dcnet"
 	prifi_protocol "github.com/dedis/prifi/sda/protocols"
 	"github.com/dedis/prifi/stream-multiplexer"
 	"go.dedis.ch/onet/v3"
@@ -155,12 +158,18 @@ func (s *ServiceState) StartRelay(group *app.Group) error {
 		DownstreamChannel: make(chan []byte),
 	}
 
+	egressOptions, err := s.egressOptions()
+	if err != nil {
+		return err
+	}
+
 	//the relay has a socks Client
 	if !s.hasSocksClientGoRoutine {
 		stopChan := make(chan bool, 1)
 		log.Lvl1("Starting EGRESS", s.prifiTomlConfig.VerboseIngressEgressServers)
-		go stream_multiplexer.StartEgressHandler(socksServerConfig.ListeningAddr, socksServerConfig.PayloadSize,
-			socksServerConfig.UpstreamChannel, socksServerConfig.DownstreamChannel, stopChan, s.prifiTomlConfig.VerboseIngressEgressServers)
+		go stream_multiplexer.StartEgressHandlerWithOptions(socksServerConfig.ListeningAddr, egressOptions,
+			socksServerConfig.PayloadSize, socksServerConfig.UpstreamChannel, socksServerConfig.DownstreamChannel, stopChan,
+			s.prifiTomlConfig.VerboseIngressEgressServers)
 		s.socksStopChan = append(s.socksStopChan, stopChan)
 		s.hasSocksClientGoRoutine = true
 	}
@@ -180,9 +189,25 @@ func (s *ServiceState) StartClient(group *app.Group, delay time.Duration) error
 	relayID, trusteeIDs := mapIdentities(group)
 	s.relayIdentity = relayID
 
+	//the protections take some room in the slot, see dcnet.CellLayout
+	layout := dcnet.CellLayout{
+		PayloadSize:            s.prifiTomlConfig.PayloadSize,
+		DisruptionProtection:   s.prifiTomlConfig.DisruptionProtectionEnabled,
+		EquivocationProtection: s.prifiTomlConfig.EquivocationProtectionEnabled,
+	}
+	payloadSize := layout.DataSize()
+	//so does the downstream key
+	if s.prifiTomlConfig.DownstreamEncryptionEnabled {
+		payloadSize -= crypto.DOWNSTREAM_KEY_SIZE
+	}
+	//so does the compression flag
+	if s.prifiTomlConfig.UpstreamCompressionEnabled {
+		payloadSize -= compression.FLAG_SIZE
+	}
+
 	socksClientConfig = &prifi_protocol.SOCKSConfig{
 		Port:              s.prifiTomlConfig.SocksServerPort,
-		PayloadSize:       s.prifiTomlConfig.PayloadSize,
+		PayloadSize:       payloadSize,
 		UpstreamChannel:   make(chan []byte),
 		DownstreamChannel: make(chan []byte),
 	}
@@ -191,7 +216,7 @@ func (s *ServiceState) StartClient(group *app.Group, delay time.Duration) error
 	if !s.hasSocksServerGoRoutine {
 		log.Lvl1("Starting SOCKS server on port", socksClientConfig.Port)
 		stopChan := make(chan bool, 1)
-		go stream_multiplexer.StartIngressServer(socksClientConfig.Port, socksClientConfig.PayloadSize,
+		go stream_multiplexer.StartIngressServerWithOptions(socksClientConfig.Port, s.ingressOptions(), socksClientConfig.PayloadSize,
 			socksClientConfig.UpstreamChannel, socksClientConfig.DownstreamChannel, stopChan, s.prifiTomlConfig.VerboseIngressEgressServers)
 		s.socksStopChan = append(s.socksStopChan, stopChan)
 		s.hasSocksServerGoRoutine = true
@@ -230,16 +255,47 @@ func (s *ServiceState) StartSocksTunnelOnly() error {
 		UpstreamChannel:   socksClientConfig.UpstreamChannel,
 		DownstreamChannel: socksClientConfig.DownstreamChannel,
 	}
+	egressOptions, err := s.egressOptions()
+	if err != nil {
+		return err
+	}
+
 	stopChan1 := make(chan bool, 1)
 	stopChan2 := make(chan bool, 1)
-	go stream_multiplexer.StartIngressServer(socksClientConfig.Port, socksClientConfig.PayloadSize, socksClientConfig.UpstreamChannel, socksClientConfig.DownstreamChannel, stopChan1, s.prifiTomlConfig.VerboseIngressEgressServers)
-	go stream_multiplexer.StartEgressHandler(socksServerConfig.ListeningAddr, socksClientConfig.PayloadSize, socksServerConfig.UpstreamChannel, socksServerConfig.DownstreamChannel, stopChan2, s.prifiTomlConfig.VerboseIngressEgressServers)
+	go stream_multiplexer.StartIngressServerWithOptions(socksClientConfig.Port, s.ingressOptions(), socksClientConfig.PayloadSize, socksClientConfig.UpstreamChannel, socksClientConfig.DownstreamChannel, stopChan1, s.prifiTomlConfig.VerboseIngressEgressServers)
+	go stream_multiplexer.StartEgressHandlerWithOptions(socksServerConfig.ListeningAddr, egressOptions, socksClientConfig.PayloadSize, socksServerConfig.UpstreamChannel, socksServerConfig.DownstreamChannel, stopChan2, s.prifiTomlConfig.VerboseIngressEgressServers)
 	s.socksStopChan = append(s.socksStopChan, stopChan1)
 	s.socksStopChan = append(s.socksStopChan, stopChan2)
 
 	return nil
 }
 
+// ingressOptions returns the settings of the client's Ingress Server
+func (s *ServiceState) ingressOptions() stream_multiplexer.IngressOptions {
+	return stream_multiplexer.IngressOptions{
+		SOCKS:        s.prifiTomlConfig.SocksLocalHandshake,
+		DNSProxyPort: s.prifiTomlConfig.DNSProxyPort,
+		TunInterface: s.prifiTomlConfig.TunInterface,
+	}
+}
+
+// egressOptions returns the settings of the relay's Egress Server, with the egress policy if there is one
+func (s *ServiceState) egressOptions() (stream_multiplexer.EgressOptions, error) {
+	options := stream_multiplexer.EgressOptions{
+		UpstreamProxy: s.prifiTomlConfig.SocksUpstreamProxy,
+		DNSResolver:   s.prifiTomlConfig.DNSResolver,
+	}
+	if s.prifiTomlConfig.EgressPolicyFile != "" {
+		policy, err := stream_multiplexer.LoadEgressPolicy(s.prifiTomlConfig.EgressPolicyFile)
+		if err != nil {
+			log.Error("Could not load the egress policy", s.prifiTomlConfig.EgressPolicyFile, ":", err)
+			return options, err
+		}
+		options.Policy = policy
+	}
+	return options, nil
+}
+
 // StartTrustee starts the necessary
 // protocols to enable the trustee-mode.
 func (s *ServiceState) StartTrustee(group *app.Group) error {
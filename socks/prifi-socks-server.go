@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/armon/go-socks5"
+	"github.com/dedis/prifi/stream-multiplexer"
 	"go.dedis.ch/onet/v3/log"
 	"strconv"
 )
@@ -18,6 +20,7 @@ func main() {
 	// Command-line flags
 	var debugFlag = flag.Int("debug", defaultBugLevel, "debug-level")
 	var portFlag = flag.Int("port", defaultPort, "port")
+	var policyFlag = flag.String("policy", "", "egress policy (TOML file), see stream-multiplexer/policy.go")
 	flag.Parse()
 	log.SetDebugVisible(*debugFlag)
 
@@ -37,6 +40,13 @@ func main() {
 
 	// Create a SOCKS5 server
 	conf := &socks5.Config{}
+	if *policyFlag != "" {
+		policy, err := stream_multiplexer.LoadEgressPolicy(*policyFlag)
+		if err != nil {
+			log.Fatal("Could not load the egress policy", *policyFlag, "error is", err)
+		}
+		conf.Rules = &policyRules{policy: policy}
+	}
 	server, err := socks5.New(conf)
 	if err != nil {
 		panic(err)
@@ -48,6 +58,24 @@ func main() {
 	}
 }
 
+// policyRules enforces an egress policy on the requests
+type policyRules struct {
+	policy *stream_multiplexer.EgressPolicy
+}
+
+// Allow implements socks5.RuleSet; the destination is resolved already
+func (r *policyRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	host := req.DestAddr.FQDN
+	if host == "" {
+		host = req.DestAddr.IP.String()
+	}
+	if err := r.policy.CheckDestination(host, req.DestAddr.IP, req.DestAddr.Port); err != nil {
+		log.Lvl1("Egress policy: refused a request to", req.DestAddr.String()+",", err)
+		return ctx, false
+	}
+	return ctx, true
+}
+
 func contains(intSlice []int, searchInt int) bool {
 	for _, value := range intSlice {
 		if value == searchInt {
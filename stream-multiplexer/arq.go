@@ -0,0 +1,193 @@
+package stream_multiplexer
+
+/*
+ARQ
+***
+The relay drops a round that takes too long (see checkIfRoundHasEndedAfterTimeOut_Phase1), and the frames it carried
+are lost. The IngressServer therefore keeps each frame it sends upstream in a sliding window, until the EgressServer
+acknowledges it. The acknowledgements are cumulative (all frames before Ack were received) and piggybacked on the
+downstream frames of the stream; if the stream has nothing to send back, the egress sends a WINDOW_UPDATE frame after
+ACK_DELAY. A frame that is not acknowledged after its timeout is given again to the client, which sends it in its next
+owned slot. The window bounds how much data is in flight: when it is full, or when the receiver's window (see flow.go)
+is exhausted, we stop reading the TCP connection.
+*/
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SEND_WINDOW is the maximum number of unacknowledged frames per stream
+const SEND_WINDOW = 64
+
+// RETRANSMIT_TIMEOUT is how long we wait for the acknowledgement of a frame before sending it again
+const RETRANSMIT_TIMEOUT = time.Second
+
+// MAX_RETRANSMIT_TIMEOUT bounds the timeout, which doubles at each retransmission of a frame
+const MAX_RETRANSMIT_TIMEOUT = 8 * time.Second
+
+// MAX_RETRANSMISSIONS is how many times we send a frame again before giving up on the stream
+const MAX_RETRANSMISSIONS = 6
+
+// RETRANSMIT_CHECK_INTERVAL is how often we look for frames to retransmit
+const RETRANSMIT_CHECK_INTERVAL = 100 * time.Millisecond
+
+// ACK_DELAY is how long the egress waits for downstream data to piggyback an acknowledgement on
+const ACK_DELAY = 200 * time.Millisecond
+
+// a frame waiting for its acknowledgement
+type sentFrame struct {
+	frame           *Frame
+	sentAt          time.Time // zero until the frame is actually sent
+	timeout         time.Duration
+	retransmissions int
+}
+
+// sendWindow holds the unacknowledged frames of a stream, in order, and the credit the receiver gave us
+type sendWindow struct {
+	lock          *sync.Mutex
+	notFull       *sync.Cond
+	frames        []*sentFrame
+	closed        bool
+	receiveWindow uint32 // the last window advertised by the receiver, or WINDOW_UNLIMITED
+	acked         uint32 // the receiver has all frames before acked
+	limit         uint32 // we can send the frames before limit
+}
+
+// newSendWindow creates a window, with the receiver's initial window
+func newSendWindow(receiveWindow uint32) *sendWindow {
+	w := &sendWindow{lock: new(sync.Mutex), frames: make([]*sentFrame, 0), receiveWindow: receiveWindow, limit: receiveWindow}
+	w.notFull = sync.NewCond(w.lock)
+	return w
+}
+
+// hasCredit tells if the receiver accepts the frame seq. Must hold the lock
+func (w *sendWindow) hasCredit(seq uint32) bool {
+	return w.receiveWindow == WINDOW_UNLIMITED || w.limit-seq-1 < 1<<31
+}
+
+// waitCredit waits until the receiver accepts the frame seq. Returns false if the window was closed meanwhile
+func (w *sendWindow) waitCredit(seq uint32) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for !w.hasCredit(seq) && !w.closed {
+		w.notFull.Wait()
+	}
+	return !w.closed
+}
+
+// push waits for room in the window and for the receiver's credit, then stores the frame. Returns false if the window
+// was closed meanwhile
+func (w *sendWindow) push(f *Frame) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for (len(w.frames) >= SEND_WINDOW || !w.hasCredit(f.Seq)) && !w.closed {
+		w.notFull.Wait()
+	}
+	if w.closed {
+		return false
+	}
+	w.frames = append(w.frames, &sentFrame{frame: f, timeout: RETRANSMIT_TIMEOUT})
+	return true
+}
+
+// markSent starts the retransmission timer of a frame
+func (w *sendWindow) markSent(seq uint32) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for _, s := range w.frames {
+		if s.frame.Seq == seq {
+			s.sentAt = time.Now()
+			return
+		}
+	}
+}
+
+// ack removes the frames before seq, which the other side received. The receive window slides with it
+func (w *sendWindow) ack(seq uint32) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.acknowledge(seq)
+	if w.receiveWindow != WINDOW_UNLIMITED && seq+w.receiveWindow-w.limit < 1<<31 {
+		w.limit = seq + w.receiveWindow
+	}
+	w.notFull.Broadcast()
+}
+
+// update handles a WINDOW_UPDATE: acknowledges the frames before seq, and accepts receiveWindow frames after it
+func (w *sendWindow) update(seq uint32, receiveWindow uint32) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if seq-w.acked >= 1<<31 {
+		// an older update, arriving late
+		return
+	}
+	w.acknowledge(seq)
+	w.receiveWindow = receiveWindow
+	w.limit = seq + receiveWindow
+	w.notFull.Broadcast()
+}
+
+// acknowledge removes the frames before seq. Must hold the lock
+func (w *sendWindow) acknowledge(seq uint32) {
+	if seq-w.acked < 1<<31 {
+		w.acked = seq
+	}
+	n := 0
+	for n < len(w.frames) && seq-w.frames[n].frame.Seq-1 < 1<<31 {
+		n++
+	}
+	w.frames = w.frames[n:]
+}
+
+// due returns the oldest unacknowledged frame if its timeout expired, and restarts its timer. The later frames probably
+// arrived (the acknowledgements are cumulative, so we cannot tell); they are retransmitted when the acknowledgement
+// stops at them. Returns an error if the frame was retransmitted MAX_RETRANSMISSIONS times already; the stream is lost
+// then
+func (w *sendWindow) due(now time.Time) ([]*Frame, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if len(w.frames) == 0 {
+		return nil, nil
+	}
+	s := w.frames[0]
+	if s.sentAt.IsZero() || now.Sub(s.sentAt) < s.timeout {
+		return nil, nil
+	}
+	if s.retransmissions >= MAX_RETRANSMISSIONS {
+		return nil, errors.New("frame " + strconv.FormatUint(uint64(s.frame.Seq), 10) + " was not acknowledged after " +
+			strconv.Itoa(s.retransmissions) + " retransmissions")
+	}
+	s.retransmissions++
+	s.sentAt = now
+	s.timeout *= 2
+	if s.timeout > MAX_RETRANSMIT_TIMEOUT {
+		s.timeout = MAX_RETRANSMIT_TIMEOUT
+	}
+	return []*Frame{s.frame}, nil
+}
+
+// close releases the writers blocked in push
+func (w *sendWindow) close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.closed = true
+	w.notFull.Broadcast()
+}
+
+// size returns the number of unacknowledged frames
+func (w *sendWindow) size() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return len(w.frames)
+}
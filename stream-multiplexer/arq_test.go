@@ -0,0 +1,203 @@
+package stream_multiplexer
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSendWindowAck(t *testing.T) {
+
+	w := newSendWindow(WINDOW_UNLIMITED)
+	for i := 0; i < 3; i++ {
+		w.push(&Frame{ID: "abcd", Seq: uint32(i)})
+		w.markSent(uint32(i))
+	}
+	w.ack(2)
+	if w.size() != 1 {
+		t.Error("Frames 0 and 1 should be acknowledged, window has", w.size())
+	}
+	// acknowledgements are cumulative, an old one changes nothing
+	w.ack(1)
+	if w.size() != 1 {
+		t.Error("An old acknowledgement should not remove frames")
+	}
+	w.ack(3)
+	if w.size() != 0 {
+		t.Error("Window should be empty")
+	}
+
+	// sequence numbers wrap around
+	w.push(&Frame{ID: "abcd", Seq: 1<<32 - 1})
+	w.push(&Frame{ID: "abcd", Seq: 0})
+	w.ack(0)
+	if w.size() != 1 {
+		t.Error("Only the frame before the wrap should be acknowledged")
+	}
+}
+
+func TestSendWindowRetransmissions(t *testing.T) {
+
+	w := newSendWindow(WINDOW_UNLIMITED)
+	w.push(&Frame{ID: "abcd", Seq: 0})
+
+	// not sent yet, nothing to retransmit
+	if frames, _ := w.due(time.Now().Add(time.Hour)); len(frames) != 0 {
+		t.Error("A frame not sent yet should not be retransmitted")
+	}
+	w.markSent(0)
+	now := time.Now()
+
+	if frames, _ := w.due(now); len(frames) != 0 {
+		t.Error("Retransmitting too early")
+	}
+
+	// the timeout doubles at each retransmission, up to MAX_RETRANSMIT_TIMEOUT
+	timeout := RETRANSMIT_TIMEOUT
+	for i := 0; i < MAX_RETRANSMISSIONS; i++ {
+		now = now.Add(timeout)
+		frames, err := w.due(now)
+		if err != nil || len(frames) != 1 {
+			t.Fatal("Retransmission", i, "expected, got", len(frames), err)
+		}
+		timeout *= 2
+		if timeout > MAX_RETRANSMIT_TIMEOUT {
+			timeout = MAX_RETRANSMIT_TIMEOUT
+		}
+		if frames, _ := w.due(now.Add(timeout / 2)); len(frames) != 0 {
+			t.Error("Retransmitting before the timeout doubled")
+		}
+	}
+
+	if _, err := w.due(now.Add(timeout)); err == nil {
+		t.Error("Should give up after", MAX_RETRANSMISSIONS, "retransmissions")
+	}
+
+	// only the oldest frame is retransmitted, the next ones wait for the acknowledgement to stop at them
+	w = newSendWindow(WINDOW_UNLIMITED)
+	for i := 0; i < 3; i++ {
+		w.push(&Frame{ID: "abcd", Seq: uint32(i)})
+		w.markSent(uint32(i))
+	}
+	now = time.Now().Add(RETRANSMIT_TIMEOUT)
+	frames, _ := w.due(now)
+	if len(frames) != 1 || frames[0].Seq != 0 {
+		t.Fatal("Expected the retransmission of frame 0 only")
+	}
+	w.ack(2)
+	frames, _ = w.due(now)
+	if len(frames) != 1 || frames[0].Seq != 2 {
+		t.Error("Expected the retransmission of frame 2, whose timeout expired too")
+	}
+}
+
+func TestSendWindowBackPressure(t *testing.T) {
+
+	w := newSendWindow(WINDOW_UNLIMITED)
+	for i := 0; i < SEND_WINDOW; i++ {
+		w.push(&Frame{ID: "abcd", Seq: uint32(i)})
+	}
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- w.push(&Frame{ID: "abcd", Seq: SEND_WINDOW})
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("Push should block while the window is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	w.ack(1)
+	if ok := <-pushed; !ok {
+		t.Error("Push should succeed once a frame is acknowledged")
+	}
+
+	go func() {
+		pushed <- w.push(&Frame{ID: "abcd", Seq: SEND_WINDOW + 1})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	w.close()
+	if ok := <-pushed; ok {
+		t.Error("Push should fail once the window is closed")
+	}
+}
+
+// Tests that a stream survives the loss of upstream frames
+func TestARQLossyUpstream(t *testing.T) {
+
+	port := 3000
+	echoServer := "127.0.0.1:3001"
+	payloadLength := MULTIPLEXER_HEADER_SIZE + 100
+	stopChan := make(chan bool, 1)
+
+	// a server that echoes everything
+	l, err := net.Listen("tcp", echoServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+
+	// ingress -> lossy channel -> egress; the downstream direction is reliable
+	ingressUp := make(chan []byte)
+	egressUp := make(chan []byte)
+	down := make(chan []byte)
+	go func() {
+		n := 0
+		for slice := range ingressUp {
+			n++
+			if n%4 == 0 {
+				// this round is lost
+				continue
+			}
+			egressUp <- slice
+		}
+	}()
+	go StartEgressHandler(echoServer, payloadLength, egressUp, down, make(chan bool, 1), false)
+	go StartIngressServer(port, payloadLength, ingressUp, down, stopChan, false)
+
+	time.Sleep(2 * time.Second)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data := make([]byte, 3000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	conn.Write(data)
+
+	echo := make([]byte, 0)
+	buffer := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	for len(echo) < len(data) {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal("Got", len(echo), "bytes only,", err)
+		}
+		echo = append(echo, buffer[:n]...)
+	}
+
+	if !bytes.Equal(echo, data) {
+		t.Error("The echo differs from the data sent")
+	}
+
+	stopChan <- true
+	time.Sleep(2 * time.Second)
+}
@@ -0,0 +1,455 @@
+package stream_multiplexer
+
+/*
+DNS
+***
+The client can run a DNS proxy (UDP), so that the names are resolved anonymously even by the applications that do
+not use SOCKS5 remote resolution. All the queries of the client go through one stream, whose OPEN frame has the
+destination TARGET_DNS; each query, and each answer, is a message of the stream. The proxy gives its own IDs to the
+queries, since several applications can use the same ID, and puts the original ID back in the answer.
+
+The egress sends the queries to the relay's resolver, and caches the answers for the smallest TTL of their records
+(at most DNS_MAX_CACHE_TTL); an answer from the cache has its TTLs decreased by the time it spent there. If the
+resolver does not answer, the client gets a SERVFAIL. DNS over TCP is not proxied.
+*/
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"go.dedis.ch/onet/v3/log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNS_TIMEOUT is how long we wait for an answer of the resolver, and how long the proxy remembers a query
+const DNS_TIMEOUT = 5 * time.Second
+
+// DNS_CACHE_SIZE is the maximum number of answers cached by the egress
+const DNS_CACHE_SIZE = 10000
+
+// DNS_MAX_CACHE_TTL bounds the time an answer stays in the cache
+const DNS_MAX_CACHE_TTL = time.Hour
+
+const dnsHeaderSize = 12
+
+const (
+	dnsTypeOPT        = 41
+	dnsRcodeNoError   = 0
+	dnsRcodeServFail  = 2
+	dnsRcodeNXDomain  = 3
+	dnsFlagResponse   = 0x80 // in the third byte of the header
+	dnsFlagTruncated  = 0x02 // in the third byte of the header
+	dnsMaxMessageSize = 65535
+)
+
+var errDNSTooShort = errors.New("DNS message too short")
+
+// dnsSkipName returns the offset after the (possibly compressed) name at off
+func dnsSkipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errDNSTooShort
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return off + 1, nil
+		case length&0xc0 == 0xc0:
+			// a pointer ends the name
+			if off+2 > len(msg) {
+				return 0, errDNSTooShort
+			}
+			return off + 2, nil
+		case length&0xc0 != 0:
+			return 0, errors.New("invalid DNS label")
+		default:
+			off += 1 + length
+		}
+	}
+}
+
+// dnsQuestion returns the question of a message with one question, in lowercase, to use as a cache key
+func dnsQuestion(msg []byte) (string, error) {
+	if len(msg) < dnsHeaderSize {
+		return "", errDNSTooShort
+	}
+	if binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return "", errors.New("not one DNS question")
+	}
+	end, err := dnsSkipName(msg, dnsHeaderSize)
+	if err != nil {
+		return "", err
+	}
+	if end+4 > len(msg) {
+		return "", errDNSTooShort
+	}
+	return strings.ToLower(string(msg[dnsHeaderSize : end+4])), nil
+}
+
+// dnsTTLs returns the offsets of the TTLs of the records of a message, and the smallest TTL
+func dnsTTLs(msg []byte) ([]int, uint32, error) {
+	if len(msg) < dnsHeaderSize {
+		return nil, 0, errDNSTooShort
+	}
+	off := dnsHeaderSize
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:6])); i++ {
+		end, err := dnsSkipName(msg, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		off = end + 4
+	}
+
+	records := int(binary.BigEndian.Uint16(msg[6:8])) + int(binary.BigEndian.Uint16(msg[8:10])) +
+		int(binary.BigEndian.Uint16(msg[10:12]))
+	offsets := make([]int, 0, records)
+	minTTL := uint32(0)
+	for i := 0; i < records; i++ {
+		end, err := dnsSkipName(msg, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		// [2 type] [2 class] [4 TTL] [2 length] [data]
+		if end+10 > len(msg) {
+			return nil, 0, errDNSTooShort
+		}
+		recordType := binary.BigEndian.Uint16(msg[end : end+2])
+		if recordType != dnsTypeOPT {
+			// the "TTL" of OPT holds flags
+			ttl := binary.BigEndian.Uint32(msg[end+4 : end+8])
+			if len(offsets) == 0 || ttl < minTTL {
+				minTTL = ttl
+			}
+			offsets = append(offsets, end+4)
+		}
+		off = end + 10 + int(binary.BigEndian.Uint16(msg[end+8:end+10]))
+		if off > len(msg) {
+			return nil, 0, errDNSTooShort
+		}
+	}
+	return offsets, minTTL, nil
+}
+
+// dnsServerFailure returns a SERVFAIL answer to the query
+func dnsServerFailure(query []byte) []byte {
+	end := len(query)
+	if e, err := dnsSkipName(query, dnsHeaderSize); err == nil && e+4 <= len(query) {
+		end = e + 4
+	}
+	answer := make([]byte, end)
+	copy(answer, query[:end])
+	answer[2] |= dnsFlagResponse
+	answer[3] = answer[3]&0xf0 | dnsRcodeServFail
+	// only the question stays
+	for i := 6; i < dnsHeaderSize; i++ {
+		answer[i] = 0
+	}
+	return answer
+}
+
+// an answer in the cache
+type dnsCacheEntry struct {
+	answer     []byte
+	ttlOffsets []int
+	storedAt   time.Time
+	expiresAt  time.Time
+}
+
+// dnsCache holds the answers of the resolver, by question
+type dnsCache struct {
+	lock    sync.Mutex
+	entries map[string]*dnsCacheEntry
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: make(map[string]*dnsCacheEntry)}
+}
+
+// get returns a copy of the cached answer, with the ID of the query and the TTLs decreased, or nil
+func (c *dnsCache) get(question string, ID []byte, now time.Time) []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, found := c.entries[question]
+	if !found {
+		return nil
+	}
+	if !now.Before(e.expiresAt) {
+		delete(c.entries, question)
+		return nil
+	}
+
+	answer := make([]byte, len(e.answer))
+	copy(answer, e.answer)
+	copy(answer[0:2], ID)
+	elapsed := uint32(now.Sub(e.storedAt) / time.Second)
+	for _, off := range e.ttlOffsets {
+		ttl := binary.BigEndian.Uint32(answer[off : off+4])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(answer[off:off+4], ttl)
+	}
+	return answer
+}
+
+// put caches an answer, if it can be
+func (c *dnsCache) put(question string, answer []byte, now time.Time) {
+	if len(answer) < dnsHeaderSize || answer[2]&dnsFlagTruncated != 0 {
+		return
+	}
+	if rcode := answer[3] & 0x0f; rcode != dnsRcodeNoError && rcode != dnsRcodeNXDomain {
+		return
+	}
+	offsets, minTTL, err := dnsTTLs(answer)
+	if err != nil || len(offsets) == 0 || minTTL == 0 {
+		return
+	}
+	ttl := time.Duration(minTTL) * time.Second
+	if ttl > DNS_MAX_CACHE_TTL {
+		ttl = DNS_MAX_CACHE_TTL
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.entries) >= DNS_CACHE_SIZE {
+		for q, e := range c.entries {
+			if !now.Before(e.expiresAt) {
+				delete(c.entries, q)
+			}
+		}
+		// still full: forget any answer
+		for q := range c.entries {
+			if len(c.entries) < DNS_CACHE_SIZE {
+				break
+			}
+			delete(c.entries, q)
+		}
+	}
+	stored := make([]byte, len(answer))
+	copy(stored, answer)
+	c.entries[question] = &dnsCacheEntry{answer: stored, ttlOffsets: offsets, storedAt: now, expiresAt: now.Add(ttl)}
+}
+
+// dnsResolver answers the queries of the clients at the egress, from its cache or from the relay's resolver
+type dnsResolver struct {
+	address string
+	cache   *dnsCache
+}
+
+// newDNSResolver creates a resolver that asks the given server ("host:port"), or the system's if it is empty
+func newDNSResolver(address string) *dnsResolver {
+	if address == "" {
+		address = systemDNSResolver()
+	}
+	return &dnsResolver{address: address, cache: newDNSCache()}
+}
+
+// systemDNSResolver returns the first name server of /etc/resolv.conf, or the local host
+func systemDNSResolver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// resolve answers a query
+func (r *dnsResolver) resolve(query []byte) ([]byte, error) {
+	if len(query) < dnsHeaderSize {
+		return nil, errDNSTooShort
+	}
+	question, err := dnsQuestion(query)
+	if err == nil {
+		if answer := r.cache.get(question, query[0:2], time.Now()); answer != nil {
+			return answer, nil
+		}
+	}
+
+	conn, err := net.DialTimeout("udp", r.address, DNS_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(DNS_TIMEOUT))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, dnsMaxMessageSize)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		// ignore the stray answers
+		if n < dnsHeaderSize || buffer[0] != query[0] || buffer[1] != query[1] {
+			continue
+		}
+		answer := buffer[:n]
+		if question != "" {
+			r.cache.put(question, answer, time.Now())
+		}
+		return answer, nil
+	}
+}
+
+// newConn creates the connection of a DNS stream: each message written is a query, and its answer can be read
+func (r *dnsResolver) newConn() net.Conn {
+	var conn *messageConn
+	write := func(query []byte) (int, error) {
+		q := make([]byte, len(query))
+		copy(q, query)
+		go func() {
+			answer, err := r.resolve(q)
+			if err != nil {
+				log.Lvl3("Egress server: DNS resolution failed,", err)
+				if len(q) < dnsHeaderSize {
+					return
+				}
+				answer = dnsServerFailure(q)
+			}
+			conn.deliver(answer)
+		}()
+		return len(query), nil
+	}
+	conn = newMessageConn(write, nil, nil, nil)
+	return conn
+}
+
+// a query forwarded by the DNS proxy
+type pendingDNSQuery struct {
+	ID     []byte // the ID the application gave
+	from   *net.UDPAddr
+	sentAt time.Time
+}
+
+// dnsProxy takes the DNS queries of the applications on the client, and sends them through the DC-net
+type dnsProxy struct {
+	ig      *IngressServer
+	socket  *net.UDPConn
+	lock    sync.Mutex
+	stream  *messageConn // the stream of the queries, nil until the first query or after it was closed
+	pending map[uint16]*pendingDNSQuery
+	nextID  uint16
+}
+
+// startDNSProxy listens for DNS queries on the local port
+func (ig *IngressServer) startDNSProxy(port int) (*dnsProxy, error) {
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		return nil, err
+	}
+	p := &dnsProxy{ig: ig, socket: socket, pending: make(map[uint16]*pendingDNSQuery)}
+	go p.serve()
+	log.Lvl2("Ingress server: DNS proxy listening on port", strconv.Itoa(port))
+	return p, nil
+}
+
+// serve forwards the queries of the applications
+func (p *dnsProxy) serve() {
+	buffer := make([]byte, dnsMaxMessageSize)
+	for {
+		n, from, err := p.socket.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if n < dnsHeaderSize || n > p.ig.maxPayloadSize*MAX_FRAGMENTS_PER_MESSAGE {
+			continue
+		}
+		query := make([]byte, n)
+		copy(query, buffer[:n])
+
+		p.lock.Lock()
+		now := time.Now()
+		for ID, q := range p.pending {
+			if now.Sub(q.sentAt) > 2*DNS_TIMEOUT {
+				delete(p.pending, ID)
+			}
+		}
+		if len(p.pending) >= 1<<16 {
+			p.lock.Unlock()
+			continue
+		}
+		for _, used := p.pending[p.nextID]; used; _, used = p.pending[p.nextID] {
+			p.nextID++
+		}
+		ID := p.nextID
+		p.nextID++
+		p.pending[ID] = &pendingDNSQuery{ID: []byte{query[0], query[1]}, from: from, sentAt: now}
+		binary.BigEndian.PutUint16(query[0:2], ID)
+
+		if p.stream == nil {
+			p.stream = p.newStream()
+			p.ig.startStream(p.stream, []byte{TARGET_DNS})
+		}
+		stream := p.stream
+		p.lock.Unlock()
+
+		stream.deliver(query)
+	}
+}
+
+// newStream creates the connection of the stream of the queries. Must hold the lock
+func (p *dnsProxy) newStream() *messageConn {
+	var stream *messageConn
+	onClose := func() {
+		p.lock.Lock()
+		if p.stream == stream {
+			p.stream = nil
+		}
+		p.lock.Unlock()
+	}
+	stream = newMessageConn(p.answer, onClose, p.socket.LocalAddr(), nil)
+	return stream
+}
+
+// answer gives an answer to the application that asked
+func (p *dnsProxy) answer(answer []byte) (int, error) {
+	if len(answer) < dnsHeaderSize {
+		return len(answer), nil
+	}
+	ID := binary.BigEndian.Uint16(answer[0:2])
+
+	p.lock.Lock()
+	q, found := p.pending[ID]
+	delete(p.pending, ID)
+	p.lock.Unlock()
+
+	if !found {
+		// too late, the application gave up
+		return len(answer), nil
+	}
+	a := make([]byte, len(answer))
+	copy(a, answer)
+	copy(a[0:2], q.ID)
+	if _, err := p.socket.WriteToUDP(a, q.from); err != nil {
+		log.Lvl3("Ingress server: cannot answer a DNS query,", err)
+	}
+	return len(answer), nil
+}
+
+// close stops the proxy
+func (p *dnsProxy) close() {
+	p.socket.Close()
+	p.lock.Lock()
+	if p.stream != nil {
+		p.stream.finish()
+	}
+	p.lock.Unlock()
+}
@@ -0,0 +1,192 @@
+package stream_multiplexer
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dnsQuery builds a query of type A for the name
+func dnsQuery(ID uint16, name string) []byte {
+	q := make([]byte, dnsHeaderSize)
+	binary.BigEndian.PutUint16(q[0:2], ID)
+	q[2] = 0x01 // recursion desired
+	binary.BigEndian.PutUint16(q[4:6], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	return append(q, 0, 0, 1, 0, 1)
+}
+
+// dnsAnswer answers a query with the address, and an OPT record
+func dnsAnswer(query []byte, ip net.IP, ttl uint32) []byte {
+	a := make([]byte, len(query))
+	copy(a, query)
+	a[2] |= dnsFlagResponse
+	binary.BigEndian.PutUint16(a[6:8], 1)
+	binary.BigEndian.PutUint16(a[10:12], 1)
+	// a pointer to the name of the question
+	a = append(a, 0xc0, dnsHeaderSize, 0, 1, 0, 1)
+	a = append(a, 0, 0, 0, 0, 0, 4)
+	binary.BigEndian.PutUint32(a[len(a)-6:len(a)-2], ttl)
+	a = append(a, ip.To4()...)
+	// OPT: root name, type 41, its "TTL" holds flags
+	return append(a, 0, 0, 41, 16, 0, 0, 0, 0x80, 0, 0, 0)
+}
+
+func TestDNSMessages(t *testing.T) {
+
+	q := dnsQuery(1, "www.Example.com")
+	question, err := dnsQuestion(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := dnsQuestion(dnsQuery(2, "WWW.example.COM")); other != question {
+		t.Error("The questions should not depend on the case or the ID")
+	}
+	if _, err := dnsQuestion(q[:len(q)-2]); err == nil {
+		t.Error("A truncated question should be refused")
+	}
+
+	a := dnsAnswer(q, net.IPv4(192, 0, 2, 1), 60)
+	offsets, minTTL, err := dnsTTLs(a)
+	if err != nil || len(offsets) != 1 || minTTL != 60 {
+		t.Error("Wrong TTLs", offsets, minTTL, err)
+	}
+	if _, _, err := dnsTTLs(a[:len(a)-5]); err == nil {
+		t.Error("A truncated answer should be refused")
+	}
+
+	f := dnsServerFailure(q)
+	if len(f) != len(q) || f[3]&0x0f != dnsRcodeServFail || f[2]&dnsFlagResponse == 0 || f[0] != q[0] || f[1] != q[1] {
+		t.Error("Wrong failure", f)
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+
+	c := newDNSCache()
+	now := time.Now()
+	q := dnsQuery(1, "example.com")
+	question, _ := dnsQuestion(q)
+
+	c.put(question, dnsAnswer(q, net.IPv4(192, 0, 2, 1), 60), now)
+
+	// the answer gets the ID of the query, and its age is taken from the TTL
+	a := c.get(question, []byte{0x12, 0x34}, now.Add(10*time.Second))
+	if a == nil {
+		t.Fatal("The answer should be cached")
+	}
+	offsets, minTTL, _ := dnsTTLs(a)
+	if a[0] != 0x12 || a[1] != 0x34 || minTTL != 50 {
+		t.Error("Wrong cached answer", a, minTTL)
+	}
+	if binary.BigEndian.Uint32(a[len(a)-6:len(a)-2]) != 0x8000 || len(offsets) != 1 {
+		t.Error("The OPT record should not change")
+	}
+
+	if c.get(question, []byte{0, 1}, now.Add(time.Minute)) != nil {
+		t.Error("The answer should expire")
+	}
+
+	// failures and answers without TTL are not cached
+	c.put(question, dnsServerFailure(q), now)
+	c.put(question, dnsAnswer(q, net.IPv4(192, 0, 2, 1), 0), now)
+	if c.get(question, []byte{0, 1}, now) != nil {
+		t.Error("The answer should not be cached")
+	}
+
+	// the TTL is capped
+	c.put(question, dnsAnswer(q, net.IPv4(192, 0, 2, 1), 86400), now)
+	if c.get(question, []byte{0, 1}, now.Add(DNS_MAX_CACHE_TTL)) != nil {
+		t.Error("The answer should not stay longer than", DNS_MAX_CACHE_TTL)
+	}
+}
+
+// Tests that the client's queries are answered through the multiplexer, from the cache of the egress if possible
+func TestDNSProxy(t *testing.T) {
+
+	// a stub resolver, which answers 192.0.2.1 to everything
+	resolver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3003})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	var queries int32
+	go func() {
+		buffer := make([]byte, 1000)
+		for {
+			n, from, err := resolver.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&queries, 1)
+			resolver.WriteToUDP(dnsAnswer(buffer[:n], net.IPv4(192, 0, 2, 1), 60), from)
+		}
+	}()
+
+	up := make(chan []byte)
+	down := make(chan []byte)
+	stopIngress := make(chan bool, 1)
+	stopEgress := make(chan bool, 1)
+	ig, err := newIngressServer(MULTIPLEXER_HEADER_SIZE+100, up, down, stopIngress, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ig.dnsProxyPort = 3002
+	eg, err := newEgressServer("127.0.0.1:3009", MULTIPLEXER_HEADER_SIZE+100, up, down, stopEgress, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eg.setOptions(EgressOptions{DNSResolver: "127.0.0.1:3003"})
+	go ig.listen(3000)
+	go eg.run()
+	time.Sleep(2 * time.Second)
+
+	ask := func(ID uint16, name string) []byte {
+		conn, err := net.Dial("udp", "127.0.0.1:3002")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write(dnsQuery(ID, name))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buffer := make([]byte, 1000)
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal("No answer for", name, err)
+		}
+		return buffer[:n]
+	}
+
+	a := ask(0x1234, "example.com")
+	if binary.BigEndian.Uint16(a[0:2]) != 0x1234 || !net.IP(a[len(a)-15:len(a)-11]).Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Error("Wrong answer", a)
+	}
+
+	// the same question, from another application with the same ID, is answered from the cache
+	a = ask(0x1234, "Example.com")
+	if binary.BigEndian.Uint16(a[0:2]) != 0x1234 || atomic.LoadInt32(&queries) != 1 {
+		t.Error("The answer should come from the cache", a, atomic.LoadInt32(&queries))
+	}
+
+	ask(0x1234, "example.org")
+	if atomic.LoadInt32(&queries) != 2 {
+		t.Error("Another name should be resolved")
+	}
+
+	// without resolver, the client gets a failure
+	resolver.Close()
+	a = ask(7, "example.net")
+	if a[3]&0x0f != dnsRcodeServFail {
+		t.Error("The query should fail", a)
+	}
+
+	stopIngress <- true
+	stopEgress <- true
+	time.Sleep(2 * time.Second)
+}
@@ -1,144 +1,478 @@
 package stream_multiplexer
 
 import (
-	"bytes"
-	"encoding/binary"
 	"encoding/hex"
 	"go.dedis.ch/onet/v3/log"
 	"io"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 )
 
 // EgressServer takes data from a go channel and recreates the multiplexed TCP streams
 type EgressServer struct {
-	activeConnections map[string]*MultiplexedConnection
-	maxMessageSize    int
-	maxPayloadSize    int
-	upstreamChan      chan []byte
-	downstreamChan    chan []byte
-	stopChan          chan bool
-	verbose           bool
+	activeConnectionsLock sync.Locker
+	activeConnections     map[string]*MultiplexedConnection
+	closedStreams         map[string]*closedStream // streams we closed; their late frames are ignored
+	serverAddress         string                   // where the streams without destination go
+	upstreamProxy         string                   // a SOCKS5 proxy to reach the destinations through, or "" to dial them directly
+	policy                *EgressPolicy            // restricts the streams, or nil, see policy.go
+	dnsResolver           *dnsResolver             // answers the DNS streams, see dns.go
+	totalBandwidth        *rateLimiter             // the bandwidth cap of all streams, or nil
+	maxMessageSize        int
+	maxPayloadSize        int
+	upstreamChan          chan []byte
+	downstreamChan        chan []byte
+	stopChan              chan bool
+	verbose               bool
+
+	// reaches the destinations of the clients
+	dial func(network, address string) (net.Conn, error)
+}
+
+// a stream we closed recently
+type closedStream struct {
+	openNonce []byte
+	closedAt  time.Time
 }
 
 // StartEgressHandler creates (and block) an Egress Server
 func StartEgressHandler(serverAddress string, maxMessageSize int, upstreamChan chan []byte, downstreamChan chan []byte, stopChan chan bool, verbose bool) {
+	eg, err := newEgressServer(serverAddress, maxMessageSize, upstreamChan, downstreamChan, stopChan, verbose)
+	if err != nil {
+		log.Error("Egress server cannot start :", err.Error())
+		return
+	}
+	eg.run()
+}
+
+// EgressOptions are the optional settings of an Egress Server
+type EgressOptions struct {
+	UpstreamProxy string        // a SOCKS5 proxy to reach the destinations given by the clients through, or ""
+	Policy        *EgressPolicy // restricts the streams, or nil
+	DNSResolver   string        // the DNS server ("host:port") answering the clients' queries, or "" for the system's
+}
+
+// StartEgressHandlerWithOptions creates (and block) an Egress Server with the given options
+func StartEgressHandlerWithOptions(serverAddress string, options EgressOptions, maxMessageSize int, upstreamChan chan []byte, downstreamChan chan []byte, stopChan chan bool, verbose bool) {
+	eg, err := newEgressServer(serverAddress, maxMessageSize, upstreamChan, downstreamChan, stopChan, verbose)
+	if err != nil {
+		log.Error("Egress server cannot start :", err.Error())
+		return
+	}
+	eg.setOptions(options)
+	eg.run()
+}
+
+func (eg *EgressServer) setOptions(options EgressOptions) {
+	eg.upstreamProxy = options.UpstreamProxy
+	eg.policy = options.Policy
+	eg.dnsResolver = newDNSResolver(options.DNSResolver)
+	if eg.policy != nil {
+		eg.totalBandwidth = newRateLimiter(eg.policy.TotalBandwidth)
+	}
+}
+
+func newEgressServer(serverAddress string, maxMessageSize int, upstreamChan chan []byte, downstreamChan chan []byte, stopChan chan bool, verbose bool) (*EgressServer, error) {
+	maxPayloadSize, err := maxPayloadSizeOf(maxMessageSize)
+	if err != nil {
+		return nil, err
+	}
 	eg := new(EgressServer)
+	eg.serverAddress = serverAddress
+	eg.dnsResolver = newDNSResolver("")
+	eg.dial = func(network, address string) (net.Conn, error) {
+		return net.DialTimeout(network, address, DIAL_TIMEOUT)
+	}
 	eg.maxMessageSize = maxMessageSize
-	eg.maxPayloadSize = maxMessageSize - MULTIPLEXER_HEADER_SIZE //we use 8 bytes for the multiplexing
+	eg.maxPayloadSize = maxPayloadSize
 	eg.upstreamChan = upstreamChan
 	eg.downstreamChan = downstreamChan
 	eg.stopChan = stopChan
+	eg.activeConnectionsLock = new(sync.Mutex)
 	eg.activeConnections = make(map[string]*MultiplexedConnection)
+	eg.closedStreams = make(map[string]*closedStream)
 	eg.verbose = verbose
 
 	if verbose {
 		log.Lvl1("Egress Server in verbose mode")
 	}
+	return eg, nil
+}
 
-	for {
-		dataRead := <-upstreamChan
+// run handles the upstream frames until stopChan is written to
+func (eg *EgressServer) run() {
+	garbageCollection := time.NewTicker(GARBAGE_COLLECTION_INTERVAL)
+	defer garbageCollection.Stop()
 
-		// if too short or all bytes are zero, there was no data usptream, discard the frame
-		if len(dataRead) < 4 || bytes.Equal(dataRead[0:4], make([]byte, 4)) {
-			log.Lvl3("Egress Server: no upstream Data, continuing")
+	for {
+		var dataRead []byte
+		select {
+		case dataRead = <-eg.upstreamChan:
+		case <-garbageCollection.C:
+			eg.collectGarbage()
 			continue
+		case <-eg.stopChan:
+			log.Lvl2("Egress server stopped.")
+			eg.activeConnectionsLock.Lock()
+			for _, mc := range eg.activeConnections {
+				mc.close()
+			}
+			eg.activeConnections = make(map[string]*MultiplexedConnection)
+			eg.activeConnectionsLock.Unlock()
+			return
 		}
 
-		if len(dataRead) < MULTIPLEXER_HEADER_SIZE {
+		frame, err := ParseFrame(dataRead)
+		if err != nil {
 			// we cannot demultiplex, skip
-			log.Lvl3("Egress Server: frame too short, continuing")
+			log.Lvl3("Egress Server: invalid frame, continuing;", err)
 			continue
 		}
 
-		ID := string(dataRead[0:4])
-		size := int(binary.BigEndian.Uint32(dataRead[4:8]))
-		data := dataRead[8:]
-
-		// trim the data if needed
-		if len(data) > size {
-			data = data[:size]
+		// an empty slot is all zeros, there was no data upstream
+		if frame.Type == FRAME_NONE {
+			log.Lvl3("Egress Server: no upstream Data, continuing")
+			continue
 		}
 
 		if eg.verbose {
-			log.Lvl1("Clients -> Egress Server:\n" + hex.Dump(data))
-		}
-
-		// if this a new connection, dial it first
-		if mc, ok := eg.activeConnections[ID]; !ok || mc == nil || mc.conn == nil {
-			c, err := net.Dial("tcp", serverAddress)
-			if err != nil {
-				log.Error("Egress server: Could not connect to server, discarding data. Do you have a SOCKS server running on",
-					serverAddress, "? You need one!", err)
-				continue
-			} else {
-
-				mc := new(MultiplexedConnection)
-				mc.conn = c
-				mc.ID = ID
-				mc.ID_bytes = []byte(ID)
-				mc.stopChan = make(chan bool, 1)
-				mc.maxMessageLength = eg.maxMessageSize
-
-				eg.activeConnections[ID] = mc
-				go eg.egressConnectionReader(mc)
-			}
+			log.Lvl1("Clients -> Egress Server:\n" + hex.Dump(dataRead[:MULTIPLEXER_HEADER_SIZE+len(frame.Data)]))
+		}
+
+		mc := eg.stream(frame)
+		if mc != nil {
+			eg.handleUpstreamFrame(mc, frame)
 		}
+	}
+}
 
-		mc, _ := eg.activeConnections[ID]
+// stream returns the stream of a frame; if the frame opens a new stream, starts to dial its connection. Returns nil if
+// the frame should be ignored. A stream opened twice with different nonces is a collision, see streamid.go
+func (eg *EgressServer) stream(frame *Frame) *MultiplexedConnection {
+	ID := frame.ID
 
-		// Try to write to it; if it fails, clean it
-		mc.conn.SetWriteDeadline(time.Now().Add(time.Second))
-		n, err := mc.conn.Write(data)
+	eg.activeConnectionsLock.Lock()
+	mc, found := eg.activeConnections[ID]
+	closed, wasClosed := eg.closedStreams[ID]
+	eg.activeConnectionsLock.Unlock()
 
-		if err != nil || n != len(data) {
-			log.Error("Egress server: could not write the whole", len(data), "bytes, only", n, "error", err)
-			mc.conn.Close()
-			mc.stopChan <- true
-			eg.activeConnections[ID] = nil
+	if found {
+		if frame.isCollision(mc.openNonce) {
+			eg.reset(mc, "was opened again by another client")
+			return nil
+		}
+		return mc
+	}
+	if wasClosed {
+		if frame.isCollision(closed.openNonce) {
+			log.Lvl2("Egress Server: new stream", hex.EncodeToString([]byte(ID)), "collides with a closed stream, rejecting it")
+			eg.sendControl(&Frame{ID: ID, Type: FRAME_RST})
+			return nil
 		}
+		log.Lvl3("Egress Server: frame", frame.Seq, "for closed stream", hex.EncodeToString([]byte(ID)), ", discarding")
+		return nil
+	}
+	if frame.Type != FRAME_OPEN {
+		// if the OPEN frame was lost, the next frames come first; we wait for its retransmission
+		log.Lvl3("Egress Server: frame", frame.Seq, "for unknown stream", hex.EncodeToString([]byte(ID)), ", discarding")
+		return nil
+	}
+
+	// the ingress does not limit us until it says so. The data that arrives before the connection is queued
+	mc = newMultiplexedConnection(ID, nil, eg.maxMessageSize, WINDOW_UNLIMITED)
+	mc.openNonce = frame.openNonce()
+	if eg.policy != nil {
+		mc.bandwidth = newRateLimiter(eg.policy.StreamBandwidth)
 	}
+
+	eg.activeConnectionsLock.Lock()
+	if eg.policy != nil && eg.policy.MaxStreams > 0 && len(eg.activeConnections) >= eg.policy.MaxStreams {
+		eg.closedStreams[ID] = &closedStream{openNonce: mc.openNonce, closedAt: time.Now()}
+		eg.activeConnectionsLock.Unlock()
+		logViolation("any destination", "too many streams")
+		eg.sendControl(&Frame{ID: ID, Type: FRAME_RST})
+		return nil
+	}
+	eg.activeConnections[ID] = mc
+	eg.activeConnectionsLock.Unlock()
+
+	// dialing can take a while, and we must keep handling the upstream frames meanwhile
+	go eg.connect(mc, frame)
+	return mc
 }
 
-func (eg *EgressServer) egressConnectionReader(mc *MultiplexedConnection) {
-	for {
-		// Check if we need to stop
-		select {
-		case _ = <-mc.stopChan:
-			mc.conn.Close()
+// connect dials the destination of the stream, then starts to read and write its connection
+func (eg *EgressServer) connect(mc *MultiplexedConnection, open *Frame) {
+	var c net.Conn
+	var err error
+	network, address, target, hasTarget := open.openTarget()
+	if hasTarget && network != "dns" && network != "ip" {
+		checked, err := eg.policy.check(address)
+		if err != nil {
+			logViolation(address, err.Error())
+			eg.reset(mc, "violates the egress policy")
 			return
-		default:
 		}
+		if checked != address {
+			// the policy resolved the domain name; we dial the address it checked
+			host, port, _ := net.SplitHostPort(checked)
+			portNumber, _ := strconv.Atoi(port)
+			address, target = checked, encodeSOCKSAddress(net.ParseIP(host), portNumber)
+		}
+	}
+
+	switch {
+	case !hasTarget:
+		c, err = net.DialTimeout("tcp", eg.serverAddress, DIAL_TIMEOUT)
+		if err != nil {
+			log.Error("Egress server: Could not connect to server, discarding data. Do you have a SOCKS server running on",
+				eg.serverAddress, "? You need one!", err)
+		}
+	case network == "dns":
+		c = eg.dnsResolver.newConn()
+	case network == "ip":
+		c = eg.newNATConn()
+	case network == "tcp" && eg.upstreamProxy != "":
+		c, err = dialThroughSOCKS5(eg.upstreamProxy, target)
+	default:
+		c, err = eg.dial(network, address)
+	}
+	if err != nil {
+		eg.reset(mc, "cannot connect, "+err.Error())
+		return
+	}
 
-		// Read data from the connection
-		buffer := make([]byte, eg.maxPayloadSize)
+	mc.lock.Lock()
+	if mc.closed {
+		mc.lock.Unlock()
+		c.Close()
+		return
+	}
+	mc.conn = c
+	mc.lock.Unlock()
+
+	go eg.egressConnectionReader(mc)
+	go connectionWriter(mc, func() { eg.sendWindowUpdate(mc) }, func(err error) {
+		eg.reset(mc, "cannot be written, "+errorString(err))
+	})
+}
+
+// newNATConn creates the connection of a TUN stream: each message written is an IP packet of the client, which the
+// NAT re-emits, and the packets of the answers can be read
+func (eg *EgressServer) newNATConn() net.Conn {
+	var conn *messageConn
+	dial := func(network, address string) (net.Conn, error) {
+		if network == "tcp" && eg.upstreamProxy != "" {
+			host, port, _ := net.SplitHostPort(address)
+			portNumber, _ := strconv.Atoi(port)
+			return dialThroughSOCKS5(eg.upstreamProxy, encodeSOCKSAddress(net.ParseIP(host), portNumber))
+		}
+		return eg.dial(network, address)
+	}
+	nat := newPacketNAT(func(packet []byte) { conn.deliver(packet) }, dial, eg.policy)
+	conn = newMessageConn(func(packet []byte) (int, error) {
+		nat.handle(packet)
+		return len(packet), nil
+	}, nat.close, nil, nil)
+	return conn
+}
+
+// handleUpstreamFrame processes a frame a client sent on one of the streams
+func (eg *EgressServer) handleUpstreamFrame(mc *MultiplexedConnection, frame *Frame) {
+	mc.touch()
+
+	switch frame.Type {
+	case FRAME_WINDOW_UPDATE:
+		mc.window.update(frame.Ack, frame.window())
+		return
+	case FRAME_RST:
+		log.Lvl2("Egress server: stream", hex.EncodeToString([]byte(mc.ID)), "was reset by the client")
+		eg.removeStream(mc)
+		return
+	}
+	if !frame.isSequenced() {
+		return
+	}
+
+	// Put the frames back in order; if one is missing for good, the stream is corrupted
+	mc.lock.Lock()
+	frames, err := mc.reassembler.add(frame)
+	ackScheduled := mc.ackPending
+	mc.ackPending = true
+	mc.lock.Unlock()
+
+	// acknowledge, even duplicates: our previous acknowledgement may have been lost
+	if !ackScheduled {
+		go eg.delayedAck(mc)
+	}
+
+	for _, f := range frames {
+		switch f.Type {
+		case FRAME_DATA:
+			mc.writeQueue.push(f.Data, f.fragments)
+		case FRAME_FIN:
+			mc.writeQueue.finish()
+		}
+	}
+	if err != nil {
+		eg.reset(mc, "cannot be rebuilt, "+err.Error())
+		return
+	}
+
+	// if the server does not keep up, ask the client to slow down
+	if mc.writeQueue.isLow() {
+		eg.sendWindowUpdate(mc)
+	}
+}
+
+func (eg *EgressServer) egressConnectionReader(mc *MultiplexedConnection) {
+	for {
+		// Read data from the connection; a message can span several frames
+		buffer := make([]byte, eg.maxPayloadSize*MAX_FRAGMENTS_PER_MESSAGE)
 		n, err := mc.conn.Read(buffer)
 
-		if err != nil {
-			if err, ok := err.(*net.OpError); ok && err.Timeout() {
-				// it was a timeout
-				continue
-			}
+		if mc.isClosed() {
+			return
+		}
 
-			if err == io.EOF {
-				// Connection closed indicator
+		if err != nil {
+			// a datagram connection cannot be half-closed; we closed it after the client's FIN
+			_, isTCP := mc.conn.(*net.TCPConn)
+			if err == io.EOF || !isTCP && mc.writeQueue.isDrained() {
+				// the server has nothing more to send, but can still read the request
+				if eg.sendSequenced(mc, &Frame{ID: mc.ID, Seq: mc.nextSeq, Type: FRAME_FIN}) {
+					mc.nextSeq++
+					mc.lock.Lock()
+					mc.finSent = true
+					mc.lock.Unlock()
+				}
 				return
 			}
 
-			log.Error("Egress server: connectionReader error (reading will stop),", err)
+			eg.reset(mc, "cannot be read, "+err.Error())
 			return
 		}
 
-		// Trim the data and send it through the data channel
-		slice := make([]byte, n+MULTIPLEXER_HEADER_SIZE)
-		copy(slice[0:4], mc.ID_bytes[:])
-		binary.BigEndian.PutUint32(slice[4:8], uint32(n))
-		copy(slice[MULTIPLEXER_HEADER_SIZE:], buffer[:n])
+		// the bandwidth caps of the policy slow us down
+		mc.bandwidth.wait(n)
+		eg.totalBandwidth.wait(n)
+
+		// Cut the data in frames and send them through the data channel, each will take one downstream cell
+		for _, f := range fragment(mc.ID, buffer[:n], eg.maxPayloadSize, &mc.nextSeq) {
+			if !eg.sendSequenced(mc, f) {
+				return
+			}
+		}
+	}
+}
+
+// sendSequenced sends a frame downstream once the ingress accepts it, with the acknowledgement of the upstream frames.
+// Returns false if the stream was closed
+func (eg *EgressServer) sendSequenced(mc *MultiplexedConnection, f *Frame) bool {
+	if !mc.window.waitCredit(f.Seq) {
+		return false
+	}
+
+	mc.lock.Lock()
+	f.Ack = mc.reassembler.nextSeq
+	f.Flags |= FLAG_ACK
+	mc.ackPending = false
+	mc.lock.Unlock()
+
+	slice := f.ToBytes()
+	eg.downstreamChan <- slice
+	mc.touch()
+
+	if eg.verbose {
+		log.Lvl1("Egress Server -> Clients:\n", hex.Dump(slice))
+	}
+	return true
+}
+
+// sendControl sends a RST or a WINDOW_UPDATE downstream. It does not block, since it is called when handling the
+// upstream data, and the relay might be waiting for us to take it
+func (eg *EgressServer) sendControl(f *Frame) {
+	slice := f.ToBytes()
+	if eg.verbose {
+		log.Lvl1("Egress Server -> Clients (control):\n", hex.Dump(slice))
+	}
+	go func() {
 		eg.downstreamChan <- slice
+	}()
+}
 
-		if eg.verbose {
-			log.Lvl1("Egress Server -> Clients:\n", hex.Dump(slice))
+// delayedAck sends an acknowledgement for the stream after ACK_DELAY, unless a downstream frame carried it meanwhile
+func (eg *EgressServer) delayedAck(mc *MultiplexedConnection) {
+	time.Sleep(ACK_DELAY)
+
+	mc.lock.Lock()
+	pending := mc.ackPending
+	mc.lock.Unlock()
+
+	if pending {
+		eg.sendWindowUpdate(mc)
+	}
+}
+
+// sendWindowUpdate acknowledges the upstream frames, and tells the ingress how many more we accept
+func (eg *EgressServer) sendWindowUpdate(mc *MultiplexedConnection) {
+	mc.lock.Lock()
+	ack := mc.reassembler.nextSeq
+	mc.ackPending = false
+	mc.lock.Unlock()
+
+	eg.sendControl(newWindowUpdate(mc.ID, ack, mc.writeQueue.advertise()))
+}
+
+// reset aborts the stream, and tells the ingress
+func (eg *EgressServer) reset(mc *MultiplexedConnection, reason string) {
+	if mc.isClosed() {
+		return
+	}
+	log.Lvl2("Egress server: stream", hex.EncodeToString([]byte(mc.ID)), reason, ", resetting it")
+	eg.sendControl(&Frame{ID: mc.ID, Type: FRAME_RST})
+	eg.removeStream(mc)
+}
+
+// removeStream closes the stream; we remember it for a while, to ignore its late frames
+func (eg *EgressServer) removeStream(mc *MultiplexedConnection) {
+	eg.activeConnectionsLock.Lock()
+	delete(eg.activeConnections, mc.ID)
+	eg.closedStreams[mc.ID] = &closedStream{openNonce: mc.openNonce, closedAt: time.Now()}
+	eg.activeConnectionsLock.Unlock()
+	mc.close()
+}
+
+// collectGarbage removes the finished and idle streams
+func (eg *EgressServer) collectGarbage() {
+	now := time.Now()
+
+	eg.activeConnectionsLock.Lock()
+	for ID, closed := range eg.closedStreams {
+		if now.Sub(closed.closedAt) > REORDER_TIMEOUT {
+			delete(eg.closedStreams, ID)
 		}
+	}
+	streams := make([]*MultiplexedConnection, 0, len(eg.activeConnections))
+	for _, mc := range eg.activeConnections {
+		streams = append(streams, mc)
+	}
+	eg.activeConnectionsLock.Unlock()
+
+	for _, mc := range streams {
+		mc.lock.Lock()
+		finished := mc.finSent
+		idle := now.Sub(mc.lastActivity) > STREAM_IDLE_TIMEOUT
+		mc.lock.Unlock()
 
+		// both directions are closed
+		if finished && mc.writeQueue.isDrained() {
+			log.Lvl2("Egress server: stream", hex.EncodeToString([]byte(mc.ID)), "is finished")
+			eg.removeStream(mc)
+		} else if idle {
+			eg.reset(mc, "is idle")
+		}
 	}
 }
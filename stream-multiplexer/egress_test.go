@@ -2,7 +2,6 @@ package stream_multiplexer
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"go.dedis.ch/onet/v3/log"
 	"net"
@@ -94,11 +93,27 @@ func StartServerAndExpect(data map[int][]byte, remote string, t *testing.T, done
 	done <- true
 }
 
+// openFrame returns the frame that opens a stream
+func openFrame(ID []byte) []byte {
+	return (&Frame{ID: string(ID), Seq: 0, Type: FRAME_OPEN}).ToBytes()
+}
+
+// nextDataFrame returns the next frame that carries data, skipping the control frames
+func nextDataFrame(downstreamChan chan []byte) []byte {
+	for {
+		slice := <-downstreamChan
+		if f, err := ParseFrame(slice); err == nil && f.Type != FRAME_DATA {
+			continue
+		}
+		return slice
+	}
+}
+
 // Tests that the multiplexer forwards short messages
 func TestEgress1(t *testing.T) {
 
 	remote := "127.0.0.1:3000"
-	payloadLength := 20
+	payloadLength := MULTIPLEXER_HEADER_SIZE + 12
 	upstreamChan := make(chan []byte)
 	downstreamChan := make(chan []byte)
 	stopChan := make(chan bool)
@@ -107,12 +122,8 @@ func TestEgress1(t *testing.T) {
 
 	// prepare a dummy message
 	payload := []byte("hello")
-	multiplexedMsg := make([]byte, MULTIPLEXER_HEADER_SIZE+len(payload))
-	ID_str := generateRandomID()
-	ID := []byte(ID_str[0:4])
-	copy(multiplexedMsg[0:4], ID)
-	multiplexedMsg[7] = byte(len(payload))
-	copy(multiplexedMsg[8:], payload)
+	ID := []byte(generateRandomID())
+	multiplexedMsg := (&Frame{ID: string(ID), Seq: 1, Type: FRAME_DATA, Data: payload}).ToBytes()
 
 	doneChan := make(chan bool, 1)
 
@@ -122,14 +133,16 @@ func TestEgress1(t *testing.T) {
 
 	time.Sleep(time.Second)
 
+	upstreamChan <- openFrame(ID)
 	upstreamChan <- multiplexedMsg
 
 	<-doneChan
 
-	echo := <-downstreamChan
-	echoID := echo[0:4]
-	size := int(binary.BigEndian.Uint32(echo[4:8]))
-	data := echo[8:]
+	echo := nextDataFrame(downstreamChan)
+	echoFrame, _ := ParseFrame(echo)
+	echoID := []byte(echoFrame.ID)
+	size := len(echoFrame.Data)
+	data := echoFrame.Data
 	if !bytes.Equal(echoID, ID) {
 		t.Error("Echoed message ID is wrong", ID, echoID)
 	}
@@ -142,7 +155,7 @@ func TestEgress1(t *testing.T) {
 func TestEgress2(t *testing.T) {
 
 	remote := "127.0.0.1:3000"
-	payloadLength := 20
+	payloadLength := MULTIPLEXER_HEADER_SIZE + 12
 	upstreamChan := make(chan []byte)
 	downstreamChan := make(chan []byte)
 	stopChan := make(chan bool)
@@ -155,12 +168,9 @@ func TestEgress2(t *testing.T) {
 	copy(doubleHello[0:5], payload)
 	copy(doubleHello[5:10], payload)
 
-	multiplexedMsg := make([]byte, MULTIPLEXER_HEADER_SIZE+len(payload))
-	ID_str := generateRandomID()
-	ID := []byte(ID_str[0:4])
-	copy(multiplexedMsg[0:4], ID)
-	multiplexedMsg[7] = byte(len(payload))
-	copy(multiplexedMsg[8:], payload)
+	ID := []byte(generateRandomID())
+	multiplexedMsg := (&Frame{ID: string(ID), Seq: 1, Type: FRAME_DATA, Data: payload}).ToBytes()
+	multiplexedMsgBis := (&Frame{ID: string(ID), Seq: 2, Type: FRAME_DATA, Data: payload}).ToBytes()
 
 	doneChan := make(chan bool, 1)
 
@@ -170,15 +180,17 @@ func TestEgress2(t *testing.T) {
 
 	time.Sleep(time.Second)
 
+	upstreamChan <- openFrame(ID)
 	upstreamChan <- multiplexedMsg
-	upstreamChan <- multiplexedMsg
+	upstreamChan <- multiplexedMsgBis
 
 	<-doneChan
 
-	echo := <-downstreamChan
-	echoID := echo[0:4]
-	size := int(binary.BigEndian.Uint32(echo[4:8]))
-	data := echo[8:]
+	echo := nextDataFrame(downstreamChan)
+	echoFrame, _ := ParseFrame(echo)
+	echoID := []byte(echoFrame.ID)
+	size := len(echoFrame.Data)
+	data := echoFrame.Data
 	if !bytes.Equal(echoID, ID) {
 		t.Error("Echoed message ID is wrong", ID, echoID)
 	}
@@ -191,7 +203,7 @@ func TestEgress2(t *testing.T) {
 func TestEgressMultiplex(t *testing.T) {
 
 	remote := "127.0.0.1:3000"
-	payloadLength := 20
+	payloadLength := MULTIPLEXER_HEADER_SIZE + 12
 	upstreamChan := make(chan []byte)
 	downstreamChan := make(chan []byte)
 	stopChan := make(chan bool)
@@ -200,21 +212,13 @@ func TestEgressMultiplex(t *testing.T) {
 
 	// prepare a dummy message
 	payload := []byte("hello")
-	multiplexedMsg := make([]byte, MULTIPLEXER_HEADER_SIZE+len(payload))
-	ID_str := generateRandomID()
-	ID := []byte(ID_str[0:4])
-	copy(multiplexedMsg[0:4], ID)
-	multiplexedMsg[7] = byte(len(payload))
-	copy(multiplexedMsg[8:], payload)
+	ID := []byte(generateRandomID())
+	multiplexedMsg := (&Frame{ID: string(ID), Seq: 1, Type: FRAME_DATA, Data: payload}).ToBytes()
 
 	// prepare a dummy message 2
 	payload2 := []byte("hello2")
-	multiplexedMsg2 := make([]byte, MULTIPLEXER_HEADER_SIZE+len(payload2))
-	ID2_str := generateRandomID()
-	ID2 := []byte(ID2_str[0:4])
-	copy(multiplexedMsg2[0:4], ID2)
-	multiplexedMsg2[7] = byte(len(payload2))
-	copy(multiplexedMsg2[8:], payload2)
+	ID2 := []byte(generateRandomID())
+	multiplexedMsg2 := (&Frame{ID: string(ID2), Seq: 1, Type: FRAME_DATA, Data: payload2}).ToBytes()
 
 	doneChan := make(chan bool, 1)
 
@@ -225,24 +229,27 @@ func TestEgressMultiplex(t *testing.T) {
 
 	time.Sleep(time.Second)
 
+	upstreamChan <- openFrame(ID)
+	upstreamChan <- openFrame(ID2)
 	upstreamChan <- multiplexedMsg
 	upstreamChan <- multiplexedMsg2
 
 	<-doneChan
 
-	echo1 := <-downstreamChan
-	echo2 := <-downstreamChan
+	echo1 := nextDataFrame(downstreamChan)
+	echo2 := nextDataFrame(downstreamChan)
 
 	//swap messages if needed
-	if bytes.Equal(ID, echo2[0:4]) && bytes.Equal(ID2, echo1[0:4]) {
+	if bytes.Equal(ID, echo2[0:STREAM_ID_SIZE]) && bytes.Equal(ID2, echo1[0:STREAM_ID_SIZE]) {
 		tmp := echo1
 		echo1 = echo2
 		echo2 = tmp
 	}
 
-	echoID1 := echo1[0:4]
-	size1 := int(binary.BigEndian.Uint32(echo1[4:8]))
-	data1 := echo1[8:]
+	echo1Frame, _ := ParseFrame(echo1)
+	echoID1 := []byte(echo1Frame.ID)
+	size1 := len(echo1Frame.Data)
+	data1 := echo1Frame.Data
 	if !bytes.Equal(echoID1, ID) {
 		t.Error("Echoed message ID is wrong", ID, echoID1)
 	}
@@ -250,9 +257,10 @@ func TestEgressMultiplex(t *testing.T) {
 		t.Error("Echoed message data is wrong", payload, data1[:size1])
 	}
 
-	echoID2 := echo2[0:4]
-	size2 := int(binary.BigEndian.Uint32(echo2[4:8]))
-	data2 := echo2[8:]
+	echo2Frame, _ := ParseFrame(echo2)
+	echoID2 := []byte(echo2Frame.ID)
+	size2 := len(echo2Frame.Data)
+	data2 := echo2Frame.Data
 	if !bytes.Equal(echoID2, ID2) {
 		t.Error("Echoed message ID is wrong", ID2, echoID2)
 	}
@@ -265,7 +273,7 @@ func TestEgressMultiplex(t *testing.T) {
 func TestEgressMultiplexLong(t *testing.T) {
 
 	remote := "127.0.0.1:3000"
-	payloadLength := 20
+	payloadLength := MULTIPLEXER_HEADER_SIZE + 12
 	upstreamChan := make(chan []byte)
 	downstreamChan := make(chan []byte)
 	stopChan := make(chan bool)
@@ -274,21 +282,17 @@ func TestEgressMultiplexLong(t *testing.T) {
 
 	// prepare a dummy message
 	payload := []byte("hello")
-	multiplexedMsg := make([]byte, MULTIPLEXER_HEADER_SIZE+len(payload))
-	ID_str := generateRandomID()
-	ID := []byte(ID_str[0:4])
-	copy(multiplexedMsg[0:4], ID)
-	multiplexedMsg[7] = byte(len(payload))
-	copy(multiplexedMsg[8:], payload)
+	ID := []byte(generateRandomID())
+	multiplexedMsg := (&Frame{ID: string(ID), Seq: 1, Type: FRAME_DATA, Data: payload}).ToBytes()
 
 	// prepare a dummy message 2
 	payload2 := []byte("hello2")
-	multiplexedMsg2 := make([]byte, MULTIPLEXER_HEADER_SIZE+len(payload2))
-	ID2_str := generateRandomID()
-	ID2 := []byte(ID2_str[0:4])
-	copy(multiplexedMsg2[0:4], ID2)
-	multiplexedMsg2[7] = byte(len(payload2))
-	copy(multiplexedMsg2[8:], payload2)
+	ID2 := []byte(generateRandomID())
+	multiplexedMsg2 := (&Frame{ID: string(ID2), Seq: 1, Type: FRAME_DATA, Data: payload2}).ToBytes()
+
+	// the second copies come next in their streams, after the OPEN frame and the first copy
+	multiplexedMsgBis := (&Frame{ID: string(ID), Seq: 2, Type: FRAME_DATA, Data: payload}).ToBytes()
+	multiplexedMsg2Bis := (&Frame{ID: string(ID2), Seq: 2, Type: FRAME_DATA, Data: payload2}).ToBytes()
 
 	doneChan := make(chan bool, 1)
 
@@ -307,26 +311,29 @@ func TestEgressMultiplexLong(t *testing.T) {
 
 	time.Sleep(time.Second)
 
+	upstreamChan <- openFrame(ID)
+	upstreamChan <- openFrame(ID2)
 	upstreamChan <- multiplexedMsg
 	upstreamChan <- multiplexedMsg2
-	upstreamChan <- multiplexedMsg2
-	upstreamChan <- multiplexedMsg
+	upstreamChan <- multiplexedMsg2Bis
+	upstreamChan <- multiplexedMsgBis
 
 	<-doneChan
 
-	echo1 := <-downstreamChan
-	echo2 := <-downstreamChan
+	echo1 := nextDataFrame(downstreamChan)
+	echo2 := nextDataFrame(downstreamChan)
 
 	//swap messages if needed
-	if bytes.Equal(ID, echo2[0:4]) && bytes.Equal(ID2, echo1[0:4]) {
+	if bytes.Equal(ID, echo2[0:STREAM_ID_SIZE]) && bytes.Equal(ID2, echo1[0:STREAM_ID_SIZE]) {
 		tmp := echo1
 		echo1 = echo2
 		echo2 = tmp
 	}
 
-	echoID1 := echo1[0:4]
-	size1 := int(binary.BigEndian.Uint32(echo1[4:8]))
-	data1 := echo1[8:]
+	echo1Frame, _ := ParseFrame(echo1)
+	echoID1 := []byte(echo1Frame.ID)
+	size1 := len(echo1Frame.Data)
+	data1 := echo1Frame.Data
 	if !bytes.Equal(echoID1, ID) {
 		t.Error("Echoed message ID is wrong", ID, echoID1)
 	}
@@ -334,9 +341,10 @@ func TestEgressMultiplexLong(t *testing.T) {
 		t.Error("Echoed message data is wrong", doubleHello, data1[:size1])
 	}
 
-	echoID2 := echo2[0:4]
-	size2 := int(binary.BigEndian.Uint32(echo2[4:8]))
-	data2 := echo2[8:]
+	echo2Frame, _ := ParseFrame(echo2)
+	echoID2 := []byte(echo2Frame.ID)
+	size2 := len(echo2Frame.Data)
+	data2 := echo2Frame.Data
 	if !bytes.Equal(echoID2, ID2) {
 		t.Error("Echoed message ID is wrong", ID2, echoID2)
 	}
@@ -0,0 +1,208 @@
+package stream_multiplexer
+
+/*
+Flow control and stream life-cycle
+**********************************
+A stream starts with an OPEN frame, and each direction ends with a FIN frame; a FIN half-closes the TCP connection on
+the other side, which can still send its answer. A stream is removed once both directions sent their FIN (and, at the
+ingress, once the FIN was acknowledged), or right away when a RST is sent or received. Streams idle for
+STREAM_IDLE_TIMEOUT are reset, so dead ones do not stay in activeConnections forever.
+
+The data received on a stream is queued until the TCP connection takes it. The receiver advertises how many frames it
+accepts after the ones it acknowledged, with a WINDOW_UPDATE frame. The egress does it all the time (its
+acknowledgements go downstream anyway). The ingress does it only when the browser is slow, since each update costs an
+upstream slot: it advertises a small window when its queue fills up, and WINDOW_UNLIMITED when it drained. The upstream
+frames can be lost, so it repeats a small window every WINDOW_UPDATE_INTERVAL.
+*/
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// RECEIVE_WINDOW is how many frames of a stream we queue before the TCP connection takes them
+const RECEIVE_WINDOW = 64
+
+// WINDOW_UNLIMITED is advertised when we do not limit the sender
+const WINDOW_UNLIMITED = math.MaxUint32
+
+// WINDOW_UPDATE_INTERVAL is how often the ingress repeats a small window, in case the update was lost
+const WINDOW_UPDATE_INTERVAL = time.Second
+
+// STREAM_IDLE_TIMEOUT is how long a stream can stay without frames in any direction before we reset it
+const STREAM_IDLE_TIMEOUT = 10 * time.Minute
+
+// GARBAGE_COLLECTION_INTERVAL is how often we look for finished and idle streams
+const GARBAGE_COLLECTION_INTERVAL = time.Second
+
+// newWindowUpdate creates a WINDOW_UPDATE frame, acknowledging the frames before ack
+func newWindowUpdate(ID string, ack uint32, window uint32) *Frame {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, window)
+	return &Frame{ID: ID, Ack: ack, Type: FRAME_WINDOW_UPDATE, Flags: FLAG_ACK, Data: data}
+}
+
+// window returns the window advertised by a WINDOW_UPDATE frame
+func (f *Frame) window() uint32 {
+	if len(f.Data) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(f.Data)
+}
+
+// a message received on a stream, and the number of frames it took
+type queuedMessage struct {
+	data   []byte
+	frames int
+}
+
+// writeQueue holds the data received on a stream until it is written to the TCP connection
+type writeQueue struct {
+	lock          *sync.Mutex
+	changed       *sync.Cond
+	messages      []*queuedMessage
+	frames        int  // number of frames in messages
+	fin           bool // the peer will not send more data
+	drained       bool // fin, and all the data was taken
+	closed        bool
+	advertisedLow bool // we advertised a window smaller than RECEIVE_WINDOW/2
+}
+
+func newWriteQueue() *writeQueue {
+	q := &writeQueue{lock: new(sync.Mutex), messages: make([]*queuedMessage, 0)}
+	q.changed = sync.NewCond(q.lock)
+	return q
+}
+
+// push queues a message of the given number of frames
+func (q *writeQueue) push(message []byte, frames int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.messages = append(q.messages, &queuedMessage{data: message, frames: frames})
+	q.frames += frames
+	q.changed.Broadcast()
+}
+
+// finish marks the end of the data; the connection is half-closed once the queue is written
+func (q *writeQueue) finish() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.fin = true
+	q.changed.Broadcast()
+}
+
+// close stops the writer
+func (q *writeQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	q.changed.Broadcast()
+}
+
+// pop waits for the next message. Returns fin=true when all the data was taken and the peer finished, and ok=false
+// if the queue was closed
+func (q *writeQueue) pop() (message []byte, fin bool, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for len(q.messages) == 0 && !q.fin && !q.closed {
+		q.changed.Wait()
+	}
+	if q.closed {
+		return nil, false, false
+	}
+	if len(q.messages) == 0 {
+		q.drained = true
+		return nil, true, true
+	}
+	m := q.messages[0]
+	q.messages = q.messages[1:]
+	q.frames -= m.frames
+	return m.data, false, true
+}
+
+// isDrained tells if the peer finished, and all its data was taken
+func (q *writeQueue) isDrained() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.drained
+}
+
+// advertise returns how many more frames we accept, and remembers that we advertised it
+func (q *writeQueue) advertise() uint32 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	w := q.window()
+	q.advertisedLow = w < RECEIVE_WINDOW/2
+	return w
+}
+
+// isLow tells if the window is below RECEIVE_WINDOW/2 and we did not advertise it yet
+func (q *writeQueue) isLow() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return !q.advertisedLow && q.window() < RECEIVE_WINDOW/2
+}
+
+// reopened tells if we advertised a small window, and it is large again
+func (q *writeQueue) reopened() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.advertisedLow && q.window() >= RECEIVE_WINDOW/2
+}
+
+// wasAdvertisedLow tells if the last window we advertised was small
+func (q *writeQueue) wasAdvertisedLow() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.advertisedLow
+}
+
+// window returns how many more frames we accept. Must hold the lock
+func (q *writeQueue) window() uint32 {
+	if q.frames >= RECEIVE_WINDOW {
+		return 0
+	}
+	return uint32(RECEIVE_WINDOW - q.frames)
+}
+
+// connectionWriter writes the data of the stream to its TCP connection, in order, and half-closes it after the peer's
+// FIN. windowReopened is called when the queue drained after we advertised a small window; failed when the connection
+// cannot be written
+func connectionWriter(mc *MultiplexedConnection, windowReopened func(), failed func(error)) {
+	for {
+		message, fin, ok := mc.writeQueue.pop()
+		if !ok {
+			return
+		}
+		if fin {
+			if tcpConn, isTCP := mc.conn.(*net.TCPConn); isTCP {
+				tcpConn.CloseWrite()
+			} else {
+				// a datagram connection cannot be half-closed
+				mc.conn.Close()
+			}
+			return
+		}
+
+		n, err := mc.conn.Write(message)
+		if err != nil || n != len(message) {
+			failed(err)
+			return
+		}
+		if mc.writeQueue.reopened() {
+			windowReopened()
+		}
+	}
+}
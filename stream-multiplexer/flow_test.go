@@ -0,0 +1,260 @@
+package stream_multiplexer
+
+import (
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWriteQueue(t *testing.T) {
+
+	q := newWriteQueue()
+	if q.window() != RECEIVE_WINDOW || q.isLow() {
+		t.Error("An empty queue should have the whole window")
+	}
+
+	q.push([]byte("hello"), RECEIVE_WINDOW/2+1)
+	if !q.isLow() {
+		t.Error("The window should be low")
+	}
+	if w := q.advertise(); w != RECEIVE_WINDOW/2-1 {
+		t.Error("Wrong window", w)
+	}
+	if q.isLow() || !q.wasAdvertisedLow() {
+		t.Error("The low window was advertised already")
+	}
+
+	message, fin, ok := q.pop()
+	if !ok || fin || string(message) != "hello" {
+		t.Error("Wrong message", string(message), fin, ok)
+	}
+	if !q.reopened() {
+		t.Error("The window should be open again")
+	}
+	q.advertise()
+	if q.reopened() {
+		t.Error("The open window was advertised already")
+	}
+
+	q.push([]byte("bye"), 1)
+	q.finish()
+	if q.isDrained() {
+		t.Error("The queue still has data")
+	}
+	message, fin, _ = q.pop()
+	if fin || string(message) != "bye" {
+		t.Error("The data should come before the end")
+	}
+	if _, fin, ok = q.pop(); !fin || !ok || !q.isDrained() {
+		t.Error("The queue should be drained")
+	}
+
+	q = newWriteQueue()
+	go q.close()
+	if _, _, ok := q.pop(); ok {
+		t.Error("Pop should fail once the queue is closed")
+	}
+}
+
+func TestSendWindowCredit(t *testing.T) {
+
+	w := newSendWindow(2)
+	w.push(&Frame{ID: "abcd", Seq: 0})
+	w.push(&Frame{ID: "abcd", Seq: 1})
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- w.push(&Frame{ID: "abcd", Seq: 2})
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("Push should wait for the receiver's credit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the window slides with the acknowledgements
+	w.ack(1)
+	<-pushed
+	w.lock.Lock()
+	if !w.hasCredit(2) || w.hasCredit(3) {
+		t.Error("The window should end before frame 3")
+	}
+	w.lock.Unlock()
+
+	// the receiver is slow: it closes the window
+	w.update(2, 0)
+	w.lock.Lock()
+	if w.hasCredit(2) {
+		t.Error("The window is closed")
+	}
+	w.lock.Unlock()
+
+	// an older update is ignored
+	w.update(1, WINDOW_UNLIMITED)
+	w.lock.Lock()
+	if w.hasCredit(2) {
+		t.Error("An older update should be ignored")
+	}
+	w.lock.Unlock()
+
+	w.update(2, WINDOW_UNLIMITED)
+	if !w.waitCredit(1000) {
+		t.Error("The window should be unlimited")
+	}
+}
+
+// starts an ingress on port 3000 and an egress to serverAddress, connected by go channels
+func startIngressAndEgress(t *testing.T, serverAddress string, payloadLength int) (*IngressServer, *EgressServer, chan bool, chan bool) {
+	up := make(chan []byte)
+	down := make(chan []byte)
+	stopIngress := make(chan bool, 1)
+	stopEgress := make(chan bool, 1)
+
+	ig, err := newIngressServer(payloadLength, up, down, stopIngress, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eg, err := newEgressServer(serverAddress, payloadLength, up, down, stopEgress, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ig.listen(3000)
+	go eg.run()
+
+	time.Sleep(2 * time.Second)
+	return ig, eg, stopIngress, stopEgress
+}
+
+// Tests that the request and the answer go through when each side half-closes, and that the stream is removed after
+func TestStreamHalfClose(t *testing.T) {
+
+	serverAddress := "127.0.0.1:3001"
+	l, err := net.Listen("tcp", serverAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		// reads the whole request, then answers and closes
+		request, _ := ioutil.ReadAll(c)
+		c.Write(append([]byte("answer to "), request...))
+		c.Close()
+	}()
+
+	ig, eg, stopIngress, stopEgress := startIngressAndEgress(t, serverAddress, MULTIPLEXER_HEADER_SIZE+20)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("a request longer than one frame"))
+	conn.(*net.TCPConn).CloseWrite()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	answer, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Error("Could not read the answer,", err)
+	}
+	if string(answer) != "answer to a request longer than one frame" {
+		t.Error("Wrong answer", string(answer))
+	}
+	conn.Close()
+
+	// the finished streams are garbage-collected
+	time.Sleep(ACK_DELAY + 2*GARBAGE_COLLECTION_INTERVAL)
+	ig.activeConnectionsLock.Lock()
+	if len(ig.activeConnections) != 0 {
+		t.Error("The ingress still has", len(ig.activeConnections), "streams")
+	}
+	ig.activeConnectionsLock.Unlock()
+	eg.activeConnectionsLock.Lock()
+	if len(eg.activeConnections) != 0 {
+		t.Error("The egress still has", len(eg.activeConnections), "streams")
+	}
+	eg.activeConnectionsLock.Unlock()
+
+	stopIngress <- true
+	stopEgress <- true
+	time.Sleep(2 * time.Second)
+}
+
+// Tests that the connection is closed when the egress cannot reach the server
+func TestStreamReset(t *testing.T) {
+
+	// nobody listens there
+	ig, _, stopIngress, stopEgress := startIngressAndEgress(t, "127.0.0.1:3002", MULTIPLEXER_HEADER_SIZE+20)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello"))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(make([]byte, 10))
+	if n != 0 || err == nil {
+		t.Error("The connection should be closed")
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		t.Error("The connection should be closed, not stay open")
+	}
+	conn.Close()
+
+	ig.activeConnectionsLock.Lock()
+	if len(ig.activeConnections) != 0 {
+		t.Error("The reset stream should be removed")
+	}
+	ig.activeConnectionsLock.Unlock()
+
+	stopIngress <- true
+	stopEgress <- true
+	time.Sleep(2 * time.Second)
+}
+
+// Tests that a stream ID made of zeros is not taken for an empty slot
+func TestZeroStreamID(t *testing.T) {
+
+	serverAddress := "127.0.0.1:3001"
+	l, err := net.Listen("tcp", serverAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		buffer := make([]byte, 10)
+		n, _ := c.Read(buffer)
+		accepted <- string(buffer[:n])
+		c.Close()
+	}()
+
+	up := make(chan []byte)
+	down := make(chan []byte, 10)
+	stopEgress := make(chan bool, 1)
+	go StartEgressHandler(serverAddress, MULTIPLEXER_HEADER_SIZE+20, up, down, stopEgress, false)
+
+	ID := string(make([]byte, STREAM_ID_SIZE))
+	up <- make([]byte, MULTIPLEXER_HEADER_SIZE+20) // an empty slot
+	up <- (&Frame{ID: ID, Seq: 0, Type: FRAME_OPEN}).ToBytes()
+	up <- (&Frame{ID: ID, Seq: 1, Type: FRAME_DATA, Data: []byte("hello")}).ToBytes()
+
+	select {
+	case data := <-accepted:
+		if data != "hello" {
+			t.Error("Wrong data " + strconv.Quote(data))
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("The stream with a zero ID was not opened")
+	}
+	stopEgress <- true
+}
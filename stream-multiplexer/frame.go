@@ -0,0 +1,189 @@
+package stream_multiplexer
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// MULTIPLEXER_HEADER_SIZE is the size of the header of a frame: STREAM_ID_SIZE bytes for the stream ID, 4 for the
+// sequence number, 4 for the acknowledgement, 1 for the type, 1 for the flags and 2 for the length
+const MULTIPLEXER_HEADER_SIZE = STREAM_ID_SIZE + 12
+
+// The types of frames. OPEN, DATA and FIN are numbered and delivered in order; RST and WINDOW_UPDATE are not
+const (
+	// FRAME_NONE is the type of an empty slot, which is all zeros
+	FRAME_NONE = iota
+	// FRAME_OPEN is the first frame of a stream
+	FRAME_OPEN
+	// FRAME_DATA carries data of the stream
+	FRAME_DATA
+	// FRAME_FIN says that the sender has no more data (half-close); the other direction stays open
+	FRAME_FIN
+	// FRAME_RST aborts the stream in both directions
+	FRAME_RST
+	// FRAME_WINDOW_UPDATE acknowledges frames and advertises the receive window, see flow.go
+	FRAME_WINDOW_UPDATE
+)
+
+// FLAG_MORE_FRAGMENTS is set on all frames of a message but the last one
+const FLAG_MORE_FRAGMENTS = 1
+
+// FLAG_ACK is set when the Ack field is valid, see arq.go
+const FLAG_ACK = 2
+
+// MAX_FRAGMENTS_PER_MESSAGE is how many frames a message read from a TCP connection can span
+const MAX_FRAGMENTS_PER_MESSAGE = 16
+
+// REORDER_MAX_FRAMES is how many frames of a stream we buffer while waiting for a missing one
+const REORDER_MAX_FRAMES = 256
+
+// REORDER_TIMEOUT is how long we wait for a missing frame before declaring a gap in the stream. It is longer than
+// the time the sender keeps retransmitting
+const REORDER_TIMEOUT = 60 * time.Second
+
+// Frame is the unit of data of the multiplexer; one frame fits in one DC-net slot (or one downstream cell).
+// The messages read from a TCP connection are cut in frames, numbered per stream, and rebuilt on the other side
+type Frame struct {
+	ID    string // STREAM_ID_SIZE bytes
+	Seq   uint32
+	Ack   uint32 // all frames of the other direction before Ack were received, if FLAG_ACK is set
+	Type  byte
+	Flags byte
+	Data  []byte
+
+	fragments int // number of frames merged in this one by the reassembler
+}
+
+// ToBytes encodes the frame
+func (f *Frame) ToBytes() []byte {
+	// [0:8 ID] [8:12 seq] [12:16 ack] [16 type] [17 flags] [18:20 length] [20: data]
+	buf := make([]byte, MULTIPLEXER_HEADER_SIZE+len(f.Data))
+	h := buf[STREAM_ID_SIZE:]
+	copy(buf[0:STREAM_ID_SIZE], f.ID)
+	binary.BigEndian.PutUint32(h[0:4], f.Seq)
+	binary.BigEndian.PutUint32(h[4:8], f.Ack)
+	h[8] = f.Type
+	h[9] = f.Flags
+	binary.BigEndian.PutUint16(h[10:12], uint16(len(f.Data)))
+	copy(buf[MULTIPLEXER_HEADER_SIZE:], f.Data)
+	return buf
+}
+
+// ParseFrame decodes a frame. The bytes after the frame (e.g. the padding of the DC-net slot) are ignored
+func ParseFrame(buf []byte) (*Frame, error) {
+	if len(buf) < MULTIPLEXER_HEADER_SIZE {
+		return nil, errors.New("frame too short, " + strconv.Itoa(len(buf)) + " bytes")
+	}
+	h := buf[STREAM_ID_SIZE:]
+	length := int(binary.BigEndian.Uint16(h[10:12]))
+	if MULTIPLEXER_HEADER_SIZE+length > len(buf) {
+		return nil, errors.New("frame announces " + strconv.Itoa(length) + " bytes, but has only " + strconv.Itoa(len(buf)-MULTIPLEXER_HEADER_SIZE))
+	}
+	f := &Frame{
+		ID:    string(buf[0:STREAM_ID_SIZE]),
+		Seq:   binary.BigEndian.Uint32(h[0:4]),
+		Ack:   binary.BigEndian.Uint32(h[4:8]),
+		Type:  h[8],
+		Flags: h[9],
+		Data:  buf[MULTIPLEXER_HEADER_SIZE : MULTIPLEXER_HEADER_SIZE+length],
+	}
+	return f, nil
+}
+
+// maxPayloadSizeOf returns how much data fits in a frame of maxMessageSize bytes, after the header. There must be room
+// for some data, or fragment would never end
+func maxPayloadSizeOf(maxMessageSize int) (int, error) {
+	if maxMessageSize <= MULTIPLEXER_HEADER_SIZE {
+		return 0, errors.New("messages of " + strconv.Itoa(maxMessageSize) + " bytes cannot carry data after the " +
+			strconv.Itoa(MULTIPLEXER_HEADER_SIZE) + " bytes of the header")
+	}
+	return maxMessageSize - MULTIPLEXER_HEADER_SIZE, nil
+}
+
+// fragment cuts a message in frames of at most maxPayloadSize bytes of data, numbered from *nextSeq on
+func fragment(ID string, message []byte, maxPayloadSize int, nextSeq *uint32) []*Frame {
+	frames := make([]*Frame, 0)
+	for start := 0; start == 0 || start < len(message); start += maxPayloadSize {
+		end := start + maxPayloadSize
+		f := &Frame{ID: ID, Seq: *nextSeq, Type: FRAME_DATA}
+		if end < len(message) {
+			f.Flags |= FLAG_MORE_FRAGMENTS
+		} else {
+			end = len(message)
+		}
+		f.Data = message[start:end]
+		frames = append(frames, f)
+		*nextSeq++
+	}
+	return frames
+}
+
+// isSequenced tells if the frame has a sequence number, i.e., is delivered in order
+func (f *Frame) isSequenced() bool {
+	return f.Type == FRAME_OPEN || f.Type == FRAME_DATA || f.Type == FRAME_FIN
+}
+
+// reassembler puts the frames of one stream back in order, and rebuilds the messages
+type reassembler struct {
+	nextSeq      uint32
+	pending      map[uint32]*Frame
+	pendingSince time.Time // when we started waiting for nextSeq, if pending is not empty
+	message      []byte    // the fragments of the current message
+	fragments    int       // number of fragments in message
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{pending: make(map[uint32]*Frame)}
+}
+
+// add stores a frame, and returns the frames that are now complete, in order; the fragments of a message are merged in
+// one DATA frame. Duplicate frames are ignored. Returns an error if a frame is missing for too long, or if a message
+// spans more than MAX_FRAGMENTS_PER_MESSAGE frames; the stream cannot be rebuilt then
+func (r *reassembler) add(f *Frame) ([]*Frame, error) {
+	if f.Seq-r.nextSeq >= 1<<31 {
+		// older than nextSeq, already delivered
+		return nil, nil
+	}
+	if _, found := r.pending[f.Seq]; found {
+		return nil, nil
+	}
+	if len(r.pending) == 0 {
+		r.pendingSince = time.Now()
+	}
+	r.pending[f.Seq] = f
+
+	frames := make([]*Frame, 0)
+	for {
+		next, found := r.pending[r.nextSeq]
+		if !found {
+			break
+		}
+		delete(r.pending, r.nextSeq)
+		r.nextSeq++
+		r.pendingSince = time.Now()
+
+		if next.Type != FRAME_DATA {
+			frames = append(frames, next)
+			continue
+		}
+		r.fragments++
+		if r.fragments > MAX_FRAGMENTS_PER_MESSAGE {
+			r.message = nil
+			return frames, errors.New("a message spans more than " + strconv.Itoa(MAX_FRAGMENTS_PER_MESSAGE) + " frames")
+		}
+		r.message = append(r.message, next.Data...)
+		if next.Flags&FLAG_MORE_FRAGMENTS == 0 {
+			frames = append(frames, &Frame{ID: next.ID, Seq: next.Seq, Type: FRAME_DATA, Data: r.message, fragments: r.fragments})
+			r.message = nil
+			r.fragments = 0
+		}
+	}
+
+	if len(r.pending) > REORDER_MAX_FRAMES || (len(r.pending) > 0 && time.Since(r.pendingSince) > REORDER_TIMEOUT) {
+		return frames, errors.New("gap in the stream, frame " + strconv.FormatUint(uint64(r.nextSeq), 10) +
+			" is missing and " + strconv.Itoa(len(r.pending)) + " later frames are waiting")
+	}
+	return frames, nil
+}
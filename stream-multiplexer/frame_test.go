@@ -0,0 +1,158 @@
+package stream_multiplexer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrameEncoding(t *testing.T) {
+
+	f := &Frame{ID: "abcdefgh", Seq: 123456, Ack: 42, Flags: FLAG_MORE_FRAGMENTS | FLAG_ACK, Data: []byte("hello")}
+	b := f.ToBytes()
+	if len(b) != MULTIPLEXER_HEADER_SIZE+5 {
+		t.Error("Wrong frame length", len(b))
+	}
+
+	// the padding of the slot is ignored
+	padded := append(b, make([]byte, 20)...)
+	f2, err := ParseFrame(padded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f2.ID != f.ID || f2.Seq != f.Seq || f2.Ack != f.Ack || f2.Flags != f.Flags || !bytes.Equal(f2.Data, f.Data) {
+		t.Error("Decoded frame differs", f2)
+	}
+
+	if _, err := ParseFrame(b[:MULTIPLEXER_HEADER_SIZE-1]); err == nil {
+		t.Error("Should not parse a truncated header")
+	}
+	if _, err := ParseFrame(b[:len(b)-1]); err == nil {
+		t.Error("Should not parse a truncated frame")
+	}
+}
+
+func TestFragment(t *testing.T) {
+
+	message := make([]byte, 25)
+	for i := range message {
+		message[i] = byte(i)
+	}
+	seq := uint32(7)
+	frames := fragment("abcd", message, 10, &seq)
+
+	if len(frames) != 3 || seq != 10 {
+		t.Fatal("Expected 3 frames and next seq 10, got", len(frames), seq)
+	}
+	rebuilt := make([]byte, 0)
+	for i, f := range frames {
+		if f.Seq != uint32(7+i) {
+			t.Error("Wrong seq", f.Seq, "for frame", i)
+		}
+		last := i == len(frames)-1
+		if (f.Flags&FLAG_MORE_FRAGMENTS == 0) != last {
+			t.Error("Wrong flags", f.Flags, "for frame", i)
+		}
+		rebuilt = append(rebuilt, f.Data...)
+	}
+	if !bytes.Equal(rebuilt, message) {
+		t.Error("Fragments do not rebuild the message")
+	}
+
+	// an empty message still makes one frame
+	frames = fragment("abcd", []byte{}, 10, &seq)
+	if len(frames) != 1 || seq != 11 {
+		t.Error("Expected one frame for an empty message")
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+
+	// the frames must have room for data after the header, or fragment would loop forever
+	for _, size := range []int{-1, 0, MULTIPLEXER_HEADER_SIZE} {
+		if _, err := newIngressServer(size, nil, nil, nil, false); err == nil {
+			t.Error("The ingress should refuse messages of", size, "bytes")
+		}
+		if _, err := newEgressServer("127.0.0.1:3009", size, nil, nil, nil, false); err == nil {
+			t.Error("The egress should refuse messages of", size, "bytes")
+		}
+	}
+	ig, err := newIngressServer(MULTIPLEXER_HEADER_SIZE+1, nil, nil, nil, false)
+	if err != nil || ig.maxPayloadSize != 1 {
+		t.Error("The ingress should carry 1 byte of data per message,", err)
+	}
+}
+
+func TestReassemblerReordering(t *testing.T) {
+
+	seq := uint32(1)
+	frames := []*Frame{{ID: "abcd", Seq: 0, Type: FRAME_OPEN}}
+	frames = append(frames, fragment("abcd", []byte("first message"), 4, &seq)...)
+	frames = append(frames, fragment("abcd", []byte("second"), 4, &seq)...)
+	frames = append(frames, &Frame{ID: "abcd", Seq: seq, Type: FRAME_FIN})
+
+	r := newReassembler()
+	received := make([]*Frame, 0)
+
+	// deliver in reverse order, with duplicates
+	for i := len(frames) - 1; i >= 0; i-- {
+		for k := 0; k < 2; k++ {
+			delivered, err := r.add(frames[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			received = append(received, delivered...)
+		}
+	}
+	// old frames are ignored
+	delivered, err := r.add(frames[1])
+	if err != nil || len(delivered) != 0 {
+		t.Error("An old frame should be ignored")
+	}
+
+	if len(received) != 4 {
+		t.Fatal("Expected OPEN, two messages and FIN, got", len(received), "frames")
+	}
+	if received[0].Type != FRAME_OPEN || received[3].Type != FRAME_FIN {
+		t.Error("The control frames should be delivered in order")
+	}
+	if string(received[1].Data) != "first message" || string(received[2].Data) != "second" {
+		t.Error("Wrong messages", string(received[1].Data), string(received[2].Data))
+	}
+	if received[1].fragments != 4 || received[2].fragments != 2 {
+		t.Error("Wrong number of fragments", received[1].fragments, received[2].fragments)
+	}
+}
+
+func TestReassemblerGap(t *testing.T) {
+
+	r := newReassembler()
+
+	// frame 0 is lost
+	for i := 1; i <= REORDER_MAX_FRAMES; i++ {
+		if _, err := r.add(&Frame{ID: "abcd", Seq: uint32(i)}); err != nil {
+			t.Fatal("Gap detected too early, at frame", i)
+		}
+	}
+	if _, err := r.add(&Frame{ID: "abcd", Seq: REORDER_MAX_FRAMES + 1}); err == nil {
+		t.Error("Should detect the missing frame")
+	}
+}
+
+func TestReassemblerTooManyFragments(t *testing.T) {
+
+	r := newReassembler()
+
+	// the peer never ends the message
+	for i := 0; i < MAX_FRAGMENTS_PER_MESSAGE; i++ {
+		if _, err := r.add(&Frame{ID: "abcd", Seq: uint32(i), Type: FRAME_DATA, Flags: FLAG_MORE_FRAGMENTS, Data: []byte{1}}); err != nil {
+			t.Fatal("Message refused too early, at frame", i)
+		}
+	}
+	seq := uint32(MAX_FRAGMENTS_PER_MESSAGE)
+	if _, err := r.add(&Frame{ID: "abcd", Seq: seq, Type: FRAME_DATA, Flags: FLAG_MORE_FRAGMENTS, Data: []byte{1}}); err == nil {
+		t.Error("Should refuse a message of more than", MAX_FRAGMENTS_PER_MESSAGE, "frames")
+	}
+	if r.message != nil {
+		t.Error("Should not keep the fragments of a refused message")
+	}
+}
@@ -5,9 +5,6 @@ import (
 
 	"strconv"
 
-	"bytes"
-	"crypto/rand"
-	"encoding/binary"
 	"encoding/hex"
 	"go.dedis.ch/onet/v3/log"
 	"io"
@@ -15,26 +12,83 @@ import (
 	"time"
 )
 
-// MULTIPLEXER_HEADER_SIZE is the size of the header for the multiplexed data,
-// currently 4 byte for StreamID and 4 byte for length
-const MULTIPLEXER_HEADER_SIZE = 8
-
 // MultiplexedConnection represents a TCP connections to which we assigned
 // a stream ID
 type MultiplexedConnection struct {
-	ID               string
-	ID_bytes         []byte
+	ID               string       // STREAM_ID_SIZE random bytes, see streamid.go
+	openNonce        []byte       // the nonce of the OPEN frame of the stream
+	target           []byte       // the network and the destination given by SOCKS5, if any, see socks5.go
+	bandwidth        *rateLimiter // the bandwidth cap of the egress policy, or nil (egress only)
 	conn             net.Conn
-	stopChan         chan bool
 	maxMessageLength int
+	nextSeq          uint32       // sequence number of the next frame we send on this stream
+	reassembler      *reassembler // puts the frames received on this stream back in order
+	window           *sendWindow  // the frames we sent and the peer did not acknowledge yet, and the peer's credit
+	writeQueue       *writeQueue  // the data received on this stream, until the connection takes it
+	lock             sync.Mutex   // protects the reassembler and the fields below
+	ackPending       bool         // we received frames and did not acknowledge them yet (egress only)
+	finSent          bool         // we sent our FIN, the connection has nothing more to read
+	closed           bool
+	lastActivity     time.Time
+	lastWindowUpdate time.Time
+}
+
+// newMultiplexedConnection creates the state of a stream; receiveWindow is the initial credit of the peer
+func newMultiplexedConnection(ID string, conn net.Conn, maxMessageLength int, receiveWindow uint32) *MultiplexedConnection {
+	mc := new(MultiplexedConnection)
+	mc.conn = conn
+	mc.ID = ID
+	mc.maxMessageLength = maxMessageLength
+	mc.reassembler = newReassembler()
+	mc.window = newSendWindow(receiveWindow)
+	mc.writeQueue = newWriteQueue()
+	mc.lastActivity = time.Now()
+	return mc
+}
+
+// touch records activity on the stream
+func (mc *MultiplexedConnection) touch() {
+	mc.lock.Lock()
+	mc.lastActivity = time.Now()
+	mc.lock.Unlock()
+}
+
+// isClosed tells if the stream was closed
+func (mc *MultiplexedConnection) isClosed() bool {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.closed
+}
+
+// close stops the goroutines of the stream and closes its connection. Returns false if it was closed already
+func (mc *MultiplexedConnection) close() bool {
+	mc.lock.Lock()
+	if mc.closed {
+		mc.lock.Unlock()
+		return false
+	}
+	mc.closed = true
+	conn := mc.conn
+	mc.lock.Unlock()
+
+	mc.window.close()
+	mc.writeQueue.close()
+	if conn != nil {
+		// the egress might still be dialing
+		conn.Close()
+	}
+	return true
 }
 
 // IngressServer accepts TCPs connections and multiplexes them (read- and write-)
 // over go channels
 type IngressServer struct {
 	activeConnectionsLock sync.Locker
-	activeConnections     []*MultiplexedConnection
+	activeConnections     map[string]*MultiplexedConnection
 	socketListener        *net.TCPListener
+	socks                 bool   // we run the SOCKS5 handshakes, and the OPEN frames carry the destination
+	dnsProxyPort          int    // we take DNS queries on this UDP port, if not 0, see dns.go
+	tunInterface          string // we take the IP packets of this TUN interface, if not "", see tun.go
 	maxMessageSize        int
 	maxPayloadSize        int
 	upstreamChan          chan []byte
@@ -45,19 +99,56 @@ type IngressServer struct {
 
 // StartIngressServer creates (and block) an Ingress Server
 func StartIngressServer(port int, maxMessageSize int, upstreamChan chan []byte, downstreamChan chan []byte, stopChan chan bool, verbose bool) {
+	ig, err := newIngressServer(maxMessageSize, upstreamChan, downstreamChan, stopChan, verbose)
+	if err != nil {
+		log.Error("Ingress server cannot start :", err.Error())
+		return
+	}
+	ig.listen(port)
+}
 
+// IngressOptions are the optional settings of an Ingress Server
+type IngressOptions struct {
+	SOCKS        bool   // terminate SOCKS5 here, and send only the destinations to the egress, see socks5.go
+	DNSProxyPort int    // take DNS queries on this local UDP port and resolve them at the egress, 0 to disable
+	TunInterface string // create this TUN interface and send its IP packets to the egress' NAT, "" to disable (Linux)
+}
+
+// StartIngressServerWithOptions creates (and block) an Ingress Server with the given options
+func StartIngressServerWithOptions(port int, options IngressOptions, maxMessageSize int, upstreamChan chan []byte, downstreamChan chan []byte, stopChan chan bool, verbose bool) {
+	ig, err := newIngressServer(maxMessageSize, upstreamChan, downstreamChan, stopChan, verbose)
+	if err != nil {
+		log.Error("Ingress server cannot start :", err.Error())
+		return
+	}
+	ig.socks = options.SOCKS
+	ig.dnsProxyPort = options.DNSProxyPort
+	ig.tunInterface = options.TunInterface
+	ig.listen(port)
+}
+
+func newIngressServer(maxMessageSize int, upstreamChan chan []byte, downstreamChan chan []byte, stopChan chan bool, verbose bool) (*IngressServer, error) {
+	maxPayloadSize, err := maxPayloadSizeOf(maxMessageSize)
+	if err != nil {
+		return nil, err
+	}
 	ig := new(IngressServer)
 	ig.maxMessageSize = maxMessageSize
 	ig.upstreamChan = upstreamChan
 	ig.downstreamChan = downstreamChan
 	ig.stopChan = stopChan
-	ig.maxPayloadSize = maxMessageSize - MULTIPLEXER_HEADER_SIZE //we use 8 bytes for the multiplexing
+	ig.maxPayloadSize = maxPayloadSize
 	ig.activeConnectionsLock = new(sync.Mutex)
-	ig.activeConnections = make([]*MultiplexedConnection, 0)
+	ig.activeConnections = make(map[string]*MultiplexedConnection)
 	ig.verbose = verbose
 	if verbose {
 		log.Lvl1("Ingress Server in verbose mode")
 	}
+	return ig, nil
+}
+
+// listen accepts connections until stopChan is written to
+func (ig *IngressServer) listen(port int) {
 
 	var err error
 	s, err := net.Listen("tcp", ":"+strconv.Itoa(port))
@@ -74,18 +165,43 @@ func StartIngressServer(port int, maxMessageSize int, upstreamChan chan []byte,
 	// starts a handler that dispatches the data from "downstreamChan" into the correct connection
 	go ig.multiplexedChannelReader()
 
+	// starts a handler that retransmits frames and collects finished streams
+	go ig.maintenance()
+
+	var dns *dnsProxy
+	if ig.dnsProxyPort != 0 {
+		if dns, err = ig.startDNSProxy(ig.dnsProxyPort); err != nil {
+			log.Error("Ingress server cannot start the DNS proxy :", err.Error())
+		}
+	}
+	var tun *tunnel
+	if ig.tunInterface != "" {
+		if tun, err = ig.startTunnel(ig.tunInterface); err != nil {
+			log.Error("Ingress server cannot open the TUN interface", ig.tunInterface, ":", err.Error())
+		}
+	}
+
 	for {
 		ig.socketListener.SetDeadline(time.Now().Add(time.Second))
 		conn, err := ig.socketListener.Accept()
 
 		select {
-		case <-stopChan:
+		case <-ig.stopChan:
 			log.Lvl2("Ingress server stopped.")
 
+			if dns != nil {
+				dns.close()
+			}
+			if tun != nil {
+				tun.close()
+			}
 			//stops all subroutines
+			ig.activeConnectionsLock.Lock()
 			for _, mc := range ig.activeConnections {
-				mc.stopChan <- true
+				mc.close()
 			}
+			ig.activeConnections = make(map[string]*MultiplexedConnection)
+			ig.activeConnectionsLock.Unlock()
 			ig.socketListener.Close()
 			return
 		default:
@@ -99,40 +215,41 @@ func StartIngressServer(port int, maxMessageSize int, upstreamChan chan []byte,
 			log.Lvl3("Ingress server error:", err)
 		}
 
-		id := generateRandomID()
-		log.Lvl2("Ingress server just accepted a connection, assigning ID", id)
-
 		if err != nil {
 			log.Error("Ingress server got an error with this new connection, shutting down :", err.Error())
 			ig.socketListener.Close()
 			return
 		}
 
-		mc := new(MultiplexedConnection)
-		mc.conn = conn
-		mc.ID = id
-		ID_bytes := []byte(id)
-		mc.ID_bytes = ID_bytes[0:4]
-		mc.stopChan = make(chan bool, 1)
-		mc.maxMessageLength = ig.maxMessageSize
-
-		// lock the list before editing it
-		ig.activeConnectionsLock.Lock()
-		ig.activeConnections = append(ig.activeConnections, mc)
-		ig.activeConnectionsLock.Unlock()
-
-		// starts a handler that pours "mc.connection" into upstreamChan
-		go ig.ingressConnectionReader(mc)
+		if ig.socks {
+			go ig.acceptSOCKS(conn)
+		} else {
+			ig.startStream(conn, nil)
+		}
 	}
 }
 
+// startStream multiplexes a new connection; target is its network and destination, or nil for the egress' server
+func (ig *IngressServer) startStream(conn net.Conn, target []byte) {
+	mc := ig.addStream(conn)
+	mc.target = target
+	log.Lvl2("Ingress server just accepted a connection, assigning ID", hex.EncodeToString([]byte(mc.ID)))
+
+	// starts a handler that pours "mc.connection" into upstreamChan, and one that writes the answers to it
+	go ig.ingressConnectionReader(mc)
+	go connectionWriter(mc, func() { ig.advertiseWindow(mc) }, func(err error) {
+		ig.reset(mc, "cannot be written, "+errorString(err))
+	})
+}
+
 // multiplexedChannelReader reads the "downstreamChan" and dispatches the data to the correct connection
 func (ig *IngressServer) multiplexedChannelReader() {
 	for {
 		// poll the downstream chanel
 		slice := <-ig.downstreamChan
 
-		if len(slice) < MULTIPLEXER_HEADER_SIZE {
+		frame, err := ParseFrame(slice)
+		if err != nil || frame.Type == FRAME_NONE {
 			// we cannot de-multiplex data without the header, just ignore
 			continue
 		}
@@ -141,42 +258,81 @@ func (ig *IngressServer) multiplexedChannelReader() {
 			log.Lvl1("Ingress Server <- DCNet: \n", hex.Dump(slice))
 		}
 
-		ID := slice[0:4]
-		length := int(binary.BigEndian.Uint32(slice[4:MULTIPLEXER_HEADER_SIZE]))
-		data := slice[MULTIPLEXER_HEADER_SIZE:]
+		// the frames of the other clients' streams are not for us
+		ig.activeConnectionsLock.Lock()
+		mc, found := ig.activeConnections[frame.ID]
+		ig.activeConnectionsLock.Unlock()
 
-		// trim the data if needed
-		if len(data) > length {
-			data = data[0:length]
+		if found {
+			ig.handleDownstreamFrame(mc, frame)
 		}
+	}
+}
 
-		ig.activeConnectionsLock.Lock()
-		for _, v := range ig.activeConnections {
-			if bytes.Equal(v.ID_bytes, ID) {
-				v.conn.Write(data)
-				break
-			}
+// handleDownstreamFrame processes a frame the egress sent on one of our streams
+func (ig *IngressServer) handleDownstreamFrame(mc *MultiplexedConnection, frame *Frame) {
+	mc.touch()
+
+	switch frame.Type {
+	case FRAME_WINDOW_UPDATE:
+		mc.window.update(frame.Ack, frame.window())
+		return
+	case FRAME_RST:
+		log.Lvl2("Ingress server: stream", hex.EncodeToString([]byte(mc.ID)), "was reset by the egress")
+		ig.removeStream(mc)
+		return
+	}
+	if !frame.isSequenced() {
+		return
+	}
+	if frame.Flags&FLAG_ACK != 0 {
+		mc.window.ack(frame.Ack)
+	}
+
+	mc.lock.Lock()
+	frames, err := mc.reassembler.add(frame)
+	mc.lock.Unlock()
+
+	for _, f := range frames {
+		switch f.Type {
+		case FRAME_DATA:
+			mc.writeQueue.push(f.Data, f.fragments)
+		case FRAME_FIN:
+			mc.writeQueue.finish()
 		}
-		ig.activeConnectionsLock.Unlock()
+	}
+	if err != nil {
+		// the stream is corrupted, close it
+		ig.reset(mc, "cannot be rebuilt, "+err.Error())
+		return
+	}
 
+	// if the browser does not keep up, ask the egress to slow down
+	if mc.writeQueue.isLow() {
+		ig.advertiseWindow(mc)
 	}
 }
 
 func (ig *IngressServer) ingressConnectionReader(mc *MultiplexedConnection) {
-	for {
-		// Check if we need to stop
-		select {
-		case _ = <-mc.stopChan:
-			mc.conn.Close()
-			return
-		default:
-		}
 
-		// Read data from the connection
-		buffer := make([]byte, ig.maxPayloadSize)
+	// the stream starts with an OPEN frame
+	open := newOpenFrame(mc.ID, mc.target)
+	mc.openNonce = open.openNonce()
+	if !ig.sendSequenced(mc, open) {
+		return
+	}
+	mc.nextSeq++
+
+	for {
+		// Read data from the connection; a message can span several frames
+		buffer := make([]byte, ig.maxPayloadSize*MAX_FRAGMENTS_PER_MESSAGE)
 		mc.conn.SetReadDeadline(time.Now().Add(time.Second))
 		n, err := mc.conn.Read(buffer)
 
+		if mc.isClosed() {
+			return
+		}
+
 		if err != nil {
 			if err, ok := err.(*net.OpError); ok && err.Timeout() {
 				// it was a timeout
@@ -184,32 +340,162 @@ func (ig *IngressServer) ingressConnectionReader(mc *MultiplexedConnection) {
 			}
 
 			if err == io.EOF {
-				// Connection closed indicator
+				// the browser has nothing more to send, but can still read the answer
+				if ig.sendSequenced(mc, &Frame{ID: mc.ID, Seq: mc.nextSeq, Type: FRAME_FIN}) {
+					mc.nextSeq++
+					mc.lock.Lock()
+					mc.finSent = true
+					mc.lock.Unlock()
+				}
 				return
 			}
 
-			log.Error("Ingress server: connectionReader error,", err)
+			ig.reset(mc, "cannot be read, "+err.Error())
 			return
 		}
 
-		// Trim the data and send it through the data channel
-		slice := make([]byte, n+MULTIPLEXER_HEADER_SIZE)
-		copy(slice[0:4], mc.ID_bytes[:])
-		binary.BigEndian.PutUint32(slice[4:8], uint32(n))
-		copy(slice[MULTIPLEXER_HEADER_SIZE:], buffer[:n])
-
-		if ig.verbose {
-			log.Lvl1("Ingress Server -> DCNet:\n", hex.Dump(slice))
+		// Cut the data in frames and send them through the data channel, each will take one slot
+		for _, f := range fragment(mc.ID, buffer[:n], ig.maxPayloadSize, &mc.nextSeq) {
+			if !ig.sendSequenced(mc, f) {
+				return
+			}
 		}
+	}
+}
+
+// sendSequenced sends a frame upstream and keeps it until it is acknowledged. If the window is full, this blocks, and
+// we stop reading the connection. Returns false if the stream was closed
+func (ig *IngressServer) sendSequenced(mc *MultiplexedConnection, f *Frame) bool {
+	if !mc.window.push(f) {
+		return false
+	}
+	slice := f.ToBytes()
+	if ig.verbose {
+		log.Lvl1("Ingress Server -> DCNet:\n", hex.Dump(slice))
+	}
+
+	ig.upstreamChan <- slice
+	mc.window.markSent(f.Seq)
+	mc.touch()
+	return true
+}
 
+// sendControl sends a RST or a WINDOW_UPDATE upstream. It does not block, since it is called when handling the
+// downstream data, and the client might be waiting for us to take it
+func (ig *IngressServer) sendControl(f *Frame) {
+	slice := f.ToBytes()
+	if ig.verbose {
+		log.Lvl1("Ingress Server -> DCNet (control):\n", hex.Dump(slice))
+	}
+	go func() {
 		ig.upstreamChan <- slice
+	}()
+}
+
+// advertiseWindow tells the egress how many frames we accept on this stream
+func (ig *IngressServer) advertiseWindow(mc *MultiplexedConnection) {
+	mc.lock.Lock()
+	ack := mc.reassembler.nextSeq
+	mc.lastWindowUpdate = time.Now()
+	mc.lock.Unlock()
+
+	window := mc.writeQueue.advertise()
+	if window >= RECEIVE_WINDOW/2 {
+		// we keep up again, do not limit the egress (we do not acknowledge the downstream frames, the window would
+		// not move)
+		window = WINDOW_UNLIMITED
 	}
+	ig.sendControl(newWindowUpdate(mc.ID, ack, window))
 }
 
-//generateID generates an ID from a private key
-func generateRandomID() string {
-	var n uint32
-	binary.Read(rand.Reader, binary.LittleEndian, &n)
+// reset aborts the stream, and tells the egress
+func (ig *IngressServer) reset(mc *MultiplexedConnection, reason string) {
+	if mc.isClosed() {
+		return
+	}
+	log.Lvl2("Ingress server: stream", hex.EncodeToString([]byte(mc.ID)), reason, ", resetting it")
+	ig.sendControl(&Frame{ID: mc.ID, Type: FRAME_RST})
+	ig.removeStream(mc)
+}
+
+// addStream assigns a new stream to the connection; its ID differs from the ones of our other streams
+func (ig *IngressServer) addStream(conn net.Conn) *MultiplexedConnection {
+	ig.activeConnectionsLock.Lock()
+	defer ig.activeConnectionsLock.Unlock()
 
-	return strconv.Itoa(int(n))
+	ID := generateRandomID()
+	for _, found := ig.activeConnections[ID]; found; _, found = ig.activeConnections[ID] {
+		ID = generateRandomID()
+	}
+	mc := newMultiplexedConnection(ID, conn, ig.maxMessageSize, RECEIVE_WINDOW)
+	ig.activeConnections[ID] = mc
+	return mc
+}
+
+// removeStream closes the stream and forgets it
+func (ig *IngressServer) removeStream(mc *MultiplexedConnection) {
+	ig.activeConnectionsLock.Lock()
+	if ig.activeConnections[mc.ID] == mc {
+		delete(ig.activeConnections, mc.ID)
+	}
+	ig.activeConnectionsLock.Unlock()
+	mc.close()
+}
+
+// maintenance sends again the frames that were not acknowledged in time (they go in the next slot of the client),
+// repeats the small windows we advertised, and removes the finished and idle streams
+func (ig *IngressServer) maintenance() {
+	for {
+		time.Sleep(RETRANSMIT_CHECK_INTERVAL)
+
+		ig.activeConnectionsLock.Lock()
+		streams := make([]*MultiplexedConnection, 0, len(ig.activeConnections))
+		for _, mc := range ig.activeConnections {
+			streams = append(streams, mc)
+		}
+		ig.activeConnectionsLock.Unlock()
+
+		now := time.Now()
+		for _, mc := range streams {
+			frames, err := mc.window.due(now)
+			if err != nil {
+				// the egress is gone, or the channel too lossy
+				ig.reset(mc, "is lost, "+err.Error())
+				continue
+			}
+			for _, f := range frames {
+				slice := f.ToBytes()
+				if ig.verbose {
+					log.Lvl1("Ingress Server -> DCNet (retransmission):\n", hex.Dump(slice))
+				}
+				ig.upstreamChan <- slice
+			}
+
+			mc.lock.Lock()
+			finished := mc.finSent
+			idle := now.Sub(mc.lastActivity) > STREAM_IDLE_TIMEOUT
+			repeatWindow := now.Sub(mc.lastWindowUpdate) > WINDOW_UPDATE_INTERVAL
+			mc.lock.Unlock()
+
+			if repeatWindow && mc.writeQueue.wasAdvertisedLow() {
+				ig.advertiseWindow(mc)
+			}
+
+			// both directions are closed, and the egress has all our frames
+			if finished && mc.writeQueue.isDrained() && mc.window.size() == 0 {
+				log.Lvl2("Ingress server: stream", hex.EncodeToString([]byte(mc.ID)), "is finished")
+				ig.removeStream(mc)
+			} else if idle {
+				ig.reset(mc, "is idle")
+			}
+		}
+	}
+}
+
+// errorString describes an error that might be nil
+func errorString(err error) string {
+	if err == nil {
+		return "short write"
+	}
+	return err.Error()
 }
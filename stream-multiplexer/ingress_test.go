@@ -2,7 +2,6 @@ package stream_multiplexer
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"math"
 	"net"
@@ -12,16 +11,40 @@ import (
 	"time"
 )
 
+// dataFrames forwards the DATA frames of upstreamChan, skipping the OPEN and FIN frames
+func dataFrames(upstreamChan chan []byte) chan []byte {
+	out := make(chan []byte)
+	go func() {
+		for slice := range upstreamChan {
+			if f, err := ParseFrame(slice); err == nil && f.Type != FRAME_DATA {
+				continue
+			}
+			out <- slice
+		}
+	}()
+	return out
+}
+
+// ackUpstream acknowledges an upstream frame, as the egress would
+func ackUpstream(downstreamChan chan []byte, data []byte) {
+	f, err := ParseFrame(data)
+	if err != nil {
+		return
+	}
+	downstreamChan <- newWindowUpdate(f.ID, f.Seq+1, RECEIVE_WINDOW).ToBytes()
+}
+
 // Tests that the multiplexer produces messages of at most "payloadLength"
 func TestIngressSizes(t *testing.T) {
 
 	port := 3000
-	payloadLength := 20
+	payloadLength := MULTIPLEXER_HEADER_SIZE + 12
 	upstreamChan := make(chan []byte)
 	downstreamChan := make(chan []byte)
 	stopChan := make(chan bool)
 
 	go StartIngressServer(port, payloadLength, upstreamChan, downstreamChan, stopChan, true)
+	up := dataFrames(upstreamChan)
 
 	time.Sleep(2 * time.Second)
 
@@ -41,11 +64,13 @@ func TestIngressSizes(t *testing.T) {
 
 	for i := 0; i < expectedNumberOfMessages-1; i++ {
 		select {
-		case data := <-upstreamChan:
+		case data := <-up:
 			if len(data) != payloadLength {
 				t.Error("Expected multiplexed data of length " + strconv.Itoa(payloadLength) +
 					" for message " + strconv.Itoa(i) + ", but instead got " + strconv.Itoa(len(data)))
 			}
+			// otherwise the window fills up
+			ackUpstream(downstreamChan, data)
 
 		case <-time.After(1 * time.Second):
 			t.Error("No data written on the upstreamchannel")
@@ -53,7 +78,7 @@ func TestIngressSizes(t *testing.T) {
 	}
 
 	select {
-	case data := <-upstreamChan:
+	case data := <-up:
 		if len(data) != lastMessageSize {
 			t.Error("Expected multiplexed data of length " + strconv.Itoa(lastMessageSize) +
 				" for last message, but instead got " + strconv.Itoa(len(data)))
@@ -72,12 +97,13 @@ func TestIngressSizes(t *testing.T) {
 func TestUpstreamIngressMultiplexer(t *testing.T) {
 
 	port := 3000
-	payloadLength := 20
+	payloadLength := MULTIPLEXER_HEADER_SIZE + 12
 	upstreamChan := make(chan []byte)
 	downstreamChan := make(chan []byte)
 	stopChan := make(chan bool, 1)
 
 	go StartIngressServer(port, payloadLength, upstreamChan, downstreamChan, stopChan, true)
+	up := dataFrames(upstreamChan)
 
 	time.Sleep(2 * time.Second)
 
@@ -91,11 +117,11 @@ func TestUpstreamIngressMultiplexer(t *testing.T) {
 	conn1.Write([]byte("test"))
 	var id_conn1_bytes []byte
 	select {
-	case data := <-upstreamChan:
+	case data := <-up:
 		if !bytes.Equal([]byte("test"), data[MULTIPLEXER_HEADER_SIZE:]) {
 			t.Error("Data not recovered")
 		}
-		id_conn1_bytes = data[0:4]
+		id_conn1_bytes = data[0:STREAM_ID_SIZE]
 
 	case <-time.After(1 * time.Second):
 		t.Error("No data written on the upstreamchannel")
@@ -104,11 +130,11 @@ func TestUpstreamIngressMultiplexer(t *testing.T) {
 	// c1 sends "ninja"
 	conn1.Write([]byte("ninja"))
 	select {
-	case data := <-upstreamChan:
+	case data := <-up:
 		if !bytes.Equal([]byte("ninja"), data[MULTIPLEXER_HEADER_SIZE:]) {
 			t.Error("Data not recovered")
 		}
-		if !bytes.Equal(id_conn1_bytes, data[0:4]) {
+		if !bytes.Equal(id_conn1_bytes, data[0:STREAM_ID_SIZE]) {
 			t.Error("Data on the same stream gets different IDs")
 		}
 
@@ -126,11 +152,11 @@ func TestUpstreamIngressMultiplexer(t *testing.T) {
 	conn2.Write([]byte("connexion2"))
 	var id_conn2_bytes []byte
 	select {
-	case data := <-upstreamChan:
+	case data := <-up:
 		if !bytes.Equal([]byte("connexion2"), data[MULTIPLEXER_HEADER_SIZE:]) {
 			t.Error("Data not recovered")
 		}
-		id_conn2_bytes = data[0:4]
+		id_conn2_bytes = data[0:STREAM_ID_SIZE]
 
 	case <-time.After(1 * time.Second):
 		t.Error("No data written on the upstreamchannel")
@@ -139,11 +165,11 @@ func TestUpstreamIngressMultiplexer(t *testing.T) {
 	// c2 sends "ninja2"
 	conn2.Write([]byte("ninja2"))
 	select {
-	case data := <-upstreamChan:
+	case data := <-up:
 		if !bytes.Equal([]byte("ninja2"), data[MULTIPLEXER_HEADER_SIZE:]) {
 			t.Error("Data not recovered")
 		}
-		if !bytes.Equal(id_conn2_bytes, data[0:4]) {
+		if !bytes.Equal(id_conn2_bytes, data[0:STREAM_ID_SIZE]) {
 			t.Error("Data on the same stream gets different IDs")
 		}
 
@@ -154,11 +180,11 @@ func TestUpstreamIngressMultiplexer(t *testing.T) {
 	// c1 sends "newdata"
 	conn1.Write([]byte("newdata"))
 	select {
-	case data := <-upstreamChan:
+	case data := <-up:
 		if !bytes.Equal([]byte("newdata"), data[MULTIPLEXER_HEADER_SIZE:]) {
 			t.Error("Data not recovered")
 		}
-		if !bytes.Equal(id_conn1_bytes, data[0:4]) {
+		if !bytes.Equal(id_conn1_bytes, data[0:STREAM_ID_SIZE]) {
 			t.Error("Data on the same stream gets different IDs")
 		}
 
@@ -175,12 +201,13 @@ func TestUpstreamIngressMultiplexer(t *testing.T) {
 func TestDownstreamIngressMultiplexer(t *testing.T) {
 
 	port := 3000
-	payloadLength := 20
+	payloadLength := MULTIPLEXER_HEADER_SIZE + 12
 	upstreamChan := make(chan []byte)
 	downstreamChan := make(chan []byte)
 	stopChan := make(chan bool, 1)
 
 	go StartIngressServer(port, payloadLength, upstreamChan, downstreamChan, stopChan, true)
+	up := dataFrames(upstreamChan)
 
 	time.Sleep(2 * time.Second)
 
@@ -194,11 +221,11 @@ func TestDownstreamIngressMultiplexer(t *testing.T) {
 	conn1.Write([]byte("test"))
 	var id_conn1_bytes []byte
 	select {
-	case data := <-upstreamChan:
+	case data := <-up:
 		if !bytes.Equal([]byte("test"), data[MULTIPLEXER_HEADER_SIZE:]) {
 			t.Error("Data not recovered")
 		}
-		id_conn1_bytes = data[0:4]
+		id_conn1_bytes = data[0:STREAM_ID_SIZE]
 
 	case <-time.After(1 * time.Second):
 		t.Error("No data written on the upstreamchannel")
@@ -214,11 +241,11 @@ func TestDownstreamIngressMultiplexer(t *testing.T) {
 	conn2.Write([]byte("connexion2"))
 	var id_conn2_bytes []byte
 	select {
-	case data := <-upstreamChan:
+	case data := <-up:
 		if !bytes.Equal([]byte("connexion2"), data[MULTIPLEXER_HEADER_SIZE:]) {
 			t.Error("Data not recovered")
 		}
-		id_conn2_bytes = data[0:4]
+		id_conn2_bytes = data[0:STREAM_ID_SIZE]
 
 	case <-time.After(1 * time.Second):
 		t.Error("No data written on the upstreamchannel")
@@ -227,10 +254,7 @@ func TestDownstreamIngressMultiplexer(t *testing.T) {
 	// now tests receiving messages (for c1)
 
 	payload := []byte("hello")
-	messageForC1 := make([]byte, MULTIPLEXER_HEADER_SIZE+len(payload))
-	copy(messageForC1[:4], id_conn1_bytes[:])
-	binary.BigEndian.PutUint32(messageForC1[4:8], uint32(len(payload)))
-	copy(messageForC1[MULTIPLEXER_HEADER_SIZE:], payload)
+	messageForC1 := (&Frame{ID: string(id_conn1_bytes), Seq: 0, Type: FRAME_DATA, Data: payload}).ToBytes()
 	downstreamChan <- messageForC1
 
 	conn1.SetDeadline(time.Now().Add(time.Second))
@@ -282,9 +306,7 @@ func TestDownstreamIngressMultiplexer(t *testing.T) {
 
 	for i := 0; i < nMessages; i++ {
 		messagesForC2[i] = make([]byte, payloadLength)
-		copy(messagesForC2[i][:4], id_conn2_bytes[:MULTIPLEXER_HEADER_SIZE])
-		binary.BigEndian.PutUint32(messagesForC2[i][4:8], uint32(len(plaintextsForC2[i])))
-		copy(messagesForC2[i][MULTIPLEXER_HEADER_SIZE:], plaintextsForC2[i])
+		copy(messagesForC2[i], (&Frame{ID: string(id_conn2_bytes), Seq: uint32(i), Type: FRAME_DATA, Data: plaintextsForC2[i]}).ToBytes())
 		//fmt.Println("Produced message", i, "bytes", messagesForC2[i])
 
 		downstreamChan <- messagesForC2[i]
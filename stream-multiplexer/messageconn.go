@@ -0,0 +1,118 @@
+package stream_multiplexer
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MESSAGE_QUEUE_SIZE is how many messages of a messageConn wait to be read; the next ones are dropped
+const MESSAGE_QUEUE_SIZE = 64
+
+// messageConn is the net.Conn of a stream that carries messages instead of a byte stream (UDP datagrams, DNS
+// queries): a Read returns one message given to deliver, and a Write hands one message to the write function
+type messageConn struct {
+	messages     chan []byte
+	finished     chan bool
+	finishOnce   sync.Once
+	lock         sync.Mutex
+	readDeadline time.Time
+	write        func([]byte) (int, error)
+	onClose      func()
+	localAddr    net.Addr
+	remoteAddr   net.Addr
+}
+
+func newMessageConn(write func([]byte) (int, error), onClose func(), localAddr net.Addr, remoteAddr net.Addr) *messageConn {
+	return &messageConn{messages: make(chan []byte, MESSAGE_QUEUE_SIZE), finished: make(chan bool), write: write,
+		onClose: onClose, localAddr: localAddr, remoteAddr: remoteAddr}
+}
+
+// deliver queues a message for Read; drops it if the queue is full
+func (c *messageConn) deliver(message []byte) {
+	select {
+	case c.messages <- message:
+	default:
+	}
+}
+
+// finish makes Read return io.EOF once the queued messages are taken
+func (c *messageConn) finish() {
+	c.finishOnce.Do(func() { close(c.finished) })
+}
+
+func (c *messageConn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	deadline := c.readDeadline
+	c.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case message := <-c.messages:
+		return copy(b, message), nil
+	case <-c.finished:
+		select {
+		case message := <-c.messages:
+			return copy(b, message), nil
+		default:
+			return 0, io.EOF
+		}
+	case <-timeout:
+		return 0, &net.OpError{Op: "read", Net: "message", Err: timeoutError{}}
+	}
+}
+
+func (c *messageConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.finished:
+		return 0, errors.New("the connection is closed")
+	default:
+	}
+	return c.write(b)
+}
+
+func (c *messageConn) Close() error {
+	c.finish()
+	if c.onClose != nil {
+		c.onClose()
+	}
+	return nil
+}
+
+func (c *messageConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *messageConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *messageConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *messageConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline = t
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *messageConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// timeoutError is returned by messageConn.Read when its deadline passes
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
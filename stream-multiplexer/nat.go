@@ -0,0 +1,803 @@
+package stream_multiplexer
+
+/*
+Userspace NAT
+*************
+In TUN mode (see tun.go), a stream carries the IP packets of the TUN interface of a client. The egress gives them to a
+packetNAT, which re-emits them from the relay itself: it terminates the TCP connections of the client with a minimal
+TCP endpoint and opens its own to the destinations, and it sends the UDP datagrams with its own sockets. The answers
+go back to the client as IP packets built by the NAT. The relay needs no privilege for that, and the destinations see
+the relay's address, as with SOCKS.
+
+Only IPv4 TCP and UDP are translated; the other packets (IPv6, ICMP, IP fragments) are dropped. The TCP endpoint is
+deliberately simple: it takes only the segments in order (the client retransmits the others), retransmits its own
+data go-back-N, and has no congestion control, since the DC-net is the bottleneck anyway. The egress policy applies to
+each flow, and its bandwidth caps to the whole stream.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"go.dedis.ch/onet/v3/log"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TUN_MTU is the largest IP packet of the tunnel; the TUN interface of the client must not have a larger MTU
+const TUN_MTU = 1400
+
+// NAT_UDP_TIMEOUT is how long a UDP flow lives without datagrams
+const NAT_UDP_TIMEOUT = time.Minute
+
+// NAT_TCP_TIMEOUT is how long a TCP flow lives without segments from the client
+const NAT_TCP_TIMEOUT = STREAM_IDLE_TIMEOUT
+
+// NAT_TCP_SEND_BUFFER bounds the data of a server that the client did not acknowledge yet
+const NAT_TCP_SEND_BUFFER = 64 * 1024
+
+// NAT_TCP_WRITE_QUEUE is how many segments of the client wait to be written to the server; the next ones are dropped
+const NAT_TCP_WRITE_QUEUE = 64
+
+const (
+	protocolTCP    = 6
+	protocolUDP    = 17
+	ipv4HeaderSize = 20
+	udpHeaderSize  = 8
+	tcpHeaderSize  = 20
+	tcpWindow      = 65535
+	tcpDefaultMSS  = 536
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+// an IPv4 packet, whose slices point into the received buffer
+type ipv4Packet struct {
+	protocol byte
+	src      net.IP
+	dst      net.IP
+	payload  []byte
+}
+
+func parseIPv4(b []byte) (*ipv4Packet, error) {
+	if len(b) < ipv4HeaderSize || b[0]>>4 != 4 {
+		return nil, errors.New("not an IPv4 packet")
+	}
+	headerSize := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:4]))
+	if headerSize < ipv4HeaderSize || total < headerSize || total > len(b) {
+		return nil, errors.New("invalid IPv4 packet")
+	}
+	// "more fragments" or a fragment offset
+	if binary.BigEndian.Uint16(b[6:8])&0x3fff != 0 {
+		return nil, errors.New("fragmented IPv4 packet")
+	}
+	return &ipv4Packet{protocol: b[9], src: net.IP(b[12:16]), dst: net.IP(b[16:20]), payload: b[headerSize:total]}, nil
+}
+
+func buildIPv4(protocol byte, src net.IP, dst net.IP, payload []byte) []byte {
+	p := make([]byte, ipv4HeaderSize+len(payload))
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:4], uint16(len(p)))
+	p[6] = 0x40 // don't fragment
+	p[8] = 64   // TTL
+	p[9] = protocol
+	copy(p[12:16], src.To4())
+	copy(p[16:20], dst.To4())
+	binary.BigEndian.PutUint16(p[10:12], checksumFold(checksumAdd(0, p[:ipv4HeaderSize])))
+	copy(p[ipv4HeaderSize:], payload)
+	return p
+}
+
+// checksumAdd adds b to a one's complement sum
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// transportChecksum is the checksum of a TCP or UDP segment, with its pseudo-header
+func transportChecksum(protocol byte, src net.IP, dst net.IP, segment []byte) uint16 {
+	sum := checksumAdd(0, src.To4())
+	sum = checksumAdd(sum, dst.To4())
+	sum += uint32(protocol) + uint32(len(segment))
+	return checksumFold(checksumAdd(sum, segment))
+}
+
+func buildUDP(src net.IP, srcPort uint16, dst net.IP, dstPort uint16, data []byte) []byte {
+	s := make([]byte, udpHeaderSize+len(data))
+	binary.BigEndian.PutUint16(s[0:2], srcPort)
+	binary.BigEndian.PutUint16(s[2:4], dstPort)
+	binary.BigEndian.PutUint16(s[4:6], uint16(len(s)))
+	copy(s[udpHeaderSize:], data)
+	sum := transportChecksum(protocolUDP, src, dst, s)
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(s[6:8], sum)
+	return buildIPv4(protocolUDP, src, dst, s)
+}
+
+type tcpSegment struct {
+	srcPort uint16
+	dstPort uint16
+	seq     uint32
+	ack     uint32
+	flags   byte
+	window  uint16
+	mss     int // the MSS option of a SYN, or 0
+	data    []byte
+}
+
+func parseTCP(b []byte) (*tcpSegment, error) {
+	if len(b) < tcpHeaderSize {
+		return nil, errors.New("TCP segment too short")
+	}
+	offset := int(b[12]>>4) * 4
+	if offset < tcpHeaderSize || offset > len(b) {
+		return nil, errors.New("invalid TCP segment")
+	}
+	s := &tcpSegment{
+		srcPort: binary.BigEndian.Uint16(b[0:2]),
+		dstPort: binary.BigEndian.Uint16(b[2:4]),
+		seq:     binary.BigEndian.Uint32(b[4:8]),
+		ack:     binary.BigEndian.Uint32(b[8:12]),
+		flags:   b[13],
+		window:  binary.BigEndian.Uint16(b[14:16]),
+		data:    b[offset:],
+	}
+
+	// we only care about the MSS; the other options (window scale, SACK...) are not echoed, hence not used
+	for i := tcpHeaderSize; i < offset; {
+		if b[i] == 0 {
+			break
+		}
+		if b[i] == 1 {
+			i++
+			continue
+		}
+		if i+1 >= offset || b[i+1] < 2 || i+int(b[i+1]) > offset {
+			break
+		}
+		if b[i] == 2 && b[i+1] == 4 {
+			s.mss = int(binary.BigEndian.Uint16(b[i+2 : i+4]))
+		}
+		i += int(b[i+1])
+	}
+	return s, nil
+}
+
+func buildTCP(src net.IP, dst net.IP, s *tcpSegment) []byte {
+	headerSize := tcpHeaderSize
+	if s.mss > 0 {
+		headerSize += 4
+	}
+	b := make([]byte, headerSize+len(s.data))
+	binary.BigEndian.PutUint16(b[0:2], s.srcPort)
+	binary.BigEndian.PutUint16(b[2:4], s.dstPort)
+	binary.BigEndian.PutUint32(b[4:8], s.seq)
+	binary.BigEndian.PutUint32(b[8:12], s.ack)
+	b[12] = byte(headerSize/4) << 4
+	b[13] = s.flags
+	binary.BigEndian.PutUint16(b[14:16], s.window)
+	if s.mss > 0 {
+		b[20], b[21] = 2, 4
+		binary.BigEndian.PutUint16(b[22:24], uint16(s.mss))
+	}
+	copy(b[headerSize:], s.data)
+	binary.BigEndian.PutUint16(b[16:18], transportChecksum(protocolTCP, src, dst, b))
+	return buildIPv4(protocolTCP, src, dst, b)
+}
+
+// seqBefore compares sequence numbers, which wrap around
+func seqBefore(a uint32, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// a flow of the NAT: the client's address and port, and the destination's
+type natFlowKey struct {
+	clientIP   [4]byte
+	clientPort uint16
+	serverIP   [4]byte
+	serverPort uint16
+}
+
+func newNATFlowKey(p *ipv4Packet, srcPort uint16, dstPort uint16) natFlowKey {
+	k := natFlowKey{clientPort: srcPort, serverPort: dstPort}
+	copy(k.clientIP[:], p.src)
+	copy(k.serverIP[:], p.dst)
+	return k
+}
+
+func (k natFlowKey) client() net.IP {
+	return net.IP(k.clientIP[:])
+}
+
+func (k natFlowKey) server() net.IP {
+	return net.IP(k.serverIP[:])
+}
+
+func (k natFlowKey) serverAddress() string {
+	return net.JoinHostPort(k.server().String(), strconv.Itoa(int(k.serverPort)))
+}
+
+// packetNAT translates the IP packets of one client to connections of the relay
+type packetNAT struct {
+	lock     sync.Mutex
+	tcpFlows map[natFlowKey]*tcpFlow
+	udpFlows map[natFlowKey]*udpFlow
+	send     func([]byte)                                    // gives a packet to the client
+	dial     func(network, address string) (net.Conn, error) // reaches a destination
+	policy   *EgressPolicy
+	stop     chan bool
+}
+
+func newPacketNAT(send func([]byte), dial func(network, address string) (net.Conn, error), policy *EgressPolicy) *packetNAT {
+	n := &packetNAT{
+		tcpFlows: make(map[natFlowKey]*tcpFlow),
+		udpFlows: make(map[natFlowKey]*udpFlow),
+		send:     send,
+		dial:     dial,
+		policy:   policy,
+		stop:     make(chan bool),
+	}
+	go n.maintenance()
+	return n
+}
+
+// handle translates a packet of the client
+func (n *packetNAT) handle(packet []byte) {
+	p, err := parseIPv4(packet)
+	if err != nil {
+		log.Lvl3("NAT: dropping a packet,", err)
+		return
+	}
+	switch p.protocol {
+	case protocolTCP:
+		n.handleTCP(p)
+	case protocolUDP:
+		n.handleUDP(p)
+	default:
+		log.Lvl3("NAT: dropping a packet of protocol", p.protocol)
+	}
+}
+
+// allowed checks a new flow against the egress policy
+func (n *packetNAT) allowed(k natFlowKey) bool {
+	if err := n.policy.CheckDestination(k.server().String(), k.server(), int(k.serverPort)); err != nil {
+		logViolation(k.serverAddress(), err.Error())
+		return false
+	}
+	return true
+}
+
+func (n *packetNAT) handleUDP(p *ipv4Packet) {
+	if len(p.payload) < udpHeaderSize {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(p.payload[4:6]))
+	if length < udpHeaderSize || length > len(p.payload) {
+		return
+	}
+	k := newNATFlowKey(p, binary.BigEndian.Uint16(p.payload[0:2]), binary.BigEndian.Uint16(p.payload[2:4]))
+
+	n.lock.Lock()
+	f, found := n.udpFlows[k]
+	if !found || f.isClosed() {
+		if !n.allowed(k) {
+			n.lock.Unlock()
+			return
+		}
+		// dialing UDP does not wait for the network
+		conn, err := n.dial("udp", k.serverAddress())
+		if err != nil {
+			n.lock.Unlock()
+			log.Lvl3("NAT: cannot reach", k.serverAddress()+",", err)
+			return
+		}
+		f = &udpFlow{nat: n, key: k, conn: conn, lastActivity: time.Now()}
+		n.udpFlows[k] = f
+		go f.read()
+	}
+	n.lock.Unlock()
+
+	f.touch()
+	if _, err := f.conn.Write(p.payload[udpHeaderSize:length]); err != nil {
+		log.Lvl3("NAT: cannot send a datagram to", k.serverAddress()+",", err)
+	}
+}
+
+func (n *packetNAT) handleTCP(p *ipv4Packet) {
+	s, err := parseTCP(p.payload)
+	if err != nil {
+		return
+	}
+	k := newNATFlowKey(p, s.srcPort, s.dstPort)
+
+	n.lock.Lock()
+	f, found := n.tcpFlows[k]
+	isSYN := s.flags&(tcpFlagSYN|tcpFlagACK|tcpFlagRST) == tcpFlagSYN
+	if found && (!isSYN || !f.isClosed()) {
+		n.lock.Unlock()
+		f.handle(s)
+		return
+	}
+	if !isSYN {
+		n.lock.Unlock()
+		// not a connection we know
+		if s.flags&tcpFlagRST == 0 {
+			n.send(buildTCP(k.server(), k.client(), &tcpSegment{srcPort: k.serverPort, dstPort: k.clientPort,
+				seq: s.ack, flags: tcpFlagRST}))
+		}
+		return
+	}
+	if !n.allowed(k) {
+		n.lock.Unlock()
+		n.send(buildTCP(k.server(), k.client(), &tcpSegment{srcPort: k.serverPort, dstPort: k.clientPort,
+			ack: s.seq + 1, flags: tcpFlagRST | tcpFlagACK}))
+		return
+	}
+	f = newTCPFlow(n, k, s)
+	n.tcpFlows[k] = f
+	n.lock.Unlock()
+
+	go f.connect()
+}
+
+// maintenance retransmits the TCP segments and collects the finished flows
+func (n *packetNAT) maintenance() {
+	ticker := time.NewTicker(RETRANSMIT_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case now := <-ticker.C:
+			// the flows take their own lock, we must not hold ours meanwhile
+			n.lock.Lock()
+			tcpFlows := make([]*tcpFlow, 0, len(n.tcpFlows))
+			for _, f := range n.tcpFlows {
+				tcpFlows = append(tcpFlows, f)
+			}
+			udpFlows := make([]*udpFlow, 0, len(n.udpFlows))
+			for _, f := range n.udpFlows {
+				udpFlows = append(udpFlows, f)
+			}
+			n.lock.Unlock()
+
+			for _, f := range tcpFlows {
+				if f.tick(now) {
+					n.lock.Lock()
+					if n.tcpFlows[f.key] == f {
+						delete(n.tcpFlows, f.key)
+					}
+					n.lock.Unlock()
+				}
+			}
+			for _, f := range udpFlows {
+				if f.tick(now) {
+					n.lock.Lock()
+					if n.udpFlows[f.key] == f {
+						delete(n.udpFlows, f.key)
+					}
+					n.lock.Unlock()
+				}
+			}
+		}
+	}
+}
+
+// close ends all the flows, when the stream of the client is closed
+func (n *packetNAT) close() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	select {
+	case <-n.stop:
+		return
+	default:
+		close(n.stop)
+	}
+	for _, f := range n.tcpFlows {
+		f.lock.Lock()
+		f.reset()
+		f.lock.Unlock()
+	}
+	for _, f := range n.udpFlows {
+		f.conn.Close()
+	}
+	n.tcpFlows = make(map[natFlowKey]*tcpFlow)
+	n.udpFlows = make(map[natFlowKey]*udpFlow)
+}
+
+// udpFlow sends the datagrams of a client's port to a destination through a socket of the relay
+type udpFlow struct {
+	nat          *packetNAT
+	key          natFlowKey
+	conn         net.Conn
+	lock         sync.Mutex
+	lastActivity time.Time
+	closed       bool
+}
+
+func (f *udpFlow) touch() {
+	f.lock.Lock()
+	f.lastActivity = time.Now()
+	f.lock.Unlock()
+}
+
+func (f *udpFlow) isClosed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.closed
+}
+
+// read gives the answers of the destination to the client
+func (f *udpFlow) read() {
+	buffer := make([]byte, 65535)
+	for {
+		n, err := f.conn.Read(buffer)
+		if err != nil {
+			f.lock.Lock()
+			f.closed = true
+			f.lock.Unlock()
+			return
+		}
+		f.touch()
+		if ipv4HeaderSize+udpHeaderSize+n > TUN_MTU {
+			log.Lvl3("NAT: dropping a datagram too large for the tunnel")
+			continue
+		}
+		f.nat.send(buildUDP(f.key.server(), f.key.serverPort, f.key.client(), f.key.clientPort, buffer[:n]))
+	}
+}
+
+// tick returns true if the flow is finished
+func (f *udpFlow) tick(now time.Time) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed || now.Sub(f.lastActivity) > NAT_UDP_TIMEOUT {
+		f.closed = true
+		f.conn.Close()
+		return true
+	}
+	return false
+}
+
+type tcpState int
+
+const (
+	tcpConnecting  tcpState = iota // we dial the destination
+	tcpSynReceived                 // we answered the SYN of the client, and wait for its ACK
+	tcpEstablished
+	tcpClosed
+)
+
+// tcpFlow terminates a TCP connection of the client, and relays it to a connection of the relay to the destination
+type tcpFlow struct {
+	nat          *packetNAT
+	key          natFlowKey
+	lock         sync.Mutex
+	bufferFree   *sync.Cond // signaled when the client acknowledges data, or when the flow is closed
+	state        tcpState
+	conn         net.Conn
+	writes       chan []byte // the data of the client, for the destination
+	writesClosed bool
+	writerDone   bool   // all the data of the client went to the destination
+	rcvNxt       uint32 // the next sequence number of the client
+	clientFIN    bool
+	iss          uint32 // our initial sequence number
+	sndUna       uint32 // our first sequence number the client did not acknowledge
+	sndNxt       uint32 // our next sequence number to send
+	unacked      []byte // the data from sndUna, without SYN and FIN
+	serverEOF    bool   // the destination finished, we send a FIN after the data
+	finAcked     bool
+	mss          int
+	peerWindow   uint32
+	lastSent     time.Time
+	timeout      time.Duration
+	lastActivity time.Time
+}
+
+func newTCPFlow(n *packetNAT, k natFlowKey, syn *tcpSegment) *tcpFlow {
+	f := &tcpFlow{
+		nat:          n,
+		key:          k,
+		state:        tcpConnecting,
+		writes:       make(chan []byte, NAT_TCP_WRITE_QUEUE),
+		rcvNxt:       syn.seq + 1,
+		iss:          binary.BigEndian.Uint32(randomBytes(4)),
+		mss:          syn.mss,
+		peerWindow:   uint32(syn.window),
+		timeout:      RETRANSMIT_TIMEOUT,
+		lastActivity: time.Now(),
+	}
+	if f.mss == 0 {
+		f.mss = tcpDefaultMSS
+	}
+	if f.mss > TUN_MTU-ipv4HeaderSize-tcpHeaderSize {
+		f.mss = TUN_MTU - ipv4HeaderSize - tcpHeaderSize
+	}
+	f.sndUna = f.iss
+	f.sndNxt = f.iss + 1
+	f.bufferFree = sync.NewCond(&f.lock)
+	return f
+}
+
+func (f *tcpFlow) isClosed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.state == tcpClosed
+}
+
+// connect dials the destination, then answers the SYN of the client
+func (f *tcpFlow) connect() {
+	conn, err := f.nat.dial("tcp", f.key.serverAddress())
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err != nil {
+		log.Lvl3("NAT: cannot reach", f.key.serverAddress()+",", err)
+		f.sendSegment(0, tcpFlagRST|tcpFlagACK, nil)
+		f.close()
+		return
+	}
+	if f.state == tcpClosed {
+		// the client gave up meanwhile
+		conn.Close()
+		return
+	}
+	f.conn = conn
+	f.state = tcpSynReceived
+	f.sendSegment(f.iss, tcpFlagSYN|tcpFlagACK, nil)
+	go f.writeServer(conn)
+}
+
+// sendSegment sends a segment to the client, which acknowledges all we received. Must hold the lock
+func (f *tcpFlow) sendSegment(seq uint32, flags byte, data []byte) {
+	s := &tcpSegment{srcPort: f.key.serverPort, dstPort: f.key.clientPort, seq: seq, ack: f.rcvNxt, flags: flags,
+		window: tcpWindow, data: data}
+	if flags&tcpFlagSYN != 0 {
+		s.mss = TUN_MTU - ipv4HeaderSize - tcpHeaderSize
+	}
+	f.lastSent = time.Now()
+	f.nat.send(buildTCP(f.key.server(), f.key.client(), s))
+}
+
+// handle processes a segment of the client
+func (f *tcpFlow) handle(s *tcpSegment) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.lastActivity = time.Now()
+	if s.flags&tcpFlagRST != 0 {
+		f.close()
+		return
+	}
+	if f.state == tcpConnecting || f.state == tcpClosed {
+		return
+	}
+	if s.flags&tcpFlagSYN != 0 {
+		// our SYN-ACK was lost
+		if f.state == tcpSynReceived {
+			f.sendSegment(f.iss, tcpFlagSYN|tcpFlagACK, nil)
+		}
+		return
+	}
+	if s.flags&tcpFlagACK == 0 {
+		return
+	}
+	if f.state == tcpSynReceived {
+		if s.ack != f.iss+1 {
+			return
+		}
+		f.state = tcpEstablished
+		f.sndUna = f.iss + 1
+		f.timeout = RETRANSMIT_TIMEOUT
+		go f.readServer()
+	}
+
+	// no window scaling was negotiated
+	f.peerWindow = uint32(s.window)
+	f.acknowledge(s.ack)
+
+	if len(s.data) > 0 || s.flags&tcpFlagFIN != 0 {
+		if s.seq != f.rcvNxt || f.clientFIN {
+			// a retransmission, or a segment after a lost one: we tell the client what we expect
+			f.sendSegment(f.sndNxt, tcpFlagACK, nil)
+			return
+		}
+		if len(s.data) > 0 {
+			data := make([]byte, len(s.data))
+			copy(data, s.data)
+			select {
+			case f.writes <- data:
+				f.rcvNxt += uint32(len(data))
+			default:
+				// the destination is slow, the client will send it again
+				f.sendSegment(f.sndNxt, tcpFlagACK, nil)
+				return
+			}
+		}
+		if s.flags&tcpFlagFIN != 0 {
+			f.clientFIN = true
+			f.rcvNxt++
+			f.writesClosed = true
+			close(f.writes)
+		}
+		f.sendSegment(f.sndNxt, tcpFlagACK, nil)
+	}
+	f.transmit()
+}
+
+// acknowledge frees the data the client acknowledged. Must hold the lock
+func (f *tcpFlow) acknowledge(ack uint32) {
+	if !seqBefore(f.sndUna, ack) || seqBefore(f.sndNxt, ack) {
+		return
+	}
+	acked := int(ack - f.sndUna)
+	if acked > len(f.unacked) {
+		// our FIN is acknowledged too
+		f.finAcked = true
+		acked = len(f.unacked)
+	}
+	f.unacked = f.unacked[acked:]
+	f.sndUna = ack
+	f.timeout = RETRANSMIT_TIMEOUT
+	f.lastSent = time.Now()
+	f.bufferFree.Broadcast()
+}
+
+// transmit sends the data (then the FIN) the window of the client allows, from sndNxt. Must hold the lock
+func (f *tcpFlow) transmit() {
+	for f.state == tcpEstablished {
+		sent := int(f.sndNxt - f.sndUna)
+		if sent < len(f.unacked) {
+			size := len(f.unacked) - sent
+			if size > f.mss {
+				size = f.mss
+			}
+			if sent+size > int(f.peerWindow) {
+				size = int(f.peerWindow) - sent
+			}
+			if size <= 0 {
+				return
+			}
+			f.sendSegment(f.sndNxt, tcpFlagACK|tcpFlagPSH, f.unacked[sent:sent+size])
+			f.sndNxt += uint32(size)
+			continue
+		}
+		if sent == len(f.unacked) && f.serverEOF && !f.finAcked {
+			f.sendSegment(f.sndNxt, tcpFlagACK|tcpFlagFIN, nil)
+			f.sndNxt++
+		}
+		return
+	}
+}
+
+// readServer sends the data of the destination to the client
+func (f *tcpFlow) readServer() {
+	buffer := make([]byte, NAT_TCP_SEND_BUFFER/4)
+	for {
+		n, err := f.conn.Read(buffer)
+
+		f.lock.Lock()
+		for n > 0 && len(f.unacked)+n > NAT_TCP_SEND_BUFFER && f.state == tcpEstablished {
+			f.bufferFree.Wait()
+		}
+		if f.state != tcpEstablished {
+			f.lock.Unlock()
+			return
+		}
+		f.unacked = append(f.unacked, buffer[:n]...)
+		if err == io.EOF {
+			f.serverEOF = true
+			if f.writerDone {
+				f.conn.Close()
+			}
+		} else if err != nil {
+			f.reset()
+		}
+		f.transmit()
+		f.lock.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeServer gives the data of the client to the destination, then half-closes the connection after the client's
+// FIN
+func (f *tcpFlow) writeServer(conn net.Conn) {
+	for data := range f.writes {
+		if _, err := conn.Write(data); err != nil {
+			f.lock.Lock()
+			f.reset()
+			f.lock.Unlock()
+			return
+		}
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+
+	f.lock.Lock()
+	f.writerDone = true
+	if f.serverEOF {
+		conn.Close()
+	}
+	f.lock.Unlock()
+}
+
+// tick retransmits what the client did not acknowledge in time; returns true if the flow is finished
+func (f *tcpFlow) tick(now time.Time) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch {
+	case f.state == tcpClosed:
+		return true
+	case now.Sub(f.lastActivity) > NAT_TCP_TIMEOUT:
+		f.reset()
+		return true
+	case f.clientFIN && f.finAcked:
+		// both sides finished; the connection is closed once its writer is done
+		f.state = tcpClosed
+		f.bufferFree.Broadcast()
+		return true
+	case now.Sub(f.lastSent) <= f.timeout:
+		return false
+	case f.state == tcpSynReceived:
+		f.sendSegment(f.iss, tcpFlagSYN|tcpFlagACK, nil)
+	case f.state == tcpEstablished && f.sndNxt != f.sndUna:
+		f.sndNxt = f.sndUna
+		f.transmit()
+	default:
+		return false
+	}
+	f.timeout *= 2
+	if f.timeout > MAX_RETRANSMIT_TIMEOUT {
+		f.timeout = MAX_RETRANSMIT_TIMEOUT
+	}
+	return false
+}
+
+// reset aborts the connection with the client and the destination. Must hold the lock
+func (f *tcpFlow) reset() {
+	if f.state == tcpSynReceived || f.state == tcpEstablished {
+		f.sendSegment(f.sndNxt, tcpFlagRST|tcpFlagACK, nil)
+	}
+	f.close()
+}
+
+// close releases the flow. Must hold the lock
+func (f *tcpFlow) close() {
+	f.state = tcpClosed
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	if !f.writesClosed {
+		f.writesClosed = true
+		close(f.writes)
+	}
+	f.bufferFree.Broadcast()
+}
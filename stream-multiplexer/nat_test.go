@@ -0,0 +1,209 @@
+package stream_multiplexer
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+var natClient = net.IPv4(10, 8, 0, 2).To4()
+
+func startUDPEchoServer(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3003})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buffer := make([]byte, 2000)
+		for {
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buffer[:n], from)
+		}
+	}()
+	return conn
+}
+
+// startNAT returns a NAT, and the channel of the packets it sends to the client
+func startNAT(policy *EgressPolicy) (*packetNAT, chan []byte) {
+	packets := make(chan []byte, 100)
+	dial := func(network, address string) (net.Conn, error) {
+		return net.DialTimeout(network, address, DIAL_TIMEOUT)
+	}
+	return newPacketNAT(func(p []byte) { packets <- p }, dial, policy), packets
+}
+
+// receiveTCP waits for the next segment of the NAT, and checks its checksums
+func receiveTCP(t *testing.T, packets chan []byte) *tcpSegment {
+	select {
+	case packet := <-packets:
+		if checksumFold(checksumAdd(0, packet[:ipv4HeaderSize])) != 0 {
+			t.Error("Wrong IPv4 checksum")
+		}
+		p, err := parseIPv4(packet)
+		if err != nil || p.protocol != protocolTCP || !p.dst.Equal(natClient) {
+			t.Fatal("Wrong packet", packet, err)
+		}
+		if transportChecksum(protocolTCP, p.src, p.dst, p.payload) != 0 {
+			t.Error("Wrong TCP checksum")
+		}
+		s, err := parseTCP(p.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("No segment from the NAT")
+	}
+	return nil
+}
+
+func sendTCP(n *packetNAT, port uint16, s *tcpSegment) {
+	s.srcPort = 40000
+	s.dstPort = port
+	if s.window == 0 {
+		s.window = 65535
+	}
+	n.handle(buildTCP(natClient, net.IPv4(127, 0, 0, 1), s))
+}
+
+func TestIPv4Packets(t *testing.T) {
+
+	packet := buildUDP(natClient, 40000, net.IPv4(192, 0, 2, 1), 53, []byte("query"))
+	p, err := parseIPv4(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.protocol != protocolUDP || !p.src.Equal(natClient) || !p.dst.Equal(net.IPv4(192, 0, 2, 1)) || string(p.payload[udpHeaderSize:]) != "query" {
+		t.Error("Wrong packet", p)
+	}
+	if checksumFold(checksumAdd(0, packet[:ipv4HeaderSize])) != 0 || transportChecksum(protocolUDP, p.src, p.dst, p.payload) != 0 {
+		t.Error("Wrong checksums")
+	}
+
+	// fragments and IPv6 are not translated
+	packet[6] |= 0x20
+	if _, err := parseIPv4(packet); err == nil {
+		t.Error("A fragment should be refused")
+	}
+	if _, err := parseIPv4(append([]byte{0x60}, make([]byte, 39)...)); err == nil {
+		t.Error("IPv6 should be refused")
+	}
+
+	packet = buildTCP(natClient, net.IPv4(192, 0, 2, 1), &tcpSegment{srcPort: 1, dstPort: 2, seq: 3, ack: 4,
+		flags: tcpFlagSYN | tcpFlagACK, window: 5, mss: 1360, data: []byte("data")})
+	p, _ = parseIPv4(packet)
+	s, err := parseTCP(p.payload)
+	if err != nil || s.srcPort != 1 || s.dstPort != 2 || s.seq != 3 || s.ack != 4 || s.flags != tcpFlagSYN|tcpFlagACK ||
+		s.window != 5 || s.mss != 1360 || string(s.data) != "data" {
+		t.Error("Wrong segment", s, err)
+	}
+
+	if !seqBefore(0xffffffff, 1) || seqBefore(1, 0xffffffff) {
+		t.Error("The sequence numbers should wrap around")
+	}
+}
+
+// Tests a whole TCP connection through the NAT, with a lost segment
+func TestNATTCP(t *testing.T) {
+
+	l := startEchoServer(t)
+	defer l.Close()
+	n, packets := startNAT(nil)
+	defer n.close()
+
+	sendTCP(n, 3001, &tcpSegment{seq: 1000, flags: tcpFlagSYN, mss: 1000})
+	synAck := receiveTCP(t, packets)
+	if synAck.flags != tcpFlagSYN|tcpFlagACK || synAck.ack != 1001 || synAck.mss != TUN_MTU-ipv4HeaderSize-tcpHeaderSize {
+		t.Fatal("Wrong SYN-ACK", synAck)
+	}
+	seq := synAck.seq + 1
+
+	// the client sends its request and closes, the echo server answers and closes
+	sendTCP(n, 3001, &tcpSegment{seq: 1001, ack: seq, flags: tcpFlagACK | tcpFlagPSH, data: []byte("hello")})
+	if s := receiveTCP(t, packets); s.ack != 1006 {
+		t.Error("The data should be acknowledged", s)
+	}
+	sendTCP(n, 3001, &tcpSegment{seq: 1006, ack: seq, flags: tcpFlagACK | tcpFlagFIN})
+	if s := receiveTCP(t, packets); s.ack != 1007 {
+		t.Error("The FIN should be acknowledged", s)
+	}
+
+	// the answer: we pretend to lose it, and get it again
+	answer := receiveTCP(t, packets)
+	if answer.seq != seq || string(answer.data) != "hello" {
+		t.Fatal("Wrong answer", answer)
+	}
+	fin := receiveTCP(t, packets)
+	if fin.flags&tcpFlagFIN == 0 {
+		t.Fatal("The NAT should close", fin)
+	}
+	start := time.Now()
+	answer = receiveTCP(t, packets)
+	if answer.seq != seq || string(answer.data) != "hello" || time.Since(start) < RETRANSMIT_TIMEOUT/2 {
+		t.Fatal("The answer should be retransmitted after a timeout", answer)
+	}
+	receiveTCP(t, packets)
+
+	sendTCP(n, 3001, &tcpSegment{seq: 1007, ack: fin.seq + 1, flags: tcpFlagACK})
+	time.Sleep(3 * RETRANSMIT_CHECK_INTERVAL)
+	n.lock.Lock()
+	flows := len(n.tcpFlows)
+	n.lock.Unlock()
+	if flows != 0 {
+		t.Error("The flow should be finished")
+	}
+
+	// a segment of an unknown connection is reset
+	sendTCP(n, 3001, &tcpSegment{seq: 1007, ack: 1234, flags: tcpFlagACK})
+	if s := receiveTCP(t, packets); s.flags&tcpFlagRST == 0 || s.seq != 1234 {
+		t.Error("The segment should be reset", s)
+	}
+
+	// so is a connection to a closed port
+	sendTCP(n, 3002, &tcpSegment{seq: 5000, flags: tcpFlagSYN})
+	if s := receiveTCP(t, packets); s.flags&tcpFlagRST == 0 || s.ack != 5001 {
+		t.Error("The connection should be refused", s)
+	}
+}
+
+func TestNATUDP(t *testing.T) {
+
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+	policy := &EgressPolicy{DeniedPorts: []string{"3001"}}
+	policy.Compile()
+	n, packets := startNAT(policy)
+	defer n.close()
+
+	n.handle(buildUDP(natClient, 40000, net.IPv4(127, 0, 0, 1), 3003, []byte("datagram")))
+	select {
+	case packet := <-packets:
+		p, err := parseIPv4(packet)
+		if err != nil || p.protocol != protocolUDP || !p.src.Equal(net.IPv4(127, 0, 0, 1)) || !p.dst.Equal(natClient) {
+			t.Fatal("Wrong answer", packet, err)
+		}
+		if binary.BigEndian.Uint16(p.payload[0:2]) != 3003 || binary.BigEndian.Uint16(p.payload[2:4]) != 40000 ||
+			string(p.payload[udpHeaderSize:]) != "datagram" || transportChecksum(protocolUDP, p.src, p.dst, p.payload) != 0 {
+			t.Error("Wrong datagram", p.payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No answer")
+	}
+
+	// the policy applies to each flow
+	n.handle(buildUDP(natClient, 40000, net.IPv4(127, 0, 0, 1), 3001, []byte("denied")))
+	sendTCP(n, 3001, &tcpSegment{seq: 1, flags: tcpFlagSYN})
+	if s := receiveTCP(t, packets); s.flags&tcpFlagRST == 0 {
+		t.Error("The connection should be refused", s)
+	}
+	n.lock.Lock()
+	flows := len(n.udpFlows) + len(n.tcpFlows)
+	n.lock.Unlock()
+	if flows != 1 {
+		t.Error("The denied flows should not exist", flows)
+	}
+}
@@ -0,0 +1,259 @@
+package stream_multiplexer
+
+/*
+Egress policy
+*************
+The relay operator decides where the anonymous traffic can go, with an EgressPolicy read from a TOML file:
+
+	AllowedNetworks = ["0.0.0.0/0"]         # CIDRs; if this or AllowedDomains is set, a destination must match one
+	DeniedNetworks  = ["10.0.0.0/8", "127.0.0.0/8"]
+	AllowedDomains  = []                    # "example.com" also matches its subdomains
+	DeniedDomains   = ["example.com"]
+	AllowedPorts    = ["80", "443", "8000-8100"] # if set, the port must be one of them
+	DeniedPorts     = ["25"]
+	StreamBandwidth = 100000                # bytes per second each stream can receive, 0 for no limit
+	TotalBandwidth  = 1000000               # bytes per second all streams can receive together, 0 for no limit
+	MaxStreams      = 1000                  # streams open at once, 0 for no limit
+
+The denied lists win over the allowed ones. A domain name is resolved by the egress if there are network rules, and
+the egress then dials the address it checked. A stream that violates the policy, or that would exceed MaxStreams, is
+reset; the violation is logged with the destination only, since the egress does not know which client opened the
+stream anyway. The bandwidth caps are not violations: the egress reads the servers' answers more slowly.
+
+The destination is known only when the client terminates SOCKS5 (see socks5.go); otherwise only the caps apply at the
+egress, and the SOCKS server behind it should enforce the same policy (see socks/prifi-socks-server.go).
+*/
+
+import (
+	"errors"
+	"github.com/BurntSushi/toml"
+	"go.dedis.ch/onet/v3/log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EgressPolicy restricts the destinations and the bandwidth of the streams
+type EgressPolicy struct {
+	AllowedNetworks []string
+	DeniedNetworks  []string
+	AllowedDomains  []string
+	DeniedDomains   []string
+	AllowedPorts    []string
+	DeniedPorts     []string
+	StreamBandwidth int
+	TotalBandwidth  int
+	MaxStreams      int
+
+	allowedNetworks []*net.IPNet
+	deniedNetworks  []*net.IPNet
+	allowedPorts    []portRange
+	deniedPorts     []portRange
+}
+
+type portRange struct {
+	low  int
+	high int
+}
+
+// LoadEgressPolicy reads a policy from a TOML file
+func LoadEgressPolicy(file string) (*EgressPolicy, error) {
+	p := new(EgressPolicy)
+	if _, err := toml.DecodeFile(file, p); err != nil {
+		return nil, err
+	}
+	if err := p.Compile(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Compile parses the networks and the ports of the policy; it must be called before the policy is used
+func (p *EgressPolicy) Compile() error {
+	var err error
+	if p.allowedNetworks, err = parseNetworks(p.AllowedNetworks); err != nil {
+		return err
+	}
+	if p.deniedNetworks, err = parseNetworks(p.DeniedNetworks); err != nil {
+		return err
+	}
+	if p.allowedPorts, err = parsePorts(p.AllowedPorts); err != nil {
+		return err
+	}
+	if p.deniedPorts, err = parsePorts(p.DeniedPorts); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	parsed := make([]*net.IPNet, 0, len(networks))
+	for _, n := range networks {
+		_, ipNet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, errors.New("egress policy: invalid network " + n)
+		}
+		parsed = append(parsed, ipNet)
+	}
+	return parsed, nil
+}
+
+func parsePorts(ports []string) ([]portRange, error) {
+	parsed := make([]portRange, 0, len(ports))
+	for _, p := range ports {
+		bounds := strings.SplitN(p, "-", 2)
+		low, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		high := low
+		if err == nil && len(bounds) == 2 {
+			high, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		}
+		if err != nil || low < 0 || high > 65535 || low > high {
+			return nil, errors.New("egress policy: invalid port " + p)
+		}
+		parsed = append(parsed, portRange{low: low, high: high})
+	}
+	return parsed, nil
+}
+
+// CheckDestination returns an error if the policy forbids the destination; ip is the address of the host, or nil if
+// it is not resolved yet
+func (p *EgressPolicy) CheckDestination(host string, ip net.IP, port int) error {
+	if p == nil {
+		return nil
+	}
+
+	if inPorts(p.deniedPorts, port) {
+		return errors.New("port " + strconv.Itoa(port) + " is denied")
+	}
+	if len(p.allowedPorts) > 0 && !inPorts(p.allowedPorts, port) {
+		return errors.New("port " + strconv.Itoa(port) + " is not allowed")
+	}
+
+	isDomain := net.ParseIP(host) == nil
+	if isDomain && inDomains(p.DeniedDomains, host) {
+		return errors.New("domain " + host + " is denied")
+	}
+	if ip != nil && inNetworks(p.deniedNetworks, ip) {
+		return errors.New("address " + ip.String() + " is denied")
+	}
+
+	if len(p.AllowedDomains) == 0 && len(p.allowedNetworks) == 0 {
+		return nil
+	}
+	if isDomain && inDomains(p.AllowedDomains, host) {
+		return nil
+	}
+	if ip != nil && inNetworks(p.allowedNetworks, ip) {
+		return nil
+	}
+	return errors.New(host + " is not allowed")
+}
+
+// check returns an error if the policy forbids the destination ("host:port"), and otherwise the address to dial. A
+// domain name is resolved here if the policy has network rules, so that we dial the address we checked
+func (p *EgressPolicy) check(address string) (string, error) {
+	if p == nil {
+		return address, nil
+	}
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return "", err
+	}
+
+	ip := net.ParseIP(host)
+	if ip != nil || len(p.allowedNetworks)+len(p.deniedNetworks) == 0 {
+		return address, p.CheckDestination(host, ip, port)
+	}
+
+	// a denied domain is refused before we resolve it
+	if inDomains(p.DeniedDomains, host) {
+		return "", errors.New("domain " + host + " is denied")
+	}
+	ipAddr, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return "", errors.New("cannot resolve " + host + ", " + err.Error())
+	}
+	if err := p.CheckDestination(host, ipAddr.IP, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ipAddr.IP.String(), portString), nil
+}
+
+func inPorts(ranges []portRange, port int) bool {
+	for _, r := range ranges {
+		if port >= r.low && port <= r.high {
+			return true
+		}
+	}
+	return false
+}
+
+func inNetworks(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// inDomains tells if host is one of the domains, or one of their subdomains
+func inDomains(domains []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// logViolation reports a stream that the policy refused, without anything that could identify its client
+func logViolation(destination string, reason string) {
+	log.Lvl1("Egress policy: refused a stream to", destination+",", reason)
+}
+
+// rateLimiter is a token bucket of bytes, which allows bursts of one second
+type rateLimiter struct {
+	lock   sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a limiter of rate bytes per second, or nil (no limit) if rate is 0
+func newRateLimiter(rate int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait blocks until n bytes can go
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	missing := -l.tokens
+	l.lock.Unlock()
+
+	// we took the bytes already, the next callers wait after us
+	if missing > 0 {
+		time.Sleep(time.Duration(missing / l.rate * float64(time.Second)))
+	}
+}
@@ -0,0 +1,176 @@
+package stream_multiplexer
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEgressPolicyDestinations(t *testing.T) {
+
+	policies := []*EgressPolicy{{
+		AllowedNetworks: []string{"192.0.2.0/24", "2001:db8::/32"},
+		DeniedNetworks:  []string{"192.0.2.128/25"},
+		AllowedPorts:    []string{"80", "443", "8000-8100"},
+		DeniedPorts:     []string{"8080"},
+	}, {
+		// without network rules, the domains are not resolved
+		AllowedDomains: []string{"example.com"},
+		DeniedDomains:  []string{"secret.example.com"},
+	}}
+	allowed := [][]string{
+		{"192.0.2.1:80", "[2001:db8::1]:443", "192.0.2.1:8000"},
+		{"example.com:80", "www.Example.com.:8100"},
+	}
+	denied := [][]string{{
+		"192.0.2.200:80",  // denied network
+		"198.51.100.1:80", // not in the allowed networks
+		"192.0.2.1:22",    // not an allowed port
+		"192.0.2.1:8080",  // denied port
+	}, {
+		"secret.example.com:80",   // denied domain
+		"a.secret.example.com:80", // denied subdomain
+		"example.org:80",          // not an allowed domain
+		"notexample.com:80",       // not a subdomain
+		"192.0.2.1:80",            // not an allowed domain
+	}}
+
+	for i, p := range policies {
+		if err := p.Compile(); err != nil {
+			t.Fatal(err)
+		}
+		for _, address := range allowed[i] {
+			if _, err := p.check(address); err != nil {
+				t.Error(address, "should be allowed,", err)
+			}
+		}
+		for _, address := range denied[i] {
+			if _, err := p.check(address); err == nil {
+				t.Error(address, "should be denied")
+			}
+		}
+	}
+
+	// no policy, no restriction
+	var none *EgressPolicy
+	if _, err := none.check("192.0.2.200:25"); err != nil {
+		t.Error("Without policy, everything is allowed")
+	}
+
+	// a domain is resolved when there are network rules, and we dial the address we checked
+	p := &EgressPolicy{DeniedNetworks: []string{"10.0.0.0/8"}}
+	p.Compile()
+	address, err := p.check("127.0.0.1:80")
+	if err != nil || address != "127.0.0.1:80" {
+		t.Error("Wrong address", address, err)
+	}
+	p = &EgressPolicy{DeniedNetworks: []string{"127.0.0.0/8"}}
+	p.Compile()
+	if _, err := p.check("localhost:80"); err == nil {
+		t.Error("localhost should be resolved, and denied")
+	}
+}
+
+func TestLoadEgressPolicy(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "policy.toml")
+	ioutil.WriteFile(file, []byte(`
+DeniedNetworks = ["10.0.0.0/8"]
+AllowedPorts = ["80", "1000-2000"]
+StreamBandwidth = 1000
+MaxStreams = 10
+`), 0600)
+	p, err := LoadEgressPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.StreamBandwidth != 1000 || p.MaxStreams != 10 || len(p.deniedNetworks) != 1 || len(p.allowedPorts) != 2 {
+		t.Error("Wrong policy", p)
+	}
+	if p.CheckDestination("10.1.2.3", net.ParseIP("10.1.2.3"), 80) == nil {
+		t.Error("The network should be denied")
+	}
+	if p.CheckDestination("192.0.2.1", net.ParseIP("192.0.2.1"), 1500) != nil {
+		t.Error("The port should be allowed")
+	}
+
+	for _, invalid := range []string{`DeniedNetworks = ["10.0.0.0/33"]`, `AllowedPorts = ["2000-1000"]`, `DeniedPorts = ["http"]`} {
+		ioutil.WriteFile(file, []byte(invalid), 0600)
+		if _, err := LoadEgressPolicy(file); err == nil {
+			t.Error("Should not load", invalid)
+		}
+	}
+
+	// the example of the repository is valid
+	if _, err := LoadEgressPolicy("../config/egress-policy.toml"); err != nil {
+		t.Error("Could not load the example policy,", err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+
+	var none *rateLimiter
+	none.wait(1000000)
+
+	// a burst of one second goes right away, the rest at the given rate
+	l := newRateLimiter(100000)
+	start := time.Now()
+	for i := 0; i < 15; i++ {
+		l.wait(10000)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Error("150000 bytes at 100000 bytes/s took", elapsed)
+	}
+}
+
+// Tests that the egress resets the streams that violate the policy
+func TestEgressPolicyEnforced(t *testing.T) {
+
+	l := startEchoServer(t)
+	defer l.Close()
+
+	policy := &EgressPolicy{DeniedPorts: []string{"3002"}, MaxStreams: 1}
+	if err := policy.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	stopIngress, stopEgress := startSOCKSIngressAndEgress(t, EgressOptions{Policy: policy})
+
+	// a denied port
+	conn, _, _ := socksRequest(t, socksCmdConnect, encodeSOCKSAddress(net.IPv4(127, 0, 0, 1), 3002))
+	if n, err := conn.Read(make([]byte, 10)); n != 0 || err == nil {
+		t.Error("The stream to a denied port should be reset")
+	}
+	conn.Close()
+
+	// one stream is fine, but not two at once
+	first, _, _ := socksRequest(t, socksCmdConnect, encodeSOCKSAddress(net.IPv4(127, 0, 0, 1), 3001))
+	first.Write([]byte("first"))
+	time.Sleep(time.Second)
+	second, _, _ := socksRequest(t, socksCmdConnect, encodeSOCKSAddress(net.IPv4(127, 0, 0, 1), 3001))
+	second.Write([]byte("second"))
+	if n, err := second.Read(make([]byte, 10)); n != 0 || err == nil {
+		t.Error("The second stream should be reset")
+	}
+	second.Close()
+
+	first.(*net.TCPConn).CloseWrite()
+	answer, err := ioutil.ReadAll(first)
+	if err != nil || string(answer) != "first" {
+		t.Error("The first stream should go through,", string(answer), err)
+	}
+	first.Close()
+
+	stopIngress <- true
+	stopEgress <- true
+	time.Sleep(2 * time.Second)
+}
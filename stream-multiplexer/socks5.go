@@ -0,0 +1,296 @@
+package stream_multiplexer
+
+/*
+SOCKS5
+******
+The client can terminate SOCKS5 (RFC 1928) itself: the handshake with the browser stays local, and the first frame of
+the stream, OPEN, carries the destination. Without it, the handshake travels through the DC-net to a SOCKS server
+behind the relay, which costs several anonymous round-trips per connection.
+
+The OPEN frame holds [OPEN_NONCE_SIZE nonce] [1 network] [address], where the address is encoded as in SOCKS5:
+[1 type] [IPv4, IPv6, or 1 length + domain name] [2 port]. An OPEN frame without a destination goes to the egress'
+serverAddress, as before. The egress dials the destination itself, or through an upstream SOCKS5 proxy; the UDP
+streams are always dialed directly.
+
+We answer a CONNECT right away, before the egress reached the destination; if it cannot, the stream is reset and the
+browser sees the connection close. For a UDP ASSOCIATE, each destination of the datagrams gets a stream, whose messages
+are the datagrams (see udp.go).
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"go.dedis.ch/onet/v3/log"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS_HANDSHAKE_TIMEOUT bounds the SOCKS5 handshake of a new connection
+const SOCKS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// DIAL_TIMEOUT bounds the time the egress takes to reach a destination
+const DIAL_TIMEOUT = 10 * time.Second
+
+// The network of the destination of an OPEN frame
+const (
+	TARGET_TCP = 1
+	TARGET_UDP = 2
+	TARGET_DNS = 3 // the resolver of the egress, without address, see dns.go
+	TARGET_IP  = 4 // the NAT of the egress, without address, see nat.go
+)
+
+const socksVersion = 5
+
+const (
+	socksMethodNoAuth       = 0
+	socksMethodNoAcceptable = 0xff
+)
+
+const (
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+)
+
+const (
+	socksAddrIPv4   = 1
+	socksAddrDomain = 3
+	socksAddrIPv6   = 4
+)
+
+const (
+	socksReplySucceeded           = 0
+	socksReplyGeneralFailure      = 1
+	socksReplyCommandNotSupported = 7
+	socksReplyAddressNotSupported = 8
+)
+
+// readSOCKSAddress reads an address encoded as in SOCKS5, and returns it still encoded
+func readSOCKSAddress(r io.Reader) ([]byte, error) {
+	addrType := make([]byte, 1)
+	if _, err := io.ReadFull(r, addrType); err != nil {
+		return nil, err
+	}
+
+	var length int
+	switch addrType[0] {
+	case socksAddrIPv4:
+		length = net.IPv4len
+	case socksAddrIPv6:
+		length = net.IPv6len
+	case socksAddrDomain:
+		domainLength := make([]byte, 1)
+		if _, err := io.ReadFull(r, domainLength); err != nil {
+			return nil, err
+		}
+		addrType = append(addrType, domainLength[0])
+		length = int(domainLength[0])
+	default:
+		return nil, errors.New("unknown address type " + strconv.Itoa(int(addrType[0])))
+	}
+
+	rest := make([]byte, length+2)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	return append(addrType, rest...), nil
+}
+
+// parseSOCKSAddress decodes an address encoded as in SOCKS5 into "host:port", and returns the length of its encoding
+func parseSOCKSAddress(b []byte) (string, int, error) {
+	if len(b) < 1 {
+		return "", 0, errors.New("empty address")
+	}
+
+	var host string
+	var length int
+	switch b[0] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ipLength := net.IPv4len
+		if b[0] == socksAddrIPv6 {
+			ipLength = net.IPv6len
+		}
+		length = 1 + ipLength + 2
+		if len(b) < length {
+			return "", 0, errors.New("address too short")
+		}
+		host = net.IP(b[1 : 1+ipLength]).String()
+	case socksAddrDomain:
+		if len(b) < 2 {
+			return "", 0, errors.New("address too short")
+		}
+		length = 2 + int(b[1]) + 2
+		if len(b) < length {
+			return "", 0, errors.New("address too short")
+		}
+		host = string(b[2 : 2+int(b[1])])
+	default:
+		return "", 0, errors.New("unknown address type " + strconv.Itoa(int(b[0])))
+	}
+
+	port := binary.BigEndian.Uint16(b[length-2 : length])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), length, nil
+}
+
+// encodeSOCKSAddress encodes an IP address and a port as in SOCKS5
+func encodeSOCKSAddress(ip net.IP, port int) []byte {
+	var b []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{socksAddrIPv4}, ip4...)
+	} else {
+		b = append([]byte{socksAddrIPv6}, ip.To16()...)
+	}
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(port))
+	return append(b, portBytes...)
+}
+
+// socksHandshake negotiates with a SOCKS5 client, and returns its command and the destination, encoded. The
+// unsupported commands are answered here
+func socksHandshake(conn net.Conn) (byte, []byte, error) {
+	// greeting: [version] [number of methods] [methods]
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, nil, err
+	}
+	if header[0] != socksVersion {
+		return 0, nil, errors.New("not SOCKS5, version " + strconv.Itoa(int(header[0])))
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return 0, nil, err
+	}
+	noAuth := false
+	for _, m := range methods {
+		noAuth = noAuth || m == socksMethodNoAuth
+	}
+	if !noAuth {
+		conn.Write([]byte{socksVersion, socksMethodNoAcceptable})
+		return 0, nil, errors.New("the client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksMethodNoAuth}); err != nil {
+		return 0, nil, err
+	}
+
+	// request: [version] [command] [reserved] [address]
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return 0, nil, err
+	}
+	target, err := readSOCKSAddress(conn)
+	if err != nil {
+		writeSOCKSReply(conn, socksReplyAddressNotSupported, nil)
+		return 0, nil, err
+	}
+	if request[1] != socksCmdConnect && request[1] != socksCmdUDPAssociate {
+		writeSOCKSReply(conn, socksReplyCommandNotSupported, nil)
+		return 0, nil, errors.New("unsupported command " + strconv.Itoa(int(request[1])))
+	}
+	return request[1], target, nil
+}
+
+// writeSOCKSReply answers a SOCKS5 request; bound is the encoded address the client should use, or nil
+func writeSOCKSReply(conn net.Conn, reply byte, bound []byte) error {
+	if bound == nil {
+		bound = encodeSOCKSAddress(net.IPv4zero, 0)
+	}
+	_, err := conn.Write(append([]byte{socksVersion, reply, 0}, bound...))
+	return err
+}
+
+// dialThroughSOCKS5 connects to the encoded destination through the SOCKS5 proxy
+func dialThroughSOCKS5(proxy string, target []byte) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxy, DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(DIAL_TIMEOUT))
+
+	fail := func(err error) (net.Conn, error) {
+		conn.Close()
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte{socksVersion, 1, socksMethodNoAuth}); err != nil {
+		return fail(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		return fail(err)
+	}
+	if method[0] != socksVersion || method[1] != socksMethodNoAuth {
+		return fail(errors.New("the proxy refused our authentication method"))
+	}
+
+	if _, err := conn.Write(append([]byte{socksVersion, socksCmdConnect, 0}, target...)); err != nil {
+		return fail(err)
+	}
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fail(err)
+	}
+	if _, err := readSOCKSAddress(conn); err != nil {
+		return fail(err)
+	}
+	if reply[1] != socksReplySucceeded {
+		return fail(errors.New("the proxy answered " + strconv.Itoa(int(reply[1]))))
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// openTarget returns the network and the destination ("host:port") of an OPEN frame; ok is false if it has none. The
+// networks "dns" and "ip" have no destination
+func (f *Frame) openTarget() (network string, address string, encoded []byte, ok bool) {
+	if f.Type != FRAME_OPEN || len(f.Data) <= OPEN_NONCE_SIZE {
+		return "", "", nil, false
+	}
+	switch f.Data[OPEN_NONCE_SIZE] {
+	case TARGET_DNS:
+		return "dns", "", nil, true
+	case TARGET_IP:
+		return "ip", "", nil, true
+	case TARGET_TCP:
+		network = "tcp"
+	case TARGET_UDP:
+		network = "udp"
+	default:
+		return "", "", nil, false
+	}
+	encoded = f.Data[OPEN_NONCE_SIZE+1:]
+	address, _, err := parseSOCKSAddress(encoded)
+	if err != nil {
+		return "", "", nil, false
+	}
+	return network, address, encoded, true
+}
+
+// acceptSOCKS runs the SOCKS5 handshake of a new connection, then starts its stream, or its UDP association
+func (ig *IngressServer) acceptSOCKS(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(SOCKS_HANDSHAKE_TIMEOUT))
+	command, target, err := socksHandshake(conn)
+	if err != nil {
+		log.Lvl2("Ingress server: SOCKS5 handshake failed,", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch command {
+	case socksCmdConnect:
+		if OPEN_NONCE_SIZE+1+len(target) > ig.maxPayloadSize {
+			writeSOCKSReply(conn, socksReplyAddressNotSupported, nil)
+			conn.Close()
+			return
+		}
+		if err := writeSOCKSReply(conn, socksReplySucceeded, nil); err != nil {
+			conn.Close()
+			return
+		}
+		ig.startStream(conn, append([]byte{TARGET_TCP}, target...))
+	case socksCmdUDPAssociate:
+		ig.associateUDP(conn)
+	}
+}
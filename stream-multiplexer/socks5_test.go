@@ -0,0 +1,259 @@
+package stream_multiplexer
+
+import (
+	"bytes"
+	"context"
+	"github.com/armon/go-socks5"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSOCKSAddress(t *testing.T) {
+
+	addresses := map[string][]byte{
+		"127.0.0.1:3001":   encodeSOCKSAddress(net.IPv4(127, 0, 0, 1), 3001),
+		"[::1]:53":         encodeSOCKSAddress(net.IPv6loopback, 53),
+		"example.com:8080": append(append([]byte{socksAddrDomain, 11}, "example.com"...), 0x1f, 0x90),
+	}
+	for expected, encoded := range addresses {
+		address, length, err := parseSOCKSAddress(append(encoded, "data"...))
+		if err != nil || address != expected || length != len(encoded) {
+			t.Error("Wrong address", address, length, err, "expected", expected)
+		}
+		read, err := readSOCKSAddress(bytes.NewReader(append(encoded, "data"...)))
+		if err != nil || !bytes.Equal(read, encoded) {
+			t.Error("Wrong address read", read, err)
+		}
+		if _, _, err := parseSOCKSAddress(encoded[:len(encoded)-1]); err == nil {
+			t.Error("Should not parse a truncated address")
+		}
+	}
+
+	open := newOpenFrame(generateRandomID(), append([]byte{TARGET_UDP}, addresses["[::1]:53"]...))
+	f, _ := ParseFrame(open.ToBytes())
+	network, address, _, ok := f.openTarget()
+	if !ok || network != "udp" || address != "[::1]:53" {
+		t.Error("Wrong destination", network, address, ok)
+	}
+	if _, _, _, ok := newOpenFrame(f.ID, nil).openTarget(); ok {
+		t.Error("This OPEN frame has no destination")
+	}
+}
+
+// starts an ingress terminating SOCKS5 on port 3000, and an egress with the given options
+func startSOCKSIngressAndEgress(t *testing.T, options EgressOptions) (chan bool, chan bool) {
+	up := make(chan []byte)
+	down := make(chan []byte)
+	stopIngress := make(chan bool, 1)
+	stopEgress := make(chan bool, 1)
+
+	ig, err := newIngressServer(MULTIPLEXER_HEADER_SIZE+100, up, down, stopIngress, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ig.socks = true
+	// nobody listens on the egress' server, the destinations come from the clients
+	eg, err := newEgressServer("127.0.0.1:3009", MULTIPLEXER_HEADER_SIZE+100, up, down, stopEgress, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eg.setOptions(options)
+	go ig.listen(3000)
+	go eg.run()
+
+	time.Sleep(2 * time.Second)
+	return stopIngress, stopEgress
+}
+
+// socksRequest connects to the ingress, and sends a SOCKS5 request. Returns the connection and the reply
+func socksRequest(t *testing.T, command byte, target []byte) (net.Conn, byte, []byte) {
+	conn, err := net.Dial("tcp", "127.0.0.1:3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	conn.Write([]byte{socksVersion, 1, socksMethodNoAuth})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != socksMethodNoAuth {
+		t.Fatal("Wrong method", method, err)
+	}
+	conn.Write(append([]byte{socksVersion, command, 0}, target...))
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal("No reply,", err)
+	}
+	bound, err := readSOCKSAddress(conn)
+	if err != nil {
+		t.Fatal("No bound address,", err)
+	}
+	return conn, reply[1], bound
+}
+
+// starts a TCP server on 127.0.0.1:3001 that echoes the whole request, then closes
+func startEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:3001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				request, _ := ioutil.ReadAll(c)
+				c.Write(request)
+				c.Close()
+			}(c)
+		}
+	}()
+	return l
+}
+
+// checks that a CONNECT to the echo server works
+func checkSOCKSConnect(t *testing.T) {
+	conn, reply, _ := socksRequest(t, socksCmdConnect, encodeSOCKSAddress(net.IPv4(127, 0, 0, 1), 3001))
+	if reply != socksReplySucceeded {
+		t.Fatal("The CONNECT failed,", reply)
+	}
+	conn.Write([]byte("hello through SOCKS"))
+	conn.(*net.TCPConn).CloseWrite()
+	answer, err := ioutil.ReadAll(conn)
+	if err != nil || string(answer) != "hello through SOCKS" {
+		t.Error("Wrong answer", string(answer), err)
+	}
+	conn.Close()
+}
+
+func TestSOCKSConnect(t *testing.T) {
+
+	l := startEchoServer(t)
+	defer l.Close()
+	stopIngress, stopEgress := startSOCKSIngressAndEgress(t, EgressOptions{})
+
+	checkSOCKSConnect(t)
+
+	// an unreachable destination closes the connection
+	conn, reply, _ := socksRequest(t, socksCmdConnect, encodeSOCKSAddress(net.IPv4(127, 0, 0, 1), 3002))
+	if reply != socksReplySucceeded {
+		t.Error("The CONNECT is answered before the egress dials", reply)
+	}
+	if n, err := conn.Read(make([]byte, 10)); n != 0 || err == nil {
+		t.Error("The connection should be closed")
+	} else if e, ok := err.(net.Error); ok && e.Timeout() {
+		t.Error("The connection should be closed, not stay open")
+	}
+	conn.Close()
+
+	// BIND is not supported
+	conn, reply, _ = socksRequest(t, 2, encodeSOCKSAddress(net.IPv4(127, 0, 0, 1), 3001))
+	if reply != socksReplyCommandNotSupported {
+		t.Error("BIND should not be supported,", reply)
+	}
+	conn.Close()
+
+	stopIngress <- true
+	stopEgress <- true
+	time.Sleep(2 * time.Second)
+}
+
+func TestSOCKSConnectThroughProxy(t *testing.T) {
+
+	l := startEchoServer(t)
+	defer l.Close()
+
+	// the proxy reports the connections it makes
+	proxied := make(chan string, 1)
+	proxy, err := socks5.New(&socks5.Config{Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		proxied <- address
+		return net.Dial(network, address)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:3002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyListener.Close()
+	go proxy.Serve(proxyListener)
+
+	stopIngress, stopEgress := startSOCKSIngressAndEgress(t, EgressOptions{UpstreamProxy: "127.0.0.1:3002"})
+
+	checkSOCKSConnect(t)
+	select {
+	case address := <-proxied:
+		if address != "127.0.0.1:3001" {
+			t.Error("The proxy connected to", address)
+		}
+	default:
+		t.Error("The egress did not go through the proxy")
+	}
+
+	stopIngress <- true
+	stopEgress <- true
+	time.Sleep(2 * time.Second)
+}
+
+// Tests that DNS-like requests go through a UDP ASSOCIATE
+func TestSOCKSUDPAssociate(t *testing.T) {
+
+	// a stub resolver, which echoes the requests
+	resolver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3003})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, from, err := resolver.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			resolver.WriteToUDP(append([]byte("answer to "), buffer[:n]...), from)
+		}
+	}()
+
+	stopIngress, stopEgress := startSOCKSIngressAndEgress(t, EgressOptions{})
+
+	control, reply, bound := socksRequest(t, socksCmdUDPAssociate, encodeSOCKSAddress(net.IPv4zero, 0))
+	if reply != socksReplySucceeded {
+		t.Fatal("The UDP ASSOCIATE failed,", reply)
+	}
+	relayAddress, _, err := parseSOCKSAddress(bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket, err := net.Dial("udp", relayAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	target := encodeSOCKSAddress(net.IPv4(127, 0, 0, 1), 3003)
+	for _, query := range []string{"query 1", "query 2"} {
+		socket.Write(append(append([]byte{0, 0, 0}, target...), query...))
+
+		socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buffer := make([]byte, 1500)
+		n, err := socket.Read(buffer)
+		if err != nil {
+			t.Fatal("No answer to", query, err)
+		}
+		header := append([]byte{0, 0, 0}, target...)
+		if !bytes.Equal(buffer[:len(header)], header) || string(buffer[len(header):n]) != "answer to "+query {
+			t.Error("Wrong answer", buffer[:n])
+		}
+	}
+	control.Close()
+
+	stopIngress <- true
+	stopEgress <- true
+	time.Sleep(2 * time.Second)
+}
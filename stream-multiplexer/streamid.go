@@ -0,0 +1,57 @@
+package stream_multiplexer
+
+/*
+Stream IDs
+**********
+The relay does not know which client owns a slot, so the streams of all clients share one namespace at the egress,
+and all ingresses see all downstream frames. The IDs are therefore STREAM_ID_SIZE random bytes; each ingress also
+checks that its own streams have different IDs. With 64 bits, the probability that two of n open streams collide is
+about n^2/2^65, e.g. 3*10^-11 for 50'000 streams.
+
+The egress still detects the collisions: the OPEN frame carries a random nonce, so a retransmitted OPEN (same nonce)
+can be told apart from another client opening a stream with the same ID (different nonce). The egress cannot tell the
+frames of the two streams apart then, so it resets the stream, which closes the connection at both ingresses; the
+browsers can retry with new IDs.
+*/
+
+import (
+	"bytes"
+	"crypto/rand"
+)
+
+// STREAM_ID_SIZE is the number of random bytes in a stream ID
+const STREAM_ID_SIZE = 8
+
+// OPEN_NONCE_SIZE is the number of random bytes at the start of an OPEN frame, used to detect colliding stream IDs
+const OPEN_NONCE_SIZE = 8
+
+// generateRandomID returns a new stream ID of STREAM_ID_SIZE random bytes
+func generateRandomID() string {
+	return string(randomBytes(STREAM_ID_SIZE))
+}
+
+// newOpenFrame creates the OPEN frame of a stream, with a new random nonce, and the destination if any (see socks5.go)
+func newOpenFrame(ID string, target []byte) *Frame {
+	return &Frame{ID: ID, Seq: 0, Type: FRAME_OPEN, Data: append(randomBytes(OPEN_NONCE_SIZE), target...)}
+}
+
+// openNonce returns the nonce of an OPEN frame, or nil if it has none
+func (f *Frame) openNonce() []byte {
+	if f.Type != FRAME_OPEN || len(f.Data) < OPEN_NONCE_SIZE {
+		return nil
+	}
+	return f.Data[:OPEN_NONCE_SIZE]
+}
+
+// isCollision tells if an OPEN frame opens another stream than the one opened with nonce
+func (f *Frame) isCollision(nonce []byte) bool {
+	return f.Type == FRAME_OPEN && !bytes.Equal(f.openNonce(), nonce)
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("stream-multiplexer: cannot read randomness, " + err.Error())
+	}
+	return b
+}
@@ -0,0 +1,224 @@
+package stream_multiplexer
+
+import (
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreamIDs(t *testing.T) {
+
+	IDs := make(map[string]bool)
+	for i := 0; i < 100000; i++ {
+		ID := generateRandomID()
+		if len(ID) != STREAM_ID_SIZE {
+			t.Fatal("Wrong ID length", len(ID))
+		}
+		if IDs[ID] {
+			t.Fatal("Generated the same ID twice")
+		}
+		IDs[ID] = true
+	}
+
+	// the ingress gives different IDs to its streams, even when they are accepted concurrently
+	ig, err := newIngressServer(MULTIPLEXER_HEADER_SIZE+20, nil, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5000; i++ {
+		wg.Add(1)
+		go func() {
+			ig.addStream(nil)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if len(ig.activeConnections) != 5000 {
+		t.Error("Some streams share an ID,", len(ig.activeConnections), "IDs for 5000 streams")
+	}
+}
+
+func TestOpenNonce(t *testing.T) {
+
+	f := newOpenFrame(generateRandomID(), nil)
+	f2, err := ParseFrame(f.ToBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f2.openNonce()) != OPEN_NONCE_SIZE {
+		t.Error("The OPEN frame has no nonce")
+	}
+
+	// a retransmission is not a collision
+	if f2.isCollision(f.openNonce()) {
+		t.Error("The same OPEN frame was taken for a collision")
+	}
+	if !newOpenFrame(f.ID, nil).isCollision(f.openNonce()) {
+		t.Error("Another OPEN frame with the same ID is a collision")
+	}
+	if (&Frame{ID: f.ID, Seq: 1, Type: FRAME_DATA}).isCollision(f.openNonce()) {
+		t.Error("Only OPEN frames can collide")
+	}
+}
+
+// Tests that the egress resets a stream that two clients open with the same ID
+func TestEgressRejectsCollision(t *testing.T) {
+
+	serverAddress := "127.0.0.1:3001"
+	l, err := net.Listen("tcp", serverAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	closed := make(chan bool, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		ioutil.ReadAll(c)
+		closed <- true
+	}()
+
+	up := make(chan []byte)
+	down := make(chan []byte, 10)
+	stopEgress := make(chan bool, 1)
+	go StartEgressHandler(serverAddress, MULTIPLEXER_HEADER_SIZE+20, up, down, stopEgress, false)
+
+	ID := generateRandomID()
+	open := newOpenFrame(ID, nil)
+	up <- open.ToBytes()
+	up <- (&Frame{ID: ID, Seq: 1, Type: FRAME_DATA, Data: []byte("hello")}).ToBytes()
+
+	// a retransmission of the OPEN frame is fine
+	up <- open.ToBytes()
+	select {
+	case <-closed:
+		t.Fatal("A retransmitted OPEN frame should not close the stream")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// another client opens a stream with the same ID
+	up <- newOpenFrame(ID, nil).ToBytes()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The connection of the colliding stream was not closed")
+	}
+
+	reset := false
+	for !reset {
+		select {
+		case slice := <-down:
+			f, _ := ParseFrame(slice)
+			reset = f.ID == ID && f.Type == FRAME_RST
+		case <-time.After(2 * time.Second):
+			t.Fatal("The egress did not reset the colliding stream")
+		}
+	}
+
+	// the late frames of both streams are ignored, and a third OPEN is rejected again
+	up <- (&Frame{ID: ID, Seq: 2, Type: FRAME_DATA, Data: []byte("late")}).ToBytes()
+	up <- newOpenFrame(ID, nil).ToBytes()
+	reset = false
+	for !reset {
+		select {
+		case slice := <-down:
+			f, _ := ParseFrame(slice)
+			reset = f.ID == ID && f.Type == FRAME_RST
+		case <-time.After(2 * time.Second):
+			t.Fatal("The egress did not reject the OPEN frame on a closed stream")
+		}
+	}
+	stopEgress <- true
+}
+
+// Tests that thousands of concurrent streams each get their own answer
+func TestManyConcurrentStreams(t *testing.T) {
+
+	nStreams := 2000
+
+	serverAddress := "127.0.0.1:3001"
+	l, err := net.Listen("tcp", serverAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// echoes the whole request, then closes
+			go func(c net.Conn) {
+				request, _ := ioutil.ReadAll(c)
+				c.Write(request)
+				c.Close()
+			}(c)
+		}
+	}()
+
+	ig, eg, stopIngress, stopEgress := startIngressAndEgress(t, serverAddress, MULTIPLEXER_HEADER_SIZE+100)
+
+	var wg sync.WaitGroup
+	errors := make(chan string, nStreams)
+	for i := 0; i < nStreams; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", "127.0.0.1:3000")
+			if err != nil {
+				errors <- err.Error()
+				return
+			}
+			defer conn.Close()
+
+			request := "request number " + strconv.Itoa(i)
+			conn.Write([]byte(request))
+			conn.(*net.TCPConn).CloseWrite()
+
+			conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+			answer, err := ioutil.ReadAll(conn)
+			if err != nil {
+				errors <- err.Error()
+			} else if string(answer) != request {
+				errors <- "stream " + strconv.Itoa(i) + " got " + strconv.Quote(string(answer))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errors)
+
+	nErrors := 0
+	for e := range errors {
+		if nErrors < 10 {
+			t.Error(e)
+		}
+		nErrors++
+	}
+	if nErrors > 0 {
+		t.Error(nErrors, "streams out of", nStreams, "failed")
+	}
+
+	// all streams finished, and are garbage-collected
+	time.Sleep(ACK_DELAY + 2*GARBAGE_COLLECTION_INTERVAL)
+	ig.activeConnectionsLock.Lock()
+	if len(ig.activeConnections) != 0 {
+		t.Error("The ingress still has", len(ig.activeConnections), "streams")
+	}
+	ig.activeConnectionsLock.Unlock()
+	eg.activeConnectionsLock.Lock()
+	if len(eg.activeConnections) != 0 {
+		t.Error("The egress still has", len(eg.activeConnections), "streams")
+	}
+	eg.activeConnectionsLock.Unlock()
+
+	stopIngress <- true
+	stopEgress <- true
+	time.Sleep(2 * time.Second)
+}
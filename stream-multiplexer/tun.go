@@ -0,0 +1,96 @@
+package stream_multiplexer
+
+/*
+TUN mode
+********
+Besides SOCKS5, the client can take the IP packets of a TUN interface, so that all the applications go through PriFi,
+not only the ones that know SOCKS. The packets go through the DC-net in one stream, whose OPEN frame has the
+destination TARGET_IP, one packet per message (the multiplexer fragments them into cells); the egress re-emits them
+with its userspace NAT (see nat.go), and the answers come back the same way.
+
+The interface is created by the client (Linux only), and configured by the operator, e.g.:
+
+	ip addr add 10.8.0.2/24 dev prifi0
+	ip link set prifi0 mtu 1400 up
+	ip route add <relay address> via <current gateway>
+	ip route add default dev prifi0
+
+The MTU must be at most TUN_MTU. Only IPv4 goes through; the other packets are dropped by the client.
+*/
+
+import (
+	"go.dedis.ch/onet/v3/log"
+	"io"
+	"sync"
+)
+
+// tunnel sends the packets of a TUN interface through the DC-net
+type tunnel struct {
+	ig     *IngressServer
+	device io.ReadWriteCloser
+	lock   sync.Mutex
+	stream *messageConn // the stream of the packets, nil until the first packet or after it was closed
+}
+
+// startTunnel opens the TUN interface with the given name
+func (ig *IngressServer) startTunnel(name string) (*tunnel, error) {
+	device, err := openTunDevice(name)
+	if err != nil {
+		return nil, err
+	}
+	t := &tunnel{ig: ig, device: device}
+	go t.serve()
+	log.Lvl2("Ingress server: sending the packets of", name, "through the DC-net")
+	return t, nil
+}
+
+// serve forwards the packets of the interface
+func (t *tunnel) serve() {
+	buffer := make([]byte, 65535)
+	for {
+		n, err := t.device.Read(buffer)
+		if err != nil {
+			return
+		}
+		// only IPv4 goes through, see nat.go
+		if n < ipv4HeaderSize || buffer[0]>>4 != 4 || n > TUN_MTU || n > t.ig.maxPayloadSize*MAX_FRAGMENTS_PER_MESSAGE {
+			continue
+		}
+		packet := make([]byte, n)
+		copy(packet, buffer[:n])
+
+		t.lock.Lock()
+		if t.stream == nil {
+			t.stream = t.newStream()
+			t.ig.startStream(t.stream, []byte{TARGET_IP})
+		}
+		stream := t.stream
+		t.lock.Unlock()
+
+		stream.deliver(packet)
+	}
+}
+
+// newStream creates the connection of the stream of the packets. Must hold the lock
+func (t *tunnel) newStream() *messageConn {
+	var stream *messageConn
+	onClose := func() {
+		t.lock.Lock()
+		if t.stream == stream {
+			t.stream = nil
+		}
+		t.lock.Unlock()
+	}
+	stream = newMessageConn(t.device.Write, onClose, nil, nil)
+	return stream
+}
+
+// close removes the interface
+func (t *tunnel) close() {
+	t.device.Close()
+	t.lock.Lock()
+	if t.stream != nil {
+		t.stream.finish()
+	}
+	t.lock.Unlock()
+}
@@ -0,0 +1,48 @@
+//go:build linux
+// +build linux
+
+package stream_multiplexer
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	tunSetIff = 0x400454ca // TUNSETIFF
+	iffTun    = 0x0001
+	iffNoPi   = 0x1000
+)
+
+// openTunDevice creates the TUN interface with the given name, or attaches to it if it exists
+func openTunDevice(name string) (io.ReadWriteCloser, error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, errors.New("TUN interface name too long: " + name)
+	}
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var request struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(request.name[:], name)
+	request.flags = iffTun | iffNoPi
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIff, uintptr(unsafe.Pointer(&request))); errno != 0 {
+		syscall.Close(fd)
+		return nil, errno
+	}
+
+	// non-blocking, so that the runtime poller can interrupt a Read when we close the device
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
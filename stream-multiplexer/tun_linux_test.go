@@ -0,0 +1,125 @@
+//go:build linux
+// +build linux
+
+package stream_multiplexer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the destination the client of TestTunnel reaches; the egress dials the local host instead
+var tunnelDestination = net.IPv4(198, 51, 100, 1)
+
+// Tests the TUN mode with a client in a network namespace, which has no other network than the tunnel. Needs root
+func TestTunnel(t *testing.T) {
+	if os.Getenv("PRIFI_TUNNEL_CLIENT") != "" {
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("The TUN mode needs root")
+	}
+	ip := func(args ...string) error {
+		out, err := exec.Command("ip", args...).CombinedOutput()
+		if err != nil {
+			return &os.PathError{Op: "ip " + strings.Join(args, " "), Path: string(out), Err: err}
+		}
+		return nil
+	}
+	namespace := "prifitest"
+	if err := ip("netns", "add", namespace); err != nil {
+		t.Skip("Cannot create a network namespace,", err)
+	}
+	defer ip("netns", "del", namespace)
+
+	l := startEchoServer(t)
+	defer l.Close()
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	up := make(chan []byte)
+	down := make(chan []byte)
+	stopIngress := make(chan bool, 1)
+	stopEgress := make(chan bool, 1)
+	ig, err := newIngressServer(MULTIPLEXER_HEADER_SIZE+100, up, down, stopIngress, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ig.tunInterface = "prifitest0"
+	eg, err := newEgressServer("127.0.0.1:3009", MULTIPLEXER_HEADER_SIZE+100, up, down, stopEgress, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eg.dial = func(network, address string) (net.Conn, error) {
+		return net.DialTimeout(network, strings.Replace(address, tunnelDestination.String(), "127.0.0.1", 1), DIAL_TIMEOUT)
+	}
+	go ig.listen(3000)
+	go eg.run()
+	time.Sleep(2 * time.Second)
+	defer func() {
+		stopIngress <- true
+		stopEgress <- true
+		time.Sleep(2 * time.Second)
+	}()
+
+	// the interface stays attached to the ingress when it moves to the namespace
+	for _, args := range [][]string{
+		{"link", "set", "prifitest0", "netns", namespace},
+		{"-n", namespace, "link", "set", "lo", "up"},
+		{"-n", namespace, "addr", "add", "10.8.0.2/24", "dev", "prifitest0"},
+		{"-n", namespace, "link", "set", "prifitest0", "mtu", "1400", "up"},
+		{"-n", namespace, "route", "add", "default", "dev", "prifitest0"},
+	} {
+		if err := ip(args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := exec.Command("ip", "netns", "exec", namespace, os.Args[0], "-test.run=^TestTunnelClient$", "-test.v")
+	client.Env = append(os.Environ(), "PRIFI_TUNNEL_CLIENT=1")
+	out, err := client.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "--- PASS: TestTunnelClient") {
+		t.Error("The client failed,", err, string(out))
+	}
+}
+
+// TestTunnelClient runs in the network namespace of TestTunnel
+func TestTunnelClient(t *testing.T) {
+	if os.Getenv("PRIFI_TUNNEL_CLIENT") == "" {
+		t.Skip("Started by TestTunnel")
+	}
+
+	// several segments each way
+	request := bytes.Repeat([]byte("through the tunnel "), 500)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(tunnelDestination.String(), "3001"), 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(20 * time.Second))
+	conn.Write(request)
+	conn.(*net.TCPConn).CloseWrite()
+	answer, err := ioutil.ReadAll(conn)
+	if err != nil || !bytes.Equal(answer, request) {
+		t.Error("Wrong TCP answer,", len(answer), err)
+	}
+	conn.Close()
+
+	datagrams, err := net.Dial("udp", net.JoinHostPort(tunnelDestination.String(), "3003"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer datagrams.Close()
+	datagrams.SetDeadline(time.Now().Add(10 * time.Second))
+	datagrams.Write([]byte("datagram"))
+	buffer := make([]byte, 100)
+	n, err := datagrams.Read(buffer)
+	if err != nil || string(buffer[:n]) != "datagram" {
+		t.Error("Wrong UDP answer,", string(buffer[:n]), err)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package stream_multiplexer
+
+import (
+	"errors"
+	"io"
+)
+
+// openTunDevice is only implemented on Linux
+func openTunDevice(name string) (io.ReadWriteCloser, error) {
+	return nil, errors.New("the TUN mode needs Linux")
+}
@@ -0,0 +1,136 @@
+package stream_multiplexer
+
+import (
+	"go.dedis.ch/onet/v3/log"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+// udpAssociation relays the datagrams of a SOCKS5 UDP ASSOCIATE. Each destination gets a stream; the association, and
+// its streams, end when the browser closes the TCP connection of the request
+type udpAssociation struct {
+	ig         *IngressServer
+	socket     *net.UDPConn
+	lock       sync.Mutex
+	clientAddr *net.UDPAddr            // where the browser sends from, learnt from its first datagram
+	streams    map[string]*messageConn // by encoded destination
+}
+
+// associateUDP opens the UDP socket of an association, tells the browser where it is, and relays the datagrams until
+// the TCP connection closes
+func (ig *IngressServer) associateUDP(control net.Conn) {
+	defer control.Close()
+
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		log.Error("Ingress server: cannot open a UDP socket,", err)
+		writeSOCKSReply(control, socksReplyGeneralFailure, nil)
+		return
+	}
+	a := &udpAssociation{ig: ig, socket: socket, streams: make(map[string]*messageConn)}
+
+	local := socket.LocalAddr().(*net.UDPAddr)
+	if err := writeSOCKSReply(control, socksReplySucceeded, encodeSOCKSAddress(local.IP, local.Port)); err != nil {
+		socket.Close()
+		return
+	}
+
+	go a.readDatagrams()
+
+	// the association lasts as long as the TCP connection
+	io.Copy(ioutil.Discard, control)
+	a.close()
+}
+
+// readDatagrams takes the datagrams of the browser, and gives each to the stream of its destination
+func (a *udpAssociation) readDatagrams() {
+	buffer := make([]byte, 65536)
+	for {
+		n, from, err := a.socket.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		// [2 reserved] [1 fragment] [address] [data]; we do not reassemble fragmented datagrams
+		if n < 4 || buffer[2] != 0 {
+			continue
+		}
+		_, length, err := parseSOCKSAddress(buffer[3:n])
+		if err != nil {
+			continue
+		}
+		target := string(buffer[3 : 3+length])
+		datagram := make([]byte, n-3-length)
+		copy(datagram, buffer[3+length:n])
+
+		a.lock.Lock()
+		if a.clientAddr == nil {
+			a.clientAddr = from
+		}
+		if !from.IP.Equal(a.clientAddr.IP) || from.Port != a.clientAddr.Port {
+			// only the browser that asked for the association can use it
+			a.lock.Unlock()
+			continue
+		}
+		stream, found := a.streams[target]
+		if !found {
+			if OPEN_NONCE_SIZE+1+len(target) > a.ig.maxPayloadSize {
+				a.lock.Unlock()
+				continue
+			}
+			stream = a.newStream(target)
+			a.streams[target] = stream
+			a.ig.startStream(stream, append([]byte{TARGET_UDP}, target...))
+		}
+		a.lock.Unlock()
+
+		stream.deliver(datagram)
+	}
+}
+
+// newStream creates the connection of the stream to a destination: a Read returns one datagram from the browser, and
+// a Write sends one datagram to it
+func (a *udpAssociation) newStream(target string) *messageConn {
+	var stream *messageConn
+	write := func(datagram []byte) (int, error) {
+		return a.send([]byte(target), datagram)
+	}
+	onClose := func() {
+		a.lock.Lock()
+		if a.streams[target] == stream {
+			delete(a.streams, target)
+		}
+		a.lock.Unlock()
+	}
+	stream = newMessageConn(write, onClose, a.socket.LocalAddr(), nil)
+	return stream
+}
+
+// send gives a datagram of the destination to the browser
+func (a *udpAssociation) send(target []byte, datagram []byte) (int, error) {
+	a.lock.Lock()
+	clientAddr := a.clientAddr
+	a.lock.Unlock()
+
+	header := append([]byte{0, 0, 0}, target...)
+	if _, err := a.socket.WriteToUDP(append(header, datagram...), clientAddr); err != nil {
+		return 0, err
+	}
+	return len(datagram), nil
+}
+
+// close ends the streams of the association
+func (a *udpAssociation) close() {
+	a.socket.Close()
+
+	a.lock.Lock()
+	streams := a.streams
+	a.streams = make(map[string]*messageConn)
+	a.lock.Unlock()
+
+	for _, s := range streams {
+		s.finish()
+	}
+}